@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	// adminTokenEnvVar enables the /admin routes, which require it as a bearer token
+	adminTokenEnvVar = "ADMIN_TOKEN"
+	adminPathPrefix  = "/admin/"
+)
+
+// handleAdmin serves the maintenance routes under /admin/. They are disabled
+// unless ADMIN_TOKEN is set, and require it as a bearer token.
+func handleAdmin(ctx context.Context, request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	token := os.Getenv(adminTokenEnvVar)
+	if token == "" {
+		return createErrorResponse(404, "Admin routes are disabled (ADMIN_TOKEN is not set)")
+	}
+	bearer, ok := strings.CutPrefix(requestHeader(request, "Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		return createErrorResponse(401, "Missing or invalid admin token")
+	}
+
+	supabaseURL := os.Getenv(supabaseURLEnvVar)
+	supabaseServiceKey := os.Getenv(supabaseServiceKeyEnvVar)
+	if supabaseURL == "" || supabaseServiceKey == "" {
+		return createErrorResponse(500, "SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set")
+	}
+	store := processor.NewSupabase(supabaseURL, supabaseServiceKey).WithRequestID(requestIDFrom(ctx)).WithReadKey(os.Getenv(supabaseReadKeyEnvVar))
+
+	method := request.RequestContext.HTTP.Method
+	switch route := strings.TrimPrefix(request.RawPath, adminPathPrefix); {
+	case route == "orphans" && (method == "GET" || method == "DELETE"):
+		return handleOrphans(ctx, store, method == "DELETE")
+	case route == "usage" && method == "GET":
+		return handleUsage(ctx, store, request.QueryStringParameters)
+	default:
+		return createErrorResponse(404, "Unknown admin route")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	// clamdAddressEnvVar points at a clamd daemon: host:port, or the path of its unix socket
+	clamdAddressEnvVar = "CLAMD_ADDRESS"
+	// clamscanPathEnvVar points at a clamscan binary, e.g. /opt/bin/clamscan from a Lambda layer
+	clamscanPathEnvVar = "CLAMSCAN_PATH"
+	// clamscanDatabaseEnvVar is the virus database directory passed to clamscan
+	clamscanDatabaseEnvVar = "CLAMSCAN_DATABASE"
+
+	virusScanTimeout = 2 * time.Minute
+	// clamdChunkSize is the size of the INSTREAM chunks sent to clamd
+	clamdChunkSize = 64 * 1024
+)
+
+// scanResult is the outcome of a virus scan, returned to the caller for infected files
+type scanResult struct {
+	Scanner   string `json:"scanner"`
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// virusScanner checks EPUBs for malware before they are processed
+type virusScanner interface {
+	scan(ctx context.Context, source *processor.Source) (*scanResult, error)
+}
+
+// newVirusScannerFromEnv returns the scanner configured by CLAMD_ADDRESS or
+// CLAMSCAN_PATH, or nil if virus scanning is disabled
+func newVirusScannerFromEnv() virusScanner {
+	if address := os.Getenv(clamdAddressEnvVar); address != "" {
+		network := "tcp"
+		if strings.HasPrefix(address, "/") {
+			network = "unix"
+		}
+		return &clamdScanner{network: network, address: address}
+	}
+	if path := os.Getenv(clamscanPathEnvVar); path != "" {
+		return &clamscanScanner{path: path, database: os.Getenv(clamscanDatabaseEnvVar)}
+	}
+	return nil
+}
+
+// clamdScanner streams the EPUB to a clamd daemon with the INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+}
+
+func (c *clamdScanner) scan(ctx context.Context, source *processor.Source) (*scanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, virusScanTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Each chunk is prefixed with its length; a zero length ends the stream
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("failed to send INSTREAM: %w", err)
+	}
+	reader := source.Reader()
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		n, err := reader.Read(chunk)
+		if n > 0 {
+			if err := binary.Write(conn, binary.BigEndian, uint32(n)); err != nil {
+				return nil, fmt.Errorf("failed to stream EPUB to clamd: %w", err)
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return nil, fmt.Errorf("failed to stream EPUB to clamd: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read EPUB: %w", err)
+		}
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		return nil, fmt.Errorf("failed to stream EPUB to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply reads "stream: OK", "stream: {signature} FOUND" or "... ERROR"
+func parseClamdReply(reply string) (*scanResult, error) {
+	result := &scanResult{Scanner: "clamd"}
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return result, nil
+	case strings.HasSuffix(status, " FOUND"):
+		result.Infected = true
+		result.Signature = strings.TrimSuffix(status, " FOUND")
+		return result, nil
+	default:
+		return nil, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// clamscanScanner runs clamscan on the spooled EPUB
+type clamscanScanner struct {
+	path     string
+	database string
+}
+
+func (c *clamscanScanner) scan(ctx context.Context, source *processor.Source) (*scanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, virusScanTimeout)
+	defer cancel()
+	args := []string{"--no-summary", "--stdout"}
+	if c.database != "" {
+		args = append(args, "--database="+c.database)
+	}
+	args = append(args, source.Path())
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	// clamscan exits with 0 when clean, 1 when a virus is found, and 2 on errors
+	result := &scanResult{Scanner: "clamscan"}
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return result, nil
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		result.Infected = true
+		// Output lines look like "{path}: {signature} FOUND"
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if status, ok := strings.CutPrefix(line, source.Path()+": "); ok && strings.HasSuffix(status, " FOUND") {
+				result.Signature = strings.TrimSuffix(status, " FOUND")
+			}
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("clamscan failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+}
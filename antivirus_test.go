@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// startFakeClamd answers INSTREAM scans, finding a virus in streams containing "EICAR"
+func startFakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			command, _ := reader.ReadString(0)
+			var data bytes.Buffer
+			for command == "zINSTREAM\x00" {
+				var size uint32
+				if binary.Read(reader, binary.BigEndian, &size) != nil || size == 0 {
+					break
+				}
+				io.CopyN(&data, reader, int64(size))
+			}
+			if bytes.Contains(data.Bytes(), []byte("EICAR")) {
+				conn.Write([]byte("stream: Win.Test.EICAR_HDB-1 FOUND\x00"))
+			} else {
+				conn.Write([]byte("stream: OK\x00"))
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestParseClamdReply(t *testing.T) {
+	if result, err := parseClamdReply("stream: OK"); err != nil || result.Infected {
+		t.Errorf("Expected a clean result, got %+v (%v)", result, err)
+	}
+	if result, err := parseClamdReply("stream: Eicar-Signature FOUND"); err != nil || !result.Infected || result.Signature != "Eicar-Signature" {
+		t.Errorf("Expected the signature, got %+v (%v)", result, err)
+	}
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("Expected an error reply to be an error")
+	}
+}
+
+func TestHandler_RejectsInfectedEPUB(t *testing.T) {
+	supabase := setupTestEnv(t)
+	t.Setenv(clamdAddressEnvVar, startFakeClamd(t))
+	supabase.Put(processor.EPUBBucket, "books/clean.epub", testEPUBBytes(t))
+	supabase.Put(processor.EPUBBucket, "books/infected.epub", append(testEPUBBytes(t), []byte("EICAR")...))
+
+	response, _ := handler(context.Background(), postRequest(map[string]interface{}{"filename": "books/infected.epub", "validate_only": true}))
+	if response.StatusCode != 422 {
+		t.Fatalf("Expected status 422, got %d: %s", response.StatusCode, response.Body)
+	}
+	var body struct {
+		Data struct {
+			VirusScan scanResult `json:"virus_scan"`
+		} `json:"data"`
+	}
+	json.Unmarshal([]byte(response.Body), &body)
+	if !body.Data.VirusScan.Infected || body.Data.VirusScan.Signature != "Win.Test.EICAR_HDB-1" {
+		t.Errorf("Expected the scan result, got %+v", body.Data.VirusScan)
+	}
+
+	response, _ = handler(context.Background(), postRequest(map[string]interface{}{"filename": "books/clean.epub", "validate_only": true}))
+	if response.StatusCode != 200 {
+		t.Errorf("Expected a clean EPUB to be processed, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	// An unreachable scanner fails the job instead of letting files through
+	t.Setenv(clamdAddressEnvVar, "127.0.0.1:1")
+	response, _ = handler(context.Background(), postRequest(map[string]interface{}{"filename": "books/clean.epub", "validate_only": true}))
+	if response.StatusCode != 503 {
+		t.Errorf("Expected status 503, got %d", response.StatusCode)
+	}
+}
+
+func TestClamscanScanner(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "clamscan")
+	// Stands in for clamscan: reports the file as infected if it contains EICAR
+	os.WriteFile(script, []byte("#!/bin/sh\nfor f; do :; done\nif grep -q EICAR \"$f\"; then echo \"$f: Eicar-Signature FOUND\"; exit 1; fi\n"), 0o755)
+	scanner := &clamscanScanner{path: script}
+
+	source, err := processor.SpoolEPUB(strings.NewReader("PK EICAR"), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	defer source.Close()
+	result, err := scanner.scan(context.Background(), source)
+	if err != nil || !result.Infected || result.Signature != "Eicar-Signature" {
+		t.Errorf("Expected an infected result, got %+v (%v)", result, err)
+	}
+
+	scanner.path = filepath.Join(dir, "missing")
+	if _, err := scanner.scan(context.Background(), source); err == nil {
+		t.Error("Expected an error when clamscan can't run")
+	}
+}
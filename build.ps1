@@ -15,7 +15,11 @@ function Build-Lambda {
     $env:GOARCH = "arm64"
     $env:CGO_ENABLED = "0"
     
-    go build -tags lambda.norpc -o bootstrap main.go
+    # Build information reported by GET /version
+    $gitCommit = git rev-parse HEAD 2>$null
+    $buildTime = (Get-Date).ToUniversalTime().ToString("yyyy-MM-ddTHH:mm:ssZ")
+    
+    go build -tags lambda.norpc -ldflags "-X main.gitCommit=$gitCommit -X main.buildTime=$buildTime" -o bootstrap .
     if ($LASTEXITCODE -ne 0) {
         Write-Host "Build failed!" -ForegroundColor Red
         exit 1
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	// cdnPurgeProviderEnvVar turns on purging the CDN in front of the storage
+	// after reprocessing: "cloudflare" or "cloudfront"
+	cdnPurgeProviderEnvVar = "CDN_PURGE_PROVIDER"
+	// cdnBaseURLEnvVar is the URL the CDN serves the Supabase project at, e.g.
+	// https://cdn.example.com, if not the Supabase URL itself
+	cdnBaseURLEnvVar = "CDN_BASE_URL"
+
+	cloudflareZoneIDEnvVar   = "CLOUDFLARE_ZONE_ID"
+	cloudflareAPITokenEnvVar = "CLOUDFLARE_API_TOKEN"
+	cloudflareAPIURLEnvVar   = "CLOUDFLARE_API_URL"
+	defaultCloudflareAPIURL  = "https://api.cloudflare.com/client/v4"
+	// cloudflarePurgeBatch is the number of URLs Cloudflare purges per request
+	cloudflarePurgeBatch = 30
+
+	cloudFrontDistributionEnvVar = "CLOUDFRONT_DISTRIBUTION_ID"
+	cloudFrontEndpointEnvVar     = "CLOUDFRONT_ENDPOINT"
+	defaultCloudFrontEndpoint    = "https://cloudfront.amazonaws.com"
+	// cloudFrontMaxPaths is the number of paths CloudFront invalidates per
+	// batch: larger publications are invalidated with a wildcard
+	cloudFrontMaxPaths = 3000
+
+	cdnPurgeTimeout = 10 * time.Second
+)
+
+// cdnPurger purges overwritten outputs from the CDN in front of the storage,
+// so readers see a fixed publication right away rather than when the cached
+// copies expire. It calls the purge API of Cloudflare, or creates CloudFront
+// invalidations signed with the Lambda execution role credentials.
+type cdnPurger struct {
+	provider string
+	baseURL  string
+	// Cloudflare
+	zoneID   string
+	apiToken string
+	apiURL   string
+	// CloudFront
+	distributionID string
+	endpoint       string
+	signer         *v4.Signer
+
+	client *http.Client
+}
+
+// newCDNPurgerFromEnv returns a purger if CDN_PURGE_PROVIDER is set, or nil if
+// purging is disabled. The purger is built once per execution environment (see
+// cachedFromEnv).
+func newCDNPurgerFromEnv() *cdnPurger {
+	return cachedFromEnv("cdn", []string{
+		cdnPurgeProviderEnvVar, cdnBaseURLEnvVar,
+		cloudflareZoneIDEnvVar, cloudflareAPITokenEnvVar, cloudflareAPIURLEnvVar,
+		cloudFrontDistributionEnvVar, cloudFrontEndpointEnvVar,
+	}, buildCDNPurger)
+}
+
+// buildCDNPurger builds the purger configured by the environment
+func buildCDNPurger() *cdnPurger {
+	purger := &cdnPurger{
+		provider: os.Getenv(cdnPurgeProviderEnvVar),
+		baseURL:  strings.TrimSuffix(os.Getenv(cdnBaseURLEnvVar), "/"),
+		client:   processor.NewHTTPClient(cdnPurgeTimeout),
+	}
+	switch purger.provider {
+	case "":
+		return nil
+	case "cloudflare":
+		purger.zoneID = os.Getenv(cloudflareZoneIDEnvVar)
+		purger.apiToken = os.Getenv(cloudflareAPITokenEnvVar)
+		if purger.zoneID == "" || purger.apiToken == "" {
+			log.Printf("Warning: CDN purging disabled: %s and %s must be set", cloudflareZoneIDEnvVar, cloudflareAPITokenEnvVar)
+			return nil
+		}
+		purger.apiURL = strings.TrimSuffix(os.Getenv(cloudflareAPIURLEnvVar), "/")
+		if purger.apiURL == "" {
+			purger.apiURL = defaultCloudflareAPIURL
+		}
+	case "cloudfront":
+		purger.distributionID = os.Getenv(cloudFrontDistributionEnvVar)
+		if purger.distributionID == "" {
+			log.Printf("Warning: CDN purging disabled: %s must be set", cloudFrontDistributionEnvVar)
+			return nil
+		}
+		purger.endpoint = strings.TrimSuffix(os.Getenv(cloudFrontEndpointEnvVar), "/")
+		if purger.endpoint == "" {
+			purger.endpoint = defaultCloudFrontEndpoint
+		}
+		purger.signer = v4.NewSigner()
+	default:
+		log.Printf("Warning: CDN purging disabled: unknown %s %q (expected cloudflare or cloudfront)", cdnPurgeProviderEnvVar, purger.provider)
+		return nil
+	}
+	return purger
+}
+
+// urls returns the URLs the CDN serves the objects stored at paths at
+func (c *cdnPurger) urls(store *processor.Supabase, supabaseURL string, paths []string) []string {
+	supabaseURL = strings.TrimSuffix(supabaseURL, "/")
+	urls := make([]string, len(paths))
+	for i, path := range paths {
+		urls[i] = store.PublicURL(path)
+		if rest, ok := strings.CutPrefix(urls[i], supabaseURL); ok && c.baseURL != "" {
+			urls[i] = c.baseURL + rest
+		}
+	}
+	return urls
+}
+
+// purge removes urls from the CDN. reference identifies the purge, so a
+// retried CloudFront invalidation isn't created twice.
+func (c *cdnPurger) purge(ctx context.Context, reference string, urls []string) error {
+	if c == nil || len(urls) == 0 {
+		return nil
+	}
+	if c.provider == "cloudfront" {
+		return c.invalidateCloudFront(ctx, reference, urls)
+	}
+	for start := 0; start < len(urls); start += cloudflarePurgeBatch {
+		if err := c.purgeCloudflare(ctx, urls[start:min(start+cloudflarePurgeBatch, len(urls))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeCloudflare purges a batch of URLs from the Cloudflare zone
+func (c *cdnPurger) purgeCloudflare(ctx context.Context, urls []string) error {
+	payload, err := json.Marshal(map[string][]string{"files": urls})
+	if err != nil {
+		return fmt.Errorf("failed to marshal purge request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/zones/%s/purge_cache", c.apiURL, url.PathEscape(c.zoneID)), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+
+	bodyBytes, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.Unmarshal(bodyBytes, &result); err != nil || !result.Success {
+		return fmt.Errorf("cloudflare refused the purge: %s", string(bodyBytes))
+	}
+	return nil
+}
+
+// invalidateCloudFront creates an invalidation of the paths of urls in the
+// CloudFront distribution
+func (c *cdnPurger) invalidateCloudFront(ctx context.Context, reference string, urls []string) error {
+	paths := make([]string, 0, len(urls))
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("invalid URL %s: %w", rawURL, err)
+		}
+		paths = append(paths, u.EscapedPath())
+	}
+	if len(paths) > cloudFrontMaxPaths {
+		paths = []string{commonDirectory(paths) + "*"}
+	}
+
+	type invalidationPaths struct {
+		Quantity int      `xml:"Quantity"`
+		Items    []string `xml:"Items>Path"`
+	}
+	payload, err := xml.Marshal(struct {
+		XMLName         xml.Name          `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+		CallerReference string            `xml:"CallerReference"`
+		Paths           invalidationPaths `xml:"Paths"`
+	}{CallerReference: reference, Paths: invalidationPaths{Quantity: len(paths), Items: paths}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal invalidation batch: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/2020-05-31/distribution/%s/invalidation", c.endpoint, url.PathEscape(c.distributionID)), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+
+	credentials := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	payloadHash := sha256.Sum256(payload)
+	// CloudFront is a global service, signed for us-east-1
+	if err := c.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), "cloudfront", "us-east-1", time.Now()); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+	_, err = c.do(req)
+	return err
+}
+
+// do executes a purge request, returning the body of a successful response
+func (c *cdnPurger) do(req *http.Request) ([]byte, error) {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return bodyBytes, nil
+}
+
+// commonDirectory returns the longest directory, ending with a slash, that
+// contains every path
+func commonDirectory(paths []string) string {
+	prefix := paths[0]
+	for _, path := range paths[1:] {
+		for !strings.HasPrefix(path, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestHandler_CDNPurgeCloudflare(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+
+	var mu sync.Mutex
+	var purged []string
+	cloudflare := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zones/zone-1/purge_cache" || r.Header.Get("Authorization") != "Bearer cf-token" {
+			t.Errorf("Unexpected purge request %s %s", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var body struct {
+			Files []string `json:"files"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		purged = append(purged, body.Files...)
+		mu.Unlock()
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer cloudflare.Close()
+	t.Setenv(cdnPurgeProviderEnvVar, "cloudflare")
+	t.Setenv(cdnBaseURLEnvVar, "https://cdn.example.com/")
+	t.Setenv(cloudflareZoneIDEnvVar, "zone-1")
+	t.Setenv(cloudflareAPITokenEnvVar, "cf-token")
+	t.Setenv(cloudflareAPIURLEnvVar, cloudflare.URL)
+
+	request := postRequest(map[string]interface{}{"filename": "books/moby-dick.epub"})
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	if len(purged) != 0 {
+		t.Errorf("Expected nothing purged on the first run, got %v", purged)
+	}
+
+	// A forced run may replace any of the stored files
+	request = postRequest(map[string]interface{}{"filename": "books/moby-dick.epub", "force": true})
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	prefix := "https://cdn.example.com/storage/v1/object/public/" + processor.ManifestBucket + "/books_moby-dick/"
+	for _, u := range purged {
+		if !strings.HasPrefix(u, prefix) {
+			t.Errorf("Expected the CDN URLs of the publication, got %s", u)
+		}
+	}
+	for _, path := range []string{"manifest.json", "OEBPS/chapter1.xhtml", "OEBPS/nav.xhtml"} {
+		if !slices.Contains(purged, prefix+path) {
+			t.Errorf("Expected %s purged, got %v", prefix+path, purged)
+		}
+	}
+}
+
+func TestCDNPurger_CloudFront(t *testing.T) {
+	var body string
+	cloudfront := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/2020-05-31/distribution/E123/invalidation" || !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/cloudfront/") {
+			t.Errorf("Unexpected invalidation request %s %s", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer cloudfront.Close()
+	t.Setenv(cdnPurgeProviderEnvVar, "cloudfront")
+	t.Setenv(cloudFrontDistributionEnvVar, "E123")
+	t.Setenv(cloudFrontEndpointEnvVar, cloudfront.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	purger := newCDNPurgerFromEnv()
+	err := purger.purge(context.Background(), "job-1", []string{"https://cdn.example.com/book/manifest.json", "https://cdn.example.com/book/chapter%201.xhtml"})
+	if err != nil {
+		t.Fatalf("Expected the invalidation created, got %v", err)
+	}
+	for _, want := range []string{"<CallerReference>job-1</CallerReference>", "<Quantity>2</Quantity>", "<Path>/book/manifest.json</Path>", "<Path>/book/chapter%201.xhtml</Path>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in the invalidation batch, got %s", want, body)
+		}
+	}
+
+	if got := commonDirectory([]string{"/book/a/1.xhtml", "/book/a/2.xhtml", "/book/b.css"}); got != "/book/" {
+		t.Errorf("Expected /book/, got %s", got)
+	}
+}
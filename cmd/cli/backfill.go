@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// backfillJobID identifies the backfill in processing locks
+const backfillJobID = "backfill"
+
+// backfillReport is printed when a backfill finishes
+type backfillReport struct {
+	Total     int               `json:"total"`
+	Processed int               `json:"processed"`
+	Skipped   int               `json:"skipped"`
+	Failed    []backfillFailure `json:"failed"`
+}
+
+// backfillFailure is an EPUB the backfill could not process
+type backfillFailure struct {
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// runBackfill processes every EPUB in the epubs bucket of the Supabase project
+// configured by SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY, and prints the
+// report as JSON. It fails if any EPUB failed, once all of them were attempted.
+func runBackfill(optionsJSON string, concurrency int, stdout io.Writer) error {
+	var options processor.Options
+	if optionsJSON != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	if err := options.ApplyProfile(configStore()); err != nil {
+		return err
+	}
+	if err := options.Resolve(); err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("invalid concurrency %d: must be at least 1", concurrency)
+	}
+	supabaseURL := os.Getenv(supabaseURLEnvVar)
+	serviceKey := os.Getenv(supabaseServiceKeyEnvVar)
+	if supabaseURL == "" || serviceKey == "" {
+		return fmt.Errorf("set %s and %s to backfill the epubs bucket", supabaseURLEnvVar, supabaseServiceKeyEnvVar)
+	}
+
+	s3, err := processor.S3ConfigFromEnv()
+	if err != nil {
+		return err
+	}
+	workers, err := processor.SignedUploadsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	store := processor.NewSupabase(supabaseURL, serviceKey).WithReadKey(os.Getenv(supabaseReadKeyEnvVar)).WithS3(s3).WithSignedUploads(workers)
+	report, err := backfill(store, options, concurrency)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d of %d EPUBs failed", len(report.Failed), report.Total)
+	}
+	return nil
+}
+
+// backfill processes the EPUBs (and LPF audiobooks and packaged Web
+// Publications) of the epubs bucket with concurrency workers. Books whose output
+// was processed from the same file, as recorded in the resource index, are
+// skipped unless options.Force is set, so an interrupted backfill can simply be
+// run again. The job tracking of the
+// Lambda is bypassed: backfilled books have no job records.
+func backfill(store *processor.Supabase, options processor.Options, concurrency int) (*backfillReport, error) {
+	objects, err := store.List(processor.EPUBBucket, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", processor.EPUBBucket, err)
+	}
+	var filenames []string
+	for _, object := range objects {
+		if ext := strings.ToLower(path.Ext(object.Path)); ext == ".epub" || ext == ".lpf" || ext == ".webpub" || ext == ".audiobook" {
+			filenames = append(filenames, object.Path)
+		}
+	}
+	log.Printf("Backfilling %d EPUBs with %d workers", len(filenames), concurrency)
+
+	report := &backfillReport{Total: len(filenames), Failed: []backfillFailure{}}
+	var mu sync.Mutex
+	done := 0
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proc := processor.New(store, store)
+			for filename := range work {
+				skipped, err := backfillOne(store, proc, filename, options)
+
+				mu.Lock()
+				done++
+				outcome := "processed"
+				switch {
+				case err != nil:
+					outcome = fmt.Sprintf("failed: %v", err)
+					report.Failed = append(report.Failed, backfillFailure{Filename: filename, Error: err.Error()})
+				case skipped:
+					outcome = "unchanged, skipped"
+					report.Skipped++
+				default:
+					report.Processed++
+				}
+				log.Printf("[%d/%d] %s: %s", done, report.Total, filename, outcome)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, filename := range filenames {
+		work <- filename
+	}
+	close(work)
+	wg.Wait()
+	return report, nil
+}
+
+// backfillOne processes one EPUB of the bucket, unless its output is up to date.
+// It holds the processing lock, so it never races the Lambda on the same book.
+func backfillOne(store *processor.Supabase, proc *processor.Processor, filename string, options processor.Options) (bool, error) {
+	basePath := processor.OutputBasePath(filename, options)
+	// An EPUB whose stored object didn't change isn't even downloaded
+	if !options.Force {
+		if check, err := proc.CheckSource(filename, basePath); err == nil && !check.NeedsProcessing {
+			return true, nil
+		}
+	}
+
+	source, err := store.Fetch(filename, processor.MaxEPUBBytesFromEnv())
+	if err != nil {
+		return false, fmt.Errorf("failed to download EPUB: %w", err)
+	}
+	defer source.Close()
+
+	if !options.Force && proc.SourceHash(basePath) == source.Hash() {
+		return true, nil
+	}
+
+	_, err = proc.WithLock(backfillJobID, 0).Process(source, filename, options)
+	return false, err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestRunBackfill(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	t.Setenv(supabaseURLEnvVar, supabase.URL)
+	t.Setenv(supabaseServiceKeyEnvVar, processortest.ServiceKey)
+
+	var audiobook bytes.Buffer
+	zw := zip.NewWriter(&audiobook)
+	for name, content := range map[string]string{
+		"publication.json": `{"type": "Audiobook", "name": "Leviathan Wakes", "readingOrder": ["chapter1.mp3"]}`,
+		"chapter1.mp3":     "one",
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	supabase.Put(processor.EPUBBucket, "audio/leviathan.lpf", audiobook.Bytes())
+	supabase.Put(processor.EPUBBucket, "books/broken.epub", []byte("not a zip"))
+	supabase.Put(processor.EPUBBucket, "books/notes.txt", []byte("not an EPUB"))
+
+	backfillReportOf := func(stdout *bytes.Buffer) backfillReport {
+		var report backfillReport
+		if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+			t.Fatalf("Expected a JSON report, got %v: %s", err, stdout.String())
+		}
+		return report
+	}
+
+	var stdout bytes.Buffer
+	if err := runBackfill("", 2, &stdout); err == nil {
+		t.Error("Expected the broken EPUB to fail the backfill")
+	}
+	report := backfillReportOf(&stdout)
+	if report.Total != 2 || report.Processed != 1 || len(report.Failed) != 1 || report.Failed[0].Filename != "books/broken.epub" {
+		t.Errorf("Expected the audiobook to be processed and the broken EPUB to fail, got %+v", report)
+	}
+	if _, ok := supabase.Object(processor.ManifestBucket, "audio_leviathan/manifest.json"); !ok {
+		t.Errorf("Expected the audiobook manifest, got %v", supabase.Paths(processor.ManifestBucket))
+	}
+
+	// A second run only retries what is left
+	stdout.Reset()
+	runBackfill("", 2, &stdout)
+	if report := backfillReportOf(&stdout); report.Skipped != 1 || report.Processed != 0 || len(report.Failed) != 1 {
+		t.Errorf("Expected the processed audiobook to be skipped, got %+v", report)
+	}
+
+	if err := runBackfill("", 0, &stdout); err == nil {
+		t.Error("Expected an error for a concurrency of 0")
+	}
+}
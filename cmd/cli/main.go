@@ -0,0 +1,229 @@
+// Command cli runs the processing pipeline on a local EPUB file, without the
+// Lambda or an EPUB in the epubs bucket:
+//
+//	go run ./cmd/cli --out ./out --options '{"validate": true}' book.epub
+//
+// With --out the output is written to that directory, one subdirectory per
+// bucket; otherwise it is uploaded to the Supabase project configured by
+// SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY.
+//
+// With --backfill it processes every EPUB in the epubs bucket of that project
+// instead, skipping those already processed, and prints a report:
+//
+//	go run ./cmd/cli --backfill --concurrency 8 > backfill.json
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/joho/godotenv"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	supabaseURLEnvVar        = "SUPABASE_URL"
+	supabaseServiceKeyEnvVar = "SUPABASE_SERVICE_ROLE_KEY"
+	supabaseReadKeyEnvVar    = "SUPABASE_READ_KEY"
+)
+
+func main() {
+	outDir := flag.String("out", "", "write the output to this directory instead of Supabase")
+	options := flag.String("options", "", "the processing options as JSON, as in the request body")
+	filename := flag.String("filename", "", "the filename the output is stored under (default: the file's base name)")
+	backfillBucket := flag.Bool("backfill", false, "process every EPUB in the epubs bucket not processed yet, instead of a local file")
+	concurrency := flag.Int("concurrency", 4, "the number of EPUBs processed at once with --backfill")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] book.epub\n       %s --backfill [flags]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *backfillBucket && (flag.NArg() != 0 || *outDir != "" || *filename != "") || !*backfillBucket && flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// Load .env for the Supabase configuration, as the Lambda does locally
+	_ = godotenv.Load()
+
+	if *backfillBucket {
+		if err := runBackfill(*options, *concurrency, os.Stdout); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+	if err := run(flag.Arg(0), *filename, *outDir, *options, os.Stdout); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// configStore returns the Supabase project configured by SUPABASE_URL and
+// SUPABASE_SERVICE_ROLE_KEY, which the pipeline config may be stored in, or nil
+func configStore() processor.Uploader {
+	supabaseURL := os.Getenv(supabaseURLEnvVar)
+	serviceKey := os.Getenv(supabaseServiceKeyEnvVar)
+	if supabaseURL == "" || serviceKey == "" {
+		return nil
+	}
+	return processor.NewSupabase(supabaseURL, serviceKey)
+}
+
+// run processes a local EPUB file with the same pipeline as the handler and
+// prints the result as JSON
+func run(epubPath, filename, outDir, optionsJSON string, stdout io.Writer) error {
+	var options processor.Options
+	if optionsJSON != "" {
+		if err := json.Unmarshal([]byte(optionsJSON), &options); err != nil {
+			return fmt.Errorf("invalid options: %w", err)
+		}
+	}
+	if filename == "" {
+		filename = filepath.Base(epubPath)
+	}
+	if err := options.ApplyProfile(configStore()); err != nil {
+		return err
+	}
+	if err := options.Resolve(); err != nil {
+		return err
+	}
+
+	file, err := os.Open(epubPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	source, err := processor.SpoolEPUB(file, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if _, err := source.CheckFormat(epubPath); err != nil {
+		return fmt.Errorf("%s: %w", epubPath, err)
+	}
+
+	var store *processor.Supabase
+	if outDir != "" {
+		storage, err := startLocalStorage(outDir)
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+		store = processor.NewSupabase(storage.url, "local")
+	} else {
+		supabaseURL := os.Getenv(supabaseURLEnvVar)
+		serviceKey := os.Getenv(supabaseServiceKeyEnvVar)
+		if supabaseURL == "" || serviceKey == "" {
+			return fmt.Errorf("set --out, or %s and %s to upload to Supabase", supabaseURLEnvVar, supabaseServiceKeyEnvVar)
+		}
+		// The local storage only speaks the REST endpoints
+		s3, err := processor.S3ConfigFromEnv()
+		if err != nil {
+			return err
+		}
+		workers, err := processor.SignedUploadsFromEnv()
+		if err != nil {
+			return err
+		}
+		store = processor.NewSupabase(supabaseURL, serviceKey).WithS3(s3).WithSignedUploads(workers)
+	}
+
+	result, err := processor.New(store, store).Process(source, filename, options)
+	if err != nil {
+		return err
+	}
+	data := result.ResponseData(options)
+	data["filename"] = filename
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// localStorage serves the subset of the Supabase Storage API the pipeline uses
+// from a local directory, so the CLI can write its output to disk
+type localStorage struct {
+	dir      string
+	url      string
+	listener net.Listener
+}
+
+// startLocalStorage serves dir on a free localhost port
+func startLocalStorage(dir string) (*localStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start local storage: %w", err)
+	}
+	s := &localStorage{dir: dir, url: "http://" + listener.Addr().String(), listener: listener}
+	go http.Serve(listener, s)
+	return s, nil
+}
+
+// Close stops serving
+func (s *localStorage) Close() error {
+	return s.listener.Close()
+}
+
+// ServeHTTP handles object uploads, downloads and deletes:
+// {POST,GET,DELETE} /storage/v1/object[/public]/{bucket}/{path}
+func (s *localStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	objectPath, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/object/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	objectPath = strings.TrimPrefix(objectPath, "public/")
+	cleaned := path.Clean("/" + objectPath)
+	if cleaned != "/"+objectPath || cleaned == "/" {
+		http.Error(w, "invalid object path", http.StatusBadRequest)
+		return
+	}
+	filePath := filepath.Join(s.dir, filepath.FromSlash(cleaned))
+
+	switch r.Method {
+	case "POST", "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(filePath), 0o755)
+		}
+		if err == nil {
+			err = os.WriteFile(filePath, data, 0o644)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "GET", "HEAD":
+		data, err := os.ReadFile(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	case "DELETE":
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
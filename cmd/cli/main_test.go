@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := startLocalStorage(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer storage.Close()
+
+	do := func(method, objectPath, body string) (int, string) {
+		req, err := http.NewRequest(method, storage.url+objectPath, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	objectPath := "/storage/v1/object/" + processor.ManifestBucket + "/book/OEBPS/chapter1.xhtml"
+	if status, _ := do("POST", objectPath, "<html/>"); status != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d", status)
+	}
+	written, err := os.ReadFile(filepath.Join(dir, processor.ManifestBucket, "book", "OEBPS", "chapter1.xhtml"))
+	if err != nil || string(written) != "<html/>" {
+		t.Errorf("Expected the object on disk, got %q (%v)", written, err)
+	}
+
+	publicPath := "/storage/v1/object/public/" + processor.ManifestBucket + "/book/OEBPS/chapter1.xhtml"
+	if status, body := do("GET", publicPath, ""); status != http.StatusOK || body != "<html/>" {
+		t.Errorf("Expected to download the object, got %d %q", status, body)
+	}
+	if status, _ := do("DELETE", objectPath, ""); status != http.StatusOK {
+		t.Fatalf("Expected delete to succeed, got %d", status)
+	}
+	if status, _ := do("GET", objectPath, ""); status != http.StatusNotFound {
+		t.Errorf("Expected the deleted object to be gone, got %d", status)
+	}
+	if status, _ := do("POST", "/storage/v1/object/"+processor.ManifestBucket+"/a/../../escape.txt", "x"); status != http.StatusBadRequest {
+		t.Errorf("Expected paths outside the directory to be refused, got %d", status)
+	}
+}
+
+func TestRun_ValidateOnly(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	w.Write([]byte("application/epub+zip"))
+	zw.Close()
+	epubPath := filepath.Join(dir, "book.epub")
+	if err := os.WriteFile(epubPath, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("Failed to write EPUB: %v", err)
+	}
+
+	var stdout bytes.Buffer
+	if err := run(epubPath, "", filepath.Join(dir, "out"), `{"validate_only": true}`, &stdout); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var data struct {
+		Filename   string                      `json:"filename"`
+		Validation *processor.ValidationReport `json:"validation"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &data); err != nil {
+		t.Fatalf("Expected JSON output, got %v: %s", err, stdout.String())
+	}
+	if data.Filename != "book.epub" || data.Validation == nil || data.Validation.Valid {
+		t.Errorf("Expected an invalid report for book.epub, got %+v", data)
+	}
+
+	if err := run(epubPath, "", dir, `{"layout": "nested"}`, &stdout); err == nil {
+		t.Error("Expected an error for invalid options")
+	}
+	notEPUB := filepath.Join(dir, "notes.txt")
+	os.WriteFile(notEPUB, []byte("hello"), 0o644)
+	if err := run(notEPUB, "", dir, "", &stdout); err == nil {
+		t.Error("Expected an error for a file that isn't an EPUB")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// corsOriginsEnvVar lists the origins allowed to call the endpoint from a
+	// browser, comma separated, or "*" for any origin. Unset disables CORS.
+	corsOriginsEnvVar = "CORS_ALLOWED_ORIGINS"
+	corsMethodsEnvVar = "CORS_ALLOWED_METHODS"
+	corsHeadersEnvVar = "CORS_ALLOWED_HEADERS"
+	corsMaxAgeEnvVar  = "CORS_MAX_AGE"
+
+	defaultCORSMethods = "GET, POST, OPTIONS"
+	defaultCORSHeaders = "Content-Type, Authorization, If-None-Match, If-Modified-Since, X-Request-ID, X-Tenant-ID, X-Api-Key"
+	defaultCORSMaxAge  = 600
+)
+
+// corsConfig holds the CORS policy applied to every response
+type corsConfig struct {
+	origins []string
+	methods string
+	headers string
+	maxAge  uint64
+}
+
+// corsConfigFromEnv reads the CORS policy from the environment
+func corsConfigFromEnv() corsConfig {
+	config := corsConfig{
+		methods: defaultCORSMethods,
+		headers: defaultCORSHeaders,
+		maxAge:  defaultCORSMaxAge,
+	}
+	for _, origin := range strings.Split(os.Getenv(corsOriginsEnvVar), ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			config.origins = append(config.origins, origin)
+		}
+	}
+	if methods := strings.TrimSpace(os.Getenv(corsMethodsEnvVar)); methods != "" {
+		config.methods = methods
+	}
+	if headers := strings.TrimSpace(os.Getenv(corsHeadersEnvVar)); headers != "" {
+		config.headers = headers
+	}
+	if v := os.Getenv(corsMaxAgeEnvVar); v != "" {
+		maxAge, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid %s=%q", corsMaxAgeEnvVar, v)
+		} else {
+			config.maxAge = maxAge
+		}
+	}
+	return config
+}
+
+// enabled reports whether any origin is allowed
+func (c corsConfig) enabled() bool {
+	return len(c.origins) > 0
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// origin, or "" when the origin is not allowed
+func (c corsConfig) allowOrigin(origin string) string {
+	for _, allowed := range c.origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// apply adds the CORS headers for the request's origin to a response
+func (c corsConfig) apply(request events.LambdaFunctionURLRequest, response events.LambdaFunctionURLResponse) events.LambdaFunctionURLResponse {
+	if !c.enabled() {
+		return response
+	}
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	// The allowed origin depends on the request, so caches must key on it
+	response.Headers["Vary"] = "Origin"
+	// Let browser callers read the request ID to quote it in bug reports, and
+	// the ETag and Last-Modified of a manifest or EPUB to send them back in
+	// conditional requests
+	response.Headers["Access-Control-Expose-Headers"] = requestIDHeader + ", ETag, Last-Modified"
+	if origin := c.allowOrigin(requestHeader(request, "Origin")); origin != "" {
+		response.Headers["Access-Control-Allow-Origin"] = origin
+	}
+	return response
+}
+
+// preflight answers an OPTIONS preflight request
+func (c corsConfig) preflight(request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	if c.allowOrigin(requestHeader(request, "Origin")) == "" {
+		return c.apply(request, createErrorResponse(403, "Origin not allowed"))
+	}
+	return c.apply(request, events.LambdaFunctionURLResponse{
+		StatusCode: 204,
+		Headers: map[string]string{
+			"Access-Control-Allow-Methods": c.methods,
+			"Access-Control-Allow-Headers": c.headers,
+			"Access-Control-Max-Age":       strconv.FormatUint(c.maxAge, 10),
+		},
+	})
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func corsRequest(method, origin string) events.LambdaFunctionURLRequest {
+	return events.LambdaFunctionURLRequest{
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: method, Path: "/"},
+		},
+		RawPath: "/",
+		Headers: map[string]string{"origin": origin},
+	}
+}
+
+func TestHandler_CORSPreflight(t *testing.T) {
+	t.Setenv(corsOriginsEnvVar, "https://admin.example.com, https://staging.example.com/")
+	t.Setenv(corsMaxAgeEnvVar, "3600")
+
+	response, err := handler(context.Background(), corsRequest("OPTIONS", "https://staging.example.com"))
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 204 {
+		t.Errorf("Expected status 204, got %d", response.StatusCode)
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://staging.example.com",
+		"Access-Control-Allow-Methods": defaultCORSMethods,
+		"Access-Control-Max-Age":       "3600",
+		"Vary":                         "Origin",
+	}
+	for name, value := range expected {
+		if response.Headers[name] != value {
+			t.Errorf("Expected %s: %q, got %q", name, value, response.Headers[name])
+		}
+	}
+	// Browsers may send the request ID the responses echo, and the tenant headers
+	for _, header := range []string{"X-Request-ID", "X-Tenant-ID", "X-Api-Key"} {
+		if allowed := response.Headers["Access-Control-Allow-Headers"]; !strings.Contains(allowed, header) {
+			t.Errorf("Expected %s to be allowed, got %q", header, allowed)
+		}
+	}
+
+	response, _ = handler(context.Background(), corsRequest("OPTIONS", "https://evil.example.com"))
+	if response.StatusCode != 403 || response.Headers["Access-Control-Allow-Origin"] != "" {
+		t.Errorf("Expected a disallowed origin to be refused, got %d %v", response.StatusCode, response.Headers)
+	}
+}
+
+func TestHandler_CORSHeadersOnResponses(t *testing.T) {
+	t.Setenv(corsOriginsEnvVar, "*")
+	response, _ := handler(context.Background(), corsRequest("PUT", "https://anywhere.example.com"))
+	if response.StatusCode != 405 || response.Headers["Access-Control-Allow-Origin"] != "*" {
+		t.Errorf("Expected error responses to carry CORS headers, got %d %v", response.StatusCode, response.Headers)
+	}
+	if response.Headers["Content-Type"] != "application/json" {
+		t.Errorf("Expected the existing headers to be kept, got %v", response.Headers)
+	}
+
+	t.Setenv(corsOriginsEnvVar, "")
+	response, _ = handler(context.Background(), corsRequest("OPTIONS", "https://anywhere.example.com"))
+	if response.StatusCode != 405 || response.Headers["Vary"] != "" {
+		t.Errorf("Expected CORS to be off without allowed origins, got %d %v", response.StatusCode, response.Headers)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// sweepJobID identifies the expiry sweep in processing locks
+const sweepJobID = "expiry-sweep"
+
+// expirySweep is the outcome of a sweep
+type expirySweep struct {
+	Deleted        []string `json:"deleted"`
+	Skipped        []string `json:"skipped"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// sweepExpired deletes the outputs of the publications whose TTL elapsed before
+// now, then their publication items. Publications being processed are skipped
+// and left to a later sweep; if the job replaces them with a permanent output,
+// the expiry is gone by then.
+func sweepExpired(ctx context.Context, store *processor.Supabase, jobs *jobStore, now time.Time) (*expirySweep, error) {
+	expired, err := jobs.expiredPublications(ctx, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired publications: %w", err)
+	}
+
+	sweep := &expirySweep{Deleted: []string{}, Skipped: []string{}}
+	proc := processor.New(store, store)
+	for _, publication := range expired {
+		deleted, bytes, err := deleteExpired(ctx, store, proc, jobs, publication, now)
+		if err != nil {
+			return sweep, fmt.Errorf("failed to delete %s: %w", publication.BasePath, err)
+		}
+		if !deleted {
+			sweep.Skipped = append(sweep.Skipped, publication.BasePath)
+			continue
+		}
+		sweep.Deleted = append(sweep.Deleted, publication.BasePath)
+		sweep.ReclaimedBytes += bytes
+	}
+	return sweep, nil
+}
+
+// deleteExpired deletes one expired publication while holding its processing
+// lock. Returns false if the publication is locked, or was reprocessed since the
+// scan.
+func deleteExpired(ctx context.Context, store *processor.Supabase, proc *processor.Processor, jobs *jobStore, publication *jobRecord, now time.Time) (bool, int64, error) {
+	// Listed before locking, so the lock itself is released rather than deleted
+	publications, err := publicationsUnder(store, publication.BasePath)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if err := proc.AcquireLock(publication.BasePath, sweepJobID, publication.Filename, 0); err != nil {
+		var held *processor.LockHeldError
+		if errors.As(err, &held) {
+			log.Printf("Skipping expired publication %s, locked by job %s", publication.BasePath, held.Holder.JobID)
+			return false, 0, nil
+		}
+		return false, 0, err
+	}
+	defer proc.ReleaseLock(publication.BasePath, sweepJobID)
+
+	latest, err := jobs.latestForPublication(ctx, publication.Tenant, publication.BasePath)
+	if err != nil {
+		return false, 0, err
+	}
+	if latest == nil || latest.ID != publication.ID || latest.ExpiresAt == nil || latest.ExpiresAt.After(now) {
+		log.Printf("Skipping expired publication %s, reprocessed since", publication.BasePath)
+		return false, 0, nil
+	}
+
+	var bytes int64
+	if output, ok := publications[publication.BasePath]; ok {
+		log.Printf("Deleting expired publication %s (%d files, %d bytes, expired %s)", publication.BasePath, output.Files, output.Bytes, publication.ExpiresAt.Format(time.RFC3339))
+		if err := store.DeleteObjects(processor.ManifestBucket, output.paths); err != nil {
+			return false, 0, err
+		}
+		bytes = output.Bytes
+	}
+	if err := jobs.forgetPublication(ctx, publication); err != nil {
+		return false, 0, fmt.Errorf("failed to delete publication record: %w", err)
+	}
+	return true, bytes, nil
+}
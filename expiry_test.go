@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// fakeJobsTable serves the DynamoDB operations used by the expiry sweep from a
+// map of items. Scan applies the sweep's filter; conditions are not checked.
+type fakeJobsTable struct {
+	mu    sync.Mutex
+	items map[string]map[string]events.DynamoDBAttributeValue
+}
+
+func (f *fakeJobsTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Key                       map[string]events.DynamoDBAttributeValue `json:"Key"`
+		Item                      map[string]events.DynamoDBAttributeValue `json:"Item"`
+		ExpressionAttributeValues map[string]events.DynamoDBAttributeValue `json:"ExpressionAttributeValues"`
+	}
+	json.NewDecoder(r.Body).Decode(&input)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out interface{} = struct{}{}
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "GetItem":
+		if item, ok := f.items[itemString(input.Key, "id")]; ok {
+			out = map[string]interface{}{"Item": item}
+		}
+	case "PutItem":
+		f.items[itemString(input.Item, "id")] = input.Item
+	case "DeleteItem":
+		delete(f.items, itemString(input.Key, "id"))
+	case "Scan":
+		now, _ := strconv.ParseInt(input.ExpressionAttributeValues[":now"].Number(), 10, 64)
+		items := []map[string]events.DynamoDBAttributeValue{}
+		for id, item := range f.items {
+			if job := jobFromItem(item); strings.HasPrefix(id, publicationKeyPrefix) && job.ExpiresAt != nil && job.ExpiresAt.Unix() <= now {
+				items = append(items, item)
+			}
+		}
+		out = map[string]interface{}{"Items": items}
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// put stores the publication item of a job
+func (f *fakeJobsTable) put(job *jobRecord) {
+	item := job.toItem()
+	item["id"] = events.NewStringAttribute(publicationKeyPrefix + job.BasePath)
+	item["job_id"] = events.NewStringAttribute(job.ID)
+	f.items[itemString(item, "id")] = item
+}
+
+func TestInvoke_ScheduledEventSweepsExpiredPublications(t *testing.T) {
+	supabase := setupTestEnv(t)
+	table := &fakeJobsTable{items: map[string]map[string]events.DynamoDBAttributeValue{}}
+	server := httptest.NewServer(table)
+	defer server.Close()
+	t.Setenv(jobsTableEnvVar, "jobs")
+	t.Setenv("DYNAMODB_ENDPOINT", server.URL)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	for _, job := range []*jobRecord{
+		{ID: "job-temp", BasePath: "books_temp", Status: jobStatusSucceeded, ExpiresAt: &past},
+		{ID: "job-busy", BasePath: "books_busy", Status: jobStatusSucceeded, ExpiresAt: &past},
+		{ID: "job-later", BasePath: "books_later", Status: jobStatusSucceeded, ExpiresAt: &future},
+		{ID: "job-kept", BasePath: "books_kept", Status: jobStatusSucceeded},
+	} {
+		table.put(job)
+		supabase.Put(processor.ManifestBucket, job.BasePath+"/manifest.json", []byte("{}"))
+		supabase.Put(processor.ManifestBucket, job.BasePath+"/"+processor.IndexPath, []byte("{}"))
+	}
+	// books_busy is being reprocessed
+	supabase.Put(processor.ManifestBucket, "books_busy/readium/lock.json", []byte(`{"job_id": "job-next", "acquired_at": "`+time.Now().UTC().Format(time.RFC3339)+`"}`))
+
+	result, err := invoke(context.Background(), json.RawMessage(`{"version": "0", "source": "aws.events", "detail-type": "Scheduled Event", "detail": {}}`))
+	if err != nil {
+		t.Fatalf("Expected the sweep to succeed, got %v", err)
+	}
+	sweep := result.(map[string]interface{})["result"].(*expirySweep)
+	if len(sweep.Deleted) != 1 || sweep.Deleted[0] != "books_temp" || sweep.ReclaimedBytes != 4 {
+		t.Errorf("Expected books_temp to be deleted, got %+v", sweep)
+	}
+	if len(sweep.Skipped) != 1 || sweep.Skipped[0] != "books_busy" {
+		t.Errorf("Expected the locked publication to be skipped, got %+v", sweep)
+	}
+
+	for _, path := range supabase.Paths(processor.ManifestBucket) {
+		if strings.HasPrefix(path, "books_temp/") {
+			t.Errorf("Expected %s to be deleted", path)
+		}
+	}
+	for _, basePath := range []string{"books_busy", "books_later", "books_kept"} {
+		if _, ok := supabase.Object(processor.ManifestBucket, basePath+"/manifest.json"); !ok {
+			t.Errorf("Expected %s to be kept", basePath)
+		}
+	}
+	if _, ok := table.items[publicationKeyPrefix+"books_temp"]; ok {
+		t.Error("Expected the publication record of books_temp to be deleted")
+	}
+}
+
+func TestHandler_TTLRequiresJobTracking(t *testing.T) {
+	setupTestEnv(t)
+
+	response, _ := handler(context.Background(), postRequest(map[string]interface{}{"filename": "a.epub", "ttl_seconds": 3600}))
+	if response.StatusCode != 400 || !strings.Contains(response.Body, "JOBS_TABLE_NAME") {
+		t.Errorf("Expected 400 without job tracking, got %d: %s", response.StatusCode, response.Body)
+	}
+	response, _ = handler(context.Background(), postRequest(map[string]interface{}{"filename": "a.epub", "ttl_seconds": -1}))
+	if response.StatusCode != 400 {
+		t.Errorf("Expected 400 for a negative TTL, got %d: %s", response.StatusCode, response.Body)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// eventSource is the service that invoked the function. Every source is
+// normalized to a Function URL request, and the response is converted back.
+type eventSource int
+
+const (
+	sourceFunctionURL eventSource = iota
+	sourceAPIGatewayREST
+	sourceAPIGatewayHTTP
+	sourceALB
+)
+
+// eventProbe holds the fields that tell the event formats apart
+type eventProbe struct {
+	Version        string `json:"version"`
+	HTTPMethod     string `json:"httpMethod"`
+	RequestContext struct {
+		ELB        json.RawMessage `json:"elb"`
+		DomainName string          `json:"domainName"`
+	} `json:"requestContext"`
+}
+
+// normalizedEvent is an invocation event converted to a Function URL request
+type normalizedEvent struct {
+	request events.LambdaFunctionURLRequest
+	source  eventSource
+	// multiValue is set for ALB target groups with multi-value headers enabled,
+	// which must be answered with multi-value headers
+	multiValue bool
+}
+
+// invoke is the Lambda entry point: it accepts Function URL, API Gateway (REST
+// and HTTP API) and ALB events, so the function can sit behind an existing
+// gateway and its authorizers. EventBridge scheduled events run a maintenance
+// task instead (see maintenanceTaskOf).
+func invoke(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	if task, ok := maintenanceTaskOf(raw); ok {
+		return handleMaintenance(ctx, task)
+	}
+	event, err := normalizeEvent(raw)
+	if err != nil {
+		return nil, err
+	}
+	response, err := handler(ctx, event.request)
+	if err != nil {
+		return nil, err
+	}
+	return formatResponse(response, event), nil
+}
+
+// normalizeEvent detects the event format and converts it to a Function URL request
+func normalizeEvent(raw json.RawMessage) (*normalizedEvent, error) {
+	var probe eventProbe
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+
+	switch {
+	case len(probe.RequestContext.ELB) > 0:
+		var alb events.ALBTargetGroupRequest
+		if err := json.Unmarshal(raw, &alb); err != nil {
+			return nil, fmt.Errorf("failed to parse ALB event: %w", err)
+		}
+		// ALB passes query parameters as received, still percent-encoded
+		query := mergeMultiValue(alb.QueryStringParameters, alb.MultiValueQueryStringParameters)
+		for name, value := range query {
+			if decoded, err := url.QueryUnescape(value); err == nil {
+				query[name] = decoded
+			}
+		}
+		return &normalizedEvent{
+			request:    httpRequest(alb.HTTPMethod, alb.Path, mergeMultiValue(alb.Headers, alb.MultiValueHeaders), query, alb.Body, alb.IsBase64Encoded),
+			source:     sourceALB,
+			multiValue: len(alb.MultiValueHeaders) > 0 && len(alb.Headers) == 0,
+		}, nil
+
+	case probe.HTTPMethod != "":
+		// REST APIs, and HTTP APIs using the 1.0 payload format
+		var proxy events.APIGatewayProxyRequest
+		if err := json.Unmarshal(raw, &proxy); err != nil {
+			return nil, fmt.Errorf("failed to parse API Gateway event: %w", err)
+		}
+		request := httpRequest(proxy.HTTPMethod, proxy.Path,
+			mergeMultiValue(proxy.Headers, proxy.MultiValueHeaders),
+			mergeMultiValue(proxy.QueryStringParameters, proxy.MultiValueQueryStringParameters),
+			proxy.Body, proxy.IsBase64Encoded)
+		request.RequestContext.RequestID = proxy.RequestContext.RequestID
+		request.RequestContext.HTTP.SourceIP = proxy.RequestContext.Identity.SourceIP
+		return &normalizedEvent{request: request, source: sourceAPIGatewayREST}, nil
+
+	case probe.Version == "2.0" && !strings.Contains(probe.RequestContext.DomainName, ".lambda-url."):
+		var httpAPI events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(raw, &httpAPI); err != nil {
+			return nil, fmt.Errorf("failed to parse API Gateway event: %w", err)
+		}
+		// Named stages prefix the path: /prod/health
+		path := httpAPI.RawPath
+		if stage := httpAPI.RequestContext.Stage; stage != "" && stage != "$default" {
+			path = strings.TrimPrefix(path, "/"+stage)
+		}
+		request := httpRequest(httpAPI.RequestContext.HTTP.Method, path, httpAPI.Headers, httpAPI.QueryStringParameters, httpAPI.Body, httpAPI.IsBase64Encoded)
+		request.RawQueryString = httpAPI.RawQueryString
+		request.Cookies = httpAPI.Cookies
+		request.RequestContext.RequestID = httpAPI.RequestContext.RequestID
+		request.RequestContext.HTTP.SourceIP = httpAPI.RequestContext.HTTP.SourceIP
+		return &normalizedEvent{request: request, source: sourceAPIGatewayHTTP}, nil
+
+	default:
+		var request events.LambdaFunctionURLRequest
+		if err := json.Unmarshal(raw, &request); err != nil {
+			return nil, fmt.Errorf("failed to parse Function URL event: %w", err)
+		}
+		return &normalizedEvent{request: request, source: sourceFunctionURL}, nil
+	}
+}
+
+// httpRequest builds a Function URL request from the common parts of an HTTP event
+func httpRequest(method, path string, headers, query map[string]string, body string, isBase64Encoded bool) events.LambdaFunctionURLRequest {
+	if path == "" {
+		path = "/"
+	}
+	values := url.Values{}
+	for name, value := range query {
+		values.Set(name, value)
+	}
+	return events.LambdaFunctionURLRequest{
+		Version:               "2.0",
+		RawPath:               path,
+		RawQueryString:        values.Encode(),
+		Headers:               headers,
+		QueryStringParameters: query,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method: strings.ToUpper(method),
+				Path:   path,
+			},
+		},
+		Body:            body,
+		IsBase64Encoded: isBase64Encoded,
+	}
+}
+
+// mergeMultiValue flattens multi-value headers or parameters into single values,
+// keeping the last one as API Gateway does
+func mergeMultiValue(single map[string]string, multi map[string][]string) map[string]string {
+	merged := make(map[string]string, len(single)+len(multi))
+	for name, values := range multi {
+		if len(values) > 0 {
+			merged[name] = values[len(values)-1]
+		}
+	}
+	for name, value := range single {
+		merged[name] = value
+	}
+	return merged
+}
+
+// formatResponse converts a Function URL response to the format of the event source
+func formatResponse(response events.LambdaFunctionURLResponse, event *normalizedEvent) interface{} {
+	switch event.source {
+	case sourceAPIGatewayREST:
+		return events.APIGatewayProxyResponse{
+			StatusCode:      response.StatusCode,
+			Headers:         response.Headers,
+			Body:            response.Body,
+			IsBase64Encoded: response.IsBase64Encoded,
+		}
+	case sourceAPIGatewayHTTP:
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode:      response.StatusCode,
+			Headers:         response.Headers,
+			Body:            response.Body,
+			IsBase64Encoded: response.IsBase64Encoded,
+			Cookies:         response.Cookies,
+		}
+	case sourceALB:
+		alb := events.ALBTargetGroupResponse{
+			StatusCode:        response.StatusCode,
+			StatusDescription: fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+			Body:              response.Body,
+			IsBase64Encoded:   response.IsBase64Encoded,
+		}
+		if event.multiValue {
+			alb.MultiValueHeaders = map[string][]string{}
+			for name, value := range response.Headers {
+				alb.MultiValueHeaders[name] = []string{value}
+			}
+		} else {
+			alb.Headers = response.Headers
+		}
+		return alb
+	default:
+		return response
+	}
+}
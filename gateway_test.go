@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestNormalizeEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  string
+		source eventSource
+		method string
+		path   string
+		query  string
+	}{
+		{
+			name:   "function URL",
+			event:  `{"version": "2.0", "rawPath": "/jobs/1", "requestContext": {"domainName": "abc.lambda-url.eu-west-1.on.aws", "http": {"method": "GET", "path": "/jobs/1"}}}`,
+			source: sourceFunctionURL, method: "GET", path: "/jobs/1",
+		},
+		{
+			name:   "HTTP API with a named stage",
+			event:  `{"version": "2.0", "rawPath": "/prod/health", "queryStringParameters": {"filename": "a.epub"}, "requestContext": {"stage": "prod", "domainName": "abc.execute-api.eu-west-1.amazonaws.com", "http": {"method": "GET", "path": "/prod/health"}}}`,
+			source: sourceAPIGatewayHTTP, method: "GET", path: "/health", query: "a.epub",
+		},
+		{
+			name:   "REST API",
+			event:  `{"resource": "/{proxy+}", "path": "/version", "httpMethod": "GET", "headers": {"Origin": "https://admin.example.com"}, "multiValueQueryStringParameters": {"filename": ["x.epub", "a.epub"]}, "requestContext": {"stage": "prod", "identity": {"sourceIp": "10.0.0.1"}}}`,
+			source: sourceAPIGatewayREST, method: "GET", path: "/version", query: "a.epub",
+		},
+		{
+			name:   "ALB",
+			event:  `{"httpMethod": "POST", "path": "/", "queryStringParameters": {"filename": "my%20book.epub"}, "headers": {"content-type": "application/json"}, "body": "{}", "requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:tg"}}}`,
+			source: sourceALB, method: "POST", path: "/", query: "my book.epub",
+		},
+	}
+	for _, tt := range tests {
+		event, err := normalizeEvent(json.RawMessage(tt.event))
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", tt.name, err)
+		}
+		request := event.request
+		if event.source != tt.source || request.RequestContext.HTTP.Method != tt.method || request.RawPath != tt.path {
+			t.Errorf("%s: expected source %d %s %s, got %d %s %s", tt.name, tt.source, tt.method, tt.path, event.source, request.RequestContext.HTTP.Method, request.RawPath)
+		}
+		if request.QueryStringParameters["filename"] != tt.query {
+			t.Errorf("%s: expected filename %q, got %q", tt.name, tt.query, request.QueryStringParameters["filename"])
+		}
+	}
+}
+
+func TestInvoke_ResponseFormats(t *testing.T) {
+	response, err := invoke(context.Background(), json.RawMessage(`{"path": "/", "httpMethod": "PUT", "requestContext": {}}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if proxy, ok := response.(events.APIGatewayProxyResponse); !ok || proxy.StatusCode != 405 {
+		t.Errorf("Expected a 405 API Gateway proxy response, got %#v", response)
+	}
+
+	response, err = invoke(context.Background(), json.RawMessage(`{"httpMethod": "PUT", "path": "/", "multiValueHeaders": {"accept": ["*/*"]}, "requestContext": {"elb": {}}}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	alb, ok := response.(events.ALBTargetGroupResponse)
+	if !ok || alb.StatusDescription != "405 Method Not Allowed" || alb.Headers != nil || alb.MultiValueHeaders["Content-Type"][0] != "application/json" {
+		t.Errorf("Expected a multi-value ALB response, got %#v", response)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// handleOrphans lists the orphaned outputs in the manifest bucket, and deletes
+// them when remove is set: GET /admin/orphans for a dry run, DELETE to reclaim
+// the storage
+func handleOrphans(ctx context.Context, store *processor.Supabase, remove bool) events.LambdaFunctionURLResponse {
+	collection, err := collectOrphans(ctx, store, newJobStoreFromEnv(), remove)
+	if err != nil {
+		log.Printf("Error collecting orphaned outputs: %v", err)
+		return createErrorResponse(500, fmt.Sprintf("Failed to collect orphaned outputs: %v", err))
+	}
+	return createSuccessResponse(fmt.Sprintf("Found %d orphaned outputs", len(collection.Orphans)), collection)
+}
+
+// orphanCollection is the outcome of a garbage collection
+type orphanCollection struct {
+	Publications   int                `json:"publications"`
+	Orphans        []publicationUsage `json:"orphans"`
+	Deleted        bool               `json:"deleted"`
+	ReclaimedBytes int64              `json:"reclaimed_bytes"`
+}
+
+// collectOrphans finds the orphaned outputs, and deletes them when remove is set
+func collectOrphans(ctx context.Context, store *processor.Supabase, jobs *jobStore, remove bool) (*orphanCollection, error) {
+	orphans, publications, err := findOrphanedOutputs(ctx, store, jobs)
+	if err != nil {
+		return nil, err
+	}
+	collection := &orphanCollection{Publications: publications, Orphans: orphans, Deleted: remove}
+	if remove {
+		collection.ReclaimedBytes, err = deleteOrphans(store, orphans)
+	}
+	return collection, err
+}
+
+// deleteOrphans deletes orphaned outputs, returning the bytes reclaimed
+func deleteOrphans(store *processor.Supabase, orphans []publicationUsage) (int64, error) {
+	var reclaimed int64
+	for _, orphan := range orphans {
+		log.Printf("Deleting orphaned output %s (%d files, %d bytes)", orphan.BasePath, orphan.Files, orphan.Bytes)
+		if err := store.DeleteObjects(processor.ManifestBucket, orphan.paths); err != nil {
+			return reclaimed, fmt.Errorf("failed to delete %s: %w", orphan.BasePath, err)
+		}
+		reclaimed += orphan.Bytes
+	}
+	return reclaimed, nil
+}
+
+// findOrphanedOutputs returns the publications in the manifest bucket that no
+// EPUB in the epubs bucket maps to (under either storage layout, directly or
+// as a watermarked copy) and, when job tracking is enabled, that have no
+// publication record either. Books fetched from a URL or uploaded directly
+// only have the record, so without job tracking they are reported as orphans too.
+func findOrphanedOutputs(ctx context.Context, store *processor.Supabase, jobs *jobStore) ([]publicationUsage, int, error) {
+	sources, err := store.List(processor.EPUBBucket, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list %s: %w", processor.EPUBBucket, err)
+	}
+	expected := map[string]bool{}
+	for _, source := range sources {
+		for _, basePath := range processor.BasePaths(source.Path) {
+			expected[basePath] = true
+		}
+	}
+
+	publications, err := publicationsUnder(store, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	basePaths := make([]string, 0, len(publications))
+	for basePath := range publications {
+		basePaths = append(basePaths, basePath)
+	}
+	sort.Strings(basePaths)
+
+	var orphans []publicationUsage
+	for _, basePath := range basePaths {
+		if expected[basePath] {
+			continue
+		}
+		// Watermarked copies live as long as the publication they were made from
+		if parent, ok := processor.WatermarkedFrom(basePath); ok && expected[parent] {
+			continue
+		}
+		record, err := jobs.latestForPublication(ctx, "", basePath)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to look up publication record for %s: %w", basePath, err)
+		}
+		if record != nil {
+			continue
+		}
+		orphans = append(orphans, *publications[basePath])
+	}
+	return orphans, len(publications), nil
+}
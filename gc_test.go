@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// adminRequest returns an admin request carrying the bearer token
+func adminRequest(method, path, token string) events.LambdaFunctionURLRequest {
+	request := getRequest(path)
+	request.RequestContext.HTTP.Method = method
+	request.Headers = map[string]string{"authorization": "Bearer " + token}
+	return request
+}
+
+func TestHandler_Orphans(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/kept.epub", []byte("epub"))
+	supabase.Put(processor.EPUBBucket, "books/nested.epub", []byte("epub"))
+	for _, path := range []string{
+		// flat layout, source present
+		"books_kept/manifest.json", "books_kept/" + processor.IndexPath,
+		// preserve layout, source present
+		"books/nested.epub/manifest.json", "books/nested.epub/" + processor.IndexPath,
+		// watermarked copy of a present source
+		"books_kept/watermarked/0a1b2c/manifest.json", "books_kept/watermarked/0a1b2c/" + processor.IndexPath,
+		// source deleted
+		"books_gone/manifest.json", "books_gone/OEBPS/chapter1.xhtml", "books_gone/" + processor.IndexPath,
+		// not a publication
+		"stray.txt",
+	} {
+		supabase.Put(processor.ManifestBucket, path, []byte("data"))
+	}
+
+	if response, _ := handler(context.Background(), adminRequest("GET", "/admin/orphans", "secret")); response.StatusCode != 404 {
+		t.Errorf("Expected admin routes to be disabled without ADMIN_TOKEN, got %d", response.StatusCode)
+	}
+	t.Setenv(adminTokenEnvVar, "secret")
+	if response, _ := handler(context.Background(), adminRequest("GET", "/admin/orphans", "wrong")); response.StatusCode != 401 {
+		t.Errorf("Expected 401 for a wrong token, got %d", response.StatusCode)
+	}
+
+	response, _ := handler(context.Background(), adminRequest("GET", "/admin/orphans", "secret"))
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	var body struct {
+		Data struct {
+			Publications int                `json:"publications"`
+			Orphans      []publicationUsage `json:"orphans"`
+		} `json:"data"`
+	}
+	json.Unmarshal([]byte(response.Body), &body)
+	if body.Data.Publications != 4 || len(body.Data.Orphans) != 1 || body.Data.Orphans[0].BasePath != "books_gone" || body.Data.Orphans[0].Files != 3 {
+		t.Fatalf("Expected books_gone to be the only orphan, got %+v", body.Data)
+	}
+	if _, ok := supabase.Object(processor.ManifestBucket, "books_gone/manifest.json"); !ok {
+		t.Error("Expected a dry run to delete nothing")
+	}
+
+	response, _ = handler(context.Background(), adminRequest("DELETE", "/admin/orphans", "secret"))
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	paths := supabase.Paths(processor.ManifestBucket)
+	if len(paths) != 7 {
+		t.Errorf("Expected only the orphan to be deleted, got %v", paths)
+	}
+	for _, path := range paths {
+		if strings.HasPrefix(path, "books_gone/") {
+			t.Errorf("Expected %s to be deleted", path)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// Build information, set at link time (see the Makefile):
+//
+//	go build -ldflags "-X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=..."
+//
+// When unset, the VCS information Go embeds in the binary is used instead.
+var (
+	gitCommit string
+	buildTime string
+)
+
+const (
+	toolkitModulePath = "github.com/readium/go-toolkit"
+	healthTimeout     = 5 * time.Second
+)
+
+// versionInfo is the body of GET /version
+type versionInfo struct {
+	GitCommit      string `json:"git_commit,omitempty"`
+	BuildTime      string `json:"build_time,omitempty"`
+	GoVersion      string `json:"go_version"`
+	ToolkitVersion string `json:"toolkit_version,omitempty"`
+}
+
+// currentVersion describes the running binary
+func currentVersion() versionInfo {
+	info := versionInfo{GitCommit: gitCommit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, dep := range build.Deps {
+		if dep.Path == toolkitModulePath {
+			info.ToolkitVersion = dep.Version
+			if dep.Replace != nil {
+				info.ToolkitVersion = dep.Replace.Version
+			}
+		}
+	}
+	modified := false
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.GitCommit == "" {
+				info.GitCommit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified && gitCommit == "" && info.GitCommit != "" {
+		info.GitCommit += "-dirty"
+	}
+	return info
+}
+
+// healthCheck is the outcome of one check of GET /health
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleHealth checks the configuration and that Supabase Storage answers,
+// returning 503 when any check fails
+func handleHealth(ctx context.Context) events.LambdaFunctionURLResponse {
+	supabaseURL := os.Getenv(supabaseURLEnvVar)
+	serviceKey := os.Getenv(supabaseServiceKeyEnvVar)
+
+	config := healthCheck{Name: "config", OK: true}
+	if supabaseURL == "" || serviceKey == "" {
+		config = healthCheck{Name: "config", Error: fmt.Sprintf("%s and %s must be set", supabaseURLEnvVar, supabaseServiceKeyEnvVar)}
+	}
+	checks := []healthCheck{config}
+
+	storage := healthCheck{Name: "storage"}
+	if config.OK {
+		if err := checkStorageReachable(ctx, supabaseURL, serviceKey); err != nil {
+			storage.Error = err.Error()
+		} else {
+			storage.OK = true
+		}
+	} else {
+		storage.Error = "skipped: configuration is incomplete"
+	}
+	checks = append(checks, storage)
+
+	data := map[string]interface{}{
+		"checks":  checks,
+		"version": currentVersion(),
+	}
+	for _, check := range checks {
+		if !check.OK {
+			return createErrorResponseWithData(503, "Unhealthy", data)
+		}
+	}
+	return createSuccessResponse("Healthy", data)
+}
+
+// checkStorageReachable looks up the manifest bucket, which needs both a
+// reachable Storage API and a valid service key
+func checkStorageReachable(ctx context.Context, supabaseURL, serviceKey string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+
+	bucketURL := fmt.Sprintf("%s/storage/v1/bucket/%s", strings.TrimSuffix(supabaseURL, "/"), processor.ManifestBucket)
+	req, err := http.NewRequestWithContext(ctx, "GET", bucketURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", serviceKey))
+	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
+	if requestID := requestIDFrom(ctx); requestID != "" {
+		req.Header.Set(requestIDHeader, requestID)
+	}
+
+	resp, err := processor.NewHTTPClient(healthTimeout).Do(req)
+	if err != nil {
+		return fmt.Errorf("storage unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func getRequest(path string) events.LambdaFunctionURLRequest {
+	return events.LambdaFunctionURLRequest{
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: "GET", Path: path},
+		},
+		RawPath: path,
+	}
+}
+
+func TestHandler_Health(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/storage/v1/bucket/"+processor.ManifestBucket || r.Header.Get("apikey") != "test-key" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	t.Setenv(supabaseURLEnvVar, server.URL)
+	t.Setenv(supabaseServiceKeyEnvVar, "test-key")
+
+	response, err := handler(context.Background(), getRequest("/health"))
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Errorf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	status = http.StatusBadGateway
+	response, _ = handler(context.Background(), getRequest("/health"))
+	if response.StatusCode != 503 {
+		t.Errorf("Expected status 503 when storage fails, got %d", response.StatusCode)
+	}
+
+	t.Setenv(supabaseServiceKeyEnvVar, "")
+	response, _ = handler(context.Background(), getRequest("/health"))
+	var body struct {
+		Data struct {
+			Checks []healthCheck `json:"checks"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if response.StatusCode != 503 || len(body.Data.Checks) != 2 || body.Data.Checks[0].OK {
+		t.Errorf("Expected the config check to fail, got %d %+v", response.StatusCode, body.Data.Checks)
+	}
+}
+
+func TestHandler_Version(t *testing.T) {
+	defer func(commit, built string) { gitCommit, buildTime = commit, built }(gitCommit, buildTime)
+	gitCommit, buildTime = "abc123", "2026-01-02T03:04:05Z"
+
+	response, err := handler(context.Background(), getRequest("/version"))
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	var body struct {
+		Data versionInfo `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if response.StatusCode != 200 || body.Data.GitCommit != "abc123" || body.Data.BuildTime != "2026-01-02T03:04:05Z" || body.Data.GoVersion == "" {
+		t.Errorf("Expected the link-time build information, got %d %+v", response.StatusCode, body.Data)
+	}
+}
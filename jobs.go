@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	jobsTableEnvVar = "JOBS_TABLE_NAME"
+
+	jobStatusProcessing = "processing"
+	jobStatusSucceeded  = "succeeded"
+	jobStatusFailed     = "failed"
+
+	// publicationKeyPrefix prefixes the items that track the latest successful
+	// job per publication, stored in the same table as the job items
+	publicationKeyPrefix = "publication#"
+	// sourceKeyPrefix prefixes the items that track the latest successful job
+	// per EPUB, which tell where the publication went under layouts that only
+	// know it once the EPUB is parsed
+	sourceKeyPrefix = "source#"
+
+	// outputExpiresAtAttribute holds the expiry of temporary outputs, in Unix
+	// seconds. It is not expires_at, so a table TTL on that attribute cannot drop
+	// a publication item before the sweep has deleted its outputs.
+	outputExpiresAtAttribute = "output_expires_at"
+)
+
+// jobRecord is a processing job as stored in DynamoDB
+type jobRecord struct {
+	ID       string `json:"job_id"`
+	Filename string `json:"filename"`
+	BasePath string `json:"base_path"`
+	// Tenant is the ID of the tenant the job ran for, in multi-tenant deployments
+	Tenant      string     `json:"tenant,omitempty"`
+	SourceHash  string     `json:"source_hash,omitempty"`
+	OptionsHash string     `json:"options_hash,omitempty"`
+	Status      string     `json:"status"`
+	ManifestURL string     `json:"manifest_url,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	DurationMs  int64      `json:"duration_ms,omitempty"`
+	// ExpiresAt marks the outputs of a temporary conversion for deletion (see sweepExpired)
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Progress is the last progress reported while the job was processing
+	Progress *processor.Progress `json:"progress,omitempty"`
+}
+
+// jobStore records processing jobs in a DynamoDB table whose partition key is
+// the string attribute "id". It talks to the DynamoDB JSON API directly, signing
+// requests with the Lambda execution role credentials from the environment.
+type jobStore struct {
+	table    string
+	region   string
+	endpoint string
+	client   *http.Client
+	signer   *v4.Signer
+}
+
+// newJobStoreFromEnv returns a jobStore if JOBS_TABLE_NAME is set, or nil if job
+// tracking is disabled. All jobStore methods are no-ops on a nil store. The
+// store is built once per execution environment (see cachedFromEnv).
+func newJobStoreFromEnv() *jobStore {
+	return cachedFromEnv("jobs", []string{jobsTableEnvVar, "AWS_REGION", "DYNAMODB_ENDPOINT"}, buildJobStore)
+}
+
+// buildJobStore builds the jobStore configured by the environment
+func buildJobStore() *jobStore {
+	table := os.Getenv(jobsTableEnvVar)
+	if table == "" {
+		return nil
+	}
+
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://dynamodb.%s.amazonaws.com", region)
+	}
+
+	return &jobStore{
+		table:    table,
+		region:   region,
+		endpoint: endpoint,
+		client:   processor.NewHTTPClient(10 * time.Second),
+		signer:   v4.NewSigner(),
+	}
+}
+
+// start records a new job. The write is conditional on the job ID not existing,
+// so retried invocations with the same job ID cannot overwrite each other.
+func (s *jobStore) start(ctx context.Context, job *jobRecord) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.call(ctx, "PutItem", map[string]interface{}{
+		"TableName":           s.table,
+		"Item":                job.toItem(),
+		"ConditionExpression": "attribute_not_exists(id)",
+	}, nil)
+}
+
+// finish marks a processing job as succeeded or failed. The update is
+// conditional on the job still being in the processing state.
+func (s *jobStore) finish(ctx context.Context, job *jobRecord) error {
+	if s == nil {
+		return nil
+	}
+
+	completedAt := time.Now().UTC()
+	job.CompletedAt = &completedAt
+	job.DurationMs = completedAt.Sub(job.StartedAt).Milliseconds()
+
+	err := s.call(ctx, "PutItem", map[string]interface{}{
+		"TableName":                 s.table,
+		"Item":                      job.toItem(),
+		"ConditionExpression":       "#status = :processing",
+		"ExpressionAttributeNames":  map[string]string{"#status": "status"},
+		"ExpressionAttributeValues": map[string]events.DynamoDBAttributeValue{":processing": events.NewStringAttribute(jobStatusProcessing)},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	// Runs that published nothing (validate_only, diff) leave the publication alone
+	if job.Status != jobStatusSucceeded || job.ManifestURL == "" {
+		return nil
+	}
+
+	// Point the publication, and the EPUB it was processed from, at this job so
+	// identical reprocessing requests can be deduplicated
+	for _, key := range []string{publicationKey(job.Tenant, job.BasePath), sourceKey(job.Tenant, job.Filename)} {
+		item := job.toItem()
+		item["id"] = events.NewStringAttribute(key)
+		item["job_id"] = events.NewStringAttribute(job.ID)
+		if err := s.call(ctx, "PutItem", map[string]interface{}{
+			"TableName": s.table,
+			"Item":      item,
+		}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// progress records the progress of a processing job. The update is
+// conditional on the job still being in the processing state, so a late report
+// cannot touch a finished job.
+func (s *jobStore) progress(ctx context.Context, job *jobRecord) error {
+	if s == nil || job.Progress == nil {
+		return nil
+	}
+
+	return s.call(ctx, "UpdateItem", map[string]interface{}{
+		"TableName":                s.table,
+		"Key":                      map[string]events.DynamoDBAttributeValue{"id": events.NewStringAttribute(job.ID)},
+		"UpdateExpression":         "SET #progress = :progress",
+		"ConditionExpression":      "#status = :processing",
+		"ExpressionAttributeNames": map[string]string{"#progress": "progress", "#status": "status"},
+		"ExpressionAttributeValues": map[string]events.DynamoDBAttributeValue{
+			":progress":   progressAttribute(job.Progress),
+			":processing": events.NewStringAttribute(jobStatusProcessing),
+		},
+	}, nil)
+}
+
+// get returns the job with the given ID, or nil if it does not exist
+func (s *jobStore) get(ctx context.Context, jobID string) (*jobRecord, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	var out struct {
+		Item map[string]events.DynamoDBAttributeValue `json:"Item"`
+	}
+	err := s.call(ctx, "GetItem", map[string]interface{}{
+		"TableName":      s.table,
+		"Key":            map[string]events.DynamoDBAttributeValue{"id": events.NewStringAttribute(jobID)},
+		"ConsistentRead": true,
+	}, &out)
+	if err != nil || out.Item == nil {
+		return nil, err
+	}
+	return jobFromItem(out.Item), nil
+}
+
+// latestForPublication returns the last successful job of the tenant for
+// basePath, or nil
+func (s *jobStore) latestForPublication(ctx context.Context, tenantID, basePath string) (*jobRecord, error) {
+	return s.get(ctx, publicationKey(tenantID, basePath))
+}
+
+// latestForSource returns the last successful job of the tenant for the EPUB
+// at filename, or nil, including when another job has since replaced the
+// publication it produced
+func (s *jobStore) latestForSource(ctx context.Context, tenantID, filename string) (*jobRecord, error) {
+	source, err := s.get(ctx, sourceKey(tenantID, filename))
+	if err != nil || source == nil {
+		return nil, err
+	}
+	publication, err := s.latestForPublication(ctx, tenantID, source.BasePath)
+	if err != nil || publication == nil || publication.ID != source.ID {
+		return nil, err
+	}
+	return publication, nil
+}
+
+// sourceKey returns the ID of the source item of filename
+func sourceKey(tenantID, filename string) string {
+	if tenantID == "" {
+		return sourceKeyPrefix + filename
+	}
+	return sourceKeyPrefix + tenantID + "#" + filename
+}
+
+// publicationKey returns the ID of the publication item of basePath. Tenants
+// get their own items, as their base paths live in different buckets.
+func publicationKey(tenantID, basePath string) string {
+	if tenantID == "" {
+		return publicationKeyPrefix + basePath
+	}
+	return publicationKeyPrefix + tenantID + "#" + basePath
+}
+
+// expiredPublications returns the publication items whose outputs expired
+// before now. It scans the whole table, which is fine for an hourly sweep.
+func (s *jobStore) expiredPublications(ctx context.Context, now time.Time) ([]*jobRecord, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	var expired []*jobRecord
+	var startKey map[string]events.DynamoDBAttributeValue
+	for {
+		input := map[string]interface{}{
+			"TableName":                s.table,
+			"FilterExpression":         "begins_with(id, :prefix) AND #expires <= :now",
+			"ExpressionAttributeNames": map[string]string{"#expires": outputExpiresAtAttribute},
+			"ExpressionAttributeValues": map[string]events.DynamoDBAttributeValue{
+				":prefix": events.NewStringAttribute(publicationKeyPrefix),
+				":now":    events.NewNumberAttribute(strconv.FormatInt(now.Unix(), 10)),
+			},
+			"ConsistentRead": true,
+		}
+		if startKey != nil {
+			input["ExclusiveStartKey"] = startKey
+		}
+		var out struct {
+			Items            []map[string]events.DynamoDBAttributeValue `json:"Items"`
+			LastEvaluatedKey map[string]events.DynamoDBAttributeValue   `json:"LastEvaluatedKey"`
+		}
+		if err := s.call(ctx, "Scan", input, &out); err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			expired = append(expired, jobFromItem(item))
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return expired, nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
+
+// forgetPublication deletes the publication item of an expired publication. The
+// delete is conditional on the item still pointing at the same job, so a
+// publication reprocessed during the sweep keeps its record.
+func (s *jobStore) forgetPublication(ctx context.Context, publication *jobRecord) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.call(ctx, "DeleteItem", map[string]interface{}{
+		"TableName":                 s.table,
+		"Key":                       map[string]events.DynamoDBAttributeValue{"id": events.NewStringAttribute(publicationKey(publication.Tenant, publication.BasePath))},
+		"ConditionExpression":       "job_id = :job",
+		"ExpressionAttributeValues": map[string]events.DynamoDBAttributeValue{":job": events.NewStringAttribute(publication.ID)},
+	}, nil)
+}
+
+// call invokes a DynamoDB JSON API operation
+func (s *jobStore) call(ctx context.Context, operation string, input interface{}, output interface{}) error {
+	payload, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s input: %w", operation, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+operation)
+
+	credentials := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	payloadHash := sha256.Sum256(payload)
+	if err := s.signer.SignHTTP(ctx, credentials, req, hex.EncodeToString(payloadHash[:]), "dynamodb", s.region, time.Now()); err != nil {
+		return fmt.Errorf("failed to sign request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DynamoDB %s failed with status %d: %s", operation, resp.StatusCode, string(bodyBytes))
+	}
+
+	if output != nil {
+		if err := json.Unmarshal(bodyBytes, output); err != nil {
+			return fmt.Errorf("failed to unmarshal %s output: %w", operation, err)
+		}
+	}
+	return nil
+}
+
+// toItem converts the job to a DynamoDB item, omitting empty attributes
+func (j *jobRecord) toItem() map[string]events.DynamoDBAttributeValue {
+	item := map[string]events.DynamoDBAttributeValue{
+		"id":         events.NewStringAttribute(j.ID),
+		"filename":   events.NewStringAttribute(j.Filename),
+		"base_path":  events.NewStringAttribute(j.BasePath),
+		"status":     events.NewStringAttribute(j.Status),
+		"started_at": events.NewStringAttribute(j.StartedAt.Format(time.RFC3339Nano)),
+	}
+	if j.Tenant != "" {
+		item["tenant"] = events.NewStringAttribute(j.Tenant)
+	}
+	if j.SourceHash != "" {
+		item["source_hash"] = events.NewStringAttribute(j.SourceHash)
+	}
+	if j.OptionsHash != "" {
+		item["options_hash"] = events.NewStringAttribute(j.OptionsHash)
+	}
+	if j.ManifestURL != "" {
+		item["manifest_url"] = events.NewStringAttribute(j.ManifestURL)
+	}
+	if j.Error != "" {
+		item["error"] = events.NewStringAttribute(j.Error)
+	}
+	if j.CompletedAt != nil {
+		item["completed_at"] = events.NewStringAttribute(j.CompletedAt.Format(time.RFC3339Nano))
+		item["duration_ms"] = events.NewNumberAttribute(strconv.FormatInt(j.DurationMs, 10))
+	}
+	if j.ExpiresAt != nil {
+		item[outputExpiresAtAttribute] = events.NewNumberAttribute(strconv.FormatInt(j.ExpiresAt.Unix(), 10))
+	}
+	if j.Progress != nil {
+		item["progress"] = progressAttribute(j.Progress)
+	}
+	return item
+}
+
+// progressAttribute converts a job progress to a DynamoDB map
+func progressAttribute(progress *processor.Progress) events.DynamoDBAttributeValue {
+	return events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+		"done":    events.NewNumberAttribute(strconv.Itoa(progress.Done)),
+		"total":   events.NewNumberAttribute(strconv.Itoa(progress.Total)),
+		"bytes":   events.NewNumberAttribute(strconv.FormatInt(progress.Bytes, 10)),
+		"percent": events.NewNumberAttribute(strconv.Itoa(progress.Percent)),
+	})
+}
+
+// jobFromItem converts a DynamoDB item back into a job
+func jobFromItem(item map[string]events.DynamoDBAttributeValue) *jobRecord {
+	job := &jobRecord{
+		ID:          itemString(item, "id"),
+		Filename:    itemString(item, "filename"),
+		BasePath:    itemString(item, "base_path"),
+		Tenant:      itemString(item, "tenant"),
+		SourceHash:  itemString(item, "source_hash"),
+		OptionsHash: itemString(item, "options_hash"),
+		Status:      itemString(item, "status"),
+		ManifestURL: itemString(item, "manifest_url"),
+		Error:       itemString(item, "error"),
+	}
+	// Publication items carry the ID of the job they were copied from
+	if jobID := itemString(item, "job_id"); jobID != "" {
+		job.ID = jobID
+	}
+	if startedAt, err := time.Parse(time.RFC3339Nano, itemString(item, "started_at")); err == nil {
+		job.StartedAt = startedAt
+	}
+	if completedAt, err := time.Parse(time.RFC3339Nano, itemString(item, "completed_at")); err == nil {
+		job.CompletedAt = &completedAt
+	}
+	if av, ok := item["duration_ms"]; ok && av.DataType() == events.DataTypeNumber {
+		job.DurationMs, _ = strconv.ParseInt(av.Number(), 10, 64)
+	}
+	if av, ok := item[outputExpiresAtAttribute]; ok && av.DataType() == events.DataTypeNumber {
+		if seconds, err := strconv.ParseInt(av.Number(), 10, 64); err == nil {
+			expiresAt := time.Unix(seconds, 0).UTC()
+			job.ExpiresAt = &expiresAt
+		}
+	}
+	if av, ok := item["progress"]; ok && av.DataType() == events.DataTypeMap {
+		number := func(name string) int64 {
+			attribute, ok := av.Map()[name]
+			if !ok || attribute.DataType() != events.DataTypeNumber {
+				return 0
+			}
+			value, _ := strconv.ParseInt(attribute.Number(), 10, 64)
+			return value
+		}
+		job.Progress = &processor.Progress{
+			Done:    int(number("done")),
+			Total:   int(number("total")),
+			Bytes:   number("bytes"),
+			Percent: int(number("percent")),
+		}
+	}
+	return job
+}
+
+// itemString returns a string attribute of an item, or "" if it is missing
+func itemString(item map[string]events.DynamoDBAttributeValue, name string) string {
+	av, ok := item[name]
+	if !ok || av.DataType() != events.DataTypeString {
+		return ""
+	}
+	return av.String()
+}
+
+// logJobError logs job store failures; tracking is best-effort and never fails a request
+func logJobError(action string, err error) {
+	if err != nil {
+		log.Printf("Warning: failed to %s job record: %v", action, err)
+	}
+}
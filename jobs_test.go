@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestJobRecord_ItemRoundTrip(t *testing.T) {
+	completedAt := time.Date(2025, 1, 2, 3, 4, 6, 0, time.UTC)
+	expiresAt := time.Date(2025, 1, 3, 3, 4, 6, 0, time.UTC)
+	job := &jobRecord{
+		ID:          "job-1",
+		Filename:    "books/a.epub",
+		BasePath:    "books_a",
+		SourceHash:  "abc123",
+		OptionsHash: "def456",
+		Status:      jobStatusSucceeded,
+		ManifestURL: "https://example.supabase.co/manifest.json",
+		StartedAt:   time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		CompletedAt: &completedAt,
+		DurationMs:  1000,
+		ExpiresAt:   &expiresAt,
+		Progress:    &processor.Progress{Done: 3, Total: 4, Bytes: 1 << 20, Percent: 75},
+	}
+
+	got := jobFromItem(job.toItem())
+
+	if got.ID != job.ID || got.Filename != job.Filename || got.BasePath != job.BasePath ||
+		got.SourceHash != job.SourceHash || got.OptionsHash != job.OptionsHash || got.Status != job.Status || got.ManifestURL != job.ManifestURL {
+		t.Errorf("Round trip mismatch: got %+v, want %+v", got, job)
+	}
+	if !got.StartedAt.Equal(job.StartedAt) || got.CompletedAt == nil || !got.CompletedAt.Equal(completedAt) {
+		t.Errorf("Timestamps not preserved: got %+v", got)
+	}
+	if got.DurationMs != 1000 {
+		t.Errorf("Expected duration 1000, got %d", got.DurationMs)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected expiry %s, got %v", expiresAt, got.ExpiresAt)
+	}
+	if got.Progress == nil || *got.Progress != *job.Progress {
+		t.Errorf("Expected progress %+v, got %+v", job.Progress, got.Progress)
+	}
+}
+
+func TestJobStore_StartIsConditional(t *testing.T) {
+	var target string
+	var input map[string]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		if r.Header.Get("Authorization") == "" {
+			t.Errorf("Expected a signed request")
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	t.Setenv(jobsTableEnvVar, "jobs")
+	t.Setenv("DYNAMODB_ENDPOINT", server.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	jobs := newJobStoreFromEnv()
+	err := jobs.start(context.Background(), &jobRecord{ID: "job-1", Status: jobStatusProcessing, StartedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+
+	if target != "DynamoDB_20120810.PutItem" {
+		t.Errorf("Expected PutItem, got %s", target)
+	}
+	var condition string
+	json.Unmarshal(input["ConditionExpression"], &condition)
+	if condition != "attribute_not_exists(id)" {
+		t.Errorf("Expected conditional create, got %q", condition)
+	}
+	var item map[string]events.DynamoDBAttributeValue
+	json.Unmarshal(input["Item"], &item)
+	if itemString(item, "id") != "job-1" {
+		t.Errorf("Expected item id job-1, got %q", itemString(item, "id"))
+	}
+}
+
+func TestJobStore_DisabledWithoutTable(t *testing.T) {
+	t.Setenv(jobsTableEnvVar, "")
+
+	jobs := newJobStoreFromEnv()
+	if jobs != nil {
+		t.Fatalf("Expected nil store when %s is unset", jobsTableEnvVar)
+	}
+	if err := jobs.start(context.Background(), &jobRecord{ID: "job-1"}); err != nil {
+		t.Errorf("Expected nil store to be a no-op, got %v", err)
+	}
+}
+
+func TestHandler_DeduplicatesBySourceAndOptions(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+	table := &fakeJobsTable{items: map[string]map[string]events.DynamoDBAttributeValue{}}
+	server := httptest.NewServer(table)
+	defer server.Close()
+	t.Setenv(jobsTableEnvVar, "jobs")
+	t.Setenv("DYNAMODB_ENDPOINT", server.URL)
+
+	// The identifier layout only tells where the publication goes once parsed
+	process := func(options map[string]interface{}) string {
+		t.Helper()
+		request := map[string]interface{}{"filename": "books/moby-dick.epub", "layout": "identifier"}
+		for name, value := range options {
+			request[name] = value
+		}
+		response, _ := handler(context.Background(), postRequest(request))
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		return response.Body
+	}
+
+	if body := process(nil); !strings.Contains(body, "EPUB processed successfully") {
+		t.Fatalf("Expected the EPUB to be processed, got %s", body)
+	}
+	if body := process(nil); !strings.Contains(body, "EPUB already processed") || !strings.Contains(body, "duplicate_of_job") {
+		t.Errorf("Expected the identical request to be deduplicated, got %s", body)
+	}
+	if body := process(map[string]interface{}{"jsonld": true}); !strings.Contains(body, "EPUB processed successfully") {
+		t.Errorf("Expected a request with other options to be processed, got %s", body)
+	}
+	if _, ok := supabase.Object(processor.ManifestBucket, "urn:isbn:9780142437247/book.jsonld"); !ok {
+		t.Errorf("Expected the output of the new options, got %v", supabase.Paths(processor.ManifestBucket))
+	}
+}
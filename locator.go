@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// handleLocator translates an EPUB CFI stored by a legacy reader into a Readium
+// locator into the processed publication of an EPUB, to migrate bookmarks:
+//
+//	GET /locator?filename=books/moby-dick.epub&cfi=epubcfi(/6/4!/4/10/3:10)
+func handleLocator(ctx context.Context, request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	query := request.QueryStringParameters
+	filename, cfi := strings.TrimPrefix(query["filename"], "/"), query["cfi"]
+	if filename == "" || cfi == "" {
+		return createErrorResponse(400, "Missing 'filename' or 'cfi' query parameter")
+	}
+	if strings.Contains(filename, "..") {
+		return createErrorResponse(400, "Invalid filename: path traversal not allowed")
+	}
+
+	tenant, err := tenantFor(request)
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
+	}
+	supabaseURL, supabaseServiceKey := tenant.supabaseConfig()
+	if supabaseURL == "" || supabaseServiceKey == "" {
+		return createErrorResponse(500, "SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set")
+	}
+	store, err := tenant.storage(processor.NewSupabase(supabaseURL, supabaseServiceKey).WithRequestID(requestIDFrom(ctx)))
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
+	}
+
+	// The publication may have been processed under either storage layout
+	for _, basePath := range processor.BasePaths(filename) {
+		var locator *processor.Locator
+		locator, err = processor.ResolveCFI(store, basePath, cfi)
+		if err == nil {
+			return createSuccessResponse("Locator resolved", locator)
+		}
+		if processor.StatusCode(err) != 404 {
+			break
+		}
+	}
+	status := processor.StatusCode(err)
+	if status == 500 {
+		log.Printf("Error resolving CFI %s in %s: %v", cfi, filename, err)
+	}
+	return createErrorResponse(status, err.Error())
+}
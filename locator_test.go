@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestHandler_Locator(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.ManifestBucket, "books_moby/manifest.json", []byte(`{"readingOrder": [
+		{"href": "OEBPS/cover.xhtml", "type": "application/xhtml+xml"},
+		{"href": "OEBPS/chapter%201.xhtml", "type": "application/xhtml+xml", "title": "Loomings"}
+	]}`))
+	supabase.Put(processor.ManifestBucket, "books_moby/OEBPS/chapter 1.xhtml",
+		[]byte(`<html><head></head><body><h1 id="ch1">Loomings</h1><p>Call me Ishmael.</p></body></html>`))
+	supabase.Put(processor.ManifestBucket, "books_moby/readium/positions.json", []byte(`{"positions": [
+		{"href": "OEBPS/cover.xhtml", "locations": {"position": 1, "progression": 0, "totalProgression": 0}},
+		{"href": "OEBPS/chapter%201.xhtml", "locations": {"position": 2, "progression": 0, "totalProgression": 0.5}},
+		{"href": "OEBPS/chapter%201.xhtml", "locations": {"position": 3, "progression": 1, "totalProgression": 0.75}}
+	]}`))
+
+	locate := func(query map[string]string) (int, processor.Locator) {
+		request := getRequest("/locator")
+		request.QueryStringParameters = query
+		response, _ := handler(context.Background(), request)
+		var body struct {
+			Data processor.Locator `json:"data"`
+		}
+		json.Unmarshal([]byte(response.Body), &body)
+		return response.StatusCode, body.Data
+	}
+
+	status, locator := locate(map[string]string{"filename": "books/moby.epub", "cfi": "epubcfi(/6/4[chap01]!/4/2[ch1]/1:3)"})
+	if status != 200 || locator.Href != "OEBPS/chapter%201.xhtml" || locator.Title != "Loomings" {
+		t.Fatalf("Expected a locator into chapter 1, got %d: %+v", status, locator)
+	}
+	locations := locator.Locations
+	if len(locations.Fragments) != 1 || locations.Fragments[0] != "ch1" || locations.Progression <= 0 || locations.Progression >= 1 {
+		t.Errorf("Expected the heading and its progression, got %+v", locations)
+	}
+	if locations.Position != 2 || locations.TotalProgression == nil || *locations.TotalProgression != 0.5 {
+		t.Errorf("Expected the position of the heading, got %+v", locations)
+	}
+
+	for query, want := range map[[2]string]int{
+		{"books/moby.epub", ""}:                      400,
+		{"books/moby.epub", "/6/4!/4"}:               400,
+		{"books/gone.epub", "epubcfi(/6/4!/4)"}:      404,
+		{"books/moby.epub", "epubcfi(/6/8!/4)"}:      422,
+		{"books/moby.epub", "epubcfi(/6/4!/4/20/1)"}: 422,
+	} {
+		if status, _ := locate(map[string]string{"filename": query[0], "cfi": query[1]}); status != want {
+			t.Errorf("%v: expected %d, got %d", query, want, status)
+		}
+	}
+}
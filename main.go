@@ -1,30 +1,22 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
-	"github.com/readium/go-toolkit/pkg/archive"
-	"github.com/readium/go-toolkit/pkg/asset"
-	"github.com/readium/go-toolkit/pkg/fetcher"
-	"github.com/readium/go-toolkit/pkg/manifest"
-	"github.com/readium/go-toolkit/pkg/mediatype"
-	"github.com/readium/go-toolkit/pkg/parser/epub"
-	"github.com/readium/go-toolkit/pkg/pub"
-	"github.com/readium/go-toolkit/pkg/util/url"
+
+	"readium-processor-lambda/pkg/processor"
 )
 
 type Response struct {
@@ -36,1143 +28,544 @@ type Response struct {
 type ErrorResponse struct {
 	Error  string `json:"error"`
 	Status int    `json:"status"`
+	Data   any    `json:"data,omitempty"`
+}
+
+// ProcessRequest is the JSON body accepted by the handler: the EPUB to process,
+// plus the pipeline options
+type ProcessRequest struct {
+	Filename string `json:"filename"`
+	// URL fetches the EPUB from a host listed in REMOTE_EPUB_HOSTS instead of the
+	// epubs bucket; the filename defaults to remote/{host}/{path}
+	URL string `json:"url,omitempty"`
+	// WaitForLock waits for a concurrent job on the same publication to finish
+	// instead of failing immediately with 409
+	WaitForLock bool `json:"wait_for_lock,omitempty"`
+	// EPUBBase64 carries the EPUB itself, for callers that upload it directly instead
+	// of storing it in the epubs bucket first (see parseProcessRequest)
+	EPUBBase64 string `json:"epub_base64,omitempty"`
+	// TTLSeconds marks the output as temporary: the expiry sweep deletes it once
+	// the TTL has elapsed. Requires job tracking (JOBS_TABLE_NAME).
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	// IfModified skips the download of an EPUB from the epubs bucket, and the job,
+	// when the stored object is the version the publication was last processed from
+	IfModified bool `json:"if_modified,omitempty"`
+	// ProgressChannel is a Supabase Realtime topic the progress of the job is
+	// broadcast on while its resources are uploaded
+	ProgressChannel string `json:"progress_channel,omitempty"`
+	processor.Options
 }
 
 const (
 	supabaseURLEnvVar        = "SUPABASE_URL"
 	supabaseServiceKeyEnvVar = "SUPABASE_SERVICE_ROLE_KEY"
-	epubBucket               = "epubs"
-	manifestBucket           = "readium-manifests"
+	// supabaseReadKeyEnvVar is a key only allowed to read the epubs bucket, used
+	// instead of the service role key to download the EPUBs when set
+	supabaseReadKeyEnvVar = "SUPABASE_READ_KEY"
+	lockWaitTimeout       = 60 * time.Second
 )
 
+// handler answers CORS preflight requests and adds the CORS headers to every
+// response. Each request is tagged with a request ID (see requestIDFor) that is
+// logged, sent to Supabase and returned to the caller.
 func handler(ctx context.Context, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
-	log.Printf("Received request: Method=%s, Path=%s", request.RequestContext.HTTP.Method, request.RawPath)
-
-	// Only allow POST requests since this operation mutates server state
-	if request.RequestContext.HTTP.Method != "POST" {
-		return createErrorResponse(405, "Method not allowed. This endpoint only accepts POST requests."), nil
-	}
-
-	// Get Supabase configuration from environment variables
-	supabaseURL := os.Getenv(supabaseURLEnvVar)
-	supabaseServiceKey := os.Getenv(supabaseServiceKeyEnvVar)
-
-	if supabaseURL == "" {
-		return createErrorResponse(500, "SUPABASE_URL environment variable is not set"), nil
-	}
-
-	if supabaseServiceKey == "" {
-		return createErrorResponse(500, "SUPABASE_SERVICE_ROLE_KEY environment variable is not set"), nil
-	}
-
-	// Extract EPUB filename from request body
-	var epubFilename string
-
-	if request.Body != "" {
-		var bodyData map[string]string
-		if err := json.Unmarshal([]byte(request.Body), &bodyData); err == nil {
-			if filename := bodyData["filename"]; filename != "" {
-				epubFilename = filename
-			}
-		}
-	}
-
-	// Validate filename
-	if epubFilename == "" {
-		return createErrorResponse(400, "Missing 'filename' parameter. Provide EPUB filename in request body: {\"filename\":\"...\"}"), nil
-	}
-
-	// Sanitize filename (remove leading slashes, prevent path traversal)
-	epubFilename = strings.TrimPrefix(epubFilename, "/")
-	if strings.Contains(epubFilename, "..") {
-		return createErrorResponse(400, "Invalid filename: path traversal not allowed"), nil
-	}
-
-	log.Printf("Processing EPUB file: %s", epubFilename)
-
-	// Construct Supabase storage URL
-	// Format: {SUPABASE_URL}/storage/v1/object/{bucket}/{filename}
-	// Using authenticated endpoint with service role key (not public endpoint)
-	storageURL := fmt.Sprintf("%s/storage/v1/object/%s/%s", strings.TrimSuffix(supabaseURL, "/"), epubBucket, epubFilename)
-
-	log.Printf("Downloading EPUB from Supabase: %s", storageURL)
-
-	// Download the EPUB file
-	epubData, err := downloadEPUBFromSupabase(storageURL, supabaseServiceKey)
-	if err != nil {
-		log.Printf("Error downloading EPUB: %v", err)
-		return createErrorResponse(500, fmt.Sprintf("Failed to download EPUB: %v", err)), nil
-	}
-	log.Printf("Successfully downloaded EPUB file (%d bytes)", len(epubData))
-
-	// Process EPUB with Readium toolkit
-	manifestURL, err := processEPUB(epubData, epubFilename, supabaseURL, supabaseServiceKey)
-	if err != nil {
-		log.Printf("Error processing EPUB: %v", err)
-		return createErrorResponse(500, fmt.Sprintf("Failed to process EPUB: %v", err)), nil
-	}
+	requestID := requestIDFor(ctx, request)
+	defer logRequestID(requestID)()
+	ctx = withRequestID(ctx, requestID)
 
-	responseBody := Response{
-		Message: "EPUB processed successfully",
-		Status:  200,
-		Data: map[string]interface{}{
-			"manifest_url": manifestURL,
-			"filename":     epubFilename,
-		},
+	cors := corsConfigFromEnv()
+	if request.RequestContext.HTTP.Method == "OPTIONS" && cors.enabled() {
+		return tagResponse(cors.preflight(request), requestID), nil
 	}
-
-	body, err := json.Marshal(responseBody)
-	if err != nil {
-		log.Printf("Error marshaling response: %v", err)
-		return createErrorResponse(500, "Internal server error"), nil
-	}
-
-	return events.LambdaFunctionURLResponse{
-		StatusCode: 200,
-		Body:       string(body),
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-	}, nil
+	response, err := handleRequest(ctx, request)
+	return tagResponse(cors.apply(request, response), requestID), err
 }
 
-func downloadEPUBFromSupabase(storageURL, serviceKey string) ([]byte, error) {
-	// Create HTTP client
-	client := &http.Client{}
-
-	// Create request
-	req, err := http.NewRequest("GET", storageURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set Supabase authentication headers
-	req.Header.Set("apikey", serviceKey)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", serviceKey))
-	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
-
-	// Execute request
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Check status code
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	// Read response body
-	epubData, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	// Validate it's actually an EPUB (check for ZIP signature)
-	if len(epubData) < 4 {
-		return nil, fmt.Errorf("file too small to be a valid EPUB")
-	}
-
-	// EPUB files are ZIP archives, check for ZIP signature (PK\x03\x04)
-	if epubData[0] != 'P' || epubData[1] != 'K' {
-		return nil, fmt.Errorf("file does not appear to be a valid EPUB (missing ZIP signature)")
-	}
-
-	return epubData, nil
+// route is a route handleRequest answers besides processing jobs, for a method
+// ("" for any) and a path, or every path under it with prefix
+type route struct {
+	name   string
+	method string
+	path   string
+	prefix bool
+	handle func(ctx context.Context, request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse
 }
 
-// processEPUB processes an EPUB file using the Readium toolkit, extracts resources,
-// uploads them to Supabase, and generates a manifest with Supabase URLs
-func processEPUB(epubData []byte, epubFilename, supabaseURL, serviceKey string) (string, error) {
-	ctx := context.Background()
-
-	// Create a zip.Reader from the EPUB bytes
-	zipReader, err := zip.NewReader(bytes.NewReader(epubData), int64(len(epubData)))
-	if err != nil {
-		return "", fmt.Errorf("failed to create zip reader: %w", err)
-	}
-	if zipReader == nil {
-		return "", fmt.Errorf("zip.NewReader returned nil")
-	}
-
-	// Create an archive from the zip reader
-	epubArchive := archive.NewGoZIPArchive(zipReader, func() error { return nil }, false)
-	if epubArchive == nil {
-		return "", fmt.Errorf("NewGoZIPArchive returned nil")
-	}
-
-	// Create a fetcher from the archive
-	assetFetcher := fetcher.NewArchiveFetcher(epubArchive)
-	if assetFetcher == nil {
-		return "", fmt.Errorf("NewArchiveFetcher returned nil")
-	}
-
-	// Create a custom asset that uses our archive fetcher
-	// The parser needs an asset, but we'll make it use our fetcher
-	epubAsset := &bytesAsset{
-		name:      epubFilename,
-		mediaType: "application/epub+zip",
-		fetcher:   assetFetcher,
-	}
-
-	// Create EPUB parser
-	parser := epub.NewParser(nil)
-
-	// Parse the EPUB - pass the fetcher directly
-	// The parser may use the fetcher parameter if provided, otherwise it calls CreateFetcher on the asset
-	builder, err := parser.Parse(ctx, epubAsset, assetFetcher)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse EPUB: %w", err)
-	}
-	if builder == nil {
-		return "", fmt.Errorf("parser returned nil builder")
-	}
-
-	// Build the publication
-	publication := builder.Build()
-	if publication == nil {
-		return "", fmt.Errorf("builder.Build() returned nil publication")
-	}
-
-	// Get the manifest (it's a field, not a method)
-	manifest := publication.Manifest
-
-	// Extract base path from EPUB filename (without extension)
-	basePath := strings.TrimSuffix(epubFilename, filepath.Ext(epubFilename))
-	// Replace any path separators with underscores for the storage path
-	basePath = strings.ReplaceAll(basePath, "/", "_")
-	basePath = strings.ReplaceAll(basePath, "\\", "_")
-
-	// Extract and upload all resources
-	resourceMap, err := extractAndUploadResources(publication, basePath, supabaseURL, serviceKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to extract and upload resources: %w", err)
-	}
-
-	// Generate and upload content.json and positions.json
-	// Files are stored at {basePath}/readium/ (without ~ since Supabase doesn't allow it)
-	// We use relative paths in manifest: readium/content.json (resolved relative to manifest)
-	_, _, err = generateAndUploadReadiumFiles(publication, &manifest, resourceMap, basePath, supabaseURL, serviceKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate and upload Readium files: %w", err)
-	}
-
-	// Generate manifest with Supabase URLs
-	// Note: We use relative paths for content.json and positions.json since we store them
-	// at readium/ (without ~) due to Supabase storage key restrictions
-	manifestJSON, err := generateManifestWithSupabaseURLs(&manifest, resourceMap, basePath, supabaseURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate manifest: %w", err)
-	}
-
-	// Upload manifest to Supabase
-	manifestPath := fmt.Sprintf("%s/manifest.json", basePath)
-	manifestURL, err := uploadToSupabase(manifestPath, manifestJSON, manifestBucket, supabaseURL, serviceKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to upload manifest: %w", err)
-	}
-
-	return manifestURL, nil
-}
-
-// extractAndUploadResources extracts all resources from the publication and uploads them to Supabase
-func extractAndUploadResources(pub *pub.Publication, basePath, supabaseURL, serviceKey string) (map[string]string, error) {
-	resourceMap := make(map[string]string)
-	manifest := pub.Manifest
-
-	// Process reading order items
-	for _, link := range manifest.ReadingOrder {
-		hrefStr := link.Href.String()
-		if err := processResource(hrefStr, &link, pub, basePath, supabaseURL, serviceKey, resourceMap); err != nil {
-			return nil, fmt.Errorf("failed to process reading order resource %s: %w", hrefStr, err)
-		}
-	}
-
-	// Process table of contents items (need to extract base hrefs without fragments)
-	if len(manifest.TableOfContents) > 0 {
-		for _, link := range manifest.TableOfContents {
-			hrefStr := link.Href.String()
-			// Extract base href without fragment
-			baseHref := hrefStr
-			if idx := strings.Index(hrefStr, "#"); idx >= 0 {
-				baseHref = hrefStr[:idx]
-			}
-			if baseHref != "" {
-				// Find the link in manifest for the base href
-				baseLink := findLinkInManifest(baseHref, &manifest)
-				if err := processResource(baseHref, baseLink, pub, basePath, supabaseURL, serviceKey, resourceMap); err != nil {
-					return nil, fmt.Errorf("failed to process TOC resource %s: %w", baseHref, err)
-				}
-			}
-		}
-	}
-
-	// Process links (which may include landmarks or other navigation links)
-	// Extract base hrefs without fragments for any links that point to resources
-	for _, link := range manifest.Links {
-		hrefStr := link.Href.String()
-		// Only process links that look like they point to resources (not external URLs)
-		if !strings.HasPrefix(hrefStr, "http://") && !strings.HasPrefix(hrefStr, "https://") && !strings.HasPrefix(hrefStr, "~") {
-			// Extract base href without fragment
-			baseHref := hrefStr
-			if idx := strings.Index(hrefStr, "#"); idx >= 0 {
-				baseHref = hrefStr[:idx]
-			}
-			if baseHref != "" {
-				// Find the link in manifest for the base href
-				baseLink := findLinkInManifest(baseHref, &manifest)
-				if err := processResource(baseHref, baseLink, pub, basePath, supabaseURL, serviceKey, resourceMap); err != nil {
-					// Log but don't fail - some links might not be resources
-					log.Printf("Warning: failed to process link resource %s: %v", baseHref, err)
-				}
-			}
-		}
-	}
-
-	// Process resources
-	for _, link := range manifest.Resources {
-		hrefStr := link.Href.String()
-		if err := processResource(hrefStr, &link, pub, basePath, supabaseURL, serviceKey, resourceMap); err != nil {
-			return nil, fmt.Errorf("failed to process resource %s: %w", hrefStr, err)
-		}
-	}
-
-	return resourceMap, nil
+// routes are the routes of handleRequest, tried in order. The name of a route
+// labels its requests in the metrics.
+var routes = []route{
+	// Monitoring endpoints
+	{name: "health", method: "GET", path: "/health", handle: func(ctx context.Context, _ events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+		return handleHealth(ctx)
+	}},
+	{name: "version", method: "GET", path: "/version", handle: func(context.Context, events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+		return createSuccessResponse("Version", currentVersion())
+	}},
+	// Job status lookups are read-only: GET /jobs/{id}
+	{name: "job_status", method: "GET", path: "/jobs/", prefix: true, handle: func(ctx context.Context, request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+		return handleJobStatus(ctx, request, strings.TrimPrefix(request.RawPath, "/jobs/"))
+	}},
+	// So is translating legacy bookmarks: GET /locator?filename=...&cfi=...
+	{name: "locator", method: "GET", path: "/locator", handle: handleLocator},
+	// And fetching the manifest of a processed EPUB: GET /manifest?filename=...
+	{name: "manifest", method: "GET", path: "/manifest", handle: handleManifest},
+	// And asking whether an EPUB needs reprocessing: GET /source?filename=...
+	{name: "source", method: "GET", path: "/source", handle: handleSource},
+	// Maintenance routes, behind ADMIN_TOKEN
+	{name: "admin", path: adminPathPrefix, prefix: true, handle: handleAdmin},
 }
 
-// findLinkInManifest finds a link in the manifest by href
-func findLinkInManifest(href string, m *manifest.Manifest) *manifest.Link {
-	// Check reading order
-	for _, link := range m.ReadingOrder {
-		if link.Href.String() == href {
-			return &link
-		}
-	}
-	// Check resources
-	for _, link := range m.Resources {
-		if link.Href.String() == href {
-			return &link
-		}
-	}
-	// Check table of contents
-	for _, link := range m.TableOfContents {
-		linkHref := link.Href.String()
-		// Remove fragment for comparison
-		if idx := strings.Index(linkHref, "#"); idx >= 0 {
-			linkHref = linkHref[:idx]
+// routeFor returns the route of request, or nil for a job to process
+func routeFor(request events.LambdaFunctionURLRequest) *route {
+	for i, route := range routes {
+		if route.method != "" && route.method != request.RequestContext.HTTP.Method {
+			continue
 		}
-		if linkHref == href {
-			return &link
+		if request.RawPath == route.path || route.prefix && strings.HasPrefix(request.RawPath, route.path) {
+			return &routes[i]
 		}
 	}
 	return nil
 }
 
-// processResource processes a single resource: reads it from publication and uploads to Supabase
-func processResource(href string, manifestLink *manifest.Link, pub *pub.Publication, basePath, supabaseURL, serviceKey string, resourceMap map[string]string) error {
-	// Skip if already processed
-	if _, exists := resourceMap[href]; exists {
-		return nil
-	}
-
-	// Create context for the operation
-	ctx := context.Background()
-
-	// Create HREF from string
-	hrefURL, err := url.URLFromString(href)
-	if err != nil {
-		return fmt.Errorf("failed to create HREF from %s: %w", href, err)
-	}
-
-	// Read resource from publication using the fetcher
-	link := manifest.Link{Href: manifest.NewHREF(hrefURL)}
-	if manifestLink != nil {
-		link.MediaType = manifestLink.MediaType
-	}
-	resource := pub.Get(ctx, link)
-	defer resource.Close()
+func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	log.Printf("Received request: Method=%s, Path=%s", request.RequestContext.HTTP.Method, request.RawPath)
 
-	// Read all data from the resource using the Read method
-	// Read(ctx, start, end) - when both are 0, the whole content is returned
-	resourceData, resErr := resource.Read(ctx, 0, 0)
-	if resErr != nil {
-		return fmt.Errorf("failed to read resource: %v", resErr)
+	if route := routeFor(request); route != nil {
+		return route.handle(ctx, request), nil
 	}
 
-	// Check if this is an XHTML/HTML file that needs link rewriting
-	mediaType := link.MediaType
-	isXHTML := false
-	if mediaType != nil {
-		mtStr := mediaType.String()
-		if mtStr == "application/xhtml+xml" || mtStr == "text/html" {
-			isXHTML = true
-		}
-	}
-	// Fallback to file extension check
-	if !isXHTML && (strings.HasSuffix(href, ".xhtml") || strings.HasSuffix(href, ".html")) {
-		isXHTML = true
+	// Only allow POST requests since this operation mutates server state
+	if request.RequestContext.HTTP.Method != "POST" {
+		return createErrorResponse(405, "Method not allowed. This endpoint only accepts POST requests."), nil
 	}
 
-	if isXHTML {
-		// Rewrite internal links in XHTML/HTML files
-		resourceData = rewriteLinksInXHTML(resourceData, href, resourceMap, basePath, supabaseURL)
+	// Throttle callers starting jobs too often (no-op unless RATE_LIMIT_PER_MINUTE is configured)
+	if limited := checkRateLimit(ctx, request); limited != nil {
+		return *limited, nil
 	}
 
-	// Create storage path: basePath/resourcePath
-	// Normalize the href to handle relative paths
-	storagePath := fmt.Sprintf("%s/%s", basePath, strings.TrimPrefix(href, "/"))
-
-	// Upload to Supabase
-	resourceURL, err := uploadToSupabase(storagePath, resourceData, manifestBucket, supabaseURL, serviceKey)
+	// Get Supabase configuration from environment variables, or from the tenant
+	// of the caller in multi-tenant deployments (TENANTS_CONFIG)
+	tenant, err := tenantFor(request)
 	if err != nil {
-		return fmt.Errorf("failed to upload resource: %w", err)
+		return createErrorResponse(processor.StatusCode(err), err.Error()), nil
 	}
+	supabaseURL, supabaseServiceKey := tenant.supabaseConfig()
 
-	// Store mapping from original href to Supabase URL
-	resourceMap[href] = resourceURL
-
-	return nil
-}
-
-// convertLinkToSupabaseURL converts a link href to a Supabase URL, handling fragments
-func convertLinkToSupabaseURL(hrefStr string, resourceMap map[string]string, basePath, supabaseURL string) string {
-	// Split href into base path and fragment
-	baseHref := hrefStr
-	fragment := ""
-	if idx := strings.Index(hrefStr, "#"); idx >= 0 {
-		baseHref = hrefStr[:idx]
-		fragment = hrefStr[idx:]
+	if supabaseURL == "" {
+		return createErrorResponse(500, "SUPABASE_URL environment variable is not set"), nil
 	}
 
-	// Get the base URL from resource map
-	supabaseResourceURL := resourceMap[baseHref]
-	if supabaseResourceURL == "" {
-		// Fallback: construct URL if not in map
-		storagePath := fmt.Sprintf("%s/%s", basePath, strings.TrimPrefix(baseHref, "/"))
-		supabaseResourceURL = fmt.Sprintf("%s/storage/v1/object/public/%s/%s", strings.TrimSuffix(supabaseURL, "/"), manifestBucket, storagePath)
+	if supabaseServiceKey == "" {
+		return createErrorResponse(500, "SUPABASE_SERVICE_ROLE_KEY environment variable is not set"), nil
 	}
 
-	// Append fragment if present
-	return supabaseResourceURL + fragment
-}
-
-// rewriteLinksInXHTML keeps relative hrefs relative - Thorium Reader resolves them against manifest base
-func rewriteLinksInXHTML(content []byte, currentHref string, resourceMap map[string]string, basePath, supabaseURL string) []byte {
-	// Convert content to string for regex processing
-	contentStr := string(content)
-
-	// Pattern to match href attributes in <a> tags
-	// Matches: href="relative/path.xhtml#fragment" or href='relative/path.xhtml#fragment'
-	hrefPattern := regexp.MustCompile(`(?i)(<a[^>]*\s+href=["'])([^"']+)(["'][^>]*>)`)
-
-	// Replace function - we'll normalize relative paths but keep them relative
-	modifiedContent := hrefPattern.ReplaceAllStringFunc(contentStr, func(match string) string {
-		parts := hrefPattern.FindStringSubmatch(match)
-		if len(parts) != 4 {
-			return match // Return original if pattern doesn't match
-		}
-
-		prefix := parts[1]    // <a ... href="
-		hrefValue := parts[2] // the href value
-		suffix := parts[3]    // " ...>
-
-		// Skip external URLs, data URIs, mailto, same-page anchors
-		if strings.HasPrefix(hrefValue, "http://") ||
-			strings.HasPrefix(hrefValue, "https://") ||
-			strings.HasPrefix(hrefValue, "mailto:") ||
-			strings.HasPrefix(hrefValue, "data:") ||
-			strings.HasPrefix(hrefValue, "#") {
-			return match // Keep external/absolute links as-is
-		}
-
-		// For internal relative links, keep them relative
-		// Thorium Reader will resolve them against the manifest base URL
-		// Just normalize the path (remove ./ and handle .. if needed)
-		normalized := normalizeRelativeLink(hrefValue)
-
-		return prefix + normalized + suffix
-	})
-
-	return []byte(modifiedContent)
-}
-
-// normalizeRelativeLink normalizes a relative link path while keeping it relative
-func normalizeRelativeLink(link string) string {
-	// Remove leading ./
-	link = strings.TrimPrefix(link, "./")
-	// Remove leading / if present (make it truly relative)
-	link = strings.TrimPrefix(link, "/")
-	// For now, assume links are already correct relative paths
-	// More complex normalization (handling ..) could be added if needed
-	return link
-}
-
-// getDirectoryFromHref extracts the directory path from an href
-func getDirectoryFromHref(href string) string {
-	// Remove leading slash
-	href = strings.TrimPrefix(href, "/")
-
-	// Find last slash
-	lastSlash := strings.LastIndex(href, "/")
-	if lastSlash == -1 {
-		return "" // No directory, just filename
+	// Extract EPUB filename and options from request body, along with the EPUB
+	// itself if the caller uploaded it directly
+	processRequest, uploaded, err := parseProcessRequest(request, processor.MaxEPUBBytesFromEnv())
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error()), nil
 	}
-
-	return href[:lastSlash+1] // Include trailing slash
-}
-
-// resolveRelativePath resolves a relative path against a base directory
-func resolveRelativePath(relativePath, baseDir string) string {
-	// If relativePath is already absolute (starts with /), return as-is
-	if strings.HasPrefix(relativePath, "/") {
-		return strings.TrimPrefix(relativePath, "/")
+	if uploaded != nil {
+		defer uploaded.Close()
 	}
-
-	// Combine baseDir and relativePath
-	combined := baseDir + relativePath
-
-	// Normalize the path (remove .. and .)
-	parts := strings.Split(combined, "/")
-	result := make([]string, 0, len(parts))
-
-	for _, part := range parts {
-		if part == "" || part == "." {
-			continue
+	if processRequest.URL != "" {
+		if uploaded != nil {
+			return createErrorResponse(400, "Provide either an uploaded EPUB or 'url', not both"), nil
 		}
-		if part == ".." {
-			if len(result) > 0 {
-				result = result[:len(result)-1]
-			}
-			continue
-		}
-		result = append(result, part)
-	}
-
-	return strings.Join(result, "/")
-}
-
-// convertTOCLink converts a TOC link (which may have children) to a map with relative paths
-func convertTOCLink(link manifest.Link, resourceMap map[string]string, basePath, supabaseURL string) map[string]interface{} {
-	hrefStr := link.Href.String()
-	// Use relative path (relative to manifest.json location)
-	// Remove leading slash if present to ensure it's a relative path
-	relativeHref := strings.TrimPrefix(hrefStr, "/")
-
-	item := map[string]interface{}{
-		"href": relativeHref,
-	}
-	if link.Title != "" {
-		item["title"] = link.Title
-	}
-
-	// Handle nested TOC entries (children) - recursively convert them
-	if len(link.Children) > 0 {
-		children := make([]map[string]interface{}, 0, len(link.Children))
-		for _, child := range link.Children {
-			childItem := convertTOCLink(child, resourceMap, basePath, supabaseURL)
-			children = append(children, childItem)
+		remoteURL, err := checkRemoteURL(processRequest.URL, remoteHostsFromEnv())
+		if err != nil {
+			return createErrorResponse(processor.StatusCode(err), err.Error()), nil
 		}
-		if len(children) > 0 {
-			item["children"] = children
+		if processRequest.Filename == "" {
+			processRequest.Filename = remoteFilename(remoteURL)
 		}
 	}
+	epubFilename := processRequest.Filename
 
-	return item
-}
-
-// generateAndUploadReadiumFiles generates content.json and positions.json and uploads them to Supabase
-// Returns the Supabase URLs for these files so they can be referenced in the manifest
-func generateAndUploadReadiumFiles(publication *pub.Publication, manifest *manifest.Manifest, resourceMap map[string]string, basePath, supabaseURL, serviceKey string) (contentURL, positionsURL string, err error) {
-	// Generate positions.json
-	positionsJSON, err := generatePositionsJSON(publication, manifest, resourceMap, basePath, supabaseURL)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate positions.json: %w", err)
-	}
-
-	// Upload positions.json to readium/ directory (without ~ since Supabase doesn't allow it in keys)
-	// We'll use full URLs in manifest instead of ~readium/ paths
-	positionsPath := fmt.Sprintf("%s/readium/positions.json", basePath)
-	positionsURL, err = uploadToSupabase(positionsPath, positionsJSON, manifestBucket, supabaseURL, serviceKey)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to upload positions.json: %w", err)
+	// Validate filename
+	if epubFilename == "" {
+		return createErrorResponse(400, "Missing 'filename' parameter. Provide EPUB filename in request body: {\"filename\":\"...\"}"), nil
 	}
 
-	// Generate content.json
-	contentJSON, err := generateContentJSON(manifest, resourceMap, basePath, supabaseURL)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate content.json: %w", err)
+	// Sanitize filename (remove leading slashes, prevent path traversal)
+	epubFilename = strings.TrimPrefix(epubFilename, "/")
+	if strings.Contains(epubFilename, "..") {
+		return createErrorResponse(400, "Invalid filename: path traversal not allowed"), nil
 	}
 
-	// Upload content.json to readium/ directory
-	contentPath := fmt.Sprintf("%s/readium/content.json", basePath)
-	contentURL, err = uploadToSupabase(contentPath, contentJSON, manifestBucket, supabaseURL, serviceKey)
+	// Every phase is bounded, so a single hung request can't use up the invocation
+	deadline, _ := ctx.Deadline()
+	timeouts := processor.TimeoutsFromEnv(deadline)
+	store, err := tenant.storage(processor.NewSupabase(supabaseURL, supabaseServiceKey).WithRequestID(requestIDFrom(ctx)).WithTimeouts(timeouts))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to upload content.json: %w", err)
-	}
-
-	return contentURL, positionsURL, nil
-}
-
-// generatePositionsJSON generates the positions.json file based on reading order and content length
-// It calculates positions based on content length (approximately 1024 characters per position)
-func generatePositionsJSON(publication *pub.Publication, manifest *manifest.Manifest, resourceMap map[string]string, basePath, supabaseURL string) ([]byte, error) {
-	ctx := context.Background()
-	positions := make([]map[string]interface{}, 0)
-	
-	const charsPerPosition = 1024 // Standard: one position per 1024 characters
-	
-	// First pass: calculate total character count and positions per resource
-	type resourceInfo struct {
-		href        string
-		mediaType   string
-		charCount   int
-		numPositions int
-	}
-	
-	resourceInfos := make([]resourceInfo, 0, len(manifest.ReadingOrder))
-	totalChars := 0
-	
-	for i := range manifest.ReadingOrder {
-		link := &manifest.ReadingOrder[i]
-		hrefStr := link.Href.String()
-		
-		// Read the resource to get its content length
-		// Use the link directly from reading order
-		resource := publication.Get(ctx, *link)
-		if resource == nil {
-			log.Printf("Warning: failed to get resource %s", hrefStr)
-			continue
-		}
-		
-		// Read the resource content
-		resourceData, err := resource.Read(ctx, 0, 0)
-		resource.Close()
-		
+		return createErrorResponse(processor.StatusCode(err), err.Error()), nil
+	}
+
+	if err := processRequest.ApplyProfile(store); err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error()), nil
+	}
+	if err := processRequest.Resolve(); err != nil {
+		return createErrorResponse(400, err.Error()), nil
+	}
+	if processRequest.IfModified && (uploaded != nil || processRequest.URL != "") {
+		return createErrorResponse(400, "'if_modified' only applies to EPUBs in the epubs bucket"), nil
+	}
+	if processRequest.TTLSeconds < 0 {
+		return createErrorResponse(400, "'ttl_seconds' must be positive"), nil
+	}
+	if processRequest.TTLSeconds > 0 && os.Getenv(jobsTableEnvVar) == "" {
+		return createErrorResponse(400, "'ttl_seconds' requires job tracking (JOBS_TABLE_NAME is not set)"), nil
+	}
+	// The expiry sweep only knows the storage of SUPABASE_URL
+	if processRequest.TTLSeconds > 0 && tenant != nil {
+		return createErrorResponse(400, "'ttl_seconds' is not supported in multi-tenant deployments"), nil
+	}
+
+	// Answer a repeated request from the warm container while the outcome of the
+	// last one is fresh (no-op unless MANIFEST_CACHE_TTL_SECONDS is configured)
+	cache := newManifestCacheFromEnv()
+	cacheKey := manifestCacheKey(processRequest, tenant.id(), epubFilename)
+	cached := cache.lookup(cacheKey)
+	if uploaded == nil && !processRequest.Force && cache.fresh(cached) {
+		log.Printf("Answering from the manifest cache: job %s at %s", cached.JobID, cached.StoredAt.Format(time.RFC3339))
+		return createSuccessResponse("EPUB processed successfully", cached.response()), nil
+	}
+
+	jobID := uuid.NewString()
+	log.Printf("Processing EPUB file: %s (job %s)", epubFilename, jobID)
+	if processRequest.Debug {
+		log.Printf("Debug: options %+v", processRequest.Options)
+	}
+
+	// Make sure no other invocation is processing the same publication
+	// concurrently: the processor locks the path it writes once it knows it
+	var lockWait time.Duration
+	if processRequest.WaitForLock {
+		lockWait = lockWaitTimeout
+	}
+	proc := processor.New(store, store).WithTimeouts(timeouts).WithLock(jobID, lockWait)
+	basePath := processor.OutputBasePath(epubFilename, processRequest.Options)
+
+	// Record the job (no-op unless JOBS_TABLE_NAME is configured)
+	jobs := newJobStoreFromEnv()
+	job := &jobRecord{
+		ID:        jobID,
+		Filename:  epubFilename,
+		BasePath:  basePath,
+		Tenant:    tenant.id(),
+		Status:    jobStatusProcessing,
+		StartedAt: time.Now().UTC(),
+		// Other options make another output from the same EPUB
+		OptionsHash: optionsHash(processRequest.Options),
+	}
+	if processRequest.TTLSeconds > 0 {
+		expiresAt := job.StartedAt.Add(time.Duration(processRequest.TTLSeconds) * time.Second).Truncate(time.Second)
+		job.ExpiresAt = &expiresAt
+	}
+	logJobError("create", jobs.start(ctx, job))
+	// Count the outcome of the job and what it stored (served on /metrics by --serve)
+	var result *processor.Result
+	defer func() { requestMetrics.observeJob(job.Status, result) }()
+
+	// Server-side failures are sent to Sentry (no-op unless SENTRY_DSN is configured)
+	errorReporter := newSentryReporterFromEnv()
+	failJob := func(phase string, err error, message string, data any) events.LambdaFunctionURLResponse {
+		statusCode := processor.StatusCode(err)
+		job.Status = jobStatusFailed
+		job.Error = message
+		logJobError("update", jobs.finish(ctx, job))
+		if statusCode >= 500 {
+			errorReporter.report(ctx, failureReport{err: err, status: statusCode, filename: epubFilename, jobID: jobID, phase: phase})
+		}
+		return createErrorResponseWithData(statusCode, message, data)
+	}
+
+	fetchStart := time.Now()
+	sourceName := processor.EPUBBucket + "/" + epubFilename
+	source := uploaded
+	if source != nil {
+		sourceName = "upload"
+		log.Printf("Using uploaded EPUB file (%d bytes)", source.Size())
+	} else if processRequest.URL != "" {
+		log.Printf("Downloading EPUB from %s", processRequest.URL)
+		sourceName = processRequest.URL
+		source, err = downloadRemoteEPUB(processRequest.URL, remoteHostsFromEnv(), processor.MaxEPUBBytesFromEnv(), timeouts.Download)
 		if err != nil {
-			log.Printf("Warning: failed to read resource %s: %v", hrefStr, err)
-			continue
+			log.Printf("Error downloading EPUB: %v", err)
+			return failJob("fetch", err, fmt.Sprintf("Failed to download EPUB: %v", err), nil), nil
 		}
-		
-		// Count characters (for text-based resources)
-		charCount := len(string(resourceData))
-		numPositions := 1 // At least one position
-		if charCount > 0 {
-			// Calculate number of positions: at least 1, or based on content length
-			numPositions = (charCount + charsPerPosition - 1) / charsPerPosition // Ceiling division
-			if numPositions == 0 {
-				numPositions = 1
+		defer source.Close()
+		log.Printf("Successfully downloaded EPUB file (%d bytes)", source.Size())
+	} else {
+		// Don't even download an EPUB the publication is up to date with
+		if processRequest.IfModified && !processRequest.Force && !processRequest.ValidateOnly && !processRequest.Diff && !processRequest.Estimate {
+			check, err := proc.CheckSource(epubFilename, basePath)
+			if err != nil {
+				log.Printf("Warning: failed to check the EPUB version, downloading it: %v", err)
+			} else if !check.NeedsProcessing {
+				log.Printf("EPUB unchanged since it was processed (%s), skipping download", check.Current.ETag)
+				job.Status = jobStatusSucceeded
+				job.ManifestURL = store.PublicURL(basePath + "/manifest.json")
+				logJobError("update", jobs.finish(ctx, job))
+				return createSuccessResponse("EPUB already processed", map[string]interface{}{
+					"manifest_url":   job.ManifestURL,
+					"filename":       epubFilename,
+					"job_id":         jobID,
+					"source_version": check.Current,
+				}), nil
 			}
 		}
-		
-		mediaTypeStr := ""
-		if link.MediaType != nil {
-			mediaTypeStr = link.MediaType.String()
-		}
-		
-		resourceInfos = append(resourceInfos, resourceInfo{
-			href:        hrefStr,
-			mediaType:   mediaTypeStr,
-			charCount:   charCount,
-			numPositions: numPositions,
-		})
-		
-		totalChars += charCount
-	}
-	
-	// Second pass: generate positions with proper progression values
-	positionCounter := 1
-	cumulativeChars := 0
-	
-	for _, info := range resourceInfos {
-		relativeHref := strings.TrimPrefix(info.href, "/")
-		
-		// Generate positions for this resource
-		for i := 0; i < info.numPositions; i++ {
-			// Calculate progression within this document (0.0 to 1.0)
-			var progression float64
-			if info.numPositions > 1 {
-				progression = float64(i) / float64(info.numPositions-1)
-			} else {
-				progression = 0.0
-			}
-			
-			// Calculate totalProgression across entire publication
-			var totalProgression float64
-			if totalChars > 0 {
-				// Estimate position in total content based on cumulative chars
-				// Add proportional contribution for this position within the resource
-				charsAtPosition := cumulativeChars + (i * info.charCount / info.numPositions)
-				totalProgression = float64(charsAtPosition) / float64(totalChars)
-				if totalProgression > 1.0 {
-					totalProgression = 1.0
-				}
-			}
-			
-			position := map[string]interface{}{
-				"href": relativeHref,
-				"locations": map[string]interface{}{
-					"position":         positionCounter,
-					"progression":      progression,
-					"totalProgression": totalProgression,
-				},
+
+		// An estimate only needs the central directory, read in ranges where the
+		// storage can: the EPUB is downloaded otherwise
+		if processRequest.Estimate {
+			estimate, err := proc.EstimateStored(epubFilename, processor.MaxEPUBBytesFromEnv(), processRequest.Options)
+			if err == nil {
+				job.Status = jobStatusSucceeded
+				logJobError("update", jobs.finish(ctx, job))
+				return createSuccessResponse("EPUB estimated", map[string]interface{}{
+					"filename": epubFilename,
+					"job_id":   jobID,
+					"estimate": estimate,
+				}), nil
 			}
-			
-			// Add type if available
-			if info.mediaType != "" {
-				position["type"] = info.mediaType
+			if !errors.Is(err, processor.ErrRangesUnsupported) {
+				log.Printf("Error estimating EPUB: %v", err)
+				return failJob("fetch", err, fmt.Sprintf("Failed to estimate EPUB: %v", err), nil), nil
 			}
-			
-			positions = append(positions, position)
-			positionCounter++
 		}
-		
-		cumulativeChars += info.charCount
-	}
-	
-	positionsData := map[string]interface{}{
-		"total":    len(positions),
-		"positions": positions,
-	}
-	
-	return json.MarshalIndent(positionsData, "", "  ")
-}
-
-// buildContentItemFromLink converts a TOC link to a content item structure
-func buildContentItemFromLink(link manifest.Link, resourceMap map[string]string, basePath, supabaseURL string) map[string]interface{} {
-	hrefStr := link.Href.String()
-	// Use relative path (relative to manifest.json location)
-	// Remove leading slash if present to ensure it's a relative path
-	relativeHref := strings.TrimPrefix(hrefStr, "/")
-
-	item := map[string]interface{}{
-		"href": relativeHref,
-	}
-
-	if link.Title != "" {
-		item["title"] = link.Title
-	}
-
-	if link.MediaType != nil {
-		item["type"] = link.MediaType.String()
-	}
 
-	// Recursively add children
-	if len(link.Children) > 0 {
-		children := make([]map[string]interface{}, 0, len(link.Children))
-		for _, child := range link.Children {
-			childItem := buildContentItemFromLink(child, resourceMap, basePath, supabaseURL)
-			children = append(children, childItem)
-		}
-		if len(children) > 0 {
-			item["children"] = children
-		}
-	}
-
-	return item
-}
-
-// generateContentJSON generates the content.json file based on table of contents
-func generateContentJSON(manifest *manifest.Manifest, resourceMap map[string]string, basePath, supabaseURL string) ([]byte, error) {
-	content := make([]map[string]interface{}, 0)
-	if len(manifest.TableOfContents) > 0 {
-		for _, link := range manifest.TableOfContents {
-			item := buildContentItemFromLink(link, resourceMap, basePath, supabaseURL)
-			content = append(content, item)
-		}
-	} else {
-		// If no TOC, use reading order as fallback
-		for _, link := range manifest.ReadingOrder {
-			hrefStr := link.Href.String()
-			// Use relative path (relative to manifest.json location)
-			// Remove leading slash if present to ensure it's a relative path
-			relativeHref := strings.TrimPrefix(hrefStr, "/")
-
-			item := map[string]interface{}{
-				"href": relativeHref,
-			}
-			if link.Title != "" {
-				item["title"] = link.Title
+		// Download the EPUB file from the epubs bucket
+		source, err = proc.Fetch(epubFilename, processor.MaxEPUBBytesFromEnv())
+		if err != nil {
+			log.Printf("Error downloading EPUB: %v", err)
+			return failJob("fetch", err, fmt.Sprintf("Failed to download EPUB: %v", err), nil), nil
+		}
+		defer source.Close()
+		log.Printf("Successfully downloaded EPUB file (%d bytes)", source.Size())
+	}
+	fetchTime := time.Since(fetchStart)
+	job.SourceHash = source.Hash()
+
+	// Skip processing entirely if this exact EPUB was already processed successfully
+	if !processRequest.Force && !processRequest.ValidateOnly && !processRequest.Diff && !processRequest.Estimate {
+		if cached != nil && cached.SourceHash == job.SourceHash {
+			log.Printf("EPUB unchanged since cached job %s, reusing manifest %s", cached.JobID, cached.ManifestURL)
+			job.Status = jobStatusSucceeded
+			job.ManifestURL = cached.ManifestURL
+			logJobError("update", jobs.finish(ctx, job))
+			return createSuccessResponse("EPUB already processed", map[string]interface{}{
+				"manifest_url":     cached.ManifestURL,
+				"filename":         epubFilename,
+				"job_id":           jobID,
+				"duplicate_of_job": cached.JobID,
+			}), nil
+		}
+		// Looked up by EPUB, as the identifier layout and path templates only tell
+		// where the publication goes once it is parsed
+		latest, err := jobs.latestForSource(ctx, tenant.id(), epubFilename)
+		logJobError("look up previous", err)
+		// Expired outputs may already have been swept, so they are never reused
+		expired := latest != nil && latest.ExpiresAt != nil && !latest.ExpiresAt.After(time.Now())
+		if latest != nil && latest.SourceHash == job.SourceHash && latest.OptionsHash == job.OptionsHash && latest.ManifestURL != "" && !expired {
+			log.Printf("EPUB unchanged since job %s, reusing manifest %s", latest.ID, latest.ManifestURL)
+			job.Status = jobStatusSucceeded
+			job.ManifestURL = latest.ManifestURL
+			logJobError("update", jobs.finish(ctx, job))
+			data := map[string]interface{}{
+				"manifest_url":     latest.ManifestURL,
+				"filename":         epubFilename,
+				"job_id":           jobID,
+				"duplicate_of_job": latest.ID,
 			}
-			if link.MediaType != nil {
-				item["type"] = link.MediaType.String()
+			if job.ExpiresAt != nil {
+				data["expires_at"] = job.ExpiresAt
 			}
-			content = append(content, item)
-		}
-	}
-
-	contentData := map[string]interface{}{
-		"metadata": map[string]interface{}{
-			"numberOfItems": len(content),
-		},
-		"structure": content,
-	}
-
-	return json.MarshalIndent(contentData, "", "  ")
-}
-
-// generateManifestWithSupabaseURLs creates a new manifest with all URLs pointing to Supabase
-func generateManifestWithSupabaseURLs(manifest *manifest.Manifest, resourceMap map[string]string, basePath, supabaseURL string) ([]byte, error) {
-	// Construct manifest URL for self reference
-	manifestPath := fmt.Sprintf("%s/manifest.json", basePath)
-	manifestURL := fmt.Sprintf("%s/storage/v1/object/public/%s/%s", strings.TrimSuffix(supabaseURL, "/"), manifestBucket, manifestPath)
-
-	// Create a new manifest structure with updated URLs
-	updatedManifest := map[string]interface{}{
-		"@context": "https://readium.org/webpub-manifest/context.jsonld",
-		"metadata": manifest.Metadata,
-	}
-
-	// Update reading order with relative paths
-	readingOrder := make([]map[string]interface{}, 0, len(manifest.ReadingOrder))
-	for _, link := range manifest.ReadingOrder {
-		hrefStr := link.Href.String()
-		// Use relative path (relative to manifest.json location)
-		// Remove leading slash if present to ensure it's a relative path
-		relativeHref := strings.TrimPrefix(hrefStr, "/")
-
-		item := map[string]interface{}{
-			"href": relativeHref,
-		}
-		if link.MediaType != nil {
-			item["type"] = link.MediaType.String()
-		}
-		if link.Title != "" {
-			item["title"] = link.Title
+			return createSuccessResponse("EPUB already processed", data), nil
 		}
-		readingOrder = append(readingOrder, item)
 	}
-	updatedManifest["readingOrder"] = readingOrder
 
-	// Update table of contents with Supabase URLs
-	if len(manifest.TableOfContents) > 0 {
-		toc := make([]map[string]interface{}, 0, len(manifest.TableOfContents))
-		for _, link := range manifest.TableOfContents {
-			tocItem := convertTOCLink(link, resourceMap, basePath, supabaseURL)
-			toc = append(toc, tocItem)
+	// Refuse infected files before the parser opens them (no-op unless CLAMD_ADDRESS or
+	// CLAMSCAN_PATH is configured). A failing scanner fails the job rather than skipping the scan.
+	if scanner := newVirusScannerFromEnv(); scanner != nil {
+		scan, err := scanner.scan(ctx, source)
+		if err != nil {
+			log.Printf("Error scanning EPUB: %v", err)
+			return failJob("scan", processor.WithStatus(503, err), fmt.Sprintf("Failed to scan EPUB for viruses: %v", err), nil), nil
 		}
-		if len(toc) > 0 {
-			updatedManifest["toc"] = toc
+		if scan.Infected {
+			log.Printf("EPUB is infected: %s", scan.Signature)
+			err := processor.WithStatus(422, fmt.Errorf("EPUB is infected (%s)", scan.Signature))
+			return failJob("scan", err, err.Error(), map[string]interface{}{"virus_scan": scan}), nil
 		}
+		log.Printf("Virus scan with %s found nothing", scan.Scanner)
 	}
 
-	// Extract landmarks from Links and TOC
-	// Common landmark rels: "contents", "start", "copyright", etc.
-	landmarkRels := map[string]bool{
-		"contents":  true,
-		"start":     true,
-		"copyright": true,
+	// Report the progress of the upload (no-op without progress_channel or job tracking)
+	if progress := newProgressPublisher(ctx, jobs, job, supabaseURL, supabaseServiceKey, processRequest.ProgressChannel); progress != nil {
+		proc = proc.WithProgress(progress.publish, progressIntervalFromEnv())
 	}
-	landmarks := make([]map[string]interface{}, 0)
-	landmarkHrefs := make(map[string]bool) // Track added landmarks to avoid duplicates
 
-	// First, extract landmarks from manifest.Links
-	for _, link := range manifest.Links {
-		// Check if this link has a rel that indicates it's a landmark
-		isLandmark := false
-		for _, rel := range link.Rels {
-			if landmarkRels[rel] {
-				isLandmark = true
-				break
-			}
-		}
-		// Also check if it's a landmark by title pattern (some EPUBs don't use rels)
-		if !isLandmark && (link.Title == "Table of Contents" || link.Title == "Begin Reading" || link.Title == "Copyright Page") {
-			isLandmark = true
-		}
-
-		if isLandmark {
-			hrefStr := link.Href.String()
-			// Use relative path (relative to manifest.json location)
-			// Remove leading slash if present to ensure it's a relative path
-			relativeHref := strings.TrimPrefix(hrefStr, "/")
-
-			item := map[string]interface{}{
-				"href": relativeHref,
-			}
-			if link.Title != "" {
-				item["title"] = link.Title
-			}
-			landmarks = append(landmarks, item)
-			landmarkHrefs[hrefStr] = true
-		}
+	// Process EPUB with Readium toolkit
+	result, err = proc.Process(source, epubFilename, processRequest.Options)
+	var held *processor.LockHeldError
+	if errors.As(err, &held) {
+		return failJob("lock", err, fmt.Sprintf("EPUB is already being processed by job %s", held.Holder.JobID), map[string]interface{}{
+			"job_id":     held.Holder.JobID,
+			"started_at": held.Holder.AcquiredAt,
+		}), nil
 	}
-
-	// Also check TOC for common landmark patterns (Table of Contents, Begin Reading, Copyright)
-	if len(manifest.TableOfContents) > 0 {
-		for _, link := range manifest.TableOfContents {
-			hrefStr := link.Href.String()
-			// Skip if already added
-			if landmarkHrefs[hrefStr] {
-				continue
-			}
-
-			title := strings.ToLower(link.Title)
-			isLandmark := false
-			landmarkTitle := ""
-
-			// Check for common landmark titles
-			if strings.Contains(title, "table of contents") || strings.Contains(title, "contents") || strings.Contains(title, "toc") {
-				isLandmark = true
-				landmarkTitle = "Table of Contents"
-			} else if strings.Contains(title, "begin reading") || strings.Contains(title, "start") {
-				isLandmark = true
-				landmarkTitle = "Begin Reading"
-			} else if strings.Contains(title, "copyright") {
-				isLandmark = true
-				landmarkTitle = "Copyright Page"
-			}
-
-			if isLandmark {
-				// Use relative path (relative to manifest.json location)
-				// Remove leading slash if present to ensure it's a relative path
-				relativeHref := strings.TrimPrefix(hrefStr, "/")
-				item := map[string]interface{}{
-					"href": relativeHref,
-				}
-				if landmarkTitle != "" {
-					item["title"] = landmarkTitle
-				} else if link.Title != "" {
-					item["title"] = link.Title
-				}
-				landmarks = append(landmarks, item)
-				landmarkHrefs[hrefStr] = true
-			}
+	if err != nil {
+		log.Printf("Error processing EPUB: %v", err)
+		var data any
+		if report := processor.DebugReportOf(err); report != nil {
+			report.AddFetch(sourceName, fetchTime)
+			data = map[string]interface{}{"debug": report}
 		}
+		return failJob("process", err, fmt.Sprintf("Failed to process EPUB: %v", err), data), nil
 	}
+	result.Debug.AddFetch(sourceName, fetchTime)
 
-	// If no landmarks found, try to infer from reading order (first item = Begin Reading)
-	if len(landmarks) == 0 && len(manifest.ReadingOrder) > 0 {
-		firstLink := manifest.ReadingOrder[0]
-		hrefStr := firstLink.Href.String()
-		// Use relative path (relative to manifest.json location)
-		// Remove leading slash if present to ensure it's a relative path
-		relativeHref := strings.TrimPrefix(hrefStr, "/")
-		landmarks = append(landmarks, map[string]interface{}{
-			"href":  relativeHref,
-			"title": "Begin Reading",
-		})
-	}
-
-	if len(landmarks) > 0 {
-		updatedManifest["landmarks"] = landmarks
+	job.Status = jobStatusSucceeded
+	job.ManifestURL = result.ManifestURL
+	// A path template using metadata only tells where the publication goes once parsed
+	if result.BasePath != "" {
+		job.BasePath = result.BasePath
 	}
+	logJobError("update", jobs.finish(ctx, job))
 
-	// Build links array - always include required Readium links
-	links := make([]map[string]interface{}, 0)
-
-	// Add self reference (required)
-	links = append(links, map[string]interface{}{
-		"href": manifestURL,
-		"rel":  "self",
-		"type": "application/webpub+json",
-	})
-
-	// Add Readium-specific links (content.json and positions.json)
-	// Use relative paths: readium/content.json (without ~) since:
-	// 1. Supabase doesn't allow ~ in storage keys, so we store at readium/
-	// 2. Readers will resolve relative to manifest: {basePath}/readium/content.json
-	// 3. This matches where we actually stored the files
-	links = append(links, map[string]interface{}{
-		"href": "readium/content.json",
-		"type": "application/vnd.readium.content+json",
-	})
-	links = append(links, map[string]interface{}{
-		"href": "readium/positions.json",
-		"type": "application/vnd.readium.position-list+json",
-	})
-
-	// Extract license links from manifest.Links (they may have rel="http://creativecommons.org/ns#license")
-	// We'll add these when processing manifest.Links below
-
-	// Add non-landmark links from manifest.Links
-	for _, link := range manifest.Links {
-		// Skip links that are landmarks (already added above)
-		isLandmark := false
-		for _, rel := range link.Rels {
-			if landmarkRels[rel] {
-				isLandmark = true
-				break
-			}
+	if processRequest.ValidateOnly {
+		data := map[string]interface{}{
+			"filename":   epubFilename,
+			"job_id":     jobID,
+			"warnings":   result.Warnings,
+			"validation": result.Validation,
 		}
-		if isLandmark {
-			continue
-		}
-
-		hrefStr := link.Href.String()
-		// Use relative paths for internal links, keep external URLs as-is
-		if !strings.HasPrefix(hrefStr, "http://") && !strings.HasPrefix(hrefStr, "https://") && !strings.HasPrefix(hrefStr, "~") {
-			// Use relative path (relative to manifest.json location)
-			// Remove leading slash if present to ensure it's a relative path
-			hrefStr = strings.TrimPrefix(hrefStr, "/")
+		if result.Debug != nil {
+			data["debug"] = result.Debug
 		}
+		return createSuccessResponse("EPUB validated", data), nil
+	}
 
-		item := map[string]interface{}{
-			"href": hrefStr,
-		}
-		if link.MediaType != nil {
-			item["type"] = link.MediaType.String()
+	if processRequest.Estimate {
+		data := map[string]interface{}{
+			"filename": epubFilename,
+			"job_id":   jobID,
+			"estimate": result.Estimate,
 		}
-		if len(link.Rels) > 0 {
-			if len(link.Rels) == 1 {
-				item["rel"] = link.Rels[0]
-			} else {
-				item["rel"] = link.Rels
-			}
+		if result.Debug != nil {
+			data["debug"] = result.Debug
 		}
-		links = append(links, item)
+		return createSuccessResponse("EPUB estimated", data), nil
 	}
 
-	// Always include links array (required by Readium spec)
-	updatedManifest["links"] = links
-
-	// Update resources with relative paths
-	resources := make([]map[string]interface{}, 0, len(manifest.Resources))
-	for _, link := range manifest.Resources {
-		hrefStr := link.Href.String()
-		// Use relative path (relative to manifest.json location)
-		// Remove leading slash if present to ensure it's a relative path
-		relativeHref := strings.TrimPrefix(hrefStr, "/")
-
-		item := map[string]interface{}{
-			"href": relativeHref,
+	if processRequest.Diff {
+		data := map[string]interface{}{
+			"filename": epubFilename,
+			"job_id":   jobID,
+			"diff":     result.Diff,
 		}
-		if link.MediaType != nil {
-			item["type"] = link.MediaType.String()
+		if len(result.Warnings) > 0 {
+			data["warnings"] = result.Warnings
 		}
-
-		// Add rel="contents" for TOC resources
-		if strings.Contains(hrefStr, "toc.xhtml") || strings.Contains(hrefStr, "toc.ncx") {
-			item["rel"] = "contents"
+		if len(result.ParserWarnings) > 0 {
+			data["parser_warnings"] = result.ParserWarnings
 		}
-
-		// Include any existing rel values from the link
-		if len(link.Rels) > 0 {
-			rels := make([]string, 0, len(link.Rels))
-			for _, rel := range link.Rels {
-				rels = append(rels, rel)
-			}
-			if len(rels) == 1 {
-				item["rel"] = rels[0]
-			} else if len(rels) > 1 {
-				item["rel"] = rels
-			}
+		if result.Debug != nil {
+			data["debug"] = result.Debug
 		}
-
-		resources = append(resources, item)
+		message := "Manifest unchanged"
+		if result.Diff.Changed() {
+			message = "Reprocessing would change the manifest"
+		}
+		return createSuccessResponse(message, data), nil
 	}
-	if len(resources) > 0 {
-		updatedManifest["resources"] = resources
+
+	data := result.ResponseData(processRequest.Options)
+	data["filename"] = epubFilename
+	data["job_id"] = jobID
+	if job.ExpiresAt != nil {
+		data["expires_at"] = job.ExpiresAt
 	}
 
-	// Marshal to JSON
-	manifestJSON, err := json.MarshalIndent(updatedManifest, "", "  ")
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	// Readers behind a CDN would see the previous version of what was replaced
+	// until it expires (no-op unless CDN_PURGE_PROVIDER is configured)
+	if purger := newCDNPurgerFromEnv(); purger != nil && len(result.Overwritten) > 0 {
+		urls := purger.urls(store, supabaseURL, result.Overwritten)
+		if err := purger.purge(ctx, jobID, urls); err != nil {
+			log.Printf("Warning: failed to purge the CDN: %v", err)
+		} else {
+			log.Printf("Purged %d overwritten URLs from the CDN", len(urls))
+		}
 	}
+	cache.store(cacheKey, manifestCacheEntry{
+		SourceHash:  job.SourceHash,
+		JobID:       jobID,
+		ManifestURL: result.ManifestURL,
+		Data:        data,
+		StoredAt:    time.Now(),
+	})
 
-	return manifestJSON, nil
+	return createSuccessResponse("EPUB processed successfully", data), nil
 }
 
-// getContentType determines the content type based on file extension and path
-func getContentType(path string) string {
-	pathLower := strings.ToLower(path)
-	
-	// Check for specific Readium JSON files first
-	if strings.HasSuffix(pathLower, "manifest.json") {
-		return "application/webpub+json; charset=utf-8"
-	}
-	if strings.HasSuffix(pathLower, "content.json") {
-		return "application/vnd.readium.content+json; charset=utf-8"
-	}
-	if strings.HasSuffix(pathLower, "positions.json") {
-		return "application/vnd.readium.position-list+json; charset=utf-8"
+// handleJobStatus returns the tracked state of a processing job. In
+// multi-tenant deployments, tenants only see their own jobs.
+func handleJobStatus(ctx context.Context, request events.LambdaFunctionURLRequest, jobID string) events.LambdaFunctionURLResponse {
+	tenant, err := tenantFor(request)
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
 	}
-	
-	// Check file extension for other files
-	ext := strings.ToLower(filepath.Ext(path))
-	switch ext {
-	case ".json":
-		return "application/json; charset=utf-8"
-	case ".html", ".htm":
-		return "text/html"
-	case ".xhtml":
-		return "application/xhtml+xml"
-	case ".css":
-		return "text/css"
-	case ".js":
-		return "application/javascript"
-	case ".png":
-		return "image/png"
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".gif":
-		return "image/gif"
-	case ".svg":
-		return "image/svg+xml"
-	case ".xml":
-		return "application/xml"
-	case ".ncx":
-		return "application/x-dtbncx+xml"
-	case ".opf":
-		return "application/oebps-package+xml"
-	default:
-		return "application/octet-stream"
+	jobs := newJobStoreFromEnv()
+	if jobs == nil {
+		return createErrorResponse(404, "Job tracking is not enabled (JOBS_TABLE_NAME is not set)")
 	}
-}
-
-// uploadToSupabase uploads data to Supabase storage
-func uploadToSupabase(path string, data []byte, bucket, supabaseURL, serviceKey string) (string, error) {
-	// Construct upload URL
-	uploadURL := fmt.Sprintf("%s/storage/v1/object/%s/%s", strings.TrimSuffix(supabaseURL, "/"), bucket, path)
-
-	// Create HTTP client
-	client := &http.Client{}
 
-	// Create request
-	req, err := http.NewRequest("POST", uploadURL, bytes.NewReader(data))
+	job, err := jobs.get(ctx, jobID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		log.Printf("Error looking up job %s: %v", jobID, err)
+		return createErrorResponse(500, fmt.Sprintf("Failed to look up job: %v", err))
 	}
-
-	// Determine content type from file extension
-	contentType := getContentType(path)
-
-	// Set Supabase authentication headers
-	req.Header.Set("apikey", serviceKey)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", serviceKey))
-	req.Header.Set("Content-Type", contentType)
-	req.Header.Set("x-upsert", "true") // Upsert to allow overwriting
-	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
-	
-	// Set Content-Disposition to inline for JSON files so browsers display them instead of downloading
-	if strings.HasSuffix(strings.ToLower(path), ".json") {
-		req.Header.Set("Content-Disposition", "inline")
+	if job == nil || job.Tenant != tenant.id() || strings.HasPrefix(jobID, publicationKeyPrefix) || strings.HasPrefix(jobID, rateLimitKeyPrefix) {
+		return createErrorResponse(404, fmt.Sprintf("Job %s not found", jobID))
 	}
 
-	// Execute request
-	resp, err := client.Do(req)
+	return createSuccessResponse("Job found", job)
+}
+
+// createSuccessResponse creates a 200 response wrapping data in the standard Response envelope
+func createSuccessResponse(message string, data any) events.LambdaFunctionURLResponse {
+	body, err := json.Marshal(Response{
+		Message: message,
+		Status:  200,
+		Data:    data,
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to execute request: %w", err)
+		log.Printf("Error marshaling response: %v", err)
+		return createErrorResponse(500, "Internal server error")
 	}
-	defer resp.Body.Close()
 
-	// Check status code (Supabase returns 200 for successful uploads)
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
 	}
-
-	// Construct public URL
-	publicURL := fmt.Sprintf("%s/storage/v1/object/public/%s/%s", strings.TrimSuffix(supabaseURL, "/"), bucket, path)
-	return publicURL, nil
 }
 
 func createErrorResponse(statusCode int, message string) events.LambdaFunctionURLResponse {
+	return createErrorResponseWithData(statusCode, message, nil)
+}
+
+// createErrorResponseWithData creates an error response carrying extra details for the caller
+func createErrorResponseWithData(statusCode int, message string, data any) events.LambdaFunctionURLResponse {
 	errorBody := ErrorResponse{
 		Error:  message,
 		Status: statusCode,
+		Data:   data,
 	}
 
 	body, err := json.Marshal(errorBody)
@@ -1189,33 +582,23 @@ func createErrorResponse(statusCode int, message string) events.LambdaFunctionUR
 	}
 }
 
-// bytesAsset implements asset.PublicationAsset for in-memory EPUB data
-type bytesAsset struct {
-	name      string
-	mediaType string
-	fetcher   fetcher.Fetcher
-}
-
-func (a *bytesAsset) Name() string {
-	return a.name
-}
-
-func (a *bytesAsset) MediaType(ctx context.Context) mediatype.MediaType {
-	mt, _ := mediatype.New(a.mediaType, "", "")
-	return mt
-}
-
-func (a *bytesAsset) CreateFetcher(ctx context.Context, dependencies asset.Dependencies, credentials string) (fetcher.Fetcher, error) {
-	return a.fetcher, nil
-}
-
 func init() {
 	// Load .env file for local development and testing (ignores error if file doesn't exist)
-	// In Lambda, environment variables are set directly, so this won't affect production
-	// init() runs before main() and before tests, so .env will be loaded for both
-	_ = godotenv.Load()
+	// In Lambda, environment variables are set directly, so the lookup is skipped there
+	// to keep it off the cold start. init() runs before main() and before tests, so .env
+	// will be loaded for both
+	if os.Getenv(lambdaFunctionNameEnvVar) == "" {
+		_ = godotenv.Load()
+	}
 }
 
 func main() {
-	lambda.Start(handler)
+	serveLocally := flag.Bool("serve", false, "serve the handler over HTTP for local development instead of running as a Lambda")
+	addr := flag.String("addr", defaultServeAddr, "address to listen on with --serve")
+	flag.Parse()
+
+	if *serveLocally {
+		log.Fatal(serve(*addr))
+	}
+	lambda.Start(invoke)
 }
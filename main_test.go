@@ -3,36 +3,43 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"os"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
-)
 
-func setupTestEnv() {
-	// Only set test values if not already set from .env file
-	if os.Getenv(supabaseURLEnvVar) == "" {
-		os.Setenv(supabaseURLEnvVar, "https://test.supabase.co")
-	}
-	if os.Getenv(supabaseServiceKeyEnvVar) == "" {
-		os.Setenv(supabaseServiceKeyEnvVar, "test-service-key")
-	}
-}
+	"readium-processor-lambda/pkg/processor"
+	"readium-processor-lambda/pkg/processor/processortest"
+)
 
-func teardownTestEnv() {
-	os.Unsetenv(supabaseURLEnvVar)
-	os.Unsetenv(supabaseServiceKeyEnvVar)
+// setupTestEnv points the handler at a fake Supabase project
+func setupTestEnv(t *testing.T) *processortest.Supabase {
+	t.Helper()
+	supabase := processortest.NewSupabase()
+	t.Cleanup(supabase.Close)
+	t.Setenv(supabaseURLEnvVar, supabase.URL)
+	t.Setenv(supabaseServiceKeyEnvVar, processortest.ServiceKey)
+	t.Setenv(supabaseReadKeyEnvVar, "")
+	t.Setenv("STORAGE_PROTOCOL", "")
+	t.Setenv("UPLOAD_MODE", "")
+	t.Setenv("OUTPUT_PATH_TEMPLATE", "")
+	t.Setenv(jobsTableEnvVar, "")
+	t.Setenv(sentryDSNEnvVar, "")
+	t.Setenv(rateLimitEnvVar, "")
+	t.Setenv(clamdAddressEnvVar, "")
+	t.Setenv(clamscanPathEnvVar, "")
+	t.Setenv(adminTokenEnvVar, "")
+	t.Setenv(manifestCacheTTLEnvVar, "")
+	t.Setenv(tenantsConfigEnvVar, "")
+	t.Setenv(cdnPurgeProviderEnvVar, "")
+	return supabase
 }
 
-func TestHandler_FilenameInBody(t *testing.T) {
-	ctx := context.Background()
-	setupTestEnv()
-	defer teardownTestEnv()
-
-	testFilename := "books/ec9e1729-f168-4718-baca-028ab1430a03/8c34a7b4-7222-492c-8100-4d25e7fedc87.epub"
-	bodyJSON, _ := json.Marshal(map[string]string{"filename": testFilename})
-
-	request := events.LambdaFunctionURLRequest{
+// postRequest returns a POST request with a JSON body
+func postRequest(body interface{}) events.LambdaFunctionURLRequest {
+	bodyJSON, _ := json.Marshal(body)
+	return events.LambdaFunctionURLRequest{
 		RequestContext: events.LambdaFunctionURLRequestContext{
 			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
 				Method: "POST",
@@ -45,26 +52,146 @@ func TestHandler_FilenameInBody(t *testing.T) {
 			"Content-Type": "application/json",
 		},
 	}
+}
 
-	response, err := handler(ctx, request)
+func TestHandler_FilenameInBody(t *testing.T) {
+	supabase := setupTestEnv(t)
+	testFilename := "books/moby-dick.epub"
+	supabase.Put(processor.EPUBBucket, testFilename, testEPUBBytes(t))
+
+	response, err := handler(context.Background(), postRequest(map[string]interface{}{
+		"filename":      testFilename,
+		"validate_only": true,
+	}))
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var body struct {
+		Data struct {
+			Filename   string                      `json:"filename"`
+			JobID      string                      `json:"job_id"`
+			Validation *processor.ValidationReport `json:"validation"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if body.Data.Filename != testFilename || body.Data.JobID == "" || body.Data.Validation == nil {
+		t.Errorf("Expected the filename, a job ID and a validation report, got %+v", body.Data)
+	}
+
+	// The processing lock is released, and validation uploads nothing
+	if paths := supabase.Paths(processor.ManifestBucket); len(paths) != 0 {
+		t.Errorf("Expected an empty manifest bucket, got %v", paths)
+	}
+}
+
+func TestHandler_Estimate(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+
+	response, err := handler(context.Background(), postRequest(map[string]interface{}{
+		"filename": "books/moby-dick.epub",
+		"estimate": true,
+	}))
 	if err != nil {
 		t.Fatalf("Handler returned error: %v", err)
 	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	var body struct {
+		Message string `json:"message"`
+		Data    struct {
+			Estimate *processor.Estimate `json:"estimate"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if body.Message != "EPUB estimated" || body.Data.Estimate == nil || body.Data.Estimate.Entries == 0 {
+		t.Errorf("Expected an estimate, got %s", response.Body)
+	}
+	if paths := supabase.Paths(processor.ManifestBucket); len(paths) != 0 {
+		t.Errorf("Expected an estimate to store nothing, got %v", paths)
+	}
+}
 
-	// This will likely return 500 if the file doesn't exist, which is expected
-	// For a real test, you'd need a valid Supabase setup or mock the HTTP client
-	if response.StatusCode < 400 {
-		var body Response
-		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
-			t.Fatalf("Failed to unmarshal response: %v", err)
+func TestHandler_S3Protocol(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+	t.Setenv("STORAGE_PROTOCOL", "s3")
+	t.Setenv("SUPABASE_S3_ACCESS_KEY_ID", processortest.S3AccessKeyID)
+	t.Setenv("SUPABASE_S3_SECRET_ACCESS_KEY", processortest.S3SecretAccessKey)
+	t.Setenv("SUPABASE_S3_REGION", "")
+
+	request := postRequest(map[string]interface{}{"filename": "books/moby-dick.epub"})
+	if response, _ := handler(context.Background(), request); response.StatusCode != 500 {
+		t.Errorf("Expected status 500 without an S3 region, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	t.Setenv("SUPABASE_S3_REGION", processortest.S3Region)
+	response, err := handler(context.Background(), request)
+	if err != nil || response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	operations := strings.Join(supabase.S3Operations(), ",")
+	if !strings.Contains(operations, "GetObject") || !strings.Contains(operations, "PutObject") {
+		t.Errorf("Expected the EPUB and the output transferred over S3, got %s", operations)
+	}
+	for _, path := range []string{"books_moby-dick/manifest.json", "books_moby-dick/OEBPS/chapter1.xhtml"} {
+		if _, ok := supabase.Object(processor.ManifestBucket, path); !ok {
+			t.Errorf("Expected %s uploaded, got %v", path, supabase.Paths(processor.ManifestBucket))
 		}
-		t.Logf("Response: %+v", body)
+	}
+}
+
+func TestHandler_SignedUploads(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+	t.Setenv("UPLOAD_MODE", "signed")
+	t.Setenv("UPLOAD_WORKERS", "4")
+
+	response, err := handler(context.Background(), postRequest(map[string]interface{}{"filename": "books/moby-dick.epub"}))
+	if err != nil || response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	paths := supabase.Paths(processor.ManifestBucket)
+	if !slices.Contains(paths, "books_moby-dick/OEBPS/chapter1.xhtml") || !slices.Contains(paths, "books_moby-dick/manifest.json") {
+		t.Fatalf("Expected the chapter and the manifest uploaded, got %v", paths)
+	}
+	if supabase.SignedURLs() != len(paths) || supabase.SignedUploads() != len(paths) {
+		t.Errorf("Expected %v uploaded to signed URLs, got %d URLs signed and %d signed uploads", paths, supabase.SignedURLs(), supabase.SignedUploads())
+	}
+}
+
+func TestHandler_EPUBNotFound(t *testing.T) {
+	setupTestEnv(t)
+
+	response, err := handler(context.Background(), postRequest(map[string]string{"filename": "books/missing.epub"}))
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 500 {
+		t.Errorf("Expected status 500, got %d", response.StatusCode)
+	}
+	var errorBody ErrorResponse
+	if err := json.Unmarshal([]byte(response.Body), &errorBody); err != nil {
+		t.Fatalf("Failed to unmarshal error response: %v", err)
+	}
+	if !strings.Contains(errorBody.Error, "Failed to download EPUB") {
+		t.Errorf("Expected a download error, got %q", errorBody.Error)
 	}
 }
 
 func TestHandler_MissingEnvVars(t *testing.T) {
 	ctx := context.Background()
-	teardownTestEnv()
+	t.Setenv(supabaseURLEnvVar, "")
+	t.Setenv(supabaseServiceKeyEnvVar, "")
 
 	bodyJSON, _ := json.Marshal(map[string]string{"filename": "test.epub"})
 	request := events.LambdaFunctionURLRequest{
@@ -91,14 +218,11 @@ func TestHandler_MissingEnvVars(t *testing.T) {
 	if err := json.Unmarshal([]byte(response.Body), &errorBody); err != nil {
 		t.Fatalf("Failed to unmarshal error response: %v", err)
 	}
-
-	setupTestEnv()
 }
 
 func TestHandler_MethodNotAllowed(t *testing.T) {
 	ctx := context.Background()
-	setupTestEnv()
-	defer teardownTestEnv()
+	setupTestEnv(t)
 
 	request := events.LambdaFunctionURLRequest{
 		RequestContext: events.LambdaFunctionURLRequestContext{
@@ -131,8 +255,7 @@ func TestHandler_MethodNotAllowed(t *testing.T) {
 
 func TestHandler_MissingFilename(t *testing.T) {
 	ctx := context.Background()
-	setupTestEnv()
-	defer teardownTestEnv()
+	setupTestEnv(t)
 
 	request := events.LambdaFunctionURLRequest{
 		RequestContext: events.LambdaFunctionURLRequestContext{
@@ -166,8 +289,7 @@ func TestHandler_MissingFilename(t *testing.T) {
 
 func TestHandler_InvalidFilename_PathTraversal(t *testing.T) {
 	ctx := context.Background()
-	setupTestEnv()
-	defer teardownTestEnv()
+	setupTestEnv(t)
 
 	bodyJSON, _ := json.Marshal(map[string]string{"filename": "../../etc/passwd"})
 	request := events.LambdaFunctionURLRequest{
@@ -195,3 +317,45 @@ func TestHandler_InvalidFilename_PathTraversal(t *testing.T) {
 		t.Fatalf("Failed to unmarshal error response: %v", err)
 	}
 }
+
+func TestHandler_RequestID(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+
+	request := postRequest(map[string]interface{}{"filename": "books/moby-dick.epub", "validate_only": true})
+	request.Headers["x-request-id"] = "app-1234"
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	var body struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if body.RequestID != "app-1234" || response.Headers[requestIDHeader] != "app-1234" {
+		t.Errorf("Expected the caller's request ID back, got %q and header %q", body.RequestID, response.Headers[requestIDHeader])
+	}
+	requestIDs := supabase.RequestIDs()
+	if len(requestIDs) == 0 {
+		t.Fatal("Expected requests to Supabase")
+	}
+	for _, id := range requestIDs {
+		if id != "app-1234" {
+			t.Errorf("Expected every Supabase request to carry the request ID, got %q", id)
+		}
+	}
+
+	// Missing or unusable IDs are replaced with a generated one
+	request.Headers["x-request-id"] = "has spaces\nand newlines"
+	response, _ = handler(context.Background(), request)
+	if id := response.Headers[requestIDHeader]; id == "" || strings.ContainsAny(id, " \n") {
+		t.Errorf("Expected a generated request ID, got %q", id)
+	}
+	response, _ = handler(context.Background(), getRequest("/version"))
+	json.Unmarshal([]byte(response.Body), &body)
+	if body.RequestID == "" || body.RequestID != response.Headers[requestIDHeader] {
+		t.Errorf("Expected a generated request ID in the body and header, got %q and %q", body.RequestID, response.Headers[requestIDHeader])
+	}
+}
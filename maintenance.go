@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// Maintenance tasks run by EventBridge schedules
+const (
+	// taskExpire deletes temporary outputs whose TTL elapsed (see sweepExpired)
+	taskExpire = "expire"
+	// taskGC deletes orphaned outputs (see findOrphanedOutputs)
+	taskGC = "gc"
+	// taskRevalidate checks every publication in the manifest bucket against its
+	// resource index, reporting the files that went missing
+	taskRevalidate = "revalidate"
+)
+
+// maintenanceTask is a maintenance task to run, with its options
+type maintenanceTask struct {
+	Name string `json:"task"`
+	// DryRun reports what gc would delete without deleting it
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// maintenanceEvent holds the fields of the events that start maintenance tasks
+type maintenanceEvent struct {
+	maintenanceTask
+	Source     string          `json:"source"`
+	DetailType string          `json:"detail-type"`
+	Detail     maintenanceTask `json:"detail"`
+}
+
+// maintenanceTaskOf returns the maintenance task requested by an invocation
+// event, if it is one. Schedules name the task either in the constant input of
+// the target, {"task": "gc"}, or in the detail of the event; scheduled events
+// without a task run the expiry sweep.
+func maintenanceTaskOf(raw json.RawMessage) (maintenanceTask, bool) {
+	var event maintenanceEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return maintenanceTask{}, false
+	}
+	switch {
+	case event.Name != "":
+		return event.maintenanceTask, true
+	case event.Source == "aws.events" && event.DetailType == "Scheduled Event":
+		if event.Detail.Name == "" {
+			event.Detail.Name = taskExpire
+		}
+		return event.Detail, true
+	default:
+		return maintenanceTask{}, false
+	}
+}
+
+// handleMaintenance runs a maintenance task. Failures are returned as errors,
+// so the invocation fails and EventBridge retries it.
+func handleMaintenance(ctx context.Context, task maintenanceTask) (interface{}, error) {
+	requestID := requestIDFor(ctx, events.LambdaFunctionURLRequest{})
+	defer logRequestID(requestID)()
+	ctx = withRequestID(ctx, requestID)
+
+	supabaseURL := os.Getenv(supabaseURLEnvVar)
+	supabaseServiceKey := os.Getenv(supabaseServiceKeyEnvVar)
+	if supabaseURL == "" || supabaseServiceKey == "" {
+		return nil, errors.New("SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set")
+	}
+	store := processor.NewSupabase(supabaseURL, supabaseServiceKey).WithRequestID(requestID).WithReadKey(os.Getenv(supabaseReadKeyEnvVar))
+	jobs := newJobStoreFromEnv()
+
+	log.Printf("Running maintenance task %q", task.Name)
+	start := time.Now()
+	var result interface{}
+	var err error
+	switch task.Name {
+	case taskExpire:
+		if jobs == nil {
+			log.Printf("Job tracking is not enabled (JOBS_TABLE_NAME is not set), nothing can expire")
+			result = &expirySweep{Deleted: []string{}, Skipped: []string{}}
+			break
+		}
+		result, err = sweepExpired(ctx, store, jobs, time.Now())
+	case taskGC:
+		result, err = collectOrphans(ctx, store, jobs, !task.DryRun)
+	case taskRevalidate:
+		result, err = revalidatePublications(store)
+	default:
+		return nil, fmt.Errorf("unknown maintenance task %q: must be %q, %q or %q", task.Name, taskExpire, taskGC, taskRevalidate)
+	}
+	if err != nil {
+		log.Printf("Error running maintenance task %q: %v", task.Name, err)
+		return nil, fmt.Errorf("maintenance task %q failed: %w", task.Name, err)
+	}
+	log.Printf("Maintenance task %q finished in %s", task.Name, time.Since(start))
+	return map[string]interface{}{"task": task.Name, "request_id": requestID, "result": result}, nil
+}
+
+// damagedPublication is a publication missing files listed in its resource index
+type damagedPublication struct {
+	BasePath string   `json:"base_path"`
+	Missing  []string `json:"missing,omitempty"`
+	// Error is set when the index itself cannot be read
+	Error string `json:"error,omitempty"`
+}
+
+// revalidation is the outcome of the revalidate task
+type revalidation struct {
+	Publications int                  `json:"publications"`
+	Damaged      []damagedPublication `json:"damaged"`
+}
+
+// revalidatePublications checks that every file recorded in the resource index
+// of each publication is still stored. Damaged publications are reported, to be
+// reprocessed with force.
+func revalidatePublications(store *processor.Supabase) (*revalidation, error) {
+	publications, err := publicationsUnder(store, "")
+	if err != nil {
+		return nil, err
+	}
+	basePaths := make([]string, 0, len(publications))
+	for basePath := range publications {
+		basePaths = append(basePaths, basePath)
+	}
+	sort.Strings(basePaths)
+
+	report := &revalidation{Publications: len(publications), Damaged: []damagedPublication{}}
+	for _, basePath := range basePaths {
+		stored := map[string]bool{}
+		for _, path := range publications[basePath].paths {
+			stored[path] = true
+		}
+
+		damaged := damagedPublication{BasePath: basePath}
+		data, err := store.Download(basePath + "/" + processor.IndexPath)
+		var indexed []string
+		if err == nil {
+			indexed, err = processor.IndexedPaths(data)
+		}
+		if err != nil {
+			damaged.Error = err.Error()
+		}
+		for _, path := range indexed {
+			if !stored[path] {
+				damaged.Missing = append(damaged.Missing, path)
+			}
+		}
+		if damaged.Error != "" {
+			log.Printf("Warning: failed to read the resource index of %s: %s", basePath, damaged.Error)
+		} else if len(damaged.Missing) > 0 {
+			log.Printf("Warning: publication %s is missing %d indexed files", basePath, len(damaged.Missing))
+		}
+		if damaged.Error != "" || len(damaged.Missing) > 0 {
+			report.Damaged = append(report.Damaged, damaged)
+		}
+	}
+	return report, nil
+}
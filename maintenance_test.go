@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestMaintenanceTaskOf(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		task  string
+		ok    bool
+	}{
+		{"constant input", `{"task": "gc", "dry_run": true}`, taskGC, true},
+		{"scheduled event with detail", `{"source": "aws.events", "detail-type": "Scheduled Event", "detail": {"task": "revalidate"}}`, taskRevalidate, true},
+		{"scheduled event", `{"source": "aws.events", "detail-type": "Scheduled Event", "detail": {}}`, taskExpire, true},
+		{"function URL", `{"version": "2.0", "rawPath": "/health", "body": "{\"task\": \"gc\"}"}`, "", false},
+		{"other EventBridge event", `{"source": "aws.s3", "detail-type": "Object Created", "detail": {}}`, "", false},
+	}
+	for _, tt := range tests {
+		task, ok := maintenanceTaskOf(json.RawMessage(tt.event))
+		if ok != tt.ok || task.Name != tt.task {
+			t.Errorf("%s: expected task %q (%t), got %q (%t)", tt.name, tt.task, tt.ok, task.Name, ok)
+		}
+	}
+}
+
+func TestInvoke_MaintenanceTasks(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/kept.epub", []byte("epub"))
+	for _, path := range []string{"books_kept/manifest.json", "books_kept/OEBPS/chapter1.xhtml", "books_gone/manifest.json", "books_gone/" + processor.IndexPath} {
+		supabase.Put(processor.ManifestBucket, path, []byte("data"))
+	}
+	// books_kept has lost a chapter since it was processed
+	supabase.Put(processor.ManifestBucket, "books_kept/"+processor.IndexPath, []byte(`{"version": 1, "resources": {
+		"books_kept/manifest.json": "a", "books_kept/OEBPS/chapter1.xhtml": "b", "books_kept/OEBPS/chapter2.xhtml": "c"}}`))
+
+	result, err := invoke(context.Background(), json.RawMessage(`{"task": "revalidate"}`))
+	if err != nil {
+		t.Fatalf("Expected revalidate to succeed, got %v", err)
+	}
+	report := result.(map[string]interface{})["result"].(*revalidation)
+	// books_gone has an unreadable index
+	if report.Publications != 2 || len(report.Damaged) != 2 {
+		t.Fatalf("Expected both publications to be damaged, got %+v", report)
+	}
+	if kept := report.Damaged[1]; kept.BasePath != "books_kept" || len(kept.Missing) != 1 || kept.Missing[0] != "books_kept/OEBPS/chapter2.xhtml" {
+		t.Errorf("Expected chapter2 to be missing, got %+v", kept)
+	}
+
+	result, err = invoke(context.Background(), json.RawMessage(`{"task": "gc", "dry_run": true}`))
+	if err != nil {
+		t.Fatalf("Expected gc to succeed, got %v", err)
+	}
+	collection := result.(map[string]interface{})["result"].(*orphanCollection)
+	if len(collection.Orphans) != 1 || collection.Deleted {
+		t.Errorf("Expected a dry run finding books_gone, got %+v", collection)
+	}
+	if _, ok := supabase.Object(processor.ManifestBucket, "books_gone/manifest.json"); !ok {
+		t.Error("Expected a dry run to delete nothing")
+	}
+
+	if _, err := invoke(context.Background(), json.RawMessage(`{"task": "gc"}`)); err != nil {
+		t.Fatalf("Expected gc to succeed, got %v", err)
+	}
+	if _, ok := supabase.Object(processor.ManifestBucket, "books_gone/manifest.json"); ok {
+		t.Error("Expected gc to delete books_gone")
+	}
+
+	if _, err := invoke(context.Background(), json.RawMessage(`{"task": "reindex"}`)); err == nil {
+		t.Error("Expected an unknown task to fail the invocation")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// handleManifest returns the stored manifest of the processed publication of
+// an EPUB with its ETag, or a 304 without a body when it matches the
+// If-None-Match of the request, so readers polling for a new version don't
+// download an unchanged manifest again:
+//
+//	GET /manifest?filename=books/moby-dick.epub
+func handleManifest(ctx context.Context, request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	filename := strings.TrimPrefix(request.QueryStringParameters["filename"], "/")
+	if filename == "" {
+		return createErrorResponse(400, "Missing 'filename' query parameter")
+	}
+	if strings.Contains(filename, "..") {
+		return createErrorResponse(400, "Invalid filename: path traversal not allowed")
+	}
+
+	tenant, err := tenantFor(request)
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
+	}
+	supabaseURL, supabaseServiceKey := tenant.supabaseConfig()
+	if supabaseURL == "" || supabaseServiceKey == "" {
+		return createErrorResponse(500, "SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set")
+	}
+	store, err := tenant.storage(processor.NewSupabase(supabaseURL, supabaseServiceKey).WithRequestID(requestIDFrom(ctx)))
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
+	}
+
+	// The publication may have been processed under either storage layout
+	for _, basePath := range processor.BasePaths(filename) {
+		var manifestJSON []byte
+		var etag string
+		manifestJSON, etag, err = processor.StoredManifest(store, basePath)
+		if err != nil {
+			continue
+		}
+		headers := map[string]string{
+			"ETag": etag,
+			// Cached copies must be revalidated, as the manifest changes in place
+			"Cache-Control": "no-cache",
+		}
+		if processor.ETagMatches(requestHeader(request, "If-None-Match"), etag) {
+			return events.LambdaFunctionURLResponse{StatusCode: 304, Headers: headers}
+		}
+		headers["Content-Type"] = "application/webpub+json"
+		return events.LambdaFunctionURLResponse{StatusCode: 200, Headers: headers, Body: string(manifestJSON)}
+	}
+	log.Printf("No manifest for %s: %v", filename, err)
+	return createErrorResponse(404, "No processed publication for "+filename)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestHandler_Manifest(t *testing.T) {
+	supabase := setupTestEnv(t)
+	manifestJSON := `{"metadata": {"title": "Moby-Dick"}, "readingOrder": []}`
+	supabase.Put(processor.ManifestBucket, "books_moby/manifest.json", []byte(manifestJSON))
+
+	request := getRequest("/manifest")
+	request.QueryStringParameters = map[string]string{"filename": "books/moby.epub"}
+	response, _ := handler(context.Background(), request)
+	if response.StatusCode != 200 || response.Body != manifestJSON {
+		t.Fatalf("Expected the manifest, got %d: %s", response.StatusCode, response.Body)
+	}
+	etag := response.Headers["ETag"]
+	if etag != processor.ManifestETag([]byte(manifestJSON)) {
+		t.Errorf("Expected the ETag of the manifest, got %q", etag)
+	}
+
+	request.Headers = map[string]string{"if-none-match": etag}
+	if response, _ := handler(context.Background(), request); response.StatusCode != 304 || response.Body != "" || response.Headers["ETag"] != etag {
+		t.Errorf("Expected 304 for an unchanged manifest, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	// A new version is sent in full
+	supabase.Put(processor.ManifestBucket, "books_moby/manifest.json", []byte(`{"metadata": {"title": "Moby Dick"}}`))
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 || response.Headers["ETag"] == etag {
+		t.Errorf("Expected the changed manifest with a new ETag, got %d: %v", response.StatusCode, response.Headers)
+	}
+
+	request.QueryStringParameters = map[string]string{"filename": "books/gone.epub"}
+	if response, _ := handler(context.Background(), request); response.StatusCode != 404 {
+		t.Errorf("Expected 404 for an unprocessed EPUB, got %d", response.StatusCode)
+	}
+}
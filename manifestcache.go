@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	manifestCacheTTLEnvVar = "MANIFEST_CACHE_TTL_SECONDS"
+	manifestCacheDirEnvVar = "MANIFEST_CACHE_DIR"
+
+	// manifestCacheMaxAge bounds how long an entry is kept to recognize an
+	// unchanged EPUB by its hash, after it stopped being fresh
+	manifestCacheMaxAge = 24 * time.Hour
+)
+
+// manifestCache keeps the outcome of recent jobs in /tmp, which Lambda keeps for
+// the lifetime of the execution environment. A request repeated while its entry
+// is fresh (the frontend retrying, say) is answered without downloading the EPUB
+// again; after that, an EPUB with the hash of the entry isn't processed again.
+// All methods are no-ops on a nil cache.
+type manifestCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// manifestCacheEntry is the outcome of a job, by filename and options
+type manifestCacheEntry struct {
+	SourceHash  string                 `json:"source_hash"`
+	JobID       string                 `json:"job_id"`
+	ManifestURL string                 `json:"manifest_url"`
+	Data        map[string]interface{} `json:"data"`
+	StoredAt    time.Time              `json:"stored_at"`
+}
+
+// newManifestCacheFromEnv returns a cache if MANIFEST_CACHE_TTL_SECONDS is set,
+// or nil if caching is disabled. Entries are stored in MANIFEST_CACHE_DIR, by
+// default a directory of the system's temporary directory.
+func newManifestCacheFromEnv() *manifestCache {
+	value := os.Getenv(manifestCacheTTLEnvVar)
+	if value == "" {
+		return nil
+	}
+	seconds, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		log.Printf("Warning: ignoring invalid %s=%q", manifestCacheTTLEnvVar, value)
+		return nil
+	}
+	if seconds == 0 {
+		return nil
+	}
+	dir := os.Getenv(manifestCacheDirEnvVar)
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "manifest-cache")
+	}
+	return &manifestCache{dir: dir, ttl: time.Duration(seconds) * time.Second}
+}
+
+// manifestCacheKey returns the cache key of a request of the tenant, or "" for
+// requests whose outcome isn't cached: validations, diffs, estimates and
+// temporary outputs
+func manifestCacheKey(request ProcessRequest, tenantID, filename string) string {
+	if request.ValidateOnly || request.Diff || request.Estimate || request.TTLSeconds > 0 {
+		return ""
+	}
+	options := optionsHash(request.Options)
+	if options == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(tenantID + "\x00" + filename + "\x00" + options))
+	return hex.EncodeToString(hash[:])
+}
+
+// optionsHash returns a hash of the processing options, which tell apart the
+// outputs of the same EPUB, or "" if they can't be encoded
+func optionsHash(options processor.Options) string {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// lookup returns the entry stored under key, or nil
+func (c *manifestCache) lookup(key string) *manifestCacheEntry {
+	if c == nil || key == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, key+".json"))
+	if err != nil {
+		return nil
+	}
+	var entry manifestCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || time.Since(entry.StoredAt) > manifestCacheMaxAge {
+		return nil
+	}
+	return &entry
+}
+
+// fresh reports whether the entry is recent enough to answer a request without
+// looking at the EPUB
+func (c *manifestCache) fresh(entry *manifestCacheEntry) bool {
+	return c != nil && entry != nil && time.Since(entry.StoredAt) <= c.ttl
+}
+
+// store records the outcome of a job under key, and drops the entries that are
+// too old to be used. Caching is best-effort: errors are logged.
+func (c *manifestCache) store(key string, entry manifestCacheEntry) {
+	if c == nil || key == "" {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(c.dir, 0o700)
+	}
+	if err == nil {
+		// Written aside and renamed, so a concurrent lookup never reads half an entry
+		tmp := filepath.Join(c.dir, key+".json.tmp")
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, filepath.Join(c.dir, key+".json"))
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: failed to cache manifest: %v", err)
+		return
+	}
+
+	files, _ := os.ReadDir(c.dir)
+	for _, f := range files {
+		if info, err := f.Info(); err == nil && time.Since(info.ModTime()) > manifestCacheMaxAge {
+			os.Remove(filepath.Join(c.dir, f.Name()))
+		}
+	}
+}
+
+// response returns the response data of the job, marked as cached
+func (e *manifestCacheEntry) response() map[string]interface{} {
+	data := e.Data
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["cached"] = true
+	return data
+}
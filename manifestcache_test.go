@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// cacheKeyFor returns the cache key the handler computes for a request for filename
+func cacheKeyFor(t *testing.T, request ProcessRequest, filename string) string {
+	t.Helper()
+	if err := request.Resolve(); err != nil {
+		t.Fatalf("Failed to resolve options: %v", err)
+	}
+	return manifestCacheKey(request, "", filename)
+}
+
+func TestManifestCacheKey(t *testing.T) {
+	plain := cacheKeyFor(t, ProcessRequest{}, "books/moby-dick.epub")
+	if plain == "" {
+		t.Fatalf("Expected a key for a plain request")
+	}
+	if other := cacheKeyFor(t, ProcessRequest{}, "books/leviathan.epub"); other == plain {
+		t.Errorf("Expected another key for another filename")
+	}
+	withOptions := ProcessRequest{}
+	withOptions.Accessibility = true
+	if other := cacheKeyFor(t, withOptions, "books/moby-dick.epub"); other == plain {
+		t.Errorf("Expected another key for other options")
+	}
+	if key := cacheKeyFor(t, ProcessRequest{TTLSeconds: 60}, "books/moby-dick.epub"); key != "" {
+		t.Errorf("Expected no key for a temporary output, got %q", key)
+	}
+}
+
+func TestManifestCache_StoreAndLookup(t *testing.T) {
+	cache := &manifestCache{dir: t.TempDir(), ttl: time.Minute}
+	if entry := cache.lookup("key"); entry != nil {
+		t.Errorf("Expected no entry before storing, got %+v", entry)
+	}
+
+	cache.store("key", manifestCacheEntry{SourceHash: "abc", JobID: "job-1", StoredAt: time.Now()})
+	entry := cache.lookup("key")
+	if entry == nil || entry.SourceHash != "abc" || entry.JobID != "job-1" {
+		t.Fatalf("Expected the stored entry, got %+v", entry)
+	}
+	if !cache.fresh(entry) {
+		t.Errorf("Expected a new entry to be fresh")
+	}
+
+	cache.store("stale", manifestCacheEntry{SourceHash: "abc", StoredAt: time.Now().Add(-time.Hour)})
+	if stale := cache.lookup("stale"); stale == nil || cache.fresh(stale) {
+		t.Errorf("Expected a stale entry to be found but not fresh, got %+v", stale)
+	}
+	cache.store("expired", manifestCacheEntry{StoredAt: time.Now().Add(-2 * manifestCacheMaxAge)})
+	if expired := cache.lookup("expired"); expired != nil {
+		t.Errorf("Expected no entry older than %s, got %+v", manifestCacheMaxAge, expired)
+	}
+
+	var disabled *manifestCache
+	disabled.store("key", manifestCacheEntry{StoredAt: time.Now()})
+	if disabled.lookup("key") != nil || disabled.fresh(entry) {
+		t.Errorf("Expected a nil cache to cache nothing")
+	}
+}
+
+func TestHandler_AnswersFromManifestCache(t *testing.T) {
+	setupTestEnv(t)
+	dir := t.TempDir()
+	t.Setenv(manifestCacheTTLEnvVar, "60")
+	t.Setenv(manifestCacheDirEnvVar, dir)
+
+	// The EPUB isn't in the bucket, so only the cache can answer
+	filename := "books/missing.epub"
+	cache := newManifestCacheFromEnv()
+	cache.store(cacheKeyFor(t, ProcessRequest{}, filename), manifestCacheEntry{
+		SourceHash:  "abc",
+		JobID:       "job-1",
+		ManifestURL: "https://example.com/manifest.json",
+		Data:        map[string]interface{}{"manifest_url": "https://example.com/manifest.json", "job_id": "job-1"},
+		StoredAt:    time.Now(),
+	})
+
+	response, err := handler(context.Background(), postRequest(map[string]string{"filename": filename}))
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if body.Data["job_id"] != "job-1" || body.Data["cached"] != true {
+		t.Errorf("Expected the cached job, got %v", body.Data)
+	}
+
+	// Forcing a reprocess goes to the bucket
+	response, _ = handler(context.Background(), postRequest(map[string]interface{}{"filename": filename, "force": true}))
+	if response.StatusCode == 200 {
+		t.Errorf("Expected force to bypass the cache")
+	}
+}
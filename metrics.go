@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// metricsPath is where --serve exposes the metrics of the server, in the
+// Prometheus text format, for self-hosted deployments without CloudWatch
+const metricsPath = "/metrics"
+
+// durationBuckets are the upper bounds, in seconds, of the buckets of the
+// request duration histogram: from the monitoring routes to the biggest books
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// requestMetrics counts the requests served by --serve
+var requestMetrics = newServerMetrics()
+
+// serverMetrics counts requests by route and status code, and the time the
+// handler took for them. Routes are named by metricsRoute rather than by path,
+// so job IDs and admin routes don't make a series each. It also counts the
+// processing jobs by outcome, and the resources they stored.
+type serverMetrics struct {
+	mu        sync.Mutex
+	requests  map[routeStatus]uint64
+	errors    map[string]uint64
+	durations map[string]*durationHistogram
+	jobs      map[string]uint64
+	// resources counts the resources of the jobs by whether they were uploaded
+	// or skipped, unchanged since the previous run
+	resources     map[string]uint64
+	uploadedBytes uint64
+}
+
+// routeStatus labels the requests counter
+type routeStatus struct {
+	route  string
+	status int
+}
+
+// durationHistogram is a cumulative histogram over durationBuckets
+type durationHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:  map[routeStatus]uint64{},
+		errors:    map[string]uint64{},
+		durations: map[string]*durationHistogram{},
+		jobs:      map[string]uint64{},
+		resources: map[string]uint64{},
+	}
+}
+
+// metricsRoute names the route of request after the route handleRequest
+// dispatches it to (see routes)
+func metricsRoute(request events.LambdaFunctionURLRequest) string {
+	method := request.RequestContext.HTTP.Method
+	if method == "OPTIONS" {
+		return "preflight"
+	}
+	if route := routeFor(request); route != nil {
+		return route.name
+	}
+	if method == "POST" {
+		return "process"
+	}
+	return "other"
+}
+
+// observe records a request to route answered with status after duration.
+// Server errors (5xx) are also counted as errors.
+func (m *serverMetrics) observe(route string, status int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[routeStatus{route, status}]++
+	if status >= 500 {
+		m.errors[route]++
+	}
+	histogram, ok := m.durations[route]
+	if !ok {
+		histogram = &durationHistogram{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[route] = histogram
+	}
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.sum += seconds
+	histogram.count++
+}
+
+// observeJob records a processing job that ended with outcome (its status),
+// and what it stored according to result, nil for jobs that didn't process
+func (m *serverMetrics) observeJob(outcome string, result *processor.Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[outcome]++
+	if result != nil {
+		m.resources["uploaded"] += uint64(result.Uploaded)
+		m.resources["skipped"] += uint64(result.Skipped)
+		m.uploadedBytes += uint64(result.UploadedBytes)
+	}
+}
+
+// write writes the metrics to w in the Prometheus text exposition format,
+// series sorted by labels so scrapes are stable
+func (m *serverMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP readium_processor_requests_total Requests handled, by route and status code.")
+	fmt.Fprintln(w, "# TYPE readium_processor_requests_total counter")
+	labels := make([]routeStatus, 0, len(m.requests))
+	for label := range m.requests {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].route != labels[j].route {
+			return labels[i].route < labels[j].route
+		}
+		return labels[i].status < labels[j].status
+	})
+	for _, label := range labels {
+		fmt.Fprintf(w, "readium_processor_requests_total{route=%q,status=\"%d\"} %d\n", label.route, label.status, m.requests[label])
+	}
+
+	fmt.Fprintln(w, "# HELP readium_processor_request_errors_total Requests that failed with a server error, by route.")
+	fmt.Fprintln(w, "# TYPE readium_processor_request_errors_total counter")
+	for _, route := range sortedKeys(m.errors) {
+		fmt.Fprintf(w, "readium_processor_request_errors_total{route=%q} %d\n", route, m.errors[route])
+	}
+
+	fmt.Fprintln(w, "# HELP readium_processor_request_duration_seconds Time the handler took to answer, by route.")
+	fmt.Fprintln(w, "# TYPE readium_processor_request_duration_seconds histogram")
+	for _, route := range sortedKeys(m.durations) {
+		histogram := m.durations[route]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "readium_processor_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, formatFloat(bound), histogram.buckets[i])
+		}
+		fmt.Fprintf(w, "readium_processor_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, histogram.count)
+		fmt.Fprintf(w, "readium_processor_request_duration_seconds_sum{route=%q} %s\n", route, formatFloat(histogram.sum))
+		fmt.Fprintf(w, "readium_processor_request_duration_seconds_count{route=%q} %d\n", route, histogram.count)
+	}
+
+	fmt.Fprintln(w, "# HELP readium_processor_jobs_total Processing jobs finished, by outcome.")
+	fmt.Fprintln(w, "# TYPE readium_processor_jobs_total counter")
+	for _, outcome := range sortedKeys(m.jobs) {
+		fmt.Fprintf(w, "readium_processor_jobs_total{outcome=%q} %d\n", outcome, m.jobs[outcome])
+	}
+
+	fmt.Fprintln(w, "# HELP readium_processor_resources_total Resources of the processed publications, by whether they were uploaded or skipped unchanged.")
+	fmt.Fprintln(w, "# TYPE readium_processor_resources_total counter")
+	for _, state := range sortedKeys(m.resources) {
+		fmt.Fprintf(w, "readium_processor_resources_total{state=%q} %d\n", state, m.resources[state])
+	}
+
+	fmt.Fprintln(w, "# HELP readium_processor_uploaded_bytes_total Bytes stored by the processing jobs.")
+	fmt.Fprintln(w, "# TYPE readium_processor_uploaded_bytes_total counter")
+	fmt.Fprintf(w, "readium_processor_uploaded_bytes_total %d\n", m.uploadedBytes)
+}
+
+// serveMetrics answers GET /metrics
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	requestMetrics.write(w)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatFloat formats v the way Prometheus parses it back
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
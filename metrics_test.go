@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestMetricsRoute(t *testing.T) {
+	for _, tc := range []struct {
+		method, path, want string
+	}{
+		{"GET", "/health", "health"},
+		{"GET", "/manifest", "manifest"},
+		{"GET", "/jobs/0b7c", "job_status"},
+		{"POST", "/jobs/0b7c", "process"},
+		{"POST", adminPathPrefix + "gc", "admin"},
+		{"POST", "/", "process"},
+		{"OPTIONS", "/", "preflight"},
+		{"PUT", "/", "other"},
+	} {
+		request := events.LambdaFunctionURLRequest{RawPath: tc.path}
+		request.RequestContext.HTTP.Method = tc.method
+		if got := metricsRoute(request); got != tc.want {
+			t.Errorf("Expected %q for %s %s, got %q", tc.want, tc.method, tc.path, got)
+		}
+	}
+}
+
+func TestServerMetrics_Write(t *testing.T) {
+	m := newServerMetrics()
+	m.observe("process", 200, 3*time.Second)
+	m.observe("process", 500, 40*time.Second)
+	m.observe("health", 200, 10*time.Millisecond)
+	m.observeJob("succeeded", &processor.Result{Uploaded: 3, Skipped: 2, UploadedBytes: 4096})
+	m.observeJob("succeeded", &processor.Result{Uploaded: 1, UploadedBytes: 1024})
+	m.observeJob("failed", nil)
+
+	var out strings.Builder
+	m.write(&out)
+	for _, line := range []string{
+		"# TYPE readium_processor_requests_total counter",
+		`readium_processor_requests_total{route="process",status="200"} 1`,
+		`readium_processor_requests_total{route="process",status="500"} 1`,
+		`readium_processor_request_errors_total{route="process"} 1`,
+		"# TYPE readium_processor_request_duration_seconds histogram",
+		`readium_processor_request_duration_seconds_bucket{route="process",le="5"} 1`,
+		`readium_processor_request_duration_seconds_bucket{route="process",le="60"} 2`,
+		`readium_processor_request_duration_seconds_bucket{route="process",le="+Inf"} 2`,
+		`readium_processor_request_duration_seconds_sum{route="process"} 43`,
+		`readium_processor_request_duration_seconds_count{route="health"} 1`,
+		`readium_processor_jobs_total{outcome="failed"} 1`,
+		`readium_processor_jobs_total{outcome="succeeded"} 2`,
+		`readium_processor_resources_total{state="skipped"} 2`,
+		`readium_processor_resources_total{state="uploaded"} 4`,
+		"readium_processor_uploaded_bytes_total 5120",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected %q in the metrics, got:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `readium_processor_request_errors_total{route="health"}`) {
+		t.Errorf("Expected no errors counted for health")
+	}
+	if strings.Index(out.String(), `{route="health",status="200"}`) > strings.Index(out.String(), `{route="process",status="200"}`) {
+		t.Errorf("Expected the series sorted by route")
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	serveHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/", nil))
+
+	recorder := httptest.NewRecorder()
+	serveMetrics(recorder, httptest.NewRequest("GET", metricsPath, nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %q", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), `readium_processor_requests_total{route="other",status="405"}`) {
+		t.Errorf("Expected the served request to be counted, got:\n%s", recorder.Body.String())
+	}
+}
+
+func TestHandler_CountsJobMetrics(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+	defer func(m *serverMetrics) { requestMetrics = m }(requestMetrics)
+	requestMetrics = newServerMetrics()
+
+	response, err := handler(context.Background(), postRequest(map[string]string{"filename": "books/moby-dick.epub"}))
+	if err != nil || response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	handler(context.Background(), postRequest(map[string]string{"filename": "books/missing.epub"}))
+
+	var out strings.Builder
+	requestMetrics.write(&out)
+	for _, line := range []string{
+		`readium_processor_jobs_total{outcome="succeeded"} 1`,
+		`readium_processor_jobs_total{outcome="failed"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected %q in the metrics, got:\n%s", line, out.String())
+		}
+	}
+	if requestMetrics.resources["uploaded"] == 0 || requestMetrics.uploadedBytes == 0 {
+		t.Errorf("Expected the uploaded resources counted, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,211 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// accessibilityReportPath is where the accessibility report is stored, next to
+// the manifest
+const accessibilityReportPath = "accessibility.json"
+
+// The accessibility rules checked on every content document, named after their
+// Ace (axe-core) counterparts
+const (
+	ruleHeadingOrder = "heading-order" // a heading skips a level
+	ruleHTMLLang     = "html-has-lang" // the document has no language
+	ruleLinkName     = "link-name"     // a link has no text alternative
+	ruleTableHeaders = "table-headers" // a table has no header cells
+)
+
+// AccessibilityReport is the outcome of the accessibility checks run on the
+// content documents when options.Accessibility is set
+type AccessibilityReport struct {
+	AltText AltTextAudit `json:"alt_text"`
+	// Violations counts the violations of each rule
+	Violations map[string]int `json:"violations"`
+	// Findings lists the violations, in reading order
+	Findings []accessibilityFinding `json:"findings"`
+}
+
+// AltTextAudit counts the images of content documents without a text alternative
+type AltTextAudit struct {
+	Images int `json:"images"`
+	// Missing counts the images without an alt attribute
+	Missing int `json:"missing"`
+	// Empty counts the images with an empty alt attribute, which marks them as
+	// decorative: worth a look, as it is often the default of authoring tools
+	Empty     int               `json:"empty"`
+	Resources []altTextDocument `json:"resources"`
+}
+
+// altTextDocument lists the images of one content document without alt text, by src
+type altTextDocument struct {
+	Document string   `json:"document"`
+	Missing  []string `json:"missing,omitempty"`
+	Empty    []string `json:"empty,omitempty"`
+}
+
+// accessibilityFinding is a violation of a rule in a content document
+type accessibilityFinding struct {
+	Rule     string `json:"rule"`
+	Document string `json:"document"`
+	Detail   string `json:"detail"`
+}
+
+// accessibilityAuditor runs the accessibility checks on content documents as
+// they are extracted. A nil auditor checks nothing.
+type accessibilityAuditor struct {
+	report AccessibilityReport
+}
+
+func newAccessibilityAuditor() *accessibilityAuditor {
+	return &accessibilityAuditor{report: AccessibilityReport{
+		AltText:    AltTextAudit{Resources: []altTextDocument{}},
+		Violations: map[string]int{ruleHeadingOrder: 0, ruleHTMLLang: 0, ruleLinkName: 0, ruleTableHeaders: 0},
+		Findings:   []accessibilityFinding{},
+	}}
+}
+
+// checkDocument runs the checks on the content document at href
+func (a *accessibilityAuditor) checkDocument(href string, content []byte) {
+	if a == nil {
+		return
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	document := altTextDocument{Document: href}
+	headingLevel := 0 // of the last heading, 0 before the first
+	// linkDepth is the nesting depth inside the current link, 0 outside links
+	linkDepth, linkHref, linkNamed := 0, "", false
+	// tables holds whether each open table has header cells, innermost last
+	var tables []bool
+	tableCount := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			attrs := accessibilityAttributes(t.Attr)
+			if linkDepth > 0 {
+				linkDepth++
+				if hasAccessibleName(attrs) || name == "img" && strings.TrimSpace(attrs["alt"]) != "" {
+					linkNamed = true
+				}
+			}
+			switch {
+			case name == "html":
+				if _, ok := attrs["lang"]; !ok {
+					a.report.add(ruleHTMLLang, href, "the html element has no lang or xml:lang attribute")
+				}
+			case headingElements[name]:
+				level, _ := strconv.Atoi(name[1:])
+				if headingLevel > 0 && level > headingLevel+1 {
+					a.report.add(ruleHeadingOrder, href, fmt.Sprintf("h%d follows h%d", level, headingLevel))
+				}
+				headingLevel = level
+			case name == "a" && linkDepth == 0:
+				if target, ok := attrs["href"]; ok {
+					linkDepth, linkHref, linkNamed = 1, target, hasAccessibleName(attrs)
+				}
+			case name == "table":
+				tableCount++
+				role := strings.ToLower(attrs["role"])
+				// Layout tables need no header cells
+				tables = append(tables, role == "presentation" || role == "none")
+			case name == "th":
+				if len(tables) > 0 {
+					tables[len(tables)-1] = true
+				}
+			case name == "img":
+				a.auditImage(&document, attrs)
+			}
+		case xml.EndElement:
+			if linkDepth > 0 {
+				if linkDepth--; linkDepth == 0 && !linkNamed {
+					a.report.add(ruleLinkName, href, fmt.Sprintf("the link to %q has no text", linkHref))
+				}
+			}
+			if strings.EqualFold(t.Name.Local, "table") && len(tables) > 0 {
+				if !tables[len(tables)-1] {
+					a.report.add(ruleTableHeaders, href, fmt.Sprintf("table %d has no header cells", tableCount))
+				}
+				tables = tables[:len(tables)-1]
+			}
+		case xml.CharData:
+			if linkDepth > 0 && len(bytes.TrimSpace(t)) > 0 {
+				linkNamed = true
+			}
+		}
+	}
+	if len(document.Missing) > 0 || len(document.Empty) > 0 {
+		a.report.AltText.Resources = append(a.report.AltText.Resources, document)
+	}
+}
+
+// auditImage records an image of document without alt text
+func (a *accessibilityAuditor) auditImage(document *altTextDocument, attrs map[string]string) {
+	audit := &a.report.AltText
+	audit.Images++
+	alt, hasAlt := attrs["alt"]
+	switch {
+	case !hasAlt:
+		audit.Missing++
+		document.Missing = append(document.Missing, attrs["src"])
+	case strings.TrimSpace(alt) == "":
+		audit.Empty++
+		document.Empty = append(document.Empty, attrs["src"])
+	}
+}
+
+// add records a violation of rule in document
+func (r *AccessibilityReport) add(rule, document, detail string) {
+	r.Violations[rule]++
+	r.Findings = append(r.Findings, accessibilityFinding{Rule: rule, Document: document, Detail: detail})
+}
+
+// accessibilityAttributes returns the attributes of an element by lowercased
+// local name, so lang and xml:lang both read as "lang"
+func accessibilityAttributes(attrs []xml.Attr) map[string]string {
+	values := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		values[strings.ToLower(attr.Name.Local)] = attr.Value
+	}
+	return values
+}
+
+// hasAccessibleName reports whether an element is named by an aria-label or title
+func hasAccessibleName(attrs map[string]string) bool {
+	return strings.TrimSpace(attrs["aria-label"]) != "" || strings.TrimSpace(attrs["title"]) != ""
+}
+
+// finish returns the report, or nil for a nil auditor
+func (a *accessibilityAuditor) finish() *AccessibilityReport {
+	if a == nil {
+		return nil
+	}
+	return &a.report
+}
+
+// generateAccessibilityJSON returns the report uploaded next to the manifest,
+// or nil for a nil auditor
+func (a *accessibilityAuditor) generateAccessibilityJSON() ([]byte, error) {
+	if a == nil {
+		return nil, nil
+	}
+	data, err := json.MarshalIndent(a.report, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal accessibility report: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccessibilityAuditor_AltText(t *testing.T) {
+	a := newAccessibilityAuditor()
+	a.checkDocument("OEBPS/chapter1.xhtml", []byte(`<html><body>
+<img src="images/whale.jpg" alt="A sperm whale breaching"/>
+<img src="images/map.png"/>
+<IMG SRC="images/rule.png" alt="  "/>
+</body></html>`))
+	a.checkDocument("OEBPS/chapter2.xhtml", []byte(`<html><body><img src="images/ship.jpg" alt="The Pequod"/></body></html>`))
+
+	audit := a.finish().AltText
+	if audit.Images != 4 || audit.Missing != 1 || audit.Empty != 1 {
+		t.Errorf("Expected 4 images, 1 missing and 1 empty alt, got %+v", audit)
+	}
+	if len(audit.Resources) != 1 {
+		t.Fatalf("Expected only chapter 1 to be reported, got %+v", audit.Resources)
+	}
+	document := audit.Resources[0]
+	if document.Document != "OEBPS/chapter1.xhtml" || len(document.Missing) != 1 || document.Missing[0] != "images/map.png" ||
+		len(document.Empty) != 1 || document.Empty[0] != "images/rule.png" {
+		t.Errorf("Expected the offending images of chapter 1, got %+v", document)
+	}
+
+	// A nil auditor checks nothing
+	var none *accessibilityAuditor
+	none.checkDocument("OEBPS/chapter1.xhtml", []byte(`<img src="a.png"/>`))
+	if none.finish() != nil {
+		t.Error("Expected no report from a nil auditor")
+	}
+}
+
+func TestAccessibilityAuditor_Rules(t *testing.T) {
+	a := newAccessibilityAuditor()
+	a.checkDocument("OEBPS/chapter1.xhtml", []byte(`<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en"><body>
+<h1>Moby-Dick</h1><h2>Loomings</h2><h4>Skipped</h4><h2>Back</h2>
+<a href="chapter2.xhtml">Next</a><a href="#top"><img src="up.png" alt="Back to top"/></a>
+<a href="notes.xhtml" aria-label="Notes"></a><a href="index.xhtml"> <span></span></a><a id="anchor"></a>
+<table><tr><th>Ship</th></tr><tr><td>Pequod</td></tr></table>
+<table role="presentation"><tr><td>Layout</td></tr></table>
+<table><tr><td>Data</td></tr></table>
+</body></html>`))
+	a.checkDocument("OEBPS/chapter2.xhtml", []byte(`<html><body><h3>Starts deep</h3></body></html>`))
+
+	report := a.finish()
+	want := map[string]int{ruleHeadingOrder: 1, ruleHTMLLang: 1, ruleLinkName: 1, ruleTableHeaders: 1}
+	for rule, count := range want {
+		if report.Violations[rule] != count {
+			t.Errorf("Expected %d %s violation, got %d", count, rule, report.Violations[rule])
+		}
+	}
+	if len(report.Findings) != 4 {
+		t.Fatalf("Expected 4 findings, got %+v", report.Findings)
+	}
+	for i, want := range []accessibilityFinding{
+		{Rule: ruleHeadingOrder, Document: "OEBPS/chapter1.xhtml", Detail: "h4 follows h2"},
+		{Rule: ruleLinkName, Document: "OEBPS/chapter1.xhtml", Detail: `the link to "index.xhtml" has no text`},
+		{Rule: ruleTableHeaders, Document: "OEBPS/chapter1.xhtml", Detail: "table 3 has no header cells"},
+		{Rule: ruleHTMLLang, Document: "OEBPS/chapter2.xhtml", Detail: "the html element has no lang or xml:lang attribute"},
+	} {
+		if report.Findings[i] != want {
+			t.Errorf("Expected finding %d to be %+v, got %+v", i, want, report.Findings[i])
+		}
+	}
+
+	data, err := a.generateAccessibilityJSON()
+	if err != nil || !strings.Contains(string(data), `"html-has-lang": 1`) {
+		t.Errorf("Expected the report as JSON, got %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,26 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// canonicalJSON encodes v in the canonical form of the generated manifests:
+// every object's keys sorted, including those of structs such as the toolkit
+// metadata, two-space indentation, and numbers exactly as first encoded. The
+// same publication then always produces byte-identical manifests, so their
+// ETags and the resource index only change when the content does.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+	return json.MarshalIndent(value, "", "  ")
+}
@@ -0,0 +1,80 @@
+package processor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	type link struct {
+		Type string  `json:"type"`
+		Href string  `json:"href"`
+		Size float64 `json:"size"`
+	}
+	data, err := canonicalJSON(map[string]interface{}{
+		"links":    []link{{Type: "text/html", Href: "a.html", Size: 0.1}},
+		"metadata": map[string]string{"title": "A", "@type": "Book"},
+	})
+	if err != nil {
+		t.Fatalf("canonicalJSON failed: %v", err)
+	}
+	expected := `{
+  "links": [
+    {
+      "href": "a.html",
+      "size": 0.1,
+      "type": "text/html"
+    }
+  ],
+  "metadata": {
+    "@type": "Book",
+    "title": "A"
+  }
+}`
+	if string(data) != expected {
+		t.Errorf("Expected sorted keys, got %s", data)
+	}
+}
+
+func TestNormalizeContributorName_StableSortAs(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		c := manifest.Contributor{LocalizedName: manifest.NewLocalizedStringFromStrings(map[string]string{
+			"fr": "Hugo, Victor",
+			"en": "Hugo, V.",
+		})}
+		normalizeContributorName(&c)
+		if c.LocalizedSortAs == nil || c.LocalizedSortAs.String() != "Hugo, V." {
+			t.Fatalf("Expected the sortAs of the first language, got %v", c.LocalizedSortAs)
+		}
+	}
+}
+
+func TestProcess_ManifestIsByteIdentical(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	var manifests [][]byte
+	for i := 0; i < 2; i++ {
+		source := spoolTestArchive(t, map[string]string{
+			lpfManifestPath:       testPublicationJSON,
+			"audio/chapter 1.mp3": "one",
+			"audio/chapter2.mp3":  "two",
+			"cover.jpg":           "cover",
+			"toc.html":            "<html></html>",
+		})
+		if _, err := p.Process(source, "leviathan.lpf", Options{Force: true}); err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		manifest, _ := supabase.Object(ManifestBucket, "leviathan/manifest.json")
+		manifests = append(manifests, manifest)
+	}
+	if !bytes.Equal(manifests[0], manifests[1]) {
+		t.Errorf("Expected identical manifests, got:\n%s\n%s", manifests[0], manifests[1])
+	}
+}
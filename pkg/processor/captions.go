@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+	"github.com/readium/go-toolkit/pkg/util/url"
+)
+
+// captionMediaTypes are the media types of caption and subtitle files: WebVTT,
+// TTML (and its DFXP profile) and SubRip
+var captionMediaTypes = map[string]bool{
+	"text/vtt":             true,
+	"application/ttml+xml": true,
+	"application/x-subrip": true,
+}
+
+// captionTrack is a <track> of a <video> or <audio> element: captions,
+// subtitles, descriptions or chapters
+type captionTrack struct {
+	target   string // archive path, or URL for external tracks
+	kind     string
+	language string
+	label    string
+}
+
+// mediaTarget resolves a src attribute of the content document at docPath to
+// an archive path, keeping external URLs as they are
+func mediaTarget(src, docPath string) string {
+	src = strings.TrimSpace(src)
+	if src == "" || isExternalHref(src) {
+		return src
+	}
+	return resolveArchiveHref(src, docPath)
+}
+
+// mediaTracks returns the tracks of the <video> and <audio> elements of the
+// content document at docPath, by the media they belong to: the src of the
+// element, or of its first <source>
+func mediaTracks(docPath string, content []byte) map[string][]captionTrack {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	found := map[string][]captionTrack{}
+	inMedia := false
+	var media string
+	var tracks []captionTrack
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			attrs := accessibilityAttributes(t.Attr)
+			switch {
+			case name == "video" || name == "audio":
+				inMedia, media, tracks = true, mediaTarget(attrs["src"], docPath), nil
+			case inMedia && name == "source" && media == "":
+				media = mediaTarget(attrs["src"], docPath)
+			case inMedia && name == "track":
+				if target := mediaTarget(attrs["src"], docPath); target != "" {
+					tracks = append(tracks, captionTrack{target: target, kind: strings.ToLower(attrs["kind"]), language: attrs["srclang"], label: attrs["label"]})
+				}
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if inMedia && (name == "video" || name == "audio") {
+				if media != "" && len(tracks) > 0 {
+					found[media] = append(found[media], tracks...)
+				}
+				inMedia = false
+			}
+		}
+	}
+	return found
+}
+
+// captionMediaType returns the media type of a caption file by extension, or ""
+func captionMediaType(href string) string {
+	href, _, _ = strings.Cut(href, "#")
+	if mediaType := getContentType(href); captionMediaTypes[mediaType] {
+		return mediaType
+	}
+	return ""
+}
+
+// captionLink returns the alternate link of a media link to one of its tracks
+func captionLink(track captionTrack) (manifest.Link, bool) {
+	u, err := url.URLFromString(track.target)
+	if err != nil {
+		return manifest.Link{}, false
+	}
+	link := manifest.Link{Href: manifest.NewHREF(u), Title: track.label}
+	if mediaType := captionMediaType(track.target); mediaType != "" {
+		if mt, err := mediatype.NewOfString(mediaType); err == nil {
+			link.MediaType = &mt
+		}
+	}
+	if track.language != "" {
+		link.Languages = manifest.Strings{track.language}
+	}
+	if track.kind != "" {
+		link.Properties = manifest.Properties{"kind": track.kind}
+	}
+	return link, true
+}
+
+// fixCaptionMediaType sets the media type of a caption file declared without
+// one, or as an opaque octet-stream
+func fixCaptionMediaType(link *manifest.Link) {
+	mediaType := captionMediaType(link.Href.String())
+	if mediaType == "" || (link.MediaType != nil && link.MediaType.String() != "application/octet-stream") {
+		return
+	}
+	if mt, err := mediatype.NewOfString(mediaType); err == nil {
+		link.MediaType = &mt
+	}
+}
+
+// alternateItems returns the "alternate" array of a generated manifest link
+func alternateItems(alternates manifest.LinkList) []map[string]interface{} {
+	items := make([]map[string]interface{}, 0, len(alternates))
+	for _, alternate := range alternates {
+		item := map[string]interface{}{"href": manifestHref(alternate.Href.String())}
+		if alternate.MediaType != nil {
+			item["type"] = alternate.MediaType.String()
+		}
+		if alternate.Title != "" {
+			item["title"] = alternate.Title
+		}
+		if len(alternate.Languages) > 0 {
+			item["language"] = alternate.Languages
+		}
+		if len(alternate.Properties) > 0 {
+			item["properties"] = alternate.Properties
+		}
+		items = append(items, item)
+	}
+	return items
+}
@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+)
+
+func TestMediaTracks(t *testing.T) {
+	document := []byte(`<html><body>
+<video controls="controls">
+  <source src="../video/intro.mp4" type="video/mp4"/>
+  <source src="../video/intro.webm" type="video/webm"/>
+  <track kind="Captions" src="../captions/intro.en.vtt" srclang="en" label="English"/>
+  <track kind="subtitles" src="https://cdn.example.com/intro.fr.vtt" srclang="fr"/>
+</video>
+<audio src="../audio/theme.mp3"><track kind="captions" src="../captions/theme.ttml"/></audio>
+<video src="../video/silent.mp4"></video>
+</body></html>`)
+
+	want := map[string][]captionTrack{
+		"OEBPS/video/intro.mp4": {
+			{target: "OEBPS/captions/intro.en.vtt", kind: "captions", language: "en", label: "English"},
+			{target: "https://cdn.example.com/intro.fr.vtt", kind: "subtitles", language: "fr"},
+		},
+		"OEBPS/audio/theme.mp3": {
+			{target: "OEBPS/captions/theme.ttml", kind: "captions"},
+		},
+	}
+	if got := mediaTracks("OEBPS/text/chapter.xhtml", document); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestMediaProber_LinksCaptions(t *testing.T) {
+	htmlType, _ := mediatype.NewOfString("application/xhtml+xml")
+	videoType, _ := mediatype.NewOfString("video/mp4")
+	octetStream, _ := mediatype.NewOfString("application/octet-stream")
+	chapter := testLink(t, "OEBPS/text/chapter.xhtml")
+	chapter.MediaType = &htmlType
+	video := testLink(t, "OEBPS/video/intro.mp4")
+	video.MediaType = &videoType
+	captions := testLink(t, "OEBPS/captions/intro.en.vtt")
+	captions.MediaType = &octetStream
+
+	probes := newMediaProber()
+	document := []byte(`<video src="../video/intro.mp4"><track kind="captions" src="../captions/intro.en.vtt" srclang="en"/></video>`)
+	probes.probe(&chapter, document)
+	// The same video in another chapter doesn't add its track twice
+	probes.probe(&chapter, document)
+
+	m := manifest.Manifest{ReadingOrder: manifest.LinkList{chapter}, Resources: manifest.LinkList{video, captions}}
+	probes.apply(&m)
+
+	if got := m.Resources[1].MediaType.String(); got != "text/vtt" {
+		t.Errorf("Expected the captions to be typed text/vtt, got %q", got)
+	}
+	alternates := m.Resources[0].Alternates
+	if len(alternates) != 1 {
+		t.Fatalf("Expected the video to have one alternate, got %d", len(alternates))
+	}
+	want := []map[string]interface{}{{
+		"href":       "OEBPS/captions/intro.en.vtt",
+		"type":       "text/vtt",
+		"language":   manifest.Strings{"en"},
+		"properties": manifest.Properties{"kind": "captions"},
+	}}
+	if got := alternateItems(alternates); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestGetContentType_CaptionsAndVideo(t *testing.T) {
+	for path, want := range map[string]string{
+		"captions/intro.vtt":  "text/vtt",
+		"captions/intro.ttml": "application/ttml+xml",
+		"captions/intro.dfxp": "application/ttml+xml",
+		"captions/intro.srt":  "application/x-subrip",
+		"video/intro.mp4":     "video/mp4",
+		"video/intro.webm":    "video/webm",
+	} {
+		if got := getContentType(path); got != want {
+			t.Errorf("Expected %s to be %q, got %q", path, want, got)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Locator is a Readium locator into a processed publication
+type Locator struct {
+	Href      string           `json:"href"`
+	Type      string           `json:"type,omitempty"`
+	Title     string           `json:"title,omitempty"`
+	Locations LocatorLocations `json:"locations"`
+}
+
+// LocatorLocations is where a locator points to in its resource
+type LocatorLocations struct {
+	Fragments        []string `json:"fragments,omitempty"`
+	Progression      float64  `json:"progression"`
+	Position         int      `json:"position,omitempty"`
+	TotalProgression *float64 `json:"totalProgression,omitempty"`
+}
+
+// cfiStep is one step of an EPUB CFI path: even indices are child elements
+// (2 is the first), odd ones the text around them
+type cfiStep struct {
+	index int
+	// id is the id assertion of the step ("[chap01]"), if any
+	id string
+}
+
+// epubCFI is a parsed EPUB CFI. Only the start of a range is kept, as a
+// bookmark or the start of a highlight is what a locator can point to.
+type epubCFI struct {
+	// spine is the path in the package document, ending at an itemref
+	spine []cfiStep
+	// content is the path in the content document the itemref points to
+	content []cfiStep
+	// offset is the character offset in the text the content path ends at, or -1
+	offset int
+}
+
+// parseCFI parses an epubcfi(...) string
+func parseCFI(value string) (*epubCFI, error) {
+	value = strings.TrimSpace(value)
+	inner, ok := strings.CutPrefix(value, "epubcfi(")
+	if !ok || !strings.HasSuffix(inner, ")") {
+		return nil, fmt.Errorf("invalid CFI %q: expected epubcfi(...)", value)
+	}
+	inner = strings.TrimSuffix(inner, ")")
+
+	// A range is parent,start,end: the start is the parent path followed by
+	// the start path
+	if parts := splitCFI(inner, ','); len(parts) == 3 {
+		inner = parts[0] + parts[1]
+	} else if len(parts) != 1 {
+		return nil, fmt.Errorf("invalid CFI %q: malformed range", value)
+	}
+
+	paths := splitCFI(inner, '!')
+	switch {
+	case len(paths) == 1:
+		return nil, fmt.Errorf("invalid CFI %q: no content document step (\"!\")", value)
+	case len(paths) > 2:
+		return nil, fmt.Errorf("unsupported CFI %q: only one indirection is supported", value)
+	}
+
+	cfi := &epubCFI{offset: -1}
+	var err error
+	if cfi.spine, _, err = parseCFIPath(paths[0]); err != nil {
+		return nil, fmt.Errorf("invalid CFI %q: %w", value, err)
+	}
+	if len(cfi.spine) == 0 || cfi.spine[len(cfi.spine)-1].index%2 != 0 {
+		return nil, fmt.Errorf("invalid CFI %q: the package path does not end at an itemref", value)
+	}
+	var rest string
+	if cfi.content, rest, err = parseCFIPath(paths[1]); err != nil {
+		return nil, fmt.Errorf("invalid CFI %q: %w", value, err)
+	}
+	if rest != "" {
+		// Temporal (~) and spatial (@) offsets don't apply to text
+		offset, ok := strings.CutPrefix(rest, ":")
+		if !ok {
+			return nil, fmt.Errorf("unsupported CFI %q: only character offsets are supported", value)
+		}
+		offset, _, _ = strings.Cut(offset, "[")
+		if cfi.offset, err = strconv.Atoi(offset); err != nil || cfi.offset < 0 {
+			return nil, fmt.Errorf("invalid CFI %q: bad character offset %q", value, offset)
+		}
+	}
+	return cfi, nil
+}
+
+// splitCFI splits a CFI on sep outside of assertions, where it may be escaped with ^
+func splitCFI(value string, sep byte) []string {
+	var parts []string
+	start, depth := 0, 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '^':
+			i++
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// parseCFIPath parses the /N[id] steps at the start of path and returns what follows
+func parseCFIPath(path string) ([]cfiStep, string, error) {
+	var steps []cfiStep
+	for strings.HasPrefix(path, "/") {
+		path = path[1:]
+		end := 0
+		for end < len(path) && path[end] >= '0' && path[end] <= '9' {
+			end++
+		}
+		index, err := strconv.Atoi(path[:end])
+		if err != nil {
+			return nil, "", fmt.Errorf("bad step %q", "/"+path)
+		}
+		step := cfiStep{index: index}
+		path = path[end:]
+		if strings.HasPrefix(path, "[") {
+			assertion, rest, err := readCFIAssertion(path)
+			if err != nil {
+				return nil, "", err
+			}
+			// Parameters such as ";s=b" follow the id
+			step.id, _, _ = strings.Cut(assertion, ";")
+			path = rest
+		}
+		steps = append(steps, step)
+	}
+	return steps, path, nil
+}
+
+// readCFIAssertion reads the [...] assertion at the start of path, unescaping it
+func readCFIAssertion(path string) (string, string, error) {
+	var assertion strings.Builder
+	for i := 1; i < len(path); i++ {
+		switch path[i] {
+		case '^':
+			if i+1 < len(path) {
+				i++
+				assertion.WriteByte(path[i])
+			}
+		case ']':
+			return assertion.String(), path[i+1:], nil
+		default:
+			assertion.WriteByte(path[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated assertion %q", path)
+}
+
+// cfiNode is an element of a content document, with the byte offsets CFI
+// steps resolve to
+type cfiNode struct {
+	id       string
+	start    int // of the start tag
+	content  int // after the start tag
+	end      int // after the end tag
+	children []*cfiNode
+}
+
+// parseCFITree reads the element tree of a content document and indexes its
+// elements by id
+func parseCFITree(content []byte) (*cfiNode, map[string]*cfiNode) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	document := &cfiNode{}
+	ids := map[string]*cfiNode{}
+	stack := []*cfiNode{document}
+	for {
+		offset := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &cfiNode{start: offset, content: int(decoder.InputOffset()), end: len(content)}
+			for _, a := range t.Attr {
+				if a.Name.Local == "id" {
+					node.id = a.Value
+					if _, ok := ids[a.Value]; !ok {
+						ids[a.Value] = node
+					}
+				}
+			}
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack[len(stack)-1].end = int(decoder.InputOffset())
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return document, ids
+}
+
+// resolveCFIContent returns the byte offset a content path (and character
+// offset) points to in a content document, and the id of the innermost element
+// on the way that has one. Id assertions win over indices, so a CFI still
+// resolves when elements were added before its target.
+func resolveCFIContent(content []byte, steps []cfiStep, offset int) (int, string, error) {
+	document, ids := parseCFITree(content)
+	if len(document.children) == 0 {
+		return 0, "", fmt.Errorf("content document has no root element")
+	}
+	node, fragment := document.children[0], document.children[0].id
+	position := node.start
+
+	for i, step := range steps {
+		if step.index%2 == 0 {
+			var child *cfiNode
+			if step.index > 0 && step.index/2 <= len(node.children) {
+				child = node.children[step.index/2-1]
+			}
+			if asserted, ok := ids[step.id]; ok && step.id != "" && (child == nil || child.id != step.id) {
+				child = asserted
+			}
+			if child == nil {
+				return 0, "", fmt.Errorf("step %d (/%d) is past the last child element", i+1, step.index)
+			}
+			node, position = child, child.start
+			if node.id != "" {
+				fragment = node.id
+			}
+			continue
+		}
+
+		// A text step can only end the path
+		if i != len(steps)-1 {
+			return 0, "", fmt.Errorf("step %d (/%d) points to text but is not the last step", i+1, step.index)
+		}
+		before := step.index / 2 // elements before the text
+		if before > len(node.children) {
+			return 0, "", fmt.Errorf("step %d (/%d) is past the last child element", i+1, step.index)
+		}
+		position = node.content
+		if before > 0 {
+			position = node.children[before-1].end
+		}
+		if offset > 0 {
+			position = advanceCharacters(content, position, offset)
+		}
+	}
+	return position, fragment, nil
+}
+
+// advanceCharacters returns the byte offset n characters of text after start,
+// counting an entity reference as one character and stopping at the next tag
+func advanceCharacters(content []byte, start, n int) int {
+	i := start
+	for ; n > 0 && i < len(content) && content[i] != '<'; n-- {
+		if content[i] == '&' {
+			if end := bytes.IndexByte(content[i:], ';'); end > 0 && end < 12 {
+				i += end + 1
+				continue
+			}
+		}
+		_, size := utf8.DecodeRune(content[i:])
+		i += size
+	}
+	return i
+}
+
+// spineMapPath is where the spine of the EPUB is stored, relative to basePath
+const spineMapPath = "readium/spine.json"
+
+// spineMap is the spine of the package document as other reading systems see
+// it. Their CFIs count every itemref, while the reading order leaves out the
+// non-linear ones and those without a manifest item, and holds the parts of the
+// split chapters.
+type spineMap struct {
+	Version  int            `json:"version"`
+	Itemrefs []spineItemref `json:"itemrefs"`
+}
+
+// spineItemref is an itemref of the spine
+type spineItemref struct {
+	ID    string `json:"id,omitempty"`
+	IDRef string `json:"idref"`
+	// Href is the archive path of the manifest item, "" when there is none
+	Href   string `json:"href,omitempty"`
+	Linear bool   `json:"linear"`
+	// Cuts are the CFI paths of the headings the chapter was split at: the
+	// part at index i+1 starts at Cuts[i]
+	Cuts [][]int `json:"cuts,omitempty"`
+}
+
+// readSpineMap reads the spine of an EPUB, or returns nil when its package
+// document can't be read
+func readSpineMap(zipReader *zip.Reader) *spineMap {
+	pkg, err := openEPUBPackage(zipReader)
+	if err != nil {
+		return nil
+	}
+	spine := &spineMap{Version: 1, Itemrefs: []spineItemref{}}
+	for _, itemref := range pkg.opf.Spine.Itemrefs {
+		ref := spineItemref{ID: itemref.ID, IDRef: itemref.IDRef, Linear: itemref.Linear != "no"}
+		if item := pkg.itemByID(itemref.IDRef); item != nil {
+			href, _, _ := strings.Cut(item.Href, "#")
+			ref.Href = pkg.resolve(href)
+		}
+		spine.Itemrefs = append(spine.Itemrefs, ref)
+	}
+	return spine
+}
+
+// addCuts records where the chapters in splits (by archive path) were split
+func (m *spineMap) addCuts(splits map[string]*chapterSplit) {
+	if m == nil {
+		return
+	}
+	for i := range m.Itemrefs {
+		if split := splits[m.Itemrefs[i].Href]; split != nil {
+			m.Itemrefs[i].Cuts = split.cuts
+		}
+	}
+}
+
+// itemref returns the itemref a CFI step points to: the one with the id the
+// step asserts, or else the one at its index
+func (m *spineMap) itemref(step cfiStep) (*spineItemref, error) {
+	if step.id != "" {
+		for i := range m.Itemrefs {
+			if m.Itemrefs[i].ID == step.id {
+				return &m.Itemrefs[i], nil
+			}
+		}
+	}
+	index := step.index/2 - 1
+	if index < 0 || index >= len(m.Itemrefs) {
+		return nil, fmt.Errorf("CFI points to spine item %d, but the spine has %d items", index+1, len(m.Itemrefs))
+	}
+	return &m.Itemrefs[index], nil
+}
+
+// splitPartSteps returns the part of a split chapter a content path points
+// into, and the path in that part. A part after the first opens again the
+// elements wrapping its heading, as the first children of their parents, and
+// goes on with the heading.
+func splitPartSteps(cuts [][]int, steps []cfiStep) (int, []cfiStep) {
+	part := 0
+	for part < len(cuts) && compareCFIPaths(cuts[part], steps) <= 0 {
+		part++
+	}
+	if part == 0 {
+		return 0, steps
+	}
+	cut := cuts[part-1]
+	translated := slices.Clone(steps)
+	for level := 1; level < len(cut) && level < len(steps) && steps[level-1].index == cut[level-1]; level++ {
+		translated[level].index = steps[level].index - cut[level] + 2
+		if steps[level].index != cut[level] {
+			break
+		}
+	}
+	return part, translated
+}
+
+// compareCFIPaths compares the element path a with the content path b in
+// document order, an element coming before its descendants
+func compareCFIPaths(a []int, b []cfiStep) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := cmp.Compare(a[i], b[i].index); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// publishedReadingOrder is the part of a published manifest a CFI resolves against
+type publishedReadingOrder struct {
+	ReadingOrder []publishedLink `json:"readingOrder"`
+}
+
+// publishedLink is a reading order item of a published manifest
+type publishedLink struct {
+	Href       string `json:"href"`
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Properties struct {
+		Encrypted map[string]interface{} `json:"encrypted"`
+	} `json:"properties"`
+}
+
+// ResolveCFI translates an EPUB CFI, as stored by other reading systems, into
+// a locator into the publication processed at basePath. The itemref the CFI
+// starts from is looked up in the spine stored with the publication and its
+// document found in the reading order, in the part of a split chapter holding
+// the target. Publications processed without a stored spine take the itemref
+// as an index into the reading order. Positions come from positions.json when
+// it was generated.
+func ResolveCFI(store Uploader, basePath, cfi string) (*Locator, error) {
+	parsed, err := parseCFI(cfi)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+
+	data, err := store.Download(fmt.Sprintf("%s/manifest.json", basePath))
+	if err != nil {
+		return nil, &statusError{status: 404, err: fmt.Errorf("no publication at %s: %w", basePath, err)}
+	}
+	var m publishedReadingOrder
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	step, steps := parsed.spine[len(parsed.spine)-1], parsed.content
+	index := step.index/2 - 1
+	if data, err := store.Download(fmt.Sprintf("%s/%s", basePath, spineMapPath)); err == nil {
+		var spine spineMap
+		if err := json.Unmarshal(data, &spine); err != nil {
+			return nil, fmt.Errorf("failed to parse spine map: %w", err)
+		}
+		itemref, err := spine.itemref(step)
+		if err != nil {
+			return nil, &statusError{status: 422, err: err}
+		}
+		if itemref.Href == "" {
+			return nil, &statusError{status: 422, err: fmt.Errorf("spine item %q matches no manifest item", itemref.IDRef)}
+		}
+		href := itemref.Href
+		if len(itemref.Cuts) > 0 {
+			var part int
+			part, steps = splitPartSteps(itemref.Cuts, steps)
+			href = splitPartName(href, part)
+		}
+		index = slices.IndexFunc(m.ReadingOrder, func(link publishedLink) bool {
+			return resourceKey(link.Href) == resourceKey(href)
+		})
+		if index < 0 {
+			return nil, &statusError{status: 422, err: fmt.Errorf("%s is not in the reading order", href)}
+		}
+	} else if index < 0 || index >= len(m.ReadingOrder) {
+		return nil, &statusError{status: 422, err: fmt.Errorf("CFI points to spine item %d, but the reading order has %d items", index+1, len(m.ReadingOrder))}
+	}
+	item := m.ReadingOrder[index]
+	if item.Properties.Encrypted != nil {
+		return nil, &statusError{status: 422, err: fmt.Errorf("%s is encrypted", item.Href)}
+	}
+	locator := &Locator{Href: item.Href, Type: item.Type, Title: item.Title}
+
+	if len(steps) > 0 {
+		content, err := store.Download(fmt.Sprintf("%s/%s", basePath, resourceKey(item.Href)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", item.Href, err)
+		}
+		position, fragment, err := resolveCFIContent(content, steps, parsed.offset)
+		if err != nil {
+			return nil, &statusError{status: 422, err: fmt.Errorf("CFI does not resolve in %s: %w", item.Href, err)}
+		}
+		if len(content) > 0 {
+			locator.Locations.Progression = float64(position) / float64(len(content))
+		}
+		if fragment != "" {
+			locator.Locations.Fragments = []string{fragment}
+		}
+	}
+
+	addPosition(store, basePath, locator)
+	return locator, nil
+}
+
+// addPosition fills in the position of the locator, and its progression in the
+// whole publication, from the last position of its resource at or before it.
+// Locators of publications without positions.json are left as they are.
+func addPosition(store Uploader, basePath string, locator *Locator) {
+	data, err := store.Download(fmt.Sprintf("%s/readium/positions.json", basePath))
+	if err != nil {
+		return
+	}
+	var list struct {
+		Positions []struct {
+			Href      string `json:"href"`
+			Locations struct {
+				Position         int     `json:"position"`
+				Progression      float64 `json:"progression"`
+				TotalProgression float64 `json:"totalProgression"`
+			} `json:"locations"`
+		} `json:"positions"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return
+	}
+	for _, p := range list.Positions {
+		if p.Href != locator.Href || (locator.Locations.Position != 0 && p.Locations.Progression > locator.Locations.Progression) {
+			continue
+		}
+		locator.Locations.Position = p.Locations.Position
+		total := p.Locations.TotalProgression
+		locator.Locations.TotalProgression = &total
+	}
+}
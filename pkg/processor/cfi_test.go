@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestParseCFI(t *testing.T) {
+	cfi, err := parseCFI("epubcfi(/6/4[chap01ref]!/4[body01]/10[para^]05]/3:10)")
+	if err != nil {
+		t.Fatalf("parseCFI failed: %v", err)
+	}
+	if len(cfi.spine) != 2 || cfi.spine[1].index != 4 || cfi.spine[1].id != "chap01ref" {
+		t.Errorf("Expected the itemref step, got %+v", cfi.spine)
+	}
+	if len(cfi.content) != 3 || cfi.content[1].id != "para]05" || cfi.content[2].index != 3 || cfi.offset != 10 {
+		t.Errorf("Expected the content path with an escaped assertion, got %+v (offset %d)", cfi.content, cfi.offset)
+	}
+
+	// A range resolves to its start
+	cfi, err = parseCFI("epubcfi(/6/4!/4/2,/1:5,/3:2)")
+	if err != nil || len(cfi.content) != 3 || cfi.content[2].index != 1 || cfi.offset != 5 {
+		t.Errorf("Expected the start of the range, got %+v (%v)", cfi, err)
+	}
+
+	for _, invalid := range []string{
+		"/6/4!/4",
+		"epubcfi(/6/4)",
+		"epubcfi(/6/3!/4)",
+		"epubcfi(/6/4!/4[body)",
+		"epubcfi(/6/4!/4/2~23.5)",
+		"epubcfi(/6/4!/4/2!/4)",
+	} {
+		if _, err := parseCFI(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestResolveCFIContent(t *testing.T) {
+	content := []byte(`<html><head><title>Loomings</title></head><body id="body01">` +
+		`<h1>Loomings</h1><p id="para02">Call me Ishmael. Some years ago&mdash;never mind how long</p></body></html>`)
+
+	position, fragment, err := resolveCFIContent(content, []cfiStep{{index: 4}, {index: 4}, {index: 1}}, 17)
+	if err != nil {
+		t.Fatalf("resolveCFIContent failed: %v", err)
+	}
+	if fragment != "para02" || !strings.HasPrefix(string(content[position:]), "Some years ago") {
+		t.Errorf("Expected the offset in the paragraph, got %q at %q", fragment, content[position:])
+	}
+
+	// Past an entity
+	position, _, _ = resolveCFIContent(content, []cfiStep{{index: 4}, {index: 4}, {index: 1}}, 32)
+	if !strings.HasPrefix(string(content[position:]), "never") {
+		t.Errorf("Expected an entity to count as one character, got %q", content[position:])
+	}
+
+	// The id assertion wins over a stale index
+	position, fragment, err = resolveCFIContent(content, []cfiStep{{index: 4}, {index: 2, id: "para02"}}, -1)
+	if err != nil || fragment != "para02" || !strings.HasPrefix(string(content[position:]), `<p id="para02">`) {
+		t.Errorf("Expected the asserted paragraph, got %q at %q (%v)", fragment, content[position:], err)
+	}
+
+	if _, _, err := resolveCFIContent(content, []cfiStep{{index: 4}, {index: 8}}, -1); err == nil {
+		t.Error("Expected a step past the last child to fail")
+	}
+}
+
+func TestResolveCFI_Spine(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	paragraph := strings.Repeat("Call me Ishmael. ", 10)
+	source := spoolTestArchive(t, map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": validContainer,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:identifier id="uid">moby</dc:identifier><dc:title>Moby-Dick</dc:title></metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="cover" linear="no"/><itemref id="ref-ch1" idref="ch1"/><itemref idref="ch2"/></spine>
+</package>`,
+		"OEBPS/nav.xhtml":   `<html xmlns="http://www.w3.org/1999/xhtml"><body><nav><ol><li><a href="ch1.xhtml">Loomings</a></li></ol></nav></body></html>`,
+		"OEBPS/cover.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p>Moby-Dick</p></body></html>`,
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Loomings</title></head><body><section>` +
+			`<h1 id="c1">Loomings</h1><p>` + paragraph + `</p><h1 id="c2">The Carpet-Bag</h1><p>` + paragraph + `</p></section></body></html>`,
+		"OEBPS/ch2.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>The Spouter-Inn</title></head><body><p id="p1">The Spouter-Inn</p></body></html>`,
+	})
+	options := Options{SplitChapterBytes: 300}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if _, err := p.Process(source, "moby.epub", options); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	for cfi, want := range map[string][2]string{
+		// The non-linear cover is counted by the CFI but not in the reading order
+		"epubcfi(/6/6!/4/2/1:3)": {"OEBPS/ch2.xhtml", "p1"},
+		// The first part of the split chapter, and the second one, reopening the section
+		"epubcfi(/6/4!/4/2/4/1:5)":         {"OEBPS/ch1.xhtml", ""},
+		"epubcfi(/6/4!/4/2/6[c2])":         {"OEBPS/ch1-split2.xhtml", "c2"},
+		"epubcfi(/6/4!/4/2/8/1:5)":         {"OEBPS/ch1-split2.xhtml", ""},
+		"epubcfi(/6/40[ref-ch1]!/4/2/2/1)": {"OEBPS/ch1.xhtml", "c1"},
+	} {
+		locator, err := ResolveCFI(store, "moby", cfi)
+		if err != nil {
+			t.Errorf("%s: ResolveCFI failed: %v", cfi, err)
+			continue
+		}
+		fragment := ""
+		if len(locator.Locations.Fragments) > 0 {
+			fragment = locator.Locations.Fragments[0]
+		}
+		if locator.Href != want[0] || fragment != want[1] {
+			t.Errorf("%s: expected %s#%s, got %s#%s", cfi, want[0], want[1], locator.Href, fragment)
+		}
+	}
+
+	if _, err := ResolveCFI(store, "moby", "epubcfi(/6/2!/4/2)"); StatusCode(err) != 422 {
+		t.Errorf("Expected the non-linear cover to be out of the reading order, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package processor
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/parser/epub"
+)
+
+// maxIdleConnsPerHost keeps enough connections to Storage open between
+// invocations for concurrent uploads, where the net/http default keeps 2
+const maxIdleConnsPerHost = 32
+
+// sharedTransport pools the connections of every HTTP client of the process, so
+// that warm invocations reuse the connections (and TLS sessions) of earlier ones
+var sharedTransport = newSharedTransport()
+
+func newSharedTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 4 * maxIdleConnsPerHost
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	return transport
+}
+
+// epubParser is shared by every job: the parser holds no state of its own
+var epubParser = epub.NewParser(nil)
+
+// NewHTTPClient returns a client bounding each request by timeout (0 for no
+// bound) that shares its connections with the other clients of the process
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: sharedTransport, Timeout: timeout}
+}
@@ -0,0 +1,19 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClientSharesTransport(t *testing.T) {
+	a, b := NewHTTPClient(time.Second), NewHTTPClient(time.Minute)
+	if a.Transport != b.Transport || a.Transport != sharedTransport {
+		t.Errorf("Expected every client to use the shared transport")
+	}
+	if a.Timeout != time.Second {
+		t.Errorf("Expected timeout 1s, got %s", a.Timeout)
+	}
+	if sharedTransport.MaxIdleConnsPerHost != maxIdleConnsPerHost {
+		t.Errorf("Expected %d idle connections per host, got %d", maxIdleConnsPerHost, sharedTransport.MaxIdleConnsPerHost)
+	}
+}
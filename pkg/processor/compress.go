@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage compression for text resources
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+
+	compressionEnvVar = "TEXT_COMPRESSION"
+)
+
+// compressibleExtensions are the text resources worth storing pre-compressed.
+// Manifests and other JSON sidecars stay plain so every client can read them.
+var compressibleExtensions = map[string]bool{
+	".xhtml": true,
+	".html":  true,
+	".htm":   true,
+	".css":   true,
+	".js":    true,
+	".svg":   true,
+}
+
+// resolveCompression returns the compression to use for a request, falling back
+// to TEXT_COMPRESSION and then to none
+func resolveCompression(requested string) (string, error) {
+	compression := requested
+	if compression == "" {
+		compression = os.Getenv(compressionEnvVar)
+	}
+	switch compression {
+	case "", compressionNone:
+		return compressionNone, nil
+	case compressionGzip:
+		return compressionGzip, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (expected %q or %q)", compression, compressionNone, compressionGzip)
+	}
+}
+
+// compressResource compresses a text resource about to be stored at path. It
+// returns the data to store and its Content-Encoding, which is empty when the
+// resource is stored as is: compression is off, the file isn't text, or
+// compressing didn't make it smaller.
+func compressResource(path string, data []byte, compression string) ([]byte, string, error) {
+	if compression != compressionGzip || !compressibleExtensions[strings.ToLower(filepath.Ext(path))] {
+		return data, "", nil
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, "", fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	if buf.Len() >= len(data) {
+		return data, "", nil
+	}
+	return buf.Bytes(), compressionGzip, nil
+}
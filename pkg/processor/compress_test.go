@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveCompression(t *testing.T) {
+	t.Setenv(compressionEnvVar, "")
+	if got, err := resolveCompression(""); err != nil || got != compressionNone {
+		t.Errorf("Expected none by default, got %q (%v)", got, err)
+	}
+	t.Setenv(compressionEnvVar, "gzip")
+	if got, err := resolveCompression(""); err != nil || got != compressionGzip {
+		t.Errorf("Expected gzip from the env, got %q (%v)", got, err)
+	}
+	if got, err := resolveCompression("none"); err != nil || got != compressionNone {
+		t.Errorf("Expected the request to win over the env, got %q (%v)", got, err)
+	}
+	if _, err := resolveCompression("br"); err == nil {
+		t.Error("Expected an error for an unsupported compression")
+	}
+}
+
+func TestCompressResource(t *testing.T) {
+	chapter := []byte("<html><body>" + strings.Repeat("<p>Call me Ishmael.</p>", 100) + "</body></html>")
+
+	data, encoding, err := compressResource("book/OEBPS/ch1.XHTML", chapter, compressionGzip)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if encoding != "gzip" || len(data) >= len(chapter) {
+		t.Fatalf("Expected a smaller gzip resource, got %q with %d bytes", encoding, len(data))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected valid gzip, got %v", err)
+	}
+	if decompressed, _ := io.ReadAll(zr); !bytes.Equal(decompressed, chapter) {
+		t.Error("Expected the resource to round-trip")
+	}
+
+	tests := map[string]struct {
+		path        string
+		data        []byte
+		compression string
+	}{
+		"compression off": {"book/ch1.xhtml", chapter, compressionNone},
+		"not text":        {"book/cover.jpg", chapter, compressionGzip},
+		"manifest":        {"book/manifest.json", chapter, compressionGzip},
+		"not smaller":     {"book/tiny.css", []byte("p{}"), compressionGzip},
+	}
+	for name, tt := range tests {
+		data, encoding, err := compressResource(tt.path, tt.data, tt.compression)
+		if err != nil || encoding != "" || !bytes.Equal(data, tt.data) {
+			t.Errorf("%s: expected the resource unchanged, got %q (%v)", name, encoding, err)
+		}
+	}
+}
+
+func TestDeltaUploader_Compression(t *testing.T) {
+	encodings := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		encodings[strings.TrimPrefix(r.URL.Path, "/storage/v1/object/"+ManifestBucket+"/")] = r.Header.Get("Content-Encoding")
+	}))
+	defer server.Close()
+
+	delta := newDeltaUploader("book", NewSupabase(server.URL, "test-key"), true)
+	delta.compression = compressionGzip
+	css := []byte(strings.Repeat("p { margin: 0; }\n", 50))
+	if _, err := delta.upload("book/style.css", css); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := delta.upload("book/manifest.json", css); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if encodings["book/style.css"] != "gzip" || encodings["book/manifest.json"] != "" {
+		t.Errorf("Expected only the stylesheet to be stored gzipped, got %v", encodings)
+	}
+}
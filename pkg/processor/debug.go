@@ -0,0 +1,229 @@
+package processor
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// Statuses of the files in a debug report
+const (
+	resourceUploaded  = "uploaded"
+	resourceUnchanged = "unchanged"
+	resourcePackaged  = "packaged"
+	resourceExcluded  = "excluded"
+	resourceOversized = "oversized"
+	resourceFailed    = "failed"
+)
+
+// DebugReport describes a single run in detail, to diagnose why a particular
+// book failed or came out wrong. It is only collected when Options.Debug is set.
+type DebugReport struct {
+	// Phases lists how long each phase of the pipeline took, in order
+	Phases []PhaseTiming `json:"phases"`
+	// Paths names the storage paths the run resolved (base path, manifest, index, ...)
+	Paths map[string]string `json:"paths"`
+	// Resources lists every file of the output and what happened to it
+	Resources []ResourceStatus `json:"resources"`
+}
+
+// PhaseTiming is the duration of one phase of the pipeline
+type PhaseTiming struct {
+	Name       string  `json:"name"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// ResourceStatus is the outcome for one file: uploaded, unchanged (skipped
+// since the previous run), packaged (only in publication.webpub), excluded,
+// oversized or failed
+type ResourceStatus struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Bytes  int    `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Failure describes where a failed Process call stopped, for error reports
+type Failure struct {
+	// Phase is the pipeline phase that failed (open, parse, resources, ...)
+	Phase string
+	// Publication holds the identifier, title, language and authors, when the
+	// publication was parsed before the failure
+	Publication map[string]string
+	// Stack holds the program counters of a panic, as returned by runtime.Callers
+	Stack []uintptr
+}
+
+// debugRecorder tracks the phase the pipeline is in and the publication being
+// processed, so failures can be reported with them. When verbose (Options.Debug)
+// it also collects a DebugReport and logs each entry as it is recorded.
+// All methods are no-ops on a nil recorder.
+type debugRecorder struct {
+	verbose     bool
+	report      DebugReport
+	current     string
+	phaseStart  time.Time
+	publication map[string]string
+}
+
+// newDebugRecorder returns a recorder, collecting a DebugReport when verbose
+func newDebugRecorder(verbose bool) *debugRecorder {
+	return &debugRecorder{verbose: verbose, report: DebugReport{Paths: map[string]string{}}}
+}
+
+// phase ends the current phase, recording its duration, and starts the next one
+func (r *debugRecorder) phase(name string) {
+	if r == nil {
+		return
+	}
+	r.finish()
+	r.current = name
+	r.phaseStart = time.Now()
+}
+
+// finish ends the current phase
+func (r *debugRecorder) finish() {
+	if r == nil || r.current == "" {
+		return
+	}
+	elapsed := time.Since(r.phaseStart)
+	if r.verbose {
+		r.report.Phases = append(r.report.Phases, PhaseTiming{Name: r.current, DurationMS: float64(elapsed.Microseconds()) / 1000})
+		log.Printf("Debug: phase %s took %s", r.current, elapsed)
+	}
+	r.current = ""
+}
+
+// parsed records the metadata identifying the publication in failure reports
+func (r *debugRecorder) parsed(metadata *manifest.Metadata) {
+	if r == nil {
+		return
+	}
+	r.publication = map[string]string{
+		"identifier": metadata.Identifier,
+		"title":      metadata.Title(),
+		"language":   strings.Join(metadata.Languages, ", "),
+	}
+	var authors []string
+	for _, author := range metadata.Authors {
+		authors = append(authors, author.Name())
+	}
+	r.publication["authors"] = strings.Join(authors, ", ")
+}
+
+// path records a resolved storage path
+func (r *debugRecorder) path(name, path string) {
+	if r == nil || !r.verbose {
+		return
+	}
+	r.report.Paths[name] = path
+	log.Printf("Debug: %s path is %s", name, path)
+}
+
+// storagePaths records where the outputs for basePath are stored
+func (r *debugRecorder) storagePaths(basePath string) {
+	r.path("bucket", ManifestBucket)
+	r.path("base", basePath)
+	r.path("manifest", basePath+"/manifest.json")
+	r.path("index", basePath+"/"+IndexPath)
+	r.path("integrity", basePath+"/"+IntegrityPath)
+	r.path("lock", basePath+"/"+lockPath)
+}
+
+// resource records the outcome for one file
+func (r *debugRecorder) resource(path, status string, size int, err error) {
+	if r == nil || !r.verbose {
+		return
+	}
+	entry := ResourceStatus{Path: path, Status: status, Bytes: size}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	r.report.Resources = append(r.report.Resources, entry)
+	if err != nil {
+		log.Printf("Debug: %s %s: %v", status, path, err)
+	} else {
+		log.Printf("Debug: %s %s (%d bytes)", status, path, size)
+	}
+}
+
+// excluded records the resources the include/exclude patterns filtered out
+func (r *debugRecorder) excluded(basePath string, keys []string) {
+	for _, key := range keys {
+		r.resource(basePath+"/"+key, resourceExcluded, 0, nil)
+	}
+}
+
+// oversized records the resources skipped for their size
+func (r *debugRecorder) oversized(basePath string, resources []OversizedResource) {
+	for _, resource := range resources {
+		r.resource(basePath+"/"+resource.Path, resourceOversized, int(resource.Bytes), nil)
+	}
+}
+
+// result returns the collected report, or nil when not verbose
+func (r *debugRecorder) result() *DebugReport {
+	if r == nil || !r.verbose {
+		return nil
+	}
+	return &r.report
+}
+
+// AddFetch records how the EPUB was obtained and how long that took, ahead of
+// the phases of Process
+func (r *DebugReport) AddFetch(source string, elapsed time.Duration) {
+	if r == nil {
+		return
+	}
+	r.Paths["source"] = source
+	r.Phases = append([]PhaseTiming{{Name: "fetch", DurationMS: float64(elapsed.Microseconds()) / 1000}}, r.Phases...)
+}
+
+// debugError carries the failure context and debug report of a failed run
+type debugError struct {
+	err     error
+	failure *Failure
+	report  *DebugReport
+}
+
+func (e *debugError) Error() string {
+	return e.err.Error()
+}
+
+func (e *debugError) Unwrap() error {
+	return e.err
+}
+
+// wrap attaches the failed phase, the publication and the report collected so
+// far to err. stack is set for panics.
+func (r *debugRecorder) wrap(err error, stack []uintptr) error {
+	if r == nil || err == nil {
+		return err
+	}
+	failure := &Failure{Phase: r.current, Publication: r.publication, Stack: stack}
+	r.finish()
+	return &debugError{err: err, failure: failure, report: r.result()}
+}
+
+// DebugReportOf returns the debug report of a failed Process call, or nil if
+// Options.Debug was not set
+func DebugReportOf(err error) *DebugReport {
+	var de *debugError
+	if errors.As(err, &de) {
+		return de.report
+	}
+	return nil
+}
+
+// FailureOf returns where a failed Process call stopped, or nil for errors
+// that don't come from Process
+func FailureOf(err error) *Failure {
+	var de *debugError
+	if errors.As(err, &de) {
+		return de.failure
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func spoolTestArchive(t *testing.T, entries map[string]string) *Source {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range entries {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	source, err := SpoolEPUB(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
+
+func TestProcess_DebugReport(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	source := spoolTestArchive(t, map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	})
+	options := Options{Debug: true, Exclude: []string{"**/*.jpg"}}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	result, err := p.Process(source, "leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	report := result.Debug
+	if report == nil {
+		t.Fatal("Expected a debug report")
+	}
+
+	var phases []string
+	for _, phase := range report.Phases {
+		phases = append(phases, phase.Name)
+	}
+	if len(phases) != 5 || phases[0] != "open" || phases[4] != "index" {
+		t.Errorf("Expected the open, parse, resources, manifest and index phases, got %v", phases)
+	}
+	if report.Paths["base"] != "leviathan" || report.Paths["manifest"] != "leviathan/manifest.json" {
+		t.Errorf("Expected the resolved storage paths, got %v", report.Paths)
+	}
+
+	statuses := map[string]string{}
+	for _, resource := range report.Resources {
+		statuses[resource.Path] = resource.Status
+	}
+	if statuses["leviathan/audio/chapter 1.mp3"] != resourceUploaded {
+		t.Errorf("Expected the first track to be uploaded, got %v", statuses)
+	}
+	if statuses["leviathan/cover.jpg"] != resourceExcluded {
+		t.Errorf("Expected the cover to be excluded, got %v", statuses)
+	}
+
+	// A second run reports every file as unchanged
+	again, err := p.Process(source, "leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Second Process failed: %v", err)
+	}
+	for _, resource := range again.Debug.Resources {
+		if resource.Status != resourceUnchanged && resource.Status != resourceExcluded {
+			t.Errorf("Expected %s to be unchanged, got %s", resource.Path, resource.Status)
+		}
+	}
+
+	// Without the option there is no report
+	options.Debug = false
+	plain, err := p.Process(source, "leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Third Process failed: %v", err)
+	}
+	if plain.Debug != nil || plain.ResponseData(options)["debug"] != nil {
+		t.Errorf("Expected no debug report, got %+v", plain.Debug)
+	}
+}
+
+func TestProcess_DebugReportOnFailure(t *testing.T) {
+	source := spoolTestArchive(t, map[string]string{lpfManifestPath: "not json"})
+	p := New(nil, nil)
+
+	_, err := p.Process(source, "broken.lpf", Options{Debug: true})
+	if err == nil {
+		t.Fatal("Expected an error for an unreadable manifest")
+	}
+	if StatusCode(err) != 400 {
+		t.Errorf("Expected status 400 through the debug report, got %d", StatusCode(err))
+	}
+	report := DebugReportOf(err)
+	if report == nil || len(report.Phases) != 2 || report.Phases[1].Name != "parse" {
+		t.Errorf("Expected a report covering the open and parse phases, got %+v", report)
+	}
+
+	_, err = p.Process(source, "broken.lpf", Options{})
+	if DebugReportOf(err) != nil {
+		t.Error("Expected no debug report without the option")
+	}
+	if failure := FailureOf(err); failure == nil || failure.Phase != "parse" || failure.Stack != nil {
+		t.Errorf("Expected the failure to be in the parse phase, got %+v", failure)
+	}
+}
+
+func TestProcess_RecoversPanics(t *testing.T) {
+	source := spoolTestArchive(t, map[string]string{lpfManifestPath: testPublicationJSON})
+	// Without an uploader the pipeline panics when it loads the previous index
+	p := New(nil, nil)
+
+	_, err := p.Process(source, "leviathan.lpf", Options{})
+	if err == nil {
+		t.Fatal("Expected the panic to be returned as an error")
+	}
+	failure := FailureOf(err)
+	if failure == nil || failure.Phase != "resources" || len(failure.Stack) == 0 {
+		t.Fatalf("Expected a stack trace in the resources phase, got %+v", failure)
+	}
+	if failure.Publication["title"] == "" {
+		t.Errorf("Expected the parsed publication metadata, got %v", failure.Publication)
+	}
+}
@@ -0,0 +1,308 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IndexPath is where the per-publication hash index is stored, relative to basePath.
+// Every run writes it, so it also marks the prefixes that hold a publication.
+const IndexPath = "readium/index.json"
+
+// resourceIndex is the sidecar stored next to the manifest, mapping each uploaded
+// storage path to the SHA-256 of the bytes that were uploaded there
+type resourceIndex struct {
+	Version   int               `json:"version"`
+	Resources map[string]string `json:"resources"`
+	// Source is the SHA-256 of the EPUB the publication was processed from
+	Source string `json:"source,omitempty"`
+	// SourceVersion is the version of the object that EPUB was fetched from
+	SourceVersion *SourceVersion `json:"source_version,omitempty"`
+	// Filename is the filename of that EPUB, to tell publications whose
+	// filenames map to the same basePath apart
+	Filename string `json:"filename,omitempty"`
+}
+
+// deltaUploader wraps an Uploader and skips uploads whose content hash matches
+// the index written by the previous run, so reprocessing only re-uploads changed files
+type deltaUploader struct {
+	uploader Uploader
+	previous map[string]string
+	current  map[string]string
+	// force uploads every file, without reading the previous index: any of
+	// them may replace another version
+	force bool
+	// checksums maps each stored path to the integrity checksum of its content
+	checksums map[string]string
+	uploaded  int
+	skipped   int
+	// uploadedBytes is the stored size of the uploaded files
+	uploadedBytes int64
+	// overwritten lists the uploaded paths that replaced what a previous run
+	// stored there, or may have when forced
+	overwritten []string
+	// pack, when set, receives every file uploaded under the publication's basePath
+	pack *webpubPackager
+	// compression is applied to text resources before they are stored
+	compression string
+	// encrypter, when set, encrypts the resources of a protected publication
+	encrypter *lcpEncrypter
+	// debug, when set, records the outcome for every file
+	debug *debugRecorder
+	// sourceHash and sourceVersion are recorded in the index, to tell whether a
+	// publication is up to date, and sourceFilename, to tell whose it is
+	sourceHash     string
+	sourceVersion  *SourceVersion
+	sourceFilename string
+	// deadline, when set, is when the job runs out of time: nothing is stored after it
+	deadline time.Time
+	// queue, when set, runs the uploads concurrently (see ConcurrentUploader)
+	queue *uploadQueue
+	// progress, when set, counts the bytes stored
+	progress *progressReporter
+}
+
+// newDeltaUploader creates an uploader seeded with the previous index for basePath.
+// When force is true (or no index exists yet) every file is uploaded.
+func newDeltaUploader(basePath string, uploader Uploader, force bool) *deltaUploader {
+	d := &deltaUploader{
+		uploader:  uploader,
+		previous:  map[string]string{},
+		current:   map[string]string{},
+		checksums: map[string]string{},
+		force:     force,
+	}
+	if concurrent, ok := uploader.(ConcurrentUploader); ok && concurrent.UploadConcurrency() > 1 {
+		d.queue = newUploadQueue(concurrent.UploadConcurrency())
+	}
+	if force {
+		return d
+	}
+
+	indexPath := fmt.Sprintf("%s/%s", basePath, IndexPath)
+	data, err := uploader.Download(indexPath)
+	if err != nil {
+		// A missing index just means this is the first run for this publication
+		log.Printf("No previous resource index for %s, uploading everything: %v", basePath, err)
+		return d
+	}
+
+	var index resourceIndex
+	if err := json.Unmarshal(data, &index); err != nil || index.Resources == nil {
+		log.Printf("Warning: ignoring unreadable resource index %s: %v", indexPath, err)
+		return d
+	}
+	d.previous = index.Resources
+	return d
+}
+
+// upload uploads data to path unless the previous run uploaded identical bytes there,
+// returning the public URL of the object either way
+func (d *deltaUploader) upload(path string, data []byte) (string, error) {
+	if !d.deadline.IsZero() && time.Now().After(d.deadline) {
+		return "", &statusError{status: 504, err: fmt.Errorf("processing ran past its deadline before storing %s", path)}
+	}
+	// Stop at the first failed upload rather than when the uploads are awaited
+	if err := d.queue.failure(); err != nil {
+		return "", err
+	}
+	if d.pack.accepts(path) {
+		if err := d.pack.add(path, data); err != nil {
+			return "", fmt.Errorf("failed to package %s: %w", path, err)
+		}
+		// Files that only go into the package are neither uploaded nor indexed
+		if !d.pack.exploded {
+			d.debug.resource(path, resourcePackaged, len(data), nil)
+			return d.uploader.PublicURL(path), nil
+		}
+	}
+
+	// Encrypted resources are stored as is, since ciphertext doesn't compress
+	encoding := ""
+	if d.encrypter.accepts(path) {
+		encrypted, err := d.encrypter.encrypt(path, data)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt %s: %w", path, err)
+		}
+		data = encrypted
+		d.checksums[path] = integrityChecksum(data)
+	} else {
+		d.checksums[path] = integrityChecksum(data)
+		compressed, compressedEncoding, err := compressResource(path, data, d.compression)
+		if err != nil {
+			return "", err
+		}
+		data, encoding = compressed, compressedEncoding
+	}
+
+	hash := hashContent(data)
+	d.current[path] = hash
+
+	if d.previous[path] == hash {
+		d.skipped++
+		d.debug.resource(path, resourceUnchanged, len(data), nil)
+		return d.uploader.PublicURL(path), nil
+	}
+
+	d.progress.stored(len(data))
+	if d.queue != nil {
+		d.queue.start(path, len(data), func() error {
+			_, err := d.uploader.Upload(path, data, encoding)
+			return err
+		})
+		return d.uploader.PublicURL(path), nil
+	}
+	publicURL, err := d.uploader.Upload(path, data, encoding)
+	if err != nil {
+		d.debug.resource(path, resourceFailed, len(data), err)
+		return "", err
+	}
+	d.recordUpload(path, len(data))
+	d.debug.resource(path, resourceUploaded, len(data), nil)
+	return publicURL, nil
+}
+
+// wait waits for the uploads started so far, recording their outcome, and
+// returns the error of the first that failed
+func (d *deltaUploader) wait() error {
+	if d.queue == nil {
+		return nil
+	}
+	var first error
+	for _, result := range d.queue.wait() {
+		if result.err != nil {
+			d.debug.resource(result.path, resourceFailed, result.size, result.err)
+			if first == nil {
+				first = result.err
+			}
+			continue
+		}
+		d.recordUpload(result.path, result.size)
+		d.debug.resource(result.path, resourceUploaded, result.size, nil)
+	}
+	return first
+}
+
+// recordUpload counts a successful upload of size bytes to path
+func (d *deltaUploader) recordUpload(path string, size int) {
+	d.uploaded++
+	d.uploadedBytes += int64(size)
+	if d.force || d.previous[path] != "" {
+		d.overwritten = append(d.overwritten, path)
+	}
+}
+
+// uploadQueue runs uploads on a bounded number of goroutines, which also bounds
+// the bytes held in memory waiting to be uploaded
+type uploadQueue struct {
+	slots   chan struct{}
+	group   sync.WaitGroup
+	mu      sync.Mutex
+	results []uploadResult
+	failed  error
+}
+
+// uploadResult is the outcome of a queued upload
+type uploadResult struct {
+	path string
+	size int
+	err  error
+}
+
+// newUploadQueue returns a queue running up to workers uploads at once
+func newUploadQueue(workers int) *uploadQueue {
+	return &uploadQueue{slots: make(chan struct{}, workers)}
+}
+
+// start runs upload once a worker is free
+func (q *uploadQueue) start(path string, size int, upload func() error) {
+	q.slots <- struct{}{}
+	q.group.Add(1)
+	go func() {
+		defer q.group.Done()
+		err := upload()
+		<-q.slots
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.results = append(q.results, uploadResult{path: path, size: size, err: err})
+		if err != nil && q.failed == nil {
+			q.failed = err
+		}
+	}()
+}
+
+// failure returns the error of the first failed upload, if any
+func (q *uploadQueue) failure() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.failed
+}
+
+// wait waits for the running uploads and returns the results collected since
+// the last wait
+func (q *uploadQueue) wait() []uploadResult {
+	q.group.Wait()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	results := q.results
+	q.results = nil
+	return results
+}
+
+// saveIndex uploads the index of everything uploaded (or skipped) during this run
+func (d *deltaUploader) saveIndex(basePath string) error {
+	indexJSON, err := json.MarshalIndent(resourceIndex{Version: 1, Resources: d.current, Source: d.sourceHash, SourceVersion: d.sourceVersion, Filename: d.sourceFilename}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal resource index: %w", err)
+	}
+
+	indexPath := fmt.Sprintf("%s/%s", basePath, IndexPath)
+	if _, err := d.uploader.Upload(indexPath, indexJSON, ""); err != nil {
+		return fmt.Errorf("failed to upload resource index: %w", err)
+	}
+	return nil
+}
+
+// SourceHash returns the SHA-256 of the EPUB the publication at basePath was
+// last processed from (see Source.Hash), or "" if it has not been processed, or
+// was processed before the hash was recorded
+func (p *Processor) SourceHash(basePath string) string {
+	data, err := p.uploader.Download(fmt.Sprintf("%s/%s", basePath, IndexPath))
+	if err != nil {
+		return ""
+	}
+	var index resourceIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ""
+	}
+	return index.Source
+}
+
+// IndexedPaths returns the storage paths recorded in a resource index, sorted
+func IndexedPaths(data []byte) ([]string, error) {
+	var index resourceIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse resource index: %w", err)
+	}
+	paths := make([]string, 0, len(index.Resources))
+	for path := range index.Resources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// hashContent returns the hex-encoded SHA-256 of data
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
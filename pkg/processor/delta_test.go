@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestDeltaUploader_SkipsUnchangedResources(t *testing.T) {
+	unchanged := []byte("<html>unchanged</html>")
+	previous := resourceIndex{
+		Version: 1,
+		Resources: map[string]string{
+			"book/chapter1.xhtml": hashContent(unchanged),
+			"book/chapter2.xhtml": hashContent([]byte("old content")),
+		},
+	}
+
+	uploads := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/storage/v1/object/"+ManifestBucket+"/")
+		switch r.Method {
+		case "GET":
+			if path == "book/"+IndexPath {
+				json.NewEncoder(w).Encode(previous)
+				return
+			}
+			http.NotFound(w, r)
+		case "POST":
+			uploads[path] = true
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	delta := newDeltaUploader("book", NewSupabase(server.URL, "test-key"), false)
+
+	if _, err := delta.upload("book/chapter1.xhtml", unchanged); err != nil {
+		t.Fatalf("upload chapter1: %v", err)
+	}
+	if _, err := delta.upload("book/chapter2.xhtml", []byte("new content")); err != nil {
+		t.Fatalf("upload chapter2: %v", err)
+	}
+
+	if uploads["book/chapter1.xhtml"] {
+		t.Errorf("Expected unchanged chapter1 to be skipped")
+	}
+	if !uploads["book/chapter2.xhtml"] {
+		t.Errorf("Expected changed chapter2 to be uploaded")
+	}
+	if delta.skipped != 1 || delta.uploaded != 1 {
+		t.Errorf("Expected 1 skipped and 1 uploaded, got %d skipped and %d uploaded", delta.skipped, delta.uploaded)
+	}
+
+	// Only chapter2 replaced a stored version
+	if _, err := delta.upload("book/chapter3.xhtml", []byte("added")); err != nil {
+		t.Fatalf("upload chapter3: %v", err)
+	}
+	if len(delta.overwritten) != 1 || delta.overwritten[0] != "book/chapter2.xhtml" {
+		t.Errorf("Expected chapter2 overwritten, got %v", delta.overwritten)
+	}
+}
+
+func TestDeltaUploader_ForceUploadsEverything(t *testing.T) {
+	uploads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			t.Errorf("Forced uploader should not fetch the previous index")
+		}
+		uploads++
+	}))
+	defer server.Close()
+
+	delta := newDeltaUploader("book", NewSupabase(server.URL, "test-key"), true)
+	if _, err := delta.upload("book/chapter1.xhtml", []byte("content")); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	if uploads != 1 {
+		t.Errorf("Expected 1 upload, got %d", uploads)
+	}
+}
+
+func TestProcessor_SourceHash(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	if hash := p.SourceHash("leviathan"); hash != "" {
+		t.Errorf("Expected no hash before processing, got %q", hash)
+	}
+	source := spoolTestArchive(t, map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+	})
+	if _, err := p.Process(source, "leviathan.lpf", Options{}); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if hash := p.SourceHash("leviathan"); hash != source.Hash() {
+		t.Errorf("Expected the index to record the source hash %s, got %q", source.Hash(), hash)
+	}
+}
@@ -0,0 +1,230 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+)
+
+// ManifestDiff is how a generated manifest differs from the published one
+type ManifestDiff struct {
+	// Published is false when nothing was published yet, so everything is new
+	Published bool `json:"published"`
+	// Fields lists the changed metadata fields ("metadata.title") and other
+	// top-level members that are not collections of links
+	Fields []FieldChange `json:"fields"`
+	// Links lists the links added, removed or changed in each collection
+	// (readingOrder, resources, links, toc, ...), matched by href
+	Links map[string]*LinkChanges `json:"links"`
+}
+
+// FieldChange is a changed manifest member; Before or After is nil when the
+// member was added or removed
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// LinkChanges are the changes to one collection of links
+type LinkChanges struct {
+	Added   []interface{} `json:"added,omitempty"`
+	Removed []interface{} `json:"removed,omitempty"`
+	Changed []LinkChange  `json:"changed,omitempty"`
+}
+
+// LinkChange is a link whose properties changed
+type LinkChange struct {
+	Href   string      `json:"href"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Changed reports whether the manifests differ
+func (d *ManifestDiff) Changed() bool {
+	return !d.Published || len(d.Fields) > 0 || len(d.Links) > 0
+}
+
+// dryRunUploader keeps uploads in memory instead of storing them, so a run can
+// be previewed without changing the published publication. Reads go to the
+// wrapped uploader.
+type dryRunUploader struct {
+	Uploader
+	uploads map[string][]byte
+}
+
+func newDryRunUploader(uploader Uploader) *dryRunUploader {
+	return &dryRunUploader{Uploader: uploader, uploads: map[string][]byte{}}
+}
+
+func (d *dryRunUploader) Upload(path string, data []byte, encoding string) (string, error) {
+	d.uploads[path] = data
+	return d.Uploader.PublicURL(path), nil
+}
+
+func (d *dryRunUploader) Create(path string, data []byte) (bool, error) {
+	d.uploads[path] = data
+	return true, nil
+}
+
+func (d *dryRunUploader) Delete(path string) error {
+	delete(d.uploads, path)
+	return nil
+}
+
+// diff processes the EPUB with a dry-run uploader and compares the generated
+// manifest with the published one. Every file is regenerated, since the dry run
+// cannot skip the unchanged ones it never stored, but the packaged outputs,
+// which are not compared, are not built.
+func (p *Processor) diff(source *Source, epubFilename string, options Options, debug *debugRecorder) (*Result, error) {
+	dryRun := newDryRunUploader(p.uploader)
+	options.Force = true
+	options.Package = packageNone
+	options.Repackage = false
+	preview := &Processor{fetcher: p.fetcher, uploader: dryRun}
+	generated, err := preview.process(source, epubFilename, options, debug)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestPath := fmt.Sprintf("%s/manifest.json", generated.BasePath)
+	diff, err := diffManifests(p.uploader, dryRun, manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Warnings: generated.Warnings, ParserWarnings: generated.ParserWarnings, Validation: generated.Validation, Links: generated.Links, Diff: diff}, nil
+}
+
+// diffManifests compares the manifest generated by a dry run with the published
+// one at manifestPath
+func diffManifests(published Uploader, dryRun *dryRunUploader, manifestPath string) (*ManifestDiff, error) {
+	generatedJSON, ok := dryRun.uploads[manifestPath]
+	if !ok {
+		return nil, fmt.Errorf("no manifest was generated at %s", manifestPath)
+	}
+	var generated map[string]interface{}
+	if err := json.Unmarshal(generatedJSON, &generated); err != nil {
+		return nil, fmt.Errorf("failed to parse generated manifest: %w", err)
+	}
+
+	diff := &ManifestDiff{Fields: []FieldChange{}, Links: map[string]*LinkChanges{}}
+	current := map[string]interface{}{}
+	if data, err := published.Download(manifestPath); err != nil {
+		log.Printf("No published manifest at %s, diffing against an empty one: %v", manifestPath, err)
+	} else if err := json.Unmarshal(data, &current); err != nil {
+		return nil, fmt.Errorf("failed to parse published manifest: %w", err)
+	} else {
+		diff.Published = true
+	}
+
+	for _, key := range unionKeys(current, generated) {
+		before, after := current[key], generated[key]
+		if key == "metadata" {
+			beforeMetadata, _ := before.(map[string]interface{})
+			afterMetadata, _ := after.(map[string]interface{})
+			for _, field := range unionKeys(beforeMetadata, afterMetadata) {
+				diff.addField("metadata."+field, beforeMetadata[field], afterMetadata[field])
+			}
+			continue
+		}
+		beforeLinks, beforeIsLinks := linkList(before)
+		afterLinks, afterIsLinks := linkList(after)
+		if (beforeIsLinks || before == nil) && (afterIsLinks || after == nil) {
+			if changes := diffLinks(beforeLinks, afterLinks); changes != nil {
+				diff.Links[key] = changes
+			}
+			continue
+		}
+		diff.addField(key, before, after)
+	}
+	return diff, nil
+}
+
+// addField records a changed field
+func (d *ManifestDiff) addField(field string, before, after interface{}) {
+	if !reflect.DeepEqual(before, after) {
+		d.Fields = append(d.Fields, FieldChange{Field: field, Before: before, After: after})
+	}
+}
+
+// diffLinks matches two lists of links by href, keeping the order of the lists.
+// It returns nil when they hold the same links.
+func diffLinks(before, after []map[string]interface{}) *LinkChanges {
+	beforeByHref := map[string]map[string]interface{}{}
+	for _, link := range before {
+		if href := linkHref(link); beforeByHref[href] == nil {
+			beforeByHref[href] = link
+		}
+	}
+	afterByHref := map[string]bool{}
+
+	changes := &LinkChanges{}
+	for _, link := range after {
+		href := linkHref(link)
+		if afterByHref[href] {
+			continue
+		}
+		afterByHref[href] = true
+		previous, ok := beforeByHref[href]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, link)
+		case !reflect.DeepEqual(previous, link):
+			changes.Changed = append(changes.Changed, LinkChange{Href: href, Before: previous, After: link})
+		}
+	}
+	for _, link := range before {
+		if href := linkHref(link); !afterByHref[href] {
+			afterByHref[href] = true
+			changes.Removed = append(changes.Removed, link)
+		}
+	}
+	if len(changes.Added) == 0 && len(changes.Removed) == 0 && len(changes.Changed) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// linkList returns value as a list of links, if it is one: a list of objects
+// with an href
+func linkList(value interface{}) ([]map[string]interface{}, bool) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	links := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		link, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if _, ok := link["href"].(string); !ok {
+			return nil, false
+		}
+		links = append(links, link)
+	}
+	return links, true
+}
+
+func linkHref(link map[string]interface{}) string {
+	href, _ := link["href"].(string)
+	return href
+}
+
+// unionKeys returns the keys of a and b, sorted
+func unionKeys(a, b map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, m := range []map[string]interface{}{a, b} {
+		for key := range m {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
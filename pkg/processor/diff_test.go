@@ -0,0 +1,117 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestProcess_Diff(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	entries := map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	}
+	options := Options{Diff: true}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	// Nothing published yet: everything is new
+	result, err := p.Process(spoolTestArchive(t, entries), "leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if result.Diff == nil || result.Diff.Published || !result.Diff.Changed() {
+		t.Fatalf("Expected a diff against nothing, got %+v", result.Diff)
+	}
+	if paths := supabase.Paths(ManifestBucket); len(paths) != 0 {
+		t.Fatalf("Expected a diff to store nothing, got %v", paths)
+	}
+
+	if _, err := p.Process(spoolTestArchive(t, entries), "leviathan.lpf", Options{}); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	published, _ := supabase.Object(ManifestBucket, "leviathan/manifest.json")
+
+	result, err = p.Process(spoolTestArchive(t, entries), "leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if result.Diff.Changed() {
+		t.Errorf("Expected no changes for the same EPUB, got %+v", result.Diff)
+	}
+
+	// With the cover dropped and a third chapter
+	entries[lpfManifestPath] = strings.NewReplacer(
+		`{"type": "LinkedResource", "rel": "cover", "url": "cover.jpg", "encodingFormat": "image/jpeg"},`, ``,
+		`"audio/chapter 1.mp3",`, `"audio/chapter 1.mp3", "audio/chapter3.mp3",`,
+	).Replace(testPublicationJSON)
+	entries["audio/chapter3.mp3"] = "three"
+	result, err = p.Process(spoolTestArchive(t, entries), "leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	diff := result.Diff
+	if order := diff.Links["readingOrder"]; order == nil || len(order.Added) != 1 || len(order.Removed) != 0 {
+		t.Errorf("Expected a chapter to be added to the reading order, got %+v", order)
+	}
+	if resources := diff.Links["resources"]; resources == nil || len(resources.Removed) != 1 {
+		t.Errorf("Expected the cover to be removed from the resources, got %+v", resources)
+	}
+
+	if current, _ := supabase.Object(ManifestBucket, "leviathan/manifest.json"); string(current) != string(published) {
+		t.Error("Expected the published manifest to be left alone")
+	}
+	if _, ok := supabase.Object(ManifestBucket, "leviathan/audio/chapter3.mp3"); ok {
+		t.Error("Expected the new chapter not to be uploaded")
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	supabase.Put(ManifestBucket, "book/manifest.json", []byte(`{
+		"metadata": {"title": "Moby Dick", "language": "en", "modified": "2020-01-01"},
+		"readingOrder": [{"href": "ch1.xhtml", "type": "application/xhtml+xml"}, {"href": "ch2.xhtml"}],
+		"toc": [{"href": "ch1.xhtml", "title": "One"}]
+	}`))
+
+	dryRun := newDryRunUploader(store)
+	dryRun.Upload("book/manifest.json", []byte(`{
+		"metadata": {"title": "Moby-Dick", "language": "en"},
+		"readingOrder": [{"href": "ch1.xhtml", "type": "application/xhtml+xml"}, {"href": "ch2.xhtml", "title": "Two"}],
+		"toc": [{"href": "ch1.xhtml", "title": "One"}],
+		"pageList": [{"href": "ch1.xhtml#p1", "title": "1"}]
+	}`), "")
+	diff, err := diffManifests(store, dryRun, "book/manifest.json")
+	if err != nil {
+		t.Fatalf("diffManifests failed: %v", err)
+	}
+
+	fields := map[string]FieldChange{}
+	for _, field := range diff.Fields {
+		fields[field.Field] = field
+	}
+	if len(fields) != 2 || fields["metadata.title"].After != "Moby-Dick" || fields["metadata.modified"].After != nil {
+		t.Errorf("Expected the title to change and the modified date to go, got %+v", diff.Fields)
+	}
+	if order := diff.Links["readingOrder"]; order == nil || len(order.Changed) != 1 || order.Changed[0].Href != "ch2.xhtml" {
+		t.Errorf("Expected ch2 to change, got %+v", order)
+	}
+	if pageList := diff.Links["pageList"]; pageList == nil || len(pageList.Added) != 1 {
+		t.Errorf("Expected a page list to be added, got %+v", pageList)
+	}
+	if _, ok := diff.Links["toc"]; ok {
+		t.Error("Expected the unchanged toc to be left out")
+	}
+}
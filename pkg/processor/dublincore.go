@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// Namespace the parser uses as the key prefix for Dublin Core elements it
+// passes through as other metadata
+const dcTermsNamespace = "http://purl.org/dc/terms/"
+
+// passthroughDCElements are the Dublin Core elements without a dedicated
+// manifest field, written to the metadata under their element name
+var passthroughDCElements = []string{"rights", "source", "relation", "coverage"}
+
+// addDublinCoreFromOPF carries the Dublin Core metadata the manifest would
+// otherwise lose or mangle: rights, source, relation and coverage statements
+// as plain strings, the publisher when the parser found none, and creators
+// whose role says they are not authors (e.g. opf:role="trl").
+func addDublinCoreFromOPF(metadata *manifest.Metadata, pkg *epubPackage) {
+	for _, name := range passthroughDCElements {
+		var values []string
+		for _, e := range pkg.metaElements(name) {
+			if value := strings.TrimSpace(e.Value); value != "" {
+				values = append(values, value)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		if metadata.OtherMetadata == nil {
+			metadata.OtherMetadata = map[string]interface{}{}
+		}
+		delete(metadata.OtherMetadata, dcTermsNamespace+name)
+		if len(values) == 1 {
+			metadata.OtherMetadata[name] = values[0]
+		} else {
+			metadata.OtherMetadata[name] = values
+		}
+	}
+
+	if len(metadata.Publishers) == 0 {
+		for _, e := range pkg.metaElements("publisher") {
+			if name := strings.TrimSpace(e.Value); name != "" {
+				metadata.Publishers = append(metadata.Publishers, manifest.Contributor{LocalizedName: manifest.NewLocalizedStringFromString(name)})
+			}
+		}
+	}
+
+	refinements := pkg.refinements()
+	for _, e := range pkg.metaElements("creator") {
+		role := e.attr("role")
+		if refined := refinements[e.attr("id")]; refined["role"] != "" {
+			role = refined["role"]
+		}
+		target := contributorsForRole(metadata, role)
+		if target == nil || target == &metadata.Authors {
+			continue
+		}
+		moveContributor(&metadata.Authors, target, strings.TrimSpace(e.Value))
+	}
+}
+
+// contributorsForRole returns the manifest contributor list for a MARC relator
+// code, or nil for roles without a dedicated list
+func contributorsForRole(metadata *manifest.Metadata, role string) *manifest.Contributors {
+	switch strings.ToLower(strings.TrimSpace(role)) {
+	case "aut":
+		return &metadata.Authors
+	case "trl":
+		return &metadata.Translators
+	case "edt":
+		return &metadata.Editors
+	case "art":
+		return &metadata.Artists
+	case "ill":
+		return &metadata.Illustrators
+	case "clr":
+		return &metadata.Colorists
+	case "nrt":
+		return &metadata.Narrators
+	case "pbl":
+		return &metadata.Publishers
+	}
+	return nil
+}
+
+// moveContributor moves the contributor with the given name from one list to
+// another, unless the destination already has it
+func moveContributor(from, to *manifest.Contributors, name string) {
+	for i, c := range *from {
+		if !strings.EqualFold(strings.TrimSpace(c.Name()), name) {
+			continue
+		}
+		*from = append((*from)[:i:i], (*from)[i+1:]...)
+		for _, existing := range *to {
+			if strings.EqualFold(strings.TrimSpace(existing.Name()), name) {
+				return
+			}
+		}
+		*to = append(*to, c)
+		return
+	}
+}
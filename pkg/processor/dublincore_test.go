@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestDublinCoreRoundTrip(t *testing.T) {
+	names := func(contributors manifest.Contributors) []string {
+		var result []string
+		for _, c := range contributors {
+			result = append(result, c.Name())
+		}
+		return result
+	}
+	date := func(d *time.Time) string {
+		if d == nil {
+			return ""
+		}
+		return d.Format("2006-01-02")
+	}
+
+	tests := []struct {
+		field    string
+		opf      string
+		parsed   manifest.Metadata
+		expected func(m *manifest.Metadata) (interface{}, interface{})
+	}{
+		{
+			"publisher",
+			`<dc:publisher>Tor Books</dc:publisher>`,
+			manifest.Metadata{},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return []string{"Tor Books"}, names(m.Publishers)
+			},
+		},
+		{
+			"publisher from parser",
+			`<dc:publisher>Tor</dc:publisher>`,
+			manifest.Metadata{Publishers: manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Tor Books")}}},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return []string{"Tor Books"}, names(m.Publishers)
+			},
+		},
+		{
+			"author",
+			`<dc:creator opf:role="aut">Doe, Jane</dc:creator>`,
+			manifest.Metadata{Authors: manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Doe, Jane")}}},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return []string{"Jane Doe"}, names(m.Authors)
+			},
+		},
+		{
+			"translator (EPUB 2 role)",
+			`<dc:creator opf:role="trl">Doe, Jane</dc:creator>`,
+			manifest.Metadata{Authors: manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Doe, Jane")}}},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return []string{"Jane Doe"}, append(names(m.Authors), names(m.Translators)...)
+			},
+		},
+		{
+			"illustrator (EPUB 3 role)",
+			`<dc:creator id="c1">John Roe</dc:creator><meta refines="#c1" property="role" scheme="marc:relators">ill</meta>`,
+			manifest.Metadata{Authors: manifest.Contributors{
+				{LocalizedName: manifest.NewLocalizedStringFromString("Jane Doe")},
+				{LocalizedName: manifest.NewLocalizedStringFromString("John Roe")},
+			}},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return "[Jane Doe] [John Roe]", fmt.Sprint(names(m.Authors), names(m.Illustrators))
+			},
+		},
+		{
+			"contributor with other role",
+			`<dc:contributor opf:role="bkp">Acme Typesetting</dc:contributor>`,
+			manifest.Metadata{Contributors: manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Acme Typesetting"), Roles: manifest.Strings{"bkp"}}}},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return "[Acme Typesetting] [bkp]", fmt.Sprint(names(m.Contributors), m.Contributors[0].Roles)
+			},
+		},
+		{
+			"rights",
+			`<dc:rights>Copyright © 2020 Jane Doe. All rights reserved.</dc:rights>`,
+			manifest.Metadata{OtherMetadata: map[string]interface{}{dcTermsNamespace + "rights": "Copyright © 2020 Jane Doe. All rights reserved."}},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return []interface{}{"Copyright © 2020 Jane Doe. All rights reserved.", nil}, []interface{}{m.OtherMetadata["rights"], m.OtherMetadata[dcTermsNamespace+"rights"]}
+			},
+		},
+		{
+			"source",
+			`<dc:source>urn:isbn:9780765326355</dc:source><dc:source>Print edition</dc:source>`,
+			manifest.Metadata{},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return "[urn:isbn:9780765326355 Print edition]", fmt.Sprint(m.OtherMetadata["source"])
+			},
+		},
+		{
+			"published",
+			`<dc:date>2010-08-31</dc:date>`,
+			manifest.Metadata{},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return "2010-08-31", date(m.Published)
+			},
+		},
+		{
+			"modified (EPUB 3)",
+			`<meta property="dcterms:modified">2021-03-04T10:00:00Z</meta>`,
+			manifest.Metadata{},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return "2021-03-04", date(m.Modified)
+			},
+		},
+		{
+			"modified (EPUB 2)",
+			`<dc:date opf:event="publication">2010-08-31</dc:date><dc:date opf:event="modification">2012-01-15</dc:date>`,
+			manifest.Metadata{},
+			func(m *manifest.Metadata) (interface{}, interface{}) {
+				return "2010-08-31 2012-01-15", date(m.Published) + " " + date(m.Modified)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+			containerPath: validContainer,
+			"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:opf="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` + tt.opf + `</metadata>
+</package>`,
+		}))
+		if err != nil {
+			t.Fatalf("%s: failed to open package: %v", tt.field, err)
+		}
+
+		metadata := tt.parsed
+		normalizeMetadata(&metadata, pkg, nil)
+		if expected, got := tt.expected(&metadata); !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: expected %v, got %v", tt.field, expected, got)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// embeddingsAPIURLEnvVar is the OpenAI-compatible embeddings endpoint the
+	// chunks are sent to, e.g. https://api.openai.com/v1/embeddings
+	embeddingsAPIURLEnvVar = "EMBEDDINGS_API_URL"
+	embeddingsAPIKeyEnvVar = "EMBEDDINGS_API_KEY"
+	embeddingsModelEnvVar  = "EMBEDDINGS_MODEL"
+	// embeddingsTableEnvVar is the pgvector table the chunks are stored in
+	embeddingsTableEnvVar  = "EMBEDDINGS_TABLE"
+	defaultEmbeddingsTable = "publication_chunks"
+
+	// chunkMaxWords is the size of the chunks the chapters are split into, in words
+	chunkMaxWords = 200
+	// embeddingsBatchSize is the number of chunks embedded per request
+	embeddingsBatchSize = 64
+	embeddingsTimeout   = 60 * time.Second
+)
+
+// EmbeddedChunk is a chunk of the text of a chapter with its embedding, as
+// stored in the pgvector table: one row per chunk, keyed by publication, href
+// and chunk index, with the locator of where the chunk starts
+type EmbeddedChunk struct {
+	Publication string                 `json:"publication"`
+	Href        string                 `json:"href"`
+	Chunk       int                    `json:"chunk"`
+	Locator     map[string]interface{} `json:"locator"`
+	Content     string                 `json:"content"`
+	Embedding   []float64              `json:"embedding"`
+}
+
+// ChunkStore keeps the embedded chunks of the publications, for semantic
+// search over the library. Supabase stores them in a pgvector table.
+type ChunkStore interface {
+	// ReplaceChunks replaces the chunks stored in table for the publication
+	// at basePath
+	ReplaceChunks(table, basePath string, chunks []EmbeddedChunk) error
+}
+
+// textChunk is a run of paragraphs of a chapter, starting at progression
+type textChunk struct {
+	text        string
+	progression float64
+}
+
+// chunkText splits the text of a chapter (paragraphs separated by blank lines,
+// as extractPlainText returns it) into chunks of at most maxWords words,
+// breaking between paragraphs where possible
+func chunkText(text string, maxWords int) []textChunk {
+	var chunks []textChunk
+	var words []string
+	start, offset := 0, 0
+	flush := func(next int) {
+		if len(words) > 0 {
+			chunks = append(chunks, textChunk{text: strings.Join(words, " "), progression: float64(start) / float64(len(text))})
+		}
+		words, start = nil, next
+	}
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		paragraphWords := strings.Fields(paragraph)
+		if len(words) > 0 && len(words)+len(paragraphWords) > maxWords {
+			flush(offset)
+		}
+		// extractPlainText collapses whitespace, so each word is followed by one space
+		wordOffset := offset
+		for _, word := range paragraphWords {
+			if len(words) == maxWords {
+				flush(wordOffset)
+			}
+			words = append(words, word)
+			wordOffset += len(word) + 1
+		}
+		offset += len(paragraph) + 2
+	}
+	flush(offset)
+	return chunks
+}
+
+// embeddingsClient calls an OpenAI-compatible embeddings endpoint
+type embeddingsClient struct {
+	client *http.Client
+	url    string
+	apiKey string
+	model  string
+	table  string
+}
+
+// embeddingsClientFromEnv returns the client of EMBEDDINGS_API_URL, or nil if
+// it isn't set
+func embeddingsClientFromEnv() *embeddingsClient {
+	apiURL := os.Getenv(embeddingsAPIURLEnvVar)
+	if apiURL == "" {
+		return nil
+	}
+	table := os.Getenv(embeddingsTableEnvVar)
+	if table == "" {
+		table = defaultEmbeddingsTable
+	}
+	return &embeddingsClient{
+		client: NewHTTPClient(embeddingsTimeout),
+		url:    apiURL,
+		apiKey: os.Getenv(embeddingsAPIKeyEnvVar),
+		model:  os.Getenv(embeddingsModelEnvVar),
+		table:  table,
+	}
+}
+
+// embed returns the embeddings of texts, in order
+func (c *embeddingsClient) embed(texts []string) ([][]float64, error) {
+	request := map[string]interface{}{"input": texts}
+	if c.model != "" {
+		request["model"] = c.model
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	embeddings := make([][]float64, len(texts))
+	for _, item := range response.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("response has an embedding for input %d of %d", item.Index, len(texts))
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	for i, embedding := range embeddings {
+		if len(embedding) == 0 {
+			return nil, fmt.Errorf("response has no embedding for input %d", i)
+		}
+	}
+	return embeddings, nil
+}
+
+// embedChapters chunks the text of the chapters and embeds each chunk, with the
+// locator of where it starts
+func (c *embeddingsClient) embedChapters(chapters []chapterText, basePath string) ([]EmbeddedChunk, error) {
+	var chunks []EmbeddedChunk
+	for _, chapter := range chapters {
+		for i, chunk := range chunkText(chapter.Text, chunkMaxWords) {
+			locator := map[string]interface{}{
+				"href":      chapter.Href,
+				"type":      "application/xhtml+xml",
+				"locations": map[string]interface{}{"progression": chunk.progression},
+			}
+			if chapter.Title != "" {
+				locator["title"] = chapter.Title
+			}
+			chunks = append(chunks, EmbeddedChunk{Publication: basePath, Href: chapter.Href, Chunk: i, Locator: locator, Content: chunk.text})
+		}
+	}
+
+	for start := 0; start < len(chunks); start += embeddingsBatchSize {
+		batch := chunks[start:min(start+embeddingsBatchSize, len(chunks))]
+		texts := make([]string, len(batch))
+		for i := range batch {
+			texts[i] = batch[i].Content
+		}
+		embeddings, err := c.embed(texts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed chunks %d-%d: %w", start, start+len(batch)-1, err)
+		}
+		for i := range batch {
+			batch[i].Embedding = embeddings[i]
+		}
+	}
+	return chunks, nil
+}
+
+// storeEmbeddings embeds the chapters and replaces the chunks of the
+// publication in the chunk store, returning the number of chunks stored
+func storeEmbeddings(client *embeddingsClient, store ChunkStore, chapters []chapterText, basePath string) (int, error) {
+	if client == nil {
+		return 0, fmt.Errorf("embeddings require %s to be set", embeddingsAPIURLEnvVar)
+	}
+	if store == nil {
+		return 0, fmt.Errorf("the storage has no table to store embeddings in")
+	}
+	chunks, err := client.embedChapters(chapters, basePath)
+	if err != nil {
+		return 0, err
+	}
+	if err := store.ReplaceChunks(client.table, basePath, chunks); err != nil {
+		return 0, fmt.Errorf("failed to store embeddings: %w", err)
+	}
+	return len(chunks), nil
+}
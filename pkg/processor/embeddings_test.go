@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestChunkText(t *testing.T) {
+	text := "one two three\n\nfour five\n\nsix seven eight nine ten"
+	chunks := chunkText(text, 5)
+	want := []struct {
+		text  string
+		start int
+	}{
+		{"one two three four five", 0},
+		{"six seven eight nine ten", strings.Index(text, "six")},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("Expected %d chunks, got %+v", len(want), chunks)
+	}
+	for i, w := range want {
+		if chunks[i].text != w.text || chunks[i].progression != float64(w.start)/float64(len(text)) {
+			t.Errorf("Chunk %d: expected %q at %d, got %+v", i, w.text, w.start, chunks[i])
+		}
+	}
+
+	// Paragraphs longer than a chunk are split between words
+	long := chunkText("a b c d e f g", 3)
+	if len(long) != 3 || long[1].text != "d e f" || long[1].progression != 6.0/13 || long[2].text != "g" {
+		t.Errorf("Expected a long paragraph split in three, got %+v", long)
+	}
+	if chunks := chunkText("", 5); len(chunks) != 0 {
+		t.Errorf("Expected no chunks for no text, got %+v", chunks)
+	}
+}
+
+func TestStoreEmbeddings(t *testing.T) {
+	var model string
+	embeddings := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Input []string `json:"input"`
+			Model string   `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		model = request.Model
+		var data []map[string]interface{}
+		for i := len(request.Input) - 1; i >= 0; i-- {
+			data = append(data, map[string]interface{}{"index": i, "embedding": []float64{float64(len(request.Input[i])), 1}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer embeddings.Close()
+	t.Setenv(embeddingsAPIURLEnvVar, embeddings.URL)
+	t.Setenv(embeddingsModelEnvVar, "test-model")
+
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	if err := store.ReplaceChunks(defaultEmbeddingsTable, "books/b1", []EmbeddedChunk{{Publication: "books/b1", Content: "stale"}}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.ReplaceChunks(defaultEmbeddingsTable, "books/b2", []EmbeddedChunk{{Publication: "books/b2", Content: "other"}}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	chapters := []chapterText{
+		{Href: "OEBPS/ch1.xhtml", Title: "Loomings", Text: "Call me Ishmael.\n\nSome years ago."},
+		{Href: "OEBPS/ch2.xhtml", Text: "The Carpet-Bag."},
+	}
+	stored, err := storeEmbeddings(embeddingsClientFromEnv(), store, chapters, "books/b1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stored != 2 || model != "test-model" {
+		t.Errorf("Expected 2 chunks embedded with the model, got %d with %q", stored, model)
+	}
+
+	rows := supabase.Rows(defaultEmbeddingsTable)
+	if len(rows) != 3 || rows[0]["content"] != "other" {
+		t.Fatalf("Expected the stale chunk replaced and the other publication kept, got %v", rows)
+	}
+	first := rows[1]
+	if first["publication"] != "books/b1" || first["href"] != "OEBPS/ch1.xhtml" || first["content"] != "Call me Ishmael. Some years ago." {
+		t.Errorf("Expected the first chunk of ch1, got %v", first)
+	}
+	if embedding, _ := first["embedding"].([]interface{}); len(embedding) != 2 || embedding[0] != float64(len("Call me Ishmael. Some years ago.")) {
+		t.Errorf("Expected the embedding of the chunk, got %v", first["embedding"])
+	}
+	if locator, _ := first["locator"].(map[string]interface{}); locator["href"] != "OEBPS/ch1.xhtml" || locator["title"] != "Loomings" {
+		t.Errorf("Expected the locator of the chunk, got %v", first["locator"])
+	}
+
+	t.Setenv(embeddingsAPIURLEnvVar, "")
+	if _, err := storeEmbeddings(embeddingsClientFromEnv(), store, chapters, "books/b1"); err == nil || !strings.Contains(err.Error(), embeddingsAPIURLEnvVar) {
+		t.Errorf("Expected an error without %s, got %v", embeddingsAPIURLEnvVar, err)
+	}
+}
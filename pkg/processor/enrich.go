@@ -0,0 +1,296 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+const (
+	enrichmentProviderEnvVar = "ENRICHMENT_PROVIDER"
+	enrichmentAPIURLEnvVar   = "ENRICHMENT_API_URL"
+	googleBooksAPIKeyEnvVar  = "GOOGLE_BOOKS_API_KEY"
+
+	providerOpenLibrary = "openlibrary"
+	providerGoogleBooks = "googlebooks"
+
+	defaultOpenLibraryURL = "https://openlibrary.org"
+	defaultGoogleBooksURL = "https://www.googleapis.com"
+
+	enrichmentTimeout = 10 * time.Second
+)
+
+// bookInfo is the metadata a lookup service returned for an ISBN
+type bookInfo struct {
+	Subjects       []string
+	Description    string
+	Publisher      string
+	Published      *time.Time
+	Series         string
+	SeriesPosition *float64
+}
+
+// metadataProvider looks up book metadata by ISBN. A nil result with no error
+// means the service doesn't know the book.
+type metadataProvider interface {
+	lookupISBN(isbn string) (*bookInfo, error)
+}
+
+// metadataProviderFromEnv returns the configured lookup service (OpenLibrary by default)
+func metadataProviderFromEnv() (metadataProvider, error) {
+	client := NewHTTPClient(enrichmentTimeout)
+	baseURL := strings.TrimSuffix(os.Getenv(enrichmentAPIURLEnvVar), "/")
+	switch provider := strings.ToLower(os.Getenv(enrichmentProviderEnvVar)); provider {
+	case "", providerOpenLibrary:
+		if baseURL == "" {
+			baseURL = defaultOpenLibraryURL
+		}
+		return &openLibraryProvider{client: client, baseURL: baseURL}, nil
+	case providerGoogleBooks:
+		if baseURL == "" {
+			baseURL = defaultGoogleBooksURL
+		}
+		return &googleBooksProvider{client: client, baseURL: baseURL, apiKey: os.Getenv(googleBooksAPIKeyEnvVar)}, nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q", enrichmentProviderEnvVar, provider)
+	}
+}
+
+// enrichMetadata looks up the publication's ISBN and fills in the subjects,
+// description, publisher, publication date and series the EPUB doesn't provide.
+// Lookup failures only produce warnings. pkg may be nil.
+func enrichMetadata(metadata *manifest.Metadata, pkg *epubPackage, provider metadataProvider) []string {
+	isbn := findISBN(metadata, pkg)
+	if isbn == "" {
+		return []string{"enrichment skipped: no ISBN in the publication identifiers"}
+	}
+
+	info, err := provider.lookupISBN(isbn)
+	if err != nil {
+		return []string{fmt.Sprintf("enrichment lookup for ISBN %s failed: %v", isbn, err)}
+	}
+	if info == nil {
+		return []string{fmt.Sprintf("enrichment found no record for ISBN %s", isbn)}
+	}
+
+	if len(metadata.Subjects) == 0 {
+		for _, subject := range info.Subjects {
+			metadata.Subjects = append(metadata.Subjects, manifest.Subject{LocalizedName: manifest.NewLocalizedStringFromString(subject)})
+		}
+	}
+	if metadata.Description == "" {
+		metadata.Description = info.Description
+	}
+	if len(metadata.Publishers) == 0 && info.Publisher != "" {
+		metadata.Publishers = manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString(info.Publisher)}}
+	}
+	if metadata.Published == nil {
+		metadata.Published = info.Published
+	}
+	if info.Series != "" && len(metadata.BelongsTo["series"]) == 0 {
+		if metadata.BelongsTo == nil {
+			metadata.BelongsTo = map[string]manifest.Collections{}
+		}
+		metadata.BelongsTo["series"] = manifest.Collections{{
+			LocalizedName: manifest.NewLocalizedStringFromString(info.Series),
+			Position:      info.SeriesPosition,
+		}}
+	}
+	return nil
+}
+
+// findISBN returns the first valid ISBN among the publication identifiers, as digits
+func findISBN(metadata *manifest.Metadata, pkg *epubPackage) string {
+	candidates := []string{metadata.Identifier}
+	for _, alt := range metadata.AltIdentifiers {
+		candidates = append(candidates, alt.Value)
+	}
+	if pkg != nil {
+		for _, e := range pkg.metaElements("identifier") {
+			candidates = append(candidates, e.Value)
+		}
+	}
+	for _, candidate := range candidates {
+		if isbn := normalizeISBN(candidate); isbn != "" {
+			return isbn
+		}
+	}
+	return ""
+}
+
+// normalizeISBN strips "urn:isbn:" prefixes and separators from an identifier and
+// returns it if it is a valid ISBN-10 or ISBN-13, or "" otherwise
+func normalizeISBN(identifier string) string {
+	identifier = strings.TrimSpace(strings.ToLower(identifier))
+	for _, prefix := range []string{"urn:isbn:", "isbn:", "isbn"} {
+		identifier = strings.TrimPrefix(identifier, prefix)
+	}
+	isbn := strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(identifier)))
+
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, r := range isbn {
+			digit := int(r - '0')
+			if r == 'X' && i == 9 {
+				digit = 10
+			} else if r < '0' || r > '9' {
+				return ""
+			}
+			sum += digit * (10 - i)
+		}
+		if sum%11 == 0 {
+			return isbn
+		}
+	case 13:
+		sum := 0
+		for i, r := range isbn {
+			if r < '0' || r > '9' {
+				return ""
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += int(r-'0') * weight
+		}
+		if sum%10 == 0 {
+			return isbn
+		}
+	}
+	return ""
+}
+
+// openLibraryProvider looks books up in the OpenLibrary editions API
+type openLibraryProvider struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (p *openLibraryProvider) lookupISBN(isbn string) (*bookInfo, error) {
+	var edition struct {
+		Publishers  []string        `json:"publishers"`
+		PublishDate string          `json:"publish_date"`
+		Series      []string        `json:"series"`
+		Subjects    []string        `json:"subjects"`
+		Description json.RawMessage `json:"description"`
+	}
+	found, err := getJSON(p.client, fmt.Sprintf("%s/isbn/%s.json", p.baseURL, isbn), &edition)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	info := &bookInfo{Subjects: edition.Subjects}
+	if len(edition.Publishers) > 0 {
+		info.Publisher = edition.Publishers[0]
+	}
+	if published, ok := parseLooseDate(edition.PublishDate); ok {
+		info.Published = &published
+	}
+	if len(edition.Series) > 0 {
+		info.Series, info.SeriesPosition = splitSeriesNumber(edition.Series[0])
+	}
+	// description is either a string or {"type": "/type/text", "value": "..."}
+	if err := json.Unmarshal(edition.Description, &info.Description); err != nil {
+		var text struct {
+			Value string `json:"value"`
+		}
+		if json.Unmarshal(edition.Description, &text) == nil {
+			info.Description = text.Value
+		}
+	}
+	return info, nil
+}
+
+// googleBooksProvider looks books up in the Google Books volumes API
+type googleBooksProvider struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+}
+
+func (p *googleBooksProvider) lookupISBN(isbn string) (*bookInfo, error) {
+	query := url.Values{"q": {"isbn:" + isbn}}
+	if p.apiKey != "" {
+		query.Set("key", p.apiKey)
+	}
+	var result struct {
+		Items []struct {
+			VolumeInfo struct {
+				Description   string   `json:"description"`
+				Publisher     string   `json:"publisher"`
+				PublishedDate string   `json:"publishedDate"`
+				Categories    []string `json:"categories"`
+			} `json:"volumeInfo"`
+		} `json:"items"`
+	}
+	found, err := getJSON(p.client, fmt.Sprintf("%s/books/v1/volumes?%s", p.baseURL, query.Encode()), &result)
+	if err != nil || !found || len(result.Items) == 0 {
+		return nil, err
+	}
+
+	volume := result.Items[0].VolumeInfo
+	info := &bookInfo{
+		Subjects:    volume.Categories,
+		Description: volume.Description,
+		Publisher:   volume.Publisher,
+	}
+	if published, ok := parseLooseDate(volume.PublishedDate); ok {
+		info.Published = &published
+	}
+	return info, nil
+}
+
+// getJSON fetches a JSON document into v. A 404 is reported as not found rather than an error.
+func getJSON(client *http.Client, requestURL string, v any) (bool, error) {
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("request failed with status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return true, nil
+}
+
+// splitSeriesNumber splits a series label like "Discworld, #3" or "Discworld ; 3"
+// into the series name and its position
+func splitSeriesNumber(series string) (string, *float64) {
+	series = strings.TrimSpace(series)
+	if idx := strings.LastIndexAny(series, ",;#("); idx > 0 {
+		number := strings.Trim(series[idx:], ",;#() ")
+		number = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(strings.ToLower(number), "no.")), "#")
+		if position, err := strconv.ParseFloat(strings.TrimSpace(number), 64); err == nil {
+			name := strings.TrimRight(strings.TrimSpace(series[:idx]), ",;# ")
+			return name, &position
+		}
+	}
+	return series, nil
+}
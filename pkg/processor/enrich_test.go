@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := map[string]string{
+		"urn:isbn:978-0-306-40615-7": "9780306406157",
+		"ISBN 0-306-40615-2":         "0306406152",
+		"080442957X":                 "080442957X",
+		"978-0-306-40615-8":          "", // bad check digit
+		"urn:uuid:1234":              "",
+	}
+	for identifier, want := range tests {
+		if got := normalizeISBN(identifier); got != want {
+			t.Errorf("normalizeISBN(%q) = %q, want %q", identifier, got, want)
+		}
+	}
+}
+
+func TestSplitSeriesNumber(t *testing.T) {
+	tests := []struct {
+		series   string
+		name     string
+		position float64
+	}{
+		{"Discworld, #3", "Discworld", 3},
+		{"Discworld ; 3", "Discworld", 3},
+		{"The Expanse (no. 2.5)", "The Expanse", 2.5},
+		{"Discworld", "Discworld", 0},
+	}
+	for _, tt := range tests {
+		name, position := splitSeriesNumber(tt.series)
+		if name != tt.name || (position == nil) != (tt.position == 0) || position != nil && *position != tt.position {
+			t.Errorf("splitSeriesNumber(%q) = %q, %v, want %q, %v", tt.series, name, position, tt.name, tt.position)
+		}
+	}
+}
+
+func TestEnrichMetadata_OpenLibrary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/isbn/9780306406157.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{
+			"publishers": ["Plenum Press"],
+			"publish_date": "1994",
+			"series": ["Physics Texts, #2"],
+			"subjects": ["Physics", "Textbooks"],
+			"description": {"type": "/type/text", "value": "An introduction."}
+		}`))
+	}))
+	defer server.Close()
+
+	t.Setenv(enrichmentProviderEnvVar, providerOpenLibrary)
+	t.Setenv(enrichmentAPIURLEnvVar, server.URL)
+	provider, err := metadataProviderFromEnv()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	metadata := manifest.Metadata{
+		Identifier:  "urn:isbn:978-0-306-40615-7",
+		Description: "Publisher description",
+	}
+	if warnings := enrichMetadata(&metadata, nil, provider); len(warnings) != 0 {
+		t.Fatalf("Expected no warnings, got %v", warnings)
+	}
+
+	if metadata.Description != "Publisher description" {
+		t.Errorf("Expected existing description to be kept, got %q", metadata.Description)
+	}
+	if len(metadata.Subjects) != 2 || metadata.Subjects[0].LocalizedName.String() != "Physics" {
+		t.Errorf("Expected subjects from lookup, got %v", metadata.Subjects)
+	}
+	if len(metadata.Publishers) != 1 || metadata.Publishers[0].LocalizedName.String() != "Plenum Press" {
+		t.Errorf("Expected publisher from lookup, got %v", metadata.Publishers)
+	}
+	if metadata.Published == nil || !metadata.Published.Equal(time.Date(1994, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected published date from lookup, got %v", metadata.Published)
+	}
+	series := metadata.BelongsTo["series"]
+	if len(series) != 1 || series[0].LocalizedName.String() != "Physics Texts" || series[0].Position == nil || *series[0].Position != 2 {
+		t.Errorf("Expected series from lookup, got %v", series)
+	}
+}
+
+func TestEnrichMetadata_GoogleBooksAndFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("q") {
+		case "isbn:9780306406157":
+			w.Write([]byte(`{"items": [{"volumeInfo": {"publisher": "Plenum", "publishedDate": "1994-05-01", "categories": ["Science"]}}]}`))
+		case "isbn:0306406152":
+			w.Write([]byte(`{"totalItems": 0}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv(enrichmentProviderEnvVar, providerGoogleBooks)
+	t.Setenv(enrichmentAPIURLEnvVar, server.URL)
+	provider, _ := metadataProviderFromEnv()
+
+	metadata := manifest.Metadata{AltIdentifiers: []manifest.AltIdentifier{{Value: "9780306406157"}}}
+	if warnings := enrichMetadata(&metadata, nil, provider); len(warnings) != 0 {
+		t.Fatalf("Expected no warnings, got %v", warnings)
+	}
+	if len(metadata.Subjects) != 1 || metadata.Publishers[0].LocalizedName.String() != "Plenum" {
+		t.Errorf("Expected subjects and publisher from lookup, got %v, %v", metadata.Subjects, metadata.Publishers)
+	}
+
+	if warnings := enrichMetadata(&manifest.Metadata{Identifier: "0306406152"}, nil, provider); len(warnings) != 1 {
+		t.Errorf("Expected a warning for an unknown ISBN, got %v", warnings)
+	}
+	if warnings := enrichMetadata(&manifest.Metadata{Identifier: "9781234567897"}, nil, provider); len(warnings) != 1 {
+		t.Errorf("Expected a warning for a failed lookup, got %v", warnings)
+	}
+	if warnings := enrichMetadata(&manifest.Metadata{Identifier: "urn:uuid:1"}, nil, provider); len(warnings) != 1 {
+		t.Errorf("Expected a warning without an ISBN, got %v", warnings)
+	}
+
+	t.Setenv(enrichmentProviderEnvVar, "worldcat")
+	if _, err := metadataProviderFromEnv(); err == nil {
+		t.Errorf("Expected error for unknown provider")
+	}
+}
@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// syncLimitEnvVar is the predicted processing time, in seconds, above which
+	// an estimate recommends the asynchronous path
+	syncLimitEnvVar = "ESTIMATE_SYNC_LIMIT_SECONDS"
+	// defaultSyncLimit stays under the 29 seconds API Gateway waits for a
+	// synchronous response
+	defaultSyncLimit = 25 * time.Second
+
+	// The cost model of an estimate, from the time jobs take in Lambda: a fixed
+	// part for parsing the EPUB and storing the manifest and its sidecars, a
+	// part per stored file for the Storage round trip, shared by the concurrent
+	// uploads, and a part per byte for the transfer
+	estimateBaseDuration   = 2 * time.Second
+	estimateFileDuration   = 80 * time.Millisecond
+	estimateBytesPerSecond = 20 << 20
+)
+
+// Estimate predicts the cost of processing an archive from its central
+// directory alone, nothing being extracted, so callers can route big books to
+// the asynchronous path before starting a job
+type Estimate struct {
+	Entries           int    `json:"entries"`
+	ArchiveBytes      int64  `json:"archive_bytes"`
+	UncompressedBytes uint64 `json:"uncompressed_bytes"`
+	// UploadFiles and UploadBytes are what storing the resources takes at most:
+	// the files unchanged since the last run are skipped
+	UploadFiles int    `json:"upload_files"`
+	UploadBytes uint64 `json:"upload_bytes"`
+	// PeakMemoryBytes is the memory the job needs at its peak (see estimateMemory)
+	PeakMemoryBytes uint64  `json:"peak_memory_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// AsyncRecommended is set when the job is predicted to outlast a
+	// synchronous request, and Refused when the job would refuse the archive
+	// outright (see checkArchiveLimits and memoryBudget), for the reasons given
+	AsyncRecommended bool     `json:"async_recommended"`
+	Refused          bool     `json:"refused,omitempty"`
+	Reasons          []string `json:"reasons,omitempty"`
+}
+
+// EstimateStored estimates the EPUB stored as filename from its central
+// directory alone, read in ranges instead of downloading the EPUB. It fails
+// with ErrRangesUnsupported when the fetcher can't read ranges: the EPUB must
+// then be fetched and Processed with options.Estimate.
+func (p *Processor) EstimateStored(filename string, maxBytes int64, options Options) (*Estimate, error) {
+	directories, ok := p.fetcher.(DirectoryFetcher)
+	if !ok {
+		return nil, ErrRangesUnsupported
+	}
+	zipReader, size, err := directories.FetchDirectory(filename, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return p.estimate(zipReader, size, options)
+}
+
+// estimate predicts the cost of processing zipReader, an archive of
+// archiveBytes, with options
+func (p *Processor) estimate(zipReader *zip.Reader, archiveBytes int64, options Options) (*Estimate, error) {
+	filter, err := newResourceFilter(options.Include, options.Exclude)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	maxResourceBytes := maxResourceBytesFromEnv()
+
+	e := &Estimate{Entries: len(zipReader.File), ArchiveBytes: archiveBytes}
+	for _, f := range zipReader.File {
+		e.UncompressedBytes += f.UncompressedSize64
+		// The container files are read, not stored
+		if strings.HasSuffix(f.Name, "/") || f.Name == "mimetype" || strings.HasPrefix(f.Name, "META-INF/") {
+			continue
+		}
+		if !filter.allows(f.Name) || maxResourceBytes > 0 && f.UncompressedSize64 > maxResourceBytes {
+			continue
+		}
+		e.UploadFiles++
+		e.UploadBytes += f.UncompressedSize64
+	}
+	e.PeakMemoryBytes, _ = estimateMemory(zipReader, maxResourceBytes)
+
+	// An archive the job would refuse is estimated all the same, saying why
+	if err := checkArchiveLimits(zipReader, archiveLimitsFromEnv()); err != nil {
+		e.Refused = true
+		e.Reasons = append(e.Reasons, err.Error())
+	}
+	if _, err := memoryBudgetFromEnv().check(zipReader, maxResourceBytes); err != nil {
+		e.Refused = true
+		e.Reasons = append(e.Reasons, err.Error())
+	}
+
+	concurrency := 1
+	if concurrent, ok := p.uploader.(ConcurrentUploader); ok {
+		concurrency = max(concurrent.UploadConcurrency(), 1)
+	}
+	duration := estimateBaseDuration +
+		time.Duration(math.Ceil(float64(e.UploadFiles)/float64(concurrency)))*estimateFileDuration +
+		time.Duration(float64(e.UploadBytes)/estimateBytesPerSecond*float64(time.Second))
+	e.DurationSeconds = math.Round(duration.Seconds()*10) / 10
+
+	syncLimit := defaultSyncLimit
+	if seconds, ok := envUint(syncLimitEnvVar); ok {
+		syncLimit = time.Duration(seconds) * time.Second
+	}
+	if duration > syncLimit {
+		e.AsyncRecommended = true
+		e.Reasons = append(e.Reasons, fmt.Sprintf("predicted to take %.1fs, more than the %s a synchronous request waits", e.DurationSeconds, syncLimit))
+	}
+	if !p.deadline.IsZero() && duration > time.Until(p.deadline) {
+		e.AsyncRecommended = true
+		e.Reasons = append(e.Reasons, "predicted to run past the deadline of this invocation")
+	}
+	log.Printf("Estimated %d files, %d bytes to upload in %.1fs (async recommended: %t, refused: %t)", e.UploadFiles, e.UploadBytes, e.DurationSeconds, e.AsyncRecommended, e.Refused)
+	return e, nil
+}
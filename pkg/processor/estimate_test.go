@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestEstimate(t *testing.T) {
+	t.Setenv(maxResourceBytesEnvVar, "")
+	t.Setenv(syncLimitEnvVar, "")
+	zipReader := buildZip(t, map[string][]byte{
+		"mimetype":                []byte("application/epub+zip"),
+		"META-INF/container.xml":  []byte(validContainer),
+		"OEBPS/content.opf":       []byte("<package/>"),
+		"OEBPS/ch1.xhtml":         []byte(strings.Repeat("a", 1000)),
+		"OEBPS/images/cover.jpg":  make([]byte, 5000),
+		"OEBPS/video/trailer.mp4": make([]byte, 20000),
+	})
+	p := New(nil, nil)
+
+	estimate, err := p.estimate(zipReader, 4096, Options{Exclude: []string{"OEBPS/video/**"}})
+	if err != nil {
+		t.Fatalf("estimate failed: %v", err)
+	}
+	if estimate.Entries != 6 || estimate.ArchiveBytes != 4096 {
+		t.Errorf("Expected 6 entries of a 4096-byte archive, got %+v", estimate)
+	}
+	if estimate.UploadFiles != 3 || estimate.UploadBytes != uint64(len("<package/>")+1000+5000) {
+		t.Errorf("Expected the container and excluded files not to be uploaded, got %d files, %d bytes", estimate.UploadFiles, estimate.UploadBytes)
+	}
+	if estimate.PeakMemoryBytes != runtimeMemoryBytes+resourceCopies*20000 {
+		t.Errorf("Expected the peak memory of the largest entry, got %d", estimate.PeakMemoryBytes)
+	}
+	if estimate.DurationSeconds < estimateBaseDuration.Seconds() || estimate.AsyncRecommended {
+		t.Errorf("Expected a short job not to need the async path, got %+v", estimate)
+	}
+
+	t.Setenv(syncLimitEnvVar, "1")
+	if estimate, _ = p.estimate(zipReader, 4096, Options{}); !estimate.AsyncRecommended || len(estimate.Reasons) != 1 {
+		t.Errorf("Expected the async path past the sync limit, got %+v", estimate)
+	}
+}
+
+func TestEstimate_ReportsRefusedArchives(t *testing.T) {
+	t.Setenv(syncLimitEnvVar, "")
+	t.Setenv(maxEntriesEnvVar, "2")
+	zipReader := buildZip(t, map[string][]byte{
+		"mimetype":        []byte("application/epub+zip"),
+		"OEBPS/ch1.xhtml": []byte("<html/>"),
+		"OEBPS/ch2.xhtml": []byte("<html/>"),
+	})
+
+	estimate, err := New(nil, nil).estimate(zipReader, 1024, Options{})
+	if err != nil {
+		t.Fatalf("Expected an estimate of an archive past the limits, got %v", err)
+	}
+	if !estimate.Refused || estimate.AsyncRecommended || len(estimate.Reasons) != 1 || !strings.Contains(estimate.Reasons[0], "entries") {
+		t.Errorf("Expected the archive refused for its entries, got %+v", estimate)
+	}
+}
+
+func TestEstimateStored_ReadsCentralDirectoryOnly(t *testing.T) {
+	t.Setenv(syncLimitEnvVar, "")
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	f.Write([]byte("application/epub+zip"))
+	audio := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(audio)
+	f, _ = w.CreateHeader(&zip.FileHeader{Name: "audio/track.mp3", Method: zip.Store})
+	f.Write(audio)
+	w.Close()
+	supabase.Put(EPUBBucket, "books/audiobook.epub", buf.Bytes())
+
+	if _, err := New(NewSupabase(supabase.URL, processortest.ServiceKey), nil).EstimateStored("books/audiobook.epub", 0, Options{}); !errors.Is(err, ErrRangesUnsupported) {
+		t.Errorf("Expected ErrRangesUnsupported without S3, got %v", err)
+	}
+
+	store := testS3Store(supabase)
+	estimate, err := New(store, store).EstimateStored("books/audiobook.epub", 0, Options{})
+	if err != nil {
+		t.Fatalf("EstimateStored failed: %v", err)
+	}
+	if estimate.Entries != 2 || estimate.ArchiveBytes != int64(buf.Len()) || estimate.UploadBytes != uint64(len(audio)) {
+		t.Errorf("Expected the 2 entries of a %d-byte archive, got %+v", buf.Len(), estimate)
+	}
+	if served := supabase.Served(EPUBBucket, "books/audiobook.epub"); served > s3WindowSize*2 {
+		t.Errorf("Expected only the central directory read, got %d of %d bytes", served, buf.Len())
+	}
+}
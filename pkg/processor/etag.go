@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ManifestETag returns the ETag of a manifest: the SHA-256 of its canonical
+// JSON, so a manifest stored with other whitespace or key order keeps its tag.
+// Manifests that aren't valid JSON are hashed as is.
+func ManifestETag(manifestJSON []byte) string {
+	data := manifestJSON
+	decoder := json.NewDecoder(bytes.NewReader(manifestJSON))
+	decoder.UseNumber()
+	var manifest interface{}
+	if err := decoder.Decode(&manifest); err == nil {
+		if canonical, err := canonicalJSON(manifest); err == nil {
+			data = canonical
+		}
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// ETagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as HTTP requires (W/"x" matches "x"), or is "*"
+func ETagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// StoredManifest returns the manifest of the publication at basePath and its
+// ETag (see ManifestETag), or a 404 if none is stored
+func StoredManifest(store Uploader, basePath string) ([]byte, string, error) {
+	data, err := store.Download(fmt.Sprintf("%s/manifest.json", basePath))
+	if err != nil {
+		return nil, "", &statusError{status: 404, err: fmt.Errorf("no publication at %s: %w", basePath, err)}
+	}
+	return data, ManifestETag(data), nil
+}
@@ -0,0 +1,51 @@
+package processor
+
+import (
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestManifestETag(t *testing.T) {
+	etag := ManifestETag([]byte(`{"metadata": {"title": "Moby-Dick"}, "links": []}`))
+	if same := ManifestETag([]byte("{\n  \"links\": [],\n  \"metadata\": {\"title\":\"Moby-Dick\"}\n}")); same != etag {
+		t.Errorf("Expected the ETag independent of formatting, got %s and %s", etag, same)
+	}
+	if other := ManifestETag([]byte(`{"metadata": {"title": "Moby Dick"}, "links": []}`)); other == etag {
+		t.Error("Expected another ETag for another manifest")
+	}
+	if len(etag) != 66 || etag[0] != '"' || etag[65] != '"' {
+		t.Errorf("Expected a quoted SHA-256, got %s", etag)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for header, want := range map[string]bool{
+		`"abc"`:        true,
+		`W/"abc"`:      true,
+		`"xyz", "abc"`: true,
+		`*`:            true,
+		`"xyz"`:        false,
+		``:             false,
+		`abc`:          false,
+	} {
+		if got := ETagMatches(header, `"abc"`); got != want {
+			t.Errorf("%q: expected %v, got %v", header, want, got)
+		}
+	}
+}
+
+func TestStoredManifest(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	supabase.Put(ManifestBucket, "books_moby/manifest.json", []byte(`{"metadata": {"title": "Moby-Dick"}}`))
+
+	data, etag, err := StoredManifest(store, "books_moby")
+	if err != nil || etag != ManifestETag(data) {
+		t.Errorf("Expected the manifest and its ETag, got %s, %s, %v", data, etag, err)
+	}
+	if _, _, err := StoredManifest(store, "books_gone"); StatusCode(err) != 404 {
+		t.Errorf("Expected a 404 for a missing manifest, got %v", err)
+	}
+}
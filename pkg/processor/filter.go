@@ -0,0 +1,123 @@
+package processor
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// resourceFilter decides which publication resources are extracted and uploaded,
+// based on the include and exclude glob patterns of a request. Patterns are matched
+// against the resource path inside the EPUB (e.g. "OEBPS/Fonts/serif.ttf"); "*"
+// matches within a path segment and "**" matches any number of segments.
+type resourceFilter struct {
+	include  []string
+	exclude  []string
+	excluded map[string]bool
+}
+
+// newResourceFilter returns a filter for the given patterns, or nil when there are
+// none. A nil filter allows every resource.
+func newResourceFilter(include, exclude []string) (*resourceFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if err := checkGlobPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return &resourceFilter{include: include, exclude: exclude, excluded: map[string]bool{}}, nil
+}
+
+// allows reports whether a resource should be uploaded. Exclusions win over
+// inclusions, and when include patterns are given a resource must match one of them.
+// Resources that are filtered out are remembered for the response.
+func (f *resourceFilter) allows(href string) bool {
+	if f == nil {
+		return true
+	}
+	key := resourceKey(href)
+	allowed := len(f.include) == 0 || matchAnyGlob(f.include, key)
+	if allowed && matchAnyGlob(f.exclude, key) {
+		allowed = false
+	}
+	if !allowed {
+		f.excluded[key] = true
+	}
+	return allowed
+}
+
+// excludedResources returns the sorted resource paths that were filtered out
+func (f *resourceFilter) excludedResources() []string {
+	if f == nil {
+		return nil
+	}
+	excluded := make([]string, 0, len(f.excluded))
+	for key := range f.excluded {
+		excluded = append(excluded, key)
+	}
+	sort.Strings(excluded)
+	return excluded
+}
+
+// checkGlobPattern reports a malformed pattern up front, since path.Match only
+// returns ErrBadPattern when it gets far enough into the pattern to notice
+func checkGlobPattern(pattern string) error {
+	if strings.TrimSpace(pattern) == "" {
+		return fmt.Errorf("empty resource filter pattern")
+	}
+	for _, segment := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid resource filter pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchAnyGlob reports whether name matches one of the patterns
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash-separated name against a pattern in which "**" stands
+// for zero or more whole path segments
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range name {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,72 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"**/*.ttf", "OEBPS/Fonts/serif.ttf", true},
+		{"**/*.ttf", "serif.ttf", true},
+		{"**/*.ttf", "OEBPS/Fonts/serif.otf", false},
+		{"audio/**", "audio/track01.mp3", true},
+		{"audio/**", "audio/disc1/track01.mp3", true},
+		{"audio/**", "OEBPS/audio/track01.mp3", false},
+		{"OEBPS/*.css", "OEBPS/style.css", true},
+		{"OEBPS/*.css", "OEBPS/Styles/style.css", false},
+		{"OEBPS/**/cover.*", "OEBPS/cover.jpg", true},
+		{"OEBPS/**/cover.*", "OEBPS/Images/cover.jpg", true},
+		{"/OEBPS/*.css", "OEBPS/style.css", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResourceFilter(t *testing.T) {
+	filter, err := newResourceFilter([]string{"OEBPS/**"}, []string{"**/*.ttf", "OEBPS/Audio/**"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	allowed := map[string]bool{
+		"/OEBPS/Text/chapter1.xhtml":  true,
+		"OEBPS/Fonts/serif.ttf":       false,
+		"OEBPS/Audio/track%2001.mp3":  false,
+		"META-INF/com.apple.ibooks.x": false,
+	}
+	for href, want := range allowed {
+		if got := filter.allows(href); got != want {
+			t.Errorf("allows(%q) = %t, want %t", href, got, want)
+		}
+	}
+
+	want := []string{"META-INF/com.apple.ibooks.x", "OEBPS/Audio/track 01.mp3", "OEBPS/Fonts/serif.ttf"}
+	if got := filter.excludedResources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected excluded %v, got %v", want, got)
+	}
+}
+
+func TestNewResourceFilter(t *testing.T) {
+	filter, err := newResourceFilter(nil, nil)
+	if err != nil || filter != nil {
+		t.Errorf("Expected nil filter without patterns, got %v, %v", filter, err)
+	}
+	if !filter.allows("OEBPS/anything.xhtml") {
+		t.Errorf("Expected nil filter to allow every resource")
+	}
+
+	if _, err := newResourceFilter(nil, []string{"OEBPS/[a-"}); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+	if _, err := newResourceFilter([]string{" "}, nil); err == nil {
+		t.Errorf("Expected error for empty pattern")
+	}
+}
@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Format is the kind of file a source was identified as
+type Format struct {
+	// Name describes the format in error messages ("EPUB", "PDF")
+	Name      string
+	MediaType string
+	// Supported is set for the formats the pipeline processes
+	Supported bool
+}
+
+// The formats told apart by sniffing
+var (
+	formatEPUB   = Format{Name: "EPUB", MediaType: "application/epub+zip", Supported: true}
+	formatLPF    = Format{Name: "LPF audiobook", MediaType: "application/lpf+zip", Supported: true}
+	formatWebPub = Format{Name: "packaged Web Publication", MediaType: "application/webpub+zip", Supported: true}
+	formatCBZ    = Format{Name: "comic book archive", MediaType: "application/vnd.comicbook+zip"}
+	formatZIP    = Format{Name: "ZIP archive", MediaType: "application/zip"}
+	formatEmpty  = Format{Name: "empty file", MediaType: "application/octet-stream"}
+)
+
+// formatsByExtension names the other ebook formats people upload by mistake,
+// which content sniffing alone can't tell apart from arbitrary binary data
+var formatsByExtension = map[string]Format{
+	".pdf":  {Name: "PDF", MediaType: "application/pdf"},
+	".mobi": {Name: "Mobipocket", MediaType: "application/x-mobipocket-ebook"},
+	".azw":  {Name: "Kindle", MediaType: "application/vnd.amazon.ebook"},
+	".azw3": {Name: "Kindle", MediaType: "application/vnd.amazon.mobi8-ebook"},
+	".fb2":  {Name: "FictionBook", MediaType: "application/x-fictionbook+xml"},
+	".djvu": {Name: "DjVu", MediaType: "image/vnd.djvu"},
+	".cbr":  {Name: "comic book archive", MediaType: "application/vnd.comicbook-rar"},
+}
+
+// inconclusiveMediaTypes are sniffed from content that could be many formats
+var inconclusiveMediaTypes = map[string]bool{
+	"application/octet-stream": true,
+	"text/plain":               true,
+	"text/xml":                 true,
+}
+
+// formatsByMediaType names the sniffed media types worth a readable name
+var formatsByMediaType = map[string]string{
+	"application/pdf":              "PDF",
+	"text/html":                    "HTML",
+	"text/plain":                   "plain text",
+	"text/xml":                     "XML",
+	"application/x-rar-compressed": "RAR archive",
+	"application/x-gzip":           "gzip archive",
+	"application/octet-stream":     "binary file",
+}
+
+// unsupported returns the error reported for a source in an unsupported format
+func (f Format) unsupported() error {
+	return &statusError{status: 415, err: fmt.Errorf("unsupported format: %s (%s)", f.Name, f.MediaType)}
+}
+
+// Sniff identifies the format of the source from its content, falling back to
+// the extension of filename when the content is not conclusive. ZIP archives
+// are told apart by their entries (see archiveFormat).
+func (s *Source) Sniff(filename string) Format {
+	if s.size == 0 {
+		return formatEmpty
+	}
+	header := make([]byte, 512)
+	n, _ := s.file.ReadAt(header, 0)
+	header = header[:n]
+
+	if bytes.HasPrefix(header, []byte("PK")) {
+		zipReader, err := zip.NewReader(s.file, s.size)
+		if err != nil {
+			// Processing reports what is wrong with a damaged archive in
+			// more detail than "unsupported format" would
+			return formatEPUB
+		}
+		return archiveFormat(zipReader)
+	}
+
+	// The content wins, unless it only tells binary data or text
+	mediaType, _, _ := strings.Cut(http.DetectContentType(header), ";")
+	ext := strings.ToLower(path.Ext(filename))
+	if format, ok := formatsByExtension[ext]; ok && (inconclusiveMediaTypes[mediaType] || mediaType == format.MediaType) {
+		return format
+	}
+	if mediaType == "application/octet-stream" {
+		if byExtension, _, _ := strings.Cut(mime.TypeByExtension(ext), ";"); byExtension != "" {
+			mediaType = byExtension
+		}
+	}
+	name, ok := formatsByMediaType[mediaType]
+	if !ok {
+		name = mediaType
+		if kind, _, _ := strings.Cut(mediaType, "/"); kind == "image" || kind == "audio" || kind == "video" {
+			name = kind
+		}
+	}
+	return Format{Name: name, MediaType: mediaType}
+}
+
+// CheckFormat sniffs the source and returns a 415 error for anything but a
+// supported format
+func (s *Source) CheckFormat(filename string) (Format, error) {
+	format := s.Sniff(filename)
+	if !format.Supported {
+		return format, format.unsupported()
+	}
+	return format, nil
+}
+
+// archiveFormat identifies a ZIP-based format by the entries of the archive.
+// EPUBs are recognized without a mimetype entry or container, as lenient mode
+// can repair those.
+func archiveFormat(zipReader *zip.Reader) Format {
+	entries := zipEntries(zipReader)
+	if f, ok := entries["mimetype"]; ok {
+		if data, err := readZipEntry(f); err == nil {
+			switch strings.TrimSpace(string(data)) {
+			case formatEPUB.MediaType:
+				return formatEPUB
+			case formatCBZ.MediaType:
+				return formatCBZ
+			}
+		}
+	}
+	if _, ok := entries[containerPath]; ok {
+		return formatEPUB
+	}
+	if isLPFArchive(zipReader) {
+		return formatLPF
+	}
+	if _, ok := entries["manifest.json"]; ok {
+		return formatWebPub
+	}
+
+	images := 0
+	for name, f := range entries {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if strings.EqualFold(path.Ext(name), ".opf") {
+			return formatEPUB
+		}
+		if strings.HasPrefix(getContentType(name), "image/") {
+			images++
+		}
+	}
+	if images > 0 && images == countFiles(zipReader) {
+		return formatCBZ
+	}
+	return formatZIP
+}
+
+// countFiles returns the number of entries of an archive that are not directories
+func countFiles(zipReader *zip.Reader) int {
+	n := 0
+	for _, f := range zipReader.File {
+		if !f.FileInfo().IsDir() {
+			n++
+		}
+	}
+	return n
+}
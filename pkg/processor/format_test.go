@@ -0,0 +1,59 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSourceSniff(t *testing.T) {
+	archives := []struct {
+		name    string
+		entries map[string]string
+		format  Format
+	}{
+		{"EPUB", map[string]string{"mimetype": "application/epub+zip", "META-INF/container.xml": "<container/>"}, formatEPUB},
+		{"EPUB without mimetype", map[string]string{"OEBPS/content.opf": "<package/>"}, formatEPUB},
+		{"LPF", map[string]string{lpfManifestPath: "{}", "audio.mp3": "mp3"}, formatLPF},
+		{"Web Publication", map[string]string{"manifest.json": "{}", "chapter1.html": "<html/>"}, formatWebPub},
+		{"comic book", map[string]string{"001.jpg": "jpg", "002.png": "png"}, formatCBZ},
+		{"ZIP", map[string]string{"notes.txt": "notes"}, formatZIP},
+	}
+	for _, tt := range archives {
+		source := spoolTestArchive(t, tt.entries)
+		if got := source.Sniff("upload.epub"); got != tt.format {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.format, got)
+		}
+	}
+
+	files := []struct {
+		filename, content, name string
+	}{
+		{"book.pdf", "%PDF-1.7\n", "PDF"},
+		{"book.epub", "%PDF-1.7\n", "PDF"},
+		{"book.mobi", "\x00\x00\x00\x00BOOKMOBI", "Mobipocket"},
+		{"book.epub", "<!DOCTYPE html><html></html>", "HTML"},
+		{"book.epub", "", "empty file"},
+	}
+	for _, tt := range files {
+		source, err := SpoolEPUB(strings.NewReader(tt.content), 0)
+		if err != nil {
+			t.Fatalf("SpoolEPUB failed: %v", err)
+		}
+		defer source.Close()
+		_, err = source.CheckFormat(tt.filename)
+		if got := source.Sniff(tt.filename); got.Name != tt.name || got.Supported {
+			t.Errorf("%s %q: expected unsupported %s, got %+v", tt.filename, tt.content, tt.name, got)
+		}
+		if StatusCode(err) != 415 || !strings.Contains(err.Error(), "unsupported format: "+tt.name) {
+			t.Errorf("%s %q: expected a 415 naming the format, got %v", tt.filename, tt.content, err)
+		}
+	}
+}
+
+func TestProcess_UnsupportedArchive(t *testing.T) {
+	source := spoolTestArchive(t, map[string]string{"001.jpg": "jpg"})
+	_, err := New(nil, nil).Process(source, "comic.cbz", Options{})
+	if StatusCode(err) != 415 || !strings.Contains(err.Error(), "comic book archive") {
+		t.Errorf("Expected a 415 for a comic book archive, got %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/pub"
+)
+
+const (
+	// guidedNavigationPath is where the guided navigation document is stored,
+	// relative to basePath
+	guidedNavigationPath = "guided-navigation.json"
+	guidedNavigationType = "application/guided-navigation+json"
+	// guidedCollectionRole is the collection of panels of a Divina manifest
+	guidedCollectionRole = "guided"
+)
+
+// guidedNavigationLink returns the manifest link to the guided navigation document
+func guidedNavigationLink() map[string]interface{} {
+	return map[string]interface{}{
+		"href": guidedNavigationPath,
+		"type": guidedNavigationType,
+		"rel":  "x-guided-navigation",
+	}
+}
+
+// isImagePublication reports whether a publication is made of images, such as
+// a comic: a Divina, or a reading order of images only
+func isImagePublication(m *manifest.Manifest) bool {
+	for _, profile := range m.Metadata.ConformsTo {
+		if profile == manifest.ProfileDivina {
+			return true
+		}
+	}
+	if len(m.ReadingOrder) == 0 {
+		return false
+	}
+	for i := range m.ReadingOrder {
+		if !strings.HasPrefix(resourceMediaType(&m.ReadingOrder[i]), "image/") {
+			return false
+		}
+	}
+	return true
+}
+
+// guidedHref returns the href of a guided navigation object for an href of the
+// document at docPath, keeping its fragment (the xywh of a panel), or ""
+func guidedHref(href, docPath string) string {
+	target := resolveArchiveHref(href, docPath)
+	if target == "" {
+		return ""
+	}
+	fragment := ""
+	if idx := strings.Index(href, "#"); idx >= 0 {
+		fragment = href[idx:]
+	}
+	return manifestHref(target) + fragment
+}
+
+// guidedObject returns the guided navigation object of a link to a page or a
+// panel: images are referenced as images, anything else as text
+func guidedObject(href, mediaType, title string) manifest.GuidedNavigationObject {
+	object := manifest.GuidedNavigationObject{Text: title}
+	if strings.HasPrefix(mediaType, "image/") {
+		object.ImgRef = href
+	} else {
+		object.TextRef = href
+	}
+	return object
+}
+
+// regionBasedNavigation returns the panels of the region-based navigation of an
+// EPUB navigation document at docPath (<nav epub:type="region-based">), nested
+// as in the document, with the epub:type of their list item as role
+func regionBasedNavigation(docPath string, content []byte) []manifest.GuidedNavigationObject {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	// Each open list item has its object, appended to its parent once closed
+	type item struct {
+		object manifest.GuidedNavigationObject
+		text   strings.Builder
+	}
+	var root []manifest.GuidedNavigationObject
+	var stack []*item
+	inNav, navDepth, inAnchor := false, 0, false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			attrs := accessibilityAttributes(t.Attr)
+			if !inNav {
+				if name == "nav" && strings.Contains(" "+attrs["type"]+" ", " region-based ") {
+					inNav, navDepth = true, 1
+				}
+				continue
+			}
+			navDepth++
+			switch name {
+			case "li":
+				it := &item{}
+				if role := strings.Fields(attrs["type"]); len(role) > 0 {
+					it.object.Role = role
+				}
+				stack = append(stack, it)
+			case "a":
+				if len(stack) > 0 {
+					current := &stack[len(stack)-1].object
+					role := current.Role
+					*current = guidedObject(guidedHref(attrs["href"], docPath), getContentType(resolveArchiveHref(attrs["href"], docPath)), "")
+					current.Role = role
+					inAnchor = true
+				}
+			}
+		case xml.EndElement:
+			if !inNav {
+				continue
+			}
+			navDepth--
+			switch strings.ToLower(t.Name.Local) {
+			case "a":
+				inAnchor = false
+			case "li":
+				if len(stack) == 0 {
+					continue
+				}
+				it := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				it.object.Text = strings.Join(strings.Fields(it.text.String()), " ")
+				if it.object.ImgRef == "" && it.object.TextRef == "" && len(it.object.Children) == 0 {
+					continue
+				}
+				if len(stack) > 0 {
+					parent := &stack[len(stack)-1].object
+					parent.Children = append(parent.Children, it.object)
+				} else {
+					root = append(root, it.object)
+				}
+			}
+			if navDepth == 0 {
+				return root
+			}
+		case xml.CharData:
+			if inAnchor && len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	return root
+}
+
+// divinaGuidedNavigation returns the panels of the "guided" collection of a
+// Divina manifest
+func divinaGuidedNavigation(m *manifest.Manifest) []manifest.GuidedNavigationObject {
+	var convert func(links manifest.LinkList) []manifest.GuidedNavigationObject
+	convert = func(links manifest.LinkList) []manifest.GuidedNavigationObject {
+		var objects []manifest.GuidedNavigationObject
+		for i := range links {
+			href := links[i].Href.String()
+			// Panels carry an xywh fragment, so their type isn't told by extension
+			mediaType := getContentType(resolveArchiveHref(href, ""))
+			if links[i].MediaType != nil {
+				mediaType = links[i].MediaType.String()
+			}
+			object := guidedObject(guidedHref(href, ""), mediaType, links[i].Title)
+			object.Children = convert(links[i].Children)
+			objects = append(objects, object)
+		}
+		return objects
+	}
+	var objects []manifest.GuidedNavigationObject
+	for _, collection := range m.Subcollections[guidedCollectionRole] {
+		objects = append(objects, convert(collection.Links)...)
+	}
+	return objects
+}
+
+// pageGuidedNavigation returns one guided navigation object per page of the
+// reading order, for image publications without panels
+func pageGuidedNavigation(m *manifest.Manifest) []manifest.GuidedNavigationObject {
+	objects := make([]manifest.GuidedNavigationObject, 0, len(m.ReadingOrder))
+	for i := range m.ReadingOrder {
+		link := &m.ReadingOrder[i]
+		objects = append(objects, guidedObject(manifestHref(link.Href.String()), resourceMediaType(link), link.Title))
+	}
+	return objects
+}
+
+// epubGuidedNavigation returns the panels of the region-based navigation of an
+// EPUB, read from its navigation document, or its pages when it has none and
+// is made of images. Returns nil for other publications.
+func epubGuidedNavigation(publication *pub.Publication, m *manifest.Manifest) []manifest.GuidedNavigationObject {
+	ctx := context.Background()
+	for _, list := range []manifest.LinkList{m.Resources, m.ReadingOrder} {
+		for _, link := range list {
+			if !hasRel(link, "contents") || !isHTMLResource(&link) {
+				continue
+			}
+			resource := publication.Get(ctx, link)
+			content, resErr := resource.Read(ctx, 0, 0)
+			resource.Close()
+			if resErr != nil {
+				log.Printf("Warning: failed to read %s for its region-based navigation: %v", link.Href.String(), resErr)
+				continue
+			}
+			if objects := regionBasedNavigation(resourceKey(link.Href.String()), content); len(objects) > 0 {
+				return objects
+			}
+		}
+	}
+	if isImagePublication(m) {
+		return pageGuidedNavigation(m)
+	}
+	return nil
+}
+
+// packageGuidedNavigation returns the panels of a packaged image publication,
+// or its pages when its manifest has none. Returns nil for other publications,
+// and for packages that come with their own guided navigation document.
+func packageGuidedNavigation(m *manifest.Manifest) []manifest.GuidedNavigationObject {
+	if !isImagePublication(m) {
+		return nil
+	}
+	for _, list := range []manifest.LinkList{m.Links, m.Resources} {
+		for i := range list {
+			if resourceMediaType(&list[i]) == guidedNavigationType {
+				return nil
+			}
+		}
+	}
+	if objects := divinaGuidedNavigation(m); len(objects) > 0 {
+		return objects
+	}
+	return pageGuidedNavigation(m)
+}
+
+// generateGuidedNavigationJSON returns the guided navigation document of the
+// objects, or nil when there are none. Its hrefs are relative to basePath,
+// like those of the manifest.
+func generateGuidedNavigationJSON(objects []manifest.GuidedNavigationObject) ([]byte, error) {
+	if len(objects) == 0 {
+		return nil, nil
+	}
+	data, err := canonicalJSON(manifest.GuidedNavigationDocument{Guided: objects})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode guided navigation: %w", err)
+	}
+	return data, nil
+}
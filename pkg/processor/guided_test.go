@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+const testRegionNav = `<html xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc"><ol><li><a href="page1.xhtml">Page 1</a></li></ol></nav>
+<nav epub:type="region-based">
+  <ol>
+    <li epub:type="panel-group"><a href="page1.xhtml#xywh=percent:0,0,100,50">Top</a>
+      <ol>
+        <li epub:type="panel"><a href="page1.xhtml#xywh=percent:0,0,50,50">Panel 1</a></li>
+        <li epub:type="panel"><a href="page1.xhtml#xywh=percent:50,0,50,50">Panel 2</a></li>
+      </ol>
+    </li>
+    <li epub:type="panel"><a href="../images/page2.jpg#xywh=0,0,300,200">Panel 3</a></li>
+  </ol>
+</nav>
+</body></html>`
+
+func TestRegionBasedNavigation(t *testing.T) {
+	objects := regionBasedNavigation("OEBPS/text/nav.xhtml", []byte(testRegionNav))
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 top-level regions, got %+v", objects)
+	}
+	group := objects[0]
+	if group.TextRef != "OEBPS/text/page1.xhtml#xywh=percent:0,0,100,50" || group.Text != "Top" || len(group.Role) != 1 || group.Role[0] != "panel-group" {
+		t.Errorf("Expected the panel group, got %+v", group)
+	}
+	if len(group.Children) != 2 || group.Children[1].TextRef != "OEBPS/text/page1.xhtml#xywh=percent:50,0,50,50" || group.Children[1].Text != "Panel 2" {
+		t.Errorf("Expected the panels of the group, got %+v", group.Children)
+	}
+	if objects[1].ImgRef != "OEBPS/images/page2.jpg#xywh=0,0,300,200" || objects[1].TextRef != "" {
+		t.Errorf("Expected an image panel, got %+v", objects[1])
+	}
+
+	if objects := regionBasedNavigation("nav.xhtml", []byte(`<nav epub:type="toc"><ol><li><a href="a.xhtml">A</a></li></ol></nav>`)); len(objects) != 0 {
+		t.Errorf("Expected no regions without a region-based nav, got %+v", objects)
+	}
+}
+
+func TestPackageGuidedNavigation(t *testing.T) {
+	page1 := testLink(t, "page1.jpg")
+	page2 := testLink(t, "page2.jpg")
+	m := &manifest.Manifest{ReadingOrder: manifest.LinkList{page1, page2}}
+	pages := packageGuidedNavigation(m)
+	if len(pages) != 2 || pages[0].ImgRef != "page1.jpg" || pages[1].ImgRef != "page2.jpg" {
+		t.Errorf("Expected one object per page, got %+v", pages)
+	}
+
+	panel := testLink(t, "page1.jpg#xywh=0,0,300,200")
+	panel.Title = "Panel 1"
+	m.Subcollections = manifest.PublicationCollectionMap{
+		guidedCollectionRole: {{Links: manifest.LinkList{panel}}},
+	}
+	panels := packageGuidedNavigation(m)
+	if len(panels) != 1 || panels[0].ImgRef != "page1.jpg#xywh=0,0,300,200" || panels[0].Text != "Panel 1" {
+		t.Errorf("Expected the panels of the guided collection, got %+v", panels)
+	}
+
+	m.Resources = manifest.LinkList{toolkitLink(map[string]interface{}{"href": "guided.json", "type": guidedNavigationType})}
+	if objects := packageGuidedNavigation(m); objects != nil {
+		t.Errorf("Expected nothing for a package with its own document, got %+v", objects)
+	}
+
+	text := &manifest.Manifest{ReadingOrder: manifest.LinkList{testLink(t, "chapter1.xhtml")}}
+	if objects := packageGuidedNavigation(text); objects != nil {
+		t.Errorf("Expected nothing for a text publication, got %+v", objects)
+	}
+}
+
+func TestProcess_RWPMGuidedNavigation(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	entries := map[string]string{
+		rwpmManifestPath: `{"metadata": {"title": "Comic"}, "readingOrder": [
+			{"href": "page1.jpg", "type": "image/jpeg"},
+			{"href": "page2.jpg", "type": "image/jpeg"}
+		]}`,
+		"page1.jpg": "page1",
+		"page2.jpg": "page2",
+	}
+	if _, err := p.Process(spoolTestArchive(t, entries), "comic.webpub", Options{}); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	data, ok := supabase.Object(ManifestBucket, "comic/"+guidedNavigationPath)
+	if !ok {
+		t.Fatalf("Expected the guided navigation to be uploaded, got %v", supabase.Paths(ManifestBucket))
+	}
+	var doc manifest.GuidedNavigationDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if len(doc.Guided) != 2 || doc.Guided[0].ImgRef != "page1.jpg" {
+		t.Errorf("Expected one object per page, got %+v", doc.Guided)
+	}
+
+	manifestJSON, _ := supabase.Object(ManifestBucket, "comic/manifest.json")
+	if !strings.Contains(string(manifestJSON), `"type": "`+guidedNavigationType+`"`) {
+		t.Errorf("Expected a link to the guided navigation, got %s", manifestJSON)
+	}
+}
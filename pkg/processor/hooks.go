@@ -0,0 +1,221 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// Hook integrates a processed publication with another system (a database,
+// an OPDS feed, a webhook, a search index...) once it is stored. stats is nil
+// for publications without text, such as audiobooks.
+type Hook interface {
+	OnPublicationProcessed(m *manifest.Manifest, stats *ReadingStats) error
+}
+
+// HookFunc adapts a plain function to Hook
+type HookFunc func(m *manifest.Manifest, stats *ReadingStats) error
+
+// OnPublicationProcessed calls f(m, stats)
+func (f HookFunc) OnPublicationProcessed(m *manifest.Manifest, stats *ReadingStats) error {
+	return f(m, stats)
+}
+
+// hookEnv is what a hook factory gets to know about the publication
+type hookEnv struct {
+	basePath    string
+	manifestURL string
+	uploader    Uploader
+	// chapters is the text of the publication, nil for publications without
+	chapters []chapterText
+}
+
+// registeredHook is a named hook that can be turned on or off per deployment
+// (HOOK_<NAME> env var) or per request ("hooks" option)
+type registeredHook struct {
+	name    string
+	enabled bool
+	// readsText marks the hooks that send the text of the publication to
+	// another system, which protected publications can't be combined with
+	readsText bool
+	newHook   func(env hookEnv) Hook
+}
+
+// hookRegistry lists the available hooks in the order they run
+var hookRegistry []registeredHook
+
+// registerHook adds a hook, run after the ones registered before it
+func registerHook(name string, enabledByDefault, readsText bool, newHook func(env hookEnv) Hook) {
+	hookRegistry = append(hookRegistry, registeredHook{name: name, enabled: enabledByDefault, readsText: readsText, newHook: newHook})
+}
+
+func init() {
+	registerHook("embeddings", false, true, func(env hookEnv) Hook {
+		return HookFunc(func(m *manifest.Manifest, stats *ReadingStats) error {
+			store, _ := env.uploader.(ChunkStore)
+			stored, err := storeEmbeddings(embeddingsClientFromEnv(), store, env.chapters, env.basePath)
+			if err != nil {
+				return err
+			}
+			log.Printf("Stored %d embedded chunks", stored)
+			return nil
+		})
+	})
+	registerHook("search_index", false, true, func(env hookEnv) Hook {
+		return HookFunc(func(m *manifest.Manifest, stats *ReadingStats) error {
+			indexer, err := searchIndexerFromEnv()
+			if err != nil {
+				return err
+			}
+			indexed, err := indexChapters(indexer, m, env.chapters, env.basePath, env.manifestURL)
+			if err != nil {
+				return err
+			}
+			log.Printf("Indexed %d chapters", indexed)
+			return nil
+		})
+	})
+	registerHook("webhook", false, false, func(env hookEnv) Hook {
+		return HookFunc(func(m *manifest.Manifest, stats *ReadingStats) error {
+			return postWebhook(webhookURLFromEnv(), env, m, stats)
+		})
+	})
+}
+
+// hookPipeline runs the enabled hooks once a publication is stored
+type hookPipeline struct {
+	names []string
+	hooks []Hook
+}
+
+// newHookPipeline builds the hooks for one publication. overrides comes from
+// the request and takes precedence over HOOK_<NAME> env vars, which take
+// precedence over each hook's default. Hooks reading the text don't run for
+// protected publications.
+func newHookPipeline(overrides map[string]bool, protected bool, env hookEnv) (*hookPipeline, error) {
+	known := map[string]bool{}
+	for _, h := range hookRegistry {
+		known[h.name] = true
+	}
+	for name := range overrides {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown hook %q", name)
+		}
+	}
+
+	p := &hookPipeline{}
+	for _, h := range hookRegistry {
+		enabled := h.enabled
+		if value := os.Getenv(hookEnvVar(h.name)); value != "" {
+			if parsed, err := strconv.ParseBool(value); err == nil {
+				enabled = parsed
+			} else {
+				log.Printf("Warning: ignoring invalid %s=%q", hookEnvVar(h.name), value)
+			}
+		}
+		if override, ok := overrides[h.name]; ok {
+			enabled = override
+		}
+		if enabled && !(protected && h.readsText) {
+			p.names = append(p.names, h.name)
+			p.hooks = append(p.hooks, h.newHook(env))
+		}
+	}
+	return p, nil
+}
+
+// hookEnvVar returns the env var that enables or disables a hook
+func hookEnvVar(name string) string {
+	return "HOOK_" + strings.ToUpper(name)
+}
+
+// hookReadsText reports whether the hook of that name sends the text of the
+// publication to another system
+func hookReadsText(name string) bool {
+	for _, h := range hookRegistry {
+		if h.name == name {
+			return h.readsText
+		}
+	}
+	return false
+}
+
+// run calls every hook. The publication is complete without them, so a hook
+// failing only yields a warning, and the hooks after it still run.
+func (p *hookPipeline) run(m *manifest.Manifest, stats *ReadingStats) []string {
+	var warnings []string
+	for i, hook := range p.hooks {
+		if err := hook.OnPublicationProcessed(m, stats); err != nil {
+			warning := fmt.Sprintf("hook %s failed: %v", p.names[i], err)
+			log.Printf("Warning: %s", warning)
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+const (
+	// webhookURLEnvVar is where the webhook hook posts the processed publications
+	webhookURLEnvVar = "WEBHOOK_URL"
+	// webhookSecretEnvVar signs the webhook payloads with HMAC-SHA256, sent hex
+	// encoded as X-Webhook-Signature
+	webhookSecretEnvVar = "WEBHOOK_SECRET"
+	webhookTimeout      = 10 * time.Second
+)
+
+// webhookURLFromEnv returns WEBHOOK_URL
+func webhookURLFromEnv() string {
+	return os.Getenv(webhookURLEnvVar)
+}
+
+// postWebhook posts a publication.processed event for the publication to url
+func postWebhook(url string, env hookEnv, m *manifest.Manifest, stats *ReadingStats) error {
+	if url == "" {
+		return fmt.Errorf("the webhook hook requires %s to be set", webhookURLEnvVar)
+	}
+	event := map[string]interface{}{
+		"event":        "publication.processed",
+		"publication":  env.basePath,
+		"manifest_url": env.manifestURL,
+		"title":        m.Metadata.Title(),
+	}
+	if stats != nil {
+		event["reading_stats"] = stats
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %w", err)
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := os.Getenv(webhookSecretEnvVar); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := NewHTTPClient(webhookTimeout).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestNewHookPipeline_Flags(t *testing.T) {
+	p, err := newHookPipeline(nil, false, hookEnv{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(p.names) != 0 {
+		t.Errorf("Expected no hooks by default, got %v", p.names)
+	}
+
+	t.Setenv(hookEnvVar("webhook"), "true")
+	t.Setenv(hookEnvVar("embeddings"), "1")
+	p, _ = newHookPipeline(nil, false, hookEnv{})
+	if want := []string{"embeddings", "webhook"}; !reflect.DeepEqual(p.names, want) {
+		t.Errorf("Expected env to enable hooks %v, got %v", want, p.names)
+	}
+
+	p, _ = newHookPipeline(map[string]bool{"webhook": false, "search_index": true}, false, hookEnv{})
+	if want := []string{"embeddings", "search_index"}; !reflect.DeepEqual(p.names, want) {
+		t.Errorf("Expected request overrides to win over env, got %v", p.names)
+	}
+
+	p, _ = newHookPipeline(map[string]bool{"search_index": true}, true, hookEnv{})
+	if want := []string{"webhook"}; !reflect.DeepEqual(p.names, want) {
+		t.Errorf("Expected hooks reading the text skipped for protected publications, got %v", p.names)
+	}
+
+	if _, err := newHookPipeline(map[string]bool{"opds": true}, false, hookEnv{}); err == nil {
+		t.Errorf("Expected error for unknown hook")
+	}
+}
+
+func TestHookPipeline_Run(t *testing.T) {
+	var calls []string
+	p := &hookPipeline{
+		names: []string{"failing", "counting"},
+		hooks: []Hook{
+			HookFunc(func(m *manifest.Manifest, stats *ReadingStats) error {
+				calls = append(calls, "failing")
+				return errors.New("unreachable")
+			}),
+			HookFunc(func(m *manifest.Manifest, stats *ReadingStats) error {
+				calls = append(calls, "counting")
+				return nil
+			}),
+		},
+	}
+	warnings := p.run(&manifest.Manifest{}, nil)
+	if want := []string{"failing", "counting"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("Expected every hook called in order, got %v", calls)
+	}
+	if len(warnings) != 1 || warnings[0] != "hook failing failed: unreachable" {
+		t.Errorf("Expected a warning for the failing hook, got %v", warnings)
+	}
+}
+
+func TestOptionsResolve_Hooks(t *testing.T) {
+	if err := (&Options{Hooks: map[string]bool{"opds": true}}).Resolve(); err == nil {
+		t.Error("Expected an error for an unknown hook")
+	}
+	if err := (&Options{Protected: true, Hooks: map[string]bool{"embeddings": true}}).Resolve(); err == nil || !strings.Contains(err.Error(), "embeddings") {
+		t.Errorf("Expected protected to reject the embeddings hook, got %v", err)
+	}
+	if err := (&Options{Protected: true, SearchIndex: true}).Resolve(); err == nil || !strings.Contains(err.Error(), "search_index") {
+		t.Errorf("Expected protected to reject the search_index shorthand, got %v", err)
+	}
+	if err := (&Options{Protected: true, Hooks: map[string]bool{"webhook": true, "embeddings": false}}).Resolve(); err != nil {
+		t.Errorf("Expected protected to allow the webhook, got %v", err)
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-Webhook-Signature")
+	}))
+	defer server.Close()
+	t.Setenv(webhookSecretEnvVar, "secret")
+
+	m := &manifest.Manifest{}
+	m.Metadata.LocalizedTitle = manifest.NewLocalizedStringFromString("Moby-Dick")
+	env := hookEnv{basePath: "books/b1", manifestURL: "https://cdn/books/b1/manifest.json"}
+	if err := postWebhook(server.URL, env, m, &ReadingStats{WordCount: 42}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("Expected a JSON event, got %s", body)
+	}
+	if event["event"] != "publication.processed" || event["publication"] != "books/b1" || event["manifest_url"] != env.manifestURL || event["title"] != "Moby-Dick" {
+		t.Errorf("Expected the publication in the event, got %v", event)
+	}
+	if stats, _ := event["reading_stats"].(map[string]interface{}); stats["word_count"] != float64(42) {
+		t.Errorf("Expected the reading stats in the event, got %v", event["reading_stats"])
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("Expected signature %s, got %s", want, signature)
+	}
+
+	if err := postWebhook("", env, m, nil); err == nil || !strings.Contains(err.Error(), webhookURLEnvVar) {
+		t.Errorf("Expected an error without %s, got %v", webhookURLEnvVar, err)
+	}
+}
@@ -0,0 +1,57 @@
+package processor
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// injectHeadEnvVar holds markup (e.g. ReadiumCSS <link> elements) injected into the
+// <head> of every content document, before any snippets passed in the request
+const injectHeadEnvVar = "INJECT_HEAD_HTML"
+
+var (
+	headCloseTagPattern = regexp.MustCompile(`(?i)</head\s*>`)
+	htmlStartTagPattern = regexp.MustCompile(`(?i)<html\b[^>]*>`)
+)
+
+// headSnippets returns the snippets to inject for a request
+func headSnippets(requested []string) []string {
+	var snippets []string
+	if snippet := strings.TrimSpace(os.Getenv(injectHeadEnvVar)); snippet != "" {
+		snippets = append(snippets, snippet)
+	}
+	for _, snippet := range requested {
+		if snippet = strings.TrimSpace(snippet); snippet != "" {
+			snippets = append(snippets, snippet)
+		}
+	}
+	return snippets
+}
+
+// injectIntoHead inserts snippets at the end of a document's <head>, creating the
+// head when the document has none. Snippets are inserted as-is, so for XHTML they
+// must be well-formed (<link ... />, <script ...></script>). Snippets already present
+// in the document are not inserted again.
+func injectIntoHead(content []byte, snippets []string) []byte {
+	contentStr := string(content)
+
+	var missing []string
+	for _, snippet := range snippets {
+		if !strings.Contains(contentStr, snippet) {
+			missing = append(missing, snippet)
+		}
+	}
+	if len(missing) == 0 {
+		return content
+	}
+	injected := strings.Join(missing, "\n")
+
+	if loc := headCloseTagPattern.FindStringIndex(contentStr); loc != nil {
+		return []byte(contentStr[:loc[0]] + injected + "\n" + contentStr[loc[0]:])
+	}
+	if loc := htmlStartTagPattern.FindStringIndex(contentStr); loc != nil {
+		return []byte(contentStr[:loc[1]] + "<head>" + injected + "</head>" + contentStr[loc[1]:])
+	}
+	return content
+}
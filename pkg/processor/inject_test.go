@@ -0,0 +1,49 @@
+package processor
+
+import "testing"
+
+func TestInjectIntoHead(t *testing.T) {
+	css := `<link rel="stylesheet" href="https://cdn.example.com/readium-css/ReadiumCSS-after.css"/>`
+	script := `<script src="https://cdn.example.com/paginate.js"></script>`
+
+	got := string(injectIntoHead([]byte(`<html><head><title>A</title></HEAD><body/></html>`), []string{css, script}))
+	want := `<html><head><title>A</title>` + css + "\n" + script + "\n" + `</HEAD><body/></html>`
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	got = string(injectIntoHead([]byte(`<html xmlns="http://www.w3.org/1999/xhtml"><body/></html>`), []string{css}))
+	want = `<html xmlns="http://www.w3.org/1999/xhtml"><head>` + css + `</head><body/></html>`
+	if got != want {
+		t.Errorf("Expected head to be created, got %s", got)
+	}
+
+	doc := `<html><head>` + css + `</head></html>`
+	if got := string(injectIntoHead([]byte(doc), []string{css})); got != doc {
+		t.Errorf("Expected snippet not to be injected twice, got %s", got)
+	}
+}
+
+func TestHeadSnippets(t *testing.T) {
+	t.Setenv(injectHeadEnvVar, ` <link rel="stylesheet" href="a.css"/> `)
+	got := headSnippets([]string{"", `<script src="b.js"></script>`})
+	if len(got) != 2 || got[0] != `<link rel="stylesheet" href="a.css"/>` || got[1] != `<script src="b.js"></script>` {
+		t.Errorf("Expected env snippet followed by request snippet, got %q", got)
+	}
+}
+
+func TestHeadInject_RunsAfterSanitize(t *testing.T) {
+	script := `<script src="paginate.js"></script>`
+	p, err := newTransformPipeline(map[string]bool{"js_sanitize": true}, transformEnv{headSnippets: []string{script}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	link := testLink(t, "OEBPS/ch1.xhtml")
+	data, err := p.apply(&link, []byte(`<html><head><script>evil()</script></head></html>`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := `<html><head>` + script + "\n" + `</head></html>`; string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+}
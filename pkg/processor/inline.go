@@ -0,0 +1,225 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"golang.org/x/net/html"
+)
+
+// maxInlineBytes caps the inline_max_bytes option, as every document using a
+// resource gets a copy of it
+const maxInlineBytes = 64 << 10
+
+// inlineImageTypes are the images that can be inlined. SVG images are left out
+// as they may refer to other files, which a data: URL can't resolve.
+var inlineImageTypes = map[string]bool{
+	"image/gif":  true,
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// inlineRefPattern matches the references that can be replaced by a data: URL:
+// the src of an <img>, the href of an SVG <image> and the href of a <link>,
+// quoted or not
+var inlineRefPattern = regexp.MustCompile(`(?i)(<(?:img|(?:\w+:)?image|link)\b[^>]*?\s(?:src|href|xlink:href)\s*=\s*)("[^"]*"|'[^']*'|[^\s"'>]+)`)
+
+// validateInlineMaxBytes checks the inline_max_bytes option; 0 inlines nothing
+func validateInlineMaxBytes(maxBytes int) error {
+	if maxBytes < 0 || maxBytes > maxInlineBytes {
+		return fmt.Errorf("inline_max_bytes must be between 0 and %d, got %d", maxInlineBytes, maxBytes)
+	}
+	return nil
+}
+
+// resourceInliner replaces the references of content documents to small images
+// and stylesheets with data: URLs, so those files don't have to be stored and
+// fetched one by one. A nil inliner inlines nothing.
+type resourceInliner struct {
+	urls  map[string]string // archive path -> data: URL
+	hrefs []string          // manifest hrefs of the inlined resources
+}
+
+// newResourceInliner picks the resources of m to inline: images, and stylesheets
+// without references of their own, of at most maxBytes that are only ever used
+// as an <img> or <image> source or a stylesheet <link> in content documents.
+// Anything else referring to a resource (another stylesheet, a <style> block or
+// style attribute, a srcset, a plain link, the manifest links or the reading
+// order) keeps it a file.
+func newResourceInliner(m *manifest.Manifest, entries map[string]*zip.File, maxBytes int) *resourceInliner {
+	inliner := &resourceInliner{urls: map[string]string{}}
+	if maxBytes <= 0 {
+		return inliner
+	}
+
+	candidates := map[string]bool{}
+	for _, link := range m.Resources {
+		target := resolveArchiveHref(link.Href.String(), "")
+		f := entries[target]
+		if f == nil || len(link.Rels) > 0 || f.UncompressedSize64 > uint64(maxBytes) {
+			continue
+		}
+		mediaType := resourceMediaType(&link)
+		if inlineImageTypes[mediaType] || mediaType == "text/css" && len(resourceRefs(target, f)) == 0 {
+			candidates[target] = true
+		}
+	}
+	if len(candidates) == 0 {
+		return inliner
+	}
+
+	// Count the references that can be inlined, and drop the candidates used any other way
+	inlinable := map[string]bool{}
+	disqualify := func(links manifest.LinkList) {
+		var walk func(manifest.LinkList)
+		walk = func(links manifest.LinkList) {
+			for _, link := range links {
+				delete(candidates, resolveArchiveHref(link.Href.String(), ""))
+				walk(link.Children)
+			}
+		}
+		walk(links)
+	}
+	disqualify(m.ReadingOrder)
+	disqualify(m.TableOfContents)
+	disqualify(m.Links)
+	for name, f := range entries {
+		if !isHTMLPath(name) {
+			for _, ref := range resourceRefs(name, f) {
+				delete(candidates, resolveArchiveHref(ref, name))
+			}
+			continue
+		}
+		data, err := readZipEntry(f)
+		if err != nil {
+			continue
+		}
+		for _, ref := range cssRefs(data) {
+			delete(candidates, resolveArchiveHref(ref, name))
+		}
+		for _, ref := range documentInlineRefs(data) {
+			target := resolveArchiveHref(ref.value, name)
+			if ref.inline {
+				inlinable[target] = true
+			} else {
+				delete(candidates, target)
+			}
+		}
+	}
+
+	for _, link := range m.Resources {
+		target := resolveArchiveHref(link.Href.String(), "")
+		if !candidates[target] || !inlinable[target] {
+			continue
+		}
+		data, err := readZipEntry(entries[target])
+		if err != nil {
+			continue
+		}
+		inliner.urls[target] = "data:" + resourceMediaType(&link) + ";base64," + base64.StdEncoding.EncodeToString(data)
+		inliner.hrefs = append(inliner.hrefs, link.Href.String())
+	}
+	return inliner
+}
+
+// isHTMLPath reports whether an archive entry is a content document, by extension
+func isHTMLPath(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".xhtml") || strings.HasSuffix(name, ".html") || strings.HasSuffix(name, ".htm")
+}
+
+// documentRef is a reference made by a content document, and whether it is in
+// a place a data: URL can take
+type documentRef struct {
+	value  string
+	inline bool
+}
+
+// documentInlineRefs returns the references in the attributes of a content
+// document (href, src, xlink:href, srcset, poster and data), flagging <img> and
+// <image> sources and stylesheet links. The document is read with the HTML
+// tokenizer, which reads on past markup an XML parser stops at, such as an
+// unquoted value.
+func documentInlineRefs(content []byte) []documentRef {
+	z := html.NewTokenizer(bytes.NewReader(content))
+
+	var refs []documentRef
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		token := z.Token()
+		name := localName(token.Data)
+		stylesheet := false
+		for _, attr := range token.Attr {
+			if attr.Key == "rel" {
+				for _, rel := range strings.Fields(strings.ToLower(attr.Val)) {
+					stylesheet = stylesheet || rel == "stylesheet"
+				}
+			}
+		}
+		for _, attr := range token.Attr {
+			switch localName(attr.Key) {
+			case "src":
+				refs = append(refs, documentRef{value: attr.Val, inline: name == "img"})
+			case "href":
+				refs = append(refs, documentRef{value: attr.Val, inline: name == "image" || name == "link" && stylesheet})
+			case "poster", "data":
+				refs = append(refs, documentRef{value: attr.Val})
+			case "srcset":
+				for _, candidate := range strings.Split(attr.Val, ",") {
+					if fields := strings.Fields(candidate); len(fields) > 0 {
+						refs = append(refs, documentRef{value: fields[0]})
+					}
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// localName returns a tag or attribute name without its prefix
+func localName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// inline replaces the references of the content document at docPath to the
+// inlined resources with their data: URLs
+func (i *resourceInliner) inline(docPath string, content []byte) []byte {
+	if i == nil || len(i.urls) == 0 {
+		return content
+	}
+	return inlineRefPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		parts := inlineRefPattern.FindSubmatch(match)
+		value, quote := string(parts[2]), `"`
+		if value[0] == '"' || value[0] == '\'' {
+			value, quote = value[1:len(value)-1], value[:1]
+		}
+		if dataURL, ok := i.urls[resolveArchiveHref(html.UnescapeString(value), docPath)]; ok {
+			return []byte(string(parts[1]) + quote + dataURL + quote)
+		}
+		return match
+	})
+}
+
+// inlinedHrefs returns the manifest hrefs of the inlined resources, which need
+// no file of their own
+func (i *resourceInliner) inlinedHrefs() []string {
+	if i == nil {
+		return nil
+	}
+	return i.hrefs
+}
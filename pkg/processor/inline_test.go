@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestResourceInliner(t *testing.T) {
+	zipReader := buildEPUB(t, map[string]string{
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head>` +
+			`<link rel="stylesheet" href="css/small.css"/><link rel="stylesheet" href="css/fonts.css"/></head>` +
+			`<body><img src="img/icon.png" alt=""/><img src="img/large.png" alt=""/><a href="img/linked.png">Map</a><img src="img/linked.png" alt=""/></body></html>`,
+		"OEBPS/ch2.xhtml":      `<html xmlns="http://www.w3.org/1999/xhtml"><body><img src="img/bg.png" alt=""/><img src="./img/icon.png" alt=""/></body></html>`,
+		"OEBPS/css/small.css":  `p { margin: 0 }`,
+		"OEBPS/css/fonts.css":  `@font-face { src: url(../fonts/serif.ttf) } body { background: url(../img/bg.png) }`,
+		"OEBPS/img/icon.png":   "icon",
+		"OEBPS/img/large.png":  strings.Repeat("x", 100),
+		"OEBPS/img/linked.png": "map",
+		"OEBPS/img/bg.png":     "bg",
+	})
+
+	m := &manifest.Manifest{
+		ReadingOrder: manifest.LinkList{testLink(t, "OEBPS/ch1.xhtml"), testLink(t, "OEBPS/ch2.xhtml")},
+		Resources: manifest.LinkList{
+			testLink(t, "OEBPS/css/small.css"),
+			testLink(t, "OEBPS/css/fonts.css"),
+			testLink(t, "OEBPS/img/icon.png"),
+			testLink(t, "OEBPS/img/large.png"),
+			testLink(t, "OEBPS/img/linked.png"),
+			testLink(t, "OEBPS/img/bg.png"),
+		},
+	}
+
+	inliner := newResourceInliner(m, zipEntries(zipReader), 64)
+	// fonts.css has references of its own, large.png is too big, linked.png is
+	// also a link target and bg.png is also used by a stylesheet
+	if want := []string{"OEBPS/css/small.css", "OEBPS/img/icon.png"}; !reflect.DeepEqual(inliner.inlinedHrefs(), want) {
+		t.Errorf("Expected %v to be inlined, got %v", want, inliner.inlinedHrefs())
+	}
+
+	data := string(inliner.inline("OEBPS/ch2.xhtml", []byte(`<body><img src="img/bg.png" alt=""/><img src="./img/icon.png" alt=""/></body>`)))
+	if want := `<img src="img/bg.png" alt=""/><img src="data:image/png;base64,aWNvbg==" alt=""/>`; !strings.Contains(data, want) {
+		t.Errorf("Expected the icon to be inlined, got %s", data)
+	}
+	data = string(inliner.inline("OEBPS/ch1.xhtml", []byte(`<link rel="stylesheet" href="css/small.css"/>`)))
+	if data != `<link rel="stylesheet" href="data:text/css;base64,cCB7IG1hcmdpbjogMCB9"/>` {
+		t.Errorf("Expected the stylesheet to be inlined, got %s", data)
+	}
+
+	var none *resourceInliner
+	if got := none.inline("OEBPS/ch1.xhtml", []byte(`<img src="img/icon.png"/>`)); string(got) != `<img src="img/icon.png"/>` {
+		t.Errorf("Expected a nil inliner to leave documents alone, got %s", got)
+	}
+}
+
+func TestResourceInliner_OtherReferences(t *testing.T) {
+	zipReader := buildEPUB(t, map[string]string{
+		"OEBPS/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><head><style>body { background: url(img/style.png) }</style></head>` +
+			`<body><img src="img/style.png" alt=""/><p style="background: url('img/attr.png')"><img src="img/attr.png" alt=""/></p>` +
+			`<img src="img/srcset.png" srcset="img/srcset.png 1x, img/retina.png 2x" alt=""/><img src="img/retina.png" alt=""/>` +
+			`<video poster="img/poster.png"/><img src="img/poster.png" alt=""/>` +
+			`<object data="img/object.png"/><img src="img/object.png" alt=""/>` +
+			`<img src=img/unquoted.png alt=""/></body></html>`,
+		"OEBPS/img/style.png":    "style",
+		"OEBPS/img/attr.png":     "attr",
+		"OEBPS/img/srcset.png":   "srcset",
+		"OEBPS/img/retina.png":   "retina",
+		"OEBPS/img/poster.png":   "poster",
+		"OEBPS/img/object.png":   "object",
+		"OEBPS/img/unquoted.png": "unquoted",
+	})
+
+	m := &manifest.Manifest{ReadingOrder: manifest.LinkList{testLink(t, "OEBPS/ch1.xhtml")}}
+	for _, name := range []string{"style", "attr", "srcset", "retina", "poster", "object", "unquoted"} {
+		m.Resources = append(m.Resources, testLink(t, "OEBPS/img/"+name+".png"))
+	}
+
+	// Only the unquoted source is used nowhere but in an <img>
+	inliner := newResourceInliner(m, zipEntries(zipReader), 64)
+	if want := []string{"OEBPS/img/unquoted.png"}; !reflect.DeepEqual(inliner.inlinedHrefs(), want) {
+		t.Errorf("Expected %v to be inlined, got %v", want, inliner.inlinedHrefs())
+	}
+	data := string(inliner.inline("OEBPS/ch1.xhtml", []byte(`<img src=img/unquoted.png alt=""/>`)))
+	if data != `<img src="data:image/png;base64,dW5xdW90ZWQ=" alt=""/>` {
+		t.Errorf("Expected the unquoted source to be inlined, got %s", data)
+	}
+}
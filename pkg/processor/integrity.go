@@ -0,0 +1,100 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// IntegrityPath is where the checksums of a publication's files are published,
+// relative to basePath
+const IntegrityPath = "readium/integrity.json"
+
+// navigationCollections hold links into documents rather than to files, so
+// their links get no checksum
+var navigationCollections = map[string]bool{
+	"toc":                 true,
+	"landmarks":           true,
+	"pageList":            true,
+	flatTOCCollectionRole: true,
+}
+
+// integrityFile is the sidecar listing the checksum of every stored file, keyed
+// by its href relative to the manifest, so mirrors can verify a whole copy
+type integrityFile struct {
+	Version   int               `json:"version"`
+	Resources map[string]string `json:"resources"`
+}
+
+// integrityChecksum returns the Subresource Integrity checksum of data
+// ("sha256-" and the base64 SHA-256), the form browsers verify natively
+func integrityChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// addLinkProperties sets the checksum property of every manifest link to a
+// file stored during this run, and the encrypted property of those that were
+// encrypted. The checksums cover the bytes readers receive, that is before any
+// storage compression but after encryption.
+func (d *deltaUploader) addLinkProperties(manifestJSON []byte, basePath string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(manifestJSON))
+	decoder.UseNumber()
+	var manifest map[string]interface{}
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	for role, value := range manifest {
+		links, ok := linkList(value)
+		if !ok || navigationCollections[role] {
+			continue
+		}
+		for _, link := range links {
+			href := linkHref(link)
+			if isExternalHref(href) || strings.ContainsAny(href, "?#") {
+				continue
+			}
+			path := fmt.Sprintf("%s/%s", basePath, resourceKey(href))
+			checksum, ok := d.checksums[path]
+			if !ok {
+				continue
+			}
+			properties, _ := link["properties"].(map[string]interface{})
+			if properties == nil {
+				properties = map[string]interface{}{}
+				link["properties"] = properties
+			}
+			properties["checksum"] = checksum
+			if encrypted := d.encrypter.encryptedProperty(path); encrypted != nil {
+				properties["encrypted"] = encrypted
+			}
+		}
+	}
+
+	data, err := canonicalJSON(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return data, nil
+}
+
+// saveIntegrity uploads the integrity sidecar for everything stored so far,
+// the manifest included, so it must be called once the manifest is uploaded
+func (d *deltaUploader) saveIntegrity(basePath string) error {
+	resources := make(map[string]string, len(d.checksums))
+	for path, checksum := range d.checksums {
+		resources[escapeStoragePath(strings.TrimPrefix(path, basePath+"/"))] = checksum
+	}
+	data, err := canonicalJSON(integrityFile{Version: 1, Resources: resources})
+	if err != nil {
+		return fmt.Errorf("failed to marshal integrity file: %w", err)
+	}
+	if _, err := d.upload(fmt.Sprintf("%s/%s", basePath, IntegrityPath), data); err != nil {
+		return fmt.Errorf("failed to upload integrity file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestIntegrityChecksum(t *testing.T) {
+	// The SRI example digest of an empty resource
+	if got := integrityChecksum(nil); got != "sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=" {
+		t.Errorf("Expected the SHA-256 of nothing, got %s", got)
+	}
+}
+
+func TestProcess_Integrity(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	entries := map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	}
+	if _, err := p.Process(spoolTestArchive(t, entries), "leviathan.lpf", Options{}); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	manifestJSON, _ := supabase.Object(ManifestBucket, "leviathan/manifest.json")
+	var manifest struct {
+		ReadingOrder []struct {
+			Href       string `json:"href"`
+			Properties struct {
+				Checksum string `json:"checksum"`
+			} `json:"properties"`
+		} `json:"readingOrder"`
+	}
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if len(manifest.ReadingOrder) != 3 || manifest.ReadingOrder[0].Href != "audio/chapter%201.mp3" {
+		t.Fatalf("Expected three chapters, got %+v", manifest.ReadingOrder)
+	}
+	if got := manifest.ReadingOrder[0].Properties.Checksum; got != integrityChecksum([]byte("one")) {
+		t.Errorf("Expected the checksum of chapter 1, got %q", got)
+	}
+	// The bonus chapter is not stored with the publication
+	if got := manifest.ReadingOrder[2].Properties.Checksum; got != "" {
+		t.Errorf("Expected no checksum for an external link, got %q", got)
+	}
+
+	data, ok := supabase.Object(ManifestBucket, "leviathan/"+IntegrityPath)
+	if !ok {
+		t.Fatalf("Expected the integrity file, got %v", supabase.Paths(ManifestBucket))
+	}
+	var integrity integrityFile
+	if err := json.Unmarshal(data, &integrity); err != nil {
+		t.Fatalf("Failed to parse integrity file: %v", err)
+	}
+	if got := integrity.Resources["manifest.json"]; got != integrityChecksum(manifestJSON) {
+		t.Errorf("Expected the checksum of the manifest, got %q", got)
+	}
+	if got := integrity.Resources["audio/chapter%201.mp3"]; got != manifest.ReadingOrder[0].Properties.Checksum {
+		t.Errorf("Expected the sidecar to match the manifest, got %q", got)
+	}
+	if _, ok := integrity.Resources[IntegrityPath]; ok || len(integrity.Resources) != 5 {
+		t.Errorf("Expected the four resources and the manifest, got %v", integrity.Resources)
+	}
+}
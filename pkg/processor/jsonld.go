@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// bookJSONLDPath is where the schema.org description is stored, relative to basePath
+const bookJSONLDPath = "book.jsonld"
+
+// generateBookJSONLD describes the publication as a schema.org Book, for pages
+// that embed it as structured data. pkg may be nil.
+func generateBookJSONLD(m *manifest.Manifest, pkg *epubPackage, resourceMap map[string]string, manifestURL string) ([]byte, error) {
+	metadata := &m.Metadata
+	book := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    "Book",
+		"name":     metadata.Title(),
+		"url":      manifestURL,
+	}
+
+	if authors := schemaPeople(metadata.Authors); len(authors) > 0 {
+		book["author"] = authors
+	}
+	for key, contributors := range map[string]manifest.Contributors{
+		"translator":  metadata.Translators,
+		"editor":      metadata.Editors,
+		"illustrator": metadata.Illustrators,
+		"readBy":      metadata.Narrators,
+	} {
+		if people := schemaPeople(contributors); len(people) > 0 {
+			book[key] = people
+		}
+	}
+	if len(metadata.Publishers) > 0 {
+		book["publisher"] = map[string]interface{}{"@type": "Organization", "name": metadata.Publishers[0].Name()}
+	}
+	if isbn := findISBN(metadata, pkg); isbn != "" {
+		book["isbn"] = isbn
+	}
+	if len(metadata.Languages) > 0 {
+		book["inLanguage"] = metadata.Languages[0]
+	}
+	if metadata.Description != "" {
+		book["description"] = metadata.Description
+	}
+	if metadata.Published != nil {
+		book["datePublished"] = metadata.Published.Format("2006-01-02")
+	}
+	if metadata.Modified != nil {
+		book["dateModified"] = metadata.Modified.Format("2006-01-02")
+	}
+	if metadata.NumberOfPages != nil {
+		book["numberOfPages"] = *metadata.NumberOfPages
+	}
+	if image := coverImageURL(m, resourceMap); image != "" {
+		book["image"] = image
+	}
+
+	var genres []string
+	for _, subject := range metadata.Subjects {
+		if name := subject.LocalizedName.String(); name != "" {
+			genres = append(genres, name)
+		}
+	}
+	if len(genres) > 0 {
+		book["genre"] = genres
+	}
+
+	if series := metadata.BelongsTo["series"]; len(series) > 0 {
+		isPartOf := map[string]interface{}{"@type": "BookSeries", "name": series[0].Name()}
+		book["isPartOf"] = isPartOf
+		if series[0].Position != nil {
+			book["position"] = *series[0].Position
+		}
+	}
+
+	data, err := json.MarshalIndent(book, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON-LD: %w", err)
+	}
+	return data, nil
+}
+
+// schemaPeople converts contributors to schema.org Person objects
+func schemaPeople(contributors manifest.Contributors) []map[string]interface{} {
+	people := make([]map[string]interface{}, 0, len(contributors))
+	for _, c := range contributors {
+		if name := c.Name(); name != "" {
+			people = append(people, map[string]interface{}{"@type": "Person", "name": name})
+		}
+	}
+	return people
+}
+
+// coverImageURL returns the public URL of the cover: either an external cover
+// link or the uploaded cover resource
+func coverImageURL(m *manifest.Manifest, resourceMap map[string]string) string {
+	for _, links := range []manifest.LinkList{m.Links, m.Resources, m.ReadingOrder} {
+		for _, link := range links {
+			if !hasRel(link, "cover") {
+				continue
+			}
+			href := link.Href.String()
+			if strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://") {
+				return href
+			}
+			if url, ok := resourceMap[href]; ok {
+				return url
+			}
+		}
+	}
+	return ""
+}
+
+// hasRel reports whether a link has the given rel
+func hasRel(link manifest.Link, rel string) bool {
+	for _, r := range link.Rels {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestGenerateBookJSONLD(t *testing.T) {
+	published := time.Date(2011, 6, 2, 0, 0, 0, 0, time.UTC)
+	position := 1.0
+	cover := testLink(t, "OEBPS/Images/cover.jpg")
+	cover.Rels = manifest.Strings{"cover"}
+	m := manifest.Manifest{
+		Metadata: manifest.Metadata{
+			Identifier:     "urn:isbn:978-0-316-12908-4",
+			LocalizedTitle: manifest.NewLocalizedStringFromString("Leviathan Wakes"),
+			Authors:        manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("James S. A. Corey")}},
+			Publishers:     manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Orbit")}},
+			Languages:      manifest.Strings{"en"},
+			Published:      &published,
+			Subjects:       []manifest.Subject{{LocalizedName: manifest.NewLocalizedStringFromString("Science Fiction")}},
+			BelongsTo: map[string]manifest.Collections{
+				"series": {{LocalizedName: manifest.NewLocalizedStringFromString("The Expanse"), Position: &position}},
+			},
+		},
+		Resources: manifest.LinkList{cover},
+	}
+	resourceMap := map[string]string{"OEBPS/Images/cover.jpg": "https://cdn.example.com/cover.jpg"}
+
+	data, err := generateBookJSONLD(&m, nil, resourceMap, "https://cdn.example.com/manifest.json")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var book map[string]interface{}
+	if err := json.Unmarshal(data, &book); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"@context":      "https://schema.org",
+		"@type":         "Book",
+		"name":          "Leviathan Wakes",
+		"isbn":          "9780316129084",
+		"inLanguage":    "en",
+		"image":         "https://cdn.example.com/cover.jpg",
+		"datePublished": "2011-06-02",
+		"url":           "https://cdn.example.com/manifest.json",
+		"position":      1.0,
+	}
+	for key, value := range expected {
+		if book[key] != value {
+			t.Errorf("Expected %s to be %v, got %v", key, value, book[key])
+		}
+	}
+	if authors, _ := book["author"].([]interface{}); len(authors) != 1 || authors[0].(map[string]interface{})["name"] != "James S. A. Corey" {
+		t.Errorf("Expected one author, got %v", book["author"])
+	}
+	if series, _ := book["isPartOf"].(map[string]interface{}); series["name"] != "The Expanse" {
+		t.Errorf("Expected series The Expanse, got %v", book["isPartOf"])
+	}
+	if publisher, _ := book["publisher"].(map[string]interface{}); publisher["name"] != "Orbit" {
+		t.Errorf("Expected publisher Orbit, got %v", book["publisher"])
+	}
+}
+
+func TestCoverImageURLExternal(t *testing.T) {
+	cover := testLink(t, "https://images.example.com/cover.png")
+	cover.Rels = manifest.Strings{"cover"}
+	m := manifest.Manifest{Links: manifest.LinkList{cover}}
+	if got := coverImageURL(&m, nil); got != "https://images.example.com/cover.png" {
+		t.Errorf("Expected external cover URL, got %q", got)
+	}
+	if got := coverImageURL(&manifest.Manifest{}, nil); got != "" {
+		t.Errorf("Expected no cover, got %q", got)
+	}
+}
@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Minimum number of letters needed before detectLanguage will guess
+const minDetectionLetters = 100
+
+// scriptLanguages maps scripts used by a single major language to that language
+var scriptLanguages = []struct {
+	table    *unicode.RangeTable
+	script   string
+	language string
+}{
+	{unicode.Hangul, "Kore", "ko"},
+	{unicode.Hiragana, "Jpan", "ja"},
+	{unicode.Katakana, "Jpan", "ja"},
+	{unicode.Han, "Hani", "zh"},
+	{unicode.Cyrillic, "Cyrl", "ru"},
+	{unicode.Greek, "Grek", "el"},
+	{unicode.Arabic, "Arab", "ar"},
+	{unicode.Hebrew, "Hebr", "he"},
+	{unicode.Thai, "Thai", "th"},
+	{unicode.Devanagari, "Deva", "hi"},
+	{unicode.Latin, "Latn", ""},
+}
+
+// latinStopwords are frequent short words that tell Latin-script languages apart
+var latinStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "a", "in", "is", "that", "it", "was", "he", "she", "for", "with", "his", "her", "you", "not"},
+	"fr": {"le", "la", "les", "de", "des", "et", "est", "un", "une", "que", "qui", "il", "elle", "dans", "pas", "pour", "sur", "au"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "zu", "den", "mit", "sich", "des", "auf", "er", "sie", "es", "dem"},
+	"es": {"el", "la", "los", "las", "de", "y", "que", "en", "un", "una", "es", "se", "no", "por", "con", "para", "del", "su"},
+	"it": {"il", "la", "di", "e", "che", "un", "una", "non", "per", "in", "del", "della", "sono", "si", "con", "gli", "le", "era"},
+	"pt": {"o", "a", "os", "as", "de", "e", "que", "em", "um", "uma", "não", "do", "da", "para", "com", "se", "ele", "ela"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "zijn", "met", "die", "voor", "hij", "zij", "ik", "maar"},
+}
+
+// detectLanguage guesses the language of text, returning a BCP-47 language
+// and the ISO 15924 script it is written in. The language is "" when the text
+// is too short or no candidate clearly wins; the script is "" when the text
+// has too few letters to tell.
+func detectLanguage(text string) (language, script string) {
+	counts := make([]int, len(scriptLanguages))
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for i, s := range scriptLanguages {
+			if unicode.Is(s.table, r) {
+				counts[i]++
+				break
+			}
+		}
+	}
+	if letters < minDetectionLetters {
+		return "", ""
+	}
+
+	// Japanese mixes kana with Han characters, so any real amount of kana wins
+	kana := counts[1] + counts[2]
+	if kana*10 >= letters {
+		return "ja", "Jpan"
+	}
+
+	best := 0
+	for i := range counts {
+		if counts[i] > counts[best] {
+			best = i
+		}
+	}
+	if counts[best]*2 < letters {
+		return "", ""
+	}
+	if scriptLanguages[best].language != "" {
+		return scriptLanguages[best].language, scriptLanguages[best].script
+	}
+	return detectLatinLanguage(text), "Latn"
+}
+
+// detectLatinLanguage picks the Latin-script language whose stopwords are most
+// frequent in text, requiring a clear margin over the runner-up
+func detectLatinLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+
+	scores := map[string]int{}
+	for language, stopwords := range latinStopwords {
+		set := make(map[string]bool, len(stopwords))
+		for _, w := range stopwords {
+			set[w] = true
+		}
+		for _, w := range words {
+			if set[w] {
+				scores[language]++
+			}
+		}
+	}
+
+	ranked := make([]string, 0, len(scores))
+	for language := range scores {
+		ranked = append(ranked, language)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+	if len(ranked) == 0 {
+		return ""
+	}
+	best, runnerUp := ranked[0], 0
+	if len(ranked) > 1 {
+		runnerUp = scores[ranked[1]]
+	}
+	// Stopwords make up a good part of running text, so require both a
+	// reasonable share of the words and a clear lead
+	if scores[best]*10 < len(words) || scores[best] < runnerUp*3/2 {
+		return ""
+	}
+	return best
+}
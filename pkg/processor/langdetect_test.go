@@ -0,0 +1,28 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		language string
+		script   string
+	}{
+		{"english", "It was the best of times, it was the worst of times, it was the age of wisdom, it was the age of foolishness, it was the epoch of belief, it was the epoch of incredulity, it was the season of Light, it was the season of Darkness.", "en", "Latn"},
+		{"french", "Longtemps, je me suis couché de bonne heure. Parfois, à peine ma bougie éteinte, mes yeux se fermaient si vite que je n'avais pas le temps de me dire: je m'endors. Et, une demi-heure après, la pensée qu'il était temps de chercher le sommeil m'éveillait.", "fr", "Latn"},
+		{"german", "Als Gregor Samsa eines Morgens aus unruhigen Träumen erwachte, fand er sich in seinem Bett zu einem ungeheueren Ungeziefer verwandelt. Er lag auf seinem panzerartig harten Rücken und sah, wenn er den Kopf ein wenig hob, seinen gewölbten, braunen Bauch.", "de", "Latn"},
+		{"russian", strings.Repeat("Все счастливые семьи похожи друг на друга, каждая несчастливая семья несчастлива по-своему. ", 3), "ru", "Cyrl"},
+		{"japanese", strings.Repeat("吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。", 8), "ja", "Jpan"},
+		{"too short", "Chapter One", "", ""},
+	}
+	for _, tt := range tests {
+		language, script := detectLanguage(tt.text)
+		if language != tt.language || script != tt.script {
+			t.Errorf("%s: Expected %q/%q, got %q/%q", tt.name, tt.language, tt.script, language, script)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Storage layouts for the output of a publication in the manifest bucket
+const (
+	// layoutFlat flattens the EPUB filename into a single path segment:
+	// books/abc/book.epub -> books_abc_book/...
+	layoutFlat = "flat"
+	// layoutPreserve keeps the EPUB filename, including its extension, as the
+	// prefix: books/abc/book.epub -> books/abc/book.epub/...
+	// Distinct source files always map to distinct prefixes, and keeping the
+	// extension stops a book's tree from overlapping the tree of a sibling
+	// directory with the same stem.
+	layoutPreserve = "preserve"
+	// layoutIdentifier stores the publication under its dc:identifier, so
+	// re-uploads of a book under another filename update the same tree:
+	// urn:isbn:9780316129084/... Publications without one get a UUID derived
+	// from their EPUB (see assignIdentifier).
+	layoutIdentifier = "identifier"
+
+	storageLayoutEnvVar = "STORAGE_LAYOUT"
+)
+
+// resolveStorageLayout returns the layout to use for a request, falling back to
+// STORAGE_LAYOUT and then to the flat layout
+func resolveStorageLayout(requested string) (string, error) {
+	layout := requested
+	if layout == "" {
+		layout = os.Getenv(storageLayoutEnvVar)
+	}
+	switch layout {
+	case "", layoutFlat:
+		return layoutFlat, nil
+	case layoutPreserve:
+		return layoutPreserve, nil
+	case layoutIdentifier:
+		return layoutIdentifier, nil
+	default:
+		return "", fmt.Errorf("unknown storage layout %q (expected %q, %q or %q)", layout, layoutFlat, layoutPreserve, layoutIdentifier)
+	}
+}
+
+// BasePath derives the storage prefix for a publication from its EPUB filename.
+// The prefix is NFC-normalized, like every other storage key. The identifier
+// layout, which doesn't depend on the filename, gets the flat prefix.
+func BasePath(epubFilename, layout string) string {
+	epubFilename = norm.NFC.String(epubFilename)
+	if layout == layoutPreserve {
+		basePath := strings.ReplaceAll(epubFilename, "\\", "/")
+		return strings.TrimPrefix(path.Clean("/"+basePath), "/")
+	}
+
+	// Extract base path from EPUB filename (without extension)
+	basePath := strings.TrimSuffix(epubFilename, filepath.Ext(epubFilename))
+	// Replace any path separators with underscores for the storage path
+	basePath = strings.ReplaceAll(basePath, "/", "_")
+	basePath = strings.ReplaceAll(basePath, "\\", "_")
+	return basePath
+}
+
+// storageBasePath returns where the publication processed from epubFilename is
+// stored (see outputBasePath), with a warning if it had to move. Distinct
+// filenames may flatten to the same prefix (a/b.epub and a_b.epub): when the
+// index there records another EPUB, the publication moves to the prefix
+// suffixed with a short hash of its filename rather than overwrite the other.
+func storageBasePath(uploader Uploader, epubFilename string, options Options, metadata *manifest.Metadata) (string, string, error) {
+	basePath, err := publicationBasePath(epubFilename, options, metadata)
+	if err != nil {
+		return "", "", err
+	}
+	var warning string
+	if options.Layout == layoutFlat && options.PathTemplate == "" {
+		epubFilename = norm.NFC.String(epubFilename)
+		if owner := norm.NFC.String(indexedFilename(uploader, basePath)); owner != "" && owner != epubFilename {
+			sum := sha256.Sum256([]byte(epubFilename))
+			disambiguated := fmt.Sprintf("%s-%s", basePath, hex.EncodeToString(sum[:4]))
+			warning = fmt.Sprintf("%s flattens to %s, which holds the publication of %s: stored under %s instead", epubFilename, basePath, owner, disambiguated)
+			basePath = disambiguated
+		}
+	}
+	return watermarkedBasePath(basePath, options.Watermark), warning, nil
+}
+
+// indexedFilename returns the EPUB filename recorded in the index at basePath,
+// or "" if there is no index or it predates the filename being recorded
+func indexedFilename(uploader Uploader, basePath string) string {
+	data, err := uploader.Download(fmt.Sprintf("%s/%s", basePath, IndexPath))
+	if err != nil {
+		return ""
+	}
+	var index resourceIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return ""
+	}
+	return index.Filename
+}
+
+// assignIdentifier gives a publication without dc:identifier a urn:uuid: one,
+// derived from the SHA-256 of its EPUB so processing the same file again keeps
+// it, and returns it. Publications with an identifier keep theirs, and get "".
+func assignIdentifier(metadata *manifest.Metadata, sourceHash string) string {
+	if strings.TrimSpace(metadata.Identifier) != "" {
+		return ""
+	}
+	id := uuid.NewString()
+	if sourceHash != "" {
+		id = uuid.NewSHA1(uuid.NameSpaceURL, []byte("urn:sha256:"+sourceHash)).String()
+	}
+	metadata.Identifier = "urn:uuid:" + id
+	return metadata.Identifier
+}
+
+// BasePaths returns the storage prefixes epubFilename maps to under every
+// layout, since a publication may have been processed with either, starting
+// with OUTPUT_PATH_TEMPLATE when it only depends on the filename
+func BasePaths(epubFilename string) []string {
+	basePaths := []string{BasePath(epubFilename, layoutFlat), BasePath(epubFilename, layoutPreserve)}
+	if template, err := resolvePathTemplate("", nil); err == nil && template != "" {
+		if basePath, err := renderPathTemplate(template, epubFilename, nil, nil); err == nil {
+			basePaths = append([]string{basePath}, basePaths...)
+		}
+	}
+	return basePaths
+}
+
+// escapeStoragePath percent-encodes each segment of an object path so keys with
+// spaces, '#', '?', '+' or non-ASCII characters produce valid URLs
+func escapeStoragePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// storageObjectURL builds a Storage API URL such as
+// {SUPABASE_URL}/storage/v1/{endpoint}/{bucket}/{path}, escaping the object path.
+// endpoint is "object" for authenticated access or "object/public" for public URLs.
+func storageObjectURL(supabaseURL, endpoint, bucket, objectPath string) string {
+	return fmt.Sprintf("%s/storage/v1/%s/%s/%s", strings.TrimSuffix(supabaseURL, "/"), endpoint, bucket, escapeStoragePath(objectPath))
+}
+
+// resourceKey returns the storage key (relative to basePath) for a publication href:
+// percent-decoded, NFC-normalized, and without a leading slash. Decoding first makes
+// the key independent of whether the href was already escaped, and NFC stops the
+// same name authored in decomposed form (common from macOS tools) from producing a
+// different key than the links that refer to it.
+func resourceKey(href string) string {
+	if decoded, err := url.PathUnescape(href); err == nil {
+		href = decoded
+	}
+	return norm.NFC.String(strings.TrimPrefix(href, "/"))
+}
+
+// manifestHref returns the href to use in generated manifests and documents for a
+// publication href: the percent-encoded resource key, with any query or fragment kept.
+// External hrefs (an externally hosted video, say) are kept as they are.
+func manifestHref(href string) string {
+	if isExternalHref(href) {
+		return href
+	}
+	suffix := ""
+	if idx := strings.IndexAny(href, "?#"); idx >= 0 {
+		href, suffix = href[:idx], href[idx:]
+	}
+	if href == "" {
+		return suffix
+	}
+	return escapeStoragePath(resourceKey(href)) + suffix
+}
@@ -0,0 +1,176 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestBasePathForFilename(t *testing.T) {
+	tests := []struct {
+		filename, layout, want string
+	}{
+		{"books/abc/book.epub", layoutFlat, "books_abc_book"},
+		{"a/b.epub", layoutFlat, "a_b"},
+		{"a_b.epub", layoutFlat, "a_b"}, // the collision the preserve layout avoids
+		{"books/abc/book.epub", layoutPreserve, "books/abc/book.epub"},
+		{"a/b.epub", layoutPreserve, "a/b.epub"},
+		{"a_b.epub", layoutPreserve, "a_b.epub"},
+		{"a\\b\\c.epub", layoutPreserve, "a/b/c.epub"},
+		{"a//./b.epub", layoutPreserve, "a/b.epub"},
+	}
+	for _, tt := range tests {
+		if got := BasePath(tt.filename, tt.layout); got != tt.want {
+			t.Errorf("BasePath(%q, %q) = %q, want %q", tt.filename, tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestStorageObjectURL_EscapesSegments(t *testing.T) {
+	got := storageObjectURL("https://x.supabase.co/", "object/public", ManifestBucket, "book/Text/chapter 1#a+b é.xhtml")
+	want := "https://x.supabase.co/storage/v1/object/public/readium-manifests/book/Text/chapter%201%23a+b%20%C3%A9.xhtml"
+	if got != want {
+		t.Errorf("storageObjectURL() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveStorageLayout(t *testing.T) {
+	t.Setenv(storageLayoutEnvVar, "")
+	if layout, _ := resolveStorageLayout(""); layout != layoutFlat {
+		t.Errorf("Expected default layout %q, got %q", layoutFlat, layout)
+	}
+
+	t.Setenv(storageLayoutEnvVar, layoutPreserve)
+	if layout, _ := resolveStorageLayout(""); layout != layoutPreserve {
+		t.Errorf("Expected layout from env %q, got %q", layoutPreserve, layout)
+	}
+	if layout, _ := resolveStorageLayout(layoutFlat); layout != layoutFlat {
+		t.Errorf("Expected requested layout to override env, got %q", layout)
+	}
+
+	if layout, _ := resolveStorageLayout(layoutIdentifier); layout != layoutIdentifier {
+		t.Errorf("Expected layout %q, got %q", layoutIdentifier, layout)
+	}
+
+	if _, err := resolveStorageLayout("nested"); err == nil {
+		t.Errorf("Expected error for unknown layout")
+	}
+}
+
+func TestAssignIdentifier(t *testing.T) {
+	metadata := &manifest.Metadata{Identifier: "urn:isbn:9780316129084"}
+	if generated := assignIdentifier(metadata, "abc"); generated != "" || metadata.Identifier != "urn:isbn:9780316129084" {
+		t.Errorf("Expected the identifier kept, got %q", metadata.Identifier)
+	}
+
+	first, second := &manifest.Metadata{}, &manifest.Metadata{}
+	generated := assignIdentifier(first, "abc")
+	if !strings.HasPrefix(generated, "urn:uuid:") || first.Identifier != generated {
+		t.Errorf("Expected a urn:uuid: identifier, got %q", generated)
+	}
+	if again := assignIdentifier(second, "abc"); again != generated {
+		t.Errorf("Expected the same identifier for the same EPUB, got %q and %q", generated, again)
+	}
+	if other := assignIdentifier(&manifest.Metadata{}, "def"); other == generated {
+		t.Error("Expected another identifier for another EPUB")
+	}
+}
+
+// processTestLPF stores an audiobook whose publication manifest is
+// publicationJSON as filename, and processes it
+func processTestLPF(t *testing.T, supabase *processortest.Supabase, p *Processor, filename, publicationJSON string, options Options) *Result {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		lpfManifestPath:       publicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+	} {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	supabase.Put(EPUBBucket, filename, buf.Bytes())
+	source, err := p.Fetch(filename, 0)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer source.Close()
+	result, err := p.Process(source, filename, options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	return result
+}
+
+func TestProcess_IdentifierLayout(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+	options := Options{Layout: layoutIdentifier}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	first := processTestLPF(t, supabase, p, "uploads/leviathan.lpf", testPublicationJSON, options)
+	if first.BasePath != "urn:isbn:9780316129084" || first.GeneratedID != "" {
+		t.Errorf("Expected the publication under its identifier, got %q (generated %q)", first.BasePath, first.GeneratedID)
+	}
+	// A re-upload under another filename updates the same tree
+	again := processTestLPF(t, supabase, p, "uploads/leviathan (1).lpf", testPublicationJSON, options)
+	if again.BasePath != first.BasePath || again.Uploaded != 0 {
+		t.Errorf("Expected the re-upload to reuse %s, got %s with %d uploads", first.BasePath, again.BasePath, again.Uploaded)
+	}
+
+	anonymous := processTestLPF(t, supabase, p, "uploads/anonymous.lpf", strings.Replace(testPublicationJSON, `"id": "urn:isbn:9780316129084",`, "", 1), options)
+	if !strings.HasPrefix(anonymous.GeneratedID, "urn:uuid:") || anonymous.BasePath != anonymous.GeneratedID {
+		t.Errorf("Expected a generated identifier as basePath, got %q (generated %q)", anonymous.BasePath, anonymous.GeneratedID)
+	}
+	if manifestJSON, ok := supabase.Object(ManifestBucket, anonymous.BasePath+"/manifest.json"); !ok || !strings.Contains(string(manifestJSON), anonymous.GeneratedID) {
+		t.Errorf("Expected the generated identifier in the manifest, got %s", manifestJSON)
+	}
+}
+
+func TestProcess_FlatLayoutCollision(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+	options := Options{Layout: layoutFlat}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	first := processTestLPF(t, supabase, p, "a/b.lpf", testPublicationJSON, options)
+	if first.BasePath != "a_b" || strings.Contains(strings.Join(first.Warnings, "\n"), "flattens") {
+		t.Fatalf("Expected a/b.lpf under a_b, got %q (%v)", first.BasePath, first.Warnings)
+	}
+	manifestJSON, _ := supabase.Object(ManifestBucket, "a_b/manifest.json")
+
+	other := strings.Replace(testPublicationJSON, "Leviathan Wakes", "Caliban's War", 1)
+	second := processTestLPF(t, supabase, p, "a_b.lpf", other, options)
+	if !strings.HasPrefix(second.BasePath, "a_b-") || len(second.BasePath) != len("a_b-")+8 {
+		t.Errorf("Expected a_b.lpf under a_b and a hash, got %q", second.BasePath)
+	}
+	if warnings := strings.Join(second.Warnings, "\n"); !strings.Contains(warnings, "a_b.lpf flattens to a_b, which holds the publication of a/b.lpf") {
+		t.Errorf("Expected a warning about the collision, got %v", second.Warnings)
+	}
+	if stored, _ := supabase.Object(ManifestBucket, "a_b/manifest.json"); string(stored) != string(manifestJSON) {
+		t.Error("Expected the publication of a/b.lpf left alone")
+	}
+
+	// Both keep their prefix when processed again
+	if again := processTestLPF(t, supabase, p, "a_b.lpf", other, options); again.BasePath != second.BasePath || again.Uploaded != 0 {
+		t.Errorf("Expected a_b.lpf to keep %s, got %s with %d uploads", second.BasePath, again.BasePath, again.Uploaded)
+	}
+	if again := processTestLPF(t, supabase, p, "a/b.lpf", testPublicationJSON, options); again.BasePath != "a_b" {
+		t.Errorf("Expected a/b.lpf to keep a_b, got %s", again.BasePath)
+	}
+}
@@ -0,0 +1,234 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	lcpServerURLEnvVar      = "LCP_SERVER_URL"
+	lcpServerUsernameEnvVar = "LCP_SERVER_USERNAME"
+	lcpServerPasswordEnvVar = "LCP_SERVER_PASSWORD"
+	lcpLicenseURLEnvVar     = "LCP_LICENSE_URL"
+	lcpProfileEnvVar        = "LCP_PROFILE"
+
+	lcpScheme       = "http://readium.org/2014/11/lcp"
+	lcpBasicProfile = "http://readium.org/lcp/basic-profile"
+	lcpAlgorithm    = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	lcpLicenseType  = "application/vnd.readium.lcp.license.v1.0+json"
+
+	// lcpContentIDPlaceholder is replaced with the content ID in LCP_LICENSE_URL
+	lcpContentIDPlaceholder = "{content_id}"
+
+	lcpTimeout = 30 * time.Second
+)
+
+// lcpServer is the LCP License Server the content keys of protected
+// publications are registered with, so it can issue licenses for them
+type lcpServer struct {
+	client     *http.Client
+	baseURL    string
+	username   string
+	password   string
+	licenseURL string
+	profile    string
+}
+
+// lcpServerFromEnv returns the License Server configured by LCP_SERVER_URL, or
+// nil when LCP is not set up. LCP_LICENSE_URL is where readers get a license
+// for a publication, with {content_id} standing for its content ID.
+func lcpServerFromEnv() (*lcpServer, error) {
+	baseURL := strings.TrimSuffix(os.Getenv(lcpServerURLEnvVar), "/")
+	if baseURL == "" {
+		return nil, nil
+	}
+	licenseURL := os.Getenv(lcpLicenseURLEnvVar)
+	if !strings.Contains(licenseURL, lcpContentIDPlaceholder) {
+		return nil, fmt.Errorf("%s must be set to a URL containing %s", lcpLicenseURLEnvVar, lcpContentIDPlaceholder)
+	}
+	profile := os.Getenv(lcpProfileEnvVar)
+	if profile == "" {
+		profile = lcpBasicProfile
+	}
+	return &lcpServer{
+		client:     NewHTTPClient(lcpTimeout),
+		baseURL:    baseURL,
+		username:   os.Getenv(lcpServerUsernameEnvVar),
+		password:   os.Getenv(lcpServerPasswordEnvVar),
+		licenseURL: licenseURL,
+		profile:    profile,
+	}, nil
+}
+
+// lcpContent is the body of the License Server's content registration
+type lcpContent struct {
+	ContentID string `json:"content-id"`
+	// ContentKey is encoded as base64, like every []byte
+	ContentKey  []byte `json:"content-encryption-key"`
+	Location    string `json:"protected-content-location"`
+	Length      int64  `json:"protected-content-length"`
+	SHA256      string `json:"protected-content-sha256"`
+	Disposition string `json:"protected-content-disposition"`
+	Type        string `json:"protected-content-type"`
+}
+
+// register stores the content key of a protected publication under contentID,
+// replacing the key of a previous run
+func (s *lcpServer) register(content lcpContent) error {
+	body, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/contents/%s", s.baseURL, url.PathEscape(content.ContentID)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to register content key: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to register content key: license server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// licenseLink is the manifest link to the license of contentID
+func (s *lcpServer) licenseLink(contentID string) map[string]interface{} {
+	return map[string]interface{}{
+		"href": strings.ReplaceAll(s.licenseURL, lcpContentIDPlaceholder, url.PathEscape(contentID)),
+		"type": lcpLicenseType,
+		"rel":  "license",
+	}
+}
+
+// lcpEncrypter encrypts the resources of one protected publication with its
+// content key. The manifest and the files under readium/ stay readable, since
+// readers need them before they have a license.
+type lcpEncrypter struct {
+	basePath string
+	key      []byte
+	profile  string
+	// originalLengths maps each encrypted storage path to its plaintext length
+	originalLengths map[string]int
+}
+
+// newLCPEncrypter generates a fresh content key for the publication at basePath.
+// Every run uses a new key, so licenses issued before a reprocessing have to be
+// fetched again.
+func newLCPEncrypter(basePath, profile string) (*lcpEncrypter, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate content key: %w", err)
+	}
+	return &lcpEncrypter{basePath: basePath, key: key, profile: profile, originalLengths: map[string]int{}}, nil
+}
+
+// accepts reports whether the file stored at path is encrypted
+func (e *lcpEncrypter) accepts(path string) bool {
+	if e == nil || !strings.HasPrefix(path, e.basePath+"/") {
+		return false
+	}
+	name := strings.TrimPrefix(path, e.basePath+"/")
+	return name != "manifest.json" && name != bookJSONLDPath && name != accessibilityReportPath && name != tocPath && name != guidedNavigationPath && !strings.HasPrefix(name, "readium/")
+}
+
+// encrypt encrypts the resource stored at path with AES-256-CBC: a random IV
+// followed by the PKCS#7-padded ciphertext, as LCP requires
+func (e *lcpEncrypter) encrypt(path string, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, aes.BlockSize+len(data)+padding)
+	iv := out[:aes.BlockSize]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %w", err)
+	}
+	plaintext := out[aes.BlockSize:]
+	copy(plaintext, data)
+	for i := len(data); i < len(plaintext); i++ {
+		plaintext[i] = byte(padding)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(plaintext, plaintext)
+	e.originalLengths[path] = len(data)
+	return out, nil
+}
+
+// encryptedProperty returns the value of the encrypted link property for the
+// file stored at path, or nil if it was not encrypted
+func (e *lcpEncrypter) encryptedProperty(path string) map[string]interface{} {
+	if e == nil {
+		return nil
+	}
+	length, ok := e.originalLengths[path]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{
+		"scheme":         lcpScheme,
+		"profile":        e.profile,
+		"algorithm":      lcpAlgorithm,
+		"compression":    "none",
+		"originalLength": length,
+	}
+}
+
+// lcpProtection returns the License Server and the encrypter for the
+// publication at basePath when options.Protected is set, and nils otherwise.
+// The content ID of the publication is its basePath.
+func lcpProtection(options Options, basePath string) (*lcpServer, *lcpEncrypter, error) {
+	if !options.Protected {
+		return nil, nil, nil
+	}
+	server, err := lcpServerFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if server == nil {
+		return nil, nil, &statusError{status: 400, err: fmt.Errorf("protected mode requires %s", lcpServerURLEnvVar)}
+	}
+	encrypter, err := newLCPEncrypter(basePath, server.profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, encrypter, nil
+}
+
+// registerLCPContent registers the content key of a protected publication,
+// pointing the License Server at its manifest
+func registerLCPContent(server *lcpServer, encrypter *lcpEncrypter, contentID, manifestURL, manifestType string, manifestJSON []byte) error {
+	sum := sha256.Sum256(manifestJSON)
+	err := server.register(lcpContent{
+		ContentID:   contentID,
+		ContentKey:  encrypter.key,
+		Location:    manifestURL,
+		Length:      int64(len(manifestJSON)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Disposition: "manifest.json",
+		Type:        manifestType,
+	})
+	if err != nil {
+		return &statusError{status: 502, err: err}
+	}
+	return nil
+}
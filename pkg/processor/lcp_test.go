@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestProcess_Protected(t *testing.T) {
+	var registered lcpContent
+	var registeredPath, username string
+	lcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registeredPath = r.URL.Path
+		username, _, _ = r.BasicAuth()
+		json.NewDecoder(r.Body).Decode(&registered)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer lcp.Close()
+
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+	entries := map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	}
+
+	options := Options{Protected: true}
+	if _, err := p.Process(spoolTestArchive(t, entries), "leviathan.lpf", options); err == nil || StatusCode(err) != 400 {
+		t.Errorf("Expected 400 without a License Server, got %v", err)
+	}
+
+	t.Setenv(lcpServerURLEnvVar, lcp.URL)
+	t.Setenv(lcpServerUsernameEnvVar, "processor")
+	t.Setenv(lcpLicenseURLEnvVar, "https://lcp.example.com/licenses?content={content_id}")
+	if _, err := p.Process(spoolTestArchive(t, entries), "leviathan.lpf", options); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	if registeredPath != "/contents/leviathan" || username != "processor" || len(registered.ContentKey) != 32 {
+		t.Fatalf("Expected the content key to be registered, got %s %+v", registeredPath, registered)
+	}
+	ciphertext, _ := supabase.Object(ManifestBucket, "leviathan/audio/chapter2.mp3")
+	if len(ciphertext) != 2*aes.BlockSize {
+		t.Fatalf("Expected an IV and one block, got %d bytes", len(ciphertext))
+	}
+	block, _ := aes.NewCipher(registered.ContentKey)
+	plaintext := make([]byte, aes.BlockSize)
+	cipher.NewCBCDecrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(plaintext, ciphertext[aes.BlockSize:])
+	if string(plaintext[:3]) != "two" || plaintext[aes.BlockSize-1] != aes.BlockSize-3 {
+		t.Errorf("Expected the padded chapter, got %q", plaintext)
+	}
+
+	manifestJSON, _ := supabase.Object(ManifestBucket, "leviathan/manifest.json")
+	var manifest struct {
+		Links []struct {
+			Href string `json:"href"`
+			Rel  string `json:"rel"`
+		} `json:"links"`
+		ReadingOrder []struct {
+			Properties struct {
+				Encrypted map[string]interface{} `json:"encrypted"`
+			} `json:"properties"`
+		} `json:"readingOrder"`
+	}
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	encrypted := manifest.ReadingOrder[1].Properties.Encrypted
+	if encrypted["scheme"] != lcpScheme || encrypted["algorithm"] != lcpAlgorithm || encrypted["originalLength"] != 3.0 {
+		t.Errorf("Expected LCP encryption properties, got %v", encrypted)
+	}
+	license := false
+	for _, link := range manifest.Links {
+		license = license || (link.Rel == "license" && link.Href == "https://lcp.example.com/licenses?content=leviathan")
+	}
+	if !license {
+		t.Errorf("Expected a license link, got %+v", manifest.Links)
+	}
+
+	lcp.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database is down", http.StatusInternalServerError)
+	})
+	if _, err := p.Process(spoolTestArchive(t, entries), "leviathan.lpf", options); err == nil || StatusCode(err) != 502 || !strings.Contains(err.Error(), "database is down") {
+		t.Errorf("Expected a failed registration to fail the run with 502, got %v", err)
+	}
+}
+
+func TestOptionsResolve_Protected(t *testing.T) {
+	for _, options := range []Options{
+		{Protected: true, ExtractText: true},
+		{Protected: true, Repackage: true},
+		{Protected: true, Package: packageWebPub},
+		{Protected: true, Diff: true},
+	} {
+		if err := options.Resolve(); err == nil {
+			t.Errorf("Expected %+v to be rejected", options)
+		}
+	}
+}
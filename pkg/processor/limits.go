@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Environment variables overriding the archive limits
+const (
+	maxUncompressedBytesEnvVar = "MAX_UNCOMPRESSED_BYTES"
+	maxEntryBytesEnvVar        = "MAX_ENTRY_BYTES"
+	maxEntriesEnvVar           = "MAX_ZIP_ENTRIES"
+	maxCompressionRatioEnvVar  = "MAX_COMPRESSION_RATIO"
+	maxEPUBBytesEnvVar         = "MAX_EPUB_BYTES"
+)
+
+// defaultMaxEPUBBytes is the largest EPUB downloaded when MAX_EPUB_BYTES is unset.
+// EPUBs are spooled to /tmp, which Lambda sizes up to 10 GB, so ZIP64 packages
+// past 4 GB fit with room for the temporary files of the job.
+const defaultMaxEPUBBytes = 8 << 30 // 8 GiB
+
+// archiveLimits bounds what we are willing to extract from an uploaded EPUB
+type archiveLimits struct {
+	MaxUncompressedBytes uint64  // total uncompressed size of all entries
+	MaxEntryBytes        uint64  // uncompressed size of any single entry
+	MaxEntries           int     // number of entries in the central directory
+	MaxCompressionRatio  float64 // uncompressed/compressed ratio of any single entry
+}
+
+// defaultArchiveLimits are generous for real books, audiobooks included, but stop
+// decompression bombs. Entries are extracted one at a time, so the total is
+// bounded by the time it takes rather than by memory; a single entry is held in
+// memory, but one too large for the function is turned away by its memoryBudget.
+var defaultArchiveLimits = archiveLimits{
+	MaxUncompressedBytes: 32 << 30, // 32 GiB
+	MaxEntryBytes:        4 << 30,  // 4 GiB
+	MaxEntries:           20000,
+	MaxCompressionRatio:  200,
+}
+
+// minRatioCheckBytes skips the compression ratio check for small entries, since
+// tiny highly-repetitive files (blank XHTML, CSS) legitimately compress very well
+const minRatioCheckBytes = 1 << 20
+
+// archiveLimitsFromEnv returns the default limits overridden by any configured env vars
+func archiveLimitsFromEnv() archiveLimits {
+	limits := defaultArchiveLimits
+	if v, ok := envUint(maxUncompressedBytesEnvVar); ok {
+		limits.MaxUncompressedBytes = v
+	}
+	if v, ok := envUint(maxEntryBytesEnvVar); ok {
+		limits.MaxEntryBytes = v
+	}
+	if v, ok := envUint(maxEntriesEnvVar); ok {
+		limits.MaxEntries = int(v)
+	}
+	if v := os.Getenv(maxCompressionRatioEnvVar); v != "" {
+		if ratio, err := strconv.ParseFloat(v, 64); err == nil && ratio > 0 {
+			limits.MaxCompressionRatio = ratio
+		} else {
+			log.Printf("Warning: ignoring invalid %s=%q", maxCompressionRatioEnvVar, v)
+		}
+	}
+	return limits
+}
+
+// checkArchiveLimits validates the central directory of an archive against limits
+// before anything is decompressed. The sizes come from the archive headers, but
+// archive/zip refuses to return more data than an entry's declared size, so a
+// lying header cannot be used to get past these checks.
+func checkArchiveLimits(zipReader *zip.Reader, limits archiveLimits) error {
+	if limits.MaxEntries > 0 && len(zipReader.File) > limits.MaxEntries {
+		return &statusError{
+			status: 413,
+			err:    fmt.Errorf("archive has %d entries, more than the limit of %d", len(zipReader.File), limits.MaxEntries),
+		}
+	}
+
+	var total uint64
+	for _, f := range zipReader.File {
+		size := f.UncompressedSize64
+		if limits.MaxEntryBytes > 0 && size > limits.MaxEntryBytes {
+			return &statusError{
+				status: 413,
+				err:    fmt.Errorf("archive entry %s is %d bytes uncompressed, more than the limit of %d", f.Name, size, limits.MaxEntryBytes),
+			}
+		}
+
+		total += size
+		if limits.MaxUncompressedBytes > 0 && total > limits.MaxUncompressedBytes {
+			return &statusError{
+				status: 413,
+				err:    fmt.Errorf("archive is more than %d bytes uncompressed", limits.MaxUncompressedBytes),
+			}
+		}
+
+		if limits.MaxCompressionRatio > 0 && size >= minRatioCheckBytes {
+			compressed := f.CompressedSize64
+			if compressed == 0 || float64(size)/float64(compressed) > limits.MaxCompressionRatio {
+				return &statusError{
+					status: 422,
+					err:    fmt.Errorf("archive entry %s has a suspicious compression ratio (%d bytes from %d compressed)", f.Name, size, compressed),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// MaxEPUBBytesFromEnv returns the maximum EPUB download size; 0 disables the limit
+func MaxEPUBBytesFromEnv() int64 {
+	if v, ok := envUint(maxEPUBBytesEnvVar); ok {
+		return int64(v)
+	}
+	return defaultMaxEPUBBytes
+}
+
+// envUint reads a non-negative integer from an environment variable
+func envUint(name string) (uint64, bool) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		log.Printf("Warning: ignoring invalid %s=%q", name, v)
+		return 0, false
+	}
+	return n, true
+}
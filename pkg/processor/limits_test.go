@@ -0,0 +1,122 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// buildZip creates an in-memory archive with the given entries
+func buildZip(t *testing.T, entries map[string][]byte) *zip.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, data := range entries {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+		f.Write(data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close zip: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	return r
+}
+
+func TestCheckArchiveLimits(t *testing.T) {
+	bomb := make([]byte, 4<<20) // 4 MiB of zeros compresses ~1000:1
+
+	tests := []struct {
+		name       string
+		entries    map[string][]byte
+		limits     archiveLimits
+		wantStatus int
+	}{
+		{
+			name:    "within limits",
+			entries: map[string][]byte{"mimetype": []byte("application/epub+zip"), "a.xhtml": []byte("<html/>")},
+			limits:  defaultArchiveLimits,
+		},
+		{
+			name:       "too many entries",
+			entries:    map[string][]byte{"a": nil, "b": nil, "c": nil},
+			limits:     archiveLimits{MaxEntries: 2},
+			wantStatus: 413,
+		},
+		{
+			name:       "entry too large",
+			entries:    map[string][]byte{"big": make([]byte, 2048)},
+			limits:     archiveLimits{MaxEntryBytes: 1024},
+			wantStatus: 413,
+		},
+		{
+			name:       "total too large",
+			entries:    map[string][]byte{"a": make([]byte, 600), "b": make([]byte, 600)},
+			limits:     archiveLimits{MaxUncompressedBytes: 1000},
+			wantStatus: 413,
+		},
+		{
+			name:       "compression ratio",
+			entries:    map[string][]byte{"bomb": bomb},
+			limits:     archiveLimits{MaxCompressionRatio: 100},
+			wantStatus: 422,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkArchiveLimits(buildZip(t, tt.entries), tt.limits)
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected status %d, got no error", tt.wantStatus)
+			}
+			if got := StatusCode(err); got != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d (%v)", tt.wantStatus, got, err)
+			}
+		})
+	}
+}
+
+func TestDownloadEPUBFromSupabase_RejectsOversizedFiles(t *testing.T) {
+	epub := append([]byte("PK\x03\x04"), make([]byte, 2048)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(epub)))
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write(epub)
+	}))
+	defer server.Close()
+
+	_, err := downloadEPUBFromSupabase(&http.Client{}, server.URL, "test-key", "", 1024)
+	if err == nil {
+		t.Fatal("Expected oversized EPUB to be rejected")
+	}
+	if got := StatusCode(err); got != 413 {
+		t.Errorf("Expected status 413, got %d (%v)", got, err)
+	}
+
+	source, err := downloadEPUBFromSupabase(&http.Client{}, server.URL, "test-key", "", 4096)
+	if err != nil {
+		t.Fatalf("Expected EPUB within limit to download, got %v", err)
+	}
+	defer source.Close()
+	if source.size != int64(len(epub)) {
+		t.Errorf("Expected %d bytes, got %d", len(epub), source.size)
+	}
+}
@@ -0,0 +1,84 @@
+package processor
+
+import (
+	"archive/zip"
+	"log"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// LinkReport lists references that don't resolve to an entry in the EPUB archive
+type LinkReport struct {
+	MissingResources []missingResource `json:"missing_resources"`
+	BrokenLinks      []brokenLink      `json:"broken_links"`
+}
+
+// missingResource is a reading order, TOC or manifest link with no archive entry
+type missingResource struct {
+	Href           string `json:"href"`
+	ReferencedFrom string `json:"referenced_from"`
+}
+
+// brokenLink is a link or embed in a content document with no archive entry
+type brokenLink struct {
+	Document string `json:"document"`
+	Href     string `json:"href"`
+	Target   string `json:"target"`
+}
+
+// linkChecker verifies hrefs against the entries of the EPUB archive during extraction
+type linkChecker struct {
+	entries map[string]bool
+	seen    map[string]bool
+	report  LinkReport
+}
+
+func newLinkChecker(zipReader *zip.Reader) *linkChecker {
+	entries := make(map[string]bool, len(zipReader.File))
+	for _, f := range zipReader.File {
+		entries[f.Name] = true
+	}
+	return &linkChecker{
+		entries: entries,
+		seen:    map[string]bool{},
+		report:  LinkReport{MissingResources: []missingResource{}, BrokenLinks: []brokenLink{}},
+	}
+}
+
+// exists reports whether a publication href resolves to an archive entry.
+// External hrefs are assumed to exist.
+func (c *linkChecker) exists(href string) bool {
+	target := resolveArchiveHref(href, "")
+	return target == "" || c.entries[target]
+}
+
+// checkLinks records every link (and nested child link) that has no archive entry
+func (c *linkChecker) checkLinks(referencedFrom string, links manifest.LinkList) {
+	for _, link := range links {
+		href := link.Href.String()
+		key := referencedFrom + "|" + href
+		if !c.exists(href) && !c.seen[key] {
+			c.seen[key] = true
+			log.Printf("Warning: %s entry %s refers to a missing resource", referencedFrom, href)
+			c.report.MissingResources = append(c.report.MissingResources, missingResource{Href: href, ReferencedFrom: referencedFrom})
+		}
+		c.checkLinks(referencedFrom, link.Children)
+	}
+}
+
+// checkDocument records links and embedded resources of a content document that
+// have no archive entry
+func (c *linkChecker) checkDocument(docHref string, content []byte) {
+	docPath := resolveArchiveHref(docHref, "")
+	// Refs before any well-formedness error are still checked; the validator reports the error itself
+	refs, _ := collectDocumentRefs(content)
+	for _, ref := range refs {
+		target := resolveArchiveHref(ref, docPath)
+		key := docPath + "|" + ref
+		if target == "" || c.entries[target] || c.seen[key] {
+			continue
+		}
+		c.seen[key] = true
+		c.report.BrokenLinks = append(c.report.BrokenLinks, brokenLink{Document: docPath, Href: ref, Target: target})
+	}
+}
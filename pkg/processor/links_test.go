@@ -0,0 +1,44 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/util/url"
+)
+
+func testLink(t *testing.T, href string, children ...manifest.Link) manifest.Link {
+	t.Helper()
+	u, err := url.URLFromString(href)
+	if err != nil {
+		t.Fatalf("URLFromString(%q): %v", href, err)
+	}
+	return manifest.Link{Href: manifest.NewHREF(u), Children: children}
+}
+
+func TestLinkChecker(t *testing.T) {
+	checker := newLinkChecker(buildEPUB(t, map[string]string{
+		"OEBPS/ch1.xhtml":       "",
+		"OEBPS/images/logo.png": "",
+	}))
+
+	checker.checkLinks("toc", manifest.LinkList{
+		testLink(t, "OEBPS/ch1.xhtml#intro", testLink(t, "OEBPS/ch2.xhtml")),
+	})
+	checker.checkDocument("OEBPS/ch1.xhtml", []byte(`<html xmlns="http://www.w3.org/1999/xhtml"><body>
+  <img src="images/logo.png"/>
+  <img src="images/missing.png"/>
+  <a href="ch1.xhtml#intro">self</a>
+  <a href="http://example.com/">external</a>
+</body></html>`))
+
+	if len(checker.report.MissingResources) != 1 || checker.report.MissingResources[0].Href != "OEBPS/ch2.xhtml" {
+		t.Errorf("Expected nested TOC entry ch2.xhtml to be missing, got %+v", checker.report.MissingResources)
+	}
+	if len(checker.report.BrokenLinks) != 1 || checker.report.BrokenLinks[0].Target != "OEBPS/images/missing.png" {
+		t.Errorf("Expected a single broken link to images/missing.png, got %+v", checker.report.BrokenLinks)
+	}
+	if !checker.exists("OEBPS/ch1.xhtml") || checker.exists("OEBPS/ch2.xhtml") {
+		t.Errorf("exists() does not match archive contents")
+	}
+}
@@ -0,0 +1,142 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/pub"
+)
+
+// LocatorsPath is where the locator templates are stored, relative to basePath
+const LocatorsPath = "readium/locators.json"
+
+// locatorsFile lets the annotation service map the locators it has stored,
+// which name chapters by their href in the EPUB, to the hrefs of the processed
+// publication. A locator for an anchor is the chapter href with the anchor ID
+// as fragment and its progression.
+type locatorsFile struct {
+	Version  int               `json:"version"`
+	Chapters []chapterLocators `json:"chapters"`
+}
+
+// chapterLocators is the locator template of one reading order item
+type chapterLocators struct {
+	// Href is the href of the chapter in the manifest, relative to it
+	Href string `json:"href"`
+	// Source is the href of the chapter in the EPUB
+	Source string `json:"source"`
+	// URL is where the chapter is stored
+	URL   string `json:"url,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title,omitempty"`
+	// Position is the first position of the chapter in positions.json
+	Position int             `json:"position"`
+	Anchors  []locatorAnchor `json:"anchors"`
+}
+
+// locatorAnchor is an element of a chapter that can be linked to
+type locatorAnchor struct {
+	ID string `json:"id"`
+	// Progression is where the element starts in the chapter, from 0 to 1
+	Progression float64 `json:"progression"`
+}
+
+// chapterAnchors returns the elements with an id in the body of a content
+// document, in document order, with their progression by byte offset. Only the
+// first element with a given id is kept, as that is the one fragments resolve to.
+func chapterAnchors(content []byte) []locatorAnchor {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	anchors := []locatorAnchor{}
+	seen := map[string]bool{}
+	inHead := false
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Warning: stopped reading anchors at offset %d: %v", offset, err)
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if strings.EqualFold(t.Name.Local, "head") {
+				inHead = true
+			}
+			if inHead {
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Name.Local != "id" || a.Value == "" || seen[a.Value] {
+					continue
+				}
+				seen[a.Value] = true
+				anchors = append(anchors, locatorAnchor{ID: a.Value, Progression: float64(offset) / float64(len(content))})
+			}
+		case xml.EndElement:
+			if strings.EqualFold(t.Name.Local, "head") {
+				inHead = false
+			}
+		}
+	}
+	return anchors
+}
+
+// generateLocatorsJSON builds the locator templates of the reading order.
+// Positions are counted the same way as in positions.json.
+func generateLocatorsJSON(publication *pub.Publication, m *manifest.Manifest, resourceMap map[string]string) ([]byte, error) {
+	ctx := context.Background()
+	file := locatorsFile{Version: 1, Chapters: []chapterLocators{}}
+	position := 1
+
+	for i := range m.ReadingOrder {
+		link := &m.ReadingOrder[i]
+		hrefStr := link.Href.String()
+
+		resource := publication.Get(ctx, *link)
+		if resource == nil {
+			continue
+		}
+		content, resErr := resource.Read(ctx, 0, 0)
+		resource.Close()
+		if resErr != nil {
+			log.Printf("Warning: failed to read resource %s for locators: %v", hrefStr, resErr)
+			continue
+		}
+
+		chapter := chapterLocators{
+			Href:     manifestHref(hrefStr),
+			Source:   hrefStr,
+			URL:      resourceMap[hrefStr],
+			Title:    link.Title,
+			Position: position,
+			Anchors:  []locatorAnchor{},
+		}
+		if link.MediaType != nil {
+			chapter.Type = link.MediaType.String()
+		}
+		if isHTMLResource(link) {
+			chapter.Anchors = chapterAnchors(content)
+		}
+		file.Chapters = append(file.Chapters, chapter)
+		position += positionCount(len(content))
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal locators: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,28 @@
+package processor
+
+import "testing"
+
+func TestChapterAnchors(t *testing.T) {
+	content := []byte(`<html><head><title id="t">Loomings</title></head>` +
+		`<body><h1 id="ch1">Loomings</h1><p>Call me Ishmael.</p><p id="p2">Some years ago</p><span id="p2">again</span><p id="">x</p></body></html>`)
+	anchors := chapterAnchors(content)
+	if len(anchors) != 2 || anchors[0].ID != "ch1" || anchors[1].ID != "p2" {
+		t.Fatalf("Expected the body anchors once each, got %+v", anchors)
+	}
+	if anchors[0].Progression <= 0 || anchors[0].Progression >= anchors[1].Progression || anchors[1].Progression >= 1 {
+		t.Errorf("Expected increasing progressions within the chapter, got %+v", anchors)
+	}
+
+	// Malformed markup keeps the anchors read so far
+	if anchors := chapterAnchors([]byte(`<body><p id="a">one</p><p id="b" <`)); len(anchors) == 0 || anchors[0].ID != "a" {
+		t.Errorf("Expected the anchors before the error, got %+v", anchors)
+	}
+}
+
+func TestPositionCount(t *testing.T) {
+	for charCount, want := range map[int]int{0: 1, 1: 1, 1024: 1, 1025: 2, 4096: 4} {
+		if got := positionCount(charCount); got != want {
+			t.Errorf("Expected %d positions for %d characters, got %d", want, charCount, got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// lockPath is where the processing lock object is stored, relative to basePath
+const lockPath = "readium/lock.json"
+
+// lockTTL is how long a lock is honoured before it is considered abandoned.
+// Lambda invocations cannot run longer than 15 minutes, so an older lock
+// belongs to an invocation that crashed before releasing it.
+const lockTTL = 15 * time.Minute
+
+// lockPollInterval is how often a waiting request re-checks the lock
+const lockPollInterval = 2 * time.Second
+
+// errLockHeld is returned when another job is already processing the same basePath
+var errLockHeld = errors.New("publication is already being processed")
+
+// ProcessingLock is the content of the lock object
+type ProcessingLock struct {
+	JobID      string    `json:"job_id"`
+	Filename   string    `json:"filename"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// LockHeldError carries the lock of the job currently holding basePath
+type LockHeldError struct {
+	Holder ProcessingLock
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("%v by job %s", errLockHeld, e.Holder.JobID)
+}
+
+func (e *LockHeldError) Unwrap() error {
+	return errLockHeld
+}
+
+// WithLock returns a copy of p whose jobs hold the processing lock of their
+// output path for jobID while they write it, waiting up to wait for another
+// job to release it. The lock is taken once the path is known, which under the
+// identifier layout and metadata path templates is only after parsing. A job
+// finding the lock held fails with a 409 wrapping a *LockHeldError.
+func (p *Processor) WithLock(jobID string, wait time.Duration) *Processor {
+	locking := *p
+	locking.lockJobID = jobID
+	locking.lockWait = wait
+	return &locking
+}
+
+// lockOutput takes the processing lock of basePath for the job set with
+// WithLock and returns its release, or locks nothing without WithLock
+func (p *Processor) lockOutput(basePath, filename string) (func(), error) {
+	if p.lockJobID == "" {
+		return func() {}, nil
+	}
+	if err := p.AcquireLock(basePath, p.lockJobID, filename, p.lockWait); err != nil {
+		var held *LockHeldError
+		if errors.As(err, &held) {
+			return nil, &statusError{status: 409, err: err}
+		}
+		return nil, err
+	}
+	return func() { p.ReleaseLock(basePath, p.lockJobID) }, nil
+}
+
+// AcquireLock creates the lock object for basePath. The create is
+// conditional (no upsert), so only one concurrent request can succeed. If the
+// lock is held and wait is non-zero, it polls until the lock is released or wait
+// elapses. Returns a *LockHeldError if the lock could not be acquired, and
+// other errors if the lock could not be read.
+func (p *Processor) AcquireLock(basePath, jobID, filename string, wait time.Duration) error {
+	path := fmt.Sprintf("%s/%s", basePath, lockPath)
+	deadline := time.Now().Add(wait)
+	readFailed := false
+
+	for {
+		lock := ProcessingLock{JobID: jobID, Filename: filename, AcquiredAt: time.Now().UTC()}
+		lockJSON, err := json.Marshal(lock)
+		if err != nil {
+			return fmt.Errorf("failed to marshal lock: %w", err)
+		}
+
+		created, err := p.uploader.Create(path, lockJSON)
+		if err != nil {
+			return fmt.Errorf("failed to create lock: %w", err)
+		}
+		if created {
+			log.Printf("Acquired processing lock %s for job %s", path, jobID)
+			return nil
+		}
+
+		// Someone else holds the lock - find out who, and whether it's stale
+		holder, err := p.readLock(path)
+		if err != nil {
+			// The lock may have been released between the create and the read,
+			// but not twice in a row
+			if readFailed {
+				return fmt.Errorf("failed to read lock %s: %w", path, err)
+			}
+			readFailed = true
+			continue
+		}
+		readFailed = false
+		if time.Since(holder.AcquiredAt) > lockTTL {
+			retry, err := p.removeStaleLock(basePath, jobID, holder)
+			if err != nil {
+				return err
+			}
+			if retry {
+				continue
+			}
+		}
+
+		if time.Now().Add(lockPollInterval).After(deadline) {
+			return &LockHeldError{Holder: *holder}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// takeoverPath is where the claim on the stale lock of a job is stored,
+// relative to basePath
+func takeoverPath(staleJobID string) string {
+	return fmt.Sprintf("readium/lock-takeover-%s.json", staleJobID)
+}
+
+// removeStaleLock deletes the stale lock of holder for jobID, and reports
+// whether the lock is worth trying again. The storage can't delete
+// conditionally, so the requests finding the lock stale race to create a claim
+// on it first, and only the winner deletes it, after checking that it is still
+// the stale one: a lock that changed hands since it was read is left alone.
+func (p *Processor) removeStaleLock(basePath, jobID string, holder *ProcessingLock) (bool, error) {
+	claimPath := fmt.Sprintf("%s/%s", basePath, takeoverPath(holder.JobID))
+	claimJSON, err := json.Marshal(ProcessingLock{JobID: jobID, AcquiredAt: time.Now().UTC()})
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal lock: %w", err)
+	}
+	claimed, err := p.uploader.Create(claimPath, claimJSON)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim stale lock: %w", err)
+	}
+	if !claimed {
+		// Another request is taking the lock over, unless it crashed doing so
+		if claim, err := p.readLock(claimPath); err == nil && time.Since(claim.AcquiredAt) > lockTTL {
+			log.Printf("Removing abandoned claim %s of job %s", claimPath, claim.JobID)
+			p.deleteLock(claimPath)
+		}
+		return false, nil
+	}
+	defer p.deleteLock(claimPath)
+
+	path := fmt.Sprintf("%s/%s", basePath, lockPath)
+	current, err := p.readLock(path)
+	if err != nil || current.JobID != holder.JobID || !current.AcquiredAt.Equal(holder.AcquiredAt) {
+		return true, nil
+	}
+	log.Printf("Removing stale lock %s held by job %s since %s", path, holder.JobID, holder.AcquiredAt)
+	if err := p.uploader.Delete(path); err != nil {
+		return false, fmt.Errorf("failed to remove stale lock: %w", err)
+	}
+	return true, nil
+}
+
+// ReleaseLock deletes the lock object for basePath if jobID still holds it.
+// A job that outlived its lock leaves alone the lock of the job that took over.
+func (p *Processor) ReleaseLock(basePath, jobID string) {
+	path := fmt.Sprintf("%s/%s", basePath, lockPath)
+	holder, err := p.readLock(path)
+	if err != nil {
+		log.Printf("Warning: failed to release lock %s: %v", path, err)
+		return
+	}
+	if holder.JobID != jobID {
+		log.Printf("Warning: lock %s was taken over by job %s, leaving it", path, holder.JobID)
+		return
+	}
+	p.deleteLock(path)
+}
+
+// readLock returns the lock stored at path
+func (p *Processor) readLock(path string) (*ProcessingLock, error) {
+	data, err := p.uploader.Download(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock ProcessingLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lock: %w", err)
+	}
+	return &lock, nil
+}
+
+// deleteLock deletes the lock or claim at path, logging failures
+func (p *Processor) deleteLock(path string) {
+	if err := p.uploader.Delete(path); err != nil {
+		log.Printf("Warning: failed to release lock %s: %v", path, err)
+	}
+}
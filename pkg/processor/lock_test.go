@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestProcessingLock_SecondRequestConflicts(t *testing.T) {
+	server := processortest.NewSupabase()
+	defer server.Close()
+	p := New(nil, NewSupabase(server.URL, processortest.ServiceKey))
+
+	if err := p.AcquireLock("book", "job-1", "book.epub", 0); err != nil {
+		t.Fatalf("First acquire failed: %v", err)
+	}
+
+	err := p.AcquireLock("book", "job-2", "book.epub", 0)
+	var held *LockHeldError
+	if !errors.As(err, &held) {
+		t.Fatalf("Expected LockHeldError, got %v", err)
+	}
+	if held.Holder.JobID != "job-1" {
+		t.Errorf("Expected lock holder job-1, got %s", held.Holder.JobID)
+	}
+
+	p.ReleaseLock("book", "job-1")
+	if err := p.AcquireLock("book", "job-2", "book.epub", 0); err != nil {
+		t.Errorf("Acquire after release failed: %v", err)
+	}
+}
+
+func TestProcessingLock_WaitsForRelease(t *testing.T) {
+	server := processortest.NewSupabase()
+	defer server.Close()
+	p := New(nil, NewSupabase(server.URL, processortest.ServiceKey))
+
+	if err := p.AcquireLock("book", "job-1", "book.epub", 0); err != nil {
+		t.Fatalf("First acquire failed: %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p.ReleaseLock("book", "job-1")
+	}()
+
+	if err := p.AcquireLock("book", "job-2", "book.epub", 10*time.Second); err != nil {
+		t.Errorf("Waiting acquire failed: %v", err)
+	}
+}
+
+func TestProcessingLock_TakesOverStaleLock(t *testing.T) {
+	server := processortest.NewSupabase()
+	defer server.Close()
+	p := New(nil, NewSupabase(server.URL, processortest.ServiceKey))
+
+	stale, _ := json.Marshal(ProcessingLock{JobID: "job-1", Filename: "book.epub", AcquiredAt: time.Now().Add(-2 * lockTTL).UTC()})
+	if _, err := p.uploader.Upload("book/"+lockPath, stale, "application/json"); err != nil {
+		t.Fatalf("Failed to store stale lock: %v", err)
+	}
+
+	if err := p.AcquireLock("book", "job-2", "book.epub", 0); err != nil {
+		t.Fatalf("Acquire over stale lock failed: %v", err)
+	}
+	holder, err := p.readLock("book/" + lockPath)
+	if err != nil {
+		t.Fatalf("Failed to read lock: %v", err)
+	}
+	if holder.JobID != "job-2" {
+		t.Errorf("Expected lock holder job-2, got %s", holder.JobID)
+	}
+}
+
+func TestProcessingLock_ReleaseLeavesOtherJobsLock(t *testing.T) {
+	server := processortest.NewSupabase()
+	defer server.Close()
+	p := New(nil, NewSupabase(server.URL, processortest.ServiceKey))
+
+	if err := p.AcquireLock("book", "job-2", "book.epub", 0); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// job-1 outlived its lock, which job-2 took over
+	p.ReleaseLock("book", "job-1")
+
+	err := p.AcquireLock("book", "job-3", "book.epub", 0)
+	var held *LockHeldError
+	if !errors.As(err, &held) || held.Holder.JobID != "job-2" {
+		t.Errorf("Expected lock still held by job-2, got %v", err)
+	}
+}
+
+func TestProcessingLock_ReadFailureIsNotHeld(t *testing.T) {
+	server := processortest.NewSupabase()
+	defer server.Close()
+	p := New(nil, NewSupabase(server.URL, processortest.ServiceKey))
+
+	if _, err := p.uploader.Upload("book/"+lockPath, []byte("not json"), "application/json"); err != nil {
+		t.Fatalf("Failed to store lock: %v", err)
+	}
+
+	err := p.AcquireLock("book", "job-2", "book.epub", 0)
+	var held *LockHeldError
+	if err == nil || errors.As(err, &held) {
+		t.Fatalf("Expected a read error, got %v", err)
+	}
+	if StatusCode(err) != 500 {
+		t.Errorf("Expected status 500, got %d", StatusCode(err))
+	}
+}
+
+func TestWithLock_HeldOutputConflicts(t *testing.T) {
+	server := processortest.NewSupabase()
+	defer server.Close()
+	p := New(nil, NewSupabase(server.URL, processortest.ServiceKey))
+
+	if err := p.AcquireLock("book", "job-1", "book.epub", 0); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	_, err := p.WithLock("job-2", 0).lockOutput("book", "book.epub")
+	var held *LockHeldError
+	if !errors.As(err, &held) {
+		t.Fatalf("Expected LockHeldError, got %v", err)
+	}
+	if StatusCode(err) != 409 {
+		t.Errorf("Expected status 409, got %d", StatusCode(err))
+	}
+}
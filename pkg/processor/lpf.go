@@ -0,0 +1,729 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+	"github.com/readium/go-toolkit/pkg/util/url"
+)
+
+// Entries of a W3C Lightweight Packaging Format (LPF) archive holding the
+// publication manifest, either on its own or embedded in the primary entry page
+const (
+	lpfManifestPath = "publication.json"
+	lpfIndexPath    = "index.html"
+)
+
+// embeddedManifestPattern finds a publication manifest embedded in an HTML page
+var embeddedManifestPattern = regexp.MustCompile(`(?is)<script[^>]+type\s*=\s*["']application/ld\+json["'][^>]*>(.*?)</script>`)
+
+// isoDurationPattern matches ISO 8601 durations such as "PT1H2M3.5S" or "P1DT2H"
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// isLPFArchive reports whether an archive is an LPF publication rather than an EPUB
+func isLPFArchive(zipReader *zip.Reader) bool {
+	entries := zipEntries(zipReader)
+	if _, ok := entries[containerPath]; ok {
+		return false
+	}
+	_, hasManifest := entries[lpfManifestPath]
+	_, hasIndex := entries[lpfIndexPath]
+	return hasManifest || hasIndex
+}
+
+// w3cManifest is the subset of a W3C publication manifest (audiobooks profile)
+// converted to a Readium manifest
+type w3cManifest struct {
+	Type               w3cStrings     `json:"type"`
+	ID                 string         `json:"id"`
+	Name               w3cLocalizable `json:"name"`
+	Author             w3cEntities    `json:"author"`
+	ReadBy             w3cEntities    `json:"readBy"`
+	Translator         w3cEntities    `json:"translator"`
+	Editor             w3cEntities    `json:"editor"`
+	Illustrator        w3cEntities    `json:"illustrator"`
+	Publisher          w3cEntities    `json:"publisher"`
+	InLanguage         w3cStrings     `json:"inLanguage"`
+	DatePublished      string         `json:"datePublished"`
+	DateModified       string         `json:"dateModified"`
+	Duration           string         `json:"duration"`
+	ReadingProgression string         `json:"readingProgression"`
+	ReadingOrder       []w3cLink      `json:"readingOrder"`
+	Resources          []w3cLink      `json:"resources"`
+	Links              []w3cLink      `json:"links"`
+}
+
+// w3cLink is a LinkedResource, which may also be written as a bare URL
+type w3cLink struct {
+	URL            string         `json:"url"`
+	EncodingFormat string         `json:"encodingFormat"`
+	Name           w3cLocalizable `json:"name"`
+	Rel            w3cStrings     `json:"rel"`
+	Duration       string         `json:"duration"`
+}
+
+func (l *w3cLink) UnmarshalJSON(data []byte) error {
+	var url string
+	if json.Unmarshal(data, &url) == nil {
+		*l = w3cLink{URL: url}
+		return nil
+	}
+	type plain w3cLink
+	return json.Unmarshal(data, (*plain)(l))
+}
+
+// w3cStrings is a string or a list of strings
+type w3cStrings []string
+
+func (s *w3cStrings) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*s = w3cStrings{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+// w3cLocalizable is a localizable string: a string, a {"value", "language"}
+// object, or a list of either
+type w3cLocalizable []struct {
+	Value    string `json:"value"`
+	Language string `json:"language"`
+}
+
+func (l *w3cLocalizable) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if json.Unmarshal(data, &items) != nil {
+		items = []json.RawMessage{data}
+	}
+	*l = nil
+	for _, item := range items {
+		var value string
+		if json.Unmarshal(item, &value) == nil {
+			*l = append(*l, struct {
+				Value    string `json:"value"`
+				Language string `json:"language"`
+			}{Value: value})
+			continue
+		}
+		var object struct {
+			Value    string `json:"value"`
+			Language string `json:"language"`
+		}
+		if err := json.Unmarshal(item, &object); err != nil {
+			return err
+		}
+		*l = append(*l, object)
+	}
+	return nil
+}
+
+// localizedString converts to a manifest localized string
+func (l w3cLocalizable) localizedString() manifest.LocalizedString {
+	translations := map[string]string{}
+	for _, item := range l {
+		if strings.TrimSpace(item.Value) == "" {
+			continue
+		}
+		language := item.Language
+		if language == "" {
+			language = manifest.UndefinedLanguage
+		}
+		translations[language] = strings.TrimSpace(item.Value)
+	}
+	return manifest.NewLocalizedStringFromStrings(translations)
+}
+
+// w3cEntities is a list of persons or organizations, each a name or an object
+// with a name
+type w3cEntities []manifest.Contributor
+
+func (e *w3cEntities) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if json.Unmarshal(data, &items) != nil {
+		items = []json.RawMessage{data}
+	}
+	*e = nil
+	for _, item := range items {
+		var name w3cLocalizable
+		var object struct {
+			Name w3cLocalizable `json:"name"`
+		}
+		if json.Unmarshal(item, &object) == nil && len(object.Name) > 0 {
+			name = object.Name
+		} else if err := json.Unmarshal(item, &name); err != nil {
+			return err
+		}
+		if localized := name.localizedString(); localized.String() != "" {
+			*e = append(*e, manifest.Contributor{LocalizedName: localized})
+		}
+	}
+	return nil
+}
+
+// readLPFManifest returns the publication manifest of an LPF archive and the
+// archive path hrefs in it are relative to
+func readLPFManifest(entries map[string]*zip.File) (*w3cManifest, string, error) {
+	var data []byte
+	manifestPath := lpfManifestPath
+	if f, ok := entries[lpfManifestPath]; ok {
+		content, err := readZipEntry(f)
+		if err != nil {
+			return nil, "", err
+		}
+		data = content
+	} else if f, ok := entries[lpfIndexPath]; ok {
+		content, err := readZipEntry(f)
+		if err != nil {
+			return nil, "", err
+		}
+		match := embeddedManifestPattern.FindSubmatch(content)
+		if match == nil {
+			return nil, "", fmt.Errorf("%s has no embedded publication manifest", lpfIndexPath)
+		}
+		data = match[1]
+		manifestPath = lpfIndexPath
+	} else {
+		return nil, "", fmt.Errorf("archive has neither %s nor %s", lpfManifestPath, lpfIndexPath)
+	}
+
+	var w3c w3cManifest
+	if err := json.Unmarshal(bytes.TrimSpace(data), &w3c); err != nil {
+		return nil, "", fmt.Errorf("failed to parse publication manifest: %w", err)
+	}
+	if len(w3c.ReadingOrder) == 0 {
+		return nil, "", fmt.Errorf("publication manifest has an empty reading order")
+	}
+	return &w3c, manifestPath, nil
+}
+
+// convertW3CManifest converts a W3C audiobook manifest into a Readium audiobook
+// manifest whose hrefs are archive paths (external URLs are kept as they are)
+func convertW3CManifest(w3c *w3cManifest, manifestPath string) (*manifest.Manifest, error) {
+	m := &manifest.Manifest{}
+	metadata := &m.Metadata
+	metadata.Identifier = w3c.ID
+	metadata.ConformsTo = manifest.Profiles{manifest.ProfileAudiobook}
+	metadata.LocalizedTitle = w3c.Name.localizedString()
+	metadata.Authors = manifest.Contributors(w3c.Author)
+	metadata.Narrators = manifest.Contributors(w3c.ReadBy)
+	metadata.Translators = manifest.Contributors(w3c.Translator)
+	metadata.Editors = manifest.Contributors(w3c.Editor)
+	metadata.Illustrators = manifest.Contributors(w3c.Illustrator)
+	metadata.Publishers = manifest.Contributors(w3c.Publisher)
+	metadata.Languages = manifest.Strings(w3c.InLanguage)
+	if published, ok := parseLooseDate(w3c.DatePublished); ok {
+		metadata.Published = &published
+	}
+	if modified, ok := parseLooseDate(w3c.DateModified); ok {
+		metadata.Modified = &modified
+	}
+	if duration, ok := parseISODuration(w3c.Duration); ok {
+		metadata.Duration = &duration
+	}
+	switch w3c.ReadingProgression {
+	case "ltr":
+		metadata.ReadingProgression = manifest.LTR
+	case "rtl":
+		metadata.ReadingProgression = manifest.RTL
+	}
+
+	convert := func(links []w3cLink) (manifest.LinkList, error) {
+		list := make(manifest.LinkList, 0, len(links))
+		for _, l := range links {
+			link, err := w3cToLink(l, manifestPath)
+			if err != nil {
+				return nil, err
+			}
+			if link != nil {
+				list = append(list, *link)
+			}
+		}
+		return list, nil
+	}
+	var err error
+	if m.ReadingOrder, err = convert(w3c.ReadingOrder); err != nil {
+		return nil, err
+	}
+	if m.Resources, err = convert(w3c.Resources); err != nil {
+		return nil, err
+	}
+	if m.Links, err = convert(w3c.Links); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// w3cToLink converts a LinkedResource, resolving its URL against the manifest.
+// Returns nil for a resource without URL.
+func w3cToLink(l w3cLink, manifestPath string) (*manifest.Link, error) {
+	href := strings.TrimSpace(l.URL)
+	if href == "" {
+		return nil, nil
+	}
+	if !isExternalHref(href) {
+		resolved := resolveArchiveHref(href, manifestPath)
+		if resolved == "" {
+			return nil, nil
+		}
+		href = resolved
+	}
+	u, err := url.URLFromString(href)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resource url %q: %w", l.URL, err)
+	}
+
+	title := l.Name.localizedString()
+	link := &manifest.Link{
+		Href:  manifest.NewHREF(u),
+		Title: title.String(),
+		Rels:  manifest.Strings(l.Rel),
+	}
+	mediaType := l.EncodingFormat
+	if mediaType == "" && !isExternalHref(href) {
+		mediaType = getContentType(href)
+	}
+	if mediaType != "" && mediaType != "application/octet-stream" {
+		if mt, err := mediatype.NewOfString(mediaType); err == nil {
+			link.MediaType = &mt
+		}
+	}
+	if duration, ok := parseISODuration(l.Duration); ok {
+		link.Duration = duration
+	}
+	return link, nil
+}
+
+// parseISODuration parses an ISO 8601 duration into seconds
+func parseISODuration(value string) (float64, bool) {
+	match := isoDurationPattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, false
+	}
+	seconds := 0.0
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(match[i+1], 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds += n * unit
+	}
+	return seconds, true
+}
+
+// readLPFTableOfContents builds the table of contents from the nav element of
+// the resource with the "contents" rel, if there is one in the archive
+func readLPFTableOfContents(m *manifest.Manifest, entries map[string]*zip.File) manifest.LinkList {
+	for _, link := range m.Resources {
+		if !hasRel(link, "contents") {
+			continue
+		}
+		docPath := resourceKey(link.Href.String())
+		f, ok := entries[docPath]
+		if !ok {
+			return nil
+		}
+		content, err := readZipEntry(f)
+		if err != nil {
+			log.Printf("Warning: failed to read table of contents: %v", err)
+			return nil
+		}
+		return parseNavTOC(content, docPath)
+	}
+	return nil
+}
+
+// parseNavTOC reads the nested lists of links of the first <nav> of an HTML
+// document (the doc-toc one if marked) into TOC links with archive path hrefs
+func parseNavTOC(content []byte, docPath string) manifest.LinkList {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	// stack holds the list being filled at each <ol>/<ul> depth
+	var stack []*manifest.LinkList
+	var root manifest.LinkList
+	var current *manifest.Link
+	var title strings.Builder
+	inNav, done := false, false
+
+	for !done {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "nav":
+				inNav = true
+			case "ol", "ul":
+				if !inNav {
+					continue
+				}
+				switch {
+				case len(stack) == 0:
+					stack = append(stack, &root)
+				default:
+					parent := *stack[len(stack)-1]
+					if len(parent) == 0 {
+						stack = append(stack, stack[len(stack)-1])
+					} else {
+						stack = append(stack, &parent[len(parent)-1].Children)
+					}
+				}
+			case "a":
+				if !inNav || len(stack) == 0 {
+					continue
+				}
+				href := ""
+				for _, a := range t.Attr {
+					if a.Name.Local == "href" {
+						href = a.Value
+					}
+				}
+				link, err := navLink(href, docPath)
+				if err != nil || link == nil {
+					continue
+				}
+				list := stack[len(stack)-1]
+				*list = append(*list, *link)
+				current = &(*list)[len(*list)-1]
+				title.Reset()
+			}
+		case xml.CharData:
+			if current != nil {
+				title.Write(t)
+			}
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "a":
+				if current != nil {
+					current.Title = strings.Join(strings.Fields(title.String()), " ")
+					current = nil
+				}
+			case "ol", "ul":
+				if len(stack) > 0 {
+					stack = stack[:len(stack)-1]
+				}
+			case "nav":
+				done = inNav && len(root) > 0
+				inNav = false
+			}
+		}
+	}
+	return root
+}
+
+// navLink converts a nav link to a TOC link whose href is an archive path,
+// keeping media fragments such as "#t=120"
+func navLink(href, docPath string) (*manifest.Link, error) {
+	base, fragment, _ := strings.Cut(strings.TrimSpace(href), "#")
+	resolved := docPath
+	if base != "" {
+		resolved = resolveArchiveHref(base, docPath)
+	}
+	if resolved == "" {
+		return nil, nil
+	}
+	if fragment != "" {
+		resolved += "#" + fragment
+	}
+	u, err := url.URLFromString(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest.Link{Href: manifest.NewHREF(u)}, nil
+}
+
+// processLPF converts an LPF audiobook into a Readium audiobook manifest,
+// uploading its audio tracks and other resources next to the manifest
+func (p *Processor) processLPF(zipReader *zip.Reader, filename string, source *Source, options Options, warnings []string, debug *debugRecorder) (*Result, error) {
+	debug.phase("parse")
+	entries := zipEntries(zipReader)
+	w3c, manifestPath, err := readLPFManifest(entries)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	m, err := convertW3CManifest(w3c, manifestPath)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	m.TableOfContents = readLPFTableOfContents(m, entries)
+	return p.rehostPackage(m, entries, filename, source, "application/audiobook+json", options, warnings, debug)
+}
+
+// rehostPackage uploads the resources of a packaged publication whose manifest
+// hrefs are archive paths, then a manifest of manifestType pointing to them
+func (p *Processor) rehostPackage(m *manifest.Manifest, entries map[string]*zip.File, filename string, source *Source, manifestType string, options Options, warnings []string, debug *debugRecorder) (*Result, error) {
+	debug.parsed(&m.Metadata)
+	debug.phase("resources")
+
+	signer, err := manifestSignerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var generatedIdentifier string
+	if options.Layout == layoutIdentifier {
+		generatedIdentifier = assignIdentifier(&m.Metadata, source.Hash())
+	}
+	basePath, collision, err := storageBasePath(p.uploader, filename, options, &m.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if collision != "" {
+		log.Printf("Warning: %s", collision)
+		warnings = append(warnings, collision)
+	}
+	debug.storagePaths(basePath)
+	release, err := p.lockOutput(basePath, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	progress := newProgressReporter(p.progress, p.progressInterval)
+	delta := newDeltaUploader(basePath, p.uploader, options.Force)
+	// A failed job still waits for the uploads it started
+	defer delta.wait()
+	delta.debug = debug
+	delta.sourceHash = source.Hash()
+	delta.sourceVersion = source.Version()
+	delta.sourceFilename = filename
+	lcp, encrypter, err := lcpProtection(options, basePath)
+	if err != nil {
+		return nil, err
+	}
+	delta.encrypter = encrypter
+	delta.progress = progress
+	filter, err := newResourceFilter(options.Include, options.Exclude)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	probes := newMediaProber()
+	failures := newResourceFailures(options.ResourceErrors)
+
+	progress.start(len(m.ReadingOrder) + len(m.Resources) + len(m.Links))
+	for _, list := range []manifest.LinkList{m.ReadingOrder, m.Resources, m.Links} {
+		for i := range list {
+			link := &list[i]
+			hrefStr := link.Href.String()
+			if isExternalHref(hrefStr) || !filter.allows(hrefStr) {
+				progress.advance()
+				continue
+			}
+			key := resourceKey(hrefStr)
+			f, ok := entries[key]
+			if !ok {
+				warning := fmt.Sprintf("resource %s is missing from the package", hrefStr)
+				log.Printf("Warning: %s", warning)
+				warnings = append(warnings, warning)
+				debug.resource(fmt.Sprintf("%s/%s", basePath, key), resourceFailed, 0, errors.New(warning))
+				progress.advance()
+				continue
+			}
+			data, err := readZipEntry(f)
+			if err != nil {
+				err = fmt.Errorf("failed to read resource: %w", err)
+				if err := failures.record(hrefStr, err); err != nil {
+					return nil, fmt.Errorf("failed to process resource %s: %w", hrefStr, err)
+				}
+				debug.resource(fmt.Sprintf("%s/%s", basePath, key), resourceFailed, 0, err)
+				progress.advance()
+				continue
+			}
+			probes.probe(link, data)
+			if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, key), data); err != nil {
+				return nil, fmt.Errorf("failed to upload resource %s: %w", hrefStr, err)
+			}
+			progress.advance()
+		}
+	}
+	progress.finish()
+	probes.apply(m)
+	failures.apply(m)
+	for _, warning := range failures.warnings() {
+		log.Printf("Warning: %s", warning)
+		warnings = append(warnings, warning)
+	}
+	debug.excluded(basePath, filter.excludedResources())
+	debug.phase("manifest")
+
+	if err := applyMetadataOverrides(m, options.Metadata); err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+
+	guidedJSON, err := generateGuidedNavigationJSON(packageGuidedNavigation(m))
+	if err != nil {
+		return nil, err
+	}
+	if guidedJSON != nil {
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, guidedNavigationPath), guidedJSON); err != nil {
+			return nil, fmt.Errorf("failed to upload guided navigation: %w", err)
+		}
+		m.Links = append(m.Links, toolkitLink(guidedNavigationLink()))
+	}
+	if signer != nil {
+		m.Links = append(m.Links, toolkitLink(signatureLink()))
+	}
+	if lcp != nil {
+		m.Links = append(m.Links, toolkitLink(lcp.licenseLink(basePath)))
+	}
+	manifestJSON, err := generatePackageManifest(m, basePath, manifestType, p.uploader)
+	if err != nil {
+		return nil, err
+	}
+	if manifestJSON, err = delta.addLinkProperties(manifestJSON, basePath); err != nil {
+		return nil, err
+	}
+	// The manifest is only stored once every resource it links to is
+	if err := delta.wait(); err != nil {
+		return nil, err
+	}
+	manifestURL, err := delta.upload(fmt.Sprintf("%s/manifest.json", basePath), manifestJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	if err := signer.uploadSignature(manifestJSON, basePath, delta); err != nil {
+		return nil, err
+	}
+	if lcp != nil {
+		if err := registerLCPContent(lcp, encrypter, basePath, manifestURL, manifestType, manifestJSON); err != nil {
+			return nil, err
+		}
+	}
+	debug.phase("index")
+	if err := delta.wait(); err != nil {
+		return nil, err
+	}
+	if err := delta.saveIntegrity(basePath); err != nil {
+		return nil, err
+	}
+	if err := delta.saveIndex(basePath); err != nil {
+		return nil, err
+	}
+
+	hooks, err := newHookPipeline(options.hookOverrides(), options.Protected, hookEnv{
+		basePath:    basePath,
+		manifestURL: manifestURL,
+		uploader:    p.uploader,
+	})
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	if len(hooks.hooks) > 0 {
+		debug.phase("hooks")
+		warnings = append(warnings, hooks.run(m, nil)...)
+	}
+
+	return &Result{
+		ManifestURL:   manifestURL,
+		BasePath:      basePath,
+		GeneratedID:   generatedIdentifier,
+		ManifestETag:  ManifestETag(manifestJSON),
+		Uploaded:      delta.uploaded,
+		UploadedBytes: delta.uploadedBytes,
+		Overwritten:   delta.overwritten,
+		Skipped:       delta.skipped,
+		Warnings:      warnings,
+		Excluded:      filter.excludedResources(),
+		Failed:        failures.failedResources(),
+	}, nil
+}
+
+// toolkitLink converts a generated manifest link with a string href, type and
+// rel into a toolkit link
+func toolkitLink(item map[string]interface{}) manifest.Link {
+	var link manifest.Link
+	if href, ok := item["href"].(string); ok {
+		if u, err := url.URLFromString(href); err == nil {
+			link.Href = manifest.NewHREF(u)
+		}
+	}
+	if mediaType, ok := item["type"].(string); ok {
+		if mt, err := mediatype.NewOfString(mediaType); err == nil {
+			link.MediaType = &mt
+		}
+	}
+	if rel, ok := item["rel"].(string); ok {
+		link.Rels = manifest.Strings{rel}
+	}
+	return link
+}
+
+// generatePackageManifest serializes the manifest of a packaged publication with
+// hrefs relative to the manifest and a self link of manifestType. Unlike EPUBs,
+// packages get no content.json or positions.json.
+func generatePackageManifest(m *manifest.Manifest, basePath, manifestType string, uploader Uploader) ([]byte, error) {
+	manifestURL := uploader.PublicURL(fmt.Sprintf("%s/manifest.json", basePath))
+
+	convert := func(links manifest.LinkList) []map[string]interface{} {
+		items := make([]map[string]interface{}, 0, len(links))
+		for _, link := range links {
+			href := link.Href.String()
+			if !isExternalHref(href) {
+				href = manifestHref(href)
+			}
+			item := map[string]interface{}{"href": href}
+			if link.MediaType != nil {
+				item["type"] = link.MediaType.String()
+			}
+			if link.Title != "" {
+				item["title"] = link.Title
+			}
+			if len(link.Rels) == 1 {
+				item["rel"] = link.Rels[0]
+			} else if len(link.Rels) > 1 {
+				item["rel"] = link.Rels
+			}
+			addMediaProperties(item, link)
+			if len(link.Properties) > 0 {
+				item["properties"] = link.Properties
+			}
+			items = append(items, item)
+		}
+		return items
+	}
+
+	links := append([]map[string]interface{}{{
+		"href": manifestURL,
+		"rel":  "self",
+		"type": manifestType,
+	}}, convert(m.Links)...)
+	publication := map[string]interface{}{
+		"@context":     "https://readium.org/webpub-manifest/context.jsonld",
+		"metadata":     m.Metadata,
+		"links":        links,
+		"readingOrder": convert(m.ReadingOrder),
+	}
+	if len(m.Resources) > 0 {
+		publication["resources"] = convert(m.Resources)
+	}
+	if len(m.TableOfContents) > 0 {
+		toc := make([]map[string]interface{}, 0, len(m.TableOfContents))
+		for _, link := range m.TableOfContents {
+			toc = append(toc, convertTOCLink(link, nil, basePath, uploader))
+		}
+		publication["toc"] = toc
+	}
+
+	data, err := canonicalJSON(publication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,173 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testPublicationJSON = `{
+  "@context": ["https://schema.org", "https://www.w3.org/ns/pub-context"],
+  "type": "Audiobook",
+  "conformsTo": "https://www.w3.org/TR/audiobooks/",
+  "id": "urn:isbn:9780316129084",
+  "name": [{"value": "Leviathan Wakes", "language": "en"}],
+  "author": ["James S. A. Corey"],
+  "readBy": {"type": "Person", "name": "Jefferson Mays"},
+  "inLanguage": "en",
+  "datePublished": "2011-06-02",
+  "duration": "PT1H30M",
+  "readingOrder": [
+    "audio/chapter 1.mp3",
+    {"type": "LinkedResource", "url": "audio/chapter2.mp3", "encodingFormat": "audio/mpeg", "name": "Chapter 2", "duration": "PT45M0.5S"},
+    {"url": "https://cdn.example.com/bonus.mp3", "encodingFormat": "audio/mpeg"}
+  ],
+  "resources": [
+    {"type": "LinkedResource", "rel": "cover", "url": "cover.jpg", "encodingFormat": "image/jpeg"},
+    {"type": "LinkedResource", "rel": "contents", "url": "toc.html", "encodingFormat": "text/html"}
+  ]
+}`
+
+func TestParseISODuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected float64
+		ok       bool
+	}{
+		{"PT1H30M", 5400, true},
+		{"PT45M0.5S", 2700.5, true},
+		{"P1DT2H", 93600, true},
+		{"PT90S", 90, true},
+		{"P", 0, false},
+		{"PT", 0, false},
+		{"1:30:00", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseISODuration(tt.value)
+		if ok != tt.ok || got != tt.expected {
+			t.Errorf("Expected %q to parse as %v (%v), got %v (%v)", tt.value, tt.expected, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestConvertW3CManifest(t *testing.T) {
+	zipReader := buildEPUB(t, map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "",
+		"audio/chapter2.mp3":  "",
+		"cover.jpg":           "",
+		"toc.html": `<html><body><nav role="doc-toc"><ol>
+  <li><a href="audio/chapter%201.mp3">Part One</a>
+    <ol><li><a href="audio/chapter%201.mp3#t=600">Chapter 1</a></li></ol>
+  </li>
+  <li><a href="audio/chapter2.mp3">  Chapter
+    2</a></li>
+</ol></nav></body></html>`,
+	})
+	if !isLPFArchive(zipReader) {
+		t.Fatal("Expected an archive with publication.json to be detected as LPF")
+	}
+	entries := zipEntries(zipReader)
+
+	w3c, manifestPath, err := readLPFManifest(entries)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m, err := convertW3CManifest(w3c, manifestPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if m.Metadata.LocalizedTitle.String() != "Leviathan Wakes" || m.Metadata.Identifier != "urn:isbn:9780316129084" {
+		t.Errorf("Expected title and identifier, got %q and %q", m.Metadata.LocalizedTitle.String(), m.Metadata.Identifier)
+	}
+	if len(m.Metadata.Authors) != 1 || m.Metadata.Authors[0].Name() != "James S. A. Corey" {
+		t.Errorf("Expected author, got %+v", m.Metadata.Authors)
+	}
+	if len(m.Metadata.Narrators) != 1 || m.Metadata.Narrators[0].Name() != "Jefferson Mays" {
+		t.Errorf("Expected narrator, got %+v", m.Metadata.Narrators)
+	}
+	if m.Metadata.Duration == nil || *m.Metadata.Duration != 5400 {
+		t.Errorf("Expected duration 5400, got %v", m.Metadata.Duration)
+	}
+	if len(m.Metadata.ConformsTo) != 1 || string(m.Metadata.ConformsTo[0]) != "https://readium.org/webpub-manifest/profiles/audiobook" {
+		t.Errorf("Expected the audiobook profile, got %v", m.Metadata.ConformsTo)
+	}
+
+	if len(m.ReadingOrder) != 3 {
+		t.Fatalf("Expected 3 reading order items, got %d", len(m.ReadingOrder))
+	}
+	if got := m.ReadingOrder[0].Href.String(); resourceKey(got) != "audio/chapter 1.mp3" {
+		t.Errorf("Expected first track at audio/chapter 1.mp3, got %q", got)
+	}
+	if m.ReadingOrder[0].MediaType == nil || m.ReadingOrder[0].MediaType.String() != "audio/mpeg" {
+		t.Errorf("Expected media type from the extension, got %v", m.ReadingOrder[0].MediaType)
+	}
+	if m.ReadingOrder[1].Title != "Chapter 2" || m.ReadingOrder[1].Duration != 2700.5 {
+		t.Errorf("Expected Chapter 2 lasting 2700.5 s, got %q lasting %v", m.ReadingOrder[1].Title, m.ReadingOrder[1].Duration)
+	}
+	if got := m.ReadingOrder[2].Href.String(); got != "https://cdn.example.com/bonus.mp3" {
+		t.Errorf("Expected external track URL to be kept, got %q", got)
+	}
+
+	toc := readLPFTableOfContents(m, entries)
+	if len(toc) != 2 || toc[0].Title != "Part One" || toc[1].Title != "Chapter 2" {
+		t.Fatalf("Expected two top-level TOC entries, got %+v", toc)
+	}
+	if len(toc[0].Children) != 1 || manifestHref(toc[0].Children[0].Href.String()) != "audio/chapter%201.mp3#t=600" {
+		t.Errorf("Expected nested entry with a media fragment, got %+v", toc[0].Children)
+	}
+}
+
+func TestReadLPFManifestEmbedded(t *testing.T) {
+	entries := zipEntries(buildEPUB(t, map[string]string{
+		lpfIndexPath: `<html><head><script type="application/ld+json">` + testPublicationJSON + `</script></head><body></body></html>`,
+	}))
+	w3c, manifestPath, err := readLPFManifest(entries)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if manifestPath != lpfIndexPath || len(w3c.ReadingOrder) != 3 {
+		t.Errorf("Expected the embedded manifest, got %s with %d tracks", manifestPath, len(w3c.ReadingOrder))
+	}
+
+	if isLPFArchive(buildEPUB(t, map[string]string{containerPath: validContainer, lpfIndexPath: ""})) {
+		t.Error("Expected an EPUB not to be detected as LPF")
+	}
+}
+
+func TestGenerateAudiobookManifest(t *testing.T) {
+	var w3c w3cManifest
+	if err := json.Unmarshal([]byte(testPublicationJSON), &w3c); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	m, err := convertW3CManifest(&w3c, lpfManifestPath)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, err := generatePackageManifest(m, "books_leviathan", "application/audiobook+json", NewSupabase("https://test.supabase.co", "test-key"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var out struct {
+		Links []struct {
+			Href string `json:"href"`
+			Rel  string `json:"rel"`
+		} `json:"links"`
+		ReadingOrder []map[string]interface{} `json:"readingOrder"`
+		Resources    []map[string]interface{} `json:"resources"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if len(out.Links) != 1 || out.Links[0].Rel != "self" {
+		t.Errorf("Expected only a self link, got %+v", out.Links)
+	}
+	if out.ReadingOrder[0]["href"] != "audio/chapter%201.mp3" || out.ReadingOrder[1]["duration"] != 2700.5 {
+		t.Errorf("Expected relative escaped hrefs and durations, got %v", out.ReadingOrder)
+	}
+	if out.Resources[0]["rel"] != "cover" {
+		t.Errorf("Expected cover rel to be kept, got %v", out.Resources[0])
+	}
+}
@@ -0,0 +1,617 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// mediaInfo is what probing a resource found out about it
+type mediaInfo struct {
+	Duration float64 // seconds
+	Bitrate  float64 // kbps
+	Width    uint    // pixels
+	Height   uint    // pixels
+	// Contains lists what a content document needs to render: "mathml", "svg"
+	// or "js", as in the "contains" link property
+	Contains []string
+}
+
+// mediaProber records the properties of images, audio and video resources as
+// they are extracted, to be added to their manifest links afterwards, along
+// with the caption and subtitle tracks content documents give them
+type mediaProber struct {
+	info   map[string]mediaInfo
+	tracks map[string][]captionTrack // media archive path or URL -> its tracks
+}
+
+func newMediaProber() *mediaProber {
+	return &mediaProber{info: map[string]mediaInfo{}, tracks: map[string][]captionTrack{}}
+}
+
+// probe reads the dimensions of a raster image, the duration and bitrate of an
+// audio or video resource, or the MathML, SVG and scripts of a content document.
+// Other resources and formats we can't read are ignored.
+func (p *mediaProber) probe(link *manifest.Link, data []byte) {
+	if isHTMLResource(link) {
+		if contains := contentFeatures(data); len(contains) > 0 {
+			p.info[link.Href.String()] = mediaInfo{Contains: contains}
+		}
+		for media, tracks := range mediaTracks(resolveArchiveHref(link.Href.String(), ""), data) {
+			for _, track := range tracks {
+				if !slices.ContainsFunc(p.tracks[media], func(t captionTrack) bool { return t.target == track.target }) {
+					p.tracks[media] = append(p.tracks[media], track)
+				}
+			}
+		}
+		return
+	}
+	mediaType := resourceMediaType(link)
+	if strings.HasPrefix(mediaType, "image/") {
+		if width, height, ok := probeImageSize(data); ok {
+			p.info[link.Href.String()] = mediaInfo{Width: width, Height: height}
+		}
+		return
+	}
+	if !strings.HasPrefix(mediaType, "audio/") && !strings.HasPrefix(mediaType, "video/") {
+		return
+	}
+	duration, ok := probeDuration(data)
+	if !ok || duration <= 0 {
+		return
+	}
+	p.info[link.Href.String()] = mediaInfo{
+		Duration: duration,
+		Bitrate:  math.Round(float64(len(data))*8/duration/1000*10) / 10,
+	}
+}
+
+// apply copies the probed properties to the manifest links, links audio and
+// video to their tracks as alternates, and gives caption files declared as
+// opaque octet-streams their media type. When every reading order item has a
+// duration (an audiobook), their total becomes the publication duration.
+func (p *mediaProber) apply(m *manifest.Manifest) {
+	update := func(links manifest.LinkList) {
+		for i := range links {
+			fixCaptionMediaType(&links[i])
+			p.linkTracks(&links[i])
+			if info, ok := p.info[links[i].Href.String()]; ok {
+				links[i].Duration = info.Duration
+				links[i].Bitrate = info.Bitrate
+				links[i].Width = info.Width
+				links[i].Height = info.Height
+				if len(info.Contains) > 0 {
+					addContains(&links[i], info.Contains)
+				}
+			}
+		}
+	}
+	update(m.ReadingOrder)
+	update(m.Resources)
+	if len(p.info) == 0 {
+		return
+	}
+
+	total := 0.0
+	for _, link := range m.ReadingOrder {
+		if link.Duration == 0 {
+			return
+		}
+		total += link.Duration
+	}
+	if m.Metadata.Duration == nil && total > 0 {
+		m.Metadata.Duration = &total
+	}
+}
+
+// linkTracks adds the tracks found for the media of link to its alternates
+func (p *mediaProber) linkTracks(link *manifest.Link) {
+	media := link.Href.String()
+	if !isExternalHref(media) {
+		media = resolveArchiveHref(media, "")
+	}
+	for _, track := range p.tracks[media] {
+		alternate, ok := captionLink(track)
+		if !ok || slices.ContainsFunc(link.Alternates, func(l manifest.Link) bool { return l.Href.String() == alternate.Href.String() }) {
+			continue
+		}
+		link.Alternates = append(link.Alternates, alternate)
+	}
+}
+
+// contentFeatures returns what a content document needs a reading system to
+// support: "mathml" for <math>, "svg" for inline <svg>, and "js" for <script>
+// elements or event handler attributes
+func contentFeatures(content []byte) []string {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	found := map[string]bool{}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(start.Name.Local) {
+		case "math":
+			found["mathml"] = true
+		case "svg":
+			found["svg"] = true
+		case "script":
+			found["js"] = true
+		}
+		for _, a := range start.Attr {
+			if strings.HasPrefix(strings.ToLower(a.Name.Local), "on") && a.Name.Space == "" {
+				found["js"] = true
+			}
+		}
+	}
+
+	var contains []string
+	for _, feature := range []string{"mathml", "svg", "js"} {
+		if found[feature] {
+			contains = append(contains, feature)
+		}
+	}
+	return contains
+}
+
+// addContains adds features to the "contains" property of a link, keeping the
+// ones the package document declared
+func addContains(link *manifest.Link, features []string) {
+	var contains []string
+	switch declared := link.Properties["contains"].(type) {
+	case []string:
+		contains = append(contains, declared...)
+	case []interface{}:
+		for _, value := range declared {
+			if s, ok := value.(string); ok {
+				contains = append(contains, s)
+			}
+		}
+	}
+	for _, feature := range features {
+		if !slices.Contains(contains, feature) {
+			contains = append(contains, feature)
+		}
+	}
+	if link.Properties == nil {
+		link.Properties = manifest.Properties{}
+	}
+	link.Properties["contains"] = contains
+}
+
+// addMediaProperties adds a link's dimensions, duration and bitrate to its manifest entry
+func addMediaProperties(item map[string]interface{}, link manifest.Link) {
+	if link.Width > 0 && link.Height > 0 {
+		item["width"] = link.Width
+		item["height"] = link.Height
+	}
+	if link.Duration > 0 {
+		item["duration"] = link.Duration
+	}
+	if link.Bitrate > 0 {
+		item["bitrate"] = link.Bitrate
+	}
+	if len(link.Alternates) > 0 {
+		item["alternate"] = alternateItems(link.Alternates)
+	}
+}
+
+// probeImageSize returns the intrinsic size of a JPEG, PNG, GIF or WebP image
+// from its header, without decoding the pixels
+func probeImageSize(data []byte) (uint, uint, bool) {
+	if len(data) >= 30 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return probeWebPSize(data)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width <= 0 || config.Height <= 0 {
+		return 0, 0, false
+	}
+	return uint(config.Width), uint(config.Height), true
+}
+
+// probeWebPSize reads the canvas size of a lossy (VP8), lossless (VP8L) or
+// extended (VP8X) WebP image
+func probeWebPSize(data []byte) (uint, uint, bool) {
+	chunk := data[12:]
+	switch string(chunk[:4]) {
+	case "VP8 ":
+		// 3-byte frame tag and start code, then 14-bit width and height
+		if chunk[11] != 0x9D || chunk[12] != 0x01 || chunk[13] != 0x2A {
+			return 0, 0, false
+		}
+		width := uint(binary.LittleEndian.Uint16(chunk[14:16]) & 0x3FFF)
+		height := uint(binary.LittleEndian.Uint16(chunk[16:18]) & 0x3FFF)
+		return width, height, width > 0 && height > 0
+	case "VP8L":
+		// signature byte, then 14-bit width-1 and height-1
+		if chunk[8] != 0x2F {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(chunk[9:13])
+		return uint(bits&0x3FFF) + 1, uint((bits>>14)&0x3FFF) + 1, true
+	case "VP8X":
+		// flags and reserved bytes, then 24-bit canvas width-1 and height-1
+		width := uint(chunk[12]) | uint(chunk[13])<<8 | uint(chunk[14])<<16
+		height := uint(chunk[15]) | uint(chunk[16])<<8 | uint(chunk[17])<<16
+		return width + 1, height + 1, true
+	}
+	return 0, 0, false
+}
+
+// probeDuration returns the duration in seconds of an MP3, MP4/M4A, WAV, FLAC,
+// Ogg (Vorbis or Opus) or WebM/Matroska file, recognized by its signature
+func probeDuration(data []byte) (float64, bool) {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return probeMP4Duration(data)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return probeWAVDuration(data)
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return probeFLACDuration(data)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return probeOggDuration(data)
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return probeMatroskaDuration(data)
+	case bytes.HasPrefix(data, []byte("ID3")) || (len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0):
+		return probeMP3Duration(data)
+	}
+	return 0, false
+}
+
+// probeMP4Duration reads the duration from the movie header box (moov/mvhd)
+func probeMP4Duration(data []byte) (float64, bool) {
+	moov, ok := findMP4Box(data, "moov")
+	if !ok {
+		return 0, false
+	}
+	mvhd, ok := findMP4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return 0, false
+	}
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, false
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if timescale == 0 {
+		return 0, false
+	}
+	return float64(duration) / float64(timescale), true
+}
+
+// findMP4Box returns the content of the first box of the given type in data
+func findMP4Box(data []byte, boxType string) ([]byte, bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[:4]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, false
+		}
+		if string(data[4:8]) == boxType {
+			return data[header:size], true
+		}
+		data = data[size:]
+	}
+	return nil, false
+}
+
+// probeWAVDuration divides the size of the data chunk by the byte rate
+func probeWAVDuration(data []byte) (float64, bool) {
+	byteRate := uint32(0)
+	for chunks := data[12:]; len(chunks) >= 8; {
+		id := string(chunks[:4])
+		size := binary.LittleEndian.Uint32(chunks[4:8])
+		switch id {
+		case "fmt ":
+			if len(chunks) >= 20 {
+				byteRate = binary.LittleEndian.Uint32(chunks[16:20])
+			}
+		case "data":
+			if byteRate == 0 {
+				return 0, false
+			}
+			// the size may be a placeholder in streamed files
+			if available := uint32(len(chunks) - 8); size > available {
+				size = available
+			}
+			return float64(size) / float64(byteRate), true
+		}
+		next := 8 + uint64(size) + uint64(size%2)
+		if next > uint64(len(chunks)) {
+			break
+		}
+		chunks = chunks[next:]
+	}
+	return 0, false
+}
+
+// probeFLACDuration reads the sample rate and total samples from STREAMINFO
+func probeFLACDuration(data []byte) (float64, bool) {
+	// "fLaC", then a 4-byte block header, STREAMINFO always comes first
+	if len(data) < 8+18 || data[4]&0x7F != 0 {
+		return 0, false
+	}
+	info := data[8:]
+	sampleRate := uint64(info[10])<<12 | uint64(info[11])<<4 | uint64(info[12])>>4
+	totalSamples := uint64(info[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+	if sampleRate == 0 || totalSamples == 0 {
+		return 0, false
+	}
+	return float64(totalSamples) / float64(sampleRate), true
+}
+
+// probeOggDuration divides the granule position of the last page by the sample
+// rate from the Vorbis or Opus identification header
+func probeOggDuration(data []byte) (float64, bool) {
+	if len(data) < 28 || len(data) < 27+int(data[26]) {
+		return 0, false
+	}
+	// First page: 27-byte header, segment table, then the identification packet
+	packet := data[27+int(data[26]):]
+	var sampleRate, preSkip uint64
+	switch {
+	case len(packet) >= 16 && bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		sampleRate = uint64(binary.LittleEndian.Uint32(packet[12:16]))
+	case len(packet) >= 12 && bytes.HasPrefix(packet, []byte("OpusHead")):
+		// Opus granule positions are always at 48 kHz
+		sampleRate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return 0, false
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if sampleRate == 0 || last < 0 || len(data) < last+14 {
+		return 0, false
+	}
+	granule := binary.LittleEndian.Uint64(data[last+6 : last+14])
+	if granule == math.MaxUint64 || granule <= preSkip {
+		return 0, false
+	}
+	return float64(granule-preSkip) / float64(sampleRate), true
+}
+
+// Matroska element IDs read by probeMatroskaDuration
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+)
+
+// probeMatroskaDuration reads Segment/Info/Duration, scaled by TimecodeScale
+func probeMatroskaDuration(data []byte) (float64, bool) {
+	segment, ok := findEBMLElement(data, ebmlSegment)
+	if !ok {
+		return 0, false
+	}
+	info, ok := findEBMLElement(segment, ebmlInfo)
+	if !ok {
+		return 0, false
+	}
+	scale := uint64(1000000)
+	if raw, ok := findEBMLElement(info, ebmlTimecodeScale); ok && len(raw) > 0 && len(raw) <= 8 {
+		scale = 0
+		for _, b := range raw {
+			scale = scale<<8 | uint64(b)
+		}
+	}
+	raw, ok := findEBMLElement(info, ebmlDuration)
+	if !ok {
+		return 0, false
+	}
+	var duration float64
+	switch len(raw) {
+	case 4:
+		duration = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+	case 8:
+		duration = math.Float64frombits(binary.BigEndian.Uint64(raw))
+	default:
+		return 0, false
+	}
+	return duration * float64(scale) / 1e9, true
+}
+
+// findEBMLElement returns the content of the first element with the given ID
+// among the elements in data. An element of unknown size extends to the end.
+func findEBMLElement(data []byte, id uint64) ([]byte, bool) {
+	for len(data) > 0 {
+		elementID, idLen := readEBMLVint(data, false)
+		if idLen == 0 {
+			return nil, false
+		}
+		size, sizeLen := readEBMLVint(data[idLen:], true)
+		if sizeLen == 0 {
+			return nil, false
+		}
+		start := uint64(idLen + sizeLen)
+		end := start + size
+		if size == math.MaxUint64 || end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		if elementID == id {
+			return data[start:end], true
+		}
+		data = data[end:]
+	}
+	return nil, false
+}
+
+// readEBMLVint reads a variable-length integer, returning it and its length
+// (0 if invalid). IDs keep their length marker bit, sizes don't; a size with
+// all value bits set means unknown and is returned as MaxUint64.
+func readEBMLVint(data []byte, isSize bool) (uint64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0])
+	if isSize {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if isSize && allOnes {
+		return math.MaxUint64, length
+	}
+	return value, length
+}
+
+// MPEG audio bitrates in kbps by [version is MPEG-1][layer index][bitrate index]
+var mp3Bitrates = [2][4][16]int{
+	{ // MPEG-2 and 2.5
+		{},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // layer III
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},      // layer II
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256}, // layer I
+	},
+	{ // MPEG-1
+		{},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},     // layer III
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},    // layer II
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448}, // layer I
+	},
+}
+
+// MPEG audio sample rates by version bits (MPEG-2.5, reserved, MPEG-2, MPEG-1)
+var mp3SampleRates = [4][3]int{
+	{11025, 12000, 8000},
+	{},
+	{22050, 24000, 16000},
+	{44100, 48000, 32000},
+}
+
+// probeMP3Duration uses the frame count of a Xing/Info or VBRI header when the
+// file has one, and otherwise assumes a constant bitrate from the first frame
+func probeMP3Duration(data []byte) (float64, bool) {
+	start := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		// ID3v2 tag size is a 28-bit syncsafe integer
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		start = 10 + size
+		if data[5]&0x10 != 0 {
+			start += 10 // footer
+		}
+	}
+	end := len(data)
+	if end-start > 128 && string(data[end-128:end-125]) == "TAG" {
+		end -= 128 // ID3v1 tag
+	}
+
+	// Find the first frame header
+	for ; start+4 <= end; start++ {
+		if data[start] == 0xFF && data[start+1]&0xE0 == 0xE0 {
+			if _, _, _, ok := parseMP3Header(data[start:]); ok {
+				break
+			}
+		}
+	}
+	if start+4 > end {
+		return 0, false
+	}
+	bitrate, sampleRate, samplesPerFrame, _ := parseMP3Header(data[start:])
+	frame := data[start:end]
+
+	// Xing/Info header sits after the side information of the first frame
+	version := (frame[1] >> 3) & 0x03
+	mono := frame[3]>>6 == 3
+	sideInfo := 32
+	switch {
+	case version == 3 && mono:
+		sideInfo = 17
+	case version != 3 && mono:
+		sideInfo = 9
+	case version != 3:
+		sideInfo = 17
+	}
+	if offset := 4 + sideInfo; len(frame) >= offset+12 {
+		tag := string(frame[offset : offset+4])
+		if (tag == "Xing" || tag == "Info") && frame[offset+7]&0x01 != 0 {
+			frames := binary.BigEndian.Uint32(frame[offset+8 : offset+12])
+			if frames > 0 {
+				return float64(frames) * float64(samplesPerFrame) / float64(sampleRate), true
+			}
+		}
+	}
+	if len(frame) >= 36+18 && string(frame[36:40]) == "VBRI" {
+		frames := binary.BigEndian.Uint32(frame[50:54])
+		if frames > 0 {
+			return float64(frames) * float64(samplesPerFrame) / float64(sampleRate), true
+		}
+	}
+
+	return float64(len(frame)) * 8 / float64(bitrate*1000), true
+}
+
+// parseMP3Header returns the bitrate (kbps), sample rate and samples per frame
+// of an MPEG audio frame header
+func parseMP3Header(header []byte) (bitrate, sampleRate, samplesPerFrame int, ok bool) {
+	if len(header) < 4 {
+		return 0, 0, 0, false
+	}
+	version := (header[1] >> 3) & 0x03
+	layer := (header[1] >> 1) & 0x03
+	bitrateIndex := header[2] >> 4
+	sampleRateIndex := (header[2] >> 2) & 0x03
+	if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return 0, 0, 0, false
+	}
+
+	mpeg1 := 0
+	if version == 3 {
+		mpeg1 = 1
+	}
+	bitrate = mp3Bitrates[mpeg1][layer][bitrateIndex]
+	sampleRate = mp3SampleRates[version][sampleRateIndex]
+	switch {
+	case layer == 3: // layer I
+		samplesPerFrame = 384
+	case layer == 1 && version != 3: // layer III, MPEG-2/2.5
+		samplesPerFrame = 576
+	default:
+		samplesPerFrame = 1152
+	}
+	return bitrate, sampleRate, samplesPerFrame, true
+}
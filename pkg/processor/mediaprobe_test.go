@@ -0,0 +1,208 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+)
+
+func mp4Box(boxType string, content []byte) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	return append(append(box, boxType...), content...)
+}
+
+func TestProbeDuration(t *testing.T) {
+	// MP4: version 0 mvhd with timescale 1000 and duration 90500
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:16], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:20], 90500)
+	mp4 := append(mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00")), mp4Box("moov", mp4Box("mvhd", mvhd))...)
+
+	// WAV: 16 kHz mono 16-bit (32000 bytes/s) with 2.5 s of samples
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00\x80\x3e\x00\x00\x00\x7d\x00\x00\x02\x00\x10\x00data")
+	wav = binary.LittleEndian.AppendUint32(wav, 80000)
+	wav = append(wav, make([]byte, 80000)...)
+
+	// FLAC: STREAMINFO with 44100 Hz and 441000 samples
+	streamInfo := make([]byte, 34)
+	streamInfo[10], streamInfo[11], streamInfo[12] = 0x0A, 0xC4, 0x40 // 44100 << 4
+	binary.BigEndian.PutUint32(streamInfo[14:18], 441000)
+	flac := append([]byte("fLaC\x00\x00\x00\x22"), streamInfo...)
+
+	// Ogg Vorbis: identification page at 48 kHz, last page at granule 96000
+	oggPage := func(granule uint64, packet []byte) []byte {
+		page := []byte("OggS\x00\x00")
+		page = binary.LittleEndian.AppendUint64(page, granule)
+		page = append(page, make([]byte, 12)...)
+		page = append(page, 1, byte(len(packet)))
+		return append(page, packet...)
+	}
+	vorbisID := append([]byte("\x01vorbis\x00\x00\x00\x00\x02"), binary.LittleEndian.AppendUint32(nil, 48000)...)
+	ogg := append(oggPage(0, vorbisID), oggPage(96000, []byte("audio"))...)
+
+	// Matroska: Segment/Info with the default timecode scale and a 12.5 s float64 duration
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(12500))
+	info := append([]byte{0x44, 0x89, 0x88}, duration...)
+	segment := append([]byte{0x15, 0x49, 0xA9, 0x66, 0x80 | byte(len(info))}, info...)
+	mkv := append([]byte{0x1A, 0x45, 0xDF, 0xA3, 0x80, 0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, segment...)
+
+	// MP3: 128 kbps CBR MPEG-1 layer III, 2 s of frames after an ID3v2 tag
+	cbr := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x0a"), make([]byte, 10)...)
+	frame := append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 414)...)
+	for len(cbr) < 10+10+32000 {
+		cbr = append(cbr, frame...)
+	}
+	cbr = cbr[:10+10+32000]
+
+	// MP3: Xing header announcing 100 frames at 44.1 kHz
+	xing := append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 32)...)
+	xing = append(xing, "Xing\x00\x00\x00\x01\x00\x00\x00\x64"...)
+	xing = append(xing, bytes.Repeat([]byte{0}, 400)...)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected float64
+	}{
+		{"mp4", mp4, 90.5},
+		{"wav", wav, 2.5},
+		{"flac", flac, 10},
+		{"ogg", ogg, 2},
+		{"matroska", mkv, 12.5},
+		{"mp3 cbr", cbr, 2},
+		{"mp3 xing", xing, 100 * 1152 / 44100.0},
+	}
+	for _, tt := range tests {
+		got, ok := probeDuration(tt.data)
+		if !ok || math.Abs(got-tt.expected) > 0.001 {
+			t.Errorf("%s: expected duration %v, got %v (ok=%v)", tt.name, tt.expected, got, ok)
+		}
+	}
+
+	if _, ok := probeDuration([]byte("not audio at all")); ok {
+		t.Error("Expected unknown data not to be probed")
+	}
+}
+
+func TestMediaProberApply(t *testing.T) {
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x01\x00\x80\x3e\x00\x00\x00\x7d\x00\x00\x02\x00\x10\x00data")
+	wav = binary.LittleEndian.AppendUint32(wav, 64000)
+	wav = append(wav, make([]byte, 64000)...)
+
+	audioType, _ := mediatype.NewOfString("audio/wav")
+	track1, track2 := testLink(t, "audio/track1.wav"), testLink(t, "audio/track2.wav")
+	track1.MediaType, track2.MediaType = &audioType, &audioType
+
+	probes := newMediaProber()
+	probes.probe(&track1, wav)
+	probes.probe(&track2, wav)
+	text := testLink(t, "OEBPS/chapter1.xhtml")
+	probes.probe(&text, wav)
+
+	m := manifest.Manifest{ReadingOrder: manifest.LinkList{testLink(t, "audio/track1.wav"), testLink(t, "audio/track2.wav")}}
+	probes.apply(&m)
+
+	if m.ReadingOrder[0].Duration != 2 || m.ReadingOrder[0].Bitrate < 256 || m.ReadingOrder[0].Bitrate > 257 {
+		t.Errorf("Expected 2 s at about 256 kbps, got %v s at %v kbps", m.ReadingOrder[0].Duration, m.ReadingOrder[0].Bitrate)
+	}
+	if m.Metadata.Duration == nil || *m.Metadata.Duration != 4 {
+		t.Errorf("Expected publication duration 4, got %v", m.Metadata.Duration)
+	}
+	if _, ok := probes.info["OEBPS/chapter1.xhtml"]; ok {
+		t.Error("Expected non-audio resources not to be probed")
+	}
+
+	item := map[string]interface{}{}
+	addMediaProperties(item, m.ReadingOrder[1])
+	if item["duration"] != 2.0 || item["bitrate"] == nil {
+		t.Errorf("Expected duration and bitrate in the manifest entry, got %v", item)
+	}
+}
+
+func TestProbeImageSize(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 640, 480))); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	webp := func(chunk string, payload []byte) []byte {
+		data := append([]byte("RIFF\x00\x00\x00\x00WEBP"), chunk...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(payload)))
+		return append(data, append(payload, make([]byte, 16)...)...)
+	}
+	lossy := append([]byte{0, 0, 0, 0x9D, 0x01, 0x2A}, binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, 800), 600)...)
+	lossless := append([]byte{0x2F}, binary.LittleEndian.AppendUint32(nil, (300-1)|(200-1)<<14)...)
+	extended := []byte{0, 0, 0, 0, 0x7F, 0x07, 0x00, 0x37, 0x04, 0x00} // 1920x1080
+
+	tests := []struct {
+		name          string
+		data          []byte
+		width, height uint
+	}{
+		{"png", pngData.Bytes(), 640, 480},
+		{"webp lossy", webp("VP8 ", lossy), 800, 600},
+		{"webp lossless", webp("VP8L", lossless), 300, 200},
+		{"webp extended", webp("VP8X", extended), 1920, 1080},
+	}
+	for _, tt := range tests {
+		width, height, ok := probeImageSize(tt.data)
+		if !ok || width != tt.width || height != tt.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d (ok=%v)", tt.name, tt.width, tt.height, width, height, ok)
+		}
+	}
+
+	if _, _, ok := probeImageSize([]byte("<svg/>")); ok {
+		t.Error("Expected SVG not to be probed")
+	}
+
+	imageType, _ := mediatype.NewOfString("image/png")
+	link := testLink(t, "OEBPS/Images/plate.png")
+	link.MediaType = &imageType
+	probes := newMediaProber()
+	probes.probe(&link, pngData.Bytes())
+	m := manifest.Manifest{Resources: manifest.LinkList{testLink(t, "OEBPS/Images/plate.png")}}
+	probes.apply(&m)
+	item := map[string]interface{}{}
+	addMediaProperties(item, m.Resources[0])
+	if item["width"] != uint(640) || item["height"] != uint(480) {
+		t.Errorf("Expected width and height in the manifest entry, got %v", item)
+	}
+}
+
+func TestContentFeatures(t *testing.T) {
+	for content, want := range map[string][]string{
+		`<html><body><p>E = <math xmlns="http://www.w3.org/1998/Math/MathML"><mi>m</mi></math></p><svg><circle/></svg></body></html>`: {"mathml", "svg"},
+		`<html><head><script src="quiz.js"></script></head><body/></html>`:                                                            {"js"},
+		`<html><body><button onclick="reveal()">Answer</button></body></html>`:                                                        {"js"},
+		`<html><body><p>Call me Ishmael.</p><img src="whale.svg"/></body></html>`:                                                     nil,
+	} {
+		if got := contentFeatures([]byte(content)); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v for %s, got %v", want, content, got)
+		}
+	}
+}
+
+func TestMediaProberContains(t *testing.T) {
+	chapter := testLink(t, "OEBPS/chapter1.xhtml")
+	chapter.Properties = manifest.Properties{"contains": []string{"remote-resources", "svg"}}
+	m := &manifest.Manifest{ReadingOrder: manifest.LinkList{chapter, testLink(t, "OEBPS/chapter2.xhtml")}}
+
+	p := newMediaProber()
+	p.probe(&m.ReadingOrder[0], []byte(`<html><body><svg/><math/></body></html>`))
+	p.probe(&m.ReadingOrder[1], []byte(`<html><body><p>Plain</p></body></html>`))
+	p.apply(m)
+
+	if got := m.ReadingOrder[0].Properties["contains"]; !reflect.DeepEqual(got, []string{"remote-resources", "svg", "mathml"}) {
+		t.Errorf("Expected the detected features after the declared ones, got %v", got)
+	}
+	if _, ok := m.ReadingOrder[1].Properties["contains"]; ok {
+		t.Errorf("Expected no contains property for a plain chapter, got %v", m.ReadingOrder[1].Properties)
+	}
+}
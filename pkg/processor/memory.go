@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"archive/zip"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+)
+
+const (
+	// lambdaMemorySizeEnvVar is set by the Lambda runtime to the function memory, in MB
+	lambdaMemorySizeEnvVar = "AWS_LAMBDA_FUNCTION_MEMORY_SIZE"
+
+	// runtimeMemoryBytes is the memory taken besides the resources: the Go
+	// runtime, the parsed publication and the manifest and sidecars being built
+	runtimeMemoryBytes = 96 << 20
+	// resourceCopies is how many copies of a resource can be in memory at once:
+	// as read, as transformed, and as compressed for upload
+	resourceCopies = 3
+	// lowMemoryFraction is the share of the function memory above which a job is
+	// processed in low-memory mode
+	lowMemoryFraction = 0.5
+	// releaseThresholdBytes is the size of the resources after which low-memory
+	// mode returns their memory to the OS
+	releaseThresholdBytes = 8 << 20
+	// softLimitFraction of the function memory is the Go runtime's soft memory
+	// limit, so the GC works harder before the function runs out of memory
+	softLimitFraction = 0.9
+)
+
+// memoryBudget accounts for the memory a job will need against the memory of
+// the function, as Lambda kills an invocation that goes over it without a word.
+// A nil budget (outside Lambda) accounts for nothing.
+type memoryBudget struct {
+	limit uint64 // function memory, in bytes
+	// lowMemory is set when the job needs a large share of the limit: memory is
+	// then returned to the OS after each large resource instead of at GC's pace
+	lowMemory bool
+}
+
+// memoryBudgetFromEnv returns the budget of the function, or nil outside Lambda
+func memoryBudgetFromEnv() *memoryBudget {
+	megabytes, err := strconv.ParseUint(os.Getenv(lambdaMemorySizeEnvVar), 10, 64)
+	if err != nil || megabytes == 0 {
+		return nil
+	}
+	return &memoryBudget{limit: megabytes << 20}
+}
+
+// estimateMemory returns the memory processing an archive takes at its peak:
+// resources are processed one at a time, so the largest one decides. Entries
+// over maxResourceBytes (0 for no cap) are skipped, and don't count.
+func estimateMemory(zipReader *zip.Reader, maxResourceBytes uint64) (uint64, *zip.File) {
+	var largest *zip.File
+	for _, f := range zipReader.File {
+		if maxResourceBytes > 0 && f.UncompressedSize64 > maxResourceBytes {
+			continue
+		}
+		if largest == nil || f.UncompressedSize64 > largest.UncompressedSize64 {
+			largest = f
+		}
+	}
+	if largest == nil {
+		return runtimeMemoryBytes, nil
+	}
+	return runtimeMemoryBytes + resourceCopies*largest.UncompressedSize64, largest
+}
+
+// check refuses an archive whose estimated peak is over the budget with a 413,
+// rather than letting the invocation be killed halfway, and switches to
+// low-memory mode when it gets close. Returns a warning when it does.
+func (b *memoryBudget) check(zipReader *zip.Reader, maxResourceBytes uint64) ([]string, error) {
+	if b == nil {
+		return nil, nil
+	}
+	debug.SetMemoryLimit(int64(float64(b.limit) * softLimitFraction))
+
+	estimate, largest := estimateMemory(zipReader, maxResourceBytes)
+	if estimate > b.limit {
+		return nil, &statusError{
+			status: 413,
+			err: fmt.Errorf("processing needs about %d MB of memory (%s is %d bytes uncompressed) but the function has %d MB: increase the function memory or process the EPUB with the CLI",
+				estimate>>20, largest.Name, largest.UncompressedSize64, b.limit>>20),
+		}
+	}
+	if float64(estimate) > float64(b.limit)*lowMemoryFraction {
+		b.lowMemory = true
+		return []string{fmt.Sprintf("processing needs about %d MB of the %d MB of memory: processing in low-memory mode", estimate>>20, b.limit>>20)}, nil
+	}
+	return nil, nil
+}
+
+// release returns the memory of a processed resource of size bytes to the OS
+// in low-memory mode, so the next large resource doesn't stack on top of it
+func (b *memoryBudget) release(size int) {
+	if b == nil || !b.lowMemory || size < releaseThresholdBytes {
+		return
+	}
+	debug.FreeOSMemory()
+}
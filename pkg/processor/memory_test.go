@@ -0,0 +1,62 @@
+package processor
+
+import (
+	"math"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestMemoryBudgetFromEnv(t *testing.T) {
+	t.Setenv(lambdaMemorySizeEnvVar, "")
+	if budget := memoryBudgetFromEnv(); budget != nil {
+		t.Errorf("Expected no budget outside Lambda, got %+v", budget)
+	}
+	t.Setenv(lambdaMemorySizeEnvVar, "1024")
+	if budget := memoryBudgetFromEnv(); budget == nil || budget.limit != 1024<<20 {
+		t.Errorf("Expected a budget of 1024 MB, got %+v", budget)
+	}
+}
+
+func TestMemoryBudget_Check(t *testing.T) {
+	t.Cleanup(func() { debug.SetMemoryLimit(math.MaxInt64) })
+	archive := buildZip(t, map[string][]byte{
+		"OEBPS/chapter.xhtml": make([]byte, 1<<20),
+		"OEBPS/video.mp4":     make([]byte, 40<<20),
+	})
+
+	tests := []struct {
+		name      string
+		limit     uint64
+		wantErr   bool
+		lowMemory bool
+	}{
+		{"plenty of memory", 2048 << 20, false, false},
+		{"close to the limit", 256 << 20, false, true},
+		{"over the limit", 128 << 20, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := &memoryBudget{limit: tt.limit}
+			warnings, err := budget.check(archive, 0)
+			if tt.wantErr {
+				if StatusCode(err) != 413 || !strings.Contains(err.Error(), "OEBPS/video.mp4") {
+					t.Errorf("Expected a 413 naming the largest entry, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if budget.lowMemory != tt.lowMemory || (len(warnings) > 0) != tt.lowMemory {
+				t.Errorf("Expected low-memory mode %v, got %v with warnings %v", tt.lowMemory, budget.lowMemory, warnings)
+			}
+		})
+	}
+
+	var disabled *memoryBudget
+	if warnings, err := disabled.check(archive, 0); warnings != nil || err != nil {
+		t.Errorf("Expected a nil budget to check nothing, got %v, %v", warnings, err)
+	}
+	disabled.release(64 << 20)
+}
@@ -0,0 +1,275 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"golang.org/x/text/language"
+)
+
+// Amount of chapter text used to detect the publication language
+const languageSampleRunes = 10000
+
+// looseDateLayouts are the date formats accepted in dc:date when the parser
+// couldn't read the date, most specific first
+var looseDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-1-2",
+	"2006/01/02",
+	"2006-01",
+	"2006",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"02 Jan 2006",
+	"January 2006",
+}
+
+// Name suffixes that follow a comma without the name being inverted
+var nameSuffixes = map[string]bool{
+	"jr": true, "sr": true, "ii": true, "iii": true, "iv": true, "phd": true, "md": true,
+	"esq": true, "inc": true, "ltd": true, "llc": true, "co": true,
+}
+
+// normalizeMetadata cleans up publication metadata for the output manifest:
+// language tags are normalized to BCP-47 (and detected from the text when missing
+// or clearly wrong), inverted contributor names ("Doe, Jane") are put in display
+// order, and Dublin Core fields, series, subject codes and dates the parser
+// couldn't read are recovered from the OPF.
+// pkg may be nil. Returns a warning for each correction that changes the meaning
+// of the metadata.
+func normalizeMetadata(metadata *manifest.Metadata, pkg *epubPackage, chapters []chapterText) []string {
+	warnings := normalizeLanguages(metadata, languageSample(chapters))
+	if pkg != nil {
+		// before names are uninverted, as roles are matched against the OPF names
+		addDublinCoreFromOPF(metadata, pkg)
+	}
+
+	for _, contributors := range []manifest.Contributors{
+		metadata.Authors, metadata.Translators, metadata.Editors, metadata.Artists,
+		metadata.Illustrators, metadata.Narrators, metadata.Contributors,
+	} {
+		for i := range contributors {
+			normalizeContributorName(&contributors[i])
+		}
+	}
+
+	if pkg != nil {
+		addCollectionsFromOPF(metadata, pkg)
+		addSubjectsFromOPF(metadata, pkg)
+
+		if metadata.Published == nil {
+			for _, e := range pkg.metaElements("date") {
+				if event := e.attr("event"); event != "" && event != "publication" {
+					continue
+				}
+				if published, ok := parseLooseDate(e.Value); ok {
+					metadata.Published = &published
+					break
+				}
+			}
+		}
+		if metadata.Modified == nil {
+			for _, e := range append(pkg.metaElements("meta"), pkg.metaElements("date")...) {
+				if e.attr("property") != "dcterms:modified" && e.attr("event") != "modification" {
+					continue
+				}
+				if modified, ok := parseLooseDate(e.Value); ok {
+					metadata.Modified = &modified
+					break
+				}
+			}
+		}
+	}
+
+	return warnings
+}
+
+// addCollectionsFromOPF fills belongsTo.series and belongsTo.collection from the
+// package document when the parser didn't: EPUB 3 belongs-to-collection metas
+// (refined by collection-type and group-position) and calibre:series metas
+func addCollectionsFromOPF(metadata *manifest.Metadata, pkg *epubPackage) {
+	found := map[string]manifest.Collections{}
+
+	metas := pkg.metaElements("meta")
+	refinements := pkg.refinements()
+	for _, e := range metas {
+		name := strings.TrimSpace(e.Value)
+		if e.attr("property") != "belongs-to-collection" || name == "" {
+			continue
+		}
+		refined := refinements[e.attr("id")]
+		role := "collection"
+		if refined["collection-type"] == "series" {
+			role = "series"
+		}
+		found[role] = append(found[role], manifest.Collection{
+			LocalizedName: manifest.NewLocalizedStringFromString(name),
+			Position:      parsePosition(refined["group-position"]),
+		})
+	}
+
+	if len(found["series"]) == 0 {
+		var series, index string
+		for _, e := range metas {
+			switch e.attr("name") {
+			case "calibre:series":
+				series = strings.TrimSpace(e.attr("content"))
+			case "calibre:series_index":
+				index = e.attr("content")
+			}
+		}
+		if series != "" {
+			found["series"] = manifest.Collections{{
+				LocalizedName: manifest.NewLocalizedStringFromString(series),
+				Position:      parsePosition(index),
+			}}
+		}
+	}
+
+	for role, collections := range found {
+		if len(metadata.BelongsTo[role]) > 0 {
+			continue
+		}
+		if metadata.BelongsTo == nil {
+			metadata.BelongsTo = map[string]manifest.Collections{}
+		}
+		metadata.BelongsTo[role] = collections
+	}
+}
+
+// parsePosition parses a position in a series, returning nil if there is none
+func parsePosition(value string) *float64 {
+	position, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return nil
+	}
+	return &position
+}
+
+// normalizeLanguages rewrites the declared languages as canonical BCP-47 tags
+// (e.g. "en-us" becomes "en-US"), dropping invalid ones. When no valid language
+// is left, or the primary language is written in a different script than the
+// sample text, the language detected from the sample is used instead.
+func normalizeLanguages(metadata *manifest.Metadata, sample string) []string {
+	var warnings []string
+	tags := make(manifest.Strings, 0, len(metadata.Languages))
+	seen := map[string]bool{}
+	for _, lang := range metadata.Languages {
+		tag, err := language.Parse(strings.TrimSpace(lang))
+		if err != nil || tag == language.Und {
+			warnings = append(warnings, fmt.Sprintf("ignored invalid language tag %q", lang))
+			continue
+		}
+		if normalized := tag.String(); !seen[normalized] {
+			seen[normalized] = true
+			tags = append(tags, normalized)
+		}
+	}
+
+	detected, script := detectLanguage(sample)
+	switch {
+	case detected == "":
+	case len(tags) == 0:
+		warnings = append(warnings, fmt.Sprintf("publication declares no language, detected %q from its text", detected))
+		tags = manifest.Strings{detected}
+	case !languageUsesScript(tags[0], script):
+		warnings = append(warnings, fmt.Sprintf("declared language %q doesn't match the text, detected %q instead", tags[0], detected))
+		tags = manifest.Strings{detected}
+	}
+
+	metadata.Languages = tags
+	return warnings
+}
+
+// languageUsesScript reports whether text in script is plausible for a language
+// tag. Han characters are accepted for Chinese, Japanese and Korean alike.
+func languageUsesScript(tag, script string) bool {
+	tagScript, _ := language.Make(tag).Script()
+	switch tagScript.String() {
+	case script:
+		return true
+	case "Hans", "Hant", "Jpan", "Kore":
+		return script == "Hani" || script == "Jpan" || script == "Kore"
+	}
+	return false
+}
+
+// languageSample returns the start of the publication's text, skipping the
+// cover and title pages that have little text of their own
+func languageSample(chapters []chapterText) string {
+	var sample strings.Builder
+	for _, chapter := range chapters {
+		if chapter.WordCount < 50 && len(chapters) > 1 {
+			continue
+		}
+		for _, r := range chapter.Text {
+			if sample.Len() >= languageSampleRunes {
+				return sample.String()
+			}
+			sample.WriteRune(r)
+		}
+		sample.WriteByte('\n')
+	}
+	return sample.String()
+}
+
+// normalizeContributorName turns an inverted name such as "Doe, Jane" into
+// "Jane Doe", keeping the inverted form as sortAs unless one is already set
+func normalizeContributorName(c *manifest.Contributor) {
+	// In language order, so the sortAs taken from the first inverted name is stable
+	languages := make([]string, 0, len(c.LocalizedName.Translations))
+	for lang := range c.LocalizedName.Translations {
+		languages = append(languages, lang)
+	}
+	sort.Strings(languages)
+	for _, lang := range languages {
+		name := c.LocalizedName.Translations[lang]
+		displayName, ok := uninvertName(name)
+		if !ok {
+			continue
+		}
+		if c.LocalizedSortAs == nil {
+			sortAs := manifest.NewLocalizedStringFromString(strings.TrimSpace(name))
+			c.LocalizedSortAs = &sortAs
+		}
+		c.LocalizedName.Translations[lang] = displayName
+	}
+}
+
+// uninvertName returns "First Last" for "Last, First". Names with a suffix after
+// the comma ("King, Jr."), more than one comma or long parts are left alone.
+func uninvertName(name string) (string, bool) {
+	parts := strings.Split(name, ",")
+	if len(parts) != 2 {
+		return "", false
+	}
+	last, first := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if last == "" || first == "" {
+		return "", false
+	}
+	if nameSuffixes[strings.ToLower(strings.Trim(first, ". "))] {
+		return "", false
+	}
+	if len(strings.Fields(last)) > 3 || len(strings.Fields(first)) > 3 {
+		return "", false
+	}
+	return first + " " + last, true
+}
+
+// parseLooseDate parses a date in one of looseDateLayouts
+func parseLooseDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range looseDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
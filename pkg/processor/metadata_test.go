@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+var englishSample = strings.Repeat("It was the best of times, it was the worst of times, it was the age of wisdom. ", 4)
+
+func TestNormalizeLanguages(t *testing.T) {
+	tests := []struct {
+		name     string
+		declared manifest.Strings
+		sample   string
+		want     manifest.Strings
+		warnings int
+	}{
+		{"canonical case", manifest.Strings{"en-us", "EN-US", "fr"}, englishSample, manifest.Strings{"en-US", "fr"}, 0},
+		{"missing", nil, englishSample, manifest.Strings{"en"}, 1},
+		{"invalid", manifest.Strings{"english"}, englishSample, manifest.Strings{"en"}, 2},
+		{"wrong script", manifest.Strings{"en"}, strings.Repeat("Все счастливые семьи похожи друг на друга. ", 6), manifest.Strings{"ru"}, 1},
+		{"undetectable", manifest.Strings{"de"}, "Chapter One", manifest.Strings{"de"}, 0},
+		{"han text in japanese book", manifest.Strings{"ja"}, strings.Repeat("天地玄黄宇宙洪荒日月盈昃辰宿列张", 20), manifest.Strings{"ja"}, 0},
+	}
+	for _, tt := range tests {
+		metadata := manifest.Metadata{Languages: tt.declared}
+		warnings := normalizeLanguages(&metadata, tt.sample)
+		if strings.Join(metadata.Languages, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: Expected languages %v, got %v", tt.name, tt.want, metadata.Languages)
+		}
+		if len(warnings) != tt.warnings {
+			t.Errorf("%s: Expected %d warnings, got %v", tt.name, tt.warnings, warnings)
+		}
+	}
+}
+
+func TestUninvertName(t *testing.T) {
+	tests := map[string]string{
+		"Doe, Jane":                  "Jane Doe",
+		"van der Berg, Anna Maria":   "Anna Maria van der Berg",
+		"Jane Doe":                   "",
+		"King, Jr.":                  "",
+		"Doe, Jane, Smith, John":     "",
+		"Penguin Random House, Inc.": "",
+	}
+	for name, want := range tests {
+		got, ok := uninvertName(name)
+		if ok != (want != "") || got != want {
+			t.Errorf("uninvertName(%q) = %q, %t, want %q", name, got, ok, want)
+		}
+	}
+}
+
+func TestNormalizeMetadata_ContributorsAndDates(t *testing.T) {
+	pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+		containerPath: validContainer,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:date>March 3, 2019</dc:date>
+    <meta property="dcterms:modified">2021-05-06</meta>
+  </metadata>
+</package>`,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open package: %v", err)
+	}
+
+	presetSortAs := manifest.NewLocalizedStringFromString("Smith")
+	metadata := manifest.Metadata{
+		Languages: manifest.Strings{"en"},
+		Authors: manifest.Contributors{
+			{LocalizedName: manifest.NewLocalizedStringFromString("Doe, Jane")},
+			{LocalizedName: manifest.NewLocalizedStringFromString("Smith, John"), LocalizedSortAs: &presetSortAs},
+		},
+	}
+	normalizeMetadata(&metadata, pkg, nil)
+
+	if name := metadata.Authors[0].LocalizedName.String(); name != "Jane Doe" {
+		t.Errorf("Expected display name Jane Doe, got %q", name)
+	}
+	if sortAs := metadata.Authors[0].LocalizedSortAs; sortAs == nil || sortAs.String() != "Doe, Jane" {
+		t.Errorf("Expected sortAs Doe, Jane, got %v", sortAs)
+	}
+	if sortAs := metadata.Authors[1].LocalizedSortAs.String(); sortAs != "Smith" {
+		t.Errorf("Expected existing sortAs to be kept, got %q", sortAs)
+	}
+
+	if metadata.Published == nil || !metadata.Published.Equal(time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected published date recovered from dc:date, got %v", metadata.Published)
+	}
+	if metadata.Modified == nil || !metadata.Modified.Equal(time.Date(2021, 5, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected modified date recovered from dcterms:modified, got %v", metadata.Modified)
+	}
+}
+
+func TestAddCollectionsFromOPF(t *testing.T) {
+	opf := func(metadata string) *epubPackage {
+		pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+			containerPath: validContainer,
+			"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` + metadata + `</metadata>
+</package>`,
+		}))
+		if err != nil {
+			t.Fatalf("Failed to open package: %v", err)
+		}
+		return pkg
+	}
+
+	metadata := manifest.Metadata{}
+	addCollectionsFromOPF(&metadata, opf(`
+    <meta property="belongs-to-collection" id="c01">The Expanse</meta>
+    <meta refines="#c01" property="collection-type">series</meta>
+    <meta refines="#c01" property="group-position">2</meta>
+    <meta property="belongs-to-collection" id="c02">Orbit Sci-Fi</meta>
+    <meta name="calibre:series" content="Ignored Calibre Series"/>`))
+
+	series := metadata.BelongsTo["series"]
+	if len(series) != 1 || series[0].LocalizedName.String() != "The Expanse" || series[0].Position == nil || *series[0].Position != 2 {
+		t.Errorf("Expected EPUB 3 series with position 2, got %+v", series)
+	}
+	collections := metadata.BelongsTo["collection"]
+	if len(collections) != 1 || collections[0].LocalizedName.String() != "Orbit Sci-Fi" || collections[0].Position != nil {
+		t.Errorf("Expected collection without position, got %+v", collections)
+	}
+
+	metadata = manifest.Metadata{}
+	addCollectionsFromOPF(&metadata, opf(`
+    <meta name="calibre:series" content="Discworld"/>
+    <meta name="calibre:series_index" content="3.0"/>`))
+	series = metadata.BelongsTo["series"]
+	if len(series) != 1 || series[0].LocalizedName.String() != "Discworld" || *series[0].Position != 3 {
+		t.Errorf("Expected calibre series with position 3, got %+v", series)
+	}
+
+	parsed := manifest.Collections{{LocalizedName: manifest.NewLocalizedStringFromString("From Parser")}}
+	metadata = manifest.Metadata{BelongsTo: map[string]manifest.Collections{"series": parsed}}
+	addCollectionsFromOPF(&metadata, opf(`<meta name="calibre:series" content="Discworld"/>`))
+	if metadata.BelongsTo["series"][0].LocalizedName.String() != "From Parser" {
+		t.Errorf("Expected series from the parser to be kept, got %+v", metadata.BelongsTo["series"])
+	}
+}
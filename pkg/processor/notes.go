@@ -0,0 +1,170 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// notesPath is where the footnote map is stored, relative to basePath
+const notesPath = "readium/notes.json"
+
+// noteTypes maps the epub:type and ARIA role values marking notes to the note
+// type reported in the footnote map
+var noteTypes = map[string]string{
+	"footnote":     "footnote",
+	"endnote":      "endnote",
+	"rearnote":     "endnote",
+	"note":         "note",
+	"doc-footnote": "footnote",
+	"doc-endnote":  "endnote",
+}
+
+// note is an entry of the footnote map: a note and the references to it
+type note struct {
+	// Href is the note, as the document href with the id of the note as fragment
+	Href string `json:"href"`
+	Type string `json:"type"`
+	// Text is the text of the note, for readers to show in a popover. It is
+	// empty for targets of references that are not marked as notes.
+	Text       string   `json:"text,omitempty"`
+	References []string `json:"references"`
+}
+
+// noteCollector records the note references and notes of content documents as
+// they are processed, to be published as the footnote map afterwards. A nil
+// collector records nothing.
+type noteCollector struct {
+	notes map[string]*note // href -> note
+	order []*note          // in the order they were found
+}
+
+func newNoteCollector() *noteCollector {
+	return &noteCollector{notes: map[string]*note{}}
+}
+
+// get returns the note at href, adding it if needed
+func (c *noteCollector) get(href string) *note {
+	n, ok := c.notes[href]
+	if !ok {
+		n = &note{Href: href, Type: "note", References: []string{}}
+		c.notes[href] = n
+		c.order = append(c.order, n)
+	}
+	return n
+}
+
+// scan records the links marked as note references (epub:type="noteref" or
+// role="doc-noteref") of the content document at docPath, and the elements
+// marked as notes
+func (c *noteCollector) scan(docPath string, content []byte) {
+	if c == nil {
+		return
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	// current is the note whose text is being read, at depth elements down
+	var current *note
+	var text strings.Builder
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if current != nil {
+				depth++
+				continue
+			}
+			semantics, id, href := noteAttributes(t.Attr)
+			if slices.Contains(semantics, "noteref") || slices.Contains(semantics, "doc-noteref") {
+				if target := noteTarget(href, docPath); target != "" {
+					n := c.get(target)
+					ref := manifestHref(docPath)
+					if id != "" {
+						ref += "#" + id
+					}
+					n.References = append(n.References, ref)
+				}
+			}
+			for _, value := range semantics {
+				if noteType, ok := noteTypes[value]; ok && id != "" {
+					current = c.get(manifestHref(docPath) + "#" + id)
+					current.Type = noteType
+					text.Reset()
+					depth = 1
+					break
+				}
+			}
+		case xml.EndElement:
+			if current == nil {
+				continue
+			}
+			if depth--; depth == 0 {
+				current.Text = strings.Join(strings.Fields(text.String()), " ")
+				current = nil
+			}
+		case xml.CharData:
+			if current != nil {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// noteAttributes returns the epub:type and role values, id and href of an element
+func noteAttributes(attrs []xml.Attr) ([]string, string, string) {
+	var semantics []string
+	id, href := "", ""
+	for _, a := range attrs {
+		switch {
+		case a.Name.Local == "type" && a.Name.Space != "", a.Name.Local == "role":
+			for _, value := range strings.Fields(a.Value) {
+				semantics = append(semantics, strings.ToLower(value))
+			}
+		case a.Name.Local == "id":
+			id = a.Value
+		case a.Name.Local == "href":
+			href = a.Value
+		}
+	}
+	return semantics, id, href
+}
+
+// noteTarget resolves the href of a note reference in the document at docPath
+// to a manifest href with fragment. References without a fragment don't point
+// to a note, and give "".
+func noteTarget(href, docPath string) string {
+	base, fragment, ok := strings.Cut(strings.TrimSpace(href), "#")
+	if !ok || fragment == "" || isExternalHref(base) {
+		return ""
+	}
+	target := docPath
+	if base != "" {
+		if target = resolveArchiveHref(base, docPath); target == "" {
+			return ""
+		}
+	}
+	return manifestHref(target) + "#" + fragment
+}
+
+// generateNotesJSON returns the footnote map, with the notes in document order,
+// or nil when no note was found
+func (c *noteCollector) generateNotesJSON() ([]byte, error) {
+	if c == nil || len(c.notes) == 0 {
+		return nil, nil
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"version": 1, "notes": c.order}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notes: %w", err)
+	}
+	return data, nil
+}
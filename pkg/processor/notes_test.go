@@ -0,0 +1,49 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNoteCollector(t *testing.T) {
+	c := newNoteCollector()
+	c.scan("OEBPS/chapter 1.xhtml", []byte(`<html xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<p>Call me Ishmael.<a epub:type="noteref" id="r1" href="#fn1">1</a> Some years ago<a role="doc-noteref" href="notes.xhtml#en1">2</a>
+<a href="#fn1">not a note reference</a><a epub:type="noteref" href="notes.xhtml">no fragment</a></p>
+<aside epub:type="footnote" id="fn1"><p>Ishmael is the <em>narrator</em>.</p></aside>
+</body></html>`))
+	c.scan("OEBPS/notes.xhtml", []byte(`<html xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<ol><li epub:type="endnote" id="en1">A whaling voyage.</li><li role="doc-endnote">No id</li></ol>
+</body></html>`))
+
+	data, err := c.generateNotesJSON()
+	if err != nil {
+		t.Fatalf("generateNotesJSON failed: %v", err)
+	}
+	var notes struct {
+		Notes []note `json:"notes"`
+	}
+	if err := json.Unmarshal(data, &notes); err != nil {
+		t.Fatalf("Failed to parse notes: %v", err)
+	}
+	if len(notes.Notes) != 2 {
+		t.Fatalf("Expected two notes, got %+v", notes.Notes)
+	}
+	footnote, endnote := notes.Notes[0], notes.Notes[1]
+	if footnote.Href != "OEBPS/chapter%201.xhtml#fn1" || footnote.Type != "footnote" || footnote.Text != "Ishmael is the narrator." {
+		t.Errorf("Expected the footnote with its text, got %+v", footnote)
+	}
+	if len(footnote.References) != 1 || footnote.References[0] != "OEBPS/chapter%201.xhtml#r1" {
+		t.Errorf("Expected the marked reference only, got %v", footnote.References)
+	}
+	if endnote.Href != "OEBPS/notes.xhtml#en1" || endnote.Type != "endnote" || endnote.Text != "A whaling voyage." {
+		t.Errorf("Expected the endnote with its text, got %+v", endnote)
+	}
+	if len(endnote.References) != 1 || endnote.References[0] != "OEBPS/chapter%201.xhtml" {
+		t.Errorf("Expected a reference without id to point to its document, got %v", endnote.References)
+	}
+
+	if data, _ := newNoteCollector().generateNotesJSON(); data != nil {
+		t.Errorf("Expected no map without notes, got %s", data)
+	}
+}
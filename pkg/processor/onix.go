@@ -0,0 +1,446 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"golang.org/x/text/language"
+)
+
+const (
+	// Largest ONIX record fetched from a URL
+	maxONIXBytes = 10 << 20
+	onixTimeout  = 30 * time.Second
+)
+
+// ONIXSource is a publisher-supplied ONIX 3.0 record (reference tags), given
+// either inline or as a URL to fetch
+type ONIXSource struct {
+	URL    string `json:"url,omitempty"`
+	Inline string `json:"inline,omitempty"`
+}
+
+// validate checks that exactly one of URL and Inline is set
+func (s *ONIXSource) validate() error {
+	if s == nil {
+		return nil
+	}
+	if (s.URL == "") == (s.Inline == "") {
+		return fmt.Errorf("onix requires exactly one of url or inline")
+	}
+	if s.URL != "" {
+		u, err := neturl.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid onix url %q: must be an absolute http(s) URL", s.URL)
+		}
+	}
+	return nil
+}
+
+// load returns the ONIX record, fetching it if needed
+func (s *ONIXSource) load() ([]byte, error) {
+	if s.Inline != "" {
+		return []byte(s.Inline), nil
+	}
+
+	client := NewHTTPClient(onixTimeout)
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch ONIX record: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch ONIX record: status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxONIXBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ONIX record: %w", err)
+	}
+	if len(data) > maxONIXBytes {
+		return nil, fmt.Errorf("ONIX record exceeds %d bytes", maxONIXBytes)
+	}
+	return data, nil
+}
+
+// onixMessage is the subset of an ONIX 3.0 message we merge into the manifest
+type onixMessage struct {
+	Products []onixProduct `xml:"Product"`
+}
+
+type onixProduct struct {
+	Identifiers []struct {
+		Type  string `xml:"ProductIDType"`
+		Value string `xml:"IDValue"`
+	} `xml:"ProductIdentifier"`
+	Descriptive struct {
+		Titles       []onixTitleDetail `xml:"TitleDetail"`
+		Collections  []onixCollection  `xml:"Collection"`
+		Contributors []onixContributor `xml:"Contributor"`
+		Languages    []struct {
+			Role string `xml:"LanguageRole"`
+			Code string `xml:"LanguageCode"`
+		} `xml:"Language"`
+		Extents []struct {
+			Type  string `xml:"ExtentType"`
+			Value string `xml:"ExtentValue"`
+			Unit  string `xml:"ExtentUnit"`
+		} `xml:"Extent"`
+		Subjects []struct {
+			Scheme  string `xml:"SubjectSchemeIdentifier"`
+			Code    string `xml:"SubjectCode"`
+			Heading string `xml:"SubjectHeadingText"`
+		} `xml:"Subject"`
+	} `xml:"DescriptiveDetail"`
+	TextContents []struct {
+		Type string   `xml:"TextType"`
+		Text onixText `xml:"Text"`
+	} `xml:"CollateralDetail>TextContent"`
+	Publishing struct {
+		Publishers []struct {
+			Role string `xml:"PublishingRole"`
+			Name string `xml:"PublisherName"`
+		} `xml:"Publisher"`
+		Dates []struct {
+			Role string `xml:"PublishingDateRole"`
+			Date string `xml:"Date"`
+		} `xml:"PublishingDate"`
+	} `xml:"PublishingDetail"`
+	Prices []struct {
+		Type     string `xml:"PriceType"`
+		Amount   string `xml:"PriceAmount"`
+		Currency string `xml:"CurrencyCode"`
+	} `xml:"ProductSupply>SupplyDetail>Price"`
+}
+
+type onixTitleDetail struct {
+	Type     string `xml:"TitleType"`
+	Elements []struct {
+		Level      string `xml:"TitleElementLevel"`
+		PartNumber string `xml:"PartNumber"`
+		Text       string `xml:"TitleText"`
+		Prefix     string `xml:"TitlePrefix"`
+		WithoutFix string `xml:"TitleWithoutPrefix"`
+		Subtitle   string `xml:"Subtitle"`
+	} `xml:"TitleElement"`
+}
+
+type onixCollection struct {
+	Type   string            `xml:"CollectionType"`
+	Titles []onixTitleDetail `xml:"TitleDetail"`
+}
+
+type onixContributor struct {
+	Sequence     string   `xml:"SequenceNumber"`
+	Roles        []string `xml:"ContributorRole"`
+	PersonName   string   `xml:"PersonName"`
+	InvertedName string   `xml:"PersonNameInverted"`
+	Corporate    string   `xml:"CorporateName"`
+}
+
+// onixText is a TextContent text, either plain or (textformat 02, 03 or 05) markup
+type onixText struct {
+	Format string `xml:"textformat,attr"`
+	Inner  string `xml:",innerxml"`
+}
+
+// onixContributorRoles maps ONIX contributor role codes (list 17) to the
+// manifest contributor list; other roles go to contributors with the code as role
+var onixContributorRoles = map[string]string{
+	"A01": "aut", "A12": "ill", "A36": "art", "B01": "edt", "B06": "trl", "E07": "nrt",
+}
+
+// onixSubjectSchemes maps ONIX subject scheme identifiers (list 26) to schemes
+var onixSubjectSchemes = map[string]string{
+	"10": subjectSchemeBISAC,
+	"93": subjectSchemeTHEMA, "94": subjectSchemeTHEMA, "95": subjectSchemeTHEMA,
+	"96": subjectSchemeTHEMA, "97": subjectSchemeTHEMA, "98": subjectSchemeTHEMA, "99": subjectSchemeTHEMA,
+}
+
+// parseONIX parses an ONIX 3.0 message and returns the product for isbn, or the
+// first product when none matches, with a warning
+func parseONIX(data []byte, isbn string) (*onixProduct, []string, error) {
+	var message onixMessage
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	if err := decoder.Decode(&message); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse ONIX record: %w", err)
+	}
+	if len(message.Products) == 0 {
+		return nil, nil, fmt.Errorf("ONIX record contains no product")
+	}
+
+	for i := range message.Products {
+		if isbn != "" && message.Products[i].isbn() == isbn {
+			return &message.Products[i], nil, nil
+		}
+	}
+	var warnings []string
+	if len(message.Products) > 1 || (isbn != "" && message.Products[0].isbn() != "") {
+		warnings = append(warnings, fmt.Sprintf("no ONIX product matches ISBN %q, using the first one", isbn))
+	}
+	return &message.Products[0], warnings, nil
+}
+
+// isbn returns the product ISBN from its ISBN-13 (ProductIDType 15), GTIN-13 (03)
+// or ISBN-10 (02) identifier
+func (p *onixProduct) isbn() string {
+	for _, id := range p.Identifiers {
+		if id.Type == "15" || id.Type == "03" || id.Type == "02" {
+			if isbn := normalizeISBN(id.Value); isbn != "" {
+				return isbn
+			}
+		}
+	}
+	return ""
+}
+
+// mergeONIX merges an ONIX product into the metadata. The publisher's record is
+// authoritative for contributors, description, publisher and publication date;
+// subjects are added to the EPUB's, and the title, language, series and page
+// count only fill gaps. Prices go to metadata.price.
+func mergeONIX(metadata *manifest.Metadata, product *onixProduct) {
+	descriptive := &product.Descriptive
+
+	for _, title := range descriptive.Titles {
+		if title.Type != "01" || len(title.Elements) == 0 {
+			continue
+		}
+		element := title.Elements[0]
+		name := strings.TrimSpace(element.Text)
+		if name == "" && element.WithoutFix != "" {
+			name = strings.TrimSpace(element.Prefix + " " + element.WithoutFix)
+		}
+		if metadata.LocalizedTitle.String() == "" && name != "" {
+			metadata.LocalizedTitle = manifest.NewLocalizedStringFromString(name)
+		}
+		if metadata.LocalizedSubtitle == nil && element.Subtitle != "" {
+			subtitle := manifest.NewLocalizedStringFromString(strings.TrimSpace(element.Subtitle))
+			metadata.LocalizedSubtitle = &subtitle
+		}
+		break
+	}
+
+	if len(descriptive.Contributors) > 0 {
+		mergeONIXContributors(metadata, descriptive.Contributors)
+	}
+
+	for _, s := range descriptive.Subjects {
+		var subjects []manifest.Subject
+		switch scheme := onixSubjectSchemes[s.Scheme]; {
+		case s.Scheme == "20": // keywords
+			for _, keyword := range strings.Split(s.Heading, ";") {
+				if keyword = strings.TrimSpace(keyword); keyword != "" {
+					subjects = append(subjects, manifest.Subject{LocalizedName: manifest.NewLocalizedStringFromString(keyword)})
+				}
+			}
+		case scheme != "" || s.Code != "":
+			if scheme == "" {
+				scheme = "onix:" + s.Scheme
+			}
+			name := strings.TrimSpace(s.Heading)
+			if name == "" {
+				name = strings.TrimSpace(s.Code)
+			}
+			subjects = append(subjects, manifest.Subject{
+				LocalizedName: manifest.NewLocalizedStringFromString(name),
+				Scheme:        scheme,
+				Code:          strings.TrimSpace(s.Code),
+			})
+		}
+		for _, subject := range subjects {
+			if !hasSubject(metadata.Subjects, subject) {
+				metadata.Subjects = append(metadata.Subjects, subject)
+			}
+		}
+	}
+
+	if len(metadata.Languages) == 0 {
+		for _, l := range descriptive.Languages {
+			if l.Role != "01" {
+				continue
+			}
+			if tag, err := language.Parse(strings.TrimSpace(l.Code)); err == nil {
+				metadata.Languages = manifest.Strings{tag.String()}
+				break
+			}
+		}
+	}
+
+	if len(metadata.BelongsTo["series"]) == 0 {
+		for _, c := range descriptive.Collections {
+			if c.Type != "10" || len(c.Titles) == 0 || len(c.Titles[0].Elements) == 0 {
+				continue
+			}
+			element := c.Titles[0].Elements[0]
+			if strings.TrimSpace(element.Text) == "" {
+				continue
+			}
+			if metadata.BelongsTo == nil {
+				metadata.BelongsTo = map[string]manifest.Collections{}
+			}
+			metadata.BelongsTo["series"] = manifest.Collections{{
+				LocalizedName: manifest.NewLocalizedStringFromString(strings.TrimSpace(element.Text)),
+				Position:      parsePosition(element.PartNumber),
+			}}
+			break
+		}
+	}
+
+	if metadata.NumberOfPages == nil {
+		for _, e := range descriptive.Extents {
+			// 00 main content page count, 11 content page count; unit 03 is pages
+			if (e.Type == "00" || e.Type == "11") && e.Unit == "03" {
+				if pages, err := strconv.ParseUint(strings.TrimSpace(e.Value), 10, 0); err == nil && pages > 0 {
+					n := uint(pages)
+					metadata.NumberOfPages = &n
+					break
+				}
+			}
+		}
+	}
+
+	// 03 is the full description, 02 the short one
+	for _, textType := range []string{"03", "02"} {
+		if description := product.text(textType); description != "" {
+			metadata.Description = description
+			break
+		}
+	}
+
+	for _, p := range product.Publishing.Publishers {
+		if (p.Role == "01" || p.Role == "") && strings.TrimSpace(p.Name) != "" {
+			metadata.Publishers = manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString(strings.TrimSpace(p.Name))}}
+			break
+		}
+	}
+
+	for _, d := range product.Publishing.Dates {
+		if d.Role != "01" {
+			continue
+		}
+		if published, ok := parseONIXDate(d.Date); ok {
+			metadata.Published = &published
+			break
+		}
+	}
+
+	var prices []map[string]interface{}
+	for _, p := range product.Prices {
+		amount, err := strconv.ParseFloat(strings.TrimSpace(p.Amount), 64)
+		if err != nil || p.Currency == "" {
+			continue
+		}
+		price := map[string]interface{}{"value": amount, "currency": strings.TrimSpace(p.Currency)}
+		if p.Type != "" {
+			price["type"] = p.Type
+		}
+		prices = append(prices, price)
+	}
+	if len(prices) > 0 {
+		if metadata.OtherMetadata == nil {
+			metadata.OtherMetadata = map[string]interface{}{}
+		}
+		metadata.OtherMetadata["price"] = prices
+	}
+}
+
+// mergeONIXContributors replaces the EPUB contributors with the ONIX ones, in
+// sequence number order
+func mergeONIXContributors(metadata *manifest.Metadata, contributors []onixContributor) {
+	sort.SliceStable(contributors, func(i, j int) bool {
+		a, errA := strconv.Atoi(contributors[i].Sequence)
+		b, errB := strconv.Atoi(contributors[j].Sequence)
+		return errA == nil && errB == nil && a < b
+	})
+
+	metadata.Authors, metadata.Translators, metadata.Editors = nil, nil, nil
+	metadata.Artists, metadata.Illustrators, metadata.Narrators, metadata.Contributors = nil, nil, nil, nil
+
+	for _, c := range contributors {
+		contributor := manifest.Contributor{}
+		name := strings.TrimSpace(c.PersonName)
+		if inverted := strings.TrimSpace(c.InvertedName); inverted != "" {
+			if name == "" {
+				if displayName, ok := uninvertName(inverted); ok {
+					name = displayName
+				} else {
+					name = inverted
+				}
+			}
+			sortAs := manifest.NewLocalizedStringFromString(inverted)
+			contributor.LocalizedSortAs = &sortAs
+		}
+		if name == "" {
+			name = strings.TrimSpace(c.Corporate)
+		}
+		if name == "" {
+			continue
+		}
+		contributor.LocalizedName = manifest.NewLocalizedStringFromString(name)
+
+		for _, code := range c.Roles {
+			code = strings.TrimSpace(code)
+			if list := contributorsForRole(metadata, onixContributorRoles[code]); list != nil {
+				*list = append(*list, contributor)
+				continue
+			}
+			other := contributor
+			other.Roles = manifest.Strings{"onix:" + code}
+			metadata.Contributors = append(metadata.Contributors, other)
+		}
+	}
+}
+
+// text returns the TextContent of the given type as plain text or HTML
+func (p *onixProduct) text(textType string) string {
+	for _, t := range p.TextContents {
+		if t.Type != textType {
+			continue
+		}
+		inner := strings.TrimSpace(t.Text.Inner)
+		if strings.HasPrefix(inner, "<![CDATA[") {
+			return strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(inner, "<![CDATA["), "]]>"))
+		}
+		switch t.Text.Format {
+		case "02", "03", "05": // HTML, XML, XHTML
+			return inner
+		}
+		return strings.TrimSpace(html.UnescapeString(inner))
+	}
+	return ""
+}
+
+// hasSubject reports whether subjects already has the subject, by code or name
+func hasSubject(subjects []manifest.Subject, subject manifest.Subject) bool {
+	for _, s := range subjects {
+		if subject.Code != "" && s.Code == subject.Code && s.Scheme == subject.Scheme {
+			return true
+		}
+		if strings.EqualFold(s.LocalizedName.String(), subject.LocalizedName.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseONIXDate parses an ONIX date, YYYYMMDD by default
+func parseONIXDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{"20060102", "200601"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return parseLooseDate(value)
+}
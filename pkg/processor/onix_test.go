@@ -0,0 +1,156 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+const testONIX = `<?xml version="1.0" encoding="UTF-8"?>
+<ONIXMessage release="3.0" xmlns="http://ns.editeur.org/onix/3.0/reference">
+  <Header><Sender><SenderName>Example</SenderName></Sender></Header>
+  <Product>
+    <ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9780000000002</IDValue></ProductIdentifier>
+    <DescriptiveDetail>
+      <TitleDetail><TitleType>01</TitleType><TitleElement><TitleElementLevel>01</TitleElementLevel><TitleText>Other Book</TitleText></TitleElement></TitleDetail>
+    </DescriptiveDetail>
+  </Product>
+  <Product>
+    <ProductIdentifier><ProductIDType>15</ProductIDType><IDValue>9780316129084</IDValue></ProductIdentifier>
+    <DescriptiveDetail>
+      <TitleDetail><TitleType>01</TitleType><TitleElement><TitleElementLevel>01</TitleElementLevel><TitleText>Leviathan Wakes</TitleText><Subtitle>Book One of the Expanse</Subtitle></TitleElement></TitleDetail>
+      <Collection><CollectionType>10</CollectionType><TitleDetail><TitleType>01</TitleType><TitleElement><TitleElementLevel>02</TitleElementLevel><PartNumber>1</PartNumber><TitleText>The Expanse</TitleText></TitleElement></TitleDetail></Collection>
+      <Contributor><SequenceNumber>2</SequenceNumber><ContributorRole>E07</ContributorRole><PersonName>Jefferson Mays</PersonName></Contributor>
+      <Contributor><SequenceNumber>1</SequenceNumber><ContributorRole>A01</ContributorRole><PersonNameInverted>Corey, James</PersonNameInverted></Contributor>
+      <Contributor><SequenceNumber>3</SequenceNumber><ContributorRole>A36</ContributorRole><ContributorRole>Z99</ContributorRole><CorporateName>Cover Studio</CorporateName></Contributor>
+      <Language><LanguageRole>01</LanguageRole><LanguageCode>eng</LanguageCode></Language>
+      <Extent><ExtentType>00</ExtentType><ExtentValue>592</ExtentValue><ExtentUnit>03</ExtentUnit></Extent>
+      <Subject><MainSubject/><SubjectSchemeIdentifier>10</SubjectSchemeIdentifier><SubjectCode>FIC028010</SubjectCode><SubjectHeadingText>FICTION / Science Fiction / Action &amp; Adventure</SubjectHeadingText></Subject>
+      <Subject><SubjectSchemeIdentifier>93</SubjectSchemeIdentifier><SubjectCode>FLS</SubjectCode></Subject>
+      <Subject><SubjectSchemeIdentifier>20</SubjectSchemeIdentifier><SubjectHeadingText>space opera; Science Fiction</SubjectHeadingText></Subject>
+    </DescriptiveDetail>
+    <CollateralDetail>
+      <TextContent><TextType>02</TextType><ContentAudience>00</ContentAudience><Text>Short.</Text></TextContent>
+      <TextContent><TextType>03</TextType><ContentAudience>00</ContentAudience><Text textformat="05"><p>Humanity has <em>colonized</em> the solar system.</p></Text></TextContent>
+    </CollateralDetail>
+    <PublishingDetail>
+      <Publisher><PublishingRole>01</PublishingRole><PublisherName>Orbit</PublisherName></Publisher>
+      <PublishingDate><PublishingDateRole>01</PublishingDateRole><Date>20110602</Date></PublishingDate>
+    </PublishingDetail>
+    <ProductSupply><SupplyDetail>
+      <Price><PriceType>01</PriceType><PriceAmount>9.99</PriceAmount><CurrencyCode>USD</CurrencyCode></Price>
+      <Price><PriceType>02</PriceType><PriceAmount>8.49</PriceAmount><CurrencyCode>GBP</CurrencyCode></Price>
+    </SupplyDetail></ProductSupply>
+  </Product>
+</ONIXMessage>`
+
+func TestParseONIXSelectsProductByISBN(t *testing.T) {
+	product, warnings, err := parseONIX([]byte(testONIX), "9780316129084")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if product.isbn() != "9780316129084" || len(warnings) != 0 {
+		t.Errorf("Expected matching product without warnings, got %s and %v", product.isbn(), warnings)
+	}
+
+	product, warnings, err = parseONIX([]byte(testONIX), "9781234567897")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if product.isbn() != "9780000000002" || len(warnings) != 1 {
+		t.Errorf("Expected first product with a warning, got %s and %v", product.isbn(), warnings)
+	}
+
+	if _, _, err := parseONIX([]byte(`<ONIXMessage></ONIXMessage>`), ""); err == nil {
+		t.Error("Expected an error for a message without products")
+	}
+}
+
+func TestMergeONIX(t *testing.T) {
+	product, _, err := parseONIX([]byte(testONIX), "9780316129084")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	metadata := manifest.Metadata{
+		LocalizedTitle: manifest.NewLocalizedStringFromString("Leviathan Wakes (EPUB)"),
+		Authors:        manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Unknown")}},
+		Description:    "From the EPUB",
+		Subjects:       []manifest.Subject{{LocalizedName: manifest.NewLocalizedStringFromString("science fiction")}},
+	}
+	mergeONIX(&metadata, product)
+
+	if metadata.LocalizedTitle.String() != "Leviathan Wakes (EPUB)" {
+		t.Errorf("Expected the EPUB title to be kept, got %q", metadata.LocalizedTitle.String())
+	}
+	if metadata.LocalizedSubtitle == nil || metadata.LocalizedSubtitle.String() != "Book One of the Expanse" {
+		t.Errorf("Expected subtitle from ONIX, got %v", metadata.LocalizedSubtitle)
+	}
+	if len(metadata.Authors) != 1 || metadata.Authors[0].Name() != "James Corey" || metadata.Authors[0].LocalizedSortAs.String() != "Corey, James" {
+		t.Errorf("Expected ONIX author James Corey, got %+v", metadata.Authors)
+	}
+	if len(metadata.Narrators) != 1 || metadata.Narrators[0].Name() != "Jefferson Mays" {
+		t.Errorf("Expected narrator Jefferson Mays, got %+v", metadata.Narrators)
+	}
+	if len(metadata.Artists) != 1 || len(metadata.Contributors) != 1 || metadata.Contributors[0].Roles[0] != "onix:Z99" {
+		t.Errorf("Expected cover artist and a contributor with role onix:Z99, got %+v and %+v", metadata.Artists, metadata.Contributors)
+	}
+	if len(metadata.Languages) != 1 || metadata.Languages[0] != "en" {
+		t.Errorf("Expected language en, got %v", metadata.Languages)
+	}
+	if metadata.NumberOfPages == nil || *metadata.NumberOfPages != 592 {
+		t.Errorf("Expected 592 pages, got %v", metadata.NumberOfPages)
+	}
+	if series := metadata.BelongsTo["series"]; len(series) != 1 || series[0].Name() != "The Expanse" || *series[0].Position != 1 {
+		t.Errorf("Expected series The Expanse #1, got %+v", series)
+	}
+	if metadata.Description != "<p>Humanity has <em>colonized</em> the solar system.</p>" {
+		t.Errorf("Expected the ONIX HTML description, got %q", metadata.Description)
+	}
+	if len(metadata.Publishers) != 1 || metadata.Publishers[0].Name() != "Orbit" {
+		t.Errorf("Expected publisher Orbit, got %+v", metadata.Publishers)
+	}
+	if metadata.Published == nil || metadata.Published.Format("2006-01-02") != "2011-06-02" {
+		t.Errorf("Expected publication date 2011-06-02, got %v", metadata.Published)
+	}
+
+	expectedSubjects := []struct{ name, scheme, code string }{
+		{"science fiction", "", ""},
+		{"FICTION / Science Fiction / Action & Adventure", "BISAC", "FIC028010"},
+		{"FLS", "THEMA", "FLS"},
+		{"space opera", "", ""},
+	}
+	if len(metadata.Subjects) != len(expectedSubjects) {
+		t.Fatalf("Expected %d subjects, got %+v", len(expectedSubjects), metadata.Subjects)
+	}
+	for i, e := range expectedSubjects {
+		s := metadata.Subjects[i]
+		if s.LocalizedName.String() != e.name || s.Scheme != e.scheme || s.Code != e.code {
+			t.Errorf("Expected subject %d to be %s (%s %s), got %s (%s %s)", i, e.name, e.scheme, e.code, s.LocalizedName.String(), s.Scheme, s.Code)
+		}
+	}
+
+	prices, _ := metadata.OtherMetadata["price"].([]map[string]interface{})
+	if len(prices) != 2 || prices[0]["value"] != 9.99 || prices[0]["currency"] != "USD" {
+		t.Errorf("Expected two prices starting with 9.99 USD, got %v", metadata.OtherMetadata["price"])
+	}
+}
+
+func TestONIXSourceValidate(t *testing.T) {
+	tests := []struct {
+		source  *ONIXSource
+		wantErr bool
+	}{
+		{nil, false},
+		{&ONIXSource{Inline: testONIX}, false},
+		{&ONIXSource{URL: "https://feeds.example.com/onix.xml"}, false},
+		{&ONIXSource{}, true},
+		{&ONIXSource{URL: "https://feeds.example.com/onix.xml", Inline: testONIX}, true},
+		{&ONIXSource{URL: "file:///etc/passwd"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.source.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Expected error %v for %+v, got %v", tt.wantErr, tt.source, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const containerPath = "META-INF/container.xml"
+
+// ocfContainer is META-INF/container.xml
+type ocfContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+// opfPackage is the subset of the OPF package document we inspect directly,
+// for information the Readium parser doesn't expose
+type opfPackage struct {
+	Version  string        `xml:"version,attr"`
+	Metadata opfMetadata   `xml:"metadata"`
+	Manifest []opfItem     `xml:"manifest>item"`
+	Spine    opfSpine      `xml:"spine"`
+	Guide    []opfGuideRef `xml:"guide>reference"`
+}
+
+type opfMetadata struct {
+	Elements []opfMetaElement `xml:",any"`
+}
+
+// opfMetaElement is any element inside <metadata>: dc:* elements and <meta>
+type opfMetaElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Value   string     `xml:",chardata"`
+}
+
+type opfItem struct {
+	ID         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+	Fallback   string `xml:"fallback,attr"`
+}
+
+type opfSpine struct {
+	Toc                      string       `xml:"toc,attr"`
+	Itemrefs                 []opfItemref `xml:"itemref"`
+	PageProgressionDirection string       `xml:"page-progression-direction,attr"`
+}
+
+type opfItemref struct {
+	ID         string `xml:"id,attr"`
+	IDRef      string `xml:"idref,attr"`
+	Linear     string `xml:"linear,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type opfGuideRef struct {
+	Type  string `xml:"type,attr"`
+	Title string `xml:"title,attr"`
+	Href  string `xml:"href,attr"`
+}
+
+// epubPackage is an opened EPUB archive with its parsed package document
+type epubPackage struct {
+	entries map[string]*zip.File
+	opfPath string
+	opf     *opfPackage
+}
+
+// openEPUBPackage locates and parses the package document of an EPUB archive
+func openEPUBPackage(zipReader *zip.Reader) (*epubPackage, error) {
+	p := &epubPackage{entries: zipEntries(zipReader)}
+
+	containerData, err := readZipEntry(p.entries[containerPath])
+	if err != nil {
+		return nil, err
+	}
+	if containerData == nil {
+		return nil, fmt.Errorf("%s is missing", containerPath)
+	}
+
+	var container ocfContainer
+	if err := xml.Unmarshal(bytes.TrimPrefix(containerData, utf8BOM), &container); err != nil {
+		return nil, fmt.Errorf("%s is not well-formed: %w", containerPath, err)
+	}
+	if len(container.Rootfiles) == 0 || container.Rootfiles[0].FullPath == "" {
+		return nil, fmt.Errorf("%s declares no rootfile", containerPath)
+	}
+	p.opfPath = container.Rootfiles[0].FullPath
+
+	opfData, err := readZipEntry(p.entries[p.opfPath])
+	if err != nil {
+		return nil, err
+	}
+	if opfData == nil {
+		return nil, fmt.Errorf("package document %s is missing", p.opfPath)
+	}
+
+	p.opf = &opfPackage{}
+	if err := xml.Unmarshal(bytes.TrimPrefix(opfData, utf8BOM), p.opf); err != nil {
+		return nil, fmt.Errorf("package document %s is not well-formed: %w", p.opfPath, err)
+	}
+	return p, nil
+}
+
+// resolve returns the archive path of an href relative to the package document
+func (p *epubPackage) resolve(href string) string {
+	return resolveArchiveHref(href, p.opfPath)
+}
+
+// itemByID returns the manifest item with the given id, or nil
+func (p *epubPackage) itemByID(id string) *opfItem {
+	for i := range p.opf.Manifest {
+		if p.opf.Manifest[i].ID == id {
+			return &p.opf.Manifest[i]
+		}
+	}
+	return nil
+}
+
+// metaElements returns the metadata elements with the given local name (e.g. "subject")
+func (p *epubPackage) metaElements(localName string) []opfMetaElement {
+	var elements []opfMetaElement
+	for _, e := range p.opf.Metadata.Elements {
+		if e.XMLName.Local == localName {
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
+// refinements returns the EPUB 3 <meta refines="#id" property="..."> values,
+// keyed by the refined element id and then by property
+func (p *epubPackage) refinements() map[string]map[string]string {
+	refinements := map[string]map[string]string{}
+	for _, e := range p.metaElements("meta") {
+		if refines := strings.TrimPrefix(e.attr("refines"), "#"); refines != "" {
+			if refinements[refines] == nil {
+				refinements[refines] = map[string]string{}
+			}
+			refinements[refines][e.attr("property")] = strings.TrimSpace(e.Value)
+		}
+	}
+	return refinements
+}
+
+// attr returns the value of an attribute by local name, or ""
+func (e opfMetaElement) attr(localName string) string {
+	for _, a := range e.Attrs {
+		if a.Name.Local == localName {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// zipEntries indexes archive entries by name
+func zipEntries(zipReader *zip.Reader) map[string]*zip.File {
+	entries := make(map[string]*zip.File, len(zipReader.File))
+	for _, f := range zipReader.File {
+		entries[f.Name] = f
+	}
+	return entries
+}
+
+// resolveArchiveHref resolves an href found in the document at fromPath to an
+// archive entry path, dropping any fragment or query and decoding %-escapes.
+// Returns "" for external or non-resource references.
+func resolveArchiveHref(href, fromPath string) string {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") || isExternalHref(href) {
+		return ""
+	}
+	if idx := strings.IndexAny(href, "#?"); idx >= 0 {
+		href = href[:idx]
+	}
+	if decoded, err := url.PathUnescape(href); err == nil {
+		href = decoded
+	}
+	if strings.HasPrefix(href, "/") {
+		return strings.TrimPrefix(path.Clean(href), "/")
+	}
+	return resolveRelativePath(href, getDirectoryFromHref(fromPath))
+}
+
+// isExternalHref reports whether href has a URL scheme (http:, mailto:, data:, ...)
+func isExternalHref(href string) bool {
+	colon := strings.Index(href, ":")
+	if colon <= 0 {
+		return false
+	}
+	slash := strings.IndexAny(href, "/?#")
+	return slash < 0 || colon < slash
+}
@@ -0,0 +1,115 @@
+package processor
+
+import (
+	"fmt"
+	neturl "net/url"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+	"github.com/readium/go-toolkit/pkg/util/url"
+	"golang.org/x/text/language"
+)
+
+// MetadataOverrides replaces parsed EPUB metadata in the generated manifest,
+// for fixing publisher metadata without repackaging the EPUB. Empty fields
+// leave the EPUB value alone.
+type MetadataOverrides struct {
+	Title          string   `json:"title,omitempty"`
+	Authors        []string `json:"authors,omitempty"`
+	Language       string   `json:"language,omitempty"`
+	Description    string   `json:"description,omitempty"`
+	Series         string   `json:"series,omitempty"`
+	SeriesPosition *float64 `json:"series_position,omitempty"`
+	// CoverURL points at an external cover image that replaces the EPUB cover
+	CoverURL string `json:"cover_url,omitempty"`
+}
+
+// validate checks the overrides that could produce an invalid manifest
+func (o *MetadataOverrides) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Language != "" {
+		if _, err := language.Parse(o.Language); err != nil {
+			return fmt.Errorf("invalid metadata language %q", o.Language)
+		}
+	}
+	if o.CoverURL != "" {
+		u, err := neturl.Parse(o.CoverURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid metadata cover_url %q: must be an absolute http(s) URL", o.CoverURL)
+		}
+	}
+	if o.SeriesPosition != nil && o.Series == "" {
+		return fmt.Errorf("metadata series_position requires series")
+	}
+	return nil
+}
+
+// applyMetadataOverrides merges the overrides over the manifest metadata.
+// A cover URL replaces the cover rel of any EPUB resource with an external link.
+func applyMetadataOverrides(m *manifest.Manifest, o *MetadataOverrides) error {
+	if o == nil {
+		return nil
+	}
+	metadata := &m.Metadata
+
+	if o.Title != "" {
+		metadata.LocalizedTitle = manifest.NewLocalizedStringFromString(o.Title)
+		metadata.LocalizedSortAs = nil
+	}
+	if len(o.Authors) > 0 {
+		metadata.Authors = make(manifest.Contributors, 0, len(o.Authors))
+		for _, author := range o.Authors {
+			metadata.Authors = append(metadata.Authors, manifest.Contributor{LocalizedName: manifest.NewLocalizedStringFromString(author)})
+		}
+	}
+	if o.Language != "" {
+		tag, _ := language.Parse(o.Language)
+		metadata.Languages = manifest.Strings{tag.String()}
+	}
+	if o.Description != "" {
+		metadata.Description = o.Description
+	}
+	if o.Series != "" {
+		if metadata.BelongsTo == nil {
+			metadata.BelongsTo = map[string]manifest.Collections{}
+		}
+		metadata.BelongsTo["series"] = manifest.Collections{{
+			LocalizedName: manifest.NewLocalizedStringFromString(o.Series),
+			Position:      o.SeriesPosition,
+		}}
+	}
+
+	if o.CoverURL != "" {
+		coverURL, err := url.URLFromString(o.CoverURL)
+		if err != nil {
+			return fmt.Errorf("invalid cover URL: %w", err)
+		}
+		removeRel(m.Resources, "cover")
+		removeRel(m.Links, "cover")
+		cover := manifest.Link{Href: manifest.NewHREF(coverURL), Rels: manifest.Strings{"cover"}}
+		parsed, _ := neturl.Parse(o.CoverURL)
+		if contentType := getContentType(parsed.Path); strings.HasPrefix(contentType, "image/") {
+			if mt, err := mediatype.NewOfString(contentType); err == nil {
+				cover.MediaType = &mt
+			}
+		}
+		m.Links = append(m.Links, cover)
+	}
+	return nil
+}
+
+// removeRel drops a rel from every link in the list
+func removeRel(links manifest.LinkList, rel string) {
+	for i := range links {
+		rels := links[i].Rels[:0]
+		for _, r := range links[i].Rels {
+			if r != rel {
+				rels = append(rels, r)
+			}
+		}
+		links[i].Rels = rels
+	}
+}
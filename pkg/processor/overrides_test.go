@@ -0,0 +1,83 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestMetadataOverrides_Validate(t *testing.T) {
+	position := 2.0
+	tests := []struct {
+		name      string
+		overrides *MetadataOverrides
+		wantErr   bool
+	}{
+		{"nil", nil, false},
+		{"valid", &MetadataOverrides{Language: "en-gb", CoverURL: "https://cdn.example.com/cover.jpg"}, false},
+		{"bad language", &MetadataOverrides{Language: "not a language"}, true},
+		{"relative cover", &MetadataOverrides{CoverURL: "images/cover.jpg"}, true},
+		{"position without series", &MetadataOverrides{SeriesPosition: &position}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.overrides.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Expected error %t, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestApplyMetadataOverrides(t *testing.T) {
+	sortAs := manifest.NewLocalizedStringFromString("Wrong Title, The")
+	coverLink := testLink(t, "OEBPS/Images/cover.jpg")
+	coverLink.Rels = manifest.Strings{"cover"}
+	m := manifest.Manifest{
+		Metadata: manifest.Metadata{
+			LocalizedTitle:  manifest.NewLocalizedStringFromString("The Wrong Title"),
+			LocalizedSortAs: &sortAs,
+			Authors:         manifest.Contributors{{LocalizedName: manifest.NewLocalizedStringFromString("Publisher Staff")}},
+			Languages:       manifest.Strings{"en"},
+			Description:     "Original description",
+		},
+		Resources: manifest.LinkList{coverLink},
+	}
+	position := 3.0
+
+	err := applyMetadataOverrides(&m, &MetadataOverrides{
+		Title:          "The Right Title",
+		Authors:        []string{"Jane Doe", "John Roe"},
+		Language:       "fr-ca",
+		Series:         "The Series",
+		SeriesPosition: &position,
+		CoverURL:       "https://cdn.example.com/covers/book.png",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if m.Metadata.LocalizedTitle.String() != "The Right Title" || m.Metadata.LocalizedSortAs != nil {
+		t.Errorf("Expected title override and no stale sortAs, got %q, %v", m.Metadata.LocalizedTitle.String(), m.Metadata.LocalizedSortAs)
+	}
+	if len(m.Metadata.Authors) != 2 || m.Metadata.Authors[1].LocalizedName.String() != "John Roe" {
+		t.Errorf("Expected authors override, got %v", m.Metadata.Authors)
+	}
+	if len(m.Metadata.Languages) != 1 || m.Metadata.Languages[0] != "fr-CA" {
+		t.Errorf("Expected normalized language override, got %v", m.Metadata.Languages)
+	}
+	if m.Metadata.Description != "Original description" {
+		t.Errorf("Expected description to be kept, got %q", m.Metadata.Description)
+	}
+	series := m.Metadata.BelongsTo["series"]
+	if len(series) != 1 || series[0].LocalizedName.String() != "The Series" || *series[0].Position != 3 {
+		t.Errorf("Expected series override, got %v", series)
+	}
+
+	if len(m.Resources[0].Rels) != 0 {
+		t.Errorf("Expected EPUB cover rel to be removed, got %v", m.Resources[0].Rels)
+	}
+	if len(m.Links) != 1 || m.Links[0].Href.String() != "https://cdn.example.com/covers/book.png" || m.Links[0].Rels[0] != "cover" {
+		t.Errorf("Expected external cover link, got %v", m.Links)
+	}
+	if m.Links[0].MediaType == nil || m.Links[0].MediaType.String() != "image/png" {
+		t.Errorf("Expected cover media type image/png, got %v", m.Links[0].MediaType)
+	}
+}
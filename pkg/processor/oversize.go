@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"archive/zip"
+	"fmt"
+	"sort"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// maxResourceBytesEnvVar sets the size above which resources are left out of
+// the output; unset or 0 leaves none out
+const maxResourceBytesEnvVar = "MAX_RESOURCE_BYTES"
+
+// maxResourceBytesFromEnv returns the size above which resources are skipped, or 0
+func maxResourceBytesFromEnv() uint64 {
+	maxBytes, _ := envUint(maxResourceBytesEnvVar)
+	return maxBytes
+}
+
+// OversizedResource is a resource left out of the output for its size
+type OversizedResource struct {
+	Path  string `json:"path"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// resourceSizeCap skips the resources larger than MAX_RESOURCE_BYTES, so that a
+// 700 MB embedded video doesn't stall the whole book. The skipped resources stay
+// in the manifest, with a note saying why their file is missing. A nil cap skips
+// nothing.
+type resourceSizeCap struct {
+	maxBytes uint64
+	entries  map[string]*zip.File
+	skipped  map[string]uint64 // href -> uncompressed size
+}
+
+// newResourceSizeCap returns a cap of maxBytes over the entries of an archive,
+// or nil for 0
+func newResourceSizeCap(entries map[string]*zip.File, maxBytes uint64) *resourceSizeCap {
+	if maxBytes == 0 {
+		return nil
+	}
+	return &resourceSizeCap{maxBytes: maxBytes, entries: entries, skipped: map[string]uint64{}}
+}
+
+// allows reports whether the resource at href is small enough to be extracted,
+// remembering the ones that aren't. The size comes from the archive headers, so
+// nothing is read to find out.
+func (c *resourceSizeCap) allows(href string) bool {
+	if c == nil {
+		return true
+	}
+	f := c.entries[resolveArchiveHref(href, "")]
+	if f == nil || f.UncompressedSize64 <= c.maxBytes {
+		return true
+	}
+	c.skipped[href] = f.UncompressedSize64
+	return false
+}
+
+// oversizedResources returns the skipped resources, sorted by path
+func (c *resourceSizeCap) oversizedResources() []OversizedResource {
+	if c == nil {
+		return nil
+	}
+	oversized := make([]OversizedResource, 0, len(c.skipped))
+	for href, size := range c.skipped {
+		oversized = append(oversized, OversizedResource{Path: resourceKey(href), Bytes: size})
+	}
+	sort.Slice(oversized, func(i, j int) bool { return oversized[i].Path < oversized[j].Path })
+	return oversized
+}
+
+// warnings returns a warning for each skipped resource
+func (c *resourceSizeCap) warnings() []string {
+	var warnings []string
+	for _, resource := range c.oversizedResources() {
+		warnings = append(warnings, fmt.Sprintf("skipped %s: %d bytes, more than %s (%d)", resource.Path, resource.Bytes, maxResourceBytesEnvVar, c.maxBytes))
+	}
+	return warnings
+}
+
+// apply notes on the manifest links of the skipped resources that their file
+// was left out, so readers can show a placeholder instead of a broken resource
+func (c *resourceSizeCap) apply(m *manifest.Manifest) {
+	if c == nil || len(c.skipped) == 0 {
+		return
+	}
+	update := func(links manifest.LinkList) {
+		for i := range links {
+			size, ok := c.skipped[links[i].Href.String()]
+			if !ok {
+				continue
+			}
+			if links[i].Properties == nil {
+				links[i].Properties = manifest.Properties{}
+			}
+			links[i].Properties["oversized"] = map[string]interface{}{"bytes": size, "limit": c.maxBytes}
+		}
+	}
+	update(m.ReadingOrder)
+	update(m.Resources)
+}
@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestResourceSizeCap(t *testing.T) {
+	entries := zipEntries(buildZip(t, map[string][]byte{
+		"OEBPS/chapter.xhtml": make([]byte, 1024),
+		"OEBPS/video.mp4":     make([]byte, 64<<10),
+	}))
+	sizeCap := newResourceSizeCap(entries, 32<<10)
+
+	if !sizeCap.allows("OEBPS/chapter.xhtml") {
+		t.Errorf("Expected a small resource to be allowed")
+	}
+	if !sizeCap.allows("OEBPS/missing.png") {
+		t.Errorf("Expected a resource without an entry to be left to the link checker")
+	}
+	if sizeCap.allows("OEBPS/video.mp4") {
+		t.Errorf("Expected a resource over the cap to be skipped")
+	}
+
+	want := []OversizedResource{{Path: "OEBPS/video.mp4", Bytes: 64 << 10}}
+	if got := sizeCap.oversizedResources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if warnings := sizeCap.warnings(); len(warnings) != 1 {
+		t.Errorf("Expected one warning, got %v", warnings)
+	}
+
+	m := manifest.Manifest{Resources: manifest.LinkList{testLink(t, "OEBPS/chapter.xhtml"), testLink(t, "OEBPS/video.mp4")}}
+	sizeCap.apply(&m)
+	if _, ok := m.Resources[0].Properties["oversized"]; ok {
+		t.Errorf("Expected no note on an extracted resource")
+	}
+	note, ok := m.Resources[1].Properties["oversized"].(map[string]interface{})
+	if !ok || note["bytes"] != uint64(64<<10) || note["limit"] != uint64(32<<10) {
+		t.Errorf("Expected a note with the size and the limit, got %v", m.Resources[1].Properties)
+	}
+}
+
+func TestResourceSizeCap_Disabled(t *testing.T) {
+	t.Setenv(maxResourceBytesEnvVar, "")
+	sizeCap := newResourceSizeCap(nil, maxResourceBytesFromEnv())
+	if sizeCap != nil {
+		t.Fatalf("Expected no cap without %s", maxResourceBytesEnvVar)
+	}
+	if !sizeCap.allows("OEBPS/video.mp4") || sizeCap.oversizedResources() != nil || sizeCap.warnings() != nil {
+		t.Errorf("Expected a nil cap to skip nothing")
+	}
+	sizeCap.apply(&manifest.Manifest{})
+}
+
+func TestEstimateMemory_IgnoresOversizedResources(t *testing.T) {
+	archive := buildZip(t, map[string][]byte{
+		"OEBPS/chapter.xhtml": make([]byte, 1<<20),
+		"OEBPS/video.mp4":     make([]byte, 8<<20),
+	})
+	if estimate, largest := estimateMemory(archive, 0); largest.Name != "OEBPS/video.mp4" || estimate != runtimeMemoryBytes+resourceCopies*8<<20 {
+		t.Errorf("Expected the video to decide, got %s (%d bytes)", largest.Name, estimate)
+	}
+	if _, largest := estimateMemory(archive, 4<<20); largest.Name != "OEBPS/chapter.xhtml" {
+		t.Errorf("Expected the skipped video not to count, got %s", largest.Name)
+	}
+}
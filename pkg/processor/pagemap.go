@@ -0,0 +1,175 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/pub"
+)
+
+const (
+	// pageMapPath is where the print page map is stored, relative to basePath
+	pageMapPath = "readium/page-map.json"
+	// pageListCollectionRole is the collection of the print page list of an EPUB
+	pageListCollectionRole = "pageList"
+)
+
+// pageMapEntry maps a print page of the page list to the position of its
+// anchor in positions.json, so readers can cite "print page 142"
+type pageMapEntry struct {
+	Page      string           `json:"page"`
+	Href      string           `json:"href"`
+	Locations pageMapLocations `json:"locations"`
+}
+
+type pageMapLocations struct {
+	Position         int     `json:"position"`
+	Progression      float64 `json:"progression"`
+	TotalProgression float64 `json:"totalProgression"`
+}
+
+// pageListLinks returns the links of the print page list of a publication
+func pageListLinks(m *manifest.Manifest) manifest.LinkList {
+	var links manifest.LinkList
+	for _, collection := range m.Subcollections[pageListCollectionRole] {
+		links = append(links, collection.Links...)
+	}
+	return links
+}
+
+// anchorOffsets returns the offsets in content of the elements with one of the
+// ids, by id. Older content marks page breaks with <a name>, which counts too.
+func anchorOffsets(content []byte, ids map[string]bool) map[string]int {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	offsets := map[string]int{}
+	for len(offsets) < len(ids) {
+		offset := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if t, ok := token.(xml.StartElement); ok {
+			attrs := accessibilityAttributes(t.Attr)
+			for _, id := range []string{attrs["id"], attrs["name"]} {
+				if _, seen := offsets[id]; id != "" && ids[id] && !seen {
+					offsets[id] = offset
+				}
+			}
+		}
+	}
+	return offsets
+}
+
+// buildPageMap locates each page of the page list in the positions of the
+// reading order, computed as generatePositionsJSON does: one position per 1024
+// characters of each document read with read. Returns a warning for each page
+// that can't be located exactly.
+func buildPageMap(pages, readingOrder manifest.LinkList, read func(link manifest.Link) ([]byte, error)) ([]pageMapEntry, []string) {
+	// The anchors to look for, by document
+	wanted := map[string]map[string]bool{}
+	for _, page := range pages {
+		base, fragment, _ := strings.Cut(page.Href.String(), "#")
+		key := resourceKey(base)
+		if wanted[key] == nil {
+			wanted[key] = map[string]bool{}
+		}
+		if fragment != "" {
+			wanted[key][fragment] = true
+		}
+	}
+
+	type document struct {
+		firstPosition  int
+		precedingChars int
+		charCount      int
+		numPositions   int
+		anchors        map[string]int
+	}
+	documents := map[string]*document{}
+	position, totalChars := 1, 0
+	for _, link := range readingOrder {
+		data, err := read(link)
+		if err != nil {
+			// positions.json has no position for it either
+			continue
+		}
+		key := resourceKey(link.Href.String())
+		doc := &document{firstPosition: position, precedingChars: totalChars, charCount: len(data), numPositions: positionCount(len(data))}
+		if len(wanted[key]) > 0 {
+			doc.anchors = anchorOffsets(data, wanted[key])
+		}
+		if _, ok := documents[key]; !ok {
+			documents[key] = doc
+		}
+		position += doc.numPositions
+		totalChars += doc.charCount
+	}
+
+	var entries []pageMapEntry
+	var warnings []string
+	for _, page := range pages {
+		href := page.Href.String()
+		base, fragment, _ := strings.Cut(href, "#")
+		doc, ok := documents[resourceKey(base)]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("page %s: %s is not in the reading order", page.Title, resourceKey(base)))
+			continue
+		}
+		offset := 0
+		if fragment != "" {
+			if offset, ok = doc.anchors[fragment]; !ok {
+				warnings = append(warnings, fmt.Sprintf("page %s: anchor #%s not found in %s, mapped to its start", page.Title, fragment, resourceKey(base)))
+			}
+		}
+
+		entry := pageMapEntry{Page: page.Title, Href: manifestHref(href), Locations: pageMapLocations{Position: doc.firstPosition}}
+		if doc.charCount > 0 {
+			index := offset * doc.numPositions / doc.charCount
+			if index >= doc.numPositions {
+				index = doc.numPositions - 1
+			}
+			entry.Locations.Position += index
+			entry.Locations.Progression = float64(offset) / float64(doc.charCount)
+		}
+		if totalChars > 0 {
+			entry.Locations.TotalProgression = float64(doc.precedingChars+offset) / float64(totalChars)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, warnings
+}
+
+// generatePageMapJSON returns the print page map of a publication with a page
+// list, or nil for one without, and the warnings of buildPageMap
+func generatePageMapJSON(publication *pub.Publication, m *manifest.Manifest) ([]byte, []string, error) {
+	pages := pageListLinks(m)
+	if len(pages) == 0 {
+		return nil, nil, nil
+	}
+	ctx := context.Background()
+	entries, warnings := buildPageMap(pages, m.ReadingOrder, func(link manifest.Link) ([]byte, error) {
+		resource := publication.Get(ctx, link)
+		defer resource.Close()
+		data, resErr := resource.Read(ctx, 0, 0)
+		if resErr != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", link.Href.String(), resErr)
+		}
+		return data, nil
+	})
+	if len(entries) == 0 {
+		return nil, warnings, nil
+	}
+	data, err := canonicalJSON(map[string]interface{}{"total": len(entries), "pages": entries})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode page map: %w", err)
+	}
+	return data, warnings, nil
+}
@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestAnchorOffsets(t *testing.T) {
+	content := `<html><body><p>Text</p><span id="p1"/><p>More</p><a name="p2"></a></body></html>`
+	offsets := anchorOffsets([]byte(content), map[string]bool{"p1": true, "p2": true, "p3": true})
+	if offsets["p1"] != strings.Index(content, `<span id="p1"`) {
+		t.Errorf("Expected p1 at its start tag, got %d", offsets["p1"])
+	}
+	if offsets["p2"] != strings.Index(content, `<a name="p2"`) {
+		t.Errorf("Expected p2 by its name, got %d", offsets["p2"])
+	}
+	if _, ok := offsets["p3"]; ok {
+		t.Error("Expected no offset for a missing anchor")
+	}
+}
+
+func TestBuildPageMap(t *testing.T) {
+	// 3000 characters: three positions, the anchor at 2100 is in the third
+	ch1 := `<html><body>` + strings.Repeat("a", 2088) + `<span id="page2"/>` + strings.Repeat("b", 882) + `</body></html>`
+	ch1 = ch1[:3000]
+	documents := map[string]string{
+		"OEBPS/cover.xhtml": "<html></html>",
+		"OEBPS/ch1.xhtml":   ch1,
+	}
+	read := func(link manifest.Link) ([]byte, error) {
+		if content, ok := documents[link.Href.String()]; ok {
+			return []byte(content), nil
+		}
+		return nil, errors.New("not found")
+	}
+	readingOrder := manifest.LinkList{testLink(t, "OEBPS/missing.xhtml"), testLink(t, "OEBPS/cover.xhtml"), testLink(t, "OEBPS/ch1.xhtml")}
+
+	page := func(href, title string) manifest.Link {
+		link := testLink(t, href)
+		link.Title = title
+		return link
+	}
+	pages := manifest.LinkList{
+		page("OEBPS/ch1.xhtml", "1"),
+		page("OEBPS/ch1.xhtml#page2", "2"),
+		page("OEBPS/ch1.xhtml#page3", "3"),
+		page("OEBPS/notes.xhtml#page4", "4"),
+	}
+	entries, warnings := buildPageMap(pages, readingOrder, read)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 pages, got %+v", entries)
+	}
+	if entries[0].Page != "1" || entries[0].Locations.Position != 2 || entries[0].Locations.Progression != 0 {
+		t.Errorf("Expected page 1 at the first position of ch1, got %+v", entries[0])
+	}
+	offset := strings.Index(ch1, `<span id="page2"`)
+	if entries[1].Href != "OEBPS/ch1.xhtml#page2" || entries[1].Locations.Position != 4 {
+		t.Errorf("Expected page 2 at the third position of ch1, got %+v", entries[1])
+	}
+	if want := float64(offset) / 3000; entries[1].Locations.Progression != want {
+		t.Errorf("Expected a progression of %v, got %v", want, entries[1].Locations.Progression)
+	}
+	if want := float64(13+offset) / 3013; entries[1].Locations.TotalProgression != want {
+		t.Errorf("Expected a total progression of %v, got %v", want, entries[1].Locations.TotalProgression)
+	}
+	if entries[2].Locations.Position != 2 {
+		t.Errorf("Expected a page with a missing anchor at the start of its document, got %+v", entries[2])
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "#page3") || !strings.Contains(warnings[1], "not in the reading order") {
+		t.Errorf("Expected warnings for the missing anchor and document, got %v", warnings)
+	}
+}
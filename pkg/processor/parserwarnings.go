@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// ParserWarning is a problem the Readium parser worked around rather than
+// failing on, such as missing metadata or an unreadable navigation document
+type ParserWarning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+}
+
+// String formats the warning for the logs
+func (w ParserWarning) String() string {
+	if w.Path == "" {
+		return fmt.Sprintf("%s: %s", w.Code, w.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", w.Code, w.Message, w.Path)
+}
+
+// parserWarnings reports the fallbacks the Readium parser took while parsing
+// the EPUB into m. The go-toolkit discards them silently, so they are found by
+// comparing its output with the package document. pkg may be nil, in which
+// case only the parsed metadata is checked.
+func parserWarnings(m *manifest.Manifest, pkg *epubPackage, epubFilename string) []ParserWarning {
+	var warnings []ParserWarning
+	add := func(code, path, format string, args ...interface{}) {
+		warnings = append(warnings, ParserWarning{Code: code, Message: fmt.Sprintf(format, args...), Path: path})
+	}
+
+	opfPath := ""
+	if pkg != nil {
+		opfPath = pkg.opfPath
+	}
+	if pkg != nil && !slices.ContainsFunc(pkg.metaElements("title"), func(e opfMetaElement) bool { return strings.TrimSpace(e.Value) != "" }) {
+		add("missing-title", opfPath, "package document has no dc:title; titled the publication %q after the filename", epubFilename)
+	}
+	if m.Metadata.Identifier == "" {
+		add("missing-identifier", opfPath, "package document has no usable dc:identifier; obfuscated fonts cannot be deobfuscated")
+	}
+	if len(m.Metadata.Languages) == 0 {
+		add("missing-language", opfPath, "package document has no dc:language")
+	}
+	if pkg == nil {
+		return warnings
+	}
+
+	for _, itemref := range pkg.opf.Spine.Itemrefs {
+		switch {
+		case pkg.itemByID(itemref.IDRef) == nil:
+			add("unknown-spine-item", opfPath, "spine item %q matches no manifest item; left out of the reading order", itemref.IDRef)
+		case itemref.Linear == "no":
+			add("non-linear-spine-item", opfPath, "spine item %q is non-linear; listed as a resource instead of in the reading order", itemref.IDRef)
+		}
+	}
+
+	// The parser reads the table of contents from the navigation document of
+	// EPUB 3, and from the NCX of earlier versions
+	version, err := strconv.ParseFloat(pkg.opf.Version, 64)
+	if pkg.opf.Version == "" || err != nil {
+		version = 1.2
+	}
+	var navItem *opfItem
+	if version >= 3 {
+		for i, item := range pkg.opf.Manifest {
+			if slices.Contains(strings.Fields(item.Properties), "nav") {
+				navItem = &pkg.opf.Manifest[i]
+				break
+			}
+		}
+		if navItem == nil {
+			add("missing-nav", opfPath, "package document declares no navigation document")
+		}
+	} else {
+		if pkg.opf.Spine.Toc != "" {
+			navItem = pkg.itemByID(pkg.opf.Spine.Toc)
+			if navItem == nil {
+				add("unknown-ncx", opfPath, "spine toc %q matches no manifest item", pkg.opf.Spine.Toc)
+			}
+		} else {
+			for i, item := range pkg.opf.Manifest {
+				if item.MediaType == "application/x-dtbncx+xml" {
+					navItem = &pkg.opf.Manifest[i]
+					break
+				}
+			}
+			if navItem == nil {
+				add("missing-ncx", opfPath, "package document declares no NCX")
+			}
+		}
+	}
+	if navItem != nil && len(m.TableOfContents) == 0 {
+		navPath := pkg.resolve(navItem.Href)
+		if pkg.entries[navPath] == nil {
+			add("missing-nav-document", navPath, "navigation document is missing from the archive")
+		} else {
+			add("malformed-nav", navPath, "navigation document has no readable table of contents")
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,80 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestParserWarnings(t *testing.T) {
+	pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+		containerPath: validContainer,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title> </dc:title>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="cover" linear="no"/><itemref idref="ch1"/><itemref idref="ghost"/></spine>
+</package>`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><nav/></body></html>`,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open package: %v", err)
+	}
+
+	warnings := parserWarnings(&manifest.Manifest{}, pkg, "books/untitled.epub")
+	var codes []string
+	for _, warning := range warnings {
+		codes = append(codes, warning.Code)
+	}
+	want := []string{"missing-title", "missing-identifier", "missing-language", "non-linear-spine-item", "unknown-spine-item", "malformed-nav"}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("Expected %v, got %v", want, codes)
+	}
+	if last := warnings[len(warnings)-1]; last.Path != "OEBPS/nav.xhtml" {
+		t.Errorf("Expected the navigation document path, got %q", last.Path)
+	}
+}
+
+func TestParserWarnings_NCX(t *testing.T) {
+	opf := func(spine string) *epubPackage {
+		pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+			containerPath: validContainer,
+			"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Moby-Dick</dc:title></metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+    <item id="ch1" href="ch1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  ` + spine + `
+</package>`,
+		}))
+		if err != nil {
+			t.Fatalf("Failed to open package: %v", err)
+		}
+		return pkg
+	}
+	parsed := &manifest.Manifest{Metadata: manifest.Metadata{Identifier: "urn:isbn:9780000000000", Languages: []string{"en"}}}
+
+	warnings := parserWarnings(parsed, opf(`<spine toc="missing"><itemref idref="ch1"/></spine>`), "moby-dick.epub")
+	if len(warnings) != 1 || warnings[0].Code != "unknown-ncx" {
+		t.Errorf("Expected an unknown-ncx warning, got %+v", warnings)
+	}
+
+	warnings = parserWarnings(parsed, opf(`<spine><itemref idref="ch1"/></spine>`), "moby-dick.epub")
+	if len(warnings) != 1 || warnings[0].Code != "missing-nav-document" || warnings[0].Path != "OEBPS/toc.ncx" {
+		t.Errorf("Expected a missing-nav-document warning for OEBPS/toc.ncx, got %+v", warnings)
+	}
+
+	parsed.TableOfContents = manifest.LinkList{testLink(t, "OEBPS/ch1.xhtml")}
+	if warnings := parserWarnings(parsed, opf(`<spine toc="ncx"><itemref idref="ch1"/></spine>`), "moby-dick.epub"); len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %+v", warnings)
+	}
+}
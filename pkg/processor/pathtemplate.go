@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// outputPathTemplateEnvVar is the default path template (see
+	// Options.PathTemplate), used instead of the storage layout when set
+	outputPathTemplateEnvVar = "OUTPUT_PATH_TEMPLATE"
+	// pathPlaceholder stands for the path of each file within the publication,
+	// and ends every template
+	pathPlaceholder = "{path}"
+)
+
+// placeholderPattern matches the {name} variables of a path template
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// Variables of a path template besides the request's own (Options.PathVars)
+var (
+	// filenameVariables are known from the EPUB filename:
+	//  {filename} the filename without extension, e.g. books/abc/moby-dick
+	//  {name}     its last segment, e.g. moby-dick
+	//  {flat}     the basePath of the flat layout, e.g. books_abc_moby-dick
+	filenameVariables = []string{"filename", "name", "flat"}
+	// metadataVariables are only known once the EPUB is parsed:
+	//  {identifier} the dc:identifier of the publication
+	//  {title}      its title
+	//  {language}   its first language
+	metadataVariables = []string{"identifier", "title", "language"}
+)
+
+// resolvePathTemplate returns the template to use for a request, falling back
+// to OUTPUT_PATH_TEMPLATE, after checking that it ends with /{path} and that
+// the request sets every variable that is not built in
+func resolvePathTemplate(requested string, vars map[string]string) (string, error) {
+	template := requested
+	if template == "" {
+		template = os.Getenv(outputPathTemplateEnvVar)
+	}
+	for name, value := range vars {
+		if !placeholderPattern.MatchString("{" + name + "}") {
+			return "", fmt.Errorf("invalid path variable name %q", name)
+		}
+		if isBuiltinVariable(name) {
+			return "", fmt.Errorf("path variable %q is built in and cannot be set", name)
+		}
+		if _, err := pathSegment(value); err != nil {
+			return "", fmt.Errorf("invalid value for path variable %q: %w", name, err)
+		}
+	}
+	if template == "" {
+		return "", nil
+	}
+
+	prefix, ok := strings.CutSuffix(template, "/"+pathPlaceholder)
+	if !ok || strings.Contains(prefix, pathPlaceholder) {
+		return "", fmt.Errorf("invalid path template %q: must end with /%s", template, pathPlaceholder)
+	}
+	if strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") || strings.Contains(prefix, "//") {
+		return "", fmt.Errorf("invalid path template %q: empty path segment", template)
+	}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(prefix, -1) {
+		if _, set := vars[match[1]]; !set && !isBuiltinVariable(match[1]) {
+			return "", fmt.Errorf("path template %q uses {%s}, which the request does not set in path_vars", template, match[1])
+		}
+	}
+	if rest := placeholderPattern.ReplaceAllString(prefix, ""); strings.ContainsAny(rest, "{}") {
+		return "", fmt.Errorf("invalid path template %q: unbalanced braces", template)
+	}
+	return template, nil
+}
+
+// isBuiltinVariable reports whether name is a variable the pipeline fills in
+func isBuiltinVariable(name string) bool {
+	return slices.Contains(filenameVariables, name) || slices.Contains(metadataVariables, name)
+}
+
+// renderPathTemplate returns the basePath a template gives the publication
+// processed from epubFilename: the template up to /{path}, with its variables
+// filled in. metadata is nil before the EPUB is parsed, which templates using
+// metadata variables fail without.
+func renderPathTemplate(template, epubFilename string, vars map[string]string, metadata *manifest.Metadata) (string, error) {
+	epubFilename = norm.NFC.String(strings.ReplaceAll(epubFilename, "\\", "/"))
+	stem := strings.TrimPrefix(path.Clean("/"+strings.TrimSuffix(epubFilename, filepath.Ext(epubFilename))), "/")
+	values := map[string]string{
+		"filename": stem,
+		"name":     path.Base(stem),
+		"flat":     BasePath(epubFilename, layoutFlat),
+	}
+	if metadata != nil {
+		values["identifier"] = metadata.Identifier
+		values["title"] = metadata.Title()
+		if len(metadata.Languages) > 0 {
+			values["language"] = metadata.Languages[0]
+		}
+	}
+
+	var renderErr error
+	prefix := strings.TrimSuffix(template, "/"+pathPlaceholder)
+	basePath := placeholderPattern.ReplaceAllStringFunc(prefix, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, builtin := values[name]
+		if !builtin {
+			value = vars[name]
+		}
+		// {filename} is the only variable spanning several segments
+		if name == "filename" {
+			return value
+		}
+		segment, err := pathSegment(value)
+		if err != nil && renderErr == nil {
+			renderErr = &statusError{status: 422, err: fmt.Errorf("cannot fill in {%s} of path template %q: %w", name, template, err)}
+		}
+		return segment
+	})
+	if renderErr != nil {
+		return "", renderErr
+	}
+	return strings.TrimPrefix(path.Clean("/"+basePath), "/"), nil
+}
+
+// pathSegment returns value as a single segment of a storage path: NFC-normalized,
+// trimmed, with any slash replaced by an underscore
+func pathSegment(value string) (string, error) {
+	segment := strings.TrimSpace(norm.NFC.String(value))
+	segment = strings.NewReplacer("/", "_", "\\", "_").Replace(segment)
+	switch segment {
+	case "":
+		return "", fmt.Errorf("value is empty")
+	case ".", "..":
+		return "", fmt.Errorf("value %q is not a valid path segment", value)
+	}
+	return segment, nil
+}
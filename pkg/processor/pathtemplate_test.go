@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestResolvePathTemplate(t *testing.T) {
+	t.Setenv(outputPathTemplateEnvVar, "")
+	vars := map[string]string{"userId": "42", "version": "v2"}
+	for template, valid := range map[string]bool{
+		"":                                       true,
+		"{userId}/{identifier}/{version}/{path}": true,
+		"books/{filename}/{path}":                true,
+		"{flat}-{version}/{path}":                true,
+		"{userId}/{identifier}":                  false,
+		"{path}/{userId}/{path}":                 false,
+		"/{userId}/{path}":                       false,
+		"{userId}//{path}":                       false,
+		"{tenant}/{path}":                        false,
+		"{userId/{path}":                         false,
+	} {
+		if _, err := resolvePathTemplate(template, vars); (err == nil) != valid {
+			t.Errorf("%q: expected valid=%v, got %v", template, valid, err)
+		}
+	}
+
+	t.Setenv(outputPathTemplateEnvVar, "{identifier}/{path}")
+	if template, err := resolvePathTemplate("", nil); template != "{identifier}/{path}" || err != nil {
+		t.Errorf("Expected the template of the environment, got %q (%v)", template, err)
+	}
+	for name, value := range map[string]string{"identifier": "x", "user id": "42", "version": ".."} {
+		if _, err := resolvePathTemplate("", map[string]string{name: value}); err == nil {
+			t.Errorf("Expected an error for path variable %q=%q", name, value)
+		}
+	}
+}
+
+func TestRenderPathTemplate(t *testing.T) {
+	metadata := &manifest.Metadata{Identifier: "urn:isbn:9780316129084", Languages: []string{"en"}}
+	vars := map[string]string{"userId": "42", "version": "v/2"}
+	for template, want := range map[string]string{
+		"{userId}/{identifier}/{version}/{path}": "42/urn:isbn:9780316129084/v_2",
+		"library/{filename}/{path}":              "library/books/abc/moby-dick",
+		"{language}/{name}/{path}":               "en/moby-dick",
+		"{flat}/{path}":                          "books_abc_moby-dick",
+	} {
+		if got, err := renderPathTemplate(template, "books/abc/moby-dick.epub", vars, metadata); got != want || err != nil {
+			t.Errorf("%q: expected %q, got %q (%v)", template, want, got, err)
+		}
+	}
+
+	if _, err := renderPathTemplate("{identifier}/{path}", "book.epub", nil, &manifest.Metadata{}); StatusCode(err) != 422 {
+		t.Errorf("Expected 422 for an EPUB without identifier, got %v", err)
+	}
+	// Before the EPUB is parsed, the filename stands in for metadata
+	options := Options{PathTemplate: "{identifier}/{path}", Layout: layoutFlat}
+	if got := OutputBasePath("books/moby-dick.epub", options); got != "books_moby-dick" {
+		t.Errorf("Expected the basePath of the filename, got %q", got)
+	}
+}
+
+func TestProcess_PathTemplate(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+	} {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	supabase.Put(EPUBBucket, "uploads/leviathan.lpf", buf.Bytes())
+
+	p := New(store, store)
+	source, err := p.Fetch("uploads/leviathan.lpf", 0)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer source.Close()
+	options := Options{PathTemplate: "{userId}/{identifier}/{path}", PathVars: map[string]string{"userId": "42"}}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	result, err := p.Process(source, "uploads/leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	if result.BasePath != "42/urn:isbn:9780316129084" {
+		t.Errorf("Expected the publication under the user and identifier, got %q", result.BasePath)
+	}
+	if _, ok := supabase.Object(ManifestBucket, result.BasePath+"/manifest.json"); !ok {
+		t.Errorf("Expected the manifest under %s, got %v", result.BasePath, supabase.Paths(ManifestBucket))
+	}
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// presentationValues maps EPUB rendition values to RWPM presentation values,
+// by presentation property. Values missing from a map are not valid for it.
+var presentationValues = map[string]map[string]string{
+	"layout":      {"pre-paginated": "fixed", "reflowable": "reflowable"},
+	"orientation": {"auto": "auto", "landscape": "landscape", "portrait": "portrait"},
+	// rendition:spread "portrait" is deprecated and means spreads in both orientations
+	"spread":   {"auto": "auto", "both": "both", "landscape": "landscape", "none": "none", "portrait": "both"},
+	"overflow": {"auto": "auto", "paginated": "paginated", "scrolled-continuous": "scrolled", "scrolled-doc": "scrolled"},
+}
+
+// renditionProperties maps the rendition metadata properties to the RWPM
+// presentation property they set
+var renditionProperties = map[string]string{
+	"rendition:layout":      "layout",
+	"rendition:orientation": "orientation",
+	"rendition:spread":      "spread",
+	"rendition:flow":        "overflow",
+}
+
+// addPresentationHints maps the EPUB rendition properties to RWPM presentation
+// hints: the package-wide rendition:layout, orientation, spread and flow go to
+// metadata.presentation, and the per-itemref overrides and page-spread-left/right
+// to the properties of the reading order links.
+func addPresentationHints(m *manifest.Manifest, pkg *epubPackage) {
+	presentation := map[string]interface{}{}
+	for _, e := range pkg.metaElements("meta") {
+		key, ok := renditionProperties[e.attr("property")]
+		if !ok || e.attr("refines") != "" {
+			continue
+		}
+		if value, ok := presentationValues[key][strings.TrimSpace(e.Value)]; ok {
+			presentation[key] = value
+		}
+	}
+	if presentation["layout"] == "fixed" {
+		m.Metadata.Layout = manifest.LayoutFixed
+	}
+	if len(presentation) > 0 {
+		if m.Metadata.OtherMetadata == nil {
+			m.Metadata.OtherMetadata = map[string]interface{}{}
+		}
+		m.Metadata.OtherMetadata["presentation"] = presentation
+	}
+
+	for _, itemref := range pkg.opf.Spine.Itemrefs {
+		properties := itemrefPresentation(itemref.Properties)
+		item := pkg.itemByID(itemref.IDRef)
+		if len(properties) == 0 || item == nil {
+			continue
+		}
+		key := resourceKey(pkg.resolve(item.Href))
+		for i := range m.ReadingOrder {
+			link := &m.ReadingOrder[i]
+			if resourceKey(link.Href.String()) != key {
+				continue
+			}
+			if link.Properties == nil {
+				link.Properties = manifest.Properties{}
+			}
+			for name, value := range properties {
+				link.Properties[name] = value
+			}
+		}
+	}
+}
+
+// itemrefPresentation returns the link properties for the rendition overrides
+// in an itemref properties attribute, e.g. "page-spread-left rendition:layout-pre-paginated"
+func itemrefPresentation(attr string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, property := range strings.Fields(attr) {
+		switch property {
+		case "page-spread-left", "rendition:page-spread-left":
+			properties["page"] = "left"
+		case "page-spread-right", "rendition:page-spread-right":
+			properties["page"] = "right"
+		case "rendition:page-spread-center":
+			properties["page"] = "center"
+		default:
+			name, value, ok := strings.Cut(strings.TrimPrefix(property, "rendition:"), "-")
+			if !ok || !strings.HasPrefix(property, "rendition:") {
+				continue
+			}
+			if name == "flow" {
+				name = "overflow"
+			}
+			if mapped, ok := presentationValues[name][value]; ok {
+				properties[name] = mapped
+			}
+		}
+	}
+	return properties
+}
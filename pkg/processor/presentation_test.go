@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestAddPresentationHints(t *testing.T) {
+	pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+		containerPath: validContainer,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" prefix="rendition: http://www.idpf.org/vocab/rendition/#">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <meta property="rendition:layout">pre-paginated</meta>
+    <meta property="rendition:orientation">landscape</meta>
+    <meta property="rendition:spread">portrait</meta>
+    <meta property="rendition:flow">bogus</meta>
+  </metadata>
+  <manifest>
+    <item id="cover" href="cover.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p1" href="pages/p1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="p2" href="pages/p2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine page-progression-direction="rtl">
+    <itemref idref="cover" properties="rendition:page-spread-center rendition:spread-none"/>
+    <itemref idref="p1" properties="page-spread-right"/>
+    <itemref idref="p2" properties="rendition:page-spread-left rendition:layout-reflowable rendition:orientation-portrait"/>
+  </spine>
+</package>`,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open package: %v", err)
+	}
+
+	m := manifest.Manifest{ReadingOrder: manifest.LinkList{
+		testLink(t, "OEBPS/cover.xhtml"),
+		testLink(t, "OEBPS/pages/p1.xhtml"),
+		testLink(t, "OEBPS/pages/p2.xhtml"),
+	}}
+	m.ReadingOrder[1].Properties = manifest.Properties{"contains": []string{"svg"}}
+	addPresentationHints(&m, pkg)
+
+	presentation, _ := m.Metadata.OtherMetadata["presentation"].(map[string]interface{})
+	expected := map[string]interface{}{"layout": "fixed", "orientation": "landscape", "spread": "both"}
+	if len(presentation) != len(expected) {
+		t.Errorf("Expected presentation %v, got %v", expected, presentation)
+	}
+	for key, value := range expected {
+		if presentation[key] != value {
+			t.Errorf("Expected presentation %s to be %v, got %v", key, value, presentation[key])
+		}
+	}
+	if m.Metadata.Layout != manifest.LayoutFixed {
+		t.Errorf("Expected fixed layout, got %v", m.Metadata.Layout)
+	}
+
+	pages := []map[string]interface{}{
+		{"page": "center", "spread": "none"},
+		{"page": "right"},
+		{"page": "left", "layout": "reflowable", "orientation": "portrait"},
+	}
+	for i, expected := range pages {
+		for key, value := range expected {
+			if got := m.ReadingOrder[i].Properties[key]; got != value {
+				t.Errorf("Expected reading order %d %s to be %v, got %v", i, key, value, got)
+			}
+		}
+	}
+	if m.ReadingOrder[1].Properties["contains"] == nil {
+		t.Error("Expected existing link properties to be kept")
+	}
+}
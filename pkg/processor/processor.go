@@ -0,0 +1,2146 @@
+// Package processor converts EPUBs into Readium Web Publications stored in
+// Supabase Storage: it parses the EPUB with the Readium toolkit, uploads its
+// resources, and generates the manifest, positions and content files.
+//
+// The Lambda handler is one caller; batch workers, the CLI and tests embed the
+// same pipeline through Processor.
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/readium/go-toolkit/pkg/archive"
+	"github.com/readium/go-toolkit/pkg/asset"
+	"github.com/readium/go-toolkit/pkg/fetcher"
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+	"github.com/readium/go-toolkit/pkg/pub"
+	"github.com/readium/go-toolkit/pkg/util/url"
+)
+
+// Bucket names in Supabase Storage
+const (
+	// EPUBBucket holds the source EPUBs
+	EPUBBucket = "epubs"
+	// ManifestBucket holds the processed publications
+	ManifestBucket = "readium-manifests"
+)
+
+// statusError is an error that should be reported to the caller with a specific HTTP status
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// WithStatus wraps err so that StatusCode reports status for it
+func WithStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+// StatusCode returns the HTTP status carried by err, or 500
+func StatusCode(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return 500
+}
+
+// Processor runs the pipeline, reading EPUBs from a Fetcher and storing the
+// output with an Uploader
+type Processor struct {
+	fetcher  Fetcher
+	uploader Uploader
+	timeouts Timeouts
+	// deadline is when the job runs out of time, zero for no deadline
+	deadline time.Time
+	// progress, when set, is reported the progress of each job (see WithProgress)
+	progress         func(Progress)
+	progressInterval time.Duration
+	// lockJobID, when set, is the job the output path is locked for while the
+	// publication is written (see WithLock)
+	lockJobID string
+	lockWait  time.Duration
+}
+
+// New returns a Processor using fetcher and uploader. Supabase implements both;
+// fetcher may be nil for callers that only Process local files.
+func New(fetcher Fetcher, uploader Uploader) *Processor {
+	return &Processor{fetcher: fetcher, uploader: uploader}
+}
+
+// WithTimeouts returns a copy of p that enforces timeouts on the jobs it runs,
+// with the job deadline counted from now. The uploader is expected to bound
+// its own requests by timeouts.Upload.
+func (p *Processor) WithTimeouts(timeouts Timeouts) *Processor {
+	bounded := *p
+	bounded.timeouts = timeouts
+	if timeouts.Total > 0 {
+		bounded.deadline = time.Now().Add(timeouts.Total)
+	}
+	return &bounded
+}
+
+// remaining bounds timeout by the time left before the job deadline, which
+// has to be in the future
+func (p *Processor) remaining(timeout time.Duration) time.Duration {
+	if p.deadline.IsZero() {
+		return timeout
+	}
+	left := max(time.Until(p.deadline), time.Millisecond)
+	if timeout <= 0 || left < timeout {
+		return left
+	}
+	return timeout
+}
+
+// Options selects the optional steps of the pipeline. It is embedded in the
+// handler's request body, so the JSON names are part of the API.
+type Options struct {
+	// Force re-uploads every resource even if it is unchanged since the last run
+	Force bool `json:"force,omitempty"`
+	// Lenient repairs common packaging defects instead of failing the whole book
+	Lenient bool `json:"lenient,omitempty"`
+	// Validate runs structural checks and includes the report in the response
+	Validate bool `json:"validate,omitempty"`
+	// ValidateOnly returns the validation report without processing the EPUB
+	ValidateOnly bool `json:"validate_only,omitempty"`
+	// Estimate returns the predicted cost of processing the EPUB, from its ZIP
+	// central directory, without processing it
+	Estimate bool `json:"estimate,omitempty"`
+	// PruneUnused skips uploading resources that nothing in the publication references
+	PruneUnused bool `json:"prune_unused,omitempty"`
+	// Layout selects the storage layout: "flat" (default), "preserve" or
+	// "identifier"
+	Layout string `json:"layout,omitempty"`
+	// PathTemplate lays the output out by a template instead, such as
+	// "{userId}/{identifier}/{version}/{path}", falling back to the
+	// OUTPUT_PATH_TEMPLATE env var (see renderPathTemplate for the variables)
+	PathTemplate string `json:"path_template,omitempty"`
+	// PathVars sets the variables of the path template that don't come from the
+	// filename or metadata (e.g. {"userId": "42", "version": "v2"})
+	PathVars map[string]string `json:"path_vars,omitempty"`
+	// Include limits extraction to resources matching one of these glob patterns
+	// (e.g. "OEBPS/Text/**"); "**" matches any number of path segments
+	Include []string `json:"include,omitempty"`
+	// Exclude skips resources matching one of these glob patterns (e.g. "**/*.ttf")
+	Exclude []string `json:"exclude,omitempty"`
+	// Profile selects a pipeline profile from the pipeline config (e.g.
+	// "web-reader"), whose options apply where the request leaves them unset
+	Profile string `json:"profile,omitempty"`
+	// Transforms turns individual resource transformers on or off by name
+	// (e.g. {"image_recompress": true}), overriding the TRANSFORM_<NAME> env vars
+	Transforms map[string]bool `json:"transforms,omitempty"`
+	// InjectHead adds markup (e.g. ReadiumCSS links or a pagination script) to the
+	// <head> of every content document, after the INJECT_HEAD_HTML snippet
+	InjectHead []string `json:"inject_head,omitempty"`
+	// ExtractText uploads the plain text of each chapter to text/{chapter}.json
+	ExtractText bool `json:"extract_text,omitempty"`
+	// Enrich fills in missing metadata by looking up the ISBN (see ENRICHMENT_PROVIDER)
+	Enrich bool `json:"enrich,omitempty"`
+	// Metadata overrides parsed EPUB metadata (title, authors, language, ...)
+	Metadata *MetadataOverrides `json:"metadata,omitempty"`
+	// JSONLD uploads a schema.org Book description to book.jsonld next to the manifest
+	JSONLD bool `json:"jsonld,omitempty"`
+	// ONIX merges a publisher-supplied ONIX 3.0 record into the manifest metadata
+	ONIX *ONIXSource `json:"onix,omitempty"`
+	// Repackage uploads an EPUB built from the processed resources (de-obfuscated
+	// fonts, recompressed images, sanitized documents) to publication.epub
+	Repackage bool `json:"repackage,omitempty"`
+	// Package selects the packaged output: "none" (default), "webpub" to also upload
+	// publication.webpub, or "webpub_only" to upload it instead of the exploded files
+	Package string `json:"package,omitempty"`
+	// Compression stores XHTML, CSS, JS and SVG resources pre-compressed: "none" or
+	// "gzip", falling back to the TEXT_COMPRESSION env var
+	Compression string `json:"compression,omitempty"`
+	// Debug reports phase timings, storage paths and the outcome for every file,
+	// and logs each of them as the run goes
+	Debug bool `json:"debug,omitempty"`
+	// Diff generates the publication without storing anything, and reports how
+	// its manifest differs from the published one
+	Diff bool `json:"diff,omitempty"`
+	// Protected encrypts the resources with LCP and registers the content key
+	// with the License Server (see LCP_SERVER_URL)
+	Protected bool `json:"protected,omitempty"`
+	// Watermark stamps a purchaser into a copy of the publication of their own
+	Watermark *WatermarkOptions `json:"watermark,omitempty"`
+	// Locators uploads the locator templates of the chapters to
+	// readium/locators.json, for services that deep link into the publication
+	Locators bool `json:"locators,omitempty"`
+	// Accessibility audits the content documents (images without alt text,
+	// heading order, document language, empty links, table headers), includes
+	// the report in the response and uploads it next to the manifest
+	Accessibility bool `json:"accessibility,omitempty"`
+	// InlineMaxBytes inlines images and stylesheets of at most this many bytes
+	// into the content documents using them as data: URLs, instead of storing
+	// them as files; 0 inlines nothing
+	InlineMaxBytes int `json:"inline_max_bytes,omitempty"`
+	// SplitChapterBytes splits the chapters larger than this many bytes at their
+	// headings into several reading order items; 0 keeps them whole
+	SplitChapterBytes int `json:"split_chapter_bytes,omitempty"`
+	// TOCDepth drops the table of contents entries nested deeper than this many
+	// levels from the manifest and content.json; 0 keeps every level
+	TOCDepth int `json:"toc_depth,omitempty"`
+	// FlattenTOC adds the table of contents as a flat list, each entry with its
+	// level, to the x-toc-flat collection of the manifest
+	FlattenTOC bool `json:"flatten_toc,omitempty"`
+	// VideoPolicy selects what happens to embedded videos: "upload" (default) to
+	// upload them as they are, "skip" to leave them out, or "external" to point
+	// to the copies hosted at VideoURLs instead
+	VideoPolicy string `json:"video_policy,omitempty"`
+	// VideoURLs maps the path of a video inside the EPUB (e.g.
+	// "OEBPS/video/intro.mp4") to where it is hosted, for video_policy "external"
+	VideoURLs map[string]string `json:"video_urls,omitempty"`
+	// ResourceErrors selects what happens when a resource can't be read or
+	// transformed: "fail" (default) to fail the whole publication, or "continue"
+	// to leave it out and mark its manifest link as failed
+	ResourceErrors string `json:"resource_errors,omitempty"`
+	// Hooks turns individual post-processing hooks on or off by name (e.g.
+	// {"webhook": true}), overriding the HOOK_<NAME> env vars
+	Hooks map[string]bool `json:"hooks,omitempty"`
+	// Embeddings is shorthand for the "embeddings" hook, which chunks the
+	// chapter text, embeds the chunks with the endpoint at EMBEDDINGS_API_URL and
+	// stores them with their locator in the pgvector table EMBEDDINGS_TABLE
+	Embeddings bool `json:"embeddings,omitempty"`
+	// SearchIndex is shorthand for the "search_index" hook, which pushes the text
+	// of each chapter to the Meilisearch or Algolia index set by SEARCH_PROVIDER
+	SearchIndex bool `json:"search_index,omitempty"`
+}
+
+// hookOverrides returns the hooks the request turns on or off, with the
+// embeddings and search_index shorthands folded in
+func (o Options) hookOverrides() map[string]bool {
+	overrides := make(map[string]bool, len(o.Hooks)+2)
+	for name, enabled := range o.Hooks {
+		overrides[name] = enabled
+	}
+	if o.Embeddings {
+		overrides["embeddings"] = true
+	}
+	if o.SearchIndex {
+		overrides["search_index"] = true
+	}
+	return overrides
+}
+
+// Resolve validates the options and fills in the defaults for the storage
+// layout and path template, packaging, compression and video policy
+func (o *Options) Resolve() error {
+	layout, err := resolveStorageLayout(o.Layout)
+	if err != nil {
+		return err
+	}
+	o.Layout = layout
+	if o.PathTemplate, err = resolvePathTemplate(o.PathTemplate, o.PathVars); err != nil {
+		return err
+	}
+
+	if _, err := newResourceFilter(o.Include, o.Exclude); err != nil {
+		return err
+	}
+	if _, err := newTransformPipeline(o.Transforms, transformEnv{}); err != nil {
+		return err
+	}
+	if _, err := newHookPipeline(o.hookOverrides(), false, hookEnv{}); err != nil {
+		return err
+	}
+	if err := o.Metadata.validate(); err != nil {
+		return err
+	}
+	if err := o.ONIX.validate(); err != nil {
+		return err
+	}
+	if err := o.Watermark.resolve(); err != nil {
+		return err
+	}
+	if err := validateTOCDepth(o.TOCDepth); err != nil {
+		return err
+	}
+	if err := validateSplitChapterBytes(o.SplitChapterBytes); err != nil {
+		return err
+	}
+	if err := validateInlineMaxBytes(o.InlineMaxBytes); err != nil {
+		return err
+	}
+	// Inlined images would escape the watermark
+	if o.InlineMaxBytes > 0 && o.Watermark != nil && o.Watermark.Images {
+		return fmt.Errorf("inline_max_bytes cannot be combined with watermarked images")
+	}
+	if o.Package, err = resolvePackageMode(o.Package); err != nil {
+		return err
+	}
+	if o.Compression, err = resolveCompression(o.Compression); err != nil {
+		return err
+	}
+	if o.VideoPolicy, err = resolveVideoPolicy(o.VideoPolicy, o.VideoURLs); err != nil {
+		return err
+	}
+	if o.ResourceErrors, err = resolveResourceErrors(o.ResourceErrors); err != nil {
+		return err
+	}
+	if o.Diff && o.ValidateOnly {
+		return fmt.Errorf("diff and validate_only cannot be combined")
+	}
+	if o.Estimate && (o.Diff || o.ValidateOnly) {
+		return fmt.Errorf("estimate cannot be combined with diff or validate_only")
+	}
+	// Every one of these would store or return the content unencrypted
+	if o.Protected {
+		switch {
+		case o.ExtractText:
+			return fmt.Errorf("protected and extract_text cannot be combined")
+		case o.Repackage:
+			return fmt.Errorf("protected and repackage cannot be combined")
+		case o.Package != packageNone:
+			return fmt.Errorf("protected publications cannot be packaged")
+		case o.Diff:
+			return fmt.Errorf("protected and diff cannot be combined")
+		}
+		for name, enabled := range o.hookOverrides() {
+			if enabled && hookReadsText(name) {
+				return fmt.Errorf("protected and %s cannot be combined", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Result describes the outcome of processing a single EPUB
+type Result struct {
+	ManifestURL string
+	Uploaded    int
+	Skipped     int
+	// UploadedBytes is the stored size of the Uploaded files
+	UploadedBytes int64
+	Warnings      []string
+	Validation    *ValidationReport
+	Links         *LinkReport
+	Unused        []string
+	Excluded      []string
+	// ParserWarnings are the fallbacks the Readium parser took (see
+	// parserWarnings), which Warnings doesn't repeat
+	ParserWarnings []ParserWarning
+	// BasePath is where the publication is stored in the manifest bucket
+	BasePath string
+	// GeneratedID is the identifier given to a publication without one
+	// under the identifier layout
+	GeneratedID string
+	// ManifestETag is the ETag the manifest is served with (see ManifestETag)
+	ManifestETag string
+	// Overwritten lists the stored paths whose previous version this run
+	// replaced (every uploaded path when forced), which caches in front of the
+	// storage may still serve
+	Overwritten []string
+	// Failed lists the resources left out under resource_errors "continue"
+	Failed []FailedResource
+	// Oversized lists the resources skipped for being larger than MAX_RESOURCE_BYTES
+	Oversized []OversizedResource
+	Stats     *ReadingStats
+	// Accessibility is set when options.Accessibility is
+	Accessibility    *AccessibilityReport
+	AccessibilityURL string
+	JSONLDURL        string
+	LocatorsURL      string
+	EPUBURL          string
+	WebPubURL        string
+	Debug            *DebugReport
+	// Diff is set instead of the URLs when options.Diff is set, as nothing is stored
+	Diff *ManifestDiff
+	// Estimate is set instead of anything else when options.Estimate is set
+	Estimate *Estimate
+}
+
+// ResponseData returns the response fields describing the result
+func (result *Result) ResponseData(options Options) map[string]interface{} {
+	data := map[string]interface{}{
+		"manifest_url":       result.ManifestURL,
+		"uploaded_resources": result.Uploaded,
+		"skipped_resources":  result.Skipped,
+	}
+	if result.BasePath != "" {
+		data["base_path"] = result.BasePath
+	}
+	if result.GeneratedID != "" {
+		data["generated_identifier"] = result.GeneratedID
+	}
+	if result.ManifestETag != "" {
+		data["manifest_etag"] = result.ManifestETag
+	}
+	if len(result.Warnings) > 0 {
+		data["warnings"] = result.Warnings
+	}
+	if len(result.ParserWarnings) > 0 {
+		data["parser_warnings"] = result.ParserWarnings
+	}
+	if result.Validation != nil {
+		data["validation"] = result.Validation
+	}
+	if result.Links != nil {
+		data["link_report"] = result.Links
+	}
+	if len(result.Unused) > 0 {
+		data["unused_resources"] = result.Unused
+		data["unused_resources_pruned"] = options.PruneUnused
+	}
+	if len(result.Excluded) > 0 {
+		data["excluded_resources"] = result.Excluded
+	}
+	if len(result.Oversized) > 0 {
+		data["oversized_resources"] = result.Oversized
+	}
+	if len(result.Failed) > 0 {
+		data["failed_resources"] = result.Failed
+	}
+	if result.Stats != nil && result.Stats.WordCount > 0 {
+		data["reading_stats"] = result.Stats
+	}
+	if result.Accessibility != nil {
+		data["accessibility"] = result.Accessibility
+	}
+	if result.AccessibilityURL != "" {
+		data["accessibility_url"] = result.AccessibilityURL
+	}
+	if result.JSONLDURL != "" {
+		data["jsonld_url"] = result.JSONLDURL
+	}
+	if result.LocatorsURL != "" {
+		data["locators_url"] = result.LocatorsURL
+	}
+	if result.EPUBURL != "" {
+		data["epub_url"] = result.EPUBURL
+	}
+	if result.WebPubURL != "" {
+		data["webpub_url"] = result.WebPubURL
+	}
+	if result.Debug != nil {
+		data["debug"] = result.Debug
+	}
+	if result.Diff != nil {
+		data["diff"] = result.Diff
+	}
+	if result.Estimate != nil {
+		data["estimate"] = result.Estimate
+	}
+	return data
+}
+
+// manifestAdditions holds extra entries that optional features add to the generated manifest
+type manifestAdditions struct {
+	// collections maps a custom collection role to its links
+	collections map[string]interface{}
+	// readingOrderProperties maps a reading order href to extra link properties
+	readingOrderProperties map[string]map[string]interface{}
+	// links are added to the manifest links
+	links []map[string]interface{}
+}
+
+// Fetch retrieves filename with the Processor's fetcher. The caller must Close
+// the returned source.
+func (p *Processor) Fetch(filename string, maxBytes int64) (*Source, error) {
+	return p.fetcher.Fetch(filename, maxBytes)
+}
+
+// EPUBTooLargeError reports an EPUB exceeding the configured size limit as a 413
+func EPUBTooLargeError(size, maxBytes int64) error {
+	return &statusError{
+		status: 413,
+		err:    fmt.Errorf("EPUB is %d bytes, more than the limit of %d bytes (%s)", size, maxBytes, maxEPUBBytesEnvVar),
+	}
+}
+
+// Process processes an EPUB file using the Readium toolkit, extracts resources,
+// uploads them to Supabase, and generates a manifest with Supabase URLs.
+// Unless options.Force is set, resources unchanged since the previous run are not re-uploaded.
+// options must have been resolved with Options.Resolve.
+// With options.Debug, the result (or the error, see DebugReportOf) carries a DebugReport.
+// With options.Diff, nothing is stored and the result carries a ManifestDiff instead.
+// Errors carry the phase that failed (see FailureOf), and panics are returned as errors.
+func (p *Processor) Process(source *Source, epubFilename string, options Options) (result *Result, err error) {
+	debug := newDebugRecorder(options.Debug)
+	defer func() {
+		// Malformed input can panic deep in the parser: fail this book, not the invocation
+		if v := recover(); v != nil {
+			stack := make([]uintptr, 64)
+			stack = stack[:runtime.Callers(3, stack)]
+			result, err = nil, debug.wrap(fmt.Errorf("panic while processing EPUB: %v", v), stack)
+		}
+	}()
+
+	if options.Diff {
+		result, err = p.diff(source, epubFilename, options, debug)
+	} else {
+		result, err = p.process(source, epubFilename, options, debug)
+	}
+	if err != nil {
+		return nil, debug.wrap(err, nil)
+	}
+	debug.finish()
+	result.Debug = debug.result()
+	return result, nil
+}
+
+func (p *Processor) process(source *Source, epubFilename string, options Options, debug *debugRecorder) (*Result, error) {
+	ctx := context.Background()
+	debug.phase("open")
+
+	// Create a zip.Reader over the spooled EPUB file
+	zipReader, err := source.openZIP()
+	if err != nil {
+		return nil, err
+	}
+	if zipReader == nil {
+		return nil, fmt.Errorf("zip.NewReader returned nil")
+	}
+
+	// An estimate reports the limits an archive breaks rather than failing on them
+	if options.Estimate {
+		estimate, err := p.estimate(zipReader, source.Size(), options)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Estimate: estimate}, nil
+	}
+
+	// Refuse decompression bombs before extracting anything
+	if err := checkArchiveLimits(zipReader, archiveLimitsFromEnv()); err != nil {
+		return nil, err
+	}
+
+	// Refuse archives that would run the function out of memory with an error
+	// saying so, rather than being killed halfway
+	var warnings []string
+	memory := memoryBudgetFromEnv()
+	memoryWarnings, err := memory.check(zipReader, maxResourceBytesFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range memoryWarnings {
+		log.Printf("Warning: %s", warning)
+		warnings = append(warnings, warning)
+	}
+
+	// Route the archive to the pipeline for its format. W3C audiobooks (LPF) are
+	// converted directly and packaged Web Publications re-hosted, without the
+	// EPUB parser.
+	switch format := archiveFormat(zipReader); format {
+	case formatEPUB:
+	case formatLPF:
+		log.Printf("Processing %s as an LPF audiobook", epubFilename)
+		return p.processLPF(zipReader, epubFilename, source, options, warnings, debug)
+	case formatWebPub:
+		log.Printf("Processing %s as a packaged Web Publication", epubFilename)
+		return p.processRWPM(zipReader, epubFilename, source, options, warnings, debug)
+	default:
+		return nil, format.unsupported()
+	}
+
+	// In lenient mode, fix packaging defects the parser would otherwise choke on
+	if options.Lenient {
+		debug.phase("repair")
+		repaired, repairedReader, repairWarnings, err := repairArchive(source, zipReader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to repair EPUB: %w", err)
+		}
+		if repaired != source {
+			defer repaired.Close()
+		}
+		zipReader = repairedReader
+		for _, warning := range repairWarnings {
+			log.Printf("Warning: %s", warning)
+		}
+		warnings = append(warnings, repairWarnings...)
+	}
+
+	// The spine as other reading systems count it, for resolving their CFIs
+	spine := readSpineMap(zipReader)
+
+	// Oversized chapters are split before the parser sees the archive, so that
+	// every later step works on the parts
+	if options.SplitChapterBytes > 0 {
+		split, splitReader, splits, splitWarnings, err := splitChapters(zipReader, options.SplitChapterBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split chapters: %w", err)
+		}
+		if split != nil {
+			defer split.Close()
+		}
+		spine.addCuts(splits)
+		zipReader = splitReader
+		for _, warning := range splitWarnings {
+			log.Printf("Warning: %s", warning)
+		}
+		warnings = append(warnings, splitWarnings...)
+	}
+
+	// Structural validation runs on the (possibly repaired) archive the parser will see
+	var validation *ValidationReport
+	if options.Validate || options.ValidateOnly {
+		debug.phase("validate")
+		validation = validateEPUB(zipReader)
+		log.Printf("Validation finished: valid=%t, %d errors, %d warnings", validation.Valid, len(validation.Errors), len(validation.Warnings))
+		if options.ValidateOnly {
+			return &Result{Warnings: warnings, Validation: validation}, nil
+		}
+	}
+
+	// Create an archive from the zip reader
+	debug.phase("parse")
+	epubArchive := archive.NewGoZIPArchive(zipReader, func() error { return nil }, false)
+	if epubArchive == nil {
+		return nil, fmt.Errorf("NewGoZIPArchive returned nil")
+	}
+
+	// Create a fetcher from the archive
+	assetFetcher := fetcher.NewArchiveFetcher(epubArchive)
+	if assetFetcher == nil {
+		return nil, fmt.Errorf("NewArchiveFetcher returned nil")
+	}
+
+	// Create a custom asset that uses our archive fetcher
+	// The parser needs an asset, but we'll make it use our fetcher
+	epubAsset := &bytesAsset{
+		name:      epubFilename,
+		mediaType: "application/epub+zip",
+		fetcher:   assetFetcher,
+	}
+
+	// Parse the EPUB - pass the fetcher directly
+	// The parser may use the fetcher parameter if provided, otherwise it calls CreateFetcher on the asset.
+	// A parser stuck on a pathological book is given up on after the parse timeout.
+	parseTimeout := p.remaining(p.timeouts.Parse)
+	publication, err := runWithTimeout("parsing the EPUB", parseTimeout, func() (*pub.Publication, error) {
+		parseCtx := ctx
+		if parseTimeout > 0 {
+			var cancel context.CancelFunc
+			parseCtx, cancel = context.WithTimeout(ctx, parseTimeout)
+			defer cancel()
+		}
+		builder, err := epubParser.Parse(parseCtx, epubAsset, assetFetcher)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EPUB: %w", err)
+		}
+		if builder == nil {
+			return nil, fmt.Errorf("parser returned nil builder")
+		}
+
+		// Build the publication
+		publication := builder.Build()
+		if publication == nil {
+			return nil, fmt.Errorf("builder.Build() returned nil publication")
+		}
+		return publication, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Detect resources nothing refers to, and drop them before upload if requested
+	unused := findUnusedResources(&publication.Manifest, zipEntries(zipReader))
+	if len(unused) > 0 {
+		log.Printf("Found %d unused resources (prune=%t)", len(unused), options.PruneUnused)
+		if options.PruneUnused {
+			pruneResources(&publication.Manifest, unused)
+		}
+	}
+	// Small images and stylesheets become data: URLs in the documents using them,
+	// and get no file of their own
+	var inliner *resourceInliner
+	if options.InlineMaxBytes > 0 {
+		inliner = newResourceInliner(&publication.Manifest, zipEntries(zipReader), options.InlineMaxBytes)
+		if inlined := inliner.inlinedHrefs(); len(inlined) > 0 {
+			log.Printf("Inlining %d resources as data URLs", len(inlined))
+			pruneResources(&publication.Manifest, inlined)
+		}
+	}
+	debug.parsed(&publication.Manifest.Metadata)
+	debug.phase("resources")
+
+	// Get the manifest (it's a field, not a method)
+	manifest := publication.Manifest
+	// The package document is read again for what the Readium parser doesn't
+	// expose, starting with the fallbacks it took
+	pkg, err := openEPUBPackage(zipReader)
+	if err != nil {
+		log.Printf("Warning: failed to read package document: %v", err)
+		pkg = nil
+	}
+	parserIssues := parserWarnings(&manifest, pkg, epubFilename)
+	for _, warning := range parserIssues {
+		log.Printf("Warning: parser: %s", warning)
+	}
+	// Repeated spine items and table of contents entries outside the spine are
+	// reported rather than left to skew progression
+	for _, warning := range checkReadingOrder(&manifest, zipEntries(zipReader)) {
+		log.Printf("Warning: %s", warning)
+		warnings = append(warnings, warning)
+	}
+	// Poorly authored EPUBs get a table of contents built from their chapters
+	if len(manifest.TableOfContents) == 0 {
+		manifest.TableOfContents = synthesizeTOC(publication, &manifest)
+		if len(manifest.TableOfContents) > 0 {
+			warning := fmt.Sprintf("EPUB has no table of contents; built one from %d chapter titles", len(manifest.TableOfContents))
+			log.Printf("Warning: %s", warning)
+			warnings = append(warnings, warning)
+		}
+	}
+	// Deep levels are dropped before content.json and the manifest are generated
+	manifest.TableOfContents = limitTOCDepth(manifest.TableOfContents, options.TOCDepth)
+
+	var generatedIdentifier string
+	if options.Layout == layoutIdentifier {
+		generatedIdentifier = assignIdentifier(&manifest.Metadata, source.Hash())
+	}
+	basePath, collision, err := storageBasePath(p.uploader, epubFilename, options, &manifest.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if collision != "" {
+		log.Printf("Warning: %s", collision)
+		warnings = append(warnings, collision)
+	}
+	debug.storagePaths(basePath)
+
+	// Nothing is written before the publication's own path is locked
+	release, err := p.lockOutput(basePath, epubFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Load the hash index from the previous run so unchanged files can be skipped
+	delta := newDeltaUploader(basePath, p.uploader, options.Force)
+	// A failed job still waits for the uploads it started
+	defer delta.wait()
+	delta.compression = options.Compression
+	delta.debug = debug
+	delta.sourceHash = source.Hash()
+	delta.sourceVersion = source.Version()
+	delta.sourceFilename = epubFilename
+	delta.deadline = p.deadline
+	delta.progress = newProgressReporter(p.progress, p.progressInterval)
+
+	// Collect the generated files into a packaged publication as they are uploaded
+	if options.Package == packageWebPub || options.Package == packageWebPubOnly {
+		if delta.pack, err = newWebPubPackager(basePath, options.Package == packageWebPub); err != nil {
+			return nil, err
+		}
+		defer delta.pack.Close()
+	}
+
+	// Read the ONIX record before uploading anything, so a bad record fails fast
+	var onixProduct *onixProduct
+	if options.ONIX != nil {
+		data, err := options.ONIX.load()
+		if err != nil {
+			return nil, &statusError{status: 502, err: err}
+		}
+		var onixWarnings []string
+		onixProduct, onixWarnings, err = parseONIX(data, findISBN(&manifest.Metadata, nil))
+		if err != nil {
+			return nil, &statusError{status: 400, err: err}
+		}
+		warnings = append(warnings, onixWarnings...)
+	}
+
+	// A bad signing key also fails before anything is uploaded
+	signer, err := manifestSignerFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	lcp, encrypter, err := lcpProtection(options, basePath)
+	if err != nil {
+		return nil, err
+	}
+	delta.encrypter = encrypter
+
+	// Resources filtered out by include/exclude patterns stay in the manifest but are not uploaded
+	filter, err := newResourceFilter(options.Include, options.Exclude)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	// So do resources larger than MAX_RESOURCE_BYTES, with a note on their link
+	sizeCap := newResourceSizeCap(zipEntries(zipReader), maxResourceBytesFromEnv())
+	// and, depending on video_policy, videos
+	videos := newVideoPolicy(options.VideoPolicy, options.VideoURLs)
+	// and, with resource_errors "continue", the resources that fail to be read
+	failures := newResourceFailures(options.ResourceErrors)
+
+	// Content transforms (link rewriting, image recompression, ...) run on each resource before upload
+	// Protected publications get no footnote map, which would leak the notes in the clear
+	var notes *noteCollector
+	if !options.Protected {
+		notes = newNoteCollector()
+	}
+	transforms, err := newTransformPipeline(options.Transforms, transformEnv{
+		basePath:     basePath,
+		uploader:     p.uploader,
+		headSnippets: headSnippets(options.InjectHead),
+		watermark:    options.Watermark,
+		notes:        notes,
+		inliner:      inliner,
+		videos:       videos,
+	})
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+
+	// Extract and upload all resources, checking every reference against the archive
+	links := newLinkChecker(zipReader)
+	var audit *accessibilityAuditor
+	if options.Accessibility {
+		audit = newAccessibilityAuditor()
+	}
+	probes := newMediaProber()
+	var repackager *epubRepackager
+	if options.Repackage {
+		if repackager, err = newEPUBRepackager(zipReader); err != nil {
+			return nil, err
+		}
+		defer repackager.Close()
+	}
+	extractor := &resourceExtractor{
+		publication: publication,
+		basePath:    basePath,
+		delta:       delta,
+		links:       links,
+		audit:       audit,
+		filter:      filter,
+		sizeCap:     sizeCap,
+		videos:      videos,
+		failures:    failures,
+		transforms:  transforms,
+		probes:      probes,
+		repackager:  repackager,
+		memory:      memory,
+		resourceMap: map[string]string{},
+	}
+	resourceMap, err := extractor.extractAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract and upload resources: %w", err)
+	}
+	transforms.applyMediaTypes(&manifest)
+	// External videos first, so their tracks are found by URL
+	videos.apply(&manifest)
+	probes.apply(&manifest)
+	sizeCap.apply(&manifest)
+	failures.apply(&manifest)
+	for _, warning := range slices.Concat(sizeCap.warnings(), videos.warnings(), failures.warnings()) {
+		log.Printf("Warning: %s", warning)
+		warnings = append(warnings, warning)
+	}
+	debug.excluded(basePath, filter.excludedResources())
+	debug.oversized(basePath, sizeCap.oversizedResources())
+	debug.phase("readium_files")
+
+	// Generate and upload content.json and positions.json
+	// Files are stored at {basePath}/readium/ (without ~ since Supabase doesn't allow it)
+	// We use relative paths in manifest: readium/content.json (resolved relative to manifest)
+	_, _, err = generateAndUploadReadiumFiles(publication, &manifest, resourceMap, basePath, p.uploader, delta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate and upload Readium files: %w", err)
+	}
+
+	// Publish the locator templates for the annotation service
+	var locatorsURL string
+	if options.Locators {
+		locatorsJSON, err := generateLocatorsJSON(publication, &manifest, resourceMap)
+		if err != nil {
+			return nil, err
+		}
+		locatorsURL, err = delta.upload(fmt.Sprintf("%s/%s", basePath, LocatorsPath), locatorsJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload locators: %w", err)
+		}
+	}
+
+	// Publish the spine, which CFIs are resolved against
+	if spine != nil {
+		spineJSON, err := json.MarshalIndent(spine, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal spine map: %w", err)
+		}
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, spineMapPath), spineJSON); err != nil {
+			return nil, fmt.Errorf("failed to upload spine map: %w", err)
+		}
+	}
+
+	// Publish the accessibility report for compliance tracking
+	var accessibilityURL string
+	accessibilityJSON, err := audit.generateAccessibilityJSON()
+	if err != nil {
+		return nil, err
+	}
+	if accessibilityJSON != nil {
+		accessibilityURL, err = delta.upload(fmt.Sprintf("%s/%s", basePath, accessibilityReportPath), accessibilityJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload accessibility report: %w", err)
+		}
+	}
+	debug.phase("metadata")
+
+	additions := &manifestAdditions{collections: map[string]interface{}{}, readingOrderProperties: map[string]map[string]interface{}{}}
+
+	// Upload the repackaged EPUB for download-to-device, and link it from the manifest
+	var epubURL string
+	if repackager != nil {
+		epubData, err := repackager.finish()
+		if err != nil {
+			return nil, err
+		}
+		epubURL, err = delta.upload(fmt.Sprintf("%s/%s", basePath, repackagedEPUBPath), epubData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload repackaged EPUB: %w", err)
+		}
+		additions.links = append(additions.links, map[string]interface{}{
+			"href": repackagedEPUBPath,
+			"type": "application/epub+zip",
+			"rel":  "alternate",
+		})
+	}
+
+	// Publish the footnote map so readers can show notes in popovers
+	notesJSON, err := notes.generateNotesJSON()
+	if err != nil {
+		return nil, err
+	}
+	if notesJSON != nil {
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, notesPath), notesJSON); err != nil {
+			return nil, fmt.Errorf("failed to upload notes: %w", err)
+		}
+		additions.links = append(additions.links, map[string]interface{}{
+			"href": notesPath,
+			"type": "application/json",
+			"rel":  "x-notes",
+		})
+	}
+
+	// Link the detached signature, which is uploaded once the manifest is final
+	if signer != nil {
+		additions.links = append(additions.links, signatureLink())
+	}
+	if lcp != nil {
+		additions.links = append(additions.links, lcp.licenseLink(basePath))
+	}
+
+	chapters := readChapterTexts(publication, &manifest)
+
+	// Normalize language tags, contributor names and dates, and read the presentation hints
+	metadataWarnings := normalizeMetadata(&manifest.Metadata, pkg, chapters)
+	if pkg != nil {
+		addPresentationHints(&manifest, pkg)
+	}
+
+	// The publisher's ONIX record is more authoritative than the EPUB
+	if onixProduct != nil {
+		mergeONIX(&manifest.Metadata, onixProduct)
+	}
+
+	// Fill in subjects, description, publisher, date and series from an ISBN lookup
+	if options.Enrich {
+		provider, err := metadataProviderFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		metadataWarnings = append(metadataWarnings, enrichMetadata(&manifest.Metadata, pkg, provider)...)
+	}
+	for _, warning := range metadataWarnings {
+		log.Printf("Warning: %s", warning)
+		warnings = append(warnings, warning)
+	}
+
+	// Request overrides win over both the EPUB and the lookup
+	if err := applyMetadataOverrides(&manifest, options.Metadata); err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+
+	// Count words for the reading time estimate
+	stats := computeReadingStats(chapters)
+	applyReadingStats(&manifest.Metadata, stats)
+	for _, chapter := range chapters {
+		additions.readingOrderProperties[chapter.source] = map[string]interface{}{"wordCount": chapter.WordCount}
+	}
+
+	debug.phase("manifest")
+
+	// Upload plain-text sidecars for search, TTS and other downstream services
+	if options.ExtractText {
+		textLinks, err := uploadChapterTexts(chapters, basePath, p.uploader, delta)
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract chapter text: %w", err)
+		}
+		if len(textLinks) > 0 {
+			additions.collections[textCollectionRole] = textLinks
+		}
+	}
+
+	if options.FlattenTOC && len(manifest.TableOfContents) > 0 {
+		additions.collections[flatTOCCollectionRole] = flattenTOC(manifest.TableOfContents)
+	}
+
+	// Publish the table of contents on its own too, so lightweight clients can
+	// fetch the navigation without the whole manifest
+	tocJSON, err := generateTOCJSON(manifest.TableOfContents, resourceMap, basePath, p.uploader)
+	if err != nil {
+		return nil, err
+	}
+	if tocJSON != nil {
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, tocPath), tocJSON); err != nil {
+			return nil, fmt.Errorf("failed to upload table of contents: %w", err)
+		}
+		additions.links = append(additions.links, map[string]interface{}{
+			"href": tocPath,
+			"type": "application/json",
+			"rel":  "contents",
+		})
+	}
+
+	// Comics and other image publications get a guided navigation document, for
+	// panel-by-panel reading
+	guidedJSON, err := generateGuidedNavigationJSON(epubGuidedNavigation(publication, &manifest))
+	if err != nil {
+		return nil, err
+	}
+	if guidedJSON != nil {
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, guidedNavigationPath), guidedJSON); err != nil {
+			return nil, fmt.Errorf("failed to upload guided navigation: %w", err)
+		}
+		additions.links = append(additions.links, guidedNavigationLink())
+	}
+
+	// Map the print pages to positions, so readers can cite the printed edition
+	pageMapJSON, pageMapWarnings, err := generatePageMapJSON(publication, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range pageMapWarnings {
+		log.Printf("Warning: %s", warning)
+		warnings = append(warnings, warning)
+	}
+	if pageMapJSON != nil {
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, pageMapPath), pageMapJSON); err != nil {
+			return nil, fmt.Errorf("failed to upload page map: %w", err)
+		}
+		additions.links = append(additions.links, map[string]interface{}{
+			"href": pageMapPath,
+			"type": "application/json",
+			"rel":  "x-page-map",
+		})
+	}
+
+	// Generate manifest with Supabase URLs
+	// Note: We use relative paths for content.json and positions.json since we store them
+	// at readium/ (without ~) due to Supabase storage key restrictions
+	manifestJSON, err := generateManifestWithSupabaseURLs(&manifest, resourceMap, basePath, p.uploader, additions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate manifest: %w", err)
+	}
+	if manifestJSON, err = delta.addLinkProperties(manifestJSON, basePath); err != nil {
+		return nil, err
+	}
+
+	// The manifest is only stored once every resource it links to is
+	if err := delta.wait(); err != nil {
+		return nil, err
+	}
+
+	// Upload manifest to Supabase
+	manifestPath := fmt.Sprintf("%s/manifest.json", basePath)
+	manifestURL, err := delta.upload(manifestPath, manifestJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	if err := signer.uploadSignature(manifestJSON, basePath, delta); err != nil {
+		return nil, err
+	}
+	if lcp != nil {
+		if err := registerLCPContent(lcp, encrypter, basePath, manifestURL, "application/webpub+json", manifestJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	// Upload the schema.org description for the public site
+	var jsonldURL string
+	if options.JSONLD {
+		jsonld, err := generateBookJSONLD(&manifest, pkg, resourceMap, manifestURL)
+		if err != nil {
+			return nil, err
+		}
+		jsonldURL, err = delta.upload(fmt.Sprintf("%s/%s", basePath, bookJSONLDPath), jsonld)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload JSON-LD: %w", err)
+		}
+	}
+
+	// Upload the packaged publication now that the manifest is in it
+	var webpubURL string
+	if delta.pack != nil {
+		debug.phase("package")
+		webpubData, err := delta.pack.finish()
+		if err != nil {
+			return nil, err
+		}
+		webpubURL, err = delta.upload(fmt.Sprintf("%s/%s", basePath, webpubPath), webpubData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload packaged publication: %w", err)
+		}
+		// Without the exploded files there is no manifest to point at
+		if !delta.pack.exploded {
+			manifestURL = ""
+		}
+	}
+
+	// Record what was uploaded so the next run can skip unchanged files
+	debug.phase("index")
+	if err := delta.wait(); err != nil {
+		return nil, err
+	}
+	if err := delta.saveIntegrity(basePath); err != nil {
+		return nil, err
+	}
+	if err := delta.saveIndex(basePath); err != nil {
+		return nil, err
+	}
+
+	// Hooks run once the publication is stored: it is complete without them,
+	// so a hook failing is only a warning
+	hooks, err := newHookPipeline(options.hookOverrides(), options.Protected, hookEnv{
+		basePath:    basePath,
+		manifestURL: manifestURL,
+		uploader:    p.uploader,
+		chapters:    chapters,
+	})
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	if len(hooks.hooks) > 0 {
+		debug.phase("hooks")
+		warnings = append(warnings, hooks.run(&manifest, stats)...)
+	}
+
+	return &Result{
+		ManifestURL:      manifestURL,
+		BasePath:         basePath,
+		GeneratedID:      generatedIdentifier,
+		ManifestETag:     ManifestETag(manifestJSON),
+		Uploaded:         delta.uploaded,
+		UploadedBytes:    delta.uploadedBytes,
+		Overwritten:      delta.overwritten,
+		Skipped:          delta.skipped,
+		Warnings:         warnings,
+		ParserWarnings:   parserIssues,
+		Validation:       validation,
+		Links:            &links.report,
+		Unused:           unused,
+		Excluded:         filter.excludedResources(),
+		Oversized:        sizeCap.oversizedResources(),
+		Failed:           failures.failedResources(),
+		Stats:            stats,
+		Accessibility:    audit.finish(),
+		AccessibilityURL: accessibilityURL,
+		JSONLDURL:        jsonldURL,
+		LocatorsURL:      locatorsURL,
+		EPUBURL:          epubURL,
+		WebPubURL:        webpubURL,
+	}, nil
+}
+
+// resourceExtractor extracts the resources of a publication and uploads them
+// under basePath, running each through the steps of the job on the way
+type resourceExtractor struct {
+	publication *pub.Publication
+	basePath    string
+	delta       *deltaUploader
+	links       *linkChecker
+	audit       *accessibilityAuditor
+	filter      *resourceFilter
+	sizeCap     *resourceSizeCap
+	videos      *videoPolicy
+	failures    *resourceFailures
+	transforms  *transformPipeline
+	probes      *mediaProber
+	repackager  *epubRepackager
+	memory      *memoryBudget
+	// resourceMap maps the href of each uploaded resource to its URL
+	resourceMap map[string]string
+}
+
+// extractAll extracts all resources from the publication and uploads them to Supabase
+// Links without an archive entry are reported by links and skipped.
+func (r *resourceExtractor) extractAll() (map[string]string, error) {
+	manifest := r.publication.Manifest
+
+	// Report navigation and manifest links that point at missing files
+	r.links.checkLinks("reading_order", manifest.ReadingOrder)
+	r.links.checkLinks("toc", manifest.TableOfContents)
+	r.links.checkLinks("resources", manifest.Resources)
+
+	// Progress counts the reading order and the resources, which hold every file
+	r.delta.progress.start(len(manifest.ReadingOrder) + len(manifest.Resources))
+
+	// Process reading order items
+	for _, link := range manifest.ReadingOrder {
+		hrefStr := link.Href.String()
+		if !r.links.exists(hrefStr) {
+			r.delta.progress.advance()
+			continue
+		}
+		if err := r.process(hrefStr, &link); err != nil {
+			return nil, fmt.Errorf("failed to process reading order resource %s: %w", hrefStr, err)
+		}
+		r.delta.progress.advance()
+	}
+
+	// Process table of contents items (need to extract base hrefs without fragments)
+	if len(manifest.TableOfContents) > 0 {
+		for _, link := range manifest.TableOfContents {
+			hrefStr := link.Href.String()
+			// Extract base href without fragment
+			baseHref := hrefStr
+			if idx := strings.Index(hrefStr, "#"); idx >= 0 {
+				baseHref = hrefStr[:idx]
+			}
+			if baseHref != "" && r.links.exists(baseHref) {
+				// Find the link in manifest for the base href
+				baseLink := findLinkInManifest(baseHref, &manifest)
+				if err := r.process(baseHref, baseLink); err != nil {
+					return nil, fmt.Errorf("failed to process TOC resource %s: %w", baseHref, err)
+				}
+			}
+		}
+	}
+
+	// Process links (which may include landmarks or other navigation links)
+	// Extract base hrefs without fragments for any links that point to resources
+	for _, link := range manifest.Links {
+		hrefStr := link.Href.String()
+		// Only process links that look like they point to resources (not external URLs)
+		if !strings.HasPrefix(hrefStr, "http://") && !strings.HasPrefix(hrefStr, "https://") && !strings.HasPrefix(hrefStr, "~") {
+			// Extract base href without fragment
+			baseHref := hrefStr
+			if idx := strings.Index(hrefStr, "#"); idx >= 0 {
+				baseHref = hrefStr[:idx]
+			}
+			if baseHref != "" {
+				// Find the link in manifest for the base href
+				baseLink := findLinkInManifest(baseHref, &manifest)
+				if err := r.process(baseHref, baseLink); err != nil {
+					// Log but don't fail - some links might not be resources
+					log.Printf("Warning: failed to process link resource %s: %v", baseHref, err)
+				}
+			}
+		}
+	}
+
+	// Process resources
+	for _, link := range manifest.Resources {
+		hrefStr := link.Href.String()
+		if !r.links.exists(hrefStr) {
+			r.delta.progress.advance()
+			continue
+		}
+		if err := r.process(hrefStr, &link); err != nil {
+			return nil, fmt.Errorf("failed to process resource %s: %w", hrefStr, err)
+		}
+		r.delta.progress.advance()
+	}
+
+	r.delta.progress.finish()
+	return r.resourceMap, nil
+}
+
+// findLinkInManifest finds a link in the manifest by href
+func findLinkInManifest(href string, m *manifest.Manifest) *manifest.Link {
+	// Check reading order
+	for _, link := range m.ReadingOrder {
+		if link.Href.String() == href {
+			return &link
+		}
+	}
+	// Check resources
+	for _, link := range m.Resources {
+		if link.Href.String() == href {
+			return &link
+		}
+	}
+	// Check table of contents
+	for _, link := range m.TableOfContents {
+		linkHref := link.Href.String()
+		// Remove fragment for comparison
+		if idx := strings.Index(linkHref, "#"); idx >= 0 {
+			linkHref = linkHref[:idx]
+		}
+		if linkHref == href {
+			return &link
+		}
+	}
+	return nil
+}
+
+// process processes a single resource: reads it from publication and uploads to Supabase
+func (r *resourceExtractor) process(href string, manifestLink *manifest.Link) error {
+	// Skip if already processed, or failed already
+	if _, exists := r.resourceMap[href]; exists || r.failures.has(href) {
+		return nil
+	}
+
+	// Skip resources the request filtered out
+	if !r.filter.allows(href) {
+		return nil
+	}
+
+	// Skip resources too large to be worth stalling the book on
+	if !r.sizeCap.allows(href) {
+		return nil
+	}
+
+	// Create context for the operation
+	ctx := context.Background()
+
+	// Create HREF from string
+	hrefURL, err := url.URLFromString(href)
+	if err != nil {
+		return fmt.Errorf("failed to create HREF from %s: %w", href, err)
+	}
+
+	// Read resource from publication using the fetcher
+	link := manifest.Link{Href: manifest.NewHREF(hrefURL)}
+	if manifestLink != nil {
+		link.MediaType = manifestLink.MediaType
+	}
+
+	// Leave out the videos the video policy doesn't upload
+	if !r.videos.allows(&link) {
+		return nil
+	}
+	resource := r.publication.Get(ctx, link)
+	defer resource.Close()
+
+	// Read all data from the resource using the Read method
+	// Read(ctx, start, end) - when both are 0, the whole content is returned
+	resourceData, resErr := resource.Read(ctx, 0, 0)
+	if resErr != nil {
+		return r.failures.record(href, fmt.Errorf("failed to read resource: %v", resErr))
+	}
+
+	// Report links to files that aren't in the archive, before any transform touches them
+	if isHTMLResource(&link) {
+		r.links.checkDocument(href, resourceData)
+		r.audit.checkDocument(href, resourceData)
+	}
+
+	// Run the enabled transformers (XHTML link rewriting, CSS rewriting, ...)
+	resourceData, err = r.transforms.apply(&link, resourceData)
+	if err != nil {
+		return r.failures.record(href, fmt.Errorf("failed to transform resource: %w", err))
+	}
+
+	// Record the duration and bitrate of audio and video for their manifest links
+	r.probes.probe(&link, resourceData)
+
+	// Write the processed content to the repackaged EPUB
+	if err := r.repackager.add(href, resourceData); err != nil {
+		return fmt.Errorf("failed to repackage resource: %w", err)
+	}
+
+	// Create storage path: basePath/resourcePath
+	// Normalize the href to handle relative paths
+	storagePath := fmt.Sprintf("%s/%s", r.basePath, resourceKey(href))
+
+	// Upload to Supabase (skipped if unchanged since the previous run)
+	resourceURL, err := r.delta.upload(storagePath, resourceData)
+	if err != nil {
+		return fmt.Errorf("failed to upload resource: %w", err)
+	}
+
+	// Store mapping from original href to Supabase URL
+	r.resourceMap[href] = resourceURL
+
+	r.memory.release(len(resourceData))
+	return nil
+}
+
+// convertLinkToSupabaseURL converts a link href to a Supabase URL, handling fragments
+func convertLinkToSupabaseURL(hrefStr string, resourceMap map[string]string, basePath string, uploader Uploader) string {
+	// Split href into base path and fragment
+	baseHref := hrefStr
+	fragment := ""
+	if idx := strings.Index(hrefStr, "#"); idx >= 0 {
+		baseHref = hrefStr[:idx]
+		fragment = hrefStr[idx:]
+	}
+
+	// Get the base URL from resource map
+	supabaseResourceURL := resourceMap[baseHref]
+	if supabaseResourceURL == "" {
+		// Fallback: construct URL if not in map
+		storagePath := fmt.Sprintf("%s/%s", basePath, resourceKey(baseHref))
+		supabaseResourceURL = uploader.PublicURL(storagePath)
+	}
+
+	// Append fragment if present
+	return supabaseResourceURL + fragment
+}
+
+// rewriteLinksInXHTML keeps relative hrefs relative - Thorium Reader resolves them against manifest base
+func rewriteLinksInXHTML(content []byte, currentHref string, resourceMap map[string]string, basePath string, uploader Uploader) []byte {
+	// Convert content to string for regex processing
+	contentStr := string(content)
+
+	// Pattern to match href attributes in <a> tags
+	// Matches: href="relative/path.xhtml#fragment" or href='relative/path.xhtml#fragment'
+	hrefPattern := regexp.MustCompile(`(?i)(<a[^>]*\s+href=["'])([^"']+)(["'][^>]*>)`)
+
+	// Replace function - we'll normalize relative paths but keep them relative
+	modifiedContent := hrefPattern.ReplaceAllStringFunc(contentStr, func(match string) string {
+		parts := hrefPattern.FindStringSubmatch(match)
+		if len(parts) != 4 {
+			return match // Return original if pattern doesn't match
+		}
+
+		prefix := parts[1]    // <a ... href="
+		hrefValue := parts[2] // the href value
+		suffix := parts[3]    // " ...>
+
+		// Skip external URLs, data URIs, mailto, same-page anchors
+		if strings.HasPrefix(hrefValue, "http://") ||
+			strings.HasPrefix(hrefValue, "https://") ||
+			strings.HasPrefix(hrefValue, "mailto:") ||
+			strings.HasPrefix(hrefValue, "data:") ||
+			strings.HasPrefix(hrefValue, "#") {
+			return match // Keep external/absolute links as-is
+		}
+
+		// For internal relative links, keep them relative
+		// Thorium Reader will resolve them against the manifest base URL
+		// Just normalize the path (remove ./ and handle .. if needed)
+		normalized := normalizeRelativeLink(hrefValue)
+
+		return prefix + normalized + suffix
+	})
+
+	return []byte(modifiedContent)
+}
+
+// normalizeRelativeLink normalizes a relative link path while keeping it relative
+func normalizeRelativeLink(link string) string {
+	// Remove leading ./
+	link = strings.TrimPrefix(link, "./")
+	// Remove leading / if present (make it truly relative)
+	link = strings.TrimPrefix(link, "/")
+	// Encode the path the same way as storage keys, so links to files with spaces
+	// or decomposed Unicode names point at the uploaded object.
+	// More complex normalization (handling ..) could be added if needed
+	return manifestHref(link)
+}
+
+// getDirectoryFromHref extracts the directory path from an href
+func getDirectoryFromHref(href string) string {
+	// Remove leading slash
+	href = strings.TrimPrefix(href, "/")
+
+	// Find last slash
+	lastSlash := strings.LastIndex(href, "/")
+	if lastSlash == -1 {
+		return "" // No directory, just filename
+	}
+
+	return href[:lastSlash+1] // Include trailing slash
+}
+
+// resolveRelativePath resolves a relative path against a base directory
+func resolveRelativePath(relativePath, baseDir string) string {
+	// If relativePath is already absolute (starts with /), return as-is
+	if strings.HasPrefix(relativePath, "/") {
+		return strings.TrimPrefix(relativePath, "/")
+	}
+
+	// Combine baseDir and relativePath
+	combined := baseDir + relativePath
+
+	// Normalize the path (remove .. and .)
+	parts := strings.Split(combined, "/")
+	result := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			if len(result) > 0 {
+				result = result[:len(result)-1]
+			}
+			continue
+		}
+		result = append(result, part)
+	}
+
+	return strings.Join(result, "/")
+}
+
+// convertTOCLink converts a TOC link (which may have children) to a map with relative paths
+func convertTOCLink(link manifest.Link, resourceMap map[string]string, basePath string, uploader Uploader) map[string]interface{} {
+	hrefStr := link.Href.String()
+	// Use relative path (relative to manifest.json location)
+	// Remove leading slash if present to ensure it's a relative path
+	relativeHref := manifestHref(hrefStr)
+
+	item := map[string]interface{}{
+		"href": relativeHref,
+	}
+	if link.Title != "" {
+		item["title"] = link.Title
+	}
+
+	// Handle nested TOC entries (children) - recursively convert them
+	if len(link.Children) > 0 {
+		children := make([]map[string]interface{}, 0, len(link.Children))
+		for _, child := range link.Children {
+			childItem := convertTOCLink(child, resourceMap, basePath, uploader)
+			children = append(children, childItem)
+		}
+		if len(children) > 0 {
+			item["children"] = children
+		}
+	}
+
+	return item
+}
+
+// generateAndUploadReadiumFiles generates content.json and positions.json and uploads them to Supabase
+// Returns the Supabase URLs for these files so they can be referenced in the manifest
+func generateAndUploadReadiumFiles(publication *pub.Publication, manifest *manifest.Manifest, resourceMap map[string]string, basePath string, uploader Uploader, delta *deltaUploader) (contentURL, positionsURL string, err error) {
+	// Generate positions.json
+	positionsJSON, err := generatePositionsJSON(publication, manifest, resourceMap, basePath, uploader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate positions.json: %w", err)
+	}
+
+	// Upload positions.json to readium/ directory (without ~ since Supabase doesn't allow it in keys)
+	// We'll use full URLs in manifest instead of ~readium/ paths
+	positionsPath := fmt.Sprintf("%s/readium/positions.json", basePath)
+	positionsURL, err = delta.upload(positionsPath, positionsJSON)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to upload positions.json: %w", err)
+	}
+
+	// Generate content.json
+	contentJSON, err := generateContentJSON(manifest, resourceMap, basePath, uploader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate content.json: %w", err)
+	}
+
+	// Upload content.json to readium/ directory
+	contentPath := fmt.Sprintf("%s/readium/content.json", basePath)
+	contentURL, err = delta.upload(contentPath, contentJSON)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to upload content.json: %w", err)
+	}
+
+	return contentURL, positionsURL, nil
+}
+
+// generatePositionsJSON generates the positions.json file based on reading order and content length
+// It calculates positions based on content length (approximately 1024 characters per position)
+func generatePositionsJSON(publication *pub.Publication, manifest *manifest.Manifest, resourceMap map[string]string, basePath string, uploader Uploader) ([]byte, error) {
+	ctx := context.Background()
+	positions := make([]map[string]interface{}, 0)
+
+	// First pass: calculate total character count and positions per resource
+	type resourceInfo struct {
+		href         string
+		mediaType    string
+		charCount    int
+		numPositions int
+	}
+
+	resourceInfos := make([]resourceInfo, 0, len(manifest.ReadingOrder))
+	totalChars := 0
+
+	for i := range manifest.ReadingOrder {
+		link := &manifest.ReadingOrder[i]
+		hrefStr := link.Href.String()
+
+		// Read the resource to get its content length
+		// Use the link directly from reading order
+		resource := publication.Get(ctx, *link)
+		if resource == nil {
+			log.Printf("Warning: failed to get resource %s", hrefStr)
+			continue
+		}
+
+		// Read the resource content
+		resourceData, err := resource.Read(ctx, 0, 0)
+		resource.Close()
+
+		if err != nil {
+			log.Printf("Warning: failed to read resource %s: %v", hrefStr, err)
+			continue
+		}
+
+		// Count characters (for text-based resources)
+		charCount := len(string(resourceData))
+		numPositions := positionCount(charCount)
+
+		mediaTypeStr := ""
+		if link.MediaType != nil {
+			mediaTypeStr = link.MediaType.String()
+		}
+
+		resourceInfos = append(resourceInfos, resourceInfo{
+			href:         hrefStr,
+			mediaType:    mediaTypeStr,
+			charCount:    charCount,
+			numPositions: numPositions,
+		})
+
+		totalChars += charCount
+	}
+
+	// Second pass: generate positions with proper progression values
+	positionCounter := 1
+	cumulativeChars := 0
+
+	for _, info := range resourceInfos {
+		relativeHref := manifestHref(info.href)
+
+		// Generate positions for this resource
+		for i := 0; i < info.numPositions; i++ {
+			// Calculate progression within this document (0.0 to 1.0)
+			var progression float64
+			if info.numPositions > 1 {
+				progression = float64(i) / float64(info.numPositions-1)
+			} else {
+				progression = 0.0
+			}
+
+			// Calculate totalProgression across entire publication
+			var totalProgression float64
+			if totalChars > 0 {
+				// Estimate position in total content based on cumulative chars
+				// Add proportional contribution for this position within the resource
+				charsAtPosition := cumulativeChars + (i * info.charCount / info.numPositions)
+				totalProgression = float64(charsAtPosition) / float64(totalChars)
+				if totalProgression > 1.0 {
+					totalProgression = 1.0
+				}
+			}
+
+			position := map[string]interface{}{
+				"href": relativeHref,
+				"locations": map[string]interface{}{
+					"position":         positionCounter,
+					"progression":      progression,
+					"totalProgression": totalProgression,
+				},
+			}
+
+			// Add type if available
+			if info.mediaType != "" {
+				position["type"] = info.mediaType
+			}
+
+			positions = append(positions, position)
+			positionCounter++
+		}
+
+		cumulativeChars += info.charCount
+	}
+
+	positionsData := map[string]interface{}{
+		"total":     len(positions),
+		"positions": positions,
+	}
+
+	return json.MarshalIndent(positionsData, "", "  ")
+}
+
+// positionCount returns the number of positions of a resource of charCount
+// characters: one per 1024 characters, and at least one
+func positionCount(charCount int) int {
+	const charsPerPosition = 1024 // Standard: one position per 1024 characters
+	if charCount <= 0 {
+		return 1
+	}
+	return (charCount + charsPerPosition - 1) / charsPerPosition // Ceiling division
+}
+
+// buildContentItemFromLink converts a TOC link to a content item structure
+func buildContentItemFromLink(link manifest.Link, resourceMap map[string]string, basePath string, uploader Uploader) map[string]interface{} {
+	hrefStr := link.Href.String()
+	// Use relative path (relative to manifest.json location)
+	// Remove leading slash if present to ensure it's a relative path
+	relativeHref := manifestHref(hrefStr)
+
+	item := map[string]interface{}{
+		"href": relativeHref,
+	}
+
+	if link.Title != "" {
+		item["title"] = link.Title
+	}
+
+	if link.MediaType != nil {
+		item["type"] = link.MediaType.String()
+	}
+
+	// Recursively add children
+	if len(link.Children) > 0 {
+		children := make([]map[string]interface{}, 0, len(link.Children))
+		for _, child := range link.Children {
+			childItem := buildContentItemFromLink(child, resourceMap, basePath, uploader)
+			children = append(children, childItem)
+		}
+		if len(children) > 0 {
+			item["children"] = children
+		}
+	}
+
+	return item
+}
+
+// generateContentJSON generates the content.json file based on table of contents
+func generateContentJSON(manifest *manifest.Manifest, resourceMap map[string]string, basePath string, uploader Uploader) ([]byte, error) {
+	content := make([]map[string]interface{}, 0)
+	if len(manifest.TableOfContents) > 0 {
+		for _, link := range manifest.TableOfContents {
+			item := buildContentItemFromLink(link, resourceMap, basePath, uploader)
+			content = append(content, item)
+		}
+	} else {
+		// If no TOC, use reading order as fallback
+		for _, link := range manifest.ReadingOrder {
+			hrefStr := link.Href.String()
+			// Use relative path (relative to manifest.json location)
+			// Remove leading slash if present to ensure it's a relative path
+			relativeHref := manifestHref(hrefStr)
+
+			item := map[string]interface{}{
+				"href": relativeHref,
+			}
+			if link.Title != "" {
+				item["title"] = link.Title
+			}
+			if link.MediaType != nil {
+				item["type"] = link.MediaType.String()
+			}
+			content = append(content, item)
+		}
+	}
+
+	contentData := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"numberOfItems": len(content),
+		},
+		"structure": content,
+	}
+
+	return json.MarshalIndent(contentData, "", "  ")
+}
+
+// generateManifestWithSupabaseURLs creates a new manifest with all URLs pointing to Supabase
+func generateManifestWithSupabaseURLs(manifest *manifest.Manifest, resourceMap map[string]string, basePath string, uploader Uploader, additions *manifestAdditions) ([]byte, error) {
+	// Construct manifest URL for self reference
+	manifestPath := fmt.Sprintf("%s/manifest.json", basePath)
+	manifestURL := uploader.PublicURL(manifestPath)
+
+	// Create a new manifest structure with updated URLs
+	updatedManifest := map[string]interface{}{
+		"@context": "https://readium.org/webpub-manifest/context.jsonld",
+		"metadata": manifest.Metadata,
+	}
+
+	// Update reading order with relative paths
+	readingOrder := make([]map[string]interface{}, 0, len(manifest.ReadingOrder))
+	for _, link := range manifest.ReadingOrder {
+		hrefStr := link.Href.String()
+		// Use relative path (relative to manifest.json location)
+		// Remove leading slash if present to ensure it's a relative path
+		relativeHref := manifestHref(hrefStr)
+
+		item := map[string]interface{}{
+			"href": relativeHref,
+		}
+		if link.MediaType != nil {
+			item["type"] = link.MediaType.String()
+		}
+		if link.Title != "" {
+			item["title"] = link.Title
+		}
+		addMediaProperties(item, link)
+		properties := map[string]interface{}{}
+		for name, value := range link.Properties {
+			properties[name] = value
+		}
+		if additions != nil {
+			for name, value := range additions.readingOrderProperties[hrefStr] {
+				properties[name] = value
+			}
+		}
+		if len(properties) > 0 {
+			item["properties"] = properties
+		}
+		readingOrder = append(readingOrder, item)
+	}
+	updatedManifest["readingOrder"] = readingOrder
+
+	// Update table of contents with Supabase URLs
+	if len(manifest.TableOfContents) > 0 {
+		toc := make([]map[string]interface{}, 0, len(manifest.TableOfContents))
+		for _, link := range manifest.TableOfContents {
+			tocItem := convertTOCLink(link, resourceMap, basePath, uploader)
+			toc = append(toc, tocItem)
+		}
+		if len(toc) > 0 {
+			updatedManifest["toc"] = toc
+		}
+	}
+
+	// Extract landmarks from Links and TOC
+	// Common landmark rels: "contents", "start", "copyright", etc.
+	landmarkRels := map[string]bool{
+		"contents":  true,
+		"start":     true,
+		"copyright": true,
+	}
+	landmarks := make([]map[string]interface{}, 0)
+	landmarkHrefs := make(map[string]bool) // Track added landmarks to avoid duplicates
+
+	// First, extract landmarks from manifest.Links
+	for _, link := range manifest.Links {
+		// Check if this link has a rel that indicates it's a landmark
+		isLandmark := false
+		for _, rel := range link.Rels {
+			if landmarkRels[rel] {
+				isLandmark = true
+				break
+			}
+		}
+		// Also check if it's a landmark by title pattern (some EPUBs don't use rels)
+		if !isLandmark && (link.Title == "Table of Contents" || link.Title == "Begin Reading" || link.Title == "Copyright Page") {
+			isLandmark = true
+		}
+
+		if isLandmark {
+			hrefStr := link.Href.String()
+			// Use relative path (relative to manifest.json location)
+			// Remove leading slash if present to ensure it's a relative path
+			relativeHref := manifestHref(hrefStr)
+
+			item := map[string]interface{}{
+				"href": relativeHref,
+			}
+			if link.Title != "" {
+				item["title"] = link.Title
+			}
+			landmarks = append(landmarks, item)
+			landmarkHrefs[hrefStr] = true
+		}
+	}
+
+	// Also check TOC for common landmark patterns (Table of Contents, Begin Reading, Copyright)
+	if len(manifest.TableOfContents) > 0 {
+		for _, link := range manifest.TableOfContents {
+			hrefStr := link.Href.String()
+			// Skip if already added
+			if landmarkHrefs[hrefStr] {
+				continue
+			}
+
+			title := strings.ToLower(link.Title)
+			isLandmark := false
+			landmarkTitle := ""
+
+			// Check for common landmark titles
+			if strings.Contains(title, "table of contents") || strings.Contains(title, "contents") || strings.Contains(title, "toc") {
+				isLandmark = true
+				landmarkTitle = "Table of Contents"
+			} else if strings.Contains(title, "begin reading") || strings.Contains(title, "start") {
+				isLandmark = true
+				landmarkTitle = "Begin Reading"
+			} else if strings.Contains(title, "copyright") {
+				isLandmark = true
+				landmarkTitle = "Copyright Page"
+			}
+
+			if isLandmark {
+				// Use relative path (relative to manifest.json location)
+				// Remove leading slash if present to ensure it's a relative path
+				relativeHref := manifestHref(hrefStr)
+				item := map[string]interface{}{
+					"href": relativeHref,
+				}
+				if landmarkTitle != "" {
+					item["title"] = landmarkTitle
+				} else if link.Title != "" {
+					item["title"] = link.Title
+				}
+				landmarks = append(landmarks, item)
+				landmarkHrefs[hrefStr] = true
+			}
+		}
+	}
+
+	// If no landmarks found, try to infer from reading order (first item = Begin Reading)
+	if len(landmarks) == 0 && len(manifest.ReadingOrder) > 0 {
+		firstLink := manifest.ReadingOrder[0]
+		hrefStr := firstLink.Href.String()
+		// Use relative path (relative to manifest.json location)
+		// Remove leading slash if present to ensure it's a relative path
+		relativeHref := manifestHref(hrefStr)
+		landmarks = append(landmarks, map[string]interface{}{
+			"href":  relativeHref,
+			"title": "Begin Reading",
+		})
+	}
+
+	if len(landmarks) > 0 {
+		updatedManifest["landmarks"] = landmarks
+	}
+
+	// Build links array - always include required Readium links
+	links := make([]map[string]interface{}, 0)
+
+	// Add self reference (required)
+	links = append(links, map[string]interface{}{
+		"href": manifestURL,
+		"rel":  "self",
+		"type": "application/webpub+json",
+	})
+
+	// Add Readium-specific links (content.json and positions.json)
+	// Use relative paths: readium/content.json (without ~) since:
+	// 1. Supabase doesn't allow ~ in storage keys, so we store at readium/
+	// 2. Readers will resolve relative to manifest: {basePath}/readium/content.json
+	// 3. This matches where we actually stored the files
+	links = append(links, map[string]interface{}{
+		"href": "readium/content.json",
+		"type": "application/vnd.readium.content+json",
+	})
+	links = append(links, map[string]interface{}{
+		"href": "readium/positions.json",
+		"type": "application/vnd.readium.position-list+json",
+	})
+
+	// Extract license links from manifest.Links (they may have rel="http://creativecommons.org/ns#license")
+	// We'll add these when processing manifest.Links below
+
+	// Add non-landmark links from manifest.Links
+	for _, link := range manifest.Links {
+		// Skip links that are landmarks (already added above)
+		isLandmark := false
+		for _, rel := range link.Rels {
+			if landmarkRels[rel] {
+				isLandmark = true
+				break
+			}
+		}
+		if isLandmark {
+			continue
+		}
+
+		hrefStr := link.Href.String()
+		// Use relative paths for internal links, keep external URLs as-is
+		if !strings.HasPrefix(hrefStr, "http://") && !strings.HasPrefix(hrefStr, "https://") && !strings.HasPrefix(hrefStr, "~") {
+			// Use relative path (relative to manifest.json location)
+			// Remove leading slash if present to ensure it's a relative path
+			hrefStr = manifestHref(hrefStr)
+		}
+
+		item := map[string]interface{}{
+			"href": hrefStr,
+		}
+		if link.MediaType != nil {
+			item["type"] = link.MediaType.String()
+		}
+		if len(link.Rels) > 0 {
+			if len(link.Rels) == 1 {
+				item["rel"] = link.Rels[0]
+			} else {
+				item["rel"] = link.Rels
+			}
+		}
+		links = append(links, item)
+	}
+
+	if additions != nil {
+		links = append(links, additions.links...)
+	}
+
+	// Always include links array (required by Readium spec)
+	updatedManifest["links"] = links
+
+	// Update resources with relative paths
+	resources := make([]map[string]interface{}, 0, len(manifest.Resources))
+	for _, link := range manifest.Resources {
+		hrefStr := link.Href.String()
+		// Use relative path (relative to manifest.json location)
+		// Remove leading slash if present to ensure it's a relative path
+		relativeHref := manifestHref(hrefStr)
+
+		item := map[string]interface{}{
+			"href": relativeHref,
+		}
+		if link.MediaType != nil {
+			item["type"] = link.MediaType.String()
+		}
+		addMediaProperties(item, link)
+		if len(link.Properties) > 0 {
+			item["properties"] = link.Properties
+		}
+
+		// Add rel="contents" for TOC resources
+		if strings.Contains(hrefStr, "toc.xhtml") || strings.Contains(hrefStr, "toc.ncx") {
+			item["rel"] = "contents"
+		}
+
+		// Include any existing rel values from the link
+		if len(link.Rels) > 0 {
+			rels := make([]string, 0, len(link.Rels))
+			for _, rel := range link.Rels {
+				rels = append(rels, rel)
+			}
+			if len(rels) == 1 {
+				item["rel"] = rels[0]
+			} else if len(rels) > 1 {
+				item["rel"] = rels
+			}
+		}
+
+		resources = append(resources, item)
+	}
+	if len(resources) > 0 {
+		updatedManifest["resources"] = resources
+	}
+
+	// Add custom collections from optional features
+	if additions != nil {
+		for role, collection := range additions.collections {
+			updatedManifest[role] = collection
+		}
+	}
+
+	// Marshal to JSON
+	manifestJSON, err := canonicalJSON(updatedManifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	return manifestJSON, nil
+}
+
+// getContentType determines the content type based on file extension and path
+func getContentType(path string) string {
+	pathLower := strings.ToLower(path)
+
+	// Check for specific Readium JSON files first
+	if strings.HasSuffix(pathLower, "manifest.json") {
+		return "application/webpub+json; charset=utf-8"
+	}
+	if strings.HasSuffix(pathLower, "content.json") {
+		return "application/vnd.readium.content+json; charset=utf-8"
+	}
+	if strings.HasSuffix(pathLower, "positions.json") {
+		return "application/vnd.readium.position-list+json; charset=utf-8"
+	}
+
+	// Check file extension for other files
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".json":
+		return "application/json; charset=utf-8"
+	case ".jsonld":
+		return "application/ld+json; charset=utf-8"
+	case ".html", ".htm":
+		return "text/html"
+	case ".xhtml":
+		return "application/xhtml+xml"
+	case ".css":
+		return "text/css"
+	case ".js":
+		return "application/javascript"
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".svg":
+		return "image/svg+xml"
+	case ".mp3":
+		return "audio/mpeg"
+	case ".m4a", ".m4b":
+		return "audio/mp4"
+	case ".aac":
+		return "audio/aac"
+	case ".ogg", ".oga", ".opus":
+		return "audio/ogg"
+	case ".wav":
+		return "audio/wav"
+	case ".flac":
+		return "audio/flac"
+	case ".mp4", ".m4v":
+		return "video/mp4"
+	case ".webm":
+		return "video/webm"
+	case ".ogv":
+		return "video/ogg"
+	case ".mov":
+		return "video/quicktime"
+	case ".vtt":
+		return "text/vtt"
+	case ".ttml", ".dfxp":
+		return "application/ttml+xml"
+	case ".srt":
+		return "application/x-subrip"
+	case ".xml":
+		return "application/xml"
+	case ".ncx":
+		return "application/x-dtbncx+xml"
+	case ".opf":
+		return "application/oebps-package+xml"
+	case ".epub":
+		return "application/epub+zip"
+	case ".webpub":
+		return "application/webpub+zip"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// bytesAsset implements asset.PublicationAsset for in-memory EPUB data
+type bytesAsset struct {
+	name      string
+	mediaType string
+	fetcher   fetcher.Fetcher
+}
+
+func (a *bytesAsset) Name() string {
+	return a.name
+}
+
+func (a *bytesAsset) MediaType(ctx context.Context) mediatype.MediaType {
+	mt, _ := mediatype.New(a.mediaType, "", "")
+	return mt
+}
+
+func (a *bytesAsset) CreateFetcher(ctx context.Context, dependencies asset.Dependencies, credentials string) (fetcher.Fetcher, error) {
+	return a.fetcher, nil
+}
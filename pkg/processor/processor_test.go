@@ -0,0 +1,105 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestProcessor_FetchAndProcessWithFakeSupabase(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	archive := map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range archive {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	supabase.Put(EPUBBucket, "audiobooks/leviathan.lpf", buf.Bytes())
+
+	source, err := p.Fetch("audiobooks/leviathan.lpf", 0)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer source.Close()
+	if source.Size() != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes, got %d", buf.Len(), source.Size())
+	}
+
+	options := Options{}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	result, err := p.Process(source, "audiobooks/leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	basePath := BasePath("audiobooks/leviathan.lpf", options.Layout)
+	if result.ManifestURL != store.PublicURL(basePath+"/manifest.json") {
+		t.Errorf("Expected the public manifest URL, got %s", result.ManifestURL)
+	}
+	if data, ok := supabase.Object(ManifestBucket, basePath+"/audio/chapter 1.mp3"); !ok || string(data) != "one" {
+		t.Errorf("Expected the first track to be uploaded, got %q (%v)", data, ok)
+	}
+	manifestJSON, ok := supabase.Object(ManifestBucket, basePath+"/manifest.json")
+	var manifest map[string]interface{}
+	if !ok || json.Unmarshal(manifestJSON, &manifest) != nil {
+		t.Fatalf("Expected a manifest, got %q", manifestJSON)
+	}
+
+	// A second run finds the index of the first and uploads nothing
+	again, err := p.Process(source, "audiobooks/leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Second Process failed: %v", err)
+	}
+	if again.Uploaded != 0 || again.Skipped != result.Uploaded {
+		t.Errorf("Expected all %d files to be skipped, got %d uploaded and %d skipped", result.Uploaded, again.Uploaded, again.Skipped)
+	}
+}
+
+func TestSupabase_ReadKey(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create(lpfManifestPath)
+	f.Write([]byte(testPublicationJSON))
+	w.Close()
+	supabase.Put(EPUBBucket, "audiobooks/leviathan.lpf", buf.Bytes())
+
+	store := NewSupabase(supabase.URL, processortest.ServiceKey).WithReadKey(processortest.ReadKey)
+	source, err := store.Fetch("audiobooks/leviathan.lpf", 0)
+	if err != nil {
+		t.Fatalf("Expected the read key to download the EPUB, got %v", err)
+	}
+	source.Close()
+	if objects, err := store.List(EPUBBucket, ""); err != nil || len(objects) != 1 {
+		t.Errorf("Expected the read key to list the EPUBs, got %v, %v", objects, err)
+	}
+	if _, err := store.Upload("audiobooks_leviathan/manifest.json", []byte("{}"), ""); err != nil {
+		t.Errorf("Expected the service role key to upload, got %v", err)
+	}
+
+	// The read key is the one sent for the EPUBs, and it writes nothing
+	if _, err := NewSupabase(supabase.URL, processortest.ServiceKey).WithReadKey("revoked").Fetch("audiobooks/leviathan.lpf", 0); err == nil {
+		t.Error("Expected a download with another read key to fail")
+	}
+	if _, err := NewSupabase(supabase.URL, processortest.ReadKey).Upload("audiobooks_leviathan/manifest.json", []byte("{}"), ""); err == nil {
+		t.Error("Expected an upload with the read key to fail")
+	}
+}
@@ -0,0 +1,575 @@
+// Package processortest provides a fake Supabase Storage API for tests of code
+// built on the processor package, so they need neither a Supabase project nor
+// real EPUBs in its buckets.
+package processortest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceKey is the service role key the fake accepts
+const ServiceKey = "test-service-key"
+
+// epubBucket is the only bucket ReadKey can read
+const epubBucket = "epubs"
+
+// ReadKey is a read-only key the fake accepts for downloading and listing the
+// epubs bucket, and nothing else
+const ReadKey = "test-read-key"
+
+// S3AccessKeyID and S3SecretAccessKey are the S3 access keys the fake accepts
+// on its S3-compatible endpoint, in the S3Region region. Signatures are not
+// verified.
+const (
+	S3AccessKeyID     = "test-s3-access-key"
+	S3SecretAccessKey = "test-s3-secret-key"
+	S3Region          = "local"
+)
+
+// Supabase is an in-memory Supabase Storage API served by an httptest.Server.
+// It implements the object endpoints the pipeline uses (upload with and
+// without upsert, download, HEAD, delete, bulk delete, list and public
+// download), bucket lookups for the health check, and inserts and deletes of
+// database rows, filtered by equality, for the embedded chunks. Uploads can go
+// through signed upload URLs too. Objects can be
+// transferred through the S3-compatible endpoint as well (put, ranged get,
+// HEAD, delete and multipart uploads).
+type Supabase struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]object
+	rows       map[string][]map[string]interface{}
+	requestIDs []string
+	// downloads counts the GET requests of each object key ("bucket/path")
+	downloads map[string]int
+	// served counts the bytes of each object key sent by S3 GET requests
+	served map[string]int64
+	// uploadTokens maps the tokens of the signed upload URLs to their object
+	uploadTokens  map[string]string
+	signedUploads int
+	// uploads holds the parts of the multipart uploads in progress
+	uploads      map[string]*multipartUpload
+	s3Operations []string
+	s3Failures   int
+}
+
+// multipartUpload is a multipart upload in progress on the S3 endpoint
+type multipartUpload struct {
+	key   string
+	parts map[int][]byte
+	object
+}
+
+// object is a stored object and the headers it was uploaded with
+type object struct {
+	data            []byte
+	contentType     string
+	contentEncoding string
+	// modified is reported as the Last-Modified of the object
+	modified time.Time
+}
+
+// NewSupabase starts a fake Supabase. Callers must Close it.
+func NewSupabase() *Supabase {
+	s := &Supabase{objects: map[string]object{}, rows: map[string][]map[string]interface{}{}, uploads: map[string]*multipartUpload{}, uploadTokens: map[string]string{}, downloads: map[string]int{}, served: map[string]int64{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Put stores an object, e.g. an EPUB in the epubs bucket
+func (s *Supabase) Put(bucket, path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[bucket+"/"+path] = object{data: data, modified: time.Now()}
+}
+
+// Object returns the object stored at path in bucket
+func (s *Supabase) Object(bucket, path string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[bucket+"/"+path]
+	return obj.data, ok
+}
+
+// RequestIDs lists the X-Request-ID headers of the requests received so far,
+// with "" for requests without one
+func (s *Supabase) RequestIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requestIDs...)
+}
+
+// Paths lists the objects stored in bucket, sorted
+func (s *Supabase) Paths(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for key := range s.objects {
+		if path, ok := strings.CutPrefix(key, bucket+"/"); ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Downloads returns the number of times the object at path in bucket was
+// downloaded through the Storage API
+func (s *Supabase) Downloads(bucket, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads[bucket+"/"+path]
+}
+
+// Served returns the bytes of the object at path in bucket sent through the
+// S3 endpoint, ranges included
+func (s *Supabase) Served(bucket, path string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.served[bucket+"/"+path]
+}
+
+// SignedUploads returns the number of objects uploaded to signed upload URLs
+func (s *Supabase) SignedUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.signedUploads
+}
+
+// SignedURLs returns the number of signed upload URLs created
+func (s *Supabase) SignedURLs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploadTokens)
+}
+
+// S3Operations lists the S3 operations received so far, e.g. "PutObject" or
+// "UploadPart", including the failed ones
+func (s *Supabase) S3Operations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.s3Operations...)
+}
+
+// FailS3 makes the next n requests to the S3 endpoint fail with a 503
+func (s *Supabase) FailS3(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s3Failures = n
+}
+
+// Rows returns the rows of a database table, in insertion order
+func (s *Supabase) Rows(table string) []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}(nil), s.rows[table]...)
+}
+
+func (s *Supabase) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requestIDs = append(s.requestIDs, r.Header.Get("X-Request-ID"))
+	s.mu.Unlock()
+
+	if bucket, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/bucket/"); ok {
+		if !authorized(r) {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id": bucket, "name": bucket})
+		return
+	}
+
+	if key, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/s3/"); ok {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+S3AccessKeyID+"/") {
+			writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId")
+			return
+		}
+		s.s3(w, r, key)
+		return
+	}
+
+	if table, ok := strings.CutPrefix(r.URL.Path, "/rest/v1/"); ok {
+		if !authorized(r) {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		s.table(w, r, table)
+		return
+	}
+
+	if key, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/object/upload/sign/"); ok {
+		s.signedUpload(w, r, key)
+		return
+	}
+
+	if bucket, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/object/list/"); ok && r.Method == "POST" {
+		if !authorized(r) && !(bucket == epubBucket && readAuthorized(r)) {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		s.list(w, r, bucket)
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/object/")
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found")
+		return
+	}
+	// Public URLs are readable without the service key
+	key, public := strings.CutPrefix(key, "public/")
+	readOnly := (r.Method == "GET" || r.Method == "HEAD") && strings.HasPrefix(key, epubBucket+"/")
+	if !public && !authorized(r) && !(readOnly && readAuthorized(r)) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.Method == "POST" && !public:
+		if _, exists := s.objects[key]; exists && r.Header.Get("x-upsert") != "true" {
+			// As the Storage API does, report duplicates as a 400 carrying a 409
+			writeJSON(w, http.StatusBadRequest, map[string]string{"statusCode": "409", "error": "Duplicate", "message": "The resource already exists"})
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.objects[key] = object{data: data, contentType: r.Header.Get("Content-Type"), contentEncoding: r.Header.Get("Content-Encoding"), modified: time.Now()}
+		writeJSON(w, http.StatusOK, map[string]string{"Key": key})
+	case r.Method == "GET" || r.Method == "HEAD":
+		obj, exists := s.objects[key]
+		if !exists {
+			writeError(w, http.StatusNotFound, "not_found")
+			return
+		}
+		if obj.contentType != "" {
+			w.Header().Set("Content-Type", obj.contentType)
+		}
+		if obj.contentEncoding != "" {
+			w.Header().Set("Content-Encoding", obj.contentEncoding)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		w.Header().Set("ETag", etag(obj.data))
+		w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			s.downloads[key]++
+			w.Write(obj.data)
+		}
+	case r.Method == "DELETE" && !public && !strings.Contains(key, "/"):
+		// Bulk delete: the body lists the paths in the bucket
+		var body struct {
+			Prefixes []string `json:"prefixes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for _, path := range body.Prefixes {
+			delete(s.objects, key+"/"+path)
+		}
+		writeJSON(w, http.StatusOK, []interface{}{})
+	case r.Method == "DELETE" && !public:
+		delete(s.objects, key)
+		writeJSON(w, http.StatusOK, map[string]string{"message": "Successfully deleted"})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// signedUpload signs an upload URL for the object key ("bucket/path") with
+// the service key, or stores the object PUT to such a URL
+func (s *Supabase) signedUpload(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case "POST":
+		if !authorized(r) {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		token := fmt.Sprintf("token-%d", len(s.uploadTokens)+1)
+		s.uploadTokens[token] = key
+		writeJSON(w, http.StatusOK, map[string]string{"url": "/object/upload/sign/" + key + "?token=" + token, "token": token})
+	case "PUT":
+		if signed, ok := s.uploadTokens[r.URL.Query().Get("token")]; !ok || signed != key {
+			writeError(w, http.StatusBadRequest, "InvalidSignature")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.objects[key] = object{data: data, contentType: r.Header.Get("Content-Type"), contentEncoding: r.Header.Get("Content-Encoding"), modified: time.Now()}
+		s.signedUploads++
+		writeJSON(w, http.StatusOK, map[string]string{"Key": key})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// s3 answers a request to the S3-compatible endpoint for the object key
+// ("bucket/path")
+func (s *Supabase) s3(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	operation := map[string]string{"PUT": "PutObject", "GET": "GetObject", "HEAD": "HeadObject", "DELETE": "DeleteObject"}[r.Method]
+	switch {
+	case r.Method == "POST" && query.Has("uploads"):
+		operation = "CreateMultipartUpload"
+	case r.Method == "PUT" && query.Has("uploadId"):
+		operation = "UploadPart"
+	case r.Method == "POST" && query.Has("uploadId"):
+		operation = "CompleteMultipartUpload"
+	case r.Method == "DELETE" && query.Has("uploadId"):
+		operation = "AbortMultipartUpload"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.s3Operations = append(s.s3Operations, operation)
+	if s.s3Failures > 0 {
+		s.s3Failures--
+		writeS3Error(w, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+
+	switch operation {
+	case "PutObject":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.objects[key] = object{data: data, contentType: r.Header.Get("Content-Type"), contentEncoding: r.Header.Get("Content-Encoding"), modified: time.Now()}
+		w.Header().Set("ETag", etag(data))
+	case "GetObject", "HeadObject":
+		obj, exists := s.objects[key]
+		if !exists {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		if obj.contentEncoding != "" {
+			w.Header().Set("Content-Encoding", obj.contentEncoding)
+		}
+		// ServeContent answers Range requests with a 206
+		w.Header().Set("ETag", etag(obj.data))
+		counter := &countingWriter{ResponseWriter: w}
+		http.ServeContent(counter, r, "", obj.modified, bytes.NewReader(obj.data))
+		s.served[key] += counter.n
+	case "DeleteObject":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "CreateMultipartUpload":
+		uploadID := strconv.Itoa(len(s.s3Operations))
+		s.uploads[uploadID] = &multipartUpload{key: key, parts: map[int][]byte{}, object: object{contentType: r.Header.Get("Content-Type"), contentEncoding: r.Header.Get("Content-Encoding")}}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Key: key, UploadID: uploadID})
+	case "UploadPart", "CompleteMultipartUpload", "AbortMultipartUpload":
+		upload, exists := s.uploads[query.Get("uploadId")]
+		if !exists || upload.key != key {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		switch operation {
+		case "UploadPart":
+			number, _ := strconv.Atoi(query.Get("partNumber"))
+			data, err := io.ReadAll(r.Body)
+			if err != nil || number < 1 {
+				writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			upload.parts[number] = data
+			w.Header().Set("ETag", etag(data))
+		case "CompleteMultipartUpload":
+			var body struct {
+				Parts []struct {
+					PartNumber int
+					ETag       string
+				} `xml:"Part"`
+			}
+			if err := xml.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Parts) == 0 {
+				writeS3Error(w, http.StatusBadRequest, "MalformedXML")
+				return
+			}
+			var data []byte
+			for i, part := range body.Parts {
+				content, exists := upload.parts[part.PartNumber]
+				if !exists || part.PartNumber != i+1 || part.ETag != etag(content) {
+					writeS3Error(w, http.StatusBadRequest, "InvalidPart")
+					return
+				}
+				data = append(data, content...)
+			}
+			upload.data, upload.modified = data, time.Now()
+			s.objects[key] = upload.object
+			delete(s.uploads, query.Get("uploadId"))
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+				Key     string
+			}{Key: key})
+		case "AbortMultipartUpload":
+			delete(s.uploads, query.Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// etag returns the ETag of an object or part, quoted as S3 does
+// countingWriter counts the bytes of the body written to a response
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func etag(data []byte) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(data))
+}
+
+// list answers a list request with the direct children of the prefix folder:
+// objects with their size and type, and folders without an ID
+func (s *Supabase) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	var body struct {
+		Prefix string `json:"prefix"`
+		Limit  int    `json:"limit"`
+		Offset int    `json:"offset"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	folder := bucket + "/"
+	if body.Prefix != "" {
+		folder += strings.Trim(body.Prefix, "/") + "/"
+	}
+
+	s.mu.Lock()
+	children := map[string]map[string]interface{}{}
+	for key, obj := range s.objects {
+		rest, ok := strings.CutPrefix(key, folder)
+		if !ok {
+			continue
+		}
+		if name, _, isFolder := strings.Cut(rest, "/"); isFolder {
+			children[name] = map[string]interface{}{"name": name, "id": nil, "metadata": nil}
+		} else {
+			children[name] = map[string]interface{}{
+				"name":     name,
+				"id":       key,
+				"metadata": map[string]interface{}{"size": len(obj.data), "mimetype": obj.contentType},
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := []map[string]interface{}{}
+	for i, name := range names {
+		if i >= body.Offset && (body.Limit == 0 || len(entries) < body.Limit) {
+			entries = append(entries, children[name])
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// table inserts the rows of a POST into table, or deletes the rows of table
+// whose columns equal the eq. filters of the query
+func (s *Supabase) table(w http.ResponseWriter, r *http.Request, table string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case "POST":
+		var rows []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&rows); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.rows[table] = append(s.rows[table], rows...)
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		var kept []map[string]interface{}
+		for _, row := range s.rows[table] {
+			matches := true
+			for column, values := range r.URL.Query() {
+				value, _ := strings.CutPrefix(values[0], "eq.")
+				if fmt.Sprint(row[column]) != value {
+					matches = false
+				}
+			}
+			if !matches {
+				kept = append(kept, row)
+			}
+		}
+		s.rows[table] = kept
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// authorized checks the apikey and bearer token the service role key is sent as
+func authorized(r *http.Request) bool {
+	return r.Header.Get("apikey") == ServiceKey && r.Header.Get("Authorization") == "Bearer "+ServiceKey
+}
+
+// readAuthorized checks the request is sent with the read-only key
+func readAuthorized(r *http.Request) bool {
+	return r.Header.Get("apikey") == ReadKey && r.Header.Get("Authorization") == "Bearer "+ReadKey
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message, "message": message})
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+	}{Code: code})
+}
+
+func writeXML(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,146 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// pipelineConfigPathEnvVar is a pipeline config bundled with the function,
+	// e.g. "profiles.yaml"
+	pipelineConfigPathEnvVar = "PIPELINE_CONFIG_PATH"
+	// pipelineConfigKeyEnvVar is a pipeline config stored in the manifest
+	// bucket, e.g. "config/profiles.yaml", which takes precedence over the
+	// bundled one so profiles can change without a deploy
+	pipelineConfigKeyEnvVar = "PIPELINE_CONFIG_KEY"
+)
+
+// pipelineConfig is the YAML (or JSON) file defining the pipeline profiles. A
+// profile holds options as in the request body, e.g.
+//
+//	profiles:
+//	  web-reader:
+//	    transforms: {image_recompress: true, js_sanitize: true}
+//	    hooks: {search_index: true}
+//	  archival:
+//	    transforms: {image_recompress: false}
+//	    package: webpub
+type pipelineConfig struct {
+	Profiles map[string]Options `json:"profiles"`
+}
+
+// parsePipelineConfig parses a pipeline config and validates its profiles
+func parsePipelineConfig(data []byte) (*pipelineConfig, error) {
+	// JSON is YAML too; going through JSON reuses the option names of the request
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid pipeline config: %w", err)
+	}
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pipeline config: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(normalized))
+	decoder.DisallowUnknownFields()
+	var config pipelineConfig
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid pipeline config: %w", err)
+	}
+
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profile := config.Profiles[name]
+		if profile.Profile != "" {
+			return nil, fmt.Errorf("invalid pipeline profile %q: profiles cannot select another profile", name)
+		}
+		// profile is a copy, so the defaults Resolve fills in don't override
+		// the options of the requests
+		if err := profile.Resolve(); err != nil {
+			return nil, fmt.Errorf("invalid pipeline profile %q: %w", name, err)
+		}
+	}
+	return &config, nil
+}
+
+// pipelineConfigFromEnv loads the pipeline config from PIPELINE_CONFIG_KEY in
+// the manifest bucket of store, or else from the PIPELINE_CONFIG_PATH file. It
+// returns nil if neither is set.
+func pipelineConfigFromEnv(store Uploader) (*pipelineConfig, error) {
+	var data []byte
+	var err error
+	if key := os.Getenv(pipelineConfigKeyEnvVar); key != "" && store != nil {
+		if data, err = store.Download(key); err != nil {
+			return nil, fmt.Errorf("failed to download pipeline config %s: %w", key, err)
+		}
+	} else if path := os.Getenv(pipelineConfigPathEnvVar); path != "" {
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read pipeline config: %w", err)
+		}
+	} else {
+		return nil, nil
+	}
+	return parsePipelineConfig(data)
+}
+
+// ApplyProfile fills in the options the request leaves unset from the profile
+// it selects, loaded from the pipeline config (see PIPELINE_CONFIG_KEY and
+// PIPELINE_CONFIG_PATH). Transforms and hooks are merged name by name. store
+// may be nil when the config can only come from a bundled file.
+func (o *Options) ApplyProfile(store Uploader) error {
+	if o.Profile == "" {
+		return nil
+	}
+	config, err := pipelineConfigFromEnv(store)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return WithStatus(400, fmt.Errorf("profile %q requires a pipeline config (%s or %s)", o.Profile, pipelineConfigKeyEnvVar, pipelineConfigPathEnvVar))
+	}
+	profile, ok := config.Profiles[o.Profile]
+	if !ok {
+		names := make([]string, 0, len(config.Profiles))
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return WithStatus(400, fmt.Errorf("unknown profile %q (available: %s)", o.Profile, strings.Join(names, ", ")))
+	}
+	mergeProfile(o, profile)
+	return nil
+}
+
+// mergeProfile copies the fields of profile into the zero fields of o, and the
+// map entries of profile missing from the maps of o
+func mergeProfile(o *Options, profile Options) {
+	target := reflect.ValueOf(o).Elem()
+	source := reflect.ValueOf(profile)
+	for i := 0; i < target.NumField(); i++ {
+		field, value := target.Field(i), source.Field(i)
+		if value.IsZero() {
+			continue
+		}
+		if field.Kind() == reflect.Map && !field.IsNil() {
+			for _, key := range value.MapKeys() {
+				if !field.MapIndex(key).IsValid() {
+					field.SetMapIndex(key, value.MapIndex(key))
+				}
+			}
+			continue
+		}
+		if field.IsZero() {
+			field.Set(value)
+		}
+	}
+}
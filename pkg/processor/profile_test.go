@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+const testPipelineConfig = `
+profiles:
+  web-reader:
+    transforms: {image_recompress: true, js_sanitize: true}
+    hooks: {search_index: true}
+    extract_text: true
+    layout: preserve
+  archival:
+    transforms: {image_recompress: false}
+    package: webpub
+`
+
+func TestParsePipelineConfig(t *testing.T) {
+	config, err := parsePipelineConfig([]byte(testPipelineConfig))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	web := config.Profiles["web-reader"]
+	if !web.ExtractText || !web.Transforms["js_sanitize"] || !web.Hooks["search_index"] {
+		t.Errorf("Expected the web-reader options, got %+v", web)
+	}
+	if archival := config.Profiles["archival"]; archival.Package != "webpub" || archival.Layout != "" {
+		t.Errorf("Expected the archival options without defaults, got %+v", archival)
+	}
+
+	// JSON is accepted too
+	if config, err := parsePipelineConfig([]byte(`{"profiles": {"minimal": {"prune_unused": true}}}`)); err != nil || !config.Profiles["minimal"].PruneUnused {
+		t.Errorf("Expected a JSON config parsed, got %+v, %v", config, err)
+	}
+
+	for _, invalid := range []string{
+		"profiles:\n  typo:\n    extract_txt: true\n",
+		"profiles:\n  bad:\n    transforms: {minify: true}\n",
+		"profiles:\n  nested:\n    profile: web-reader\n",
+		"profiles: [",
+	} {
+		if _, err := parsePipelineConfig([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	if err := os.WriteFile(path, []byte(testPipelineConfig), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(pipelineConfigPathEnvVar, path)
+	t.Setenv(pipelineConfigKeyEnvVar, "")
+
+	options := Options{Profile: "web-reader", Layout: "flat", Transforms: map[string]bool{"image_recompress": false}}
+	if err := options.ApplyProfile(nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if options.Layout != "flat" || !options.ExtractText {
+		t.Errorf("Expected the profile to fill in unset options only, got %+v", options)
+	}
+	if want := map[string]bool{"image_recompress": false, "js_sanitize": true}; !reflect.DeepEqual(options.Transforms, want) {
+		t.Errorf("Expected transforms %v, got %v", want, options.Transforms)
+	}
+	if err := options.Resolve(); err != nil {
+		t.Errorf("Expected the merged options to resolve, got %v", err)
+	}
+
+	unknown := Options{Profile: "print"}
+	if err := unknown.ApplyProfile(nil); err == nil || StatusCode(err) != 400 || !strings.Contains(err.Error(), "archival, web-reader") {
+		t.Errorf("Expected a 400 listing the profiles, got %v", err)
+	}
+
+	t.Setenv(pipelineConfigPathEnvVar, "")
+	if err := (&Options{Profile: "web-reader"}).ApplyProfile(nil); err == nil || StatusCode(err) != 400 {
+		t.Errorf("Expected a 400 without a pipeline config, got %v", err)
+	}
+	if err := (&Options{}).ApplyProfile(nil); err != nil {
+		t.Errorf("Expected no error without a profile, got %v", err)
+	}
+}
+
+func TestApplyProfile_FromBucket(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	if _, err := store.Upload("config/profiles.json", []byte(`{"profiles": {"archival": {"package": "webpub"}}}`), ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(pipelineConfigKeyEnvVar, "config/profiles.json")
+	t.Setenv(pipelineConfigPathEnvVar, filepath.Join(t.TempDir(), "missing.yaml"))
+
+	options := Options{Profile: "archival"}
+	if err := options.ApplyProfile(store); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if options.Package != "webpub" {
+		t.Errorf("Expected the profile from the bucket, got %+v", options)
+	}
+}
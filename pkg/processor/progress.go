@@ -0,0 +1,88 @@
+package processor
+
+import "time"
+
+// Progress is how far a job has come through the resources of a publication
+type Progress struct {
+	// Done is the number of resources processed, out of Total
+	Done  int `json:"done"`
+	Total int `json:"total"`
+	// Bytes is the size of the files sent to storage so far, unchanged files
+	// excluded
+	Bytes   int64 `json:"bytes"`
+	Percent int   `json:"percent"`
+}
+
+// WithProgress returns a copy of p that calls report as the jobs it runs
+// process their resources, at most once per interval besides the first and
+// last reports. report is called on the processing goroutine, so it should
+// return quickly.
+func (p *Processor) WithProgress(report func(Progress), interval time.Duration) *Processor {
+	reporting := *p
+	reporting.progress = report
+	reporting.progressInterval = interval
+	return &reporting
+}
+
+// progressReporter counts the resources of a job and reports its progress.
+// A nil reporter reports nothing.
+type progressReporter struct {
+	report   func(Progress)
+	interval time.Duration
+	progress Progress
+	last     time.Time
+}
+
+// newProgressReporter returns a reporter calling report, or nil without one
+func newProgressReporter(report func(Progress), interval time.Duration) *progressReporter {
+	if report == nil {
+		return nil
+	}
+	return &progressReporter{report: report, interval: interval}
+}
+
+// start reports that the job has total resources to process
+func (r *progressReporter) start(total int) {
+	if r == nil {
+		return
+	}
+	r.progress.Total = total
+	r.send()
+}
+
+// advance counts a processed resource
+func (r *progressReporter) advance() {
+	if r == nil {
+		return
+	}
+	r.progress.Done = min(r.progress.Done+1, r.progress.Total)
+	if time.Since(r.last) >= r.interval {
+		r.send()
+	}
+}
+
+// stored counts the size of a stored file
+func (r *progressReporter) stored(size int) {
+	if r != nil {
+		r.progress.Bytes += int64(size)
+	}
+}
+
+// finish reports every resource as processed
+func (r *progressReporter) finish() {
+	if r == nil {
+		return
+	}
+	r.progress.Done = r.progress.Total
+	r.send()
+}
+
+// send reports the current progress
+func (r *progressReporter) send() {
+	r.progress.Percent = 100
+	if r.progress.Total > 0 {
+		r.progress.Percent = r.progress.Done * 100 / r.progress.Total
+	}
+	r.last = time.Now()
+	r.report(r.progress)
+}
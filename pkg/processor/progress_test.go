@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestProgressReporter_Throttles(t *testing.T) {
+	var reports []Progress
+	r := newProgressReporter(func(p Progress) { reports = append(reports, p) }, time.Hour)
+	r.start(4)
+	for range 4 {
+		r.stored(10)
+		r.advance()
+	}
+	r.finish()
+
+	want := []Progress{{Done: 0, Total: 4}, {Done: 4, Total: 4, Bytes: 40, Percent: 100}}
+	if len(reports) != len(want) || reports[0] != want[0] || reports[1] != want[1] {
+		t.Errorf("Expected %+v, got %+v", want, reports)
+	}
+
+	var nilReporter *progressReporter
+	nilReporter.start(1)
+	nilReporter.advance()
+	nilReporter.finish()
+}
+
+func TestProcess_ReportsProgress(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	var reports []Progress
+	p := New(store, store).WithProgress(func(progress Progress) { reports = append(reports, progress) }, 0)
+	options := Options{}
+	if err := options.Resolve(); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	processTestLPF(t, supabase, p, "audiobooks/leviathan.lpf", testPublicationJSON, options)
+	if len(reports) < 3 {
+		t.Fatalf("Expected a report per resource, got %+v", reports)
+	}
+	first, last := reports[0], reports[len(reports)-1]
+	if first.Done != 0 || first.Total == 0 || first.Percent != 0 {
+		t.Errorf("Expected the first report to be at 0%%, got %+v", first)
+	}
+	if last.Done != last.Total || last.Percent != 100 || last.Bytes != int64(len("one")+len("two")) {
+		t.Errorf("Expected the last report to be at 100%% with both tracks stored, got %+v", last)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Done < reports[i-1].Done {
+			t.Errorf("Expected progress to only go forward, got %+v", reports)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package processor
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// repackagedEPUBPath is where the repackaged EPUB is stored, relative to basePath
+const repackagedEPUBPath = "publication.epub"
+
+// encryptionPath is the container file listing encrypted and obfuscated resources
+const encryptionPath = "META-INF/encryption.xml"
+
+// fontObfuscationAlgorithms only obfuscate fonts; the parser's fetcher undoes them,
+// so the fonts written to the repackaged EPUB are plain
+var fontObfuscationAlgorithms = map[string]bool{
+	"http://www.idpf.org/2008/embedding": true,
+	"http://ns.adobe.com/pdf/enc#RC":     true,
+}
+
+var (
+	encryptedDataPattern    = regexp.MustCompile(`(?is)\s*<(?:\w+:)?EncryptedData\b.*?</(?:\w+:)?EncryptedData>`)
+	encryptionMethodPattern = regexp.MustCompile(`(?i)<(?:\w+:)?EncryptionMethod[^>]*\sAlgorithm=["']([^"']+)["']`)
+	cipherReferencePattern  = regexp.MustCompile(`(?i)<(?:\w+:)?CipherReference[^>]*\sURI=["']([^"']+)["']`)
+)
+
+// epubRepackager writes the processed resources back into an EPUB, so readers who
+// download the book get the same content as the web reader. Resources are written
+// as they are processed; finish copies everything else from the source archive.
+// A nil repackager ignores all calls.
+type epubRepackager struct {
+	source  []*zip.File
+	entries map[string]*zip.File // resource key -> source entry
+	file    *os.File
+	zw      *zip.Writer
+	written map[string]bool // entry names already in the new archive
+	added   map[string]bool // entry names written with processed content
+}
+
+// newEPUBRepackager starts a new archive next to zipReader, on local disk
+func newEPUBRepackager(zipReader *zip.Reader) (*epubRepackager, error) {
+	file, err := os.CreateTemp("", "repackaged-*.epub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	r := &epubRepackager{
+		source:  zipReader.File,
+		entries: map[string]*zip.File{},
+		file:    file,
+		zw:      zip.NewWriter(file),
+		written: map[string]bool{},
+		added:   map[string]bool{},
+	}
+	for _, f := range zipReader.File {
+		r.entries[resourceKey(f.Name)] = f
+	}
+
+	// The mimetype entry must be first and stored uncompressed
+	w, err := r.zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err == nil {
+		_, err = io.WriteString(w, "application/epub+zip")
+	}
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to write mimetype entry: %w", err)
+	}
+	r.written["mimetype"] = true
+	return r, nil
+}
+
+// add writes the processed content of the resource at href, under the name of
+// its source entry so the package document still refers to it
+func (r *epubRepackager) add(href string, data []byte) error {
+	if r == nil {
+		return nil
+	}
+	key := resourceKey(href)
+	header := &zip.FileHeader{Name: key, Method: zip.Deflate}
+	if f := r.entries[key]; f != nil {
+		header.Name = f.Name
+		header.Modified = f.Modified
+	}
+	if r.written[header.Name] {
+		return nil
+	}
+	w, err := r.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	r.written[header.Name] = true
+	r.added[header.Name] = true
+	return nil
+}
+
+// finish copies the entries that were not processed (package document, navigation,
+// filtered-out resources, ...) unchanged and returns the complete archive. Fonts
+// written de-obfuscated are removed from META-INF/encryption.xml.
+func (r *epubRepackager) finish() ([]byte, error) {
+	if r == nil {
+		return nil, nil
+	}
+	for _, f := range r.source {
+		if r.written[f.Name] {
+			continue
+		}
+		if f.Name == encryptionPath {
+			if err := r.writeEncryption(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := r.zw.Copy(f); err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", f.Name, err)
+		}
+		r.written[f.Name] = true
+	}
+	if err := r.zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish repackaged EPUB: %w", err)
+	}
+
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r.file)
+}
+
+// writeEncryption writes encryption.xml without the obfuscated fonts that were
+// repackaged in the clear, dropping the file when nothing else is encrypted
+func (r *epubRepackager) writeEncryption(f *zip.File) error {
+	data, err := readZipEntry(f)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	rewritten := encryptedDataPattern.ReplaceAllStringFunc(string(data), func(block string) string {
+		method := encryptionMethodPattern.FindStringSubmatch(block)
+		reference := cipherReferencePattern.FindStringSubmatch(block)
+		if method != nil && reference != nil && fontObfuscationAlgorithms[method[1]] {
+			if source := r.entries[resourceKey(strings.TrimPrefix(reference[1], "/"))]; source != nil && r.added[source.Name] {
+				return ""
+			}
+		}
+		remaining++
+		return block
+	})
+	if remaining == 0 {
+		return nil
+	}
+	w, err := r.zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, rewritten); err != nil {
+		return err
+	}
+	r.written[f.Name] = true
+	return nil
+}
+
+// Close removes the temporary archive
+func (r *epubRepackager) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.file.Close()
+	return os.Remove(r.file.Name())
+}
@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testEncryptionXML = `<?xml version="1.0"?>
+<encryption xmlns="urn:oasis:names:tc:opendocument:xmlns:container" xmlns:enc="http://www.w3.org/2001/04/xmlenc#">
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/fonts/body.otf"/></enc:CipherData>
+  </enc:EncryptedData>
+  <enc:EncryptedData>
+    <enc:EncryptionMethod Algorithm="http://www.idpf.org/2008/embedding"/>
+    <enc:CipherData><enc:CipherReference URI="OEBPS/fonts/excluded.otf"/></enc:CipherData>
+  </enc:EncryptedData>
+</encryption>`
+
+func TestEPUBRepackager(t *testing.T) {
+	source := buildEPUB(t, map[string]string{
+		"mimetype":                 "application/epub+zip",
+		"META-INF/container.xml":   validContainer,
+		"META-INF/encryption.xml":  testEncryptionXML,
+		"OEBPS/content.opf":        "<package/>",
+		"OEBPS/text/ch1.xhtml":     "<html><script>alert(1)</script></html>",
+		"OEBPS/fonts/body.otf":     "obfuscated",
+		"OEBPS/fonts/excluded.otf": "obfuscated",
+	})
+
+	repackager, err := newEPUBRepackager(source)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer repackager.Close()
+	if err := repackager.add("OEBPS/text/ch1.xhtml", []byte("<html></html>")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := repackager.add("/OEBPS/fonts/body.otf", []byte("plain")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, err := repackager.finish()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Expected a valid ZIP, got %v", err)
+	}
+	if first := zipReader.File[0]; first.Name != "mimetype" || first.Method != zip.Store {
+		t.Errorf("Expected a stored mimetype entry first, got %s (method %d)", first.Name, first.Method)
+	}
+	entries := map[string]string{}
+	for _, f := range zipReader.File {
+		if _, ok := entries[f.Name]; ok {
+			t.Errorf("Expected %s only once", f.Name)
+		}
+		content, err := readZipEntry(f)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", f.Name, err)
+		}
+		entries[f.Name] = string(content)
+	}
+
+	expected := map[string]string{
+		"OEBPS/text/ch1.xhtml":     "<html></html>",
+		"OEBPS/fonts/body.otf":     "plain",
+		"OEBPS/fonts/excluded.otf": "obfuscated",
+		"OEBPS/content.opf":        "<package/>",
+	}
+	for name, content := range expected {
+		if entries[name] != content {
+			t.Errorf("Expected %s to contain %q, got %q", name, content, entries[name])
+		}
+	}
+	encryption := entries[encryptionPath]
+	if strings.Contains(encryption, "body.otf") || !strings.Contains(encryption, "excluded.otf") {
+		t.Errorf("Expected only the repackaged font to be removed from encryption.xml, got %s", encryption)
+	}
+}
+
+func TestEPUBRepackagerDropsEmptyEncryption(t *testing.T) {
+	source := buildEPUB(t, map[string]string{
+		"META-INF/encryption.xml":  testEncryptionXML,
+		"OEBPS/fonts/body.otf":     "obfuscated",
+		"OEBPS/fonts/excluded.otf": "obfuscated",
+	})
+	repackager, err := newEPUBRepackager(source)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer repackager.Close()
+	repackager.add("OEBPS/fonts/body.otf", []byte("plain"))
+	repackager.add("OEBPS/fonts/excluded.otf", []byte("plain"))
+	data, err := repackager.finish()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Expected a valid ZIP, got %v", err)
+	}
+	for _, f := range zipReader.File {
+		if f.Name == encryptionPath {
+			t.Error("Expected encryption.xml to be dropped once every font is de-obfuscated")
+		}
+	}
+
+	var nilRepackager *epubRepackager
+	if err := nilRepackager.add("a.xhtml", nil); err != nil {
+		t.Errorf("Expected a nil repackager to ignore add, got %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// utf8BOM is the byte order mark some authoring tools prepend to XML files
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+var (
+	rootfilePattern  = regexp.MustCompile(`(?i)<rootfile[^>]*\sfull-path=["']([^"']+)["']`)
+	opfItemIDPattern = regexp.MustCompile(`(?i)<item\s[^>]*\bid=["']([^"']+)["']`)
+	itemrefPattern   = regexp.MustCompile(`(?i)<itemref\s[^>]*\bidref=["']([^"']+)["'][^>]*/?>(\s*</itemref>)?`)
+)
+
+// repairArchive fixes common real-world packaging defects that make the EPUB
+// parser fail outright, returning a repaired copy of the archive plus a warning
+// for each fix. If nothing needs repairing the original source is returned.
+//
+// Repairs:
+//   - missing mimetype entry
+//   - UTF-8 BOM in META-INF/container.xml or the OPF
+//   - spine itemrefs pointing at ids missing from the OPF manifest
+//   - entry names in a legacy (CP437) encoding instead of UTF-8
+func repairArchive(source *Source, zipReader *zip.Reader) (*Source, *zip.Reader, []string, error) {
+	var warnings []string
+	fixes := map[string][]byte{} // entry name -> replacement content
+	renames := map[*zip.File]string{}
+
+	// Non-UTF-8 entry names: decode them as CP437, the ZIP spec's legacy encoding
+	for _, f := range zipReader.File {
+		if f.NonUTF8 || !utf8.ValidString(f.Name) {
+			decoded, err := charmap.CodePage437.NewDecoder().String(f.Name)
+			if err == nil && decoded != f.Name {
+				renames[f] = decoded
+				warnings = append(warnings, fmt.Sprintf("decoded non-UTF-8 entry name %q as %q", f.Name, decoded))
+			}
+		}
+	}
+
+	entries := map[string]*zip.File{}
+	for _, f := range zipReader.File {
+		name := f.Name
+		if renamed, ok := renames[f]; ok {
+			name = renamed
+		}
+		entries[name] = f
+	}
+
+	hasMimetype := entries["mimetype"] != nil
+	if !hasMimetype {
+		warnings = append(warnings, "added missing mimetype entry")
+	}
+
+	// BOM in container.xml
+	containerData, err := readZipEntry(entries["META-INF/container.xml"])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if bytes.HasPrefix(containerData, utf8BOM) {
+		containerData = bytes.TrimPrefix(containerData, utf8BOM)
+		fixes["META-INF/container.xml"] = containerData
+		warnings = append(warnings, "removed byte order mark from META-INF/container.xml")
+	}
+
+	// BOM in the OPF, and spine items missing from the manifest
+	if match := rootfilePattern.FindSubmatch(containerData); match != nil {
+		opfPath := string(match[1])
+		opfData, err := readZipEntry(entries[opfPath])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		original := opfData
+
+		if bytes.HasPrefix(opfData, utf8BOM) {
+			opfData = bytes.TrimPrefix(opfData, utf8BOM)
+			warnings = append(warnings, fmt.Sprintf("removed byte order mark from %s", opfPath))
+		}
+
+		itemIDs := map[string]bool{}
+		for _, m := range opfItemIDPattern.FindAllSubmatch(opfData, -1) {
+			itemIDs[string(m[1])] = true
+		}
+		opfData = itemrefPattern.ReplaceAllFunc(opfData, func(itemref []byte) []byte {
+			idref := string(itemrefPattern.FindSubmatch(itemref)[1])
+			if itemIDs[idref] {
+				return itemref
+			}
+			warnings = append(warnings, fmt.Sprintf("removed spine item %q which is missing from the manifest", idref))
+			return nil
+		})
+
+		if !bytes.Equal(opfData, original) {
+			fixes[opfPath] = opfData
+		}
+	}
+
+	if len(warnings) == 0 {
+		return source, zipReader, nil, nil
+	}
+
+	repaired, err := rewriteArchive(zipReader, renames, fixes, !hasMimetype)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to write repaired archive: %w", err)
+	}
+	repairedReader, err := repaired.openZIP()
+	if err != nil {
+		repaired.Close()
+		return nil, nil, nil, err
+	}
+	return repaired, repairedReader, warnings, nil
+}
+
+// rewriteArchive writes a copy of zipReader to a new spooled source, renaming and
+// replacing entries as requested, optionally prepending a mimetype entry. Fixes
+// for names that aren't in the archive are added at its end.
+func rewriteArchive(zipReader *zip.Reader, renames map[*zip.File]string, fixes map[string][]byte, addMimetype bool) (*Source, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeRepairedArchive(pw, zipReader, renames, fixes, addMimetype))
+	}()
+	return SpoolEPUB(pr, 0)
+}
+
+func writeRepairedArchive(w io.Writer, zipReader *zip.Reader, renames map[*zip.File]string, fixes map[string][]byte, addMimetype bool) error {
+	zw := zip.NewWriter(w)
+
+	// The mimetype entry must be first and stored uncompressed
+	if addMimetype {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, "application/epub+zip"); err != nil {
+			return err
+		}
+	}
+
+	written := map[string]bool{}
+	for _, f := range zipReader.File {
+		name := f.Name
+		if renamed, ok := renames[f]; ok {
+			name = renamed
+		}
+		written[name] = true
+
+		if data, ok := fixes[name]; ok {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: f.Method, Modified: f.Modified})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if name == f.Name {
+			// Unchanged entries are copied without recompressing
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header := f.FileHeader
+		header.Name = name
+		header.NonUTF8 = false
+		raw, err := f.OpenRaw()
+		if err != nil {
+			return err
+		}
+		w, err := zw.CreateRaw(&header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, raw); err != nil {
+			return err
+		}
+	}
+
+	added := make([]string, 0, len(fixes))
+	for name := range fixes {
+		if !written[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(fixes[name]); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// readZipEntry reads the whole content of an archive entry; a nil entry reads as empty
+func readZipEntry(f *zip.File) ([]byte, error) {
+	if f == nil {
+		return nil, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRepairArchive_FixesCommonDefects(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	add := func(header *zip.FileHeader, content string) {
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatalf("create %s: %v", header.Name, err)
+		}
+		f.Write([]byte(content))
+	}
+	// No mimetype entry, a BOM in container.xml, a dangling spine item and a CP437 entry name
+	add(&zip.FileHeader{Name: "META-INF/container.xml"}, "\xEF\xBB\xBF"+`<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`)
+	add(&zip.FileHeader{Name: "content.opf"}, `<package><manifest><item id="ch1" href="ch1.xhtml"/></manifest><spine><itemref idref="ch1"/><itemref idref="missing"/></spine></package>`)
+	add(&zip.FileHeader{Name: "ch1.xhtml"}, "<html/>")
+	add(&zip.FileHeader{Name: "caf\x82.jpg", NonUTF8: true}, "jpeg")
+	w.Close()
+
+	source, err := SpoolEPUB(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	defer source.Close()
+	zipReader, err := source.openZIP()
+	if err != nil {
+		t.Fatalf("openZIP failed: %v", err)
+	}
+
+	repaired, repairedReader, warnings, err := repairArchive(source, zipReader)
+	if err != nil {
+		t.Fatalf("repairArchive failed: %v", err)
+	}
+	defer repaired.Close()
+
+	if len(warnings) != 4 {
+		t.Errorf("Expected 4 warnings, got %d: %v", len(warnings), warnings)
+	}
+
+	entries := map[string]*zip.File{}
+	for _, f := range repairedReader.File {
+		entries[f.Name] = f
+	}
+	if repairedReader.File[0].Name != "mimetype" || repairedReader.File[0].Method != zip.Store {
+		t.Errorf("Expected a stored mimetype as the first entry, got %s", repairedReader.File[0].Name)
+	}
+	if entries["café.jpg"] == nil {
+		t.Errorf("Expected CP437 entry name to be decoded to café.jpg")
+	}
+
+	container, _ := readZipEntry(entries["META-INF/container.xml"])
+	if bytes.HasPrefix(container, utf8BOM) {
+		t.Errorf("Expected BOM to be removed from container.xml")
+	}
+	opf, _ := readZipEntry(entries["content.opf"])
+	if strings.Contains(string(opf), "missing") || !strings.Contains(string(opf), `idref="ch1"`) {
+		t.Errorf("Expected only the dangling itemref to be removed, got %s", opf)
+	}
+}
+
+func TestRepairArchive_LeavesValidArchiveAlone(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	f.Write([]byte("application/epub+zip"))
+	f, _ = w.Create("META-INF/container.xml")
+	f.Write([]byte(`<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`))
+	f, _ = w.Create("content.opf")
+	f.Write([]byte(`<package><manifest><item id="ch1" href="ch1.xhtml"/></manifest><spine><itemref idref="ch1"/></spine></package>`))
+	w.Close()
+
+	source, err := SpoolEPUB(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	defer source.Close()
+	zipReader, _ := source.openZIP()
+
+	repaired, _, warnings, err := repairArchive(source, zipReader)
+	if err != nil {
+		t.Fatalf("repairArchive failed: %v", err)
+	}
+	if repaired != source || len(warnings) != 0 {
+		t.Errorf("Expected valid archive to be returned unchanged, got warnings %v", warnings)
+	}
+}
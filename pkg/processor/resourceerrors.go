@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// The policies for the resources that fail to be read or transformed
+const (
+	// resourceErrorsFail aborts the whole publication on the first failure
+	resourceErrorsFail = "fail"
+	// resourceErrorsContinue leaves the failed resources out: their links stay,
+	// noted as failed, and a warning reports each of them
+	resourceErrorsContinue = "continue"
+)
+
+// resolveResourceErrors validates the resource_errors option; an empty policy
+// means resourceErrorsFail
+func resolveResourceErrors(requested string) (string, error) {
+	switch requested {
+	case "":
+		return resourceErrorsFail, nil
+	case resourceErrorsFail, resourceErrorsContinue:
+		return requested, nil
+	}
+	return "", fmt.Errorf("unknown resource_errors %q (expected %q or %q)", requested, resourceErrorsFail, resourceErrorsContinue)
+}
+
+// FailedResource is a resource left out of the output because it could not be
+// read or transformed
+type FailedResource struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// resourceFailures applies resource_errors to the resources of a publication,
+// so one corrupt chapter doesn't cost readers the rest of the book. Only the
+// content of a resource can fail this way: storage errors still abort. A nil
+// policy fails fast.
+type resourceFailures struct {
+	failed map[string]string // href -> error
+}
+
+// newResourceFailures returns the policy for the resolved option, or nil for
+// resourceErrorsFail
+func newResourceFailures(policy string) *resourceFailures {
+	if policy != resourceErrorsContinue {
+		return nil
+	}
+	return &resourceFailures{failed: map[string]string{}}
+}
+
+// record returns err when failing fast, or remembers that the resource at href
+// failed with err and returns nil
+func (f *resourceFailures) record(href string, err error) error {
+	if f == nil {
+		return err
+	}
+	f.failed[href] = err.Error()
+	return nil
+}
+
+// has reports whether the resource at href already failed
+func (f *resourceFailures) has(href string) bool {
+	if f == nil {
+		return false
+	}
+	_, failed := f.failed[href]
+	return failed
+}
+
+// failedResources returns the failed resources, sorted by path
+func (f *resourceFailures) failedResources() []FailedResource {
+	if f == nil {
+		return nil
+	}
+	failed := make([]FailedResource, 0, len(f.failed))
+	for href, message := range f.failed {
+		failed = append(failed, FailedResource{Path: resourceKey(href), Error: message})
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Path < failed[j].Path })
+	return failed
+}
+
+// warnings returns a warning for each failed resource
+func (f *resourceFailures) warnings() []string {
+	var warnings []string
+	for _, resource := range f.failedResources() {
+		warnings = append(warnings, fmt.Sprintf("left out %s: %s", resource.Path, resource.Error))
+	}
+	return warnings
+}
+
+// apply notes on the manifest links of the failed resources that their file is
+// missing, so readers can skip them or show a placeholder
+func (f *resourceFailures) apply(m *manifest.Manifest) {
+	if f == nil || len(f.failed) == 0 {
+		return
+	}
+	update := func(links manifest.LinkList) {
+		for i := range links {
+			message, ok := f.failed[links[i].Href.String()]
+			if !ok {
+				continue
+			}
+			if links[i].Properties == nil {
+				links[i].Properties = manifest.Properties{}
+			}
+			links[i].Properties["failed"] = map[string]interface{}{"error": message}
+		}
+	}
+	update(m.ReadingOrder)
+	update(m.Resources)
+}
@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestResolveResourceErrors(t *testing.T) {
+	for requested, want := range map[string]string{"": resourceErrorsFail, "fail": resourceErrorsFail, "continue": resourceErrorsContinue} {
+		if got, err := resolveResourceErrors(requested); err != nil || got != want {
+			t.Errorf("Expected %q for %q, got %q (%v)", want, requested, got, err)
+		}
+	}
+	if _, err := resolveResourceErrors("ignore"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+func TestResourceFailures_FailFast(t *testing.T) {
+	failures := newResourceFailures(resourceErrorsFail)
+	readErr := errors.New("failed to read resource: flate: corrupt input")
+	if err := failures.record("OEBPS/ch2.xhtml", readErr); err != readErr {
+		t.Errorf("Expected the error to be returned, got %v", err)
+	}
+	if failures.has("OEBPS/ch2.xhtml") || failures.failedResources() != nil {
+		t.Errorf("Expected nothing recorded when failing fast")
+	}
+}
+
+func TestResourceFailures_Continue(t *testing.T) {
+	failures := newResourceFailures(resourceErrorsContinue)
+	if err := failures.record("OEBPS/ch2.xhtml", errors.New("failed to read resource: flate: corrupt input")); err != nil {
+		t.Fatalf("Expected the failure to be recorded, got %v", err)
+	}
+	if !failures.has("OEBPS/ch2.xhtml") {
+		t.Errorf("Expected the resource to be remembered as failed")
+	}
+
+	want := []FailedResource{{Path: "OEBPS/ch2.xhtml", Error: "failed to read resource: flate: corrupt input"}}
+	if got := failures.failedResources(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+	if warnings := failures.warnings(); len(warnings) != 1 || warnings[0] != "left out OEBPS/ch2.xhtml: failed to read resource: flate: corrupt input" {
+		t.Errorf("Expected a warning for the failed resource, got %q", warnings)
+	}
+
+	m := &manifest.Manifest{ReadingOrder: manifest.LinkList{testLink(t, "OEBPS/ch1.xhtml"), testLink(t, "OEBPS/ch2.xhtml")}}
+	failures.apply(m)
+	if m.ReadingOrder[0].Properties != nil {
+		t.Errorf("Expected the readable chapter to be left alone, got %v", m.ReadingOrder[0].Properties)
+	}
+	failed, ok := m.ReadingOrder[1].Properties["failed"].(map[string]interface{})
+	if !ok || failed["error"] != "failed to read resource: flate: corrupt input" {
+		t.Errorf("Expected the failed chapter to be marked, got %v", m.ReadingOrder[1].Properties)
+	}
+}
+
+func TestProcess_ResourceErrors(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	// The second chapter is stored as deflated data that doesn't inflate
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create(lpfManifestPath)
+	f.Write([]byte(testPublicationJSON))
+	f, _ = w.Create("audio/chapter 1.mp3")
+	f.Write([]byte("one"))
+	raw, _ := w.CreateRaw(&zip.FileHeader{Name: "audio/chapter2.mp3", Method: zip.Deflate, CompressedSize64: 4, UncompressedSize64: 3})
+	raw.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	w.Close()
+	supabase.Put(EPUBBucket, "audiobooks/leviathan.lpf", buf.Bytes())
+
+	process := func(policy string) (*Result, error) {
+		options := Options{ResourceErrors: policy}
+		if err := options.Resolve(); err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		source, err := p.Fetch("audiobooks/leviathan.lpf", 0)
+		if err != nil {
+			t.Fatalf("Fetch failed: %v", err)
+		}
+		defer source.Close()
+		return p.Process(source, "audiobooks/leviathan.lpf", options)
+	}
+
+	if _, err := process(""); err == nil || !strings.Contains(err.Error(), "audio/chapter2.mp3") {
+		t.Errorf("Expected the corrupt chapter to fail the publication, got %v", err)
+	}
+
+	result, err := process(resourceErrorsContinue)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Path != "audio/chapter2.mp3" {
+		t.Errorf("Expected the corrupt chapter to be reported, got %+v", result.Failed)
+	}
+	if _, ok := result.ResponseData(Options{})["failed_resources"]; !ok {
+		t.Errorf("Expected failed_resources in the response")
+	}
+	manifestJSON, _ := supabase.Object(ManifestBucket, result.BasePath+"/manifest.json")
+	if !strings.Contains(string(manifestJSON), `"error": "failed to read resource: flate`) {
+		t.Errorf("Expected the failed chapter to be marked in the manifest, got %s", manifestJSON)
+	}
+	if _, ok := supabase.Object(ManifestBucket, result.BasePath+"/audio/chapter 1.mp3"); !ok {
+		t.Errorf("Expected the readable chapter to be uploaded")
+	}
+}
@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+	"github.com/readium/go-toolkit/pkg/util/url"
+)
+
+// rwpmManifestPath is the entry of a packaged Readium Web Publication holding
+// its manifest
+const rwpmManifestPath = "manifest.json"
+
+// rwpmManifestTypes maps the profiles of a Readium manifest to the media type
+// of its self link; anything else is a plain Web Publication
+var rwpmManifestTypes = map[manifest.Profile]string{
+	manifest.ProfileAudiobook: "application/audiobook+json",
+	manifest.ProfileDivina:    "application/divina+json",
+}
+
+// readRWPMManifest parses the manifest of a packaged Web Publication with the
+// toolkit, dropping its self link, which points to wherever it was packaged from
+func readRWPMManifest(entries map[string]*zip.File) (*manifest.Manifest, error) {
+	f, ok := entries[rwpmManifestPath]
+	if !ok {
+		return nil, fmt.Errorf("archive has no %s", rwpmManifestPath)
+	}
+	data, err := readZipEntry(f)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", rwpmManifestPath, err)
+	}
+	// The self link has to go before parsing: the toolkit turns the self link
+	// of a packaged manifest into an alternate one
+	if links, ok := raw["links"].([]interface{}); ok {
+		raw["links"] = withoutSelfLinks(links)
+	}
+	m, err := manifest.ManifestFromJSON(raw, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", rwpmManifestPath, err)
+	}
+	if len(m.ReadingOrder) == 0 {
+		return nil, fmt.Errorf("%s has an empty reading order", rwpmManifestPath)
+	}
+	return m, nil
+}
+
+// withoutSelfLinks returns the raw links that aren't self links; rel is either
+// a string or a list of them
+func withoutSelfLinks(links []interface{}) []interface{} {
+	kept := make([]interface{}, 0, len(links))
+	for _, link := range links {
+		object, _ := link.(map[string]interface{})
+		self := false
+		switch rel := object["rel"].(type) {
+		case string:
+			self = rel == "self"
+		case []interface{}:
+			for _, r := range rel {
+				self = self || r == "self"
+			}
+		}
+		if !self {
+			kept = append(kept, link)
+		}
+	}
+	return kept
+}
+
+// addUnlistedResources appends the archive entries the manifest doesn't
+// reference to its resources, so stylesheets and images only linked from
+// content documents are re-hosted along with them
+func addUnlistedResources(m *manifest.Manifest, entries map[string]*zip.File) {
+	listed := map[string]bool{rwpmManifestPath: true}
+	for _, list := range []manifest.LinkList{m.ReadingOrder, m.Resources, m.Links} {
+		for _, link := range list {
+			listed[resourceKey(link.Href.String())] = true
+		}
+	}
+
+	var unlisted []string
+	for name, f := range entries {
+		if !f.FileInfo().IsDir() && !listed[name] {
+			unlisted = append(unlisted, name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, name := range unlisted {
+		u, err := url.URLFromString(manifestHref(name))
+		if err != nil {
+			log.Printf("Warning: skipping archive entry %s: %v", name, err)
+			continue
+		}
+		link := manifest.Link{Href: manifest.NewHREF(u)}
+		if mt, err := mediatype.NewOfString(getContentType(name)); err == nil {
+			link.MediaType = &mt
+		}
+		m.Resources = append(m.Resources, link)
+	}
+}
+
+// processRWPM re-hosts a packaged Readium Web Publication: its manifest is
+// already in the output format, so it only needs its resources uploaded and a
+// new self link
+func (p *Processor) processRWPM(zipReader *zip.Reader, filename string, source *Source, options Options, warnings []string, debug *debugRecorder) (*Result, error) {
+	debug.phase("parse")
+	entries := zipEntries(zipReader)
+	m, err := readRWPMManifest(entries)
+	if err != nil {
+		return nil, &statusError{status: 400, err: err}
+	}
+	addUnlistedResources(m, entries)
+
+	manifestType := "application/webpub+json"
+	for _, profile := range m.Metadata.ConformsTo {
+		if t, ok := rwpmManifestTypes[profile]; ok {
+			manifestType = t
+		}
+	}
+	return p.rehostPackage(m, entries, filename, source, manifestType, options, warnings, debug)
+}
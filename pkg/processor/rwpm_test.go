@@ -0,0 +1,88 @@
+package processor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+const testRWPMManifestJSON = `{
+  "@context": "https://readium.org/webpub-manifest/context.jsonld",
+  "metadata": {"title": "Moby-Dick"},
+  "links": [{"href": "https://example.com/moby/manifest.json", "rel": "self", "type": "application/webpub+json"}],
+  "readingOrder": [
+    {"href": "chapter%201.html", "type": "text/html", "title": "Loomings"},
+    {"href": "chapter2.html", "type": "text/html"}
+  ],
+  "resources": [{"href": "cover.jpg", "type": "image/jpeg", "rel": "cover"}]
+}`
+
+func TestProcess_RWPM(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	p := New(store, store)
+
+	entries := map[string]string{
+		rwpmManifestPath:  testRWPMManifestJSON,
+		"chapter 1.html":  "<html><link href='styles/moby.css'/></html>",
+		"chapter2.html":   "<html></html>",
+		"cover.jpg":       "cover",
+		"styles/moby.css": "body {}",
+	}
+	result, err := p.Process(spoolTestArchive(t, entries), "moby.webpub", Options{})
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if !strings.HasSuffix(result.ManifestURL, "/moby/manifest.json") {
+		t.Errorf("Expected the manifest under moby, got %s", result.ManifestURL)
+	}
+	for _, key := range []string{"moby/chapter 1.html", "moby/chapter2.html", "moby/cover.jpg", "moby/styles/moby.css"} {
+		if _, ok := supabase.Object(ManifestBucket, key); !ok {
+			t.Errorf("Expected %s to be uploaded, got %v", key, supabase.Paths(ManifestBucket))
+		}
+	}
+
+	manifestJSON, _ := supabase.Object(ManifestBucket, "moby/manifest.json")
+	var manifest struct {
+		Links []struct {
+			Href string `json:"href"`
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+		} `json:"links"`
+		ReadingOrder []struct {
+			Href  string `json:"href"`
+			Title string `json:"title"`
+		} `json:"readingOrder"`
+		Resources []struct {
+			Href string `json:"href"`
+			Type string `json:"type"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if len(manifest.Links) != 1 || manifest.Links[0].Href != result.ManifestURL || manifest.Links[0].Type != "application/webpub+json" {
+		t.Errorf("Expected the packaged self link to be replaced, got %+v", manifest.Links)
+	}
+	if len(manifest.ReadingOrder) != 2 || manifest.ReadingOrder[0].Href != "chapter%201.html" || manifest.ReadingOrder[0].Title != "Loomings" {
+		t.Errorf("Expected the reading order to be kept, got %+v", manifest.ReadingOrder)
+	}
+	if len(manifest.Resources) != 2 || manifest.Resources[1].Href != "styles/moby.css" || manifest.Resources[1].Type != "text/css" {
+		t.Errorf("Expected the unlisted stylesheet to be added to resources, got %+v", manifest.Resources)
+	}
+}
+
+func TestProcess_RWPMInvalid(t *testing.T) {
+	for name, manifestJSON := range map[string]string{
+		"malformed":           "{",
+		"empty reading order": `{"metadata": {"title": "Moby-Dick"}, "readingOrder": []}`,
+	} {
+		source := spoolTestArchive(t, map[string]string{rwpmManifestPath: manifestJSON, "chapter1.html": "<html/>"})
+		if _, err := New(nil, nil).Process(source, "moby.webpub", Options{}); StatusCode(err) != 400 {
+			t.Errorf("%s: expected 400, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+const (
+	// storageProtocolEnvVar selects the API objects are transferred with:
+	// "rest" (default), the Storage REST endpoints, or "s3", the S3-compatible
+	// endpoint of Supabase Storage (see S3ConfigFromEnv)
+	storageProtocolEnvVar = "STORAGE_PROTOCOL"
+	// s3AccessKeyIDEnvVar and s3SecretAccessKeyEnvVar are S3 access keys
+	// created in the Storage settings of the project
+	s3AccessKeyIDEnvVar     = "SUPABASE_S3_ACCESS_KEY_ID"
+	s3SecretAccessKeyEnvVar = "SUPABASE_S3_SECRET_ACCESS_KEY"
+	// s3RegionEnvVar is the region of the project, which requests are signed for
+	s3RegionEnvVar = "SUPABASE_S3_REGION"
+	// s3EndpointEnvVar overrides the endpoint, {SUPABASE_URL}/storage/v1/s3 by default
+	s3EndpointEnvVar = "SUPABASE_S3_ENDPOINT"
+
+	// s3PartSize is the size of the parts of multipart uploads, and of the
+	// ranges EPUBs are downloaded in. Smaller objects are uploaded at once.
+	s3PartSize = 8 << 20
+	// s3MaxAttempts bounds the attempts of a request failing with a network
+	// error, a 5xx or a 429
+	s3MaxAttempts = 3
+	s3RetryDelay  = 200 * time.Millisecond
+	// s3WindowSize is the least read of an EPUB read in ranges, enough for the
+	// central directory of most books in a request or two
+	s3WindowSize = 256 << 10
+)
+
+// S3Config holds the S3 access keys of a Supabase project
+type S3Config struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	// Endpoint defaults to {SUPABASE_URL}/storage/v1/s3
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// Validate checks the config holds keys and a region to sign requests with
+func (c *S3Config) Validate() error {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" || c.Region == "" {
+		return errors.New("S3 storage needs an access key ID, a secret access key and a region")
+	}
+	return nil
+}
+
+// S3ConfigFromEnv returns the S3 config of the environment if STORAGE_PROTOCOL
+// is "s3", or nil if objects are transferred with the REST endpoints
+func S3ConfigFromEnv() (*S3Config, error) {
+	switch protocol := os.Getenv(storageProtocolEnvVar); protocol {
+	case "", "rest":
+		return nil, nil
+	case "s3":
+		config := &S3Config{
+			AccessKeyID:     os.Getenv(s3AccessKeyIDEnvVar),
+			SecretAccessKey: os.Getenv(s3SecretAccessKeyEnvVar),
+			Region:          os.Getenv(s3RegionEnvVar),
+			Endpoint:        os.Getenv(s3EndpointEnvVar),
+		}
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("%w (%s, %s and %s)", err, s3AccessKeyIDEnvVar, s3SecretAccessKeyEnvVar, s3RegionEnvVar)
+		}
+		return config, nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q (expected rest or s3)", storageProtocolEnvVar, protocol)
+	}
+}
+
+// WithS3 returns a copy of s that transfers objects through the S3-compatible
+// endpoint of the project, which uploads large objects in parts, downloads the
+// EPUBs in ranges and retries failed requests. Creates, lists and bulk deletes
+// still go through the REST endpoints, as do EPUB downloads with a read key. A
+// nil config keeps the REST endpoints.
+func (s *Supabase) WithS3(config *S3Config) *Supabase {
+	scoped := *s
+	scoped.s3 = nil
+	if config != nil {
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = strings.TrimSuffix(s.url, "/") + "/storage/v1/s3"
+		}
+		scoped.s3 = &s3Client{
+			endpoint: strings.TrimSuffix(endpoint, "/"),
+			region:   config.Region,
+			credentials: aws.Credentials{
+				AccessKeyID:     config.AccessKeyID,
+				SecretAccessKey: config.SecretAccessKey,
+			},
+			// S3 signs the path as sent, without escaping it twice
+			signer: v4.NewSigner(func(o *v4.SignerOptions) { o.DisableURIPathEscaping = true }),
+		}
+	}
+	return &scoped
+}
+
+// s3Client sends path-style requests to an S3-compatible endpoint, signed with
+// Signature Version 4
+type s3Client struct {
+	endpoint    string
+	region      string
+	credentials aws.Credentials
+	signer      *v4.Signer
+}
+
+// s3Request is a request to the object key in bucket
+type s3Request struct {
+	method  string
+	bucket  string
+	key     string
+	query   neturl.Values
+	headers map[string]string
+	body    []byte
+}
+
+// do sends request, retrying it after network errors, 5xx and 429 responses.
+// The response of the last attempt is returned whatever its status.
+func (c *s3Client) do(client *http.Client, request s3Request, requestID string) (*http.Response, error) {
+	objectURL := fmt.Sprintf("%s/%s/%s", c.endpoint, request.bucket, escapeStoragePath(request.key))
+	if len(request.query) > 0 {
+		objectURL += "?" + request.query.Encode()
+	}
+	payloadHash := sha256.Sum256(request.body)
+
+	var lastErr error
+	for attempt := 0; attempt < s3MaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s3RetryDelay << (attempt - 1))
+		}
+		req, err := http.NewRequest(request.method, objectURL, bytes.NewReader(request.body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		for name, value := range request.headers {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+		if err := c.signer.SignHTTP(context.Background(), c.credentials, req, hex.EncodeToString(payloadHash[:]), "s3", c.region, time.Now()); err != nil {
+			return nil, fmt.Errorf("failed to sign request: %w", err)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to execute request: %w", err)
+			continue
+		}
+		if (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests) && attempt < s3MaxAttempts-1 {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// send sends request and fails unless it succeeds, returning the body
+func (c *s3Client) send(client *http.Client, request s3Request, requestID string) (*http.Response, []byte, error) {
+	resp, err := c.do(client, request, requestID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return resp, bodyBytes, nil
+}
+
+// uploadS3 stores data at path in the manifest bucket, in parts if it is
+// larger than s3PartSize
+func (s *Supabase) uploadS3(path string, data []byte, encoding string) (string, error) {
+	headers := objectHeaders(path, encoding)
+	key := s.prefix + path
+	if len(data) <= s3PartSize {
+		request := s3Request{method: "PUT", bucket: s.manifests(), key: key, headers: headers, body: data}
+		if _, _, err := s.s3.send(s.client(), request, s.requestID); err != nil {
+			return "", err
+		}
+	} else if err := s.uploadS3Parts(key, data, headers); err != nil {
+		return "", err
+	}
+	return s.PublicURL(path), nil
+}
+
+// uploadS3Parts stores data at key in the manifest bucket with a multipart
+// upload, aborting it if a part fails so no parts are left behind
+func (s *Supabase) uploadS3Parts(key string, data []byte, headers map[string]string) error {
+	client := s.client()
+	create := s3Request{method: "POST", bucket: s.manifests(), key: key, query: neturl.Values{"uploads": {""}}, headers: headers}
+	_, body, err := s.s3.send(client, create, s.requestID)
+	if err != nil {
+		return fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &created); err != nil || created.UploadID == "" {
+		return fmt.Errorf("failed to parse multipart upload: %s", string(body))
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var completed struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}
+	for offset := 0; offset < len(data); offset += s3PartSize {
+		number := len(completed.Parts) + 1
+		upload := s3Request{
+			method: "PUT",
+			bucket: s.manifests(),
+			key:    key,
+			query:  neturl.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {created.UploadID}},
+			body:   data[offset:min(offset+s3PartSize, len(data))],
+		}
+		resp, _, err := s.s3.send(client, upload, s.requestID)
+		if err != nil {
+			s.abortS3Upload(key, created.UploadID)
+			return fmt.Errorf("failed to upload part %d: %w", number, err)
+		}
+		completed.Parts = append(completed.Parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	}
+
+	payload, err := xml.Marshal(completed)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parts: %w", err)
+	}
+	complete := s3Request{method: "POST", bucket: s.manifests(), key: key, query: neturl.Values{"uploadId": {created.UploadID}}, body: payload}
+	if _, _, err := s.s3.send(client, complete, s.requestID); err != nil {
+		s.abortS3Upload(key, created.UploadID)
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// abortS3Upload discards the parts of a failed multipart upload
+func (s *Supabase) abortS3Upload(key, uploadID string) {
+	abort := s3Request{method: "DELETE", bucket: s.manifests(), key: key, query: neturl.Values{"uploadId": {uploadID}}}
+	if _, _, err := s.s3.send(s.client(), abort, s.requestID); err != nil {
+		log.Printf("Warning: failed to abort multipart upload of %s: %v", key, err)
+	}
+}
+
+// downloadS3 returns the object at path in the manifest bucket
+func (s *Supabase) downloadS3(path string) ([]byte, error) {
+	_, body, err := s.s3.send(s.client(), s3Request{method: "GET", bucket: s.manifests(), key: s.prefix + path}, s.requestID)
+	return body, err
+}
+
+// deleteS3 removes the object at path from the manifest bucket
+func (s *Supabase) deleteS3(path string) error {
+	_, _, err := s.s3.send(s.client(), s3Request{method: "DELETE", bucket: s.manifests(), key: s.prefix + path}, s.requestID)
+	return err
+}
+
+// fetchS3 spools filename from the epubs bucket, reading it in ranges of
+// s3PartSize so a dropped connection only repeats the current range
+func (s *Supabase) fetchS3(filename string, maxBytes int64) (*Source, error) {
+	client := NewHTTPClient(s.timeouts.Download)
+	key := s.prefix + filename
+	resp, _, err := s.s3.send(client, s3Request{method: "HEAD", bucket: s.epubs(), key: key}, s.requestID)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength < 0 {
+		return nil, fmt.Errorf("response has no Content-Length")
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, EPUBTooLargeError(resp.ContentLength, maxBytes)
+	}
+	reader := &s3RangeReader{s: s, client: client, key: key, size: resp.ContentLength}
+	defer reader.Close()
+	source, err := SpoolEPUB(reader, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	source.version = versionFromHeaders(resp.Header)
+	return source, nil
+}
+
+// s3RangeReader reads an object of the epubs bucket range by range, retrying
+// a range whose transfer fails midway from where it stopped
+type s3RangeReader struct {
+	s      *Supabase
+	client *http.Client
+	key    string
+	size   int64
+	offset int64
+	// start is the offset the current range was requested from
+	start int64
+	body  io.ReadCloser
+	// failures counts the consecutive failed transfers
+	failures int
+}
+
+func (r *s3RangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.body != nil {
+			n, err := r.body.Read(p)
+			r.offset += int64(n)
+			if err == nil || n > 0 {
+				if n > 0 {
+					r.failures = 0
+				}
+				return n, nil
+			}
+			r.body.Close()
+			r.body = nil
+			// A range ending early is requested again from where it stopped,
+			// unless the transfers keep failing
+			if err != io.EOF || r.offset == r.start {
+				if r.failures++; r.failures >= s3MaxAttempts {
+					return 0, fmt.Errorf("failed to read response body: %w", err)
+				}
+				log.Printf("Warning: EPUB download interrupted at byte %d, resuming: %v", r.offset, err)
+			}
+			continue
+		}
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+
+		end := min(r.offset+s3PartSize, r.size) - 1
+		request := s3Request{method: "GET", bucket: r.s.epubs(), key: r.key, headers: map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", r.offset, end)}}
+		resp, err := r.s.s3.do(r.client, request, r.s.requestID)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			return 0, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		}
+		r.start = r.offset
+		r.body = resp.Body
+	}
+}
+
+// Close releases the range being read
+func (r *s3RangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// FetchDirectory opens filename from the epubs bucket as a ZIP archive read in
+// ranges, so reading its central directory takes a few requests however large
+// the EPUB is. Only the S3 endpoint reads ranges.
+func (s *Supabase) FetchDirectory(filename string, maxBytes int64) (*zip.Reader, int64, error) {
+	if s.s3 == nil || s.readKey != "" {
+		return nil, 0, ErrRangesUnsupported
+	}
+	client := NewHTTPClient(s.timeouts.Download)
+	key := s.prefix + filename
+	resp, _, err := s.s3.send(client, s3Request{method: "HEAD", bucket: s.epubs(), key: key}, s.requestID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.ContentLength < 0 {
+		return nil, 0, fmt.Errorf("response has no Content-Length")
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, 0, EPUBTooLargeError(resp.ContentLength, maxBytes)
+	}
+	log.Printf("Reading the central directory of %s/%s from Supabase S3", s.epubs(), key)
+	zipReader, err := openZIPAt(&s3ReaderAt{s: s, client: client, key: key, size: resp.ContentLength}, resp.ContentLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	return zipReader, resp.ContentLength, nil
+}
+
+// s3ReaderAt reads an object of the epubs bucket at any offset, requesting a
+// window of at least s3WindowSize around each read it can't serve from the
+// last one
+type s3ReaderAt struct {
+	s      *Supabase
+	client *http.Client
+	key    string
+	size   int64
+
+	mu sync.Mutex
+	// window holds the bytes of the object from windowStart
+	window      []byte
+	windowStart int64
+}
+
+func (r *s3ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off+int64(n) < r.size {
+		pos := off + int64(n)
+		if pos < r.windowStart || pos >= r.windowStart+int64(len(r.window)) {
+			if err := r.fetch(pos, max(int64(len(p)-n), s3WindowSize)); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.window[pos-r.windowStart:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fetch reads length bytes of the object from offset into the window
+func (r *s3ReaderAt) fetch(offset, length int64) error {
+	end := min(offset+length, r.size) - 1
+	request := s3Request{method: "GET", bucket: r.s.epubs(), key: r.key, headers: map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", offset, end)}}
+	resp, body, err := r.s.s3.send(r.client, request, r.s.requestID)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusPartialContent || int64(len(body)) != end-offset+1 {
+		return fmt.Errorf("unexpected response to the range %d-%d: status %d, %d bytes", offset, end, resp.StatusCode, len(body))
+	}
+	r.window, r.windowStart = body, offset
+	return nil
+}
@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+// testS3Store returns a store transferring objects through the S3 endpoint of supabase
+func testS3Store(supabase *processortest.Supabase) *Supabase {
+	return NewSupabase(supabase.URL, processortest.ServiceKey).WithS3(&S3Config{
+		AccessKeyID:     processortest.S3AccessKeyID,
+		SecretAccessKey: processortest.S3SecretAccessKey,
+		Region:          processortest.S3Region,
+	})
+}
+
+func TestS3ConfigFromEnv(t *testing.T) {
+	t.Setenv(storageProtocolEnvVar, "")
+	if config, err := S3ConfigFromEnv(); config != nil || err != nil {
+		t.Errorf("Expected the REST endpoints by default, got %v, %v", config, err)
+	}
+
+	t.Setenv(storageProtocolEnvVar, "s3")
+	t.Setenv(s3AccessKeyIDEnvVar, "key")
+	t.Setenv(s3SecretAccessKeyEnvVar, "secret")
+	t.Setenv(s3RegionEnvVar, "")
+	if _, err := S3ConfigFromEnv(); err == nil {
+		t.Error("Expected an error without a region")
+	}
+	t.Setenv(s3RegionEnvVar, "eu-west-1")
+	if config, err := S3ConfigFromEnv(); err != nil || config.Region != "eu-west-1" || config.AccessKeyID != "key" {
+		t.Errorf("Expected the S3 config, got %+v, %v", config, err)
+	}
+
+	t.Setenv(storageProtocolEnvVar, "ftp")
+	if _, err := S3ConfigFromEnv(); err == nil {
+		t.Error("Expected an error for an unknown protocol")
+	}
+}
+
+func TestSupabase_S3(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := testS3Store(supabase)
+
+	url, err := store.Upload("book/manifest.json", []byte(`{"title":"Moby-Dick"}`), "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if url != store.PublicURL("book/manifest.json") {
+		t.Errorf("Expected the public URL, got %s", url)
+	}
+	if data, err := store.Download("book/manifest.json"); err != nil || string(data) != `{"title":"Moby-Dick"}` {
+		t.Errorf("Expected the uploaded object back, got %q, %v", data, err)
+	}
+	if err := store.Delete("book/manifest.json"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, ok := supabase.Object(ManifestBucket, "book/manifest.json"); ok {
+		t.Error("Expected the object deleted")
+	}
+	if want := []string{"PutObject", "GetObject", "DeleteObject"}; !reflect.DeepEqual(supabase.S3Operations(), want) {
+		t.Errorf("Expected operations %v, got %v", want, supabase.S3Operations())
+	}
+
+	// Creates stay on the REST endpoints, which the S3 uploads share a bucket with
+	if created, err := store.Create("book/.lock", []byte("{}")); err != nil || !created {
+		t.Errorf("Expected the lock created, got %v, %v", created, err)
+	}
+
+	keyless := NewSupabase(supabase.URL, processortest.ServiceKey).WithS3(&S3Config{AccessKeyID: "revoked", SecretAccessKey: "secret", Region: "local"})
+	if _, err := keyless.Upload("book/manifest.json", []byte("{}"), ""); err == nil {
+		t.Error("Expected an upload with unknown S3 keys to fail")
+	}
+}
+
+func TestSupabase_S3Multipart(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := testS3Store(supabase)
+
+	data := make([]byte, 2*s3PartSize+1)
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := store.Upload("book/audio/track.mp3", data, ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if stored, _ := supabase.Object(ManifestBucket, "book/audio/track.mp3"); !bytes.Equal(stored, data) {
+		t.Errorf("Expected the parts assembled into %d bytes, got %d", len(data), len(stored))
+	}
+	want := []string{"CreateMultipartUpload", "UploadPart", "UploadPart", "UploadPart", "CompleteMultipartUpload"}
+	if !reflect.DeepEqual(supabase.S3Operations(), want) {
+		t.Errorf("Expected operations %v, got %v", want, supabase.S3Operations())
+	}
+}
+
+func TestSupabase_S3Fetch(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create(lpfManifestPath)
+	f.Write([]byte(testPublicationJSON))
+	// Stored uncompressed, so the archive spans several ranges
+	f, _ = w.CreateHeader(&zip.FileHeader{Name: "audio/track.mp3", Method: zip.Store})
+	io.CopyN(f, rand.New(rand.NewSource(1)), s3PartSize+1024)
+	w.Close()
+	supabase.Put(EPUBBucket, "audiobooks/leviathan.lpf", buf.Bytes())
+
+	// The first request fails once and is retried
+	store := testS3Store(supabase)
+	supabase.FailS3(1)
+	source, err := store.Fetch("audiobooks/leviathan.lpf", 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	source.Close()
+	if want := []string{"HeadObject", "HeadObject", "GetObject", "GetObject"}; !reflect.DeepEqual(supabase.S3Operations(), want) {
+		t.Errorf("Expected operations %v, got %v", want, supabase.S3Operations())
+	}
+
+	if _, err := store.Fetch("audiobooks/leviathan.lpf", 1024); err == nil {
+		t.Error("Expected the size limit enforced")
+	}
+	supabase.FailS3(s3MaxAttempts)
+	if _, err := store.Fetch("audiobooks/leviathan.lpf", 0); err == nil {
+		t.Error("Expected an error once the attempts are used up")
+	}
+}
@@ -0,0 +1,246 @@
+package processor
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// scriptURLPrefixes are the URL schemes (and data: types) that run script when
+// a document follows or embeds them, compared after the browser's own cleanup
+var scriptURLPrefixes = []string{
+	"javascript:",
+	"vbscript:",
+	"data:text/html",
+	"data:application/xhtml+xml",
+	"data:image/svg+xml",
+	"data:text/xml",
+	"data:application/xml",
+}
+
+// rawTextElements are the elements the HTML tokenizer reads the content of as
+// text. In an XHTML document their content is markup like any other.
+var rawTextElements = map[string]bool{
+	"iframe": true, "noembed": true, "noframes": true, "noscript": true, "plaintext": true,
+	"script": true, "style": true, "title": true, "textarea": true, "xmp": true,
+}
+
+// sanitizeXHTML removes publisher scripts from a content document or an SVG
+// image: <script> elements, on* event handler attributes, javascript: and
+// markup data: URLs in any attribute, and iframes that load remote pages.
+// Iframes pointing inside the publication are kept. The document is read with
+// the HTML tokenizer, so that malformed markup is read the way a browser would
+// read it, and whatever is kept is copied unchanged.
+func sanitizeXHTML(content []byte) []byte {
+	var out bytes.Buffer
+	z := html.NewTokenizer(bytes.NewReader(content))
+	// dropping is the element whose content is being left out, "" for none
+	dropping := ""
+	// rawText is set after a start tag whose content the tokenizer reads as text
+	rawText := false
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		// Token lower-cases the names in place, so the raw bytes are kept first
+		raw := append([]byte(nil), z.Raw()...)
+		wasRawText := rawText
+		rawText = false
+
+		if dropping != "" {
+			if tt == html.EndTagToken {
+				if name, _ := z.TagName(); string(name) == dropping {
+					dropping = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.TextToken:
+			if wasRawText {
+				// Sanitized as markup too, since an XML parser reads it as such
+				out.Write(sanitizeXHTML(raw))
+			} else {
+				out.Write(raw)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			token := z.Token()
+			if !validTagName(token.Data) {
+				// Not a tag to a browser either: kept as the text it is
+				out.WriteString(html.EscapeString(string(raw)))
+				continue
+			}
+			if tt == html.EndTagToken {
+				if token.Data != "script" {
+					out.Write(raw)
+				}
+				continue
+			}
+			// The tokenizer reads what follows <script/> as text as well, but
+			// for XHTML the element is empty
+			rawText = rawTextElements[token.Data]
+			if token.Data == "script" || isRemoteFrame(token) {
+				if tt == html.StartTagToken {
+					dropping = token.Data
+				}
+				continue
+			}
+			out.Write(sanitizeStartTag(raw, token))
+		default:
+			out.Write(raw)
+		}
+	}
+	return out.Bytes()
+}
+
+// sanitizeStartTag returns the raw start tag without its event handlers and
+// script URLs, the attributes kept as written
+func sanitizeStartTag(raw []byte, token html.Token) []byte {
+	var kept []html.Attribute
+	keep := make([]bool, len(token.Attr))
+	for i, attr := range token.Attr {
+		if keep[i] = !isScriptAttribute(attr); keep[i] {
+			kept = append(kept, attr)
+		}
+	}
+	if len(kept) == len(token.Attr) {
+		return raw
+	}
+
+	name, attrs, end := splitRawTag(raw)
+	if len(attrs) != len(token.Attr) {
+		// Read differently than by the tokenizer: written anew from its reading
+		token.Attr = kept
+		return []byte(token.String())
+	}
+	for i, attr := range attrs {
+		if !strings.EqualFold(attr.name, token.Attr[i].Key) {
+			token.Attr = kept
+			return []byte(token.String())
+		}
+	}
+	sanitized := []byte("<" + name)
+	for i, attr := range attrs {
+		if keep[i] {
+			sanitized = append(sanitized, attr.text...)
+		}
+	}
+	return append(sanitized, end...)
+}
+
+// isScriptAttribute reports whether attr is an event handler, an iframe
+// document, or holds a URL that runs script
+func isScriptAttribute(attr html.Attribute) bool {
+	local := attr.Key
+	if i := strings.LastIndex(local, ":"); i >= 0 {
+		local = local[i+1:]
+	}
+	return strings.HasPrefix(local, "on") || local == "srcdoc" || isScriptURL(attr.Val)
+}
+
+// isScriptURL reports whether value, entities already decoded, is a URL that
+// runs script. Browsers ignore the whitespace and control characters in a
+// scheme, and its case.
+func isScriptURL(value string) bool {
+	value = strings.ToLower(strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, value))
+	for _, prefix := range scriptURLPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRemoteFrame reports whether token is a frame loading a page from outside
+// the publication
+func isRemoteFrame(token html.Token) bool {
+	if token.Data != "iframe" && token.Data != "frame" {
+		return false
+	}
+	for _, attr := range token.Attr {
+		if attr.Key == "src" {
+			src := strings.TrimSpace(attr.Val)
+			return isExternalHref(src) || strings.HasPrefix(src, "//")
+		}
+	}
+	return false
+}
+
+// validTagName reports whether name is made of the characters of an element name
+func validTagName(name string) bool {
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == ':' || r > 0x7f) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// rawAttr is an attribute of a raw start tag, with the whitespace before it
+type rawAttr struct {
+	name string
+	text string
+}
+
+// splitRawTag splits a raw start tag into its name, its attributes and what
+// closes it, following the tokenization of the HTML standard
+func splitRawTag(raw []byte) (name string, attrs []rawAttr, end string) {
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+	n := len(raw)
+	i := 1
+	for i < n && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' {
+		i++
+	}
+	name = string(raw[1:i])
+
+	for i < n {
+		start := i
+		for i < n && (isSpace(raw[i]) || raw[i] == '/' && i+1 < n && raw[i+1] != '>') {
+			i++
+		}
+		if i >= n || raw[i] == '>' || raw[i] == '/' {
+			return name, attrs, string(raw[start:])
+		}
+
+		nameStart := i
+		i++
+		for i < n && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' && raw[i] != '=' {
+			i++
+		}
+		attrName := string(raw[nameStart:i])
+		afterName := i
+		for i < n && isSpace(raw[i]) {
+			i++
+		}
+		if i < n && raw[i] == '=' {
+			i++
+			for i < n && isSpace(raw[i]) {
+				i++
+			}
+			if i < n && (raw[i] == '"' || raw[i] == '\'') {
+				if closing := bytes.IndexByte(raw[i+1:], raw[i]); closing >= 0 {
+					i += closing + 2
+				} else {
+					i = n
+				}
+			} else {
+				for i < n && !isSpace(raw[i]) && raw[i] != '>' {
+					i++
+				}
+			}
+		} else {
+			i = afterName
+		}
+		attrs = append(attrs, rawAttr{name: attrName, text: string(raw[start:i])})
+	}
+	return name, attrs, ""
+}
@@ -0,0 +1,84 @@
+package processor
+
+import "testing"
+
+func TestSanitizeXHTML(t *testing.T) {
+	input := `<html><head><script src="js/app.js"/><script type="text/javascript">
+if (a < b) { alert("hi"); }
+</script></head>
+<body onload="init()"><p onclick='track(1)' class="x">Text</p>
+<a href="javascript:void(0)">js link</a> <a href="ch2.xhtml">next</a>
+<iframe src="https://ads.example.com/frame"></iframe>
+<iframe src="//cdn.example.com/frame"/>
+<iframe src="media/player.xhtml"></iframe>
+</body></html>`
+
+	want := `<html><head></head>
+<body><p class="x">Text</p>
+<a>js link</a> <a href="ch2.xhtml">next</a>
+
+
+<iframe src="media/player.xhtml"></iframe>
+</body></html>`
+
+	if got := string(sanitizeXHTML([]byte(input))); got != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestSanitizeXHTML_DisabledByDefault(t *testing.T) {
+	p, err := newTransformPipeline(nil, transformEnv{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, name := range p.names {
+		if name == "js_sanitize" {
+			t.Errorf("Expected js_sanitize to be opt-in")
+		}
+	}
+
+	p, _ = newTransformPipeline(map[string]bool{"js_sanitize": true}, transformEnv{})
+	link := testLink(t, "OEBPS/ch1.xhtml")
+	data, err := p.apply(&link, []byte(`<p onclick="x()">a</p><script>x()</script>`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(data) != "<p>a</p>" {
+		t.Errorf("Expected sanitized document, got %s", data)
+	}
+}
+
+func TestSanitizeXHTML_Bypasses(t *testing.T) {
+	for _, tc := range []struct {
+		name, input, want string
+	}{
+		{"quoted >", `<p title=">" onclick="alert(1)">x</p>`, `<p title=">">x</p>`},
+		{"unquoted URL", `<a href=javascript:alert(1)>x</a>`, `<a>x</a>`},
+		{"entity-encoded URL", `<a href="&#106;avascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"whitespace in scheme", `<a href=" java&#x09;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"HTML data: URL", `<object data="data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;"></object>`, `<object></object>`},
+		{"SVG animation", `<svg><set attributeName="href" to="javascript:alert(1)"/></svg>`, `<svg><set attributeName="href"/></svg>`},
+		{"nested script", `<scr<script></script>ipt>alert(1)</script>`, `&lt;scr&lt;script&gt;ipt>alert(1)`},
+		{"unquoted iframe", `<iframe src=https://evil/></iframe><p>after</p>`, `<p>after</p>`},
+		{"slash before attribute", `<svg/onload="alert(1)"><circle r="1"/></svg>`, `<svg><circle r="1"/></svg>`},
+		{"script in raw text element", `<title><script>alert(1)</script></title>`, `<title></title>`},
+		{"self-closing script", `<script/><p onclick="x()">a</p>`, `<p>a</p>`},
+		{"attribute case kept", `<svg viewBox="0 0 1 1" onLoad="x()"><linearGradient gradientUnits="userSpaceOnUse"/></svg>`, `<svg viewBox="0 0 1 1"><linearGradient gradientUnits="userSpaceOnUse"/></svg>`},
+	} {
+		if got := string(sanitizeXHTML([]byte(tc.input))); got != tc.want {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestSanitizeXHTML_SVGResources(t *testing.T) {
+	p, _ := newTransformPipeline(map[string]bool{"js_sanitize": true}, transformEnv{})
+	link := testLink(t, "OEBPS/images/map.svg")
+	data, err := p.apply(&link, []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><rect onclick="x()" width="1"/></svg>`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := `<svg xmlns="http://www.w3.org/2000/svg"><rect width="1"/></svg>`; string(data) != want {
+		t.Errorf("Expected %s, got %s", want, data)
+	}
+}
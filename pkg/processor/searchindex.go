@@ -0,0 +1,241 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+const (
+	// searchProviderEnvVar selects the search engine the chapters are indexed
+	// in: "meilisearch" or "algolia"
+	searchProviderEnvVar = "SEARCH_PROVIDER"
+	// searchAPIURLEnvVar is the URL of the Meilisearch instance, or overrides
+	// the Algolia API host
+	searchAPIURLEnvVar = "SEARCH_API_URL"
+	searchAPIKeyEnvVar = "SEARCH_API_KEY"
+	searchIndexEnvVar  = "SEARCH_INDEX"
+	algoliaAppIDEnvVar = "ALGOLIA_APP_ID"
+
+	providerMeilisearch = "meilisearch"
+	providerAlgolia     = "algolia"
+
+	defaultSearchIndex = "chapters"
+	searchTimeout      = 30 * time.Second
+	// algoliaMaxTextBytes bounds the text of a chapter record, as Algolia
+	// refuses records over its size limit (10 KB on the smallest plans)
+	algoliaMaxTextBytes = 8 << 10
+)
+
+// searchDocument is the search record of a chapter: its text along with the
+// metadata of the publication, so results can be shown without the manifest
+type searchDocument struct {
+	ID          string   `json:"id"`
+	Publication string   `json:"publication"`
+	ManifestURL string   `json:"manifest_url"`
+	Href        string   `json:"href"`
+	Chapter     int      `json:"chapter"`
+	Title       string   `json:"title,omitempty"`
+	BookTitle   string   `json:"book_title"`
+	Authors     []string `json:"authors,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	WordCount   int      `json:"word_count"`
+	Text        string   `json:"text"`
+	// ObjectID is the ID under the name Algolia gives it
+	ObjectID string `json:"objectID,omitempty"`
+}
+
+// searchDocuments returns the search records of the chapters of a publication.
+// IDs are derived from the publication and the chapter href, so reprocessing
+// a publication overwrites its records.
+func searchDocuments(m *manifest.Manifest, chapters []chapterText, basePath, manifestURL string) []searchDocument {
+	var authors []string
+	for _, author := range m.Metadata.Authors {
+		if name := author.Name(); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	language := ""
+	if len(m.Metadata.Languages) > 0 {
+		language = m.Metadata.Languages[0]
+	}
+
+	documents := make([]searchDocument, 0, len(chapters))
+	for i, chapter := range chapters {
+		id := sha256.Sum256([]byte(basePath + "\x00" + chapter.Href))
+		documents = append(documents, searchDocument{
+			ID:          hex.EncodeToString(id[:16]),
+			Publication: basePath,
+			ManifestURL: manifestURL,
+			Href:        chapter.Href,
+			Chapter:     i,
+			Title:       chapter.Title,
+			BookTitle:   m.Metadata.Title(),
+			Authors:     authors,
+			Language:    language,
+			WordCount:   chapter.WordCount,
+			Text:        chapter.Text,
+		})
+	}
+	return documents
+}
+
+// searchIndexer keeps the records of the publications in a search index
+type searchIndexer interface {
+	// replace deletes the records of the publication at basePath and adds documents
+	replace(basePath string, documents []searchDocument) error
+}
+
+// searchIndexerFromEnv returns the indexer of SEARCH_PROVIDER, or nil if it isn't set
+func searchIndexerFromEnv() (searchIndexer, error) {
+	client := NewHTTPClient(searchTimeout)
+	baseURL := strings.TrimSuffix(os.Getenv(searchAPIURLEnvVar), "/")
+	index := os.Getenv(searchIndexEnvVar)
+	if index == "" {
+		index = defaultSearchIndex
+	}
+	switch provider := strings.ToLower(os.Getenv(searchProviderEnvVar)); provider {
+	case "":
+		return nil, nil
+	case providerMeilisearch:
+		if baseURL == "" {
+			return nil, fmt.Errorf("%s %q requires %s", searchProviderEnvVar, provider, searchAPIURLEnvVar)
+		}
+		return &meilisearchIndexer{client: client, baseURL: baseURL, apiKey: os.Getenv(searchAPIKeyEnvVar), index: index}, nil
+	case providerAlgolia:
+		appID := os.Getenv(algoliaAppIDEnvVar)
+		if appID == "" {
+			return nil, fmt.Errorf("%s %q requires %s", searchProviderEnvVar, provider, algoliaAppIDEnvVar)
+		}
+		if baseURL == "" {
+			baseURL = fmt.Sprintf("https://%s.algolia.net", appID)
+		}
+		return &algoliaIndexer{client: client, baseURL: baseURL, appID: appID, apiKey: os.Getenv(searchAPIKeyEnvVar), index: index}, nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q", searchProviderEnvVar, provider)
+	}
+}
+
+// meilisearchIndexer indexes in Meilisearch. The publication attribute must be
+// filterable for the records of a publication to be replaced.
+type meilisearchIndexer struct {
+	client  *http.Client
+	baseURL string
+	apiKey  string
+	index   string
+}
+
+func (m *meilisearchIndexer) replace(basePath string, documents []searchDocument) error {
+	headers := map[string]string{}
+	if m.apiKey != "" {
+		headers["Authorization"] = "Bearer " + m.apiKey
+	}
+	indexURL := fmt.Sprintf("%s/indexes/%s/documents", m.baseURL, neturl.PathEscape(m.index))
+	filter := map[string]string{"filter": "publication = " + strconv.Quote(basePath)}
+	if err := sendSearchRequest(m.client, "POST", indexURL+"/delete", headers, filter); err != nil {
+		return fmt.Errorf("failed to delete previous records: %w", err)
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+	if err := sendSearchRequest(m.client, "POST", indexURL+"?primaryKey=id", headers, documents); err != nil {
+		return fmt.Errorf("failed to add records: %w", err)
+	}
+	return nil
+}
+
+// algoliaIndexer indexes in Algolia, with the chapter text truncated to
+// algoliaMaxTextBytes. The publication attribute must be declared for faceting
+// for the records of a publication to be replaced.
+type algoliaIndexer struct {
+	client  *http.Client
+	baseURL string
+	appID   string
+	apiKey  string
+	index   string
+}
+
+func (a *algoliaIndexer) replace(basePath string, documents []searchDocument) error {
+	headers := map[string]string{"X-Algolia-Application-Id": a.appID, "X-Algolia-API-Key": a.apiKey}
+	indexURL := fmt.Sprintf("%s/1/indexes/%s", a.baseURL, neturl.PathEscape(a.index))
+	filter := map[string]string{"filters": "publication:" + strconv.Quote(basePath)}
+	if err := sendSearchRequest(a.client, "POST", indexURL+"/deleteByQuery", headers, filter); err != nil {
+		return fmt.Errorf("failed to delete previous records: %w", err)
+	}
+	if len(documents) == 0 {
+		return nil
+	}
+	requests := make([]map[string]interface{}, 0, len(documents))
+	for _, document := range documents {
+		document.ObjectID = document.ID
+		document.Text = truncateUTF8(document.Text, algoliaMaxTextBytes)
+		requests = append(requests, map[string]interface{}{"action": "updateObject", "body": document})
+	}
+	if err := sendSearchRequest(a.client, "POST", indexURL+"/batch", headers, map[string]interface{}{"requests": requests}); err != nil {
+		return fmt.Errorf("failed to add records: %w", err)
+	}
+	return nil
+}
+
+// truncateUTF8 returns the first bytes of s, at most maxBytes of them, without
+// cutting a character in two
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
+
+// sendSearchRequest sends body as JSON to a search engine API
+func sendSearchRequest(client *http.Client, method, requestURL string, headers map[string]string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+	req, err := http.NewRequest(method, requestURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// indexChapters pushes the chapters of a publication to the search index of
+// SEARCH_PROVIDER, returning the number of records indexed
+func indexChapters(indexer searchIndexer, m *manifest.Manifest, chapters []chapterText, basePath, manifestURL string) (int, error) {
+	if indexer == nil {
+		return 0, fmt.Errorf("search indexing requires %s to be set", searchProviderEnvVar)
+	}
+	documents := searchDocuments(m, chapters, basePath, manifestURL)
+	if err := indexer.replace(basePath, documents); err != nil {
+		return 0, err
+	}
+	return len(documents), nil
+}
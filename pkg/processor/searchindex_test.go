@@ -0,0 +1,153 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// searchRequest is a request received by the fake search engine
+type searchRequest struct {
+	path    string
+	headers http.Header
+	body    map[string]interface{}
+	list    []map[string]interface{}
+}
+
+func fakeSearchEngine(t *testing.T) (*httptest.Server, *[]searchRequest) {
+	t.Helper()
+	var requests []searchRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := searchRequest{path: r.URL.RequestURI(), headers: r.Header}
+		var body interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch b := body.(type) {
+		case map[string]interface{}:
+			request.body = b
+		case []interface{}:
+			for _, item := range b {
+				request.list = append(request.list, item.(map[string]interface{}))
+			}
+		}
+		requests = append(requests, request)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func testSearchChapters() []chapterText {
+	return []chapterText{
+		{Href: "OEBPS/ch1.xhtml", Title: "Loomings", WordCount: 3, Text: "Call me Ishmael."},
+		{Href: "OEBPS/ch2.xhtml", WordCount: 2, Text: "The Carpet-Bag."},
+	}
+}
+
+func TestSearchDocuments(t *testing.T) {
+	m := &manifest.Manifest{}
+	m.Metadata.Languages = []string{"en"}
+	documents := searchDocuments(m, testSearchChapters(), "books/b1", "https://cdn/books/b1/manifest.json")
+	if len(documents) != 2 || documents[1].Chapter != 1 || documents[0].Language != "en" || documents[0].Text != "Call me Ishmael." {
+		t.Fatalf("Expected a document per chapter, got %+v", documents)
+	}
+	again := searchDocuments(m, testSearchChapters(), "books/b1", "")
+	other := searchDocuments(m, testSearchChapters(), "books/b2", "")
+	if documents[0].ID != again[0].ID || documents[0].ID == documents[1].ID || documents[0].ID == other[0].ID {
+		t.Errorf("Expected IDs stable per publication and chapter, got %s, %s, %s, %s", documents[0].ID, again[0].ID, documents[1].ID, other[0].ID)
+	}
+}
+
+func TestMeilisearchIndexer(t *testing.T) {
+	server, requests := fakeSearchEngine(t)
+	t.Setenv(searchProviderEnvVar, "meilisearch")
+	t.Setenv(searchAPIURLEnvVar, server.URL)
+	t.Setenv(searchAPIKeyEnvVar, "master-key")
+	t.Setenv(searchIndexEnvVar, "library")
+	indexer, err := searchIndexerFromEnv()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	indexed, err := indexChapters(indexer, &manifest.Manifest{}, testSearchChapters(), "books/b1", "")
+	if err != nil || indexed != 2 {
+		t.Fatalf("Expected 2 chapters indexed, got %d, %v", indexed, err)
+	}
+	if len(*requests) != 2 {
+		t.Fatalf("Expected a delete and an add, got %+v", *requests)
+	}
+	deletion, addition := (*requests)[0], (*requests)[1]
+	if deletion.path != "/indexes/library/documents/delete" || deletion.body["filter"] != `publication = "books/b1"` {
+		t.Errorf("Expected the records of the publication deleted, got %+v", deletion)
+	}
+	if deletion.headers.Get("Authorization") != "Bearer master-key" {
+		t.Errorf("Expected the API key, got %q", deletion.headers.Get("Authorization"))
+	}
+	if addition.path != "/indexes/library/documents?primaryKey=id" || len(addition.list) != 2 || addition.list[0]["title"] != "Loomings" {
+		t.Errorf("Expected the chapters added, got %+v", addition)
+	}
+	if _, ok := addition.list[0]["objectID"]; ok {
+		t.Error("Expected no objectID for Meilisearch")
+	}
+}
+
+func TestAlgoliaIndexer(t *testing.T) {
+	server, requests := fakeSearchEngine(t)
+	t.Setenv(searchProviderEnvVar, "algolia")
+	t.Setenv(searchAPIURLEnvVar, server.URL)
+	t.Setenv(algoliaAppIDEnvVar, "APP")
+	t.Setenv(searchAPIKeyEnvVar, "admin-key")
+	indexer, err := searchIndexerFromEnv()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	chapters := testSearchChapters()
+	chapters[0].Text = strings.Repeat("é", algoliaMaxTextBytes)
+	if _, err := indexChapters(indexer, &manifest.Manifest{}, chapters, "books/b1", ""); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(*requests) != 2 {
+		t.Fatalf("Expected a delete and a batch, got %+v", *requests)
+	}
+	deletion, batch := (*requests)[0], (*requests)[1]
+	if deletion.path != "/1/indexes/chapters/deleteByQuery" || deletion.body["filters"] != `publication:"books/b1"` {
+		t.Errorf("Expected the records of the publication deleted, got %+v", deletion)
+	}
+	if deletion.headers.Get("X-Algolia-Application-Id") != "APP" || deletion.headers.Get("X-Algolia-API-Key") != "admin-key" {
+		t.Errorf("Expected the Algolia credentials, got %v", deletion.headers)
+	}
+	items, _ := batch.body["requests"].([]interface{})
+	if batch.path != "/1/indexes/chapters/batch" || len(items) != 2 {
+		t.Fatalf("Expected a batch of 2 records, got %+v", batch)
+	}
+	record := items[0].(map[string]interface{})["body"].(map[string]interface{})
+	if record["objectID"] != record["id"] || record["objectID"] == "" {
+		t.Errorf("Expected the ID as objectID, got %v", record)
+	}
+	if text := record["text"].(string); len(text) > algoliaMaxTextBytes || !strings.HasPrefix(chapters[0].Text, text) {
+		t.Errorf("Expected the text truncated to %d bytes, got %d", algoliaMaxTextBytes, len(text))
+	}
+}
+
+func TestSearchIndexerFromEnv(t *testing.T) {
+	t.Setenv(searchProviderEnvVar, "")
+	if indexer, err := searchIndexerFromEnv(); indexer != nil || err != nil {
+		t.Errorf("Expected no indexer by default, got %v, %v", indexer, err)
+	}
+	t.Setenv(searchProviderEnvVar, "meilisearch")
+	t.Setenv(searchAPIURLEnvVar, "")
+	if _, err := searchIndexerFromEnv(); err == nil {
+		t.Error("Expected an error for Meilisearch without a URL")
+	}
+	t.Setenv(searchProviderEnvVar, "elastic")
+	if _, err := searchIndexerFromEnv(); err == nil {
+		t.Error("Expected an error for an unknown provider")
+	}
+	if _, err := indexChapters(nil, &manifest.Manifest{}, testSearchChapters(), "books/b1", ""); err == nil || !strings.Contains(err.Error(), searchProviderEnvVar) {
+		t.Errorf("Expected an error without a provider, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package processor
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+const (
+	signingKeyEnvVar   = "MANIFEST_SIGNING_KEY"
+	signingKeyIDEnvVar = "MANIFEST_SIGNING_KEY_ID"
+
+	// signaturePath is where the detached JWS of the manifest is stored, relative to basePath
+	signaturePath = "readium/manifest.jws"
+	// signatureRel is the rel of the manifest link to the signature
+	signatureRel = "signature"
+)
+
+// manifestSigner produces detached JWS signatures (RFC 7515, appendix F) of
+// generated manifests, so readers can verify a manifest served from a public
+// bucket came from us
+type manifestSigner struct {
+	key crypto.Signer
+	alg string
+	kid string
+}
+
+// manifestSignerFromEnv returns the signer for the PEM private key (PKCS#8,
+// SEC 1 or PKCS#1) in MANIFEST_SIGNING_KEY, or nil when signing is off. Escaped
+// newlines ("\n") are accepted, since multi-line values are awkward in most
+// environment configuration.
+func manifestSignerFromEnv() (*manifestSigner, error) {
+	value := strings.TrimSpace(os.Getenv(signingKeyEnvVar))
+	if value == "" {
+		return nil, nil
+	}
+	signer, err := newManifestSigner([]byte(strings.ReplaceAll(value, `\n`, "\n")), os.Getenv(signingKeyIDEnvVar))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", signingKeyEnvVar, err)
+	}
+	return signer, nil
+}
+
+// newManifestSigner parses a PEM private key and picks the JWS algorithm for it:
+// ES256/ES384/ES512 for ECDSA, EdDSA for Ed25519 and RS256 for RSA
+func newManifestSigner(keyPEM []byte, kid string) (*manifestSigner, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer := &manifestSigner{kid: kid}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			signer.alg = "ES256"
+		case elliptic.P384():
+			signer.alg = "ES384"
+		case elliptic.P521():
+			signer.alg = "ES512"
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+		}
+		signer.key = k
+	case ed25519.PrivateKey:
+		signer.alg = "EdDSA"
+		signer.key = k
+	case *rsa.PrivateKey:
+		signer.alg = "RS256"
+		signer.key = k
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// sign returns the detached JWS of payload in compact serialization: the
+// protected header, an empty payload and the signature, separated by dots. The
+// signature covers the header and the base64url-encoded payload as usual.
+func (s *manifestSigner) sign(payload []byte) ([]byte, error) {
+	header := map[string]string{"alg": s.alg, "cty": "application/webpub+json"}
+	if s.kid != "" {
+		header["kid"] = s.kid
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(headerJSON)
+	signingInput := encodedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	signature, err := s.signInput([]byte(signingInput))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	return []byte(encodedHeader + ".." + base64.RawURLEncoding.EncodeToString(signature)), nil
+}
+
+// signInput signs the JWS signing input with the algorithm of the key
+func (s *manifestSigner) signInput(input []byte) ([]byte, error) {
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, input), nil
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var h hash.Hash
+		switch s.alg {
+		case "ES256":
+			h = sha256.New()
+		case "ES384":
+			h = sha512.New384()
+		default:
+			h = sha512.New()
+		}
+		h.Write(input)
+		sigR, sigS, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed-size concatenation of R and S, not ASN.1
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		sigR.FillBytes(signature[:size])
+		sigS.FillBytes(signature[size:])
+		return signature, nil
+	}
+	return nil, fmt.Errorf("unsupported key %T", s.key)
+}
+
+// signatureLink is the manifest link to the detached signature
+func signatureLink() map[string]interface{} {
+	return map[string]interface{}{
+		"href": signaturePath,
+		"type": "application/jose",
+		"rel":  signatureRel,
+	}
+}
+
+// uploadSignature signs the manifest as uploaded and stores the signature next
+// to it. Nothing is signed when signer is nil.
+func (s *manifestSigner) uploadSignature(manifestJSON []byte, basePath string, delta *deltaUploader) error {
+	if s == nil {
+		return nil
+	}
+	signature, err := s.sign(manifestJSON)
+	if err != nil {
+		return err
+	}
+	if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, signaturePath), signature); err != nil {
+		return fmt.Errorf("failed to upload manifest signature: %w", err)
+	}
+	return nil
+}
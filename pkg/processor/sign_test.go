@@ -0,0 +1,110 @@
+package processor
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+// testSigningKey returns key as the PKCS#8 PEM the MANIFEST_SIGNING_KEY env var holds
+func testSigningKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// verifyDetachedJWS checks a detached JWS of payload with verify, returning its header
+func verifyDetachedJWS(t *testing.T, jws, payload []byte, verify func(input, signature []byte) bool) map[string]string {
+	parts := strings.Split(string(jws), ".")
+	if len(parts) != 3 || parts[1] != "" {
+		t.Fatalf("Expected a detached compact JWS, got %s", jws)
+	}
+	var header map[string]string
+	headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !verify([]byte(parts[0]+"."+base64.RawURLEncoding.EncodeToString(payload)), signature) {
+		t.Error("Expected the signature to verify against the manifest")
+	}
+	return header
+}
+
+func TestNewManifestSigner_ECDSA(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signer, err := newManifestSigner([]byte(testSigningKey(t, key)), "")
+	if err != nil {
+		t.Fatalf("Expected a signer, got %v", err)
+	}
+	payload := []byte(`{"metadata": {}}`)
+	jws, err := signer.sign(payload)
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	header := verifyDetachedJWS(t, jws, payload, func(input, signature []byte) bool {
+		digest := sha256.Sum256(input)
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return len(signature) == 64 && ecdsa.Verify(&key.PublicKey, digest[:], r, s)
+	})
+	if header["alg"] != "ES256" {
+		t.Errorf("Expected ES256, got %v", header)
+	}
+
+	if _, err := newManifestSigner([]byte("not a key"), ""); err == nil {
+		t.Error("Expected an error for a value without a PEM block")
+	}
+}
+
+func TestProcess_SignsManifest(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	t.Setenv(signingKeyEnvVar, strings.ReplaceAll(testSigningKey(t, private), "\n", `\n`))
+	t.Setenv(signingKeyIDEnvVar, "2026-10")
+
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+	entries := map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	}
+	if _, err := New(store, store).Process(spoolTestArchive(t, entries), "leviathan.lpf", Options{}); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	manifestJSON, _ := supabase.Object(ManifestBucket, "leviathan/manifest.json")
+	if !strings.Contains(string(manifestJSON), `"href": "`+signaturePath+`"`) {
+		t.Errorf("Expected a link to the signature, got %s", manifestJSON)
+	}
+	jws, ok := supabase.Object(ManifestBucket, "leviathan/"+signaturePath)
+	if !ok {
+		t.Fatalf("Expected the signature to be uploaded, got %v", supabase.Paths(ManifestBucket))
+	}
+	header := verifyDetachedJWS(t, jws, manifestJSON, func(input, signature []byte) bool {
+		return ed25519.Verify(public, input, signature)
+	})
+	if header["alg"] != "EdDSA" || header["kid"] != "2026-10" {
+		t.Errorf("Expected an EdDSA header with the key ID, got %v", header)
+	}
+
+	t.Setenv(signingKeyEnvVar, "garbage")
+	if _, err := New(store, store).Process(spoolTestArchive(t, entries), "leviathan.lpf", Options{}); err == nil || !strings.Contains(err.Error(), signingKeyEnvVar) {
+		t.Errorf("Expected an invalid key to fail the run, got %v", err)
+	}
+}
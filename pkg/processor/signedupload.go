@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// uploadModeEnvVar selects how the output is uploaded: "direct" (default),
+	// with the service role key, or "signed", to signed upload URLs
+	uploadModeEnvVar = "UPLOAD_MODE"
+	// uploadWorkersEnvVar is the number of uploads run at once in signed mode
+	uploadWorkersEnvVar  = "UPLOAD_WORKERS"
+	defaultUploadWorkers = 4
+)
+
+// SignedUploadsFromEnv returns the number of upload workers if UPLOAD_MODE is
+// "signed", or 0 if the output is uploaded directly
+func SignedUploadsFromEnv() (int, error) {
+	switch mode := os.Getenv(uploadModeEnvVar); mode {
+	case "", "direct":
+		return 0, nil
+	case "signed":
+		value := os.Getenv(uploadWorkersEnvVar)
+		if value == "" {
+			return defaultUploadWorkers, nil
+		}
+		workers, err := strconv.Atoi(value)
+		// More workers than pooled connections would keep reconnecting
+		if err != nil || workers < 1 || workers > maxIdleConnsPerHost {
+			return 0, fmt.Errorf("invalid %s %q: must be between 1 and %d", uploadWorkersEnvVar, value, maxIdleConnsPerHost)
+		}
+		return workers, nil
+	default:
+		return 0, fmt.Errorf("unknown %s %q (expected direct or signed)", uploadModeEnvVar, mode)
+	}
+}
+
+// WithSignedUploads returns a copy of s that uploads the output to signed
+// upload URLs: the service role key only asks Storage for a URL, and the bytes
+// are PUT to it with its token, as a client uploading directly would. Up to
+// workers uploads of a publication then run at once (see ConcurrentUploader).
+// 0 workers keeps direct uploads. Uploads through S3 (see WithS3) take
+// precedence, but still run on the workers.
+func (s *Supabase) WithSignedUploads(workers int) *Supabase {
+	scoped := *s
+	scoped.uploadWorkers = workers
+	return &scoped
+}
+
+// UploadConcurrency returns the number of uploads run at once
+func (s *Supabase) UploadConcurrency() int {
+	return max(s.uploadWorkers, 1)
+}
+
+// uploadSigned uploads data to path in the manifest bucket through a signed upload URL
+func (s *Supabase) uploadSigned(path string, data []byte, encoding string) (string, error) {
+	signedURL, err := s.signUpload(s.prefix + path)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign upload of %s: %w", path, err)
+	}
+
+	req, err := http.NewRequest("PUT", signedURL, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	// The token of the URL authorizes the upload: no key is sent along
+	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
+	if s.requestID != "" {
+		req.Header.Set("X-Request-ID", s.requestID)
+	}
+	for name, value := range objectHeaders(path, encoding) {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("x-upsert", "true")
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return s.PublicURL(path), nil
+}
+
+// signUpload returns a signed URL uploading to key in the manifest bucket,
+// overwriting any existing object
+func (s *Supabase) signUpload(key string) (string, error) {
+	req, err := http.NewRequest("POST", storageObjectURL(s.url, "object/upload/sign", s.manifests(), key), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	setStorageHeaders(req, s.serviceKey, s.requestID)
+	req.Header.Set("x-upsert", "true")
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	// The URL is relative to the Storage API, e.g.
+	// /object/upload/sign/{bucket}/{path}?token=...
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(bodyBytes, &signed); err != nil || signed.URL == "" {
+		return "", fmt.Errorf("failed to parse signed upload URL: %s", string(bodyBytes))
+	}
+	return strings.TrimSuffix(s.url, "/") + "/storage/v1" + signed.URL, nil
+}
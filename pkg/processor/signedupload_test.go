@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestSignedUploadsFromEnv(t *testing.T) {
+	t.Setenv(uploadModeEnvVar, "")
+	t.Setenv(uploadWorkersEnvVar, "")
+	if workers, err := SignedUploadsFromEnv(); workers != 0 || err != nil {
+		t.Errorf("Expected direct uploads by default, got %d, %v", workers, err)
+	}
+	t.Setenv(uploadModeEnvVar, "signed")
+	if workers, err := SignedUploadsFromEnv(); workers != defaultUploadWorkers || err != nil {
+		t.Errorf("Expected %d workers by default, got %d, %v", defaultUploadWorkers, workers, err)
+	}
+	t.Setenv(uploadWorkersEnvVar, "8")
+	if workers, err := SignedUploadsFromEnv(); workers != 8 || err != nil {
+		t.Errorf("Expected 8 workers, got %d, %v", workers, err)
+	}
+	for _, invalid := range []string{"0", "many", "1000"} {
+		t.Setenv(uploadWorkersEnvVar, invalid)
+		if _, err := SignedUploadsFromEnv(); err == nil {
+			t.Errorf("Expected an error for %s workers", invalid)
+		}
+	}
+	t.Setenv(uploadModeEnvVar, "presigned")
+	if _, err := SignedUploadsFromEnv(); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestSupabase_SignedUploads(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey).WithSignedUploads(4)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+		"cover.jpg":           "cover",
+		"toc.html":            "<html></html>",
+	} {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	supabase.Put(EPUBBucket, "audiobooks/leviathan.lpf", buf.Bytes())
+
+	p := New(store, store)
+	source, err := p.Fetch("audiobooks/leviathan.lpf", 0)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer source.Close()
+	options := Options{}
+	options.Resolve()
+	result, err := p.Process(source, "audiobooks/leviathan.lpf", options)
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	basePath := BasePath("audiobooks/leviathan.lpf", options.Layout)
+	if data, ok := supabase.Object(ManifestBucket, basePath+"/audio/chapter 1.mp3"); !ok || string(data) != "one" {
+		t.Errorf("Expected the first track uploaded, got %q (%v)", data, ok)
+	}
+	// Every object is uploaded to a signed URL, the index included
+	if paths := supabase.Paths(ManifestBucket); supabase.SignedUploads() != len(paths) || result.Uploaded < 4 {
+		t.Errorf("Expected %v uploaded to signed URLs, got %d signed uploads", paths, supabase.SignedUploads())
+	}
+}
+
+// failingUploader fails the uploads of paths containing "fail"
+type failingUploader struct {
+	mu       sync.Mutex
+	uploaded []string
+}
+
+func (u *failingUploader) Upload(path string, data []byte, encoding string) (string, error) {
+	if strings.Contains(path, "fail") {
+		return "", errors.New("storage unavailable")
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uploaded = append(u.uploaded, path)
+	return u.PublicURL(path), nil
+}
+func (u *failingUploader) Create(path string, data []byte) (bool, error) { return true, nil }
+func (u *failingUploader) Download(path string) ([]byte, error) {
+	return nil, errors.New("not found")
+}
+func (u *failingUploader) Delete(path string) error     { return nil }
+func (u *failingUploader) PublicURL(path string) string { return "https://cdn/" + path }
+func (u *failingUploader) UploadConcurrency() int       { return 3 }
+
+func TestDeltaUploader_Concurrent(t *testing.T) {
+	uploader := &failingUploader{}
+	delta := newDeltaUploader("book", uploader, false)
+	if delta.queue == nil {
+		t.Fatal("Expected a concurrent uploader to get an upload queue")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := delta.upload(fmt.Sprintf("book/%d.xhtml", i), []byte{byte(i)}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if err := delta.wait(); err != nil || delta.uploaded != 10 || len(uploader.uploaded) != 10 {
+		t.Errorf("Expected 10 uploads, got %d (%v)", delta.uploaded, err)
+	}
+
+	delta.upload("book/fail.xhtml", []byte("x"))
+	if err := delta.wait(); err == nil || !strings.Contains(err.Error(), "storage unavailable") {
+		t.Errorf("Expected the failed upload reported, got %v", err)
+	}
+	if _, err := delta.upload("book/after.xhtml", []byte("x")); err == nil {
+		t.Error("Expected uploads to stop after a failure")
+	}
+}
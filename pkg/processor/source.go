@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Source is a downloaded EPUB spooled to local disk. Keeping the archive on
+// disk (Lambda's /tmp holds up to 10 GB) rather than in memory lets us open
+// ZIP64 packages larger than 4 GB, such as audiobooks, with the same code path.
+type Source struct {
+	file *os.File
+	size int64
+	hash string
+	// version is the version of the stored object, for EPUBs fetched from a bucket
+	version *SourceVersion
+}
+
+// SpoolEPUB copies r to a temporary file, hashing it on the way. At most maxBytes
+// are accepted (0 means unlimited).
+func SpoolEPUB(r io.Reader, maxBytes int64) (*Source, error) {
+	file, err := os.CreateTemp("", "epub-*.epub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	source := &Source{file: file}
+
+	// Read one byte past the limit to detect oversized bodies without a Content-Length
+	if maxBytes > 0 {
+		r = io.LimitReader(r, maxBytes+1)
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), r)
+	if err != nil {
+		source.Close()
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if maxBytes > 0 && size > maxBytes {
+		source.Close()
+		return nil, EPUBTooLargeError(size, maxBytes)
+	}
+
+	source.size = size
+	source.hash = hex.EncodeToString(hasher.Sum(nil))
+	return source, nil
+}
+
+// Size returns the length of the EPUB in bytes
+func (s *Source) Size() int64 {
+	return s.size
+}
+
+// Hash returns the hex-encoded SHA-256 of the EPUB
+func (s *Source) Hash() string {
+	return s.hash
+}
+
+// Version returns the version of the object the EPUB was fetched from, or nil
+// for EPUBs that weren't fetched from a bucket
+func (s *Source) Version() *SourceVersion {
+	return s.version
+}
+
+// Path returns the location of the spooled file, for tools that scan files on disk
+func (s *Source) Path() string {
+	return s.file.Name()
+}
+
+// Reader returns a reader over the whole EPUB, independent of other readers
+func (s *Source) Reader() io.Reader {
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+// HasZIPSignature reports whether the source starts with a ZIP local file header (PK\x03\x04)
+func (s *Source) HasZIPSignature() bool {
+	header := make([]byte, 4)
+	if _, err := s.file.ReadAt(header, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(header, []byte("PK\x03\x04"))
+}
+
+// openZIP opens the source as a ZIP archive. archive/zip reads ZIP64 central
+// directories transparently; errors are reported as 422s with a readable message
+// instead of the bare "zip: not a valid zip file".
+func (s *Source) openZIP() (*zip.Reader, error) {
+	return openZIPAt(s.file, s.size)
+}
+
+// openZIPAt opens the size bytes of r as a ZIP archive, reporting unreadable
+// archives as openZIP does
+func openZIPAt(r io.ReaderAt, size int64) (*zip.Reader, error) {
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrAlgorithm) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &statusError{
+				status: 422,
+				err:    fmt.Errorf("EPUB is not a readable ZIP archive (%d bytes, possibly truncated or corrupt): %w", size, err),
+			}
+		}
+		return nil, fmt.Errorf("failed to create zip reader: %w", err)
+	}
+	return zipReader, nil
+}
+
+// Close closes and deletes the spooled file
+func (s *Source) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
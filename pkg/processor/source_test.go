@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSpoolEPUB_OpensArchiveFromDisk(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create("mimetype")
+	f.Write([]byte("application/epub+zip"))
+	w.Close()
+
+	source, err := SpoolEPUB(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	name := source.file.Name()
+
+	if source.hash != hashContent(buf.Bytes()) {
+		t.Errorf("Expected hash of the spooled content")
+	}
+	if !source.HasZIPSignature() {
+		t.Errorf("Expected ZIP signature")
+	}
+	zipReader, err := source.openZIP()
+	if err != nil {
+		t.Fatalf("openZIP failed: %v", err)
+	}
+	if len(zipReader.File) != 1 || zipReader.File[0].Name != "mimetype" {
+		t.Errorf("Unexpected archive contents: %+v", zipReader.File)
+	}
+
+	source.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file to be removed, got %v", err)
+	}
+}
+
+func TestOpenZIP_TruncatedArchiveIs422(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create("chapter.xhtml")
+	f.Write(bytes.Repeat([]byte("<p>text</p>"), 100))
+	w.Close()
+
+	// Cut off the central directory, as an interrupted upload would
+	truncated := buf.Bytes()[:buf.Len()/2]
+	source, err := SpoolEPUB(bytes.NewReader(truncated), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	defer source.Close()
+
+	_, err = source.openZIP()
+	if got := StatusCode(err); got != 422 {
+		t.Errorf("Expected status 422, got %d (%v)", got, err)
+	}
+}
+
+func TestSpoolEPUB_OpensZIP64Archive(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, _ := w.Create("mimetype")
+	f.Write([]byte("application/epub+zip"))
+	// More entries than a ZIP32 end of central directory can count
+	for i := 0; i < 0xffff; i++ {
+		w.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("OEBPS/%05d.xhtml", i), Method: zip.Store})
+	}
+	// A size past 4 GB, recorded in a ZIP64 extra field
+	raw, err := w.CreateRaw(&zip.FileHeader{Name: "audio/track.mp3", Method: zip.Store, CompressedSize64: 1, UncompressedSize64: 5 << 30})
+	if err != nil {
+		t.Fatalf("CreateRaw failed: %v", err)
+	}
+	raw.Write([]byte{0})
+	w.Close()
+	if !bytes.Contains(buf.Bytes(), []byte("PK\x06\x06")) {
+		t.Fatalf("Expected a ZIP64 end of central directory record")
+	}
+
+	source, err := SpoolEPUB(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatalf("SpoolEPUB failed: %v", err)
+	}
+	defer source.Close()
+
+	zipReader, err := source.openZIP()
+	if err != nil {
+		t.Fatalf("openZIP failed: %v", err)
+	}
+	if len(zipReader.File) != 0x10001 {
+		t.Errorf("Expected %d entries, got %d", 0x10001, len(zipReader.File))
+	}
+	last := zipReader.File[len(zipReader.File)-1]
+	if last.Name != "audio/track.mp3" || last.UncompressedSize64 != 5<<30 {
+		t.Errorf("Expected audio/track.mp3 of %d bytes, got %s of %d", uint64(5<<30), last.Name, last.UncompressedSize64)
+	}
+}
@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SourceVersion identifies the stored object an EPUB was downloaded from, as
+// Storage reports it, so a change can be detected without downloading it
+type SourceVersion struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified,omitzero"`
+}
+
+// versionFromHeaders returns the version of the object a response serves, or
+// nil if it carries neither an ETag nor a Last-Modified
+func versionFromHeaders(header http.Header) *SourceVersion {
+	version := &SourceVersion{ETag: header.Get("ETag")}
+	if modified, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		version.LastModified = modified.UTC()
+	}
+	if version.ETag == "" && version.LastModified.IsZero() {
+		return nil
+	}
+	return version
+}
+
+// Unchanged reports whether current is the version v was recorded from: same
+// ETag, or, for objects without one, not modified since
+func (v *SourceVersion) Unchanged(current *SourceVersion) bool {
+	switch {
+	case v == nil || current == nil:
+		return false
+	case v.ETag != "" && current.ETag != "":
+		return v.ETag == current.ETag
+	case !v.LastModified.IsZero() && !current.LastModified.IsZero():
+		return !current.LastModified.After(v.LastModified)
+	}
+	return false
+}
+
+// Stater is implemented by Fetchers that can report the version of an EPUB
+// without downloading it
+type Stater interface {
+	// Stat returns the version of the EPUB stored as filename
+	Stat(filename string) (*SourceVersion, error)
+}
+
+// SourceCheck tells whether the publication of an EPUB is out of date
+type SourceCheck struct {
+	NeedsProcessing bool   `json:"needs_processing"`
+	Reason          string `json:"reason"`
+	// Current is the version of the EPUB in the bucket
+	Current *SourceVersion `json:"current,omitempty"`
+	// Processed is the version the publication was last processed from
+	Processed *SourceVersion `json:"processed,omitempty"`
+}
+
+// CheckSource compares the version of the EPUB stored as filename with the one
+// the publication at basePath was last processed from, downloading neither the
+// EPUB nor more than the resource index. The fetcher must implement Stater.
+func (p *Processor) CheckSource(filename, basePath string) (*SourceCheck, error) {
+	stater, ok := p.fetcher.(Stater)
+	if !ok {
+		return nil, fmt.Errorf("the fetcher cannot report EPUB versions")
+	}
+	current, err := stater.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	check := &SourceCheck{Current: current}
+
+	data, err := p.uploader.Download(fmt.Sprintf("%s/%s", basePath, IndexPath))
+	var index resourceIndex
+	switch {
+	case err != nil || json.Unmarshal(data, &index) != nil:
+		check.NeedsProcessing, check.Reason = true, "not processed yet"
+	case index.Filename != "" && index.Filename != filename:
+		check.NeedsProcessing, check.Reason = true, "the publication stored there is of "+index.Filename
+	case index.SourceVersion == nil:
+		check.NeedsProcessing, check.Reason = true, "processed before source versions were recorded"
+	case !index.SourceVersion.Unchanged(current):
+		check.NeedsProcessing, check.Reason, check.Processed = true, "EPUB changed since it was processed", index.SourceVersion
+	default:
+		check.Reason, check.Processed = "EPUB unchanged since it was processed", index.SourceVersion
+	}
+	return check, nil
+}
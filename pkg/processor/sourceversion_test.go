@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestSourceVersion_Unchanged(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	recorded := &SourceVersion{ETag: `"abc"`, LastModified: modified}
+	for name, test := range map[string]struct {
+		current *SourceVersion
+		want    bool
+	}{
+		"same ETag":                  {&SourceVersion{ETag: `"abc"`, LastModified: modified.Add(time.Hour)}, true},
+		"other ETag":                 {&SourceVersion{ETag: `"xyz"`, LastModified: modified}, false},
+		"no ETag, not modified":      {&SourceVersion{LastModified: modified}, true},
+		"no ETag, modified later":    {&SourceVersion{LastModified: modified.Add(time.Second)}, false},
+		"unknown":                    {nil, false},
+		"neither ETag nor timestamp": {&SourceVersion{}, false},
+	} {
+		if got := recorded.Unchanged(test.current); got != test.want {
+			t.Errorf("%s: expected %v, got %v", name, test.want, got)
+		}
+	}
+	if (*SourceVersion)(nil).Unchanged(recorded) {
+		t.Error("Expected an unrecorded version never to be unchanged")
+	}
+}
+
+func TestVersionFromHeaders(t *testing.T) {
+	header := http.Header{}
+	if version := versionFromHeaders(header); version != nil {
+		t.Errorf("Expected no version without headers, got %+v", version)
+	}
+	header.Set("ETag", `"abc"`)
+	header.Set("Last-Modified", "Fri, 01 Mar 2024 12:00:00 GMT")
+	version := versionFromHeaders(header)
+	if version == nil || version.ETag != `"abc"` || !version.LastModified.Equal(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected the ETag and Last-Modified, got %+v", version)
+	}
+}
+
+func TestProcessor_CheckSource(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	store := NewSupabase(supabase.URL, processortest.ServiceKey)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		lpfManifestPath:       testPublicationJSON,
+		"audio/chapter 1.mp3": "one",
+		"audio/chapter2.mp3":  "two",
+	} {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+	filename := "audiobooks/leviathan.lpf"
+	supabase.Put(EPUBBucket, filename, buf.Bytes())
+
+	p := New(store, store)
+	options := Options{}
+	options.Resolve()
+	basePath := BasePath(filename, options.Layout)
+	check, err := p.CheckSource(filename, basePath)
+	if err != nil || !check.NeedsProcessing || check.Current == nil || check.Current.ETag == "" {
+		t.Fatalf("Expected an unprocessed EPUB to need processing, got %+v (%v)", check, err)
+	}
+
+	source, err := p.Fetch(filename, 0)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer source.Close()
+	if source.Version() == nil || source.Version().ETag != check.Current.ETag {
+		t.Errorf("Expected the fetched version %+v, got %+v", check.Current, source.Version())
+	}
+	if _, err := p.Process(source, filename, options); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+
+	check, err = p.CheckSource(filename, basePath)
+	if err != nil || check.NeedsProcessing || check.Processed == nil || check.Processed.ETag != check.Current.ETag {
+		t.Errorf("Expected the processed EPUB to be up to date, got %+v (%v)", check, err)
+	}
+
+	// Replacing the EPUB changes its ETag
+	supabase.Put(EPUBBucket, filename, append(buf.Bytes(), 0))
+	if check, err := p.CheckSource(filename, basePath); err != nil || !check.NeedsProcessing {
+		t.Errorf("Expected a replaced EPUB to need processing, got %+v (%v)", check, err)
+	}
+
+	if _, err := p.CheckSource("audiobooks/gone.lpf", basePath); StatusCode(err) != 404 {
+		t.Errorf("Expected 404 for a missing EPUB, got %v", err)
+	}
+}
+
+func TestSupabase_StatS3(t *testing.T) {
+	supabase := processortest.NewSupabase()
+	defer supabase.Close()
+	supabase.Put(EPUBBucket, "books/moby.epub", []byte("epub"))
+	version, err := testS3Store(supabase).Stat("books/moby.epub")
+	if err != nil || version.ETag == "" || version.LastModified.IsZero() {
+		t.Errorf("Expected the ETag and Last-Modified of the EPUB, got %+v (%v)", version, err)
+	}
+}
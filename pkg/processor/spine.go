@@ -0,0 +1,46 @@
+package processor
+
+import (
+	"archive/zip"
+	"fmt"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// checkReadingOrder looks for the spine inconsistencies that confuse progress
+// tracking and returns a warning for each: reading order items listed more than
+// once, which are dropped after their first occurrence, reading order items
+// missing from the archive, and table of contents entries pointing to documents
+// outside the reading order.
+func checkReadingOrder(m *manifest.Manifest, entries map[string]*zip.File) []string {
+	var warnings []string
+	inReadingOrder := map[string]bool{}
+	readingOrder := make(manifest.LinkList, 0, len(m.ReadingOrder))
+	for _, link := range m.ReadingOrder {
+		href := link.Href.String()
+		target := resolveArchiveHref(href, "")
+		if inReadingOrder[target] {
+			warnings = append(warnings, fmt.Sprintf("reading order lists %s more than once; dropped the repeat", href))
+			continue
+		}
+		inReadingOrder[target] = true
+		if target != "" && entries[target] == nil {
+			warnings = append(warnings, fmt.Sprintf("reading order item %s is missing from the archive", href))
+		}
+		readingOrder = append(readingOrder, link)
+	}
+	m.ReadingOrder = readingOrder
+
+	var walk func(links manifest.LinkList)
+	walk = func(links manifest.LinkList) {
+		for _, link := range links {
+			href := link.Href.String()
+			if target := resolveArchiveHref(href, ""); target != "" && !inReadingOrder[target] {
+				warnings = append(warnings, fmt.Sprintf("table of contents entry %q points outside the reading order (%s)", link.Title, href))
+			}
+			walk(link.Children)
+		}
+	}
+	walk(m.TableOfContents)
+	return warnings
+}
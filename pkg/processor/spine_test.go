@@ -0,0 +1,50 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestCheckReadingOrder(t *testing.T) {
+	zipReader := buildEPUB(t, map[string]string{
+		"OEBPS/ch1.xhtml":   "<html/>",
+		"OEBPS/ch2.xhtml":   "<html/>",
+		"OEBPS/notes.xhtml": "<html/>",
+	})
+
+	chapter2 := testLink(t, "OEBPS/ch2.xhtml#s1")
+	chapter2.Title = "Chapter 2"
+	notes := testLink(t, "OEBPS/notes.xhtml")
+	notes.Title = "Notes"
+	m := &manifest.Manifest{
+		ReadingOrder: manifest.LinkList{
+			testLink(t, "OEBPS/ch1.xhtml"),
+			testLink(t, "OEBPS/ch2.xhtml"),
+			testLink(t, "OEBPS/ch1.xhtml"),
+			testLink(t, "OEBPS/ch3.xhtml"),
+		},
+		TableOfContents: manifest.LinkList{
+			{Href: testLink(t, "OEBPS/ch1.xhtml").Href, Title: "Chapter 1", Children: manifest.LinkList{chapter2, notes}},
+		},
+	}
+
+	warnings := checkReadingOrder(m, zipEntries(zipReader))
+	want := []string{
+		"reading order lists OEBPS/ch1.xhtml more than once; dropped the repeat",
+		"reading order item OEBPS/ch3.xhtml is missing from the archive",
+		`table of contents entry "Notes" points outside the reading order (OEBPS/notes.xhtml)`,
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("Expected %q, got %q", want, warnings)
+	}
+
+	var hrefs []string
+	for _, link := range m.ReadingOrder {
+		hrefs = append(hrefs, link.Href.String())
+	}
+	if !reflect.DeepEqual(hrefs, []string{"OEBPS/ch1.xhtml", "OEBPS/ch2.xhtml", "OEBPS/ch3.xhtml"}) {
+		t.Errorf("Expected the repeat to be dropped, got %v", hrefs)
+	}
+}
@@ -0,0 +1,357 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// splitPartSuffix names the parts of a split chapter: chapter.xhtml keeps the
+// first part, chapter-split2.xhtml holds the second, and so on. The parts stay
+// next to the chapter so its relative references still resolve.
+const splitPartSuffix = "-split"
+
+var (
+	opfManifestEndPattern = regexp.MustCompile(`(?i)</(?:\w+:)?manifest>`)
+	// fragmentRefPattern matches the references to an element of a document
+	fragmentRefPattern = regexp.MustCompile(`(?i)(\s(?:href|src)=["'])([^"'#]*)#([^"']+)(["'])`)
+	tagNamePattern     = regexp.MustCompile(`^<([^\s/>]+)`)
+	markupPattern      = regexp.MustCompile(`<[^>]*>`)
+)
+
+// validateSplitChapterBytes checks the split_chapter_bytes option; 0 splits nothing
+func validateSplitChapterBytes(maxBytes int) error {
+	if maxBytes < 0 {
+		return fmt.Errorf("split_chapter_bytes must be positive, got %d", maxBytes)
+	}
+	return nil
+}
+
+// splitPartName returns the name of the part at index (from 0) of a chapter,
+// given the archive path or href of the chapter
+func splitPartName(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s%s%d%s", strings.TrimSuffix(name, ext), splitPartSuffix, index+1, ext)
+}
+
+// chapterSplit is a chapter cut into parts
+type chapterSplit struct {
+	parts [][]byte
+	ids   map[string]int // element id -> index of the part holding it
+	// cuts are the CFI paths in the chapter (from its root element) of the
+	// headings the parts after the first start at
+	cuts [][]int
+}
+
+// splitChapter cuts the body of a content document before headings, so that
+// each part holds at most maxBytes of it where the headings allow. The elements
+// wrapping a heading are closed at the end of a part and opened again at the
+// start of the next one; every part gets the <head> of the chapter. Returns nil
+// when the document has no heading to cut before.
+func splitChapter(content []byte, maxBytes int) *chapterSplit {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	type openElement struct {
+		name  string // as written, prefix included
+		tag   []byte // the start tag as written
+		index int    // its CFI step among the children of its parent
+	}
+	type boundary struct {
+		offset int64
+		open   []openElement // the elements between <body> and the heading
+		path   []int         // the CFI path of the heading
+	}
+	type idOffset struct {
+		id     string
+		offset int64
+	}
+	var stack []openElement
+	children := []int{0} // element children seen so far, at each level of stack
+	var boundaries []boundary
+	var ids []idOffset
+	body := -1 // index of <body> in stack while inside it
+	bodyStart, bodyEnd := int64(-1), int64(-1)
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			tag := content[offset:decoder.InputOffset()]
+			name := string(tag)
+			if match := tagNamePattern.FindSubmatch(tag); match != nil {
+				name = string(match[1])
+			}
+			children[len(children)-1]++
+			element := openElement{name: name, tag: tag, index: 2 * children[len(children)-1]}
+			if body >= 0 {
+				if headingElements[strings.ToLower(t.Name.Local)] {
+					var path []int
+					for _, e := range stack[1:] {
+						path = append(path, e.index)
+					}
+					path = append(path, element.index)
+					boundaries = append(boundaries, boundary{offset: offset, open: slices.Clone(stack[body+1:]), path: path})
+				}
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "id" {
+						ids = append(ids, idOffset{id: attr.Value, offset: offset})
+					}
+				}
+			}
+			stack = append(stack, element)
+			children = append(children, 0)
+			if bodyStart < 0 && strings.EqualFold(t.Name.Local, "body") {
+				body, bodyStart = len(stack)-1, decoder.InputOffset()
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			stack, children = stack[:len(stack)-1], children[:len(children)-1]
+			if len(stack) == body {
+				body, bodyEnd = -1, offset
+			}
+		}
+	}
+	if bodyEnd < 0 {
+		return nil
+	}
+
+	// Cut before the furthest heading that keeps the part within maxBytes, or
+	// before the next one when none does, until the rest fits
+	var cuts []boundary
+	start, next := bodyStart, 0
+	for bodyEnd-start > int64(maxBytes) {
+		// A cut must leave some text before it, or the part would be a blank page
+		for next < len(boundaries) && !hasText(content[start:boundaries[next].offset]) {
+			next++
+		}
+		if next == len(boundaries) {
+			break
+		}
+		cut := next
+		for i := next + 1; i < len(boundaries) && boundaries[i].offset-start <= int64(maxBytes); i++ {
+			cut = i
+		}
+		cuts = append(cuts, boundaries[cut])
+		start, next = boundaries[cut].offset, cut+1
+	}
+	if len(cuts) == 0 {
+		return nil
+	}
+
+	split := &chapterSplit{ids: map[string]int{}}
+	start = bodyStart
+	var reopen []openElement
+	for i := 0; i <= len(cuts); i++ {
+		end, open := bodyEnd, []openElement(nil)
+		if i < len(cuts) {
+			end, open = cuts[i].offset, cuts[i].open
+		}
+		var part bytes.Buffer
+		part.Write(content[:bodyStart])
+		for _, e := range reopen {
+			part.Write(e.tag)
+		}
+		part.Write(content[start:end])
+		for j := len(open) - 1; j >= 0; j-- {
+			fmt.Fprintf(&part, "</%s>", open[j].name)
+		}
+		part.Write(content[bodyEnd:])
+		split.parts = append(split.parts, part.Bytes())
+		if i < len(cuts) {
+			split.cuts = append(split.cuts, cuts[i].path)
+		}
+		start, reopen = end, open
+	}
+	for _, id := range ids {
+		part := 0
+		for part < len(cuts) && cuts[part].offset <= id.offset {
+			part++
+		}
+		if _, ok := split.ids[id.id]; !ok {
+			split.ids[id.id] = part
+		}
+	}
+	return split
+}
+
+// hasText reports whether a piece of markup has any text outside its tags
+func hasText(markup []byte) bool {
+	return len(bytes.TrimSpace(markupPattern.ReplaceAll(markup, nil))) > 0
+}
+
+// splitChapters splits the spine documents of more than maxBytes at their
+// headings, before the parser sees the archive: the parts are added to the
+// package manifest and to the spine after their chapter, and the references to
+// elements that moved to another part (from the navigation document, the NCX
+// and every content document) are updated. Returns a nil source when nothing
+// was split, the chapters split by archive path, and a warning for each chapter
+// split or left whole.
+func splitChapters(zipReader *zip.Reader, maxBytes int) (*Source, *zip.Reader, map[string]*chapterSplit, []string, error) {
+	pkg, err := openEPUBPackage(zipReader)
+	if err != nil {
+		// Left for the parser to report
+		return nil, zipReader, nil, nil, nil
+	}
+	opfData, err := readZipEntry(pkg.entries[pkg.opfPath])
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	var warnings []string
+	fixes := map[string][]byte{} // entry name -> new content
+	splits := map[string]*chapterSplit{}
+	partOf := map[string]string{} // part entry name -> chapter entry name
+	partIndex := map[string]int{}
+	var items strings.Builder
+	itemrefs := map[string]string{} // chapter item id -> itemrefs of its other parts
+	for _, itemref := range pkg.opf.Spine.Itemrefs {
+		item := pkg.itemByID(itemref.IDRef)
+		if item == nil || item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		docPath := pkg.resolve(item.Href)
+		f := pkg.entries[docPath]
+		if f == nil || f.UncompressedSize64 <= uint64(maxBytes) || splits[docPath] != nil {
+			continue
+		}
+		content, err := readZipEntry(f)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		split := splitChapter(content, maxBytes)
+		if split == nil {
+			warnings = append(warnings, fmt.Sprintf("%s is %d bytes but has no heading to split it at", docPath, len(content)))
+			continue
+		}
+		taken := false
+		for i := 1; i < len(split.parts); i++ {
+			taken = taken || pkg.entries[splitPartName(docPath, i)] != nil || pkg.itemByID(splitPartName(item.ID, i)) != nil
+		}
+		if taken {
+			warnings = append(warnings, fmt.Sprintf("%s is %d bytes but the names of its parts are taken", docPath, len(content)))
+			continue
+		}
+
+		splits[docPath] = split
+		href, _, _ := strings.Cut(item.Href, "#")
+		var refs strings.Builder
+		for i, part := range split.parts {
+			name := splitPartName(docPath, i)
+			fixes[name] = part
+			partOf[name], partIndex[name] = docPath, i
+			if i == 0 {
+				continue
+			}
+			fmt.Fprintf(&items, "<item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n",
+				html.EscapeString(splitPartName(item.ID, i)), html.EscapeString(splitPartName(href, i)))
+			linear := ""
+			if itemref.Linear == "no" {
+				linear = ` linear="no"`
+			}
+			fmt.Fprintf(&refs, "<itemref idref=\"%s\"%s/>", html.EscapeString(splitPartName(item.ID, i)), linear)
+		}
+		itemrefs[item.ID] = refs.String()
+		warnings = append(warnings, fmt.Sprintf("split %s (%d bytes) into %d parts at its headings", docPath, len(content), len(split.parts)))
+	}
+	if len(splits) == 0 {
+		return nil, zipReader, nil, warnings, nil
+	}
+
+	// Add the parts to the package manifest and to the spine
+	end := opfManifestEndPattern.FindIndex(opfData)
+	if end == nil {
+		return nil, zipReader, nil, append(warnings, "left the chapters whole: the package document has no manifest end tag"), nil
+	}
+	opfData = slices.Concat(opfData[:end[0]], []byte(items.String()), opfData[end[0]:])
+	opfData = itemrefPattern.ReplaceAllFunc(opfData, func(itemref []byte) []byte {
+		idref := string(itemrefPattern.FindSubmatch(itemref)[1])
+		return slices.Concat(itemref, []byte(itemrefs[idref]))
+	})
+	fixes[pkg.opfPath] = opfData
+
+	// Point the references to moved elements at their new part
+	for name, f := range pkg.entries {
+		if !isHTMLPath(name) && !strings.HasSuffix(strings.ToLower(name), ".ncx") {
+			continue
+		}
+		if splits[name] != nil {
+			continue // rewritten part by part below
+		}
+		content, err := readZipEntry(f)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if rewritten := rewriteSplitRefs(content, name, 0, splits); !bytes.Equal(rewritten, content) {
+			fixes[name] = rewritten
+		}
+	}
+	for name, chapter := range partOf {
+		fixes[name] = rewriteSplitRefs(fixes[name], chapter, partIndex[name], splits)
+	}
+
+	rewritten, err := rewriteArchive(zipReader, nil, fixes, false)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to write split archive: %w", err)
+	}
+	rewrittenReader, err := rewritten.openZIP()
+	if err != nil {
+		rewritten.Close()
+		return nil, nil, nil, nil, err
+	}
+	return rewritten, rewrittenReader, splits, warnings, nil
+}
+
+// rewriteSplitRefs updates the references of a document to elements that moved
+// to another part of a split chapter. docPath is the document, or for a part
+// the chapter it comes from, with part its index.
+func rewriteSplitRefs(content []byte, docPath string, part int, splits map[string]*chapterSplit) []byte {
+	return fragmentRefPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		groups := fragmentRefPattern.FindSubmatch(match)
+		base, fragment := string(groups[2]), string(groups[3])
+		target := docPath
+		if base != "" {
+			target = resolveArchiveHref(base, docPath)
+		}
+		split := splits[target]
+		if split == nil {
+			return match
+		}
+		id := fragment
+		if decoded, err := url.PathUnescape(fragment); err == nil {
+			id = decoded
+		}
+		moved, ok := split.ids[id]
+		if !ok {
+			return match
+		}
+		if base == "" {
+			if moved == part {
+				return match
+			}
+			base = manifestHref(path.Base(target))
+		}
+		newBase := splitPartName(base, moved)
+		if newBase == string(groups[2]) {
+			return match
+		}
+		return []byte(string(groups[1]) + newBase + "#" + fragment + string(groups[4]))
+	})
+}
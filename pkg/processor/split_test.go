@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitChapter(t *testing.T) {
+	paragraph := strings.Repeat("Call me Ishmael. ", 10)
+	content := `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Moby-Dick</title></head><body>` +
+		`<section id="part1"><h1 id="c1">Loomings</h1><p>` + paragraph + `</p>` +
+		`<h1 id="c2">The Carpet-Bag</h1><p id="p2">` + paragraph + `</p>` +
+		`<h1 id="c3">The Spouter-Inn</h1><p>` + paragraph + `</p></section></body></html>`
+
+	split := splitChapter([]byte(content), 250)
+	if split == nil || len(split.parts) != 3 {
+		t.Fatalf("Expected three parts, got %v", split)
+	}
+	second := string(split.parts[1])
+	if !strings.HasPrefix(second, `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Moby-Dick</title></head><body><section id="part1"><h1 id="c2">`) ||
+		!strings.HasSuffix(second, `</p></section></body></html>`) {
+		t.Errorf("Expected the second part to reopen the section, got %s", second)
+	}
+	if first := string(split.parts[0]); !strings.HasSuffix(first, `</p></section></body></html>`) || strings.Contains(first, "c2") {
+		t.Errorf("Expected the first part to close the section before the second heading, got %s", first)
+	}
+	if !reflect.DeepEqual(split.cuts, [][]int{{4, 2, 6}, {4, 2, 10}}) {
+		t.Errorf("Expected the CFI paths of the second and third headings, got %v", split.cuts)
+	}
+	for id, want := range map[string]int{"part1": 0, "c1": 0, "c2": 1, "p2": 1, "c3": 2} {
+		if split.ids[id] != want {
+			t.Errorf("Expected %s in part %d, got %d", id, want, split.ids[id])
+		}
+	}
+
+	// Fits already, or no heading to cut before
+	if splitChapter([]byte(content), len(content)) != nil {
+		t.Error("Expected a chapter within the limit to stay whole")
+	}
+	if splitChapter([]byte(`<html><body><p>`+paragraph+`</p></body></html>`), 10) != nil {
+		t.Error("Expected a chapter without headings to stay whole")
+	}
+}
+
+func TestSplitChapters(t *testing.T) {
+	paragraph := strings.Repeat("Call me Ishmael. ", 10)
+	zipReader := buildEPUB(t, map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": validContainer,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="ch2" href="text/ch2.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="ch1"/><itemref idref="ch2"/></spine>
+</package>`,
+		"OEBPS/nav.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><nav><ol>` +
+			`<li><a href="text/ch1.xhtml#c1">Loomings</a></li><li><a href="text/ch1.xhtml#c2">The Carpet-Bag</a></li>` +
+			`<li><a href="text/ch2.xhtml">Chapter 2</a></li></ol></nav></body></html>`,
+		"OEBPS/text/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1 id="c1">Loomings</h1><p>` + paragraph +
+			`<a href="#c2">next</a></p><h1 id="c2">The Carpet-Bag</h1><p>` + paragraph + `<a href="#c1">back</a></p></body></html>`,
+		"OEBPS/text/ch2.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body><p><a href="ch1.xhtml#c2">see</a></p></body></html>`,
+	})
+
+	split, splitReader, splits, warnings, err := splitChapters(zipReader, 300)
+	if err != nil {
+		t.Fatalf("splitChapters failed: %v", err)
+	}
+	if split == nil {
+		t.Fatalf("Expected a split archive, got warnings %v", warnings)
+	}
+	defer split.Close()
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "split OEBPS/text/ch1.xhtml") {
+		t.Errorf("Expected a warning for the split chapter, got %v", warnings)
+	}
+	if chapter := splits["OEBPS/text/ch1.xhtml"]; chapter == nil || !reflect.DeepEqual(chapter.cuts, [][]int{{2, 6}}) {
+		t.Errorf("Expected the chapter cut before its second heading, got %+v", chapter)
+	}
+
+	entries := zipEntries(splitReader)
+	read := func(name string) string {
+		data, err := readZipEntry(entries[name])
+		if err != nil || data == nil {
+			t.Fatalf("Expected %s in the split archive (%v)", name, err)
+		}
+		return string(data)
+	}
+	opf := read("OEBPS/content.opf")
+	if !strings.Contains(opf, `<item id="ch1-split2" href="text/ch1-split2.xhtml" media-type="application/xhtml+xml"/>`) ||
+		!strings.Contains(opf, `<itemref idref="ch1"/><itemref idref="ch1-split2"/><itemref idref="ch2"/>`) {
+		t.Errorf("Expected the second part in the manifest and spine, got %s", opf)
+	}
+	if nav := read("OEBPS/nav.xhtml"); !strings.Contains(nav, `href="text/ch1.xhtml#c1"`) || !strings.Contains(nav, `href="text/ch1-split2.xhtml#c2"`) {
+		t.Errorf("Expected the moved heading to be linked in its part, got %s", nav)
+	}
+	if first := read("OEBPS/text/ch1.xhtml"); !strings.Contains(first, `href="ch1-split2.xhtml#c2"`) {
+		t.Errorf("Expected the first part to link to the second, got %s", first)
+	}
+	if second := read("OEBPS/text/ch1-split2.xhtml"); !strings.Contains(second, `href="ch1.xhtml#c1"`) || !strings.HasPrefix(second, `<html xmlns="http://www.w3.org/1999/xhtml"><body><h1 id="c2">`) {
+		t.Errorf("Expected the second part to start at its heading and link back, got %s", second)
+	}
+	if other := read("OEBPS/text/ch2.xhtml"); !strings.Contains(other, `href="ch1-split2.xhtml#c2"`) {
+		t.Errorf("Expected links from other chapters to follow the move, got %s", other)
+	}
+}
@@ -0,0 +1,676 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"strings"
+)
+
+// Fetcher retrieves the EPUBs to process
+type Fetcher interface {
+	// Fetch spools the EPUB stored as filename to local disk, refusing EPUBs
+	// larger than maxBytes (0 means unlimited). The caller must Close the source.
+	Fetch(filename string, maxBytes int64) (*Source, error)
+}
+
+// DirectoryFetcher is implemented by Fetchers able to read a stored EPUB in
+// ranges, so its ZIP central directory is read without downloading the EPUB
+type DirectoryFetcher interface {
+	// FetchDirectory opens the EPUB stored as filename as a ZIP archive whose
+	// bytes are only read as they are needed, and returns its size. It fails
+	// with ErrRangesUnsupported when the EPUB can't be read in ranges.
+	FetchDirectory(filename string, maxBytes int64) (*zip.Reader, int64, error)
+}
+
+// ErrRangesUnsupported is returned by a DirectoryFetcher that can't read the
+// EPUB in ranges, which must then be fetched whole
+var ErrRangesUnsupported = errors.New("storage can't read EPUBs in ranges")
+
+// Uploader stores the processed publications. Besides the uploads themselves,
+// the pipeline reads back the index of the previous run and keeps its
+// processing lock there.
+type Uploader interface {
+	// Upload stores data at path, overwriting any existing object, and returns
+	// its public URL. A non-empty encoding is stored as the Content-Encoding.
+	Upload(path string, data []byte, encoding string) (string, error)
+	// Create stores data at path only if no object exists there yet, and
+	// reports whether it did
+	Create(path string, data []byte) (bool, error)
+	// Download returns the object at path
+	Download(path string) ([]byte, error)
+	// Delete removes the object at path
+	Delete(path string) error
+	// PublicURL returns the URL the object at path is served from
+	PublicURL(path string) string
+}
+
+// ConcurrentUploader is implemented by Uploaders whose Upload may be called
+// from several goroutines. The pipeline then runs up to UploadConcurrency
+// uploads of a publication at once, waiting for them before it stores the
+// manifest.
+type ConcurrentUploader interface {
+	UploadConcurrency() int
+}
+
+// Supabase fetches EPUBs from the epubs bucket of a Supabase project and stores
+// the output in its readium-manifests bucket, using the service role key, or a
+// read-only key for the EPUBs (see WithReadKey)
+type Supabase struct {
+	url        string
+	serviceKey string
+	// requestID is sent as X-Request-ID with every request, so the calls can be
+	// found in the Supabase logs
+	requestID string
+	// timeouts bounds the EPUB downloads (Download) and every other request (Upload)
+	timeouts Timeouts
+	// epubBucket and manifestBucket override EPUBBucket and ManifestBucket, and
+	// prefix is prepended to every path in them, for tenants (see WithTenant)
+	epubBucket     string
+	manifestBucket string
+	prefix         string
+	// readKey, when set, is used instead of the service role key to download
+	// and list the EPUBs, so the key writing the output never reads them
+	readKey string
+	// s3, when set, transfers objects through the S3-compatible endpoint (see WithS3)
+	s3 *s3Client
+	// uploadWorkers, when set, uploads the output to signed upload URLs, that
+	// many at once (see WithSignedUploads)
+	uploadWorkers int
+}
+
+// NewSupabase returns the Storage of the Supabase project at url
+func NewSupabase(url, serviceKey string) *Supabase {
+	return &Supabase{url: url, serviceKey: serviceKey}
+}
+
+// WithRequestID returns a copy of s that tags its requests with requestID
+func (s *Supabase) WithRequestID(requestID string) *Supabase {
+	tagged := *s
+	tagged.requestID = requestID
+	return &tagged
+}
+
+// WithTimeouts returns a copy of s whose requests are bounded by timeouts
+func (s *Supabase) WithTimeouts(timeouts Timeouts) *Supabase {
+	bounded := *s
+	bounded.timeouts = timeouts
+	return &bounded
+}
+
+// WithTenant returns a copy of s that reads the EPUBs from epubBucket and
+// stores the output in manifestBucket, both under prefix, so tenants sharing a
+// project never see each other's files. Empty buckets keep the defaults.
+func (s *Supabase) WithTenant(epubBucket, manifestBucket, prefix string) *Supabase {
+	scoped := *s
+	scoped.epubBucket = epubBucket
+	scoped.manifestBucket = manifestBucket
+	scoped.prefix = prefix
+	return &scoped
+}
+
+// WithReadKey returns a copy of s that reads the EPUB bucket with readKey, a
+// key only allowed to read it, instead of the service role key. An empty key
+// keeps the service role key.
+func (s *Supabase) WithReadKey(readKey string) *Supabase {
+	scoped := *s
+	scoped.readKey = readKey
+	return &scoped
+}
+
+// keyFor returns the key to read bucket with
+func (s *Supabase) keyFor(bucket string) string {
+	if s.readKey != "" && bucket == s.epubs() {
+		return s.readKey
+	}
+	return s.serviceKey
+}
+
+// epubs returns the bucket the EPUBs are read from
+func (s *Supabase) epubs() string {
+	if s.epubBucket != "" {
+		return s.epubBucket
+	}
+	return EPUBBucket
+}
+
+// manifests returns the bucket the output is stored in
+func (s *Supabase) manifests() string {
+	if s.manifestBucket != "" {
+		return s.manifestBucket
+	}
+	return ManifestBucket
+}
+
+// client returns the HTTP client for requests other than EPUB downloads
+func (s *Supabase) client() *http.Client {
+	return NewHTTPClient(s.timeouts.Upload)
+}
+
+// Fetch downloads filename from the epubs bucket
+func (s *Supabase) Fetch(filename string, maxBytes int64) (*Source, error) {
+	if s.s3 != nil && s.readKey == "" {
+		log.Printf("Downloading EPUB from Supabase S3: %s/%s", s.epubs(), s.prefix+filename)
+		source, err := s.fetchS3(filename, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		return checkSourceFormat(source, filename)
+	}
+
+	// Using the authenticated endpoint with the service role key (not the public endpoint)
+	storageURL := storageObjectURL(s.url, "object", s.epubs(), s.prefix+filename)
+	log.Printf("Downloading EPUB from Supabase: %s", storageURL)
+	source, err := downloadEPUBFromSupabase(NewHTTPClient(s.timeouts.Download), storageURL, s.keyFor(s.epubs()), s.requestID, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return checkSourceFormat(source, filename)
+}
+
+// Stat returns the version of the EPUB stored as filename, as its ETag and
+// Last-Modified, without downloading it
+func (s *Supabase) Stat(filename string) (*SourceVersion, error) {
+	var resp *http.Response
+	if s.s3 != nil && s.readKey == "" {
+		var err error
+		resp, _, err = s.s3.send(s.client(), s3Request{method: "HEAD", bucket: s.epubs(), key: s.prefix + filename}, s.requestID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req, err := http.NewRequest("HEAD", storageObjectURL(s.url, "object", s.epubs(), s.prefix+filename), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		setStorageHeaders(req, s.keyFor(s.epubs()), s.requestID)
+		resp, err = s.client().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute request: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+			// Storage answers 400 for objects that don't exist
+			return nil, &statusError{status: 404, err: fmt.Errorf("no EPUB at %s", filename)}
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+	}
+
+	version := versionFromHeaders(resp.Header)
+	if version == nil {
+		return nil, fmt.Errorf("storage reported no ETag or Last-Modified for %s", filename)
+	}
+	return version, nil
+}
+
+// checkSourceFormat refuses PDFs, Kindle books and anything else the pipeline
+// doesn't process, closing the source
+func checkSourceFormat(source *Source, filename string) (*Source, error) {
+	if _, err := source.CheckFormat(filename); err != nil {
+		source.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// Upload uploads data to path in the manifest bucket
+func (s *Supabase) Upload(path string, data []byte, encoding string) (string, error) {
+	if s.s3 != nil {
+		return s.uploadS3(path, data, encoding)
+	}
+	if s.uploadWorkers > 0 {
+		return s.uploadSigned(path, data, encoding)
+	}
+	return uploadEncodedToSupabase(s.client(), s.prefix+path, data, encoding, s.manifests(), s.url, s.serviceKey, s.requestID)
+}
+
+// Create uploads data to path in the manifest bucket unless the object exists
+func (s *Supabase) Create(path string, data []byte) (bool, error) {
+	return createObjectInSupabase(s.client(), s.prefix+path, data, s.manifests(), s.url, s.serviceKey, s.requestID)
+}
+
+// Download downloads path from the manifest bucket
+func (s *Supabase) Download(path string) ([]byte, error) {
+	if s.s3 != nil {
+		return s.downloadS3(path)
+	}
+	return downloadFromSupabase(s.client(), s.prefix+path, s.manifests(), s.url, s.serviceKey, s.requestID)
+}
+
+// Delete deletes path from the manifest bucket
+func (s *Supabase) Delete(path string) error {
+	if s.s3 != nil {
+		return s.deleteS3(path)
+	}
+	return deleteFromSupabase(s.client(), s.prefix+path, s.manifests(), s.url, s.serviceKey, s.requestID)
+}
+
+// PublicURL returns the public URL of path in the manifest bucket
+func (s *Supabase) PublicURL(path string) string {
+	return publicObjectURL(s.url, s.manifests(), s.prefix+path)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Path string
+	Size int64
+	// ContentType is the stored type, or the one implied by the path for
+	// objects stored without one
+	ContentType string
+}
+
+// List returns every object under prefix in bucket, walking into folders. An
+// empty prefix lists the whole bucket.
+func (s *Supabase) List(bucket, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	folders := []string{strings.Trim(prefix, "/")}
+	for len(folders) > 0 {
+		folder := folders[0]
+		folders = folders[1:]
+		for offset := 0; ; offset += listPageSize {
+			entries, err := listFolderInSupabase(s.client(), folder, offset, bucket, s.url, s.keyFor(bucket), s.requestID)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				entryPath := entry.Name
+				if folder != "" {
+					entryPath = folder + "/" + entry.Name
+				}
+				// Folders are listed without an ID
+				if entry.ID == nil {
+					folders = append(folders, entryPath)
+					continue
+				}
+				contentType := entry.Metadata.Mimetype
+				if contentType == "" {
+					contentType = getContentType(entryPath)
+				}
+				objects = append(objects, ObjectInfo{Path: entryPath, Size: entry.Metadata.Size, ContentType: contentType})
+			}
+			if len(entries) < listPageSize {
+				break
+			}
+		}
+	}
+	return objects, nil
+}
+
+// DeleteObjects deletes paths from bucket in batches
+func (s *Supabase) DeleteObjects(bucket string, paths []string) error {
+	for start := 0; start < len(paths); start += listPageSize {
+		end := min(start+listPageSize, len(paths))
+		if err := deleteObjectsFromSupabase(s.client(), paths[start:end], bucket, s.url, s.serviceKey, s.requestID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkInsertBatchSize is the number of chunks inserted per request, as each
+// carries a vector of a few thousand numbers
+const chunkInsertBatchSize = 100
+
+// ReplaceChunks deletes the chunks of the publication at basePath from table
+// and inserts chunks, through the REST API of the Supabase database
+func (s *Supabase) ReplaceChunks(table, basePath string, chunks []EmbeddedChunk) error {
+	tableURL := fmt.Sprintf("%s/rest/v1/%s", strings.TrimSuffix(s.url, "/"), table)
+	// Tenants sharing a table are told apart by their prefix
+	publication := s.prefix + basePath
+	filter := neturl.Values{"publication": {"eq." + publication}}
+	if err := restRequest(s.client(), "DELETE", tableURL+"?"+filter.Encode(), nil, s.serviceKey, s.requestID); err != nil {
+		return fmt.Errorf("failed to delete previous chunks: %w", err)
+	}
+	for start := 0; start < len(chunks); start += chunkInsertBatchSize {
+		batch := append([]EmbeddedChunk(nil), chunks[start:min(start+chunkInsertBatchSize, len(chunks))]...)
+		for i := range batch {
+			batch[i].Publication = publication
+		}
+		if err := restRequest(s.client(), "POST", tableURL, batch, s.serviceKey, s.requestID); err != nil {
+			return fmt.Errorf("failed to insert chunks: %w", err)
+		}
+	}
+	return nil
+}
+
+// restRequest sends a request to the REST API of a Supabase database, with
+// body encoded as JSON unless nil
+func restRequest(client *http.Client, method, requestURL string, body interface{}, serviceKey, requestID string) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, requestURL, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	setStorageHeaders(req, serviceKey, requestID)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// downloadEPUBFromSupabase downloads an EPUB to a temporary file, refusing files larger
+// than maxBytes. A HEAD request is issued first so oversized files are rejected without
+// downloading them. The caller must Close the returned source.
+func downloadEPUBFromSupabase(client *http.Client, storageURL, serviceKey, requestID string, maxBytes int64) (*Source, error) {
+	// Pre-flight size check. Not every storage backend answers HEAD, so a failure
+	// here is not fatal - the Content-Length of the GET is checked below as well.
+	if size, err := headContentLength(client, storageURL, serviceKey, requestID); err != nil {
+		log.Printf("Warning: HEAD request failed, skipping pre-flight size check: %v", err)
+	} else if maxBytes > 0 && size > maxBytes {
+		return nil, EPUBTooLargeError(size, maxBytes)
+	}
+
+	// Create request
+	req, err := http.NewRequest("GET", storageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set Supabase authentication headers
+	setStorageHeaders(req, serviceKey, requestID)
+
+	// Execute request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check status code
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, EPUBTooLargeError(resp.ContentLength, maxBytes)
+	}
+
+	// Stream the response body to disk
+	source, err := SpoolEPUB(resp.Body, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	source.version = versionFromHeaders(resp.Header)
+
+	return source, nil
+}
+
+// setStorageHeaders sets the service key authentication headers of a Storage
+// request, and the X-Request-ID that correlates it with the invocation
+func setStorageHeaders(req *http.Request, serviceKey, requestID string) {
+	req.Header.Set("apikey", serviceKey)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", serviceKey))
+	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
+	if requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+}
+
+// headContentLength returns the size of the object at storageURL using a HEAD request
+func headContentLength(client *http.Client, storageURL, serviceKey, requestID string) (int64, error) {
+	req, err := http.NewRequest("HEAD", storageURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	setStorageHeaders(req, serviceKey, requestID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute request: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("response has no Content-Length")
+	}
+	return resp.ContentLength, nil
+}
+
+// uploadEncodedToSupabase uploads data stored with a Content-Encoding (e.g. gzip),
+// which Storage serves back so clients decompress it transparently. An empty
+// encoding uploads the data as is.
+func uploadEncodedToSupabase(client *http.Client, path string, data []byte, encoding, bucket, supabaseURL, serviceKey, requestID string) (string, error) {
+	// Construct upload URL
+	uploadURL := storageObjectURL(supabaseURL, "object", bucket, path)
+
+	// Create request
+	req, err := http.NewRequest("POST", uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set Supabase authentication headers
+	setStorageHeaders(req, serviceKey, requestID)
+	for name, value := range objectHeaders(path, encoding) {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("x-upsert", "true") // Upsert to allow overwriting
+
+	// Execute request
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Check status code (Supabase returns 200 for successful uploads)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	return publicObjectURL(supabaseURL, bucket, path), nil
+}
+
+// objectHeaders returns the headers an object is stored with: its content type,
+// determined from the file extension, and encoding
+func objectHeaders(path, encoding string) map[string]string {
+	headers := map[string]string{"Content-Type": getContentType(path)}
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	// Set Content-Disposition to inline for JSON files so browsers display them instead of downloading
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		headers["Content-Disposition"] = "inline"
+	}
+	return headers
+}
+
+// publicObjectURL returns the public URL of an object in a Supabase storage bucket
+func publicObjectURL(supabaseURL, bucket, path string) string {
+	return storageObjectURL(supabaseURL, "object/public", bucket, path)
+}
+
+// deleteFromSupabase deletes an object from a Supabase storage bucket
+func deleteFromSupabase(client *http.Client, path, bucket, supabaseURL, serviceKey, requestID string) error {
+	deleteURL := storageObjectURL(supabaseURL, "object", bucket, path)
+
+	req, err := http.NewRequest("DELETE", deleteURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	setStorageHeaders(req, serviceKey, requestID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// listPageSize is the number of entries requested per list call, and the number
+// of objects deleted per bulk delete
+const listPageSize = 1000
+
+// storageListEntry is an entry of a Storage list response
+type storageListEntry struct {
+	Name     string  `json:"name"`
+	ID       *string `json:"id"`
+	Metadata struct {
+		Size     int64  `json:"size"`
+		Mimetype string `json:"mimetype"`
+	} `json:"metadata"`
+}
+
+// listFolderInSupabase lists one page of the direct children of folder in a Supabase storage bucket
+func listFolderInSupabase(client *http.Client, folder string, offset int, bucket, supabaseURL, serviceKey, requestID string) ([]storageListEntry, error) {
+	listURL := fmt.Sprintf("%s/storage/v1/object/list/%s", strings.TrimSuffix(supabaseURL, "/"), bucket)
+	body, err := json.Marshal(map[string]interface{}{
+		"prefix": folder,
+		"limit":  listPageSize,
+		"offset": offset,
+		"sortBy": map[string]string{"column": "name", "order": "asc"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal list request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", listURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	setStorageHeaders(req, serviceKey, requestID)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	var entries []storageListEntry
+	if err := json.Unmarshal(bodyBytes, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse list response: %w", err)
+	}
+	return entries, nil
+}
+
+// deleteObjectsFromSupabase deletes several objects from a Supabase storage bucket in one request
+func deleteObjectsFromSupabase(client *http.Client, paths []string, bucket, supabaseURL, serviceKey, requestID string) error {
+	deleteURL := fmt.Sprintf("%s/storage/v1/object/%s", strings.TrimSuffix(supabaseURL, "/"), bucket)
+	body, err := json.Marshal(map[string][]string{"prefixes": paths})
+	if err != nil {
+		return fmt.Errorf("failed to marshal delete request: %w", err)
+	}
+
+	req, err := http.NewRequest("DELETE", deleteURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	setStorageHeaders(req, serviceKey, requestID)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// downloadFromSupabase downloads an object from a Supabase storage bucket using the service key
+func downloadFromSupabase(client *http.Client, path, bucket, supabaseURL, serviceKey, requestID string) ([]byte, error) {
+	downloadURL := storageObjectURL(supabaseURL, "object", bucket, path)
+
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	setStorageHeaders(req, serviceKey, requestID)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// createObjectInSupabase uploads data only if no object exists at path yet.
+// Returns false (and no error) if the object already exists.
+func createObjectInSupabase(client *http.Client, path string, data []byte, bucket, supabaseURL, serviceKey, requestID string) (bool, error) {
+	uploadURL := storageObjectURL(supabaseURL, "object", bucket, path)
+
+	req, err := http.NewRequest("POST", uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// No x-upsert header: Supabase rejects the upload if the object exists
+	setStorageHeaders(req, serviceKey, requestID)
+	req.Header.Set("Content-Type", getContentType(path))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		return true, nil
+	}
+
+	// Depending on the Storage API version a duplicate is reported as a 409, or
+	// as a 400 whose body carries statusCode "409" / error "Duplicate"
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict || strings.Contains(string(bodyBytes), "Duplicate") || strings.Contains(string(bodyBytes), `"409"`) {
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+}
@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+// Subject schemes written to the manifest for the classification codes we recognize
+const (
+	subjectSchemeBISAC = "BISAC"
+	subjectSchemeTHEMA = "THEMA"
+)
+
+// subjectSchemeAliases maps the authority values found in the wild to a scheme
+var subjectSchemeAliases = map[string]string{
+	"bisac":      subjectSchemeBISAC,
+	"bisacsh":    subjectSchemeBISAC,
+	"bisg":       subjectSchemeBISAC,
+	"thema":      subjectSchemeTHEMA,
+	"themacodes": subjectSchemeTHEMA,
+}
+
+// bisacCode matches a BISAC subject code, optionally followed by its heading
+// (e.g. "FIC009000" or "FIC009000 - FICTION / Fantasy / General")
+var bisacCode = regexp.MustCompile(`^([A-Z]{3}[0-9]{6})(?:\s*[-:–]?\s*(.*))?$`)
+
+// addSubjectsFromOPF completes metadata.subject with the classification codes
+// of the dc:subject elements: EPUB 3 authority/term refinements, EPUB 2
+// opf:authority/opf:term attributes and bare BISAC codes. Subjects the parser
+// already read get their scheme and code filled in; coded subjects it dropped
+// are added.
+func addSubjectsFromOPF(metadata *manifest.Metadata, pkg *epubPackage) {
+	refinements := pkg.refinements()
+	for _, e := range pkg.metaElements("subject") {
+		name := strings.TrimSpace(e.Value)
+		scheme, code := e.attr("authority"), e.attr("term")
+		if refined := refinements[e.attr("id")]; refined != nil {
+			if refined["authority"] != "" {
+				scheme, code = refined["authority"], refined["term"]
+			}
+		}
+		subject := classifySubject(manifest.Subject{
+			LocalizedName: manifest.NewLocalizedStringFromString(name),
+			Scheme:        subjectScheme(scheme),
+			Code:          strings.TrimSpace(code),
+		})
+		if subject.Code == "" || name == "" {
+			continue
+		}
+
+		if existing := findSubject(metadata.Subjects, name, subject.LocalizedName.String()); existing != nil {
+			if existing.Code == "" {
+				existing.Scheme, existing.Code = subject.Scheme, subject.Code
+				if subject.LocalizedName.String() != name {
+					existing.LocalizedName = subject.LocalizedName
+				}
+			}
+			continue
+		}
+		metadata.Subjects = append(metadata.Subjects, subject)
+	}
+
+	for i := range metadata.Subjects {
+		metadata.Subjects[i] = classifySubject(metadata.Subjects[i])
+	}
+}
+
+// classifySubject recognizes a BISAC code used as the subject name, moving it
+// to the code and keeping the heading, if any, as the name
+func classifySubject(subject manifest.Subject) manifest.Subject {
+	if subject.Code != "" {
+		return subject
+	}
+	match := bisacCode.FindStringSubmatch(strings.TrimSpace(subject.LocalizedName.String()))
+	if match == nil {
+		return subject
+	}
+	subject.Scheme, subject.Code = subjectSchemeBISAC, match[1]
+	if heading := strings.TrimSpace(match[2]); heading != "" {
+		subject.LocalizedName = manifest.NewLocalizedStringFromString(heading)
+	}
+	return subject
+}
+
+// subjectScheme returns the canonical scheme for an authority, or the authority
+// itself when it isn't one we know
+func subjectScheme(authority string) string {
+	authority = strings.TrimSpace(authority)
+	if scheme, ok := subjectSchemeAliases[strings.ToLower(authority)]; ok {
+		return scheme
+	}
+	return authority
+}
+
+// findSubject returns the subject with one of the given names, ignoring case
+func findSubject(subjects []manifest.Subject, names ...string) *manifest.Subject {
+	for i := range subjects {
+		for _, name := range names {
+			if strings.EqualFold(strings.TrimSpace(subjects[i].LocalizedName.String()), name) {
+				return &subjects[i]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestAddSubjectsFromOPF(t *testing.T) {
+	pkg, err := openEPUBPackage(buildEPUB(t, map[string]string{
+		containerPath: validContainer,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:opf="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:subject id="s1">FICTION / Fantasy / Epic</dc:subject>
+    <meta refines="#s1" property="authority">BISAC</meta>
+    <meta refines="#s1" property="term">FIC009020</meta>
+    <dc:subject id="s2">Fantasy</dc:subject>
+    <meta refines="#s2" property="authority">thema</meta>
+    <meta refines="#s2" property="term">FMB</meta>
+    <dc:subject opf:authority="BISAC" opf:term="FIC028000">Science Fiction</dc:subject>
+    <dc:subject>Dragons</dc:subject>
+  </metadata>
+</package>`,
+	}))
+	if err != nil {
+		t.Fatalf("Failed to open package: %v", err)
+	}
+
+	metadata := manifest.Metadata{Subjects: []manifest.Subject{
+		{LocalizedName: manifest.NewLocalizedStringFromString("Fantasy")},
+		{LocalizedName: manifest.NewLocalizedStringFromString("Dragons")},
+		{LocalizedName: manifest.NewLocalizedStringFromString("FIC002000 - FICTION / Action & Adventure")},
+	}}
+	addSubjectsFromOPF(&metadata, pkg)
+
+	expected := []struct{ name, scheme, code string }{
+		{"Fantasy", "THEMA", "FMB"},
+		{"Dragons", "", ""},
+		{"FICTION / Action & Adventure", "BISAC", "FIC002000"},
+		{"FICTION / Fantasy / Epic", "BISAC", "FIC009020"},
+		{"Science Fiction", "BISAC", "FIC028000"},
+	}
+	if len(metadata.Subjects) != len(expected) {
+		t.Fatalf("Expected %d subjects, got %+v", len(expected), metadata.Subjects)
+	}
+	for i, e := range expected {
+		s := metadata.Subjects[i]
+		if s.LocalizedName.String() != e.name || s.Scheme != e.scheme || s.Code != e.code {
+			t.Errorf("Expected subject %d to be %s (%s %s), got %s (%s %s)", i, e.name, e.scheme, e.code, s.LocalizedName.String(), s.Scheme, s.Code)
+		}
+	}
+}
+
+func TestClassifySubject(t *testing.T) {
+	tests := []struct {
+		name, expectedName, expectedCode string
+	}{
+		{"FIC009000", "FIC009000", "FIC009000"},
+		{"JUV001000: JUVENILE FICTION / Action & Adventure", "JUVENILE FICTION / Action & Adventure", "JUV001000"},
+		{"Fiction", "Fiction", ""},
+		{"fic009000", "fic009000", ""},
+	}
+	for _, tt := range tests {
+		s := classifySubject(manifest.Subject{LocalizedName: manifest.NewLocalizedStringFromString(tt.name)})
+		if s.LocalizedName.String() != tt.expectedName || s.Code != tt.expectedCode {
+			t.Errorf("Expected %q to give %q (%q), got %q (%q)", tt.name, tt.expectedName, tt.expectedCode, s.LocalizedName.String(), s.Code)
+		}
+	}
+}
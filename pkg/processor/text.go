@@ -0,0 +1,171 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/pub"
+)
+
+// textCollectionRole is the manifest collection listing the chapter text sidecars
+const textCollectionRole = "x-text"
+
+// chapterText is the plain text of a reading order item, uploaded as its sidecar
+type chapterText struct {
+	Href      string `json:"href"`
+	Title     string `json:"title,omitempty"`
+	WordCount int    `json:"wordCount"`
+	Text      string `json:"text"`
+
+	source string // href in the publication
+}
+
+// Elements whose content is not part of the readable text
+var skippedTextElements = map[string]bool{
+	"head": true, "script": true, "style": true, "template": true, "rt": true, "rp": true,
+}
+
+// Elements that start a new paragraph in the extracted text
+var blockTextElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "figcaption": true, "figure": true,
+	"footer": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "main": true, "nav": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "td": true, "th": true, "tr": true, "ul": true,
+}
+
+// extractPlainText returns the readable text of an XHTML document, one paragraph
+// per block element, separated by blank lines. Whitespace inside a paragraph is
+// collapsed. On malformed markup the text read so far is returned with the error.
+func extractPlainText(content []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var paragraphs []string
+	var current strings.Builder
+	skipDepth := 0
+	flush := func() {
+		if text := strings.Join(strings.Fields(current.String()), " "); text != "" {
+			paragraphs = append(paragraphs, text)
+		}
+		current.Reset()
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			flush()
+			return strings.Join(paragraphs, "\n\n"), err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 || skippedTextElements[name] {
+				skipDepth++
+			} else if blockTextElements[name] {
+				flush()
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 {
+				skipDepth--
+			} else if blockTextElements[name] {
+				flush()
+			}
+		case xml.CharData:
+			if skipDepth == 0 {
+				current.Write(t)
+			}
+		}
+	}
+	flush()
+	return strings.Join(paragraphs, "\n\n"), nil
+}
+
+// chapterTextPath returns the storage path, relative to basePath, of the text
+// sidecar for a reading order item: text/ followed by the resource path without
+// its extension, so chapters with the same file name in different folders don't clash
+func chapterTextPath(href string) string {
+	key := resourceKey(href)
+	return "text/" + strings.TrimSuffix(key, path.Ext(key)) + ".json"
+}
+
+// readChapterTexts extracts the plain text of every XHTML reading order item
+func readChapterTexts(publication *pub.Publication, m *manifest.Manifest) []chapterText {
+	ctx := context.Background()
+	chapters := make([]chapterText, 0, len(m.ReadingOrder))
+
+	for i := range m.ReadingOrder {
+		link := &m.ReadingOrder[i]
+		if !isHTMLResource(link) {
+			continue
+		}
+		hrefStr := link.Href.String()
+
+		resource := publication.Get(ctx, *link)
+		content, resErr := resource.Read(ctx, 0, 0)
+		resource.Close()
+		if resErr != nil {
+			log.Printf("Warning: failed to read %s for text extraction: %v", hrefStr, resErr)
+			continue
+		}
+
+		text, err := extractPlainText(content)
+		if err != nil {
+			log.Printf("Warning: text of %s may be incomplete: %v", hrefStr, err)
+		}
+
+		chapters = append(chapters, chapterText{
+			Href:      manifestHref(hrefStr),
+			Title:     link.Title,
+			WordCount: countWords(text),
+			Text:      text,
+			source:    hrefStr,
+		})
+	}
+
+	return chapters
+}
+
+// uploadChapterTexts uploads each chapter's text to {basePath}/text/{chapter}.json
+// and returns the links for the manifest's text collection
+func uploadChapterTexts(chapters []chapterText, basePath string, uploader Uploader, delta *deltaUploader) ([]map[string]interface{}, error) {
+	collection := make([]map[string]interface{}, 0, len(chapters))
+
+	for _, chapter := range chapters {
+		data, err := json.Marshal(chapter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal text of %s: %w", chapter.source, err)
+		}
+
+		textPath := chapterTextPath(chapter.source)
+		if _, err := delta.upload(fmt.Sprintf("%s/%s", basePath, textPath), data); err != nil {
+			return nil, fmt.Errorf("failed to upload text of %s: %w", chapter.source, err)
+		}
+
+		item := map[string]interface{}{
+			"href":       escapeStoragePath(textPath),
+			"type":       "application/json",
+			"properties": map[string]interface{}{"source": chapter.Href},
+		}
+		if chapter.Title != "" {
+			item["title"] = chapter.Title
+		}
+		collection = append(collection, item)
+	}
+
+	return collection, nil
+}
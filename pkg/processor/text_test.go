@@ -0,0 +1,38 @@
+package processor
+
+import "testing"
+
+func TestExtractPlainText(t *testing.T) {
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Ignored</title><style>p { color: red }</style></head>
+<body>
+<h1>Chapter   One</h1>
+<p>It was a <em>dark</em>ly <b>and</b>
+stormy night&nbsp;&mdash; or so they said.</p>
+<script>var x = "not text";</script>
+<p>Line one<br/>line two</p>
+<p><ruby>漢<rt>kan</rt></ruby>字</p>
+</body></html>`
+
+	got, err := extractPlainText([]byte(doc))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := "Chapter One\n\nIt was a darkly and stormy night — or so they said.\n\nLine one\n\nline two\n\n漢字"
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestChapterTextPath(t *testing.T) {
+	tests := map[string]string{
+		"/OEBPS/Text/ch01.xhtml":      "text/OEBPS/Text/ch01.json",
+		"OEBPS/Text/chapter%202.html": "text/OEBPS/Text/chapter 2.json",
+		"index":                       "text/index.json",
+	}
+	for href, want := range tests {
+		if got := chapterTextPath(href); got != want {
+			t.Errorf("chapterTextPath(%q) = %q, want %q", href, got, want)
+		}
+	}
+}
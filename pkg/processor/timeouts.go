@@ -0,0 +1,102 @@
+package processor
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	downloadTimeoutEnvVar   = "DOWNLOAD_TIMEOUT_SECONDS"
+	parseTimeoutEnvVar      = "PARSE_TIMEOUT_SECONDS"
+	uploadTimeoutEnvVar     = "UPLOAD_TIMEOUT_SECONDS"
+	processingTimeoutEnvVar = "PROCESSING_TIMEOUT_SECONDS"
+
+	// The defaults when there is no invocation deadline to derive them from
+	defaultDownloadTimeout = 5 * time.Minute
+	defaultParseTimeout    = 2 * time.Minute
+	defaultUploadTimeout   = time.Minute
+	// deadlineMargin is kept from the invocation deadline, so a job that runs
+	// out of time is reported before Lambda kills the invocation
+	deadlineMargin = 10 * time.Second
+)
+
+// Timeouts bounds the phases of a job, so that a single hung request can't use
+// up the whole invocation. A zero duration leaves its phase unbounded.
+type Timeouts struct {
+	// Download bounds downloading the EPUB
+	Download time.Duration
+	// Parse bounds parsing the EPUB
+	Parse time.Duration
+	// Upload bounds each Storage request
+	Upload time.Duration
+	// Total bounds the whole job
+	Total time.Duration
+}
+
+// TimeoutsFromEnv reads the timeouts from the DOWNLOAD_, PARSE_, UPLOAD_ and
+// PROCESSING_TIMEOUT_SECONDS env vars. Their defaults derive from deadline, the
+// end of the invocation (zero outside Lambda): the job gets what is left of it
+// minus a margin to report the timeout, and no phase gets more than a third of
+// that. None of the timeouts outlasts the job.
+func TimeoutsFromEnv(deadline time.Time) Timeouts {
+	t := Timeouts{Download: defaultDownloadTimeout, Parse: defaultParseTimeout, Upload: defaultUploadTimeout}
+	if !deadline.IsZero() {
+		t.Total = max(time.Until(deadline)-deadlineMargin, time.Second)
+		t.Download = min(t.Download, t.Total/3)
+		t.Parse = min(t.Parse, t.Total/3)
+		t.Upload = min(t.Upload, t.Total/3)
+	}
+
+	for name, timeout := range map[string]*time.Duration{
+		downloadTimeoutEnvVar:   &t.Download,
+		parseTimeoutEnvVar:      &t.Parse,
+		uploadTimeoutEnvVar:     &t.Upload,
+		processingTimeoutEnvVar: &t.Total,
+	} {
+		if seconds, ok := envUint(name); ok {
+			*timeout = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if t.Total > 0 {
+		for _, timeout := range []*time.Duration{&t.Download, &t.Parse, &t.Upload} {
+			if *timeout == 0 || *timeout > t.Total {
+				*timeout = t.Total
+			}
+		}
+	}
+	return t
+}
+
+// timeoutError reports a phase that ran out of time, with status 504
+func timeoutError(phase string, timeout time.Duration) error {
+	return &statusError{status: 504, err: fmt.Errorf("%s timed out after %s", phase, timeout)}
+}
+
+// runWithTimeout runs f, giving up on it after timeout (0 waits for it however
+// long it takes). f keeps running in the background when it is given up on, so
+// it must not touch anything the caller still uses.
+func runWithTimeout[T any](phase string, timeout time.Duration, f func() (T, error)) (T, error) {
+	if timeout <= 0 {
+		return f()
+	}
+	type outcome struct {
+		value T
+		err   error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		value, err := f()
+		done <- outcome{value, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.value, o.err
+	case <-timer.C:
+		var zero T
+		return zero, timeoutError(phase, timeout)
+	}
+}
@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+func TestTimeoutsFromEnv(t *testing.T) {
+	timeouts := TimeoutsFromEnv(time.Time{})
+	if timeouts != (Timeouts{Download: defaultDownloadTimeout, Parse: defaultParseTimeout, Upload: defaultUploadTimeout}) {
+		t.Errorf("Expected the defaults without a deadline, got %+v", timeouts)
+	}
+
+	// A 15 minute invocation
+	timeouts = TimeoutsFromEnv(time.Now().Add(15 * time.Minute))
+	if timeouts.Total <= 14*time.Minute || timeouts.Total > 15*time.Minute-deadlineMargin {
+		t.Errorf("Expected the job to get the invocation minus the margin, got %s", timeouts.Total)
+	}
+	if timeouts.Download != timeouts.Total/3 || timeouts.Parse != defaultParseTimeout || timeouts.Upload != defaultUploadTimeout {
+		t.Errorf("Expected the download to get a third of the job and the other defaults to fit, got %+v", timeouts)
+	}
+
+	// A 1 minute invocation leaves each phase a third of the 50 seconds left
+	timeouts = TimeoutsFromEnv(time.Now().Add(time.Minute))
+	if timeouts.Download > 17*time.Second || timeouts.Parse > 17*time.Second || timeouts.Upload > 17*time.Second {
+		t.Errorf("Expected the phases to be shortened to fit the invocation, got %+v", timeouts)
+	}
+
+	t.Setenv(parseTimeoutEnvVar, "30")
+	t.Setenv(uploadTimeoutEnvVar, "0")
+	t.Setenv(processingTimeoutEnvVar, "20")
+	timeouts = TimeoutsFromEnv(time.Time{})
+	if timeouts.Total != 20*time.Second || timeouts.Parse != 20*time.Second || timeouts.Upload != 20*time.Second {
+		t.Errorf("Expected the env vars to win, and no phase to outlast the job, got %+v", timeouts)
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	value, err := runWithTimeout("parsing", time.Second, func() (int, error) { return 42, nil })
+	if err != nil || value != 42 {
+		t.Errorf("Expected the result, got %d (%v)", value, err)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	_, err = runWithTimeout("parsing", 10*time.Millisecond, func() (int, error) {
+		<-release
+		return 0, nil
+	})
+	if StatusCode(err) != 504 {
+		t.Errorf("Expected a 504 once the timeout elapses, got %v", err)
+	}
+}
+
+func TestDeltaUploader_Deadline(t *testing.T) {
+	fake := processortest.NewSupabase()
+	defer fake.Close()
+	delta := newDeltaUploader("books_moby", NewSupabase(fake.URL, processortest.ServiceKey), true)
+	if _, err := delta.upload("books_moby/chapter1.xhtml", []byte("<html/>")); err != nil {
+		t.Fatalf("Expected an upload before the deadline, got %v", err)
+	}
+
+	delta.deadline = time.Now().Add(-time.Second)
+	if _, err := delta.upload("books_moby/chapter2.xhtml", []byte("<html/>")); StatusCode(err) != 504 {
+		t.Errorf("Expected a 504 after the deadline, got %v", err)
+	}
+	if _, ok := fake.Object(ManifestBucket, "books_moby/chapter2.xhtml"); ok {
+		t.Error("Expected nothing to be stored after the deadline")
+	}
+}
+
+func TestSupabase_WithTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	store := NewSupabase(server.URL, "test-key").WithTimeouts(Timeouts{Upload: 20 * time.Millisecond})
+	start := time.Now()
+	if _, err := store.Upload("book/chapter1.xhtml", []byte("<html/>"), ""); err == nil {
+		t.Error("Expected a hung upload to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the upload to give up after its timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,167 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/pub"
+)
+
+// flatTOCCollectionRole is the manifest collection holding the flattened table
+// of contents, for clients that can't handle nested children
+const flatTOCCollectionRole = "x-toc-flat"
+
+// tocPath is where the standalone table of contents is stored, relative to basePath
+const tocPath = "toc.json"
+
+// validateTOCDepth checks the toc_depth option; 0 keeps every level
+func validateTOCDepth(depth int) error {
+	if depth < 0 {
+		return fmt.Errorf("toc_depth must be positive, got %d", depth)
+	}
+	return nil
+}
+
+// limitTOCDepth returns the table of contents without the entries nested deeper
+// than depth levels. A depth of 0 keeps every level.
+func limitTOCDepth(toc manifest.LinkList, depth int) manifest.LinkList {
+	if depth <= 0 || len(toc) == 0 {
+		return toc
+	}
+	limited := make(manifest.LinkList, len(toc))
+	for i, link := range toc {
+		limited[i] = link
+		if depth == 1 {
+			limited[i].Children = nil
+		} else {
+			limited[i].Children = limitTOCDepth(link.Children, depth-1)
+		}
+	}
+	return limited
+}
+
+// flattenTOC lists the entries of a table of contents in reading order, each
+// with its nesting level (1 for the top level) in its properties
+func flattenTOC(toc manifest.LinkList) []map[string]interface{} {
+	flat := []map[string]interface{}{}
+	var walk func(links manifest.LinkList, level int)
+	walk = func(links manifest.LinkList, level int) {
+		for _, link := range links {
+			item := map[string]interface{}{
+				"href":       manifestHref(link.Href.String()),
+				"properties": map[string]interface{}{"level": level},
+			}
+			if link.Title != "" {
+				item["title"] = link.Title
+			}
+			flat = append(flat, item)
+			walk(link.Children, level+1)
+		}
+	}
+	walk(toc, 1)
+	return flat
+}
+
+// generateTOCJSON returns the table of contents as a document of its own, for
+// clients that only need the navigation, or nil when there is none. Its hrefs
+// are relative to basePath, like those of the manifest.
+func generateTOCJSON(toc manifest.LinkList, resourceMap map[string]string, basePath string, uploader Uploader) ([]byte, error) {
+	if len(toc) == 0 {
+		return nil, nil
+	}
+	items := make([]map[string]interface{}, 0, len(toc))
+	for _, link := range toc {
+		items = append(items, convertTOCLink(link, resourceMap, basePath, uploader))
+	}
+	data, err := canonicalJSON(map[string]interface{}{"toc": items})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode table of contents: %w", err)
+	}
+	return data, nil
+}
+
+// headingElements are the elements a chapter title is taken from
+var headingElements = map[string]bool{"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true}
+
+// synthesizeTOC builds a table of contents for an EPUB whose navigation document
+// and NCX yield none: one entry per content document of the reading order,
+// titled by its reading order title, its first heading or its <title>.
+// Documents with none of those, such as cover pages, are left out.
+func synthesizeTOC(publication *pub.Publication, m *manifest.Manifest) manifest.LinkList {
+	ctx := context.Background()
+	var toc manifest.LinkList
+
+	for i := range m.ReadingOrder {
+		link := m.ReadingOrder[i]
+		if !isHTMLResource(&link) {
+			continue
+		}
+		title := link.Title
+		if title == "" {
+			resource := publication.Get(ctx, link)
+			content, resErr := resource.Read(ctx, 0, 0)
+			resource.Close()
+			if resErr != nil {
+				log.Printf("Warning: failed to read %s for its title: %v", link.Href.String(), resErr)
+				continue
+			}
+			title = chapterHeading(content)
+		}
+		if title == "" {
+			continue
+		}
+		toc = append(toc, manifest.Link{Href: link.Href, MediaType: link.MediaType, Title: title})
+	}
+	return toc
+}
+
+// chapterHeading returns the text of the first heading of a content document,
+// or of its <title> when it has no heading
+func chapterHeading(content []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var title, text strings.Builder
+	inTitle, depth := false, 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			switch {
+			case depth > 0 || headingElements[name]:
+				depth++
+			case name == "title":
+				inTitle = true
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				if depth--; depth == 0 {
+					if heading := strings.Join(strings.Fields(text.String()), " "); heading != "" {
+						return heading
+					}
+					text.Reset()
+				}
+			} else if strings.EqualFold(t.Name.Local, "title") {
+				inTitle = false
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+			} else if inTitle {
+				title.Write(t)
+			}
+		}
+	}
+	return strings.Join(strings.Fields(title.String()), " ")
+}
@@ -0,0 +1,104 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func testTOC(t *testing.T) manifest.LinkList {
+	part := testLink(t, "OEBPS/part1.xhtml")
+	part.Title = "Part I"
+	chapter := testLink(t, "OEBPS/chapter1.xhtml")
+	chapter.Title = "Chapter 1"
+	section := testLink(t, "OEBPS/chapter1.xhtml#s1")
+	section.Title = "Section 1.1"
+	chapter.Children = manifest.LinkList{section}
+	part.Children = manifest.LinkList{chapter}
+	appendix := testLink(t, "OEBPS/appendix.xhtml")
+	return manifest.LinkList{part, appendix}
+}
+
+func TestLimitTOCDepth(t *testing.T) {
+	toc := testTOC(t)
+	limited := limitTOCDepth(toc, 2)
+	if len(limited) != 2 || len(limited[0].Children) != 1 || len(limited[0].Children[0].Children) != 0 {
+		t.Errorf("Expected two levels, got %+v", limited)
+	}
+	if len(toc[0].Children[0].Children) != 1 {
+		t.Error("Expected the original table of contents to be left alone")
+	}
+	if flat := limitTOCDepth(toc, 1); len(flat[0].Children) != 0 {
+		t.Errorf("Expected the top level only, got %+v", flat)
+	}
+	if all := limitTOCDepth(toc, 0); len(all[0].Children[0].Children) != 1 {
+		t.Errorf("Expected every level with a depth of 0, got %+v", all)
+	}
+}
+
+func TestFlattenTOC(t *testing.T) {
+	flat := flattenTOC(testTOC(t))
+	want := []struct {
+		href  string
+		level int
+	}{
+		{"OEBPS/part1.xhtml", 1},
+		{"OEBPS/chapter1.xhtml", 2},
+		{"OEBPS/chapter1.xhtml#s1", 3},
+		{"OEBPS/appendix.xhtml", 1},
+	}
+	if len(flat) != len(want) {
+		t.Fatalf("Expected %d entries, got %+v", len(want), flat)
+	}
+	for i, w := range want {
+		level := flat[i]["properties"].(map[string]interface{})["level"]
+		if flat[i]["href"] != w.href || level != w.level {
+			t.Errorf("Entry %d: expected %s at level %d, got %v", i, w.href, w.level, flat[i])
+		}
+	}
+	if _, ok := flat[3]["title"]; ok {
+		t.Errorf("Expected no title for an untitled entry, got %v", flat[3])
+	}
+}
+
+func TestGenerateTOCJSON(t *testing.T) {
+	data, err := generateTOCJSON(testTOC(t), nil, "books/b1", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var doc struct {
+		TOC []struct {
+			Href     string `json:"href"`
+			Title    string `json:"title"`
+			Children []struct {
+				Href string `json:"href"`
+			} `json:"children"`
+		} `json:"toc"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	if len(doc.TOC) != 2 || doc.TOC[0].Href != "OEBPS/part1.xhtml" || doc.TOC[0].Title != "Part I" {
+		t.Fatalf("Expected the top-level entries, got %+v", doc.TOC)
+	}
+	if len(doc.TOC[0].Children) != 1 || doc.TOC[0].Children[0].Href != "OEBPS/chapter1.xhtml" {
+		t.Errorf("Expected the nested entries, got %+v", doc.TOC[0].Children)
+	}
+
+	if data, err := generateTOCJSON(nil, nil, "books/b1", nil); data != nil || err != nil {
+		t.Errorf("Expected nothing for an empty table of contents, got %s, %v", data, err)
+	}
+}
+
+func TestChapterHeading(t *testing.T) {
+	for content, want := range map[string]string{
+		`<html><head><title>Moby-Dick</title></head><body><h2 class="ch">Chapter 1.<br/>  Loomings</h2><h3>Later</h3></body></html>`: "Chapter 1. Loomings",
+		`<html><head><title> Moby-Dick </title></head><body><h1><img src="ornament.png"/></h1><p>Call me Ishmael.</p></body></html>`: "Moby-Dick",
+		`<html><body><p>Call me Ishmael.</p></body></html>`:                                                                          "",
+	} {
+		if got := chapterHeading([]byte(content)); got != want {
+			t.Errorf("Expected %q for %s, got %q", want, content, got)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package processor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+)
+
+// ResourceTransformer rewrites a publication resource before it is uploaded.
+// It returns the new content and media type; an empty media type keeps the
+// current one. Transformers that don't apply to a resource return it unchanged.
+type ResourceTransformer interface {
+	Transform(link *manifest.Link, data []byte) ([]byte, string, error)
+}
+
+// ResourceTransformerFunc adapts a plain function to ResourceTransformer
+type ResourceTransformerFunc func(link *manifest.Link, data []byte) ([]byte, string, error)
+
+// Transform calls f(link, data)
+func (f ResourceTransformerFunc) Transform(link *manifest.Link, data []byte) ([]byte, string, error) {
+	return f(link, data)
+}
+
+// transformEnv is what a transformer factory gets to know about the publication
+type transformEnv struct {
+	basePath     string
+	uploader     Uploader
+	headSnippets []string
+	watermark    *WatermarkOptions
+	notes        *noteCollector
+	inliner      *resourceInliner
+	videos       *videoPolicy
+}
+
+// registeredTransformer is a named transformer that can be turned on or off per
+// deployment (TRANSFORM_<NAME> env var) or per request ("transforms" option)
+type registeredTransformer struct {
+	name    string
+	enabled bool
+	newStep func(env transformEnv) ResourceTransformer
+}
+
+// transformerRegistry lists the available transformers in the order they run.
+// The built-ins are registered together in init so their order is explicit.
+var transformerRegistry []registeredTransformer
+
+// registerTransformer adds a transformer to the end of the pipeline
+func registerTransformer(name string, enabledByDefault bool, newStep func(env transformEnv) ResourceTransformer) {
+	transformerRegistry = append(transformerRegistry, registeredTransformer{name: name, enabled: enabledByDefault, newStep: newStep})
+}
+
+func init() {
+	// Runs first so the other transformers see the data: URLs, which they leave alone
+	registerTransformer("inline_resources", true, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			if !isHTMLResource(link) {
+				return data, "", nil
+			}
+			return env.inliner.inline(resolveArchiveHref(link.Href.String(), ""), data), "", nil
+		})
+	})
+	registerTransformer("external_videos", true, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			if !isHTMLResource(link) {
+				return data, "", nil
+			}
+			return env.videos.rewrite(resolveArchiveHref(link.Href.String(), ""), data), "", nil
+		})
+	})
+	registerTransformer("html_links", true, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			if !isHTMLResource(link) {
+				return data, "", nil
+			}
+			return rewriteLinksInXHTML(data, link.Href.String(), nil, env.basePath, env.uploader), "", nil
+		})
+	})
+	registerTransformer("js_sanitize", false, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			if !isHTMLResource(link) && !isSVGResource(link) {
+				return data, "", nil
+			}
+			return sanitizeXHTML(data), "", nil
+		})
+	})
+	registerTransformer("head_inject", true, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			if len(env.headSnippets) == 0 || !isHTMLResource(link) {
+				return data, "", nil
+			}
+			return injectIntoHead(data, env.headSnippets), "", nil
+		})
+	})
+	registerTransformer("css_urls", true, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(rewriteCSSURLs)
+	})
+	registerTransformer("image_recompress", false, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(recompressImage)
+	})
+	// Reads the documents rather than rewriting them, to build the footnote map
+	registerTransformer("footnotes", true, func(env transformEnv) ResourceTransformer {
+		return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			if isHTMLResource(link) {
+				env.notes.scan(resourceKey(link.Href.String()), data)
+			}
+			return data, "", nil
+		})
+	})
+}
+
+// transformPipeline runs the enabled transformers over each resource
+type transformPipeline struct {
+	names      []string
+	steps      []ResourceTransformer
+	mediaTypes map[string]string // href -> media type set by a transformer
+}
+
+// newTransformPipeline builds the pipeline for one publication. overrides comes
+// from the request and takes precedence over TRANSFORM_<NAME> env vars, which
+// take precedence over each transformer's default.
+func newTransformPipeline(overrides map[string]bool, env transformEnv) (*transformPipeline, error) {
+	known := map[string]bool{}
+	for _, t := range transformerRegistry {
+		known[t.name] = true
+	}
+	for name := range overrides {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+	}
+
+	p := &transformPipeline{mediaTypes: map[string]string{}}
+	for _, t := range transformerRegistry {
+		enabled := t.enabled
+		if value := os.Getenv(transformEnvVar(t.name)); value != "" {
+			if parsed, err := strconv.ParseBool(value); err == nil {
+				enabled = parsed
+			} else {
+				log.Printf("Warning: ignoring invalid %s=%q", transformEnvVar(t.name), value)
+			}
+		}
+		if override, ok := overrides[t.name]; ok {
+			enabled = override
+		}
+		if enabled {
+			p.names = append(p.names, t.name)
+			p.steps = append(p.steps, t.newStep(env))
+		}
+	}
+	// The watermark can't be switched off, and runs last so that nothing
+	// (image recompression in particular) undoes it
+	if env.watermark != nil {
+		p.names = append(p.names, "watermark")
+		p.steps = append(p.steps, newWatermarker(env.watermark))
+	}
+	return p, nil
+}
+
+// transformEnvVar returns the env var that enables or disables a transformer
+func transformEnvVar(name string) string {
+	return "TRANSFORM_" + strings.ToUpper(name)
+}
+
+// apply runs every step over a resource, updating link.MediaType when a step changes it
+func (p *transformPipeline) apply(link *manifest.Link, data []byte) ([]byte, error) {
+	for i, step := range p.steps {
+		newData, newMediaType, err := step.Transform(link, data)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s failed: %w", p.names[i], err)
+		}
+		data = newData
+		if newMediaType != "" && newMediaType != resourceMediaType(link) {
+			mt, err := mediatype.NewOfString(newMediaType)
+			if err != nil {
+				return nil, fmt.Errorf("transform %s returned invalid media type %q: %w", p.names[i], newMediaType, err)
+			}
+			link.MediaType = &mt
+			p.mediaTypes[link.Href.String()] = newMediaType
+		}
+	}
+	return data, nil
+}
+
+// applyMediaTypes copies the media types changed by transformers into the manifest
+func (p *transformPipeline) applyMediaTypes(m *manifest.Manifest) {
+	if len(p.mediaTypes) == 0 {
+		return
+	}
+	update := func(links manifest.LinkList) {
+		for i := range links {
+			if newMediaType, ok := p.mediaTypes[links[i].Href.String()]; ok {
+				if mt, err := mediatype.NewOfString(newMediaType); err == nil {
+					links[i].MediaType = &mt
+				}
+			}
+		}
+	}
+	update(m.ReadingOrder)
+	update(m.Resources)
+}
+
+// resourceMediaType returns the media type of a link without parameters,
+// falling back to the file extension when the manifest doesn't declare one
+func resourceMediaType(link *manifest.Link) string {
+	mediaType := ""
+	if link.MediaType != nil {
+		mediaType = link.MediaType.String()
+	} else {
+		mediaType = getContentType(link.Href.String())
+	}
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	return strings.TrimSpace(mediaType)
+}
+
+// isHTMLResource reports whether a link is an XHTML or HTML content document
+func isHTMLResource(link *manifest.Link) bool {
+	switch resourceMediaType(link) {
+	case "application/xhtml+xml", "text/html":
+		return true
+	}
+	href := strings.ToLower(link.Href.String())
+	return strings.HasSuffix(href, ".xhtml") || strings.HasSuffix(href, ".html")
+}
+
+// isSVGResource reports whether a link is an SVG image, which can hold scripts
+// of its own
+func isSVGResource(link *manifest.Link) bool {
+	return resourceMediaType(link) == "image/svg+xml" || strings.HasSuffix(strings.ToLower(link.Href.String()), ".svg")
+}
+
+var cssURLRewritePattern = regexp.MustCompile(`(?i)(url\(\s*['"]?)([^'")]+?)(['"]?\s*\))|(@import\s+['"])([^'"]+)(['"])`)
+
+// rewriteCSSURLs normalizes relative url() and @import references in stylesheets
+// the same way links in content documents are, so fonts and images whose names
+// need escaping still resolve against the uploaded objects
+func rewriteCSSURLs(link *manifest.Link, data []byte) ([]byte, string, error) {
+	if resourceMediaType(link) != "text/css" {
+		return data, "", nil
+	}
+	rewritten := cssURLRewritePattern.ReplaceAllStringFunc(string(data), func(match string) string {
+		parts := cssURLRewritePattern.FindStringSubmatch(match)
+		prefix, ref, suffix := parts[1], parts[2], parts[3]
+		if prefix == "" {
+			prefix, ref, suffix = parts[4], parts[5], parts[6]
+		}
+		if isExternalHref(ref) || strings.HasPrefix(ref, "#") {
+			return match
+		}
+		return prefix + normalizeRelativeLink(ref) + suffix
+	})
+	return []byte(rewritten), "", nil
+}
+
+const (
+	jpegQualityEnvVar  = "IMAGE_JPEG_QUALITY"
+	defaultJPEGQuality = 80
+)
+
+// recompressImage re-encodes JPEG and PNG images, keeping the result only when it
+// is smaller. Images that fail to decode are uploaded unchanged.
+func recompressImage(link *manifest.Link, data []byte) ([]byte, string, error) {
+	mediaType := resourceMediaType(link)
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		return data, "", nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Warning: failed to decode image %s, uploading it unchanged: %v", link.Href.String(), err)
+		return data, "", nil
+	}
+
+	var buf bytes.Buffer
+	if mediaType == "image/jpeg" {
+		quality := defaultJPEGQuality
+		if value, ok := envUint(jpegQualityEnvVar); ok && value >= 1 && value <= 100 {
+			quality = int(value)
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode %s: %w", mediaType, err)
+	}
+
+	if buf.Len() >= len(data) {
+		return data, "", nil
+	}
+	return buf.Bytes(), "", nil
+}
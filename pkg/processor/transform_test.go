@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestNewTransformPipeline_Flags(t *testing.T) {
+	p, err := newTransformPipeline(nil, transformEnv{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := []string{"inline_resources", "external_videos", "html_links", "head_inject", "css_urls", "footnotes"}; !reflect.DeepEqual(p.names, want) {
+		t.Errorf("Expected default transforms %v, got %v", want, p.names)
+	}
+
+	t.Setenv(transformEnvVar("image_recompress"), "true")
+	t.Setenv(transformEnvVar("css_urls"), "false")
+	p, _ = newTransformPipeline(nil, transformEnv{})
+	if want := []string{"inline_resources", "external_videos", "html_links", "head_inject", "image_recompress", "footnotes"}; !reflect.DeepEqual(p.names, want) {
+		t.Errorf("Expected env to toggle transforms to %v, got %v", want, p.names)
+	}
+
+	p, _ = newTransformPipeline(map[string]bool{"image_recompress": false, "inline_resources": false, "external_videos": false, "html_links": false, "head_inject": false, "footnotes": false}, transformEnv{})
+	if len(p.names) != 0 {
+		t.Errorf("Expected request overrides to win over env, got %v", p.names)
+	}
+
+	if _, err := newTransformPipeline(map[string]bool{"minify": true}, transformEnv{}); err == nil {
+		t.Errorf("Expected error for unknown transform")
+	}
+}
+
+func TestTransformPipeline_MediaTypeChange(t *testing.T) {
+	p := &transformPipeline{
+		names: []string{"to_webp"},
+		steps: []ResourceTransformer{ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+			return []byte("webp"), "image/webp", nil
+		})},
+		mediaTypes: map[string]string{},
+	}
+
+	link := testLink(t, "OEBPS/cover.png")
+	data, err := p.apply(&link, []byte("png"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if string(data) != "webp" {
+		t.Errorf("Expected transformed data, got %q", data)
+	}
+	if link.MediaType == nil || link.MediaType.String() != "image/webp" {
+		t.Errorf("Expected link media type to be updated, got %v", link.MediaType)
+	}
+
+	m := manifest.Manifest{Resources: manifest.LinkList{testLink(t, "OEBPS/cover.png")}}
+	p.applyMediaTypes(&m)
+	if mt := m.Resources[0].MediaType; mt == nil || mt.String() != "image/webp" {
+		t.Errorf("Expected manifest media type to be updated, got %v", mt)
+	}
+}
+
+func TestRewriteCSSURLs(t *testing.T) {
+	css := `@font-face { src: url("../Fonts/My Font.ttf"); }
+@import 'base styles.css';
+.a { background: url(data:image/png;base64,AAAA); }
+.b { background: url(https://example.com/x.png); }`
+
+	got, _, err := rewriteCSSURLs(ptr(testLink(t, "OEBPS/Styles/style.css")), []byte(css))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := `@font-face { src: url("../Fonts/My%20Font.ttf"); }
+@import 'base%20styles.css';
+.a { background: url(data:image/png;base64,AAAA); }
+.b { background: url(https://example.com/x.png); }`
+	if string(got) != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	js := []byte(`url("a b.png")`)
+	if got, _, _ := rewriteCSSURLs(ptr(testLink(t, "OEBPS/script.js")), js); !bytes.Equal(got, js) {
+		t.Errorf("Expected non-CSS resource to be unchanged, got %s", got)
+	}
+}
+
+func TestRecompressImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.NoCompression}).Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+
+	got, _, err := recompressImage(ptr(testLink(t, "OEBPS/Images/red.png")), buf.Bytes())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(got) >= buf.Len() {
+		t.Errorf("Expected recompressed PNG to be smaller than %d bytes, got %d", buf.Len(), len(got))
+	}
+
+	broken := []byte("not a png")
+	if got, _, err := recompressImage(ptr(testLink(t, "OEBPS/Images/broken.png")), broken); err != nil || !bytes.Equal(got, broken) {
+		t.Errorf("Expected undecodable image to be unchanged, got %q, %v", got, err)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"archive/zip"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+var (
+	cssURLPattern    = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]+?)['"]?\s*\)`)
+	cssImportPattern = regexp.MustCompile(`(?i)@import\s+['"]([^'"]+)['"]`)
+)
+
+// findUnusedResources returns the hrefs of manifest resources that are never
+// referenced, directly or transitively, from the reading order, the TOC, the
+// publication links, or resources with a role (cover, navigation document, NCX).
+// References are followed through XHTML, SVG and CSS files in the archive.
+func findUnusedResources(m *manifest.Manifest, entries map[string]*zip.File) []string {
+	reached := map[string]bool{}
+	var queue []string
+	visit := func(target string) {
+		if target != "" && !reached[target] {
+			reached[target] = true
+			queue = append(queue, target)
+		}
+	}
+	visitLinks := func(links manifest.LinkList) {
+		var walk func(manifest.LinkList)
+		walk = func(links manifest.LinkList) {
+			for _, link := range links {
+				visit(resolveArchiveHref(link.Href.String(), ""))
+				walk(link.Children)
+			}
+		}
+		walk(links)
+	}
+
+	// Roots
+	visitLinks(m.ReadingOrder)
+	visitLinks(m.TableOfContents)
+	visitLinks(m.Links)
+	for _, link := range m.Resources {
+		mediaType := ""
+		if link.MediaType != nil {
+			mediaType = link.MediaType.String()
+		}
+		if len(link.Rels) > 0 || mediaType == "application/x-dtbncx+xml" {
+			visit(resolveArchiveHref(link.Href.String(), ""))
+		}
+	}
+
+	// Follow references through documents and stylesheets
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for _, ref := range resourceRefs(current, entries[current]) {
+			visit(resolveArchiveHref(ref, current))
+		}
+	}
+
+	unused := []string{}
+	for _, link := range m.Resources {
+		href := link.Href.String()
+		if !reached[resolveArchiveHref(href, "")] {
+			unused = append(unused, href)
+		}
+	}
+	return unused
+}
+
+// resourceRefs returns the references made by an archive entry, based on its extension
+func resourceRefs(name string, f *zip.File) []string {
+	if f == nil {
+		return nil
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	isMarkup := ext == ".xhtml" || ext == ".html" || ext == ".htm" || ext == ".svg"
+	if !isMarkup && ext != ".css" {
+		return nil
+	}
+
+	data, err := readZipEntry(f)
+	if err != nil {
+		return nil
+	}
+
+	var refs []string
+	if isMarkup {
+		refs, _ = collectDocumentRefs(data)
+	}
+	return append(refs, cssRefs(data)...)
+}
+
+// cssRefs returns the url() and @import references of a stylesheet, or of the
+// <style> blocks and style attributes of markup
+func cssRefs(data []byte) []string {
+	var refs []string
+	for _, m := range cssURLPattern.FindAllSubmatch(data, -1) {
+		refs = append(refs, string(m[1]))
+	}
+	for _, m := range cssImportPattern.FindAllSubmatch(data, -1) {
+		refs = append(refs, string(m[1]))
+	}
+	return refs
+}
+
+// pruneResources removes the given hrefs from the manifest resources
+func pruneResources(m *manifest.Manifest, hrefs []string) {
+	pruned := make(map[string]bool, len(hrefs))
+	for _, href := range hrefs {
+		pruned[href] = true
+	}
+
+	kept := make(manifest.LinkList, 0, len(m.Resources))
+	for _, link := range m.Resources {
+		if !pruned[link.Href.String()] {
+			kept = append(kept, link)
+		}
+	}
+	m.Resources = kept
+}
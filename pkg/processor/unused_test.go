@@ -0,0 +1,46 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestFindUnusedResources(t *testing.T) {
+	zipReader := buildEPUB(t, map[string]string{
+		"OEBPS/ch1.xhtml":       `<html xmlns="http://www.w3.org/1999/xhtml"><head><link rel="stylesheet" href="css/style.css"/></head><body><img src="img/used.png"/></body></html>`,
+		"OEBPS/css/style.css":   `@import "base.css"; @font-face { src: url('../fonts/serif.ttf'); }`,
+		"OEBPS/css/base.css":    `body { background: url(../img/bg.jpg) }`,
+		"OEBPS/fonts/serif.ttf": "",
+		"OEBPS/img/used.png":    "",
+		"OEBPS/img/bg.jpg":      "",
+		"OEBPS/img/cover.jpg":   "",
+		"OEBPS/img/orphan.png":  "",
+	})
+
+	cover := testLink(t, "OEBPS/img/cover.jpg")
+	cover.Rels = manifest.Strings{"cover"}
+	m := &manifest.Manifest{
+		ReadingOrder: manifest.LinkList{testLink(t, "OEBPS/ch1.xhtml")},
+		Resources: manifest.LinkList{
+			testLink(t, "OEBPS/css/style.css"),
+			testLink(t, "OEBPS/css/base.css"),
+			testLink(t, "OEBPS/fonts/serif.ttf"),
+			testLink(t, "OEBPS/img/used.png"),
+			testLink(t, "OEBPS/img/bg.jpg"),
+			cover,
+			testLink(t, "OEBPS/img/orphan.png"),
+		},
+	}
+
+	unused := findUnusedResources(m, zipEntries(zipReader))
+	if !reflect.DeepEqual(unused, []string{"OEBPS/img/orphan.png"}) {
+		t.Fatalf("Expected only orphan.png to be unused, got %v", unused)
+	}
+
+	pruneResources(m, unused)
+	if len(m.Resources) != 6 {
+		t.Errorf("Expected 6 resources after pruning, got %d", len(m.Resources))
+	}
+}
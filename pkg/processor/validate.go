@@ -0,0 +1,139 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// validationIssue is a single finding of the structural validator
+type validationIssue struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+}
+
+// ValidationReport is the result of validateEPUB
+type ValidationReport struct {
+	Valid    bool              `json:"valid"`
+	Errors   []validationIssue `json:"errors"`
+	Warnings []validationIssue `json:"warnings"`
+}
+
+func (r *ValidationReport) addError(code, path, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, validationIssue{Code: code, Message: fmt.Sprintf(format, args...), Path: path})
+}
+
+func (r *ValidationReport) addWarning(code, path, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, validationIssue{Code: code, Message: fmt.Sprintf(format, args...), Path: path})
+}
+
+// validateEPUB runs lightweight structural checks (a small subset of epubcheck)
+// over the archive: OCF container, package document well-formedness,
+// manifest/spine consistency, missing resources and broken internal links
+func validateEPUB(zipReader *zip.Reader) *ValidationReport {
+	report := &ValidationReport{Errors: []validationIssue{}, Warnings: []validationIssue{}}
+	entries := zipEntries(zipReader)
+
+	// OCF: mimetype must be the first, uncompressed entry
+	mimetype := entries["mimetype"]
+	if mimetype == nil {
+		report.addError("OCF-001", "mimetype", "mimetype entry is missing")
+	} else {
+		content, _ := readZipEntry(mimetype)
+		if strings.TrimSpace(string(content)) != "application/epub+zip" {
+			report.addError("OCF-002", "mimetype", "mimetype entry contains %q instead of application/epub+zip", string(content))
+		}
+		if zipReader.File[0] != mimetype || mimetype.Method != zip.Store {
+			report.addWarning("OCF-003", "mimetype", "mimetype entry should be the first entry and stored uncompressed")
+		}
+	}
+
+	pkg, err := openEPUBPackage(zipReader)
+	if err != nil {
+		report.addError("PKG-001", containerPath, "%v", err)
+		report.Valid = false
+		return report
+	}
+
+	// Manifest: unique ids, and every item present in the archive
+	ids := map[string]bool{}
+	for _, item := range pkg.opf.Manifest {
+		if item.ID == "" {
+			report.addError("OPF-001", pkg.opfPath, "manifest item %q has no id", item.Href)
+		} else if ids[item.ID] {
+			report.addError("OPF-002", pkg.opfPath, "duplicate manifest id %q", item.ID)
+		}
+		ids[item.ID] = true
+
+		target := pkg.resolve(item.Href)
+		if target != "" && entries[target] == nil {
+			report.addError("RSC-001", target, "manifest item %q refers to a missing resource", item.ID)
+		}
+	}
+
+	// Spine: non-empty, and every itemref pointing at a manifest item
+	if len(pkg.opf.Spine.Itemrefs) == 0 {
+		report.addError("OPF-003", pkg.opfPath, "spine is empty")
+	}
+	for _, itemref := range pkg.opf.Spine.Itemrefs {
+		if !ids[itemref.IDRef] {
+			report.addError("OPF-004", pkg.opfPath, "spine itemref %q is not in the manifest", itemref.IDRef)
+		}
+	}
+
+	// Content documents: well-formed, with internal links resolving to archive entries
+	for _, item := range pkg.opf.Manifest {
+		if item.MediaType != "application/xhtml+xml" {
+			continue
+		}
+		docPath := pkg.resolve(item.Href)
+		data, err := readZipEntry(entries[docPath])
+		if err != nil || data == nil {
+			continue // already reported as missing
+		}
+
+		refs, err := collectDocumentRefs(data)
+		if err != nil {
+			report.addError("HTM-001", docPath, "content document is not well-formed XML: %v", err)
+		}
+		for _, ref := range refs {
+			target := resolveArchiveHref(ref, docPath)
+			if target != "" && entries[target] == nil {
+				report.addError("RSC-002", docPath, "broken link to %q", ref)
+			}
+		}
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// collectDocumentRefs returns the href/src/xlink:href attribute values of an XHTML
+// document. Refs found before a well-formedness error are still returned.
+func collectDocumentRefs(data []byte) ([]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Entity = xml.HTMLEntity
+	var refs []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return refs, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "href" || attr.Name.Local == "src" {
+				refs = append(refs, attr.Value)
+			}
+		}
+	}
+}
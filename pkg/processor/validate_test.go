@@ -0,0 +1,85 @@
+package processor
+
+import (
+	"archive/zip"
+	"testing"
+)
+
+// buildEPUB creates an in-memory EPUB archive from entry names and their text content
+func buildEPUB(t *testing.T, entries map[string]string) *zip.Reader {
+	t.Helper()
+
+	files := map[string][]byte{}
+	for name, content := range entries {
+		files[name] = []byte(content)
+	}
+	return buildZip(t, files)
+}
+
+const validContainer = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`
+
+func TestValidateEPUB_ReportsStructuralProblems(t *testing.T) {
+	zipReader := buildEPUB(t, map[string]string{
+		"mimetype":               "application/epub+zip",
+		"META-INF/container.xml": validContainer,
+		"OEBPS/content.opf": `<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <manifest>
+    <item id="ch1" href="text/ch1.xhtml" media-type="application/xhtml+xml"/>
+    <item id="img" href="images/missing.png" media-type="image/png"/>
+  </manifest>
+  <spine><itemref idref="ch1"/><itemref idref="ghost"/></spine>
+</package>`,
+		"OEBPS/text/ch1.xhtml": `<html xmlns="http://www.w3.org/1999/xhtml"><body>
+  <a href="ch2.xhtml#s1">next</a>
+  <a href="https://example.com">external</a>
+  <a href="#top">top</a>
+</body></html>`,
+	})
+
+	report := validateEPUB(zipReader)
+
+	if report.Valid {
+		t.Fatalf("Expected invalid report")
+	}
+	codes := map[string]bool{}
+	for _, issue := range report.Errors {
+		codes[issue.Code] = true
+	}
+	for _, code := range []string{"RSC-001", "OPF-004", "RSC-002"} {
+		if !codes[code] {
+			t.Errorf("Expected error %s, got %+v", code, report.Errors)
+		}
+	}
+	if len(report.Errors) != 3 {
+		t.Errorf("Expected exactly 3 errors, got %+v", report.Errors)
+	}
+}
+
+func TestValidateEPUB_MissingContainer(t *testing.T) {
+	report := validateEPUB(buildEPUB(t, map[string]string{"mimetype": "application/epub+zip"}))
+
+	if report.Valid || len(report.Errors) != 1 || report.Errors[0].Code != "PKG-001" {
+		t.Errorf("Expected a single PKG-001 error, got %+v", report.Errors)
+	}
+}
+
+func TestResolveArchiveHref(t *testing.T) {
+	tests := []struct {
+		href, from, want string
+	}{
+		{"ch2.xhtml#s1", "OEBPS/text/ch1.xhtml", "OEBPS/text/ch2.xhtml"},
+		{"../images/a%20b.png", "OEBPS/text/ch1.xhtml", "OEBPS/images/a b.png"},
+		{"/OEBPS/style.css", "OEBPS/text/ch1.xhtml", "OEBPS/style.css"},
+		{"https://example.com/x", "OEBPS/ch1.xhtml", ""},
+		{"mailto:a@b.c", "OEBPS/ch1.xhtml", ""},
+		{"#note", "OEBPS/ch1.xhtml", ""},
+	}
+	for _, tt := range tests {
+		if got := resolveArchiveHref(tt.href, tt.from); got != tt.want {
+			t.Errorf("resolveArchiveHref(%q, %q) = %q, want %q", tt.href, tt.from, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package processor
+
+import (
+	"fmt"
+	neturl "net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/util/url"
+)
+
+// The policies for the videos embedded in a publication
+const (
+	// videoUpload uploads videos as they are, like any other resource
+	videoUpload = "upload"
+	// videoSkip uploads no video: their links stay, noted as skipped
+	videoSkip = "skip"
+	// videoExternal points the links and the references of content documents
+	// to the videos at the URLs given in video_urls
+	videoExternal = "external"
+)
+
+// videoRefPattern matches the references of content documents to videos: the
+// src of a <video> or of the <source> elements of one
+var videoRefPattern = regexp.MustCompile(`(?i)(<(?:video|source)\b[^>]*?\ssrc=["'])([^"']+)(["'])`)
+
+// resolveVideoPolicy validates the video_policy and video_urls options; an
+// empty policy means videoUpload
+func resolveVideoPolicy(requested string, urls map[string]string) (string, error) {
+	policy := requested
+	switch requested {
+	case "":
+		policy = videoUpload
+	case videoUpload, videoSkip, videoExternal:
+	default:
+		return "", fmt.Errorf("unknown video_policy %q (expected %q, %q or %q)", requested, videoUpload, videoSkip, videoExternal)
+	}
+
+	if policy != videoExternal && len(urls) > 0 {
+		return "", fmt.Errorf("video_urls requires video_policy %q", videoExternal)
+	}
+	if policy == videoExternal && len(urls) == 0 {
+		return "", fmt.Errorf("video_policy %q requires video_urls", videoExternal)
+	}
+	for path, rawURL := range urls {
+		u, err := neturl.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("invalid video_urls entry for %q: %q must be an absolute http(s) URL", path, rawURL)
+		}
+	}
+	return policy, nil
+}
+
+// videoPolicy applies video_policy to the video resources of a publication,
+// since videos dominate the processing time of enhanced EPUBs. A nil policy
+// uploads every video.
+type videoPolicy struct {
+	policy   string
+	urls     map[string]string // archive path -> external URL
+	replaced map[string]bool   // hrefs of the videos that were skipped or made external
+	missing  map[string]bool   // archive paths of external videos without a URL, uploaded instead
+}
+
+// newVideoPolicy returns the policy for the resolved options, or nil for videoUpload
+func newVideoPolicy(policy string, urls map[string]string) *videoPolicy {
+	if policy == "" || policy == videoUpload {
+		return nil
+	}
+	v := &videoPolicy{policy: policy, urls: map[string]string{}, replaced: map[string]bool{}, missing: map[string]bool{}}
+	for path, u := range urls {
+		v.urls[resolveArchiveHref(path, "")] = u
+	}
+	return v
+}
+
+// isVideoResource reports whether a link is a video
+func isVideoResource(link *manifest.Link) bool {
+	return strings.HasPrefix(resourceMediaType(link), "video/")
+}
+
+// allows reports whether the resource of link is to be uploaded. Videos are
+// not under videoSkip, nor under videoExternal when video_urls has a URL for
+// them; the ones without are uploaded, with a warning.
+func (v *videoPolicy) allows(link *manifest.Link) bool {
+	if v == nil || !isVideoResource(link) {
+		return true
+	}
+	href := link.Href.String()
+	if v.policy == videoExternal {
+		if _, ok := v.urls[resolveArchiveHref(href, "")]; !ok {
+			v.missing[resourceKey(href)] = true
+			return true
+		}
+	}
+	v.replaced[href] = true
+	return false
+}
+
+// rewrite points the references of the content document at docPath to the
+// external videos at their URL
+func (v *videoPolicy) rewrite(docPath string, content []byte) []byte {
+	if v == nil || v.policy != videoExternal {
+		return content
+	}
+	return videoRefPattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		parts := videoRefPattern.FindSubmatch(match)
+		if external, ok := v.urls[resolveArchiveHref(string(parts[2]), docPath)]; ok {
+			return []byte(string(parts[1]) + external + string(parts[3]))
+		}
+		return match
+	})
+}
+
+// apply updates the manifest links of the videos that weren't uploaded: the
+// skipped ones are noted as such, and the external ones point to their URL
+func (v *videoPolicy) apply(m *manifest.Manifest) {
+	if v == nil || len(v.replaced) == 0 {
+		return
+	}
+	update := func(links manifest.LinkList) {
+		for i := range links {
+			href := links[i].Href.String()
+			if !v.replaced[href] {
+				continue
+			}
+			if v.policy == videoSkip {
+				if links[i].Properties == nil {
+					links[i].Properties = manifest.Properties{}
+				}
+				links[i].Properties["skipped"] = "video_policy"
+				continue
+			}
+			if u, err := url.URLFromString(v.urls[resolveArchiveHref(href, "")]); err == nil {
+				links[i].Href = manifest.NewHREF(u)
+			}
+		}
+	}
+	update(m.ReadingOrder)
+	update(m.Resources)
+}
+
+// warnings returns a warning for each external video uploaded for lack of a URL
+func (v *videoPolicy) warnings() []string {
+	if v == nil {
+		return nil
+	}
+	var missing []string
+	for path := range v.missing {
+		missing = append(missing, path)
+	}
+	sort.Strings(missing)
+	var warnings []string
+	for _, path := range missing {
+		warnings = append(warnings, fmt.Sprintf("uploaded video %s: video_urls has no URL for it", path))
+	}
+	return warnings
+}
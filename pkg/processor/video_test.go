@@ -0,0 +1,107 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+	"github.com/readium/go-toolkit/pkg/mediatype"
+)
+
+func TestResolveVideoPolicy(t *testing.T) {
+	urls := map[string]string{"OEBPS/video/intro.mp4": "https://cdn.example.com/intro.mp4"}
+	tests := []struct {
+		name    string
+		policy  string
+		urls    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"default", "", nil, videoUpload, false},
+		{"skip", videoSkip, nil, videoSkip, false},
+		{"external", videoExternal, urls, videoExternal, false},
+		{"unknown policy", "stream", nil, "", true},
+		{"external without urls", videoExternal, nil, "", true},
+		{"urls without external", videoSkip, urls, "", true},
+		{"relative url", videoExternal, map[string]string{"OEBPS/video/intro.mp4": "intro.mp4"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveVideoPolicy(tt.policy, tt.urls)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expected error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// videoLinks returns the links of a video, a second video and a chapter
+func videoLinks(t *testing.T) (manifest.Link, manifest.Link, manifest.Link) {
+	videoType, _ := mediatype.NewOfString("video/mp4")
+	intro, outro := testLink(t, "OEBPS/video/intro.mp4"), testLink(t, "OEBPS/video/outro.mp4")
+	intro.MediaType, outro.MediaType = &videoType, &videoType
+	return intro, outro, testLink(t, "OEBPS/chapter.xhtml")
+}
+
+func TestVideoPolicy_Skip(t *testing.T) {
+	intro, _, chapter := videoLinks(t)
+	videos := newVideoPolicy(videoSkip, nil)
+	if videos.allows(&intro) {
+		t.Errorf("Expected the video to be skipped")
+	}
+	if !videos.allows(&chapter) {
+		t.Errorf("Expected the chapter to be uploaded")
+	}
+
+	m := manifest.Manifest{Resources: manifest.LinkList{intro}}
+	videos.apply(&m)
+	if got := m.Resources[0].Properties["skipped"]; got != "video_policy" {
+		t.Errorf("Expected the skipped video to be noted, got %v", got)
+	}
+}
+
+func TestVideoPolicy_External(t *testing.T) {
+	intro, outro, _ := videoLinks(t)
+	videos := newVideoPolicy(videoExternal, map[string]string{"/OEBPS/video/intro.mp4": "https://cdn.example.com/intro.mp4"})
+	if videos.allows(&intro) {
+		t.Errorf("Expected the external video not to be uploaded")
+	}
+	if !videos.allows(&outro) {
+		t.Errorf("Expected a video without a URL to be uploaded")
+	}
+	if warnings := videos.warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "OEBPS/video/outro.mp4") {
+		t.Errorf("Expected a warning for the video without a URL, got %v", warnings)
+	}
+
+	document := []byte(`<video controls="controls"><source src="video/intro.mp4" type="video/mp4"/></video><video src="video/outro.mp4"/>`)
+	want := `<video controls="controls"><source src="https://cdn.example.com/intro.mp4" type="video/mp4"/></video><video src="video/outro.mp4"/>`
+	if got := string(videos.rewrite("OEBPS/chapter.xhtml", document)); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+
+	m := manifest.Manifest{Resources: manifest.LinkList{intro, outro}}
+	videos.apply(&m)
+	if got := m.Resources[0].Href.String(); got != "https://cdn.example.com/intro.mp4" {
+		t.Errorf("Expected the link to point to the external video, got %q", got)
+	}
+	if got := manifestHref(m.Resources[0].Href.String()); got != "https://cdn.example.com/intro.mp4" {
+		t.Errorf("Expected the manifest to keep the external href, got %q", got)
+	}
+	if got := m.Resources[1].Href.String(); got != "OEBPS/video/outro.mp4" {
+		t.Errorf("Expected the uploaded video to keep its href, got %q", got)
+	}
+}
+
+func TestVideoPolicy_Upload(t *testing.T) {
+	intro, _, _ := videoLinks(t)
+	videos := newVideoPolicy(videoUpload, nil)
+	if videos != nil || !videos.allows(&intro) {
+		t.Errorf("Expected every video to be uploaded")
+	}
+	if got := string(videos.rewrite("OEBPS/chapter.xhtml", []byte(`<video src="video/intro.mp4"/>`))); got != `<video src="video/intro.mp4"/>` {
+		t.Errorf("Expected the document to be left alone, got %s", got)
+	}
+}
@@ -0,0 +1,277 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+const (
+	// watermarkDir holds the watermarked copies of a publication, one per purchaser
+	watermarkDir = "watermarked"
+	// watermarkUserIDPlaceholder is replaced with the user ID in the footer text
+	watermarkUserIDPlaceholder = "{user_id}"
+	defaultWatermarkText       = "Licensed to " + watermarkUserIDPlaceholder
+	maxWatermarkUserIDLength   = 256
+	// maxWatermarkImagePixels caps the images marked, as marking holds two
+	// decoded copies of an image in memory
+	maxWatermarkImagePixels = 16 << 20
+	// watermarkSecretEnvVar keys the HMAC naming the watermarked copies, so that
+	// their URLs can't be worked out from a user ID
+	watermarkSecretEnvVar = "WATERMARK_SECRET"
+)
+
+// imageWatermarkMagic starts the payload hidden in images, so it can be told
+// apart from noise when reading it back
+var imageWatermarkMagic = []byte("RWM1")
+
+var bodyCloseTagPattern = regexp.MustCompile(`(?i)</body\s*>`)
+
+// WatermarkOptions stamps the purchaser a publication is processed for into its
+// content, as a social DRM alternative to LCP. The copy is stored apart from the
+// publication (see OutputBasePath).
+type WatermarkOptions struct {
+	// UserID identifies the purchaser
+	UserID string `json:"user_id"`
+	// Text is the visible footer, where {user_id} stands for UserID
+	// (default "Licensed to {user_id}")
+	Text string `json:"text,omitempty"`
+	// Footer adds the text at the end of every content document
+	Footer bool `json:"footer,omitempty"`
+	// Images hides UserID in the least significant bits of PNG images. JPEGs are
+	// left alone, since re-encoding them would both lose quality and the marks.
+	Images bool `json:"images,omitempty"`
+}
+
+// resolve validates the watermark and marks with the footer when no mark is selected
+func (w *WatermarkOptions) resolve() error {
+	if w == nil {
+		return nil
+	}
+	if strings.TrimSpace(w.UserID) == "" {
+		return fmt.Errorf("watermark requires a user_id")
+	}
+	if len(w.UserID) > maxWatermarkUserIDLength {
+		return fmt.Errorf("watermark user_id is longer than %d bytes", maxWatermarkUserIDLength)
+	}
+	if strings.IndexFunc(w.UserID, unicode.IsControl) >= 0 {
+		return fmt.Errorf("watermark user_id contains control characters")
+	}
+	if os.Getenv(watermarkSecretEnvVar) == "" {
+		return fmt.Errorf("watermark requires %s to be set", watermarkSecretEnvVar)
+	}
+	if !w.Footer && !w.Images {
+		w.Footer = true
+	}
+	return nil
+}
+
+// OutputBasePath returns where the publication processed from epubFilename with
+// options is stored: its BasePath, or for a watermarked copy a directory under
+// it named after an HMAC of the user ID, so copies never overwrite the
+// publication or each other and their URLs can't be derived from the ID. A path
+// template using metadata, or the identifier layout, only applies once the EPUB
+// is parsed: until then the BasePath of the filename stands in for it, and
+// Result.BasePath tells where the publication went.
+func OutputBasePath(epubFilename string, options Options) string {
+	basePath, err := outputBasePath(epubFilename, options, nil)
+	if err != nil {
+		options.PathTemplate = ""
+		if options.Layout == layoutIdentifier {
+			options.Layout = layoutFlat
+		}
+		basePath, _ = outputBasePath(epubFilename, options, nil)
+	}
+	return basePath
+}
+
+// outputBasePath returns where the publication is stored, rendering the path
+// template with metadata, nil before the EPUB is parsed
+func outputBasePath(epubFilename string, options Options, metadata *manifest.Metadata) (string, error) {
+	basePath, err := publicationBasePath(epubFilename, options, metadata)
+	if err != nil {
+		return "", err
+	}
+	return watermarkedBasePath(basePath, options.Watermark), nil
+}
+
+// publicationBasePath returns where the publication is stored, leaving out
+// the directory of watermarked copies
+func publicationBasePath(epubFilename string, options Options, metadata *manifest.Metadata) (string, error) {
+	basePath := BasePath(epubFilename, options.Layout)
+	if options.Layout == layoutIdentifier && options.PathTemplate == "" {
+		if metadata == nil {
+			return "", fmt.Errorf("the identifier is only known once the EPUB is parsed")
+		}
+		segment, err := pathSegment(metadata.Identifier)
+		if err != nil {
+			return "", &statusError{status: 422, err: fmt.Errorf("invalid identifier for the identifier layout: %w", err)}
+		}
+		basePath = segment
+	}
+	if options.PathTemplate != "" {
+		var err error
+		if basePath, err = renderPathTemplate(options.PathTemplate, epubFilename, options.PathVars, metadata); err != nil {
+			return "", err
+		}
+	}
+	return basePath, nil
+}
+
+// watermarkedBasePath returns where the copy of the publication at basePath
+// watermarked with w is stored, or basePath without watermark. The copy is
+// named after the HMAC-SHA256 of the user ID keyed with WATERMARK_SECRET.
+func watermarkedBasePath(basePath string, w *WatermarkOptions) string {
+	if w == nil {
+		return basePath
+	}
+	mac := hmac.New(sha256.New, []byte(os.Getenv(watermarkSecretEnvVar)))
+	mac.Write([]byte(w.UserID))
+	return fmt.Sprintf("%s/%s/%s", basePath, watermarkDir, hex.EncodeToString(mac.Sum(nil)[:16]))
+}
+
+// WatermarkedFrom returns the base path of the publication a watermarked copy
+// at basePath was made from, and false if basePath is not a watermarked copy
+func WatermarkedFrom(basePath string) (string, bool) {
+	dir, key, ok := strings.Cut(basePath, "/"+watermarkDir+"/")
+	if !ok || dir == "" || key == "" || strings.Contains(key, "/") {
+		return "", false
+	}
+	return dir, true
+}
+
+// newWatermarker returns the transform stamping w into content documents and images
+func newWatermarker(w *WatermarkOptions) ResourceTransformer {
+	text := w.Text
+	if text == "" {
+		text = defaultWatermarkText
+	}
+	footer := fmt.Sprintf(`<p class="readium-watermark" style="margin-top: 2em; font-size: 0.75em; text-align: center; opacity: 0.6;">%s</p>`,
+		html.EscapeString(strings.ReplaceAll(text, watermarkUserIDPlaceholder, w.UserID)))
+
+	return ResourceTransformerFunc(func(link *manifest.Link, data []byte) ([]byte, string, error) {
+		switch {
+		case w.Footer && isHTMLResource(link):
+			return appendToBody(data, footer), "", nil
+		case w.Images && resourceMediaType(link) == "image/png":
+			marked, err := hideInImage(data, w.UserID)
+			if err != nil {
+				// A mark that doesn't fit is no reason to fail the purchase
+				log.Printf("Warning: not watermarking image %s: %v", link.Href.String(), err)
+				return data, "", nil
+			}
+			return marked, "", nil
+		}
+		return data, "", nil
+	})
+}
+
+// appendToBody inserts markup at the end of a document's <body>. Documents
+// without a closing body tag are returned unchanged.
+func appendToBody(content []byte, markup string) []byte {
+	locs := bodyCloseTagPattern.FindAllIndex(content, -1)
+	if len(locs) == 0 {
+		return content
+	}
+	end := locs[len(locs)-1][0]
+	out := make([]byte, 0, len(content)+len(markup)+1)
+	out = append(out, content[:end]...)
+	out = append(out, markup...)
+	out = append(out, '\n')
+	return append(out, content[end:]...)
+}
+
+// hideInImage re-encodes a PNG with text hidden in the least significant bit of
+// the red, green and blue channels of its pixels, row by row: the magic, the
+// length of the text as a big-endian uint16, then the text. Images of more than
+// maxWatermarkImagePixels are refused from their header, before decoding.
+func hideInImage(data []byte, text string) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG: %w", err)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > maxWatermarkImagePixels {
+		return nil, fmt.Errorf("image is too large (%dx%d) to mark", config.Width, config.Height)
+	}
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG: %w", err)
+	}
+	payload := append([]byte{}, imageWatermarkMagic...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(text)))
+	payload = append(payload, text...)
+
+	bounds := src.Bounds()
+	if capacity := bounds.Dx() * bounds.Dy() * 3; capacity < len(payload)*8 {
+		return nil, fmt.Errorf("image is too small (%dx%d) for a %d-byte mark", bounds.Dx(), bounds.Dy(), len(payload))
+	}
+	img := image.NewNRGBA(bounds)
+	draw.Draw(img, bounds, src, bounds.Min, draw.Src)
+
+	bit := 0
+	for i := 0; bit < len(payload)*8; i++ {
+		if i%4 == 3 {
+			continue // alpha
+		}
+		value := (payload[bit/8] >> (7 - bit%8)) & 1
+		img.Pix[i] = img.Pix[i]&^1 | value
+		bit++
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// readImageWatermark returns the text hidden in a PNG by hideInImage, to trace
+// a leaked copy back to its purchaser
+func readImageWatermark(data []byte) (string, bool) {
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", false
+	}
+	bounds := src.Bounds()
+	img := image.NewNRGBA(bounds)
+	draw.Draw(img, bounds, src, bounds.Min, draw.Src)
+
+	i := 0
+	readBytes := func(n int) ([]byte, bool) {
+		out := make([]byte, n)
+		for bit := 0; bit < n*8; i++ {
+			if i >= len(img.Pix) {
+				return nil, false
+			}
+			if i%4 == 3 {
+				continue
+			}
+			out[bit/8] |= (img.Pix[i] & 1) << (7 - bit%8)
+			bit++
+		}
+		return out, true
+	}
+	header, ok := readBytes(len(imageWatermarkMagic) + 2)
+	if !ok || !bytes.Equal(header[:len(imageWatermarkMagic)], imageWatermarkMagic) {
+		return "", false
+	}
+	text, ok := readBytes(int(binary.BigEndian.Uint16(header[len(imageWatermarkMagic):])))
+	if !ok {
+		return "", false
+	}
+	return string(text), true
+}
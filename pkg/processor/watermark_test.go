@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestWatermarkOptionsResolve(t *testing.T) {
+	t.Setenv(watermarkSecretEnvVar, "")
+	if err := (&WatermarkOptions{UserID: "reader-42"}).resolve(); err == nil {
+		t.Error("Expected a watermark without WATERMARK_SECRET to be rejected")
+	}
+
+	t.Setenv(watermarkSecretEnvVar, "s3cret")
+	w := &WatermarkOptions{UserID: "reader-42"}
+	if err := w.resolve(); err != nil || !w.Footer || w.Images {
+		t.Errorf("Expected the footer by default, got %+v (%v)", w, err)
+	}
+	for _, w := range []*WatermarkOptions{{UserID: " "}, {UserID: "a\nb"}, {UserID: strings.Repeat("x", 300)}} {
+		if err := w.resolve(); err == nil {
+			t.Errorf("Expected user ID %q to be rejected", w.UserID)
+		}
+	}
+}
+
+func TestOutputBasePath(t *testing.T) {
+	t.Setenv(watermarkSecretEnvVar, "s3cret")
+	options := Options{Layout: layoutFlat, Watermark: &WatermarkOptions{UserID: "reader-42"}}
+	basePath := OutputBasePath("books/moby.epub", options)
+	if !strings.HasPrefix(basePath, "books_moby/watermarked/") || strings.Contains(basePath, "reader-42") {
+		t.Errorf("Expected a copy under the publication without the user ID, got %s", basePath)
+	}
+	sum := sha256.Sum256([]byte("reader-42"))
+	if strings.Contains(basePath, hex.EncodeToString(sum[:8])) {
+		t.Errorf("Expected the copy not to be named after a plain hash of the user ID, got %s", basePath)
+	}
+	t.Setenv(watermarkSecretEnvVar, "other")
+	if other := OutputBasePath("books/moby.epub", options); other == basePath {
+		t.Errorf("Expected the name of the copy to depend on the secret, got %s twice", basePath)
+	}
+	if other := OutputBasePath("books/moby.epub", Options{Layout: layoutFlat, Watermark: &WatermarkOptions{UserID: "reader-43"}}); other == basePath {
+		t.Errorf("Expected every purchaser to get their own copy, got %s twice", basePath)
+	}
+	if parent, ok := WatermarkedFrom(basePath); !ok || parent != "books_moby" {
+		t.Errorf("Expected the copy to come from books_moby, got %q (%t)", parent, ok)
+	}
+	if _, ok := WatermarkedFrom("books_moby"); ok {
+		t.Error("Expected a publication not to be a watermarked copy")
+	}
+}
+
+func TestWatermarker(t *testing.T) {
+	t.Setenv(watermarkSecretEnvVar, "s3cret")
+	w := &WatermarkOptions{UserID: "Ada <ada@example.com>", Images: true}
+	if err := w.resolve(); err != nil {
+		t.Fatalf("resolve failed: %v", err)
+	}
+	w.Footer = true
+	// Turning every transform off leaves the watermark
+	p, err := newTransformPipeline(map[string]bool{"inline_resources": false, "html_links": false, "head_inject": false, "css_urls": false, "footnotes": false}, transformEnv{watermark: w})
+	if err != nil {
+		t.Fatalf("newTransformPipeline failed: %v", err)
+	}
+
+	chapter := testLink(t, "OEBPS/chapter1.xhtml")
+	data, err := p.apply(&chapter, []byte("<html><body><p>Call me Ishmael.</p></body></html>"))
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if !strings.Contains(string(data), "Licensed to Ada &lt;ada@example.com&gt;</p>\n</body>") {
+		t.Errorf("Expected an escaped footer at the end of the body, got %s", data)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	img.Set(0, 0, color.NRGBA{A: 0})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	cover := testLink(t, "OEBPS/cover.png")
+	marked, err := p.apply(&cover, buf.Bytes())
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if text, ok := readImageWatermark(marked); !ok || text != w.UserID {
+		t.Errorf("Expected the user ID in the image, got %q (%t)", text, ok)
+	}
+	if _, ok := readImageWatermark(buf.Bytes()); ok {
+		t.Error("Expected no mark in the original image")
+	}
+
+	// Too small for the mark: uploaded unchanged
+	buf.Reset()
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	icon := testLink(t, "OEBPS/icon.png")
+	if unchanged, _ := p.apply(&icon, buf.Bytes()); !bytes.Equal(unchanged, buf.Bytes()) {
+		t.Error("Expected an image too small for the mark to be left alone")
+	}
+
+	// Too large to decode: refused from its header, and uploaded unchanged
+	huge := bytes.Clone(buf.Bytes())
+	binary.BigEndian.PutUint32(huge[16:], 50000)
+	binary.BigEndian.PutUint32(huge[20:], 50000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	if _, err := hideInImage(huge, w.UserID); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Expected a 50000x50000 image to be refused, got %v", err)
+	}
+	poster := testLink(t, "OEBPS/poster.png")
+	if unchanged, _ := p.apply(&poster, huge); !bytes.Equal(unchanged, huge) {
+		t.Error("Expected an image too large for the mark to be left alone")
+	}
+}
@@ -0,0 +1,165 @@
+package processor
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Packaging modes for the output of a publication
+const (
+	// packageNone uploads the exploded publication only
+	packageNone = "none"
+	// packageWebPub also uploads the publication packaged as a single .webpub
+	packageWebPub = "webpub"
+	// packageWebPubOnly uploads the .webpub instead of the exploded publication
+	packageWebPubOnly = "webpub_only"
+)
+
+// webpubPath is where the packaged Readium Web Publication is stored, relative to basePath
+const webpubPath = "publication.webpub"
+
+// resolvePackageMode validates the requested packaging mode; empty means packageNone
+func resolvePackageMode(requested string) (string, error) {
+	switch requested {
+	case "", packageNone:
+		return packageNone, nil
+	case packageWebPub, packageWebPubOnly:
+		return requested, nil
+	default:
+		return "", fmt.Errorf("unknown package %q (expected %q, %q or %q)", requested, packageNone, packageWebPub, packageWebPubOnly)
+	}
+}
+
+// webpubPackager builds a packaged Readium Web Publication (a ZIP with manifest.json
+// at its root) from the files uploaded under basePath. Files are written as they
+// are uploaded, so nothing is held in memory. A nil packager accepts nothing.
+type webpubPackager struct {
+	basePath string
+	// exploded is false when the package replaces the individual uploads
+	exploded bool
+	file     *os.File
+	zw       *zip.Writer
+	written  map[string]bool // paths relative to basePath
+}
+
+// newWebPubPackager starts a new package on local disk
+func newWebPubPackager(basePath string, exploded bool) (*webpubPackager, error) {
+	file, err := os.CreateTemp("", "publication-*.webpub")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	return &webpubPackager{
+		basePath: basePath,
+		exploded: exploded,
+		file:     file,
+		zw:       zip.NewWriter(file),
+		written:  map[string]bool{},
+	}, nil
+}
+
+// accepts reports whether the file uploaded at path belongs in the package. The
+// resource index, the integrity sidecar, the manifest signature (which is for
+// the manifest in the bucket), the locator templates, the spine map, the
+// accessibility report and the other distribution formats stay out of it.
+func (p *webpubPackager) accepts(path string) bool {
+	if p == nil || !strings.HasPrefix(path, p.basePath+"/") {
+		return false
+	}
+	switch strings.TrimPrefix(path, p.basePath+"/") {
+	case IndexPath, IntegrityPath, signaturePath, LocatorsPath, spineMapPath, accessibilityReportPath, bookJSONLDPath, repackagedEPUBPath, webpubPath:
+		return false
+	}
+	return true
+}
+
+// add writes the file uploaded at path to the package. The manifest loses its
+// self link and any link to a file outside the package, since the package is
+// read without the bucket next to it.
+func (p *webpubPackager) add(path string, data []byte) error {
+	name := strings.TrimPrefix(path, p.basePath+"/")
+	if p.written[name] {
+		return nil
+	}
+	if name == "manifest.json" {
+		var err error
+		if data, err = p.packagedManifest(data); err != nil {
+			return err
+		}
+	}
+	w, err := p.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	p.written[name] = true
+	return nil
+}
+
+// packagedManifest removes the links that don't resolve inside the package
+func (p *webpubPackager) packagedManifest(data []byte) ([]byte, error) {
+	var manifest map[string]interface{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	links, _ := manifest["links"].([]interface{})
+	kept := make([]interface{}, 0, len(links))
+	for _, link := range links {
+		item, ok := link.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if rels := manifestLinkRels(item); rels["self"] {
+			continue
+		}
+		href, _ := item["href"].(string)
+		if !isExternalHref(href) && !p.written[resourceKey(strings.SplitN(href, "#", 2)[0])] {
+			continue
+		}
+		kept = append(kept, item)
+	}
+	manifest["links"] = kept
+	return json.MarshalIndent(manifest, "", "  ")
+}
+
+// manifestLinkRels returns the rel values of a generated manifest link, which
+// are either a string or a list
+func manifestLinkRels(item map[string]interface{}) map[string]bool {
+	rels := map[string]bool{}
+	switch rel := item["rel"].(type) {
+	case string:
+		rels[rel] = true
+	case []interface{}:
+		for _, r := range rel {
+			if s, ok := r.(string); ok {
+				rels[s] = true
+			}
+		}
+	}
+	return rels
+}
+
+// finish returns the complete package
+func (p *webpubPackager) finish() ([]byte, error) {
+	if err := p.zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish packaged publication: %w", err)
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(p.file)
+}
+
+// Close removes the temporary package
+func (p *webpubPackager) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.file.Close()
+	return os.Remove(p.file.Name())
+}
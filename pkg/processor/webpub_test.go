@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolvePackageMode(t *testing.T) {
+	for requested, expected := range map[string]string{"": packageNone, "none": packageNone, "webpub": packageWebPub, "webpub_only": packageWebPubOnly} {
+		got, err := resolvePackageMode(requested)
+		if err != nil || got != expected {
+			t.Errorf("Expected %q to resolve to %q, got %q (%v)", requested, expected, got, err)
+		}
+	}
+	if _, err := resolvePackageMode("zip"); err == nil {
+		t.Error("Expected an error for an unknown package")
+	}
+}
+
+func TestWebPubPackager(t *testing.T) {
+	uploads := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		uploads[strings.TrimPrefix(r.URL.Path, "/storage/v1/object/"+ManifestBucket+"/")] = true
+	}))
+	defer server.Close()
+
+	delta := newDeltaUploader("book", NewSupabase(server.URL, "test-key"), true)
+	pack, err := newWebPubPackager("book", false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer pack.Close()
+	delta.pack = pack
+
+	manifest := `{
+  "metadata": {"title": "Book"},
+  "links": [
+    {"href": "https://test.supabase.co/storage/v1/object/public/readium-manifests/book/manifest.json", "rel": "self"},
+    {"href": "readium/content.json", "rel": "contents"},
+    {"href": "publication.epub", "rel": "alternate", "type": "application/epub+zip"},
+    {"href": "https://example.com/license", "rel": "license"}
+  ]
+}`
+	for path, content := range map[string]string{
+		"book/OEBPS/chapter%201.xhtml": "<html/>",
+		"book/readium/content.json":    "{}",
+		"book/" + repackagedEPUBPath:   "epub",
+	} {
+		if _, err := delta.upload(strings.ReplaceAll(path, "%20", " "), []byte(content)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if _, err := delta.upload("book/manifest.json", []byte(manifest)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(uploads) != 1 || !uploads["book/"+repackagedEPUBPath] {
+		t.Errorf("Expected only the repackaged EPUB to be uploaded on its own, got %v", uploads)
+	}
+	if _, ok := delta.current["book/manifest.json"]; ok {
+		t.Error("Expected packaged-only files to stay out of the resource index")
+	}
+
+	data, err := pack.finish()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Expected a valid ZIP, got %v", err)
+	}
+	entries := map[string]*zip.File{}
+	for _, f := range zipReader.File {
+		entries[f.Name] = f
+	}
+	for _, name := range []string{"OEBPS/chapter 1.xhtml", "readium/content.json", "manifest.json"} {
+		if entries[name] == nil {
+			t.Errorf("Expected %s in the package", name)
+		}
+	}
+	if entries[repackagedEPUBPath] != nil {
+		t.Error("Expected the repackaged EPUB to stay out of the package")
+	}
+
+	manifestData, err := readZipEntry(entries["manifest.json"])
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	var packaged struct {
+		Links []struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if err := json.Unmarshal(manifestData, &packaged); err != nil {
+		t.Fatalf("Expected valid JSON, got %v", err)
+	}
+	var hrefs []string
+	for _, link := range packaged.Links {
+		hrefs = append(hrefs, link.Href)
+	}
+	if strings.Join(hrefs, " ") != "readium/content.json https://example.com/license" {
+		t.Errorf("Expected the self link and the link outside the package to be dropped, got %v", hrefs)
+	}
+}
@@ -0,0 +1,92 @@
+package processor
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+const (
+	wordsPerMinuteEnvVar  = "WORDS_PER_MINUTE"
+	defaultWordsPerMinute = 250
+	// wordsPerPage is the page size used for the numberOfPages estimate
+	wordsPerPage = 250
+)
+
+// ReadingStats summarizes the length of a publication's text
+type ReadingStats struct {
+	WordCount int `json:"word_count"`
+	// ReadingTimeMinutes is the estimated time to read the whole publication
+	ReadingTimeMinutes int `json:"reading_time_minutes"`
+	// EstimatedPages is WordCount divided into pages of wordsPerPage words
+	EstimatedPages int                `json:"estimated_pages"`
+	Chapters       []chapterWordCount `json:"chapters,omitempty"`
+}
+
+// chapterWordCount is the word count of one reading order item
+type chapterWordCount struct {
+	Href      string `json:"href"`
+	WordCount int    `json:"word_count"`
+}
+
+// countWords counts the words in text. Han, Hiragana, Katakana and Hangul
+// characters each count as one word, since those scripts don't separate words
+// with spaces.
+func countWords(text string) int {
+	count := 0
+	inWord := false
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			count++
+			inWord = false
+		case unicode.IsLetter(r) || unicode.IsNumber(r):
+			if !inWord {
+				count++
+				inWord = true
+			}
+		case unicode.IsSpace(r) || unicode.IsPunct(r) && !strings.ContainsRune("'’-", r):
+			inWord = false
+		}
+	}
+	return count
+}
+
+// computeReadingStats totals the chapter word counts and derives the estimates
+func computeReadingStats(chapters []chapterText) *ReadingStats {
+	stats := &ReadingStats{Chapters: make([]chapterWordCount, 0, len(chapters))}
+	for _, chapter := range chapters {
+		stats.WordCount += chapter.WordCount
+		stats.Chapters = append(stats.Chapters, chapterWordCount{Href: chapter.Href, WordCount: chapter.WordCount})
+	}
+
+	wordsPerMinute := defaultWordsPerMinute
+	if value, ok := envUint(wordsPerMinuteEnvVar); ok && value > 0 {
+		wordsPerMinute = int(value)
+	}
+	if stats.WordCount > 0 {
+		stats.ReadingTimeMinutes = int(math.Ceil(float64(stats.WordCount) / float64(wordsPerMinute)))
+		stats.EstimatedPages = int(math.Ceil(float64(stats.WordCount) / wordsPerPage))
+	}
+	return stats
+}
+
+// applyReadingStats adds the word count and reading time to the manifest metadata
+// (wordCount, and readingTime in seconds like duration) and fills in numberOfPages
+// when the publication doesn't declare it
+func applyReadingStats(metadata *manifest.Metadata, stats *ReadingStats) {
+	if stats.WordCount == 0 {
+		return
+	}
+	if metadata.OtherMetadata == nil {
+		metadata.OtherMetadata = map[string]interface{}{}
+	}
+	metadata.OtherMetadata["wordCount"] = stats.WordCount
+	metadata.OtherMetadata["readingTime"] = stats.ReadingTimeMinutes * 60
+	if metadata.NumberOfPages == nil {
+		pages := uint(stats.EstimatedPages)
+		metadata.NumberOfPages = &pages
+	}
+}
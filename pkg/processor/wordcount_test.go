@@ -0,0 +1,60 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/readium/go-toolkit/pkg/manifest"
+)
+
+func TestCountWords(t *testing.T) {
+	tests := map[string]int{
+		"":                                0,
+		"It was a dark and stormy night.": 7,
+		"Don’t over-think it — 42 times!": 5,
+		"  spaced\n\nout\ttext  ":         3,
+		"吾輩は猫である":                         7,
+		"Chapter 1: 東京":                   4,
+	}
+	for text, want := range tests {
+		if got := countWords(text); got != want {
+			t.Errorf("countWords(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestComputeReadingStats(t *testing.T) {
+	t.Setenv(wordsPerMinuteEnvVar, "")
+	stats := computeReadingStats([]chapterText{
+		{Href: "ch1.xhtml", WordCount: 300},
+		{Href: "ch2.xhtml", WordCount: 200},
+	})
+	if stats.WordCount != 500 || stats.ReadingTimeMinutes != 2 || stats.EstimatedPages != 2 {
+		t.Errorf("Expected 500 words, 2 minutes, 2 pages, got %+v", stats)
+	}
+	if len(stats.Chapters) != 2 || stats.Chapters[1].WordCount != 200 {
+		t.Errorf("Expected per-chapter counts, got %+v", stats.Chapters)
+	}
+
+	t.Setenv(wordsPerMinuteEnvVar, "100")
+	if stats := computeReadingStats([]chapterText{{WordCount: 500}}); stats.ReadingTimeMinutes != 5 {
+		t.Errorf("Expected 5 minutes at 100 wpm, got %d", stats.ReadingTimeMinutes)
+	}
+}
+
+func TestApplyReadingStats(t *testing.T) {
+	metadata := manifest.Metadata{}
+	applyReadingStats(&metadata, &ReadingStats{WordCount: 90000, ReadingTimeMinutes: 360, EstimatedPages: 360})
+	if metadata.OtherMetadata["wordCount"] != 90000 || metadata.OtherMetadata["readingTime"] != 21600 {
+		t.Errorf("Expected wordCount and readingTime in metadata, got %v", metadata.OtherMetadata)
+	}
+	if metadata.NumberOfPages == nil || *metadata.NumberOfPages != 360 {
+		t.Errorf("Expected estimated numberOfPages, got %v", metadata.NumberOfPages)
+	}
+
+	declared := uint(412)
+	metadata = manifest.Metadata{NumberOfPages: &declared}
+	applyReadingStats(&metadata, &ReadingStats{WordCount: 90000, ReadingTimeMinutes: 360, EstimatedPages: 360})
+	if *metadata.NumberOfPages != 412 {
+		t.Errorf("Expected declared numberOfPages to be kept, got %d", *metadata.NumberOfPages)
+	}
+}
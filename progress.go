@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	// progressIntervalEnvVar is the minimum number of seconds between two
+	// progress reports of a job
+	progressIntervalEnvVar  = "PROGRESS_INTERVAL_SECONDS"
+	defaultProgressInterval = 2 * time.Second
+	// progressTimeout bounds each report, which holds up the processing
+	progressTimeout = 5 * time.Second
+	// progressEvent is the Realtime event progress is broadcast as
+	progressEvent = "progress"
+)
+
+// progressPublisher reports the progress of a job, so the uploading UI can
+// show a progress bar rather than a spinner for minutes on very large books.
+// It broadcasts each report on the Supabase Realtime channel the request
+// named in progress_channel, and records it in the job record.
+type progressPublisher struct {
+	ctx  context.Context
+	jobs *jobStore
+	job  *jobRecord
+	// channel is the Realtime topic to broadcast on, "" for none
+	channel      string
+	broadcastURL string
+	serviceKey   string
+	client       *http.Client
+}
+
+// progressMessage is the payload of a progress broadcast
+type progressMessage struct {
+	JobID    string `json:"job_id"`
+	Filename string `json:"filename"`
+	processor.Progress
+}
+
+// newProgressPublisher returns a publisher of the progress of job, or nil when
+// there is neither a channel to broadcast on nor a job store to record it in
+func newProgressPublisher(ctx context.Context, jobs *jobStore, job *jobRecord, supabaseURL, serviceKey, channel string) *progressPublisher {
+	if jobs == nil && channel == "" {
+		return nil
+	}
+	return &progressPublisher{
+		ctx:          ctx,
+		jobs:         jobs,
+		job:          job,
+		channel:      channel,
+		broadcastURL: strings.TrimSuffix(supabaseURL, "/") + "/realtime/v1/api/broadcast",
+		serviceKey:   serviceKey,
+		client:       processor.NewHTTPClient(progressTimeout),
+	}
+}
+
+// progressIntervalFromEnv returns the minimum time between two progress
+// reports, PROGRESS_INTERVAL_SECONDS or 2 seconds
+func progressIntervalFromEnv() time.Duration {
+	value := os.Getenv(progressIntervalEnvVar)
+	if value == "" {
+		return defaultProgressInterval
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		log.Printf("Warning: ignoring invalid %s=%q", progressIntervalEnvVar, value)
+		return defaultProgressInterval
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// publish reports progress. Reporting is best-effort and never fails a job.
+func (p *progressPublisher) publish(progress processor.Progress) {
+	ctx, cancel := context.WithTimeout(p.ctx, progressTimeout)
+	defer cancel()
+
+	if p.channel != "" {
+		if err := p.broadcast(ctx, progress); err != nil {
+			log.Printf("Warning: failed to broadcast progress on %s: %v", p.channel, err)
+		}
+	}
+	p.job.Progress = &progress
+	logJobError("record progress of", p.jobs.progress(ctx, p.job))
+}
+
+// broadcast sends progress to the subscribers of the Realtime channel
+func (p *progressPublisher) broadcast(ctx context.Context, progress processor.Progress) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"messages": []map[string]interface{}{{
+			"topic":   p.channel,
+			"event":   progressEvent,
+			"payload": progressMessage{JobID: p.job.ID, Filename: p.job.Filename, Progress: progress},
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.broadcastURL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apikey", p.serviceKey)
+	req.Header.Set("Authorization", "Bearer "+p.serviceKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
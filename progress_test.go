@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestProgressPublisher_BroadcastsAndRecords(t *testing.T) {
+	var broadcast struct {
+		Messages []struct {
+			Topic   string          `json:"topic"`
+			Event   string          `json:"event"`
+			Payload progressMessage `json:"payload"`
+		} `json:"messages"`
+	}
+	realtime := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/realtime/v1/api/broadcast" {
+			t.Errorf("Expected the broadcast endpoint, got %s", r.URL.Path)
+		}
+		if r.Header.Get("apikey") != "service-key" || r.Header.Get("Authorization") != "Bearer service-key" {
+			t.Errorf("Expected the service key, got %v", r.Header)
+		}
+		json.NewDecoder(r.Body).Decode(&broadcast)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer realtime.Close()
+
+	var target string
+	var input map[string]json.RawMessage
+	dynamo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.Header.Get("X-Amz-Target")
+		json.NewDecoder(r.Body).Decode(&input)
+		w.Write([]byte("{}"))
+	}))
+	defer dynamo.Close()
+	t.Setenv(jobsTableEnvVar, "jobs")
+	t.Setenv("DYNAMODB_ENDPOINT", dynamo.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	job := &jobRecord{ID: "job-1", Filename: "books/moby-dick.epub", Status: jobStatusProcessing}
+	publisher := newProgressPublisher(context.Background(), newJobStoreFromEnv(), job, realtime.URL+"/", "service-key", "upload:42")
+	publisher.publish(processor.Progress{Done: 1, Total: 4, Bytes: 2048, Percent: 25})
+
+	if len(broadcast.Messages) != 1 {
+		t.Fatalf("Expected one broadcast message, got %+v", broadcast)
+	}
+	message := broadcast.Messages[0]
+	if message.Topic != "upload:42" || message.Event != progressEvent {
+		t.Errorf("Expected a progress event on upload:42, got %s on %s", message.Event, message.Topic)
+	}
+	if message.Payload.JobID != "job-1" || message.Payload.Filename != "books/moby-dick.epub" || message.Payload.Percent != 25 || message.Payload.Bytes != 2048 {
+		t.Errorf("Expected the job progress, got %+v", message.Payload)
+	}
+
+	if target != "DynamoDB_20120810.UpdateItem" {
+		t.Errorf("Expected UpdateItem, got %s", target)
+	}
+	var condition string
+	json.Unmarshal(input["ConditionExpression"], &condition)
+	if condition != "#status = :processing" {
+		t.Errorf("Expected the update to be conditional on the job processing, got %q", condition)
+	}
+	if job.Progress == nil || job.Progress.Done != 1 {
+		t.Errorf("Expected the progress on the job, got %+v", job.Progress)
+	}
+}
+
+func TestNewProgressPublisher_DisabledWithoutChannelOrJobs(t *testing.T) {
+	if publisher := newProgressPublisher(context.Background(), nil, &jobRecord{}, "https://example.supabase.co", "key", ""); publisher != nil {
+		t.Errorf("Expected no publisher, got %+v", publisher)
+	}
+}
+
+func TestProgressIntervalFromEnv(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":    defaultProgressInterval,
+		"0.5": 500 * time.Millisecond,
+		"10":  10 * time.Second,
+		"-1":  defaultProgressInterval,
+		"x":   defaultProgressInterval,
+	} {
+		t.Setenv(progressIntervalEnvVar, value)
+		if got := progressIntervalFromEnv(); got != want {
+			t.Errorf("Expected %s for %q, got %s", want, value, got)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	rateLimitEnvVar        = "RATE_LIMIT_PER_MINUTE"
+	rateLimitBurstEnvVar   = "RATE_LIMIT_BURST"
+	rateLimitBackendEnvVar = "RATE_LIMIT_BACKEND"
+
+	rateLimitBackendMemory   = "memory"
+	rateLimitBackendDynamoDB = "dynamodb"
+
+	// rateLimitKeyPrefix prefixes the token bucket items stored in the jobs table
+	rateLimitKeyPrefix = "ratelimit#"
+
+	// maxMemoryBuckets bounds the in-memory buckets; beyond it, full buckets are dropped
+	maxMemoryBuckets = 10000
+	// rateLimitAttempts bounds the optimistic DynamoDB updates racing other invocations
+	rateLimitAttempts = 3
+)
+
+// rateLimiter limits how often each caller may start processing jobs, with a
+// token bucket per caller
+type rateLimiter interface {
+	// allow takes a token from the caller's bucket, or reports how long until one is available
+	allow(ctx context.Context, key string) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// bucketLimits configures the token buckets
+type bucketLimits struct {
+	// rate is the number of tokens added per second
+	rate float64
+	// burst is the capacity of a bucket
+	burst float64
+}
+
+// tokenBucket is the state of one caller's bucket
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time elapsed since its last update and takes
+// a token. A zero bucket is a new, full one.
+func (l bucketLimits) take(b tokenBucket, now time.Time) (tokenBucket, bool, time.Duration) {
+	tokens := l.burst
+	if !b.updated.IsZero() {
+		tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	}
+	if tokens < 1 {
+		wait := time.Duration((1 - tokens) / l.rate * float64(time.Second))
+		return tokenBucket{tokens: tokens, updated: now}, false, wait
+	}
+	return tokenBucket{tokens: tokens - 1, updated: now}, true, 0
+}
+
+// newRateLimiterFromEnv returns a rate limiter if RATE_LIMIT_PER_MINUTE is set,
+// or nil if rate limiting is disabled. Buckets are kept in memory per execution
+// environment unless RATE_LIMIT_BACKEND is "dynamodb", which shares them across
+// environments through the jobs table (JOBS_TABLE_NAME).
+func newRateLimiterFromEnv() (rateLimiter, error) {
+	value := os.Getenv(rateLimitEnvVar)
+	if value == "" {
+		return nil, nil
+	}
+	perMinute, err := strconv.ParseFloat(value, 64)
+	if err != nil || perMinute < 0 {
+		return nil, fmt.Errorf("invalid %s %q", rateLimitEnvVar, value)
+	}
+	if perMinute == 0 {
+		return nil, nil
+	}
+	limits := bucketLimits{rate: perMinute / 60, burst: math.Max(1, perMinute)}
+	if value := os.Getenv(rateLimitBurstEnvVar); value != "" {
+		burst, err := strconv.ParseFloat(value, 64)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid %s %q: must be at least 1", rateLimitBurstEnvVar, value)
+		}
+		limits.burst = burst
+	}
+
+	switch backend := os.Getenv(rateLimitBackendEnvVar); backend {
+	case "", rateLimitBackendMemory:
+		return &memoryRateLimiter{limits: limits, buckets: memoryBuckets}, nil
+	case rateLimitBackendDynamoDB:
+		store := newJobStoreFromEnv()
+		if store == nil {
+			return nil, fmt.Errorf("%s=%s requires %s", rateLimitBackendEnvVar, backend, jobsTableEnvVar)
+		}
+		return &dynamoRateLimiter{limits: limits, store: store}, nil
+	default:
+		return nil, fmt.Errorf("invalid %s %q: must be %q or %q", rateLimitBackendEnvVar, backend, rateLimitBackendMemory, rateLimitBackendDynamoDB)
+	}
+}
+
+// bucketMap holds in-memory buckets. It outlives invocations, as warm execution
+// environments are reused.
+type bucketMap struct {
+	mu      sync.Mutex
+	buckets map[string]tokenBucket
+}
+
+var memoryBuckets = &bucketMap{buckets: map[string]tokenBucket{}}
+
+// memoryRateLimiter keeps the buckets of the current execution environment.
+// Each environment limits callers on its own, so the effective limit grows with
+// the concurrency of the function.
+type memoryRateLimiter struct {
+	limits  bucketLimits
+	buckets *bucketMap
+}
+
+func (m *memoryRateLimiter) allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	m.buckets.mu.Lock()
+	defer m.buckets.mu.Unlock()
+
+	now := time.Now()
+	if len(m.buckets.buckets) >= maxMemoryBuckets {
+		// Buckets that have refilled are the same as new ones
+		for k, b := range m.buckets.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*m.limits.rate >= m.limits.burst {
+				delete(m.buckets.buckets, k)
+			}
+		}
+	}
+	bucket, allowed, retryAfter := m.limits.take(m.buckets.buckets[key], now)
+	m.buckets.buckets[key] = bucket
+	return allowed, retryAfter, nil
+}
+
+// dynamoRateLimiter keeps the buckets in the jobs table, shared by every
+// execution environment. Concurrent updates of a bucket are detected with a
+// condition on its last update time, and retried.
+type dynamoRateLimiter struct {
+	limits bucketLimits
+	store  *jobStore
+}
+
+func (d *dynamoRateLimiter) allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	id := rateLimitKeyPrefix + key
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		var out struct {
+			Item map[string]events.DynamoDBAttributeValue `json:"Item"`
+		}
+		err := d.store.call(ctx, "GetItem", map[string]interface{}{
+			"TableName":      d.store.table,
+			"Key":            map[string]events.DynamoDBAttributeValue{"id": events.NewStringAttribute(id)},
+			"ConsistentRead": true,
+		}, &out)
+		if err != nil {
+			return false, 0, err
+		}
+
+		var previous tokenBucket
+		updated := itemString(out.Item, "updated")
+		if updated != "" {
+			previous.updated, _ = time.Parse(time.RFC3339Nano, updated)
+			if av, ok := out.Item["tokens"]; ok && av.DataType() == events.DataTypeNumber {
+				previous.tokens, _ = strconv.ParseFloat(av.Number(), 64)
+			}
+		}
+		now := time.Now()
+		bucket, allowed, retryAfter := d.limits.take(previous, now)
+
+		put := map[string]interface{}{
+			"TableName": d.store.table,
+			"Item": map[string]events.DynamoDBAttributeValue{
+				"id":      events.NewStringAttribute(id),
+				"tokens":  events.NewNumberAttribute(strconv.FormatFloat(bucket.tokens, 'f', -1, 64)),
+				"updated": events.NewStringAttribute(bucket.updated.UTC().Format(time.RFC3339Nano)),
+				// Lets a TTL on the table remove buckets once they have refilled
+				"expires_at": events.NewNumberAttribute(strconv.FormatInt(now.Unix()+int64(math.Ceil(d.limits.burst/d.limits.rate)), 10)),
+			},
+		}
+		if updated == "" {
+			put["ConditionExpression"] = "attribute_not_exists(id)"
+		} else {
+			put["ConditionExpression"] = "#updated = :updated"
+			put["ExpressionAttributeNames"] = map[string]string{"#updated": "updated"}
+			put["ExpressionAttributeValues"] = map[string]events.DynamoDBAttributeValue{":updated": events.NewStringAttribute(updated)}
+		}
+		err = d.store.call(ctx, "PutItem", put, nil)
+		if err == nil {
+			return allowed, retryAfter, nil
+		}
+		if !strings.Contains(err.Error(), "ConditionalCheckFailedException") {
+			return false, 0, err
+		}
+	}
+	return false, 0, fmt.Errorf("rate limit bucket %s is contended", key)
+}
+
+// rateLimitKey identifies the caller: by API key or bearer token when the
+// request has one (hashed, so no secret is stored), otherwise by source IP
+func rateLimitKey(request events.LambdaFunctionURLRequest) string {
+	for _, header := range []string{"X-Api-Key", "Authorization"} {
+		if value := requestHeader(request, header); value != "" {
+			sum := sha256.Sum256([]byte(value))
+			return "key:" + hex.EncodeToString(sum[:8])
+		}
+	}
+	return "ip:" + request.RequestContext.HTTP.SourceIP
+}
+
+// checkRateLimit returns a 429 response if the caller has run out of tokens, or
+// nil to go ahead. Limiter failures let the request through: rate limiting
+// protects Supabase, and must not take the function down with DynamoDB.
+func checkRateLimit(ctx context.Context, request events.LambdaFunctionURLRequest) *events.LambdaFunctionURLResponse {
+	limiter, err := newRateLimiterFromEnv()
+	if err != nil {
+		log.Printf("Warning: rate limiting disabled: %v", err)
+		return nil
+	}
+	if limiter == nil {
+		return nil
+	}
+
+	key := rateLimitKey(request)
+	allowed, retryAfter, err := limiter.allow(ctx, key)
+	if err != nil {
+		log.Printf("Warning: rate limit check failed, allowing request: %v", err)
+		return nil
+	}
+	if allowed {
+		return nil
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	log.Printf("Rate limit exceeded for %s, retry in %ds", key, seconds)
+	response := createErrorResponseWithData(429, "Too many requests, retry later", map[string]interface{}{
+		"retry_after_seconds": seconds,
+	})
+	response.Headers["Retry-After"] = strconv.Itoa(seconds)
+	return &response
+}
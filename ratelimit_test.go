@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestBucketLimits_Take(t *testing.T) {
+	limits := bucketLimits{rate: 1, burst: 2}
+	now := time.Now()
+
+	bucket, allowed, _ := limits.take(tokenBucket{}, now)
+	if !allowed || bucket.tokens != 1 {
+		t.Fatalf("Expected a new bucket to start full, got %+v", bucket)
+	}
+	bucket, allowed, _ = limits.take(bucket, now)
+	if !allowed || bucket.tokens != 0 {
+		t.Fatalf("Expected the burst to be usable, got %+v", bucket)
+	}
+	_, allowed, retryAfter := limits.take(bucket, now.Add(500*time.Millisecond))
+	if allowed || retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms for the next token, got %t and %s", allowed, retryAfter)
+	}
+	bucket, allowed, _ = limits.take(bucket, now.Add(time.Hour))
+	if !allowed || bucket.tokens != 1 {
+		t.Errorf("Expected the bucket to refill up to the burst, got %+v", bucket)
+	}
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	setupTestEnv(t)
+	previous := memoryBuckets
+	memoryBuckets = &bucketMap{buckets: map[string]tokenBucket{}}
+	t.Cleanup(func() { memoryBuckets = previous })
+	t.Setenv(rateLimitEnvVar, "1")
+
+	request := postRequest(map[string]string{"filename": "books/missing.epub"})
+	request.Headers["x-api-key"] = "client-a"
+	if response, _ := handler(context.Background(), request); response.StatusCode == 429 {
+		t.Fatal("Expected the first request through")
+	}
+	response, _ := handler(context.Background(), request)
+	if response.StatusCode != 429 || response.Headers["Retry-After"] == "" {
+		t.Fatalf("Expected 429 with Retry-After, got %d %v", response.StatusCode, response.Headers)
+	}
+
+	// Other callers have their own bucket, and monitoring isn't limited
+	request.Headers["x-api-key"] = "client-b"
+	if response, _ := handler(context.Background(), request); response.StatusCode == 429 {
+		t.Error("Expected another API key to have its own bucket")
+	}
+	if response, _ := handler(context.Background(), getRequest("/version")); response.StatusCode != 200 {
+		t.Errorf("Expected GET /version not to be limited, got %d", response.StatusCode)
+	}
+
+	// Bad configuration lets requests through rather than failing them
+	t.Setenv(rateLimitBackendEnvVar, "redis")
+	if response, _ := handler(context.Background(), request); response.StatusCode == 429 {
+		t.Error("Expected a misconfigured limiter to allow requests")
+	}
+}
+
+func TestDynamoRateLimiter_RetriesConflicts(t *testing.T) {
+	var puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") == "DynamoDB_20120810.GetItem" {
+			w.Write([]byte("{}"))
+			return
+		}
+		var input map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&input)
+		var item map[string]events.DynamoDBAttributeValue
+		json.Unmarshal(input["Item"], &item)
+		if itemString(item, "id") != rateLimitKeyPrefix+"ip:203.0.113.7" {
+			t.Errorf("Expected the bucket item, got %v", item)
+		}
+		puts++
+		// Another invocation created the bucket first
+		if puts == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException"}`))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	t.Setenv(jobsTableEnvVar, "jobs")
+	t.Setenv("DYNAMODB_ENDPOINT", server.URL)
+	t.Setenv(rateLimitEnvVar, "10")
+	t.Setenv(rateLimitBackendEnvVar, rateLimitBackendDynamoDB)
+	limiter, err := newRateLimiterFromEnv()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	allowed, _, err := limiter.allow(context.Background(), "ip:203.0.113.7")
+	if err != nil || !allowed || puts != 2 {
+		t.Errorf("Expected the conflict to be retried, got %t (%v) after %d writes", allowed, err, puts)
+	}
+}
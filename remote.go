@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	// remoteHostsEnvVar lists the hosts EPUBs may be fetched from by URL, comma
+	// separated; "*.example.com" allows every subdomain. Unset disables remote URLs.
+	remoteHostsEnvVar = "REMOTE_EPUB_HOSTS"
+	maxRedirects      = 5
+)
+
+// remoteHostsFromEnv returns the configured host allowlist
+func remoteHostsFromEnv() []string {
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv(remoteHostsEnvVar), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hostAllowed reports whether host matches an allowlist entry
+func hostAllowed(host string, allowed []string) bool {
+	host = strings.ToLower(host)
+	for _, entry := range allowed {
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRemoteURL parses an EPUB URL and checks its host against the allowlist.
+// Disallowed hosts are reported with status 403.
+func checkRemoteURL(rawURL string, allowed []string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, processor.WithStatus(400, fmt.Errorf("invalid url %q: must be an absolute http(s) URL", rawURL))
+	}
+	if len(allowed) == 0 {
+		return nil, processor.WithStatus(403, fmt.Errorf("remote URLs are disabled (set %s)", remoteHostsEnvVar))
+	}
+	if !hostAllowed(u.Hostname(), allowed) {
+		return nil, processor.WithStatus(403, fmt.Errorf("host %q is not allowed", u.Hostname()))
+	}
+	return u, nil
+}
+
+// remoteFilename derives the filename, and so the storage prefix, of a remote
+// EPUB from its URL: https://host/path/book.epub -> remote/host/path/book.epub
+func remoteFilename(u *url.URL) string {
+	return path.Join("remote", strings.ToLower(u.Hostname()), path.Clean("/"+u.Path))
+}
+
+// downloadRemoteEPUB downloads an EPUB from an allowed host to a temporary file,
+// refusing files larger than maxBytes. Redirects are followed only to allowed
+// hosts, and the whole download is bounded by timeout (0 for no bound). The
+// caller must Close the returned source.
+func downloadRemoteEPUB(rawURL string, allowed []string, maxBytes int64, timeout time.Duration) (*processor.Source, error) {
+	u, err := checkRemoteURL(rawURL, allowed)
+	if err != nil {
+		return nil, err
+	}
+	client := processor.NewHTTPClient(timeout)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return errors.New("too many redirects")
+		}
+		if !hostAllowed(req.URL.Hostname(), allowed) {
+			return fmt.Errorf("redirect to host %q is not allowed", req.URL.Hostname())
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Readium-Processor-Lambda/1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, processor.WithStatus(502, fmt.Errorf("failed to fetch %s: %w", rawURL, err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, processor.WithStatus(502, fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(body)))
+	}
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, processor.EPUBTooLargeError(resp.ContentLength, maxBytes)
+	}
+
+	source, err := processor.SpoolEPUB(resp.Body, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := source.CheckFormat(u.Path); err != nil {
+		source.Close()
+		return nil, err
+	}
+	return source, nil
+}
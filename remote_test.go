@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"www.gutenberg.org", "*.cdn.example.com"}
+	tests := map[string]bool{
+		"www.gutenberg.org":     true,
+		"WWW.Gutenberg.org":     true,
+		"gutenberg.org":         false,
+		"books.cdn.example.com": true,
+		"cdn.example.com":       false,
+		"evilcdn.example.com":   false,
+	}
+	for host, expected := range tests {
+		if got := hostAllowed(host, allowed); got != expected {
+			t.Errorf("Expected hostAllowed(%q) to be %t, got %t", host, expected, got)
+		}
+	}
+}
+
+func TestCheckRemoteURL(t *testing.T) {
+	allowed := []string{"www.gutenberg.org"}
+	tests := []struct {
+		url     string
+		allowed []string
+		status  int
+	}{
+		{"https://www.gutenberg.org/ebooks/2701.epub3.images", allowed, 0},
+		{"ftp://www.gutenberg.org/book.epub", allowed, 400},
+		{"/book.epub", allowed, 400},
+		{"https://169.254.169.254/latest", allowed, 403},
+		{"https://www.gutenberg.org/book.epub", nil, 403},
+	}
+	for _, tt := range tests {
+		_, err := checkRemoteURL(tt.url, tt.allowed)
+		status := 0
+		if err != nil {
+			status = processor.StatusCode(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected status %d for %s, got %d (%v)", tt.status, tt.url, status, err)
+		}
+	}
+
+	u, _ := url.Parse("https://www.gutenberg.org/ebooks/../ebooks/2701.epub?download=1")
+	if got := remoteFilename(u); got != "remote/www.gutenberg.org/ebooks/2701.epub" {
+		t.Errorf("Expected remote/www.gutenberg.org/ebooks/2701.epub, got %q", got)
+	}
+}
+
+func TestDownloadRemoteEPUB(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/book.epub":
+			w.Write(testEPUBBytes(t))
+		case "/moved.epub":
+			http.Redirect(w, r, "/book.epub", http.StatusFound)
+		case "/elsewhere.epub":
+			http.Redirect(w, r, "http://example.com/book.epub", http.StatusFound)
+		case "/page.html":
+			w.Write([]byte("<html></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	allowed := []string{strings.Split(strings.TrimPrefix(server.URL, "http://"), ":")[0]}
+
+	source, err := downloadRemoteEPUB(server.URL+"/moved.epub", allowed, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	source.Close()
+
+	for path, expected := range map[string]int{"/elsewhere.epub": 502, "/missing.epub": 502, "/page.html": 415} {
+		if source, err := downloadRemoteEPUB(server.URL+path, allowed, 0, time.Minute); err == nil {
+			source.Close()
+			t.Errorf("Expected an error for %s", path)
+		} else if status := processor.StatusCode(err); status != expected {
+			t.Errorf("Expected status %d for %s, got %d (%v)", expected, path, status, err)
+		}
+	}
+
+	if _, err := downloadRemoteEPUB(server.URL+"/book.epub", allowed, 8, time.Minute); processor.StatusCode(err) != 413 {
+		t.Errorf("Expected status 413 for an oversized EPUB, got %v", err)
+	}
+}
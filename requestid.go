@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/google/uuid"
+)
+
+// requestIDHeader carries the correlation ID of a request, both ways
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds caller-supplied IDs, which end up in every log line
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// requestIDFor returns the caller's X-Request-ID, or generates one when the
+// header is missing or unusable. Generated IDs reuse the Lambda request ID,
+// so they also match the START/END lines Lambda logs itself.
+func requestIDFor(ctx context.Context, request events.LambdaFunctionURLRequest) string {
+	if id := requestHeader(request, requestIDHeader); validRequestID(id) {
+		return id
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	return uuid.NewString()
+}
+
+// validRequestID accepts IDs made of printable ASCII without spaces, so they
+// can't break log lines or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID returns ctx carrying the request ID
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequestID prefixes every log line with the request ID until the returned
+// function is called. The prefix is global, which is fine since an execution
+// environment handles one invocation at a time (and serve does the same).
+func logRequestID(id string) func() {
+	prefix, flags := log.Prefix(), log.Flags()
+	log.SetPrefix("[" + id + "] ")
+	log.SetFlags(flags | log.Lmsgprefix)
+	return func() {
+		log.SetPrefix(prefix)
+		log.SetFlags(flags)
+	}
+}
+
+// tagResponse adds the request ID to the response headers, and to the body of
+// JSON object responses as "request_id"
+func tagResponse(response events.LambdaFunctionURLResponse, id string) events.LambdaFunctionURLResponse {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers[requestIDHeader] = id
+
+	if response.Headers["Content-Type"] != "application/json" || response.IsBase64Encoded {
+		return response
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil || body == nil {
+		return response
+	}
+	body["request_id"], _ = json.Marshal(id)
+	tagged, err := json.Marshal(body)
+	if err != nil {
+		return response
+	}
+	response.Body = string(tagged)
+	return response
+}
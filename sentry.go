@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	sentryDSNEnvVar         = "SENTRY_DSN"
+	sentryEnvironmentEnvVar = "SENTRY_ENVIRONMENT"
+	sentryTimeout           = 3 * time.Second
+	sentryModulePrefix      = "readium-processor-lambda"
+)
+
+// sentryReporter sends processing failures to Sentry, or any service accepting
+// Sentry envelopes (GlitchTip, self-hosted Sentry, ...). It talks to the
+// envelope endpoint directly, so the function carries no SDK.
+type sentryReporter struct {
+	dsn         string
+	endpoint    string
+	publicKey   string
+	environment string
+	client      *http.Client
+}
+
+// failureReport is what is known about a failed job
+type failureReport struct {
+	err      error
+	status   int
+	filename string
+	jobID    string
+	// phase is where the job failed, unless the processor reports a finer one
+	phase string
+}
+
+// newSentryReporterFromEnv returns a reporter if SENTRY_DSN is set, or nil if
+// error reporting is disabled. report is a no-op on a nil reporter. The
+// reporter is built once per execution environment (see cachedFromEnv).
+func newSentryReporterFromEnv() *sentryReporter {
+	return cachedFromEnv("sentry", []string{sentryDSNEnvVar, sentryEnvironmentEnvVar}, buildSentryReporter)
+}
+
+// buildSentryReporter builds the reporter configured by the environment
+func buildSentryReporter() *sentryReporter {
+	dsn := os.Getenv(sentryDSNEnvVar)
+	if dsn == "" {
+		return nil
+	}
+	reporter, err := newSentryReporter(dsn)
+	if err != nil {
+		log.Printf("Warning: error reporting disabled: %v", err)
+		return nil
+	}
+	reporter.environment = os.Getenv(sentryEnvironmentEnvVar)
+	return reporter
+}
+
+// newSentryReporter parses a DSN of the form {scheme}://{public_key}@{host}/{path}/{project_id}
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", sentryDSNEnvVar, err)
+	}
+	publicKey := u.User.Username()
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if u.Host == "" || publicKey == "" || slash < 0 || path[slash+1:] == "" {
+		return nil, fmt.Errorf("invalid %s: expected {scheme}://{public_key}@{host}/{project_id}", sentryDSNEnvVar)
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path[:slash], path[slash+1:])
+	return &sentryReporter{
+		dsn:       dsn,
+		endpoint:  endpoint,
+		publicKey: publicKey,
+		client:    processor.NewHTTPClient(sentryTimeout),
+	}, nil
+}
+
+// report sends a failure to Sentry. Reporting is best-effort: errors are logged
+// and never change the response. It waits for the upload, since Lambda freezes
+// the environment as soon as the handler returns.
+func (s *sentryReporter) report(ctx context.Context, failure failureReport) {
+	if s == nil {
+		return
+	}
+	event := s.event(ctx, failure)
+	if err := s.send(ctx, event); err != nil {
+		log.Printf("Warning: failed to report error to Sentry: %v", err)
+		return
+	}
+	log.Printf("Reported error to Sentry as event %s", event["event_id"])
+}
+
+// event builds the Sentry event for a failure: the error chain as exceptions,
+// the stack trace of panics, and the job and publication as tags and contexts
+func (s *sentryReporter) event(ctx context.Context, failure failureReport) map[string]interface{} {
+	tags := map[string]string{
+		"filename": failure.filename,
+		"job_id":   failure.jobID,
+		"phase":    failure.phase,
+		"status":   strconv.Itoa(failure.status),
+	}
+	if requestID := requestIDFrom(ctx); requestID != "" {
+		tags["request_id"] = requestID
+	}
+	contexts := map[string]interface{}{}
+
+	exceptions := errorChain(failure.err)
+	if details := processor.FailureOf(failure.err); details != nil {
+		if details.Phase != "" {
+			tags["phase"] = details.Phase
+		}
+		if details.Publication != nil {
+			contexts["publication"] = details.Publication
+		}
+		if len(details.Stack) > 0 {
+			// The panic is the innermost error, which comes first
+			exceptions[0]["stacktrace"] = map[string]interface{}{"frames": stackFrames(details.Stack)}
+			exceptions[0]["mechanism"] = map[string]interface{}{"type": "panic", "handled": false}
+		}
+	}
+
+	event := map[string]interface{}{
+		"event_id":  strings.ReplaceAll(uuid.NewString(), "-", ""),
+		"timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"platform":  "go",
+		"level":     "error",
+		"logger":    sentryModulePrefix,
+		"message":   map[string]string{"formatted": failure.err.Error()},
+		"exception": map[string]interface{}{"values": exceptions},
+		"tags":      tags,
+		"contexts":  contexts,
+	}
+	if release := currentVersion().GitCommit; release != "" {
+		event["release"] = release
+	}
+	if s.environment != "" {
+		event["environment"] = s.environment
+	}
+	if name := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); name != "" {
+		event["server_name"] = name
+	}
+	return event
+}
+
+// send posts the event as an envelope
+func (s *sentryReporter) send(ctx context.Context, event map[string]interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	header, _ := json.Marshal(map[string]string{
+		"event_id": event["event_id"].(string),
+		"dsn":      s.dsn,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	itemHeader, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(payload)})
+	var envelope bytes.Buffer
+	for _, line := range [][]byte{header, itemHeader, payload} {
+		envelope.Write(line)
+		envelope.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sentryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint, &envelope)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s/1.0, sentry_key=%s", sentryModulePrefix, s.publicKey))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// errorChain converts err and the errors it wraps to Sentry exceptions,
+// innermost first as Sentry expects. Wrappers that add nothing to the message
+// are folded into the error they wrap.
+func errorChain(err error) []map[string]interface{} {
+	var exceptions []map[string]interface{}
+	previous := ""
+	for ; err != nil; err = errors.Unwrap(err) {
+		message := err.Error()
+		if len(exceptions) > 0 && message == previous {
+			exceptions[0]["type"] = fmt.Sprintf("%T", err)
+			continue
+		}
+		previous = message
+		exceptions = append([]map[string]interface{}{{
+			"type":  fmt.Sprintf("%T", err),
+			"value": message,
+		}}, exceptions...)
+	}
+	return exceptions
+}
+
+// stackFrames converts program counters to Sentry frames, outermost first
+func stackFrames(stack []uintptr) []map[string]interface{} {
+	var frames []map[string]interface{}
+	callers := runtime.CallersFrames(stack)
+	for {
+		frame, more := callers.Next()
+		frames = append([]map[string]interface{}{{
+			"function": frame.Function,
+			"abs_path": frame.File,
+			"lineno":   frame.Line,
+			"in_app":   strings.HasPrefix(frame.Function, sentryModulePrefix),
+		}}, frames...)
+		if !more {
+			break
+		}
+	}
+	return frames
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestNewSentryReporter(t *testing.T) {
+	reporter, err := newSentryReporter("https://abc123@o1.ingest.sentry.io/42")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reporter.endpoint != "https://o1.ingest.sentry.io/api/42/envelope/" || reporter.publicKey != "abc123" {
+		t.Errorf("Expected the envelope endpoint and key, got %s and %s", reporter.endpoint, reporter.publicKey)
+	}
+
+	reporter, err = newSentryReporter("http://key@localhost:9000/sentry/7")
+	if err != nil || reporter.endpoint != "http://localhost:9000/sentry/api/7/envelope/" {
+		t.Errorf("Expected the path prefix to be kept, got %+v (%v)", reporter, err)
+	}
+
+	for _, dsn := range []string{"https://o1.ingest.sentry.io/42", "https://key@o1.ingest.sentry.io/", "not a url"} {
+		if _, err := newSentryReporter(dsn); err == nil {
+			t.Errorf("Expected an error for %q", dsn)
+		}
+	}
+}
+
+func TestErrorChain(t *testing.T) {
+	inner := errors.New("zip: not a valid zip file")
+	err := fmt.Errorf("failed to parse EPUB: %w", inner)
+
+	exceptions := errorChain(err)
+	if len(exceptions) != 2 {
+		t.Fatalf("Expected 2 exceptions, got %d", len(exceptions))
+	}
+	if exceptions[0]["value"] != inner.Error() || exceptions[1]["value"] != err.Error() {
+		t.Errorf("Expected the innermost error first, got %v", exceptions)
+	}
+}
+
+func TestHandler_ReportsFailuresToSentry(t *testing.T) {
+	supabase := setupTestEnv(t)
+	events := make(chan map[string]interface{}, 1)
+	sentry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=public") {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		// Envelope header, item header, then the event
+		scanner := bufio.NewScanner(r.Body)
+		var lines []string
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		var event map[string]interface{}
+		if len(lines) == 3 && json.Unmarshal([]byte(lines[2]), &event) == nil {
+			events <- event
+		}
+	}))
+	defer sentry.Close()
+	t.Setenv(sentryDSNEnvVar, strings.Replace(sentry.URL, "http://", "http://public@", 1)+"/42")
+
+	response, _ := handler(context.Background(), postRequest(map[string]string{"filename": "books/missing.epub"}))
+	if response.StatusCode != 500 {
+		t.Fatalf("Expected status 500, got %d", response.StatusCode)
+	}
+	select {
+	case event := <-events:
+		tags, _ := event["tags"].(map[string]interface{})
+		if tags["filename"] != "books/missing.epub" || tags["phase"] != "fetch" || tags["request_id"] == "" {
+			t.Errorf("Expected the filename, phase and request ID as tags, got %v", tags)
+		}
+	default:
+		t.Fatal("Expected the failure to be reported")
+	}
+
+	// Client errors are the caller's problem and aren't reported
+	supabase.Put(processor.EPUBBucket, "books/huge.epub", testEPUBBytes(t))
+	t.Setenv("MAX_EPUB_BYTES", "10")
+	response, _ = handler(context.Background(), postRequest(map[string]string{"filename": "books/huge.epub"}))
+	if response.StatusCode != 413 || len(events) != 0 {
+		t.Errorf("Expected an unreported 413, got %d and %d reports", response.StatusCode, len(events))
+	}
+}
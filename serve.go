@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultServeAddr is where --serve listens unless --addr says otherwise
+const defaultServeAddr = "localhost:8080"
+
+// serve runs the handler behind net/http for local development, so it can be
+// called with curl without deploying or faking Function URL events:
+//
+//	go run . --serve
+//	curl -X POST localhost:8080 -d '{"filename": "books/moby-dick.epub"}'
+//
+// Unlike the Lambda, the server also exposes its metrics on GET /metrics.
+func serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+metricsPath, serveMetrics)
+	mux.HandleFunc("/", serveHTTP)
+	log.Printf("Serving on http://%s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// serveMu serializes requests, as Lambda runs one invocation at a time per
+// execution environment (the handler relies on it for its log prefix)
+var serveMu sync.Mutex
+
+// serveHTTP converts an HTTP request to a Function URL event and writes back the
+// response, counting it in requestMetrics
+func serveHTTP(w http.ResponseWriter, r *http.Request) {
+	request, err := functionURLRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveMu.Lock()
+	start := time.Now()
+	response, err := handler(r.Context(), request)
+	duration := time.Since(start)
+	serveMu.Unlock()
+	if err != nil {
+		requestMetrics.observe(metricsRoute(request), http.StatusInternalServerError, duration)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	requestMetrics.observe(metricsRoute(request), response.StatusCode, duration)
+	writeFunctionURLResponse(w, response)
+}
+
+// functionURLRequest builds the event Lambda would send for r. As with Function
+// URLs, header names are lower-cased, repeated values are joined with commas,
+// and bodies that aren't valid UTF-8 are base64-encoded.
+func functionURLRequest(r *http.Request) (events.LambdaFunctionURLRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return events.LambdaFunctionURLRequest{}, err
+	}
+
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	query := map[string]string{}
+	for name, values := range r.URL.Query() {
+		query[name] = strings.Join(values, ",")
+	}
+	sourceIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	request := events.LambdaFunctionURLRequest{
+		Version:               "2.0",
+		RawPath:               r.URL.Path,
+		RawQueryString:        r.URL.RawQuery,
+		Headers:               headers,
+		QueryStringParameters: query,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Protocol:  r.Proto,
+				SourceIP:  sourceIP,
+				UserAgent: r.UserAgent(),
+			},
+		},
+	}
+	if utf8.Valid(body) {
+		request.Body = string(body)
+	} else {
+		request.Body = base64.StdEncoding.EncodeToString(body)
+		request.IsBase64Encoded = true
+	}
+	return request, nil
+}
+
+// writeFunctionURLResponse writes a Function URL response to w
+func writeFunctionURLResponse(w http.ResponseWriter, response events.LambdaFunctionURLResponse) {
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	for _, cookie := range response.Cookies {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	body := []byte(response.Body)
+	if response.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(response.Body)
+		if err != nil {
+			http.Error(w, "invalid base64 response body", http.StatusInternalServerError)
+			return
+		}
+		body = decoded
+	}
+	w.WriteHeader(response.StatusCode)
+	w.Write(body)
+}
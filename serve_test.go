@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestFunctionURLRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/upload?filename=a.epub&tag=x&tag=y", bytes.NewReader([]byte{'P', 'K', 0xff, 0x00}))
+	r.Header.Set("Content-Type", "application/epub+zip")
+	r.Header.Add("X-Tag", "one")
+	r.Header.Add("X-Tag", "two")
+
+	request, err := functionURLRequest(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if request.RequestContext.HTTP.Method != "POST" || request.RawPath != "/upload" {
+		t.Errorf("Expected POST /upload, got %s %s", request.RequestContext.HTTP.Method, request.RawPath)
+	}
+	if request.Headers["content-type"] != "application/epub+zip" || request.Headers["x-tag"] != "one,two" {
+		t.Errorf("Expected lower-cased, joined headers, got %v", request.Headers)
+	}
+	if request.QueryStringParameters["filename"] != "a.epub" || request.QueryStringParameters["tag"] != "x,y" {
+		t.Errorf("Expected query parameters, got %v", request.QueryStringParameters)
+	}
+	if decoded, _ := base64.StdEncoding.DecodeString(request.Body); !request.IsBase64Encoded || !bytes.Equal(decoded, []byte{'P', 'K', 0xff, 0x00}) {
+		t.Errorf("Expected the binary body to be base64-encoded, got %q", request.Body)
+	}
+
+	request, _ = functionURLRequest(httptest.NewRequest("POST", "/", strings.NewReader(`{"filename": "a.epub"}`)))
+	if request.IsBase64Encoded || request.Body != `{"filename": "a.epub"}` {
+		t.Errorf("Expected a text body to be passed as is, got %q", request.Body)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	serveHTTP(recorder, httptest.NewRequest("PUT", "/", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the handler's 405 JSON response, got %d %v", recorder.Code, recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	writeFunctionURLResponse(recorder, events.LambdaFunctionURLResponse{
+		StatusCode:      201,
+		Body:            base64.StdEncoding.EncodeToString([]byte("binary")),
+		IsBase64Encoded: true,
+		Cookies:         []string{"a=1", "b=2"},
+	})
+	if recorder.Code != 201 || recorder.Body.String() != "binary" || len(recorder.Header().Values("Set-Cookie")) != 2 {
+		t.Errorf("Expected a decoded body and cookies, got %d %q %v", recorder.Code, recorder.Body.String(), recorder.Header())
+	}
+}
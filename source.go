@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// handleSource tells whether an EPUB changed since its publication was last
+// processed, from the ETag and Last-Modified of the stored object, so
+// schedulers can decide to reprocess it without downloading it:
+//
+//	GET /source?filename=books/moby-dick.epub
+//
+// A request whose If-None-Match or If-Modified-Since still matches the EPUB is
+// answered with a 304 without a body.
+func handleSource(ctx context.Context, request events.LambdaFunctionURLRequest) events.LambdaFunctionURLResponse {
+	filename := strings.TrimPrefix(request.QueryStringParameters["filename"], "/")
+	if filename == "" {
+		return createErrorResponse(400, "Missing 'filename' query parameter")
+	}
+	if strings.Contains(filename, "..") {
+		return createErrorResponse(400, "Invalid filename: path traversal not allowed")
+	}
+
+	tenant, err := tenantFor(request)
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
+	}
+	supabaseURL, supabaseServiceKey := tenant.supabaseConfig()
+	if supabaseURL == "" || supabaseServiceKey == "" {
+		return createErrorResponse(500, "SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set")
+	}
+	store, err := tenant.storage(processor.NewSupabase(supabaseURL, supabaseServiceKey).WithRequestID(requestIDFrom(ctx)))
+	if err != nil {
+		return createErrorResponse(processor.StatusCode(err), err.Error())
+	}
+	proc := processor.New(store, store)
+
+	// The publication may have been processed under either storage layout: the
+	// first one it was processed under answers
+	var check *processor.SourceCheck
+	for _, basePath := range processor.BasePaths(filename) {
+		check, err = proc.CheckSource(filename, basePath)
+		if err != nil {
+			log.Printf("Error checking EPUB version: %v", err)
+			return createErrorResponse(processor.StatusCode(err), err.Error())
+		}
+		if check.Processed != nil {
+			break
+		}
+	}
+
+	headers := map[string]string{"Cache-Control": "no-cache"}
+	if check.Current.ETag != "" {
+		headers["ETag"] = check.Current.ETag
+	}
+	if !check.Current.LastModified.IsZero() {
+		headers["Last-Modified"] = check.Current.LastModified.Format(http.TimeFormat)
+	}
+	if notModified(request, check.Current) {
+		return events.LambdaFunctionURLResponse{StatusCode: 304, Headers: headers}
+	}
+	response := createSuccessResponse("EPUB version checked", check)
+	for name, value := range headers {
+		response.Headers[name] = value
+	}
+	return response
+}
+
+// notModified reports whether the conditional headers of a request still match
+// version. If-None-Match takes precedence over If-Modified-Since, as in HTTP.
+func notModified(request events.LambdaFunctionURLRequest, version *processor.SourceVersion) bool {
+	if ifNoneMatch := requestHeader(request, "If-None-Match"); ifNoneMatch != "" {
+		return version.ETag != "" && processor.ETagMatches(ifNoneMatch, version.ETag)
+	}
+	since, err := http.ParseTime(requestHeader(request, "If-Modified-Since"))
+	if err != nil || version.LastModified.IsZero() {
+		return false
+	}
+	return !version.LastModified.After(since)
+}
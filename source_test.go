@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestHandler_Source(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+
+	request := getRequest("/source")
+	request.QueryStringParameters = map[string]string{"filename": "books/moby-dick.epub"}
+	response, _ := handler(context.Background(), request)
+	if response.StatusCode != 200 || !strings.Contains(response.Body, `"needs_processing":true`) {
+		t.Fatalf("Expected an unprocessed EPUB to need processing, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	if response, _ := handler(context.Background(), postRequest(map[string]interface{}{"filename": "books/moby-dick.epub"})); response.StatusCode != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	response, _ = handler(context.Background(), request)
+	var body struct {
+		Data processor.SourceCheck `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil || body.Data.NeedsProcessing || body.Data.Processed == nil {
+		t.Fatalf("Expected the processed EPUB to be up to date, got %d: %s", response.StatusCode, response.Body)
+	}
+	etag := response.Headers["ETag"]
+	if etag == "" || etag != body.Data.Current.ETag || response.Headers["Last-Modified"] == "" {
+		t.Errorf("Expected the version of the EPUB in the headers, got %v", response.Headers)
+	}
+
+	request.Headers = map[string]string{"if-none-match": etag}
+	if response, _ := handler(context.Background(), request); response.StatusCode != 304 || response.Body != "" {
+		t.Errorf("Expected 304 for an unchanged EPUB, got %d: %s", response.StatusCode, response.Body)
+	}
+	request.Headers = map[string]string{"if-modified-since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}
+	if response, _ := handler(context.Background(), request); response.StatusCode != 304 {
+		t.Errorf("Expected 304 for an EPUB not modified since, got %d", response.StatusCode)
+	}
+
+	request.QueryStringParameters = map[string]string{"filename": "books/gone.epub"}
+	request.Headers = nil
+	if response, _ := handler(context.Background(), request); response.StatusCode != 404 {
+		t.Errorf("Expected 404 for a missing EPUB, got %d", response.StatusCode)
+	}
+}
+
+func TestHandler_IfModified(t *testing.T) {
+	supabase := setupTestEnv(t)
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", testEPUBBytes(t))
+	request := postRequest(map[string]interface{}{"filename": "books/moby-dick.epub", "if_modified": true})
+
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 || !strings.Contains(response.Body, "EPUB processed successfully") {
+		t.Fatalf("Expected an unprocessed EPUB to be processed, got %d: %s", response.StatusCode, response.Body)
+	}
+	downloads := supabase.Downloads(processor.EPUBBucket, "books/moby-dick.epub")
+	response, _ := handler(context.Background(), request)
+	if response.StatusCode != 200 || !strings.Contains(response.Body, "EPUB already processed") || !strings.Contains(response.Body, "books_moby-dick/manifest.json") {
+		t.Errorf("Expected an unchanged EPUB to be skipped, got %d: %s", response.StatusCode, response.Body)
+	}
+	if got := supabase.Downloads(processor.EPUBBucket, "books/moby-dick.epub"); got != downloads {
+		t.Errorf("Expected the unchanged EPUB not to be downloaded again, got %d downloads after %d", got, downloads)
+	}
+
+	// A new version of the EPUB is processed again
+	supabase.Put(processor.EPUBBucket, "books/moby-dick.epub", append(testEPUBBytes(t), ' '))
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 || !strings.Contains(response.Body, "EPUB processed successfully") {
+		t.Errorf("Expected a modified EPUB to be processed, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	t.Setenv("REMOTE_EPUB_HOSTS", "example.com")
+	bad := postRequest(map[string]interface{}{"url": "https://example.com/moby.epub", "if_modified": true})
+	if response, _ := handler(context.Background(), bad); response.StatusCode != 400 {
+		t.Errorf("Expected status 400 for a remote EPUB, got %d: %s", response.StatusCode, response.Body)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+const (
+	// tenantsConfigEnvVar holds the tenants of a multi-tenant deployment as a
+	// JSON object keyed by tenant ID (see tenant). Once set, every request must
+	// identify its tenant and SUPABASE_URL is only used for the admin routes.
+	tenantsConfigEnvVar = "TENANTS_CONFIG"
+	// tenantClaimEnvVar is the JWT claim naming the tenant (default "tenant_id")
+	tenantClaimEnvVar  = "TENANT_JWT_CLAIM"
+	defaultTenantClaim = "tenant_id"
+	// tenantHeader names the tenant of requests authenticated by API key
+	tenantHeader = "X-Tenant-ID"
+)
+
+// tenant is an app served by a multi-tenant deployment, with its own Supabase
+// project or buckets. Its requests authenticate with a JWT signed (HS256) with
+// JWTSecret, whose tenant claim names it, or with X-Tenant-ID and APIKey as
+// X-Api-Key.
+type tenant struct {
+	ID          string `json:"-"`
+	SupabaseURL string `json:"supabase_url"`
+	ServiceKey  string `json:"service_role_key"`
+	// ReadKey downloads the EPUBs instead of ServiceKey (see SUPABASE_READ_KEY)
+	ReadKey        string `json:"read_key,omitempty"`
+	EPUBBucket     string `json:"epub_bucket,omitempty"`
+	ManifestBucket string `json:"manifest_bucket,omitempty"`
+	// PathPrefix is prepended to every path in the buckets, e.g. "acme/", for
+	// tenants sharing them
+	PathPrefix string `json:"path_prefix,omitempty"`
+	JWTSecret  string `json:"jwt_secret,omitempty"`
+	APIKey     string `json:"api_key,omitempty"`
+	// S3 transfers the objects of the tenant through the S3-compatible endpoint
+	// of its project (see STORAGE_PROTOCOL)
+	S3 *processor.S3Config `json:"s3,omitempty"`
+}
+
+// tenantRegistry holds the tenants of TENANTS_CONFIG, or the error parsing it
+type tenantRegistry struct {
+	tenants map[string]*tenant
+	err     error
+}
+
+// tenantsFromEnv returns the tenants of TENANTS_CONFIG, or nil for a
+// single-tenant deployment. The config is parsed once per execution
+// environment (see cachedFromEnv).
+func tenantsFromEnv() (map[string]*tenant, error) {
+	registry := cachedFromEnv("tenants", []string{tenantsConfigEnvVar}, func() tenantRegistry {
+		tenants, err := parseTenants(os.Getenv(tenantsConfigEnvVar))
+		if err != nil {
+			log.Printf("Error: invalid %s: %v", tenantsConfigEnvVar, err)
+		}
+		return tenantRegistry{tenants: tenants, err: err}
+	})
+	return registry.tenants, registry.err
+}
+
+// parseTenants parses a tenants config, checking every tenant can be
+// authenticated and stored
+func parseTenants(config string) (map[string]*tenant, error) {
+	if config == "" {
+		return nil, nil
+	}
+	var tenants map[string]*tenant
+	if err := json.Unmarshal([]byte(config), &tenants); err != nil {
+		return nil, err
+	}
+	if len(tenants) == 0 {
+		return nil, errors.New("no tenants")
+	}
+	for id, t := range tenants {
+		switch {
+		case t == nil || t.SupabaseURL == "" || t.ServiceKey == "":
+			return nil, fmt.Errorf("tenant %q needs supabase_url and service_role_key", id)
+		case t.JWTSecret == "" && t.APIKey == "":
+			return nil, fmt.Errorf("tenant %q needs a jwt_secret or an api_key", id)
+		case t.PathPrefix != "" && (!strings.HasSuffix(t.PathPrefix, "/") || strings.HasPrefix(t.PathPrefix, "/") || strings.Contains(t.PathPrefix, "..")):
+			return nil, fmt.Errorf("tenant %q has an invalid path_prefix %q: it must be relative and end with a slash", id, t.PathPrefix)
+		}
+		if t.S3 != nil {
+			if err := t.S3.Validate(); err != nil {
+				return nil, fmt.Errorf("tenant %q has an invalid s3 config: %w", id, err)
+			}
+		}
+		t.ID = id
+	}
+	return tenants, nil
+}
+
+// tenantFor returns the tenant the request authenticates as, or nil for a
+// single-tenant deployment. Requests to a multi-tenant deployment without
+// valid credentials fail with 401.
+func tenantFor(request events.LambdaFunctionURLRequest) (*tenant, error) {
+	tenants, err := tenantsFromEnv()
+	if err != nil {
+		return nil, processor.WithStatus(500, fmt.Errorf("invalid %s: %w", tenantsConfigEnvVar, err))
+	}
+	if tenants == nil {
+		return nil, nil
+	}
+
+	if token, ok := strings.CutPrefix(requestHeader(request, "Authorization"), "Bearer "); ok && strings.Count(token, ".") == 2 {
+		t, err := tenantFromJWT(tenants, token, time.Now())
+		if err != nil {
+			return nil, processor.WithStatus(401, err)
+		}
+		return t, nil
+	}
+	if id := requestHeader(request, tenantHeader); id != "" {
+		t, ok := tenants[id]
+		key := requestHeader(request, "X-Api-Key")
+		if !ok || t.APIKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(t.APIKey)) != 1 {
+			return nil, processor.WithStatus(401, fmt.Errorf("invalid API key for tenant %q", id))
+		}
+		return t, nil
+	}
+	return nil, processor.WithStatus(401, fmt.Errorf("missing tenant credentials: send a tenant JWT as bearer token, or %s and X-Api-Key", tenantHeader))
+}
+
+// tenantFromJWT verifies an HS256 JWT with the secret of the tenant its claim
+// names, and returns that tenant
+func tenantFromJWT(tenants map[string]*tenant, token string, now time.Time) (*tenant, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", header.Alg)
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	claim := os.Getenv(tenantClaimEnvVar)
+	if claim == "" {
+		claim = defaultTenantClaim
+	}
+	id, _ := claims[claim].(string)
+	t, ok := tenants[id]
+	if !ok || t.JWTSecret == "" {
+		return nil, fmt.Errorf("JWT names no known tenant in its %q claim", claim)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, []byte(t.JWTSecret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid JWT signature")
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.Unix() >= int64(exp) {
+		return nil, errors.New("expired JWT")
+	}
+	return t, nil
+}
+
+// decodeJWTPart decodes a base64url-encoded JSON part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// supabaseConfig returns the Supabase project of the tenant, or the one of
+// SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY for a single-tenant deployment
+func (t *tenant) supabaseConfig() (string, string) {
+	if t == nil {
+		return os.Getenv(supabaseURLEnvVar), os.Getenv(supabaseServiceKeyEnvVar)
+	}
+	return t.SupabaseURL, t.ServiceKey
+}
+
+// storage scopes store to the buckets, path prefix, read key and S3 keys of the
+// tenant, or gives it the read key of SUPABASE_READ_KEY and the S3 keys of
+// STORAGE_PROTOCOL for a single-tenant deployment. Either way it uploads as
+// UPLOAD_MODE says.
+func (t *tenant) storage(store *processor.Supabase) (*processor.Supabase, error) {
+	workers, err := processor.SignedUploadsFromEnv()
+	if err != nil {
+		return nil, processor.WithStatus(500, err)
+	}
+	store = store.WithSignedUploads(workers)
+	if t == nil {
+		s3, err := processor.S3ConfigFromEnv()
+		if err != nil {
+			return nil, processor.WithStatus(500, err)
+		}
+		return store.WithReadKey(os.Getenv(supabaseReadKeyEnvVar)).WithS3(s3), nil
+	}
+	return store.WithTenant(t.EPUBBucket, t.ManifestBucket, t.PathPrefix).WithReadKey(t.ReadKey).WithS3(t.S3), nil
+}
+
+// id returns the ID of the tenant, or "" for a single-tenant deployment
+func (t *tenant) id() string {
+	if t == nil {
+		return ""
+	}
+	return t.ID
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+	"readium-processor-lambda/pkg/processor/processortest"
+)
+
+// testJWT returns an HS256 JWT with claims, signed with secret
+func testJWT(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setupTenants configures the tenants "acme", sharing the buckets under a
+// prefix, and "globex", with its own buckets
+func setupTenants(t *testing.T, supabase *processortest.Supabase) {
+	t.Helper()
+	config, _ := json.Marshal(map[string]interface{}{
+		"acme":   map[string]string{"supabase_url": supabase.URL, "service_role_key": processortest.ServiceKey, "path_prefix": "acme/", "api_key": "acme-key"},
+		"globex": map[string]string{"supabase_url": supabase.URL, "service_role_key": processortest.ServiceKey, "epub_bucket": "globex-epubs", "manifest_bucket": "globex-manifests", "jwt_secret": "globex-secret"},
+	})
+	t.Setenv(tenantsConfigEnvVar, string(config))
+	t.Setenv(tenantClaimEnvVar, "")
+}
+
+func TestParseTenants(t *testing.T) {
+	if tenants, err := parseTenants(""); tenants != nil || err != nil {
+		t.Errorf("Expected no tenants by default, got %v, %v", tenants, err)
+	}
+	for _, invalid := range []string{
+		`{`,
+		`{}`,
+		`{"acme": {"supabase_url": "https://acme.supabase.co", "api_key": "k"}}`,
+		`{"acme": {"supabase_url": "https://acme.supabase.co", "service_role_key": "s"}}`,
+		`{"acme": {"supabase_url": "https://acme.supabase.co", "service_role_key": "s", "api_key": "k", "path_prefix": "acme"}}`,
+		`{"acme": {"supabase_url": "https://acme.supabase.co", "service_role_key": "s", "api_key": "k", "path_prefix": "../acme/"}}`,
+		`{"acme": {"supabase_url": "https://acme.supabase.co", "service_role_key": "s", "api_key": "k", "s3": {"access_key_id": "a"}}}`,
+	} {
+		if _, err := parseTenants(invalid); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestTenantFor(t *testing.T) {
+	supabase := setupTestEnv(t)
+	setupTenants(t, supabase)
+	request := func(headers map[string]string) events.LambdaFunctionURLRequest {
+		return events.LambdaFunctionURLRequest{Headers: headers}
+	}
+
+	if tenant, err := tenantFor(request(map[string]string{"x-tenant-id": "acme", "x-api-key": "acme-key"})); err != nil || tenant.id() != "acme" {
+		t.Errorf("Expected acme by API key, got %v, %v", tenant, err)
+	}
+	token := testJWT(t, "globex-secret", map[string]interface{}{"tenant_id": "globex", "exp": time.Now().Add(time.Hour).Unix()})
+	if tenant, err := tenantFor(request(map[string]string{"Authorization": "Bearer " + token})); err != nil || tenant.id() != "globex" {
+		t.Errorf("Expected globex by JWT, got %v, %v", tenant, err)
+	}
+
+	for name, headers := range map[string]map[string]string{
+		"no credentials":     {},
+		"wrong API key":      {"X-Tenant-ID": "acme", "X-Api-Key": "globex-key"},
+		"tenant without key": {"X-Tenant-ID": "globex", "X-Api-Key": ""},
+		"forged JWT":         {"Authorization": "Bearer " + testJWT(t, "acme-key", map[string]interface{}{"tenant_id": "globex"})},
+		"expired JWT":        {"Authorization": "Bearer " + testJWT(t, "globex-secret", map[string]interface{}{"tenant_id": "globex", "exp": time.Now().Add(-time.Minute).Unix()})},
+		"unknown tenant":     {"Authorization": "Bearer " + testJWT(t, "globex-secret", map[string]interface{}{"tenant_id": "initech"})},
+	} {
+		if _, err := tenantFor(request(headers)); processor.StatusCode(err) != 401 {
+			t.Errorf("%s: expected 401, got %v", name, err)
+		}
+	}
+
+	t.Setenv(tenantsConfigEnvVar, "")
+	if tenant, err := tenantFor(request(nil)); tenant != nil || err != nil {
+		t.Errorf("Expected no tenant for a single-tenant deployment, got %v, %v", tenant, err)
+	}
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	supabase := setupTestEnv(t)
+	setupTenants(t, supabase)
+	supabase.Put(processor.EPUBBucket, "acme/books/moby-dick.epub", testEPUBBytes(t))
+	supabase.Put("globex-epubs", "books/moby-dick.epub", testEPUBBytes(t))
+
+	request := postRequest(map[string]interface{}{"filename": "books/moby-dick.epub", "validate_only": true})
+	response, err := handler(context.Background(), request)
+	if err != nil || response.StatusCode != 401 {
+		t.Fatalf("Expected 401 without credentials, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	request.Headers["X-Tenant-ID"] = "acme"
+	request.Headers["X-Api-Key"] = "acme-key"
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 {
+		t.Errorf("Expected acme to read its EPUB under its prefix, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	delete(request.Headers, "X-Tenant-ID")
+	delete(request.Headers, "X-Api-Key")
+	request.Headers["Authorization"] = "Bearer " + testJWT(t, "globex-secret", map[string]interface{}{"tenant_id": "globex"})
+	if response, _ := handler(context.Background(), request); response.StatusCode != 200 {
+		t.Errorf("Expected globex to read its EPUB from its bucket, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	supabase.Put(processor.EPUBBucket, "books/leviathan.epub", testEPUBBytes(t))
+	other := postRequest(map[string]interface{}{"filename": "books/leviathan.epub", "validate_only": true})
+	other.Headers["Authorization"] = request.Headers["Authorization"]
+	if response, _ := handler(context.Background(), other); response.StatusCode == 200 {
+		t.Errorf("Expected globex not to read the default bucket, got %s", response.Body)
+	}
+}
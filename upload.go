@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// Multipart form fields of a direct upload
+const (
+	uploadFileField    = "file"
+	uploadOptionsField = "options"
+)
+
+// parseProcessRequest reads the processing options from the request, and the EPUB
+// itself when the caller sent it inline instead of naming a file in the epubs
+// bucket. Three forms carry an EPUB:
+//   - multipart/form-data with the EPUB in the "file" part and the JSON options
+//     in an optional "options" part
+//   - an application/epub+zip (or application/octet-stream) body, with the
+//     filename in the query string
+//   - a JSON body with the base64-encoded EPUB in "epub_base64"
+//
+// The returned source is nil when the EPUB has to be downloaded. An uploaded EPUB
+// without a filename is named after its hash.
+func parseProcessRequest(request events.LambdaFunctionURLRequest, maxBytes int64) (ProcessRequest, *processor.Source, error) {
+	var processRequest ProcessRequest
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return processRequest, nil, processor.WithStatus(400, fmt.Errorf("invalid base64 request body: %w", err))
+		}
+		body = decoded
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(requestHeader(request, "Content-Type"))
+	var source *processor.Source
+	var err error
+	switch mediaType {
+	case "multipart/form-data":
+		source, err = parseMultipartUpload(body, params["boundary"], maxBytes, &processRequest)
+	case "application/epub+zip", "application/octet-stream":
+		processRequest.Filename = request.QueryStringParameters["filename"]
+		if len(body) > 0 {
+			source, err = spoolUpload(bytes.NewReader(body), maxBytes)
+		}
+	default:
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &processRequest); err != nil {
+				log.Printf("Ignoring unparseable request body: %v", err)
+			}
+		}
+		if processRequest.EPUBBase64 != "" {
+			source, err = spoolUpload(base64.NewDecoder(base64.StdEncoding, strings.NewReader(processRequest.EPUBBase64)), maxBytes)
+			processRequest.EPUBBase64 = ""
+		}
+	}
+	if err != nil {
+		return processRequest, nil, err
+	}
+
+	if source == nil {
+		return processRequest, nil, nil
+	}
+	if _, err := source.CheckFormat(processRequest.Filename); err != nil {
+		source.Close()
+		return processRequest, nil, err
+	}
+	if processRequest.Filename == "" {
+		processRequest.Filename = fmt.Sprintf("uploads/%s.epub", source.Hash()[:16])
+	}
+	return processRequest, source, nil
+}
+
+// parseMultipartUpload reads the options and EPUB parts of a multipart body
+func parseMultipartUpload(body []byte, boundary string, maxBytes int64, processRequest *ProcessRequest) (*processor.Source, error) {
+	if boundary == "" {
+		return nil, processor.WithStatus(400, errors.New("multipart body without boundary"))
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var source *processor.Source
+	var uploadName string
+	fail := func(err error) (*processor.Source, error) {
+		if source != nil {
+			source.Close()
+		}
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(processor.WithStatus(400, fmt.Errorf("invalid multipart body: %w", err)))
+		}
+		switch part.FormName() {
+		case uploadOptionsField:
+			if err := json.NewDecoder(part).Decode(processRequest); err != nil {
+				return fail(processor.WithStatus(400, fmt.Errorf("invalid options: %w", err)))
+			}
+		case uploadFileField:
+			if source != nil {
+				return fail(processor.WithStatus(400, errors.New("more than one file in multipart body")))
+			}
+			if source, err = spoolUpload(part, maxBytes); err != nil {
+				return nil, err
+			}
+			uploadName = part.FileName()
+		}
+	}
+	if source == nil {
+		return nil, processor.WithStatus(400, fmt.Errorf("multipart body has no %q part", uploadFileField))
+	}
+	if processRequest.Filename == "" {
+		processRequest.Filename = uploadName
+	}
+	return source, nil
+}
+
+// spoolUpload spools an uploaded EPUB to disk. Its format is checked once the
+// filename is known.
+func spoolUpload(r io.Reader, maxBytes int64) (*processor.Source, error) {
+	source, err := processor.SpoolEPUB(r, maxBytes)
+	if err != nil {
+		// Keep the status of errors that already carry one, like oversized uploads
+		if processor.StatusCode(err) != 500 {
+			return nil, err
+		}
+		return nil, processor.WithStatus(400, fmt.Errorf("failed to read uploaded EPUB: %w", err))
+	}
+	return source, nil
+}
+
+// requestHeader looks up a header case-insensitively; Function URLs lower-case
+// header names but other event sources may not
+func requestHeader(request events.LambdaFunctionURLRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"mime/multipart"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// testEPUBFiles are the entries of the EPUB returned by testEPUBBytes, after
+// its mimetype
+var testEPUBFiles = []struct{ name, body string }{
+	{"META-INF/container.xml", `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`},
+	{"OEBPS/content.opf", `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">urn:isbn:9780142437247</dc:identifier>
+    <dc:title>Moby-Dick</dc:title>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="ch1" href="chapter1.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine><itemref idref="ch1"/></spine>
+</package>`},
+	{"OEBPS/nav.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops"><body>
+<nav epub:type="toc"><ol><li><a href="chapter1.xhtml">Loomings</a></li></ol></nav>
+</body></html>`},
+	{"OEBPS/chapter1.xhtml", `<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Loomings</title></head><body><p>Call me Ishmael.</p></body></html>`},
+}
+
+// testEPUBBytes returns a minimal EPUB archive to upload: one chapter and its
+// navigation document
+func testEPUBBytes(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("Failed to create entry: %v", err)
+	}
+	w.Write([]byte("application/epub+zip"))
+	for _, file := range testEPUBFiles {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatalf("Failed to create entry: %v", err)
+		}
+		w.Write([]byte(file.body))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseProcessRequest_Multipart(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	options, _ := writer.CreateFormField(uploadOptionsField)
+	options.Write([]byte(`{"validate": true}`))
+	file, _ := writer.CreateFormFile(uploadFileField, "moby-dick.epub")
+	file.Write(testEPUBBytes(t))
+	writer.Close()
+
+	request := events.LambdaFunctionURLRequest{
+		Headers:         map[string]string{"content-type": writer.FormDataContentType()},
+		Body:            base64.StdEncoding.EncodeToString(body.Bytes()),
+		IsBase64Encoded: true,
+	}
+	processRequest, source, err := parseProcessRequest(request, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer source.Close()
+	if processRequest.Filename != "moby-dick.epub" || !processRequest.Validate {
+		t.Errorf("Expected options and the uploaded filename, got %+v", processRequest)
+	}
+	if !source.HasZIPSignature() {
+		t.Error("Expected the uploaded EPUB to be spooled")
+	}
+}
+
+func TestParseProcessRequest_RawBody(t *testing.T) {
+	request := events.LambdaFunctionURLRequest{
+		Headers:               map[string]string{"Content-Type": "application/epub+zip"},
+		QueryStringParameters: map[string]string{"filename": "books/raw.epub"},
+		Body:                  base64.StdEncoding.EncodeToString(testEPUBBytes(t)),
+		IsBase64Encoded:       true,
+	}
+	processRequest, source, err := parseProcessRequest(request, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer source.Close()
+	if processRequest.Filename != "books/raw.epub" {
+		t.Errorf("Expected filename from the query string, got %q", processRequest.Filename)
+	}
+}
+
+func TestParseProcessRequest_JSON(t *testing.T) {
+	body, _ := json.Marshal(map[string]string{"epub_base64": base64.StdEncoding.EncodeToString(testEPUBBytes(t))})
+	processRequest, source, err := parseProcessRequest(events.LambdaFunctionURLRequest{Body: string(body)}, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer source.Close()
+	if processRequest.Filename != "uploads/"+source.Hash()[:16]+".epub" {
+		t.Errorf("Expected a filename derived from the hash, got %q", processRequest.Filename)
+	}
+	if processRequest.EPUBBase64 != "" {
+		t.Error("Expected the inline EPUB to be dropped from the options")
+	}
+
+	processRequest, source, err = parseProcessRequest(events.LambdaFunctionURLRequest{Body: `{"filename": "books/a.epub"}`}, 0)
+	if err != nil || source != nil || processRequest.Filename != "books/a.epub" {
+		t.Errorf("Expected a plain request to need a download, got %+v, %v, %v", processRequest, source, err)
+	}
+}
+
+func TestParseProcessRequest_Rejects(t *testing.T) {
+	tests := map[string]events.LambdaFunctionURLRequest{
+		"not a ZIP": {Body: `{"epub_base64": "` + base64.StdEncoding.EncodeToString([]byte("hello")) + `"}`},
+		"too large": {Body: `{"epub_base64": "` + base64.StdEncoding.EncodeToString(testEPUBBytes(t)) + `"}`},
+		"no file part": {
+			Headers: map[string]string{"Content-Type": "multipart/form-data; boundary=xyz"},
+			Body:    "--xyz\r\nContent-Disposition: form-data; name=\"options\"\r\n\r\n{}\r\n--xyz--\r\n",
+		},
+	}
+	for name, request := range tests {
+		maxBytes := int64(0)
+		if name == "too large" {
+			maxBytes = 8
+		}
+		_, source, err := parseProcessRequest(request, maxBytes)
+		if err == nil {
+			source.Close()
+			t.Errorf("%s: expected an error", name)
+			continue
+		}
+		expected := 400
+		switch name {
+		case "too large":
+			expected = 413
+		case "not a ZIP":
+			expected = 415
+		}
+		if status := processor.StatusCode(err); status != expected {
+			t.Errorf("%s: expected status %d, got %d (%v)", name, expected, status, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+// publicationUsage is the storage used by a processed publication
+type publicationUsage struct {
+	BasePath   string                     `json:"base_path"`
+	Files      int                        `json:"files"`
+	Bytes      int64                      `json:"bytes"`
+	MediaTypes map[string]*mediaTypeUsage `json:"media_types"`
+
+	paths []string
+}
+
+// mediaTypeUsage is the storage used by the files of one media type
+type mediaTypeUsage struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// add counts an object against the publication
+func (p *publicationUsage) add(object processor.ObjectInfo) {
+	p.Files++
+	p.Bytes += object.Size
+	p.paths = append(p.paths, object.Path)
+	addMediaType(p.MediaTypes, object)
+}
+
+// addMediaType counts an object against its media type, without parameters
+// such as charset
+func addMediaType(usage map[string]*mediaTypeUsage, object processor.ObjectInfo) {
+	mediaType, _, err := mime.ParseMediaType(object.ContentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	if usage[mediaType] == nil {
+		usage[mediaType] = &mediaTypeUsage{}
+	}
+	usage[mediaType].Files++
+	usage[mediaType].Bytes += object.Size
+}
+
+// handleUsage reports the storage used by processed publications, to attribute
+// storage costs per book or per user:
+//
+//	GET /admin/usage?filename=books/moby-dick.epub  the publication of an EPUB
+//	GET /admin/usage?prefix=user-123                publications under a folder
+//	GET /admin/usage                                every publication
+func handleUsage(ctx context.Context, store *processor.Supabase, query map[string]string) events.LambdaFunctionURLResponse {
+	filename, prefix := query["filename"], query["prefix"]
+	if filename != "" && prefix != "" {
+		return createErrorResponse(400, "Pass either filename or prefix, not both")
+	}
+
+	var publications map[string]*publicationUsage
+	if filename != "" {
+		// The publication may have been processed under either storage layout
+		publications = map[string]*publicationUsage{}
+		for _, basePath := range processor.BasePaths(filename) {
+			found, err := publicationsUnder(store, basePath)
+			if err != nil {
+				log.Printf("Error computing storage usage of %s: %v", filename, err)
+				return createErrorResponse(500, fmt.Sprintf("Failed to compute storage usage: %v", err))
+			}
+			if publication, ok := found[basePath]; ok {
+				publications[basePath] = publication
+			}
+		}
+		if len(publications) == 0 {
+			return createErrorResponse(404, fmt.Sprintf("No processed publication found for %s", filename))
+		}
+	} else {
+		var err error
+		publications, err = publicationsUnder(store, prefix)
+		if err != nil {
+			log.Printf("Error computing storage usage under %q: %v", prefix, err)
+			return createErrorResponse(500, fmt.Sprintf("Failed to compute storage usage: %v", err))
+		}
+	}
+
+	basePaths := make([]string, 0, len(publications))
+	for basePath := range publications {
+		basePaths = append(basePaths, basePath)
+	}
+	sort.Strings(basePaths)
+
+	total := publicationUsage{MediaTypes: map[string]*mediaTypeUsage{}}
+	report := make([]*publicationUsage, 0, len(basePaths))
+	for _, basePath := range basePaths {
+		publication := publications[basePath]
+		report = append(report, publication)
+		total.Files += publication.Files
+		total.Bytes += publication.Bytes
+		for mediaType, usage := range publication.MediaTypes {
+			if total.MediaTypes[mediaType] == nil {
+				total.MediaTypes[mediaType] = &mediaTypeUsage{}
+			}
+			total.MediaTypes[mediaType].Files += usage.Files
+			total.MediaTypes[mediaType].Bytes += usage.Bytes
+		}
+	}
+
+	return createSuccessResponse(fmt.Sprintf("Storage usage of %d publications", len(report)), map[string]interface{}{
+		"publications": report,
+		"files":        total.Files,
+		"bytes":        total.Bytes,
+		"media_types":  total.MediaTypes,
+	})
+}
+
+// publicationsUnder lists the manifest bucket under prefix, grouped by publication
+func publicationsUnder(store *processor.Supabase, prefix string) (map[string]*publicationUsage, error) {
+	objects, err := store.List(processor.ManifestBucket, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", processor.ManifestBucket, err)
+	}
+	return groupByPublication(objects), nil
+}
+
+// groupByPublication assigns each object to the publication whose base path
+// contains it. Publications are found by their index; with the preserve layout
+// they can nest, so objects go to the longest matching base path. Objects
+// outside any publication are left out.
+func groupByPublication(objects []processor.ObjectInfo) map[string]*publicationUsage {
+	publications := map[string]*publicationUsage{}
+	for _, object := range objects {
+		if basePath, ok := strings.CutSuffix(object.Path, "/"+processor.IndexPath); ok {
+			publications[basePath] = &publicationUsage{BasePath: basePath, MediaTypes: map[string]*mediaTypeUsage{}}
+		}
+	}
+	for _, object := range objects {
+		for dir := object.Path; strings.Contains(dir, "/"); {
+			dir = dir[:strings.LastIndex(dir, "/")]
+			if publication, ok := publications[dir]; ok {
+				publication.add(object)
+				break
+			}
+		}
+	}
+	return publications
+}
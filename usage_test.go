@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"readium-processor-lambda/pkg/processor"
+)
+
+func TestHandler_Usage(t *testing.T) {
+	supabase := setupTestEnv(t)
+	t.Setenv(adminTokenEnvVar, "secret")
+	for path, data := range map[string]string{
+		"user-1/moby-dick.epub/manifest.json":          "{}",
+		"user-1/moby-dick.epub/" + processor.IndexPath: "{}",
+		"user-1/moby-dick.epub/OEBPS/chapter1.xhtml":   "chapter one",
+		"user-1/moby-dick.epub/OEBPS/chapter2.xhtml":   "chapter two",
+		"user-1/moby-dick.epub/OEBPS/cover.jpg":        "jpeg",
+		"user-2/walden.epub/manifest.json":             "{}",
+		"user-2/walden.epub/" + processor.IndexPath:    "{}",
+		"user-2/walden.epub/OEBPS/walden.xhtml":        "walden",
+		"user-2/stray.txt":                             "not a publication",
+		"books_flat/manifest.json":                     "{}",
+		"books_flat/" + processor.IndexPath:            "{}",
+	} {
+		supabase.Put(processor.ManifestBucket, path, []byte(data))
+	}
+
+	type report struct {
+		Publications []publicationUsage         `json:"publications"`
+		Files        int                        `json:"files"`
+		Bytes        int64                      `json:"bytes"`
+		MediaTypes   map[string]*mediaTypeUsage `json:"media_types"`
+	}
+	usage := func(path string, query map[string]string) (int, report) {
+		request := adminRequest("GET", path, "secret")
+		request.QueryStringParameters = query
+		response, _ := handler(context.Background(), request)
+		var body struct {
+			Data report `json:"data"`
+		}
+		json.Unmarshal([]byte(response.Body), &body)
+		return response.StatusCode, body.Data
+	}
+
+	status, all := usage("/admin/usage", nil)
+	if status != 200 || len(all.Publications) != 3 || all.Files != 10 {
+		t.Fatalf("Expected 3 publications and 10 files, got %d: %+v", status, all)
+	}
+
+	status, book := usage("/admin/usage", map[string]string{"filename": "user-1/moby-dick.epub"})
+	if status != 200 || len(book.Publications) != 1 {
+		t.Fatalf("Expected the publication of the EPUB, got %d: %+v", status, book)
+	}
+	publication := book.Publications[0]
+	if publication.BasePath != "user-1/moby-dick.epub" || publication.Files != 5 || publication.Bytes != 30 {
+		t.Errorf("Expected 5 files and 30 bytes, got %+v", publication)
+	}
+	if xhtml := publication.MediaTypes["application/xhtml+xml"]; xhtml == nil || xhtml.Files != 2 || xhtml.Bytes != 22 {
+		t.Errorf("Expected 2 XHTML files of 22 bytes, got %+v", xhtml)
+	}
+	if jpeg := publication.MediaTypes["image/jpeg"]; jpeg == nil || jpeg.Files != 1 {
+		t.Errorf("Expected a JPEG file, got %+v", jpeg)
+	}
+
+	status, user := usage("/admin/usage", map[string]string{"prefix": "user-2"})
+	if status != 200 || len(user.Publications) != 1 || user.Files != 3 || user.Bytes != 10 {
+		t.Errorf("Expected walden only, without the stray file, got %d: %+v", status, user)
+	}
+
+	if status, _ := usage("/admin/usage", map[string]string{"filename": "missing.epub"}); status != 404 {
+		t.Errorf("Expected 404 for an unprocessed EPUB, got %d", status)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+// lambdaFunctionNameEnvVar is set by the Lambda runtime, and nowhere else
+const lambdaFunctionNameEnvVar = "AWS_LAMBDA_FUNCTION_NAME"
+
+// envCache holds what is built from env vars for the lifetime of the execution
+// environment, so warm invocations (and every invocation under provisioned
+// concurrency) reuse the clients of the first one and their open connections
+var envCache = struct {
+	sync.Mutex
+	entries map[string]envCacheEntry
+}{entries: map[string]envCacheEntry{}}
+
+// envCacheEntry is a cached value and the env var values it was built from
+type envCacheEntry struct {
+	env   string
+	value any
+}
+
+// cachedFromEnv returns the value cached under name, calling build when there is
+// none yet. The value is built again if any of envVars changed since, which in
+// Lambda never happens but keeps --serve and the tests honest.
+func cachedFromEnv[T any](name string, envVars []string, build func() T) T {
+	values := make([]string, len(envVars))
+	for i, envVar := range envVars {
+		values[i] = os.Getenv(envVar)
+	}
+	env := strings.Join(values, "\x00")
+
+	envCache.Lock()
+	defer envCache.Unlock()
+	if entry, ok := envCache.entries[name]; ok && entry.env == env {
+		return entry.value.(T)
+	}
+	value := build()
+	envCache.entries[name] = envCacheEntry{env: env, value: value}
+	return value
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestCachedFromEnvReusesValueUntilEnvChanges(t *testing.T) {
+	t.Setenv("WARM_TEST_VALUE", "a")
+	builds := 0
+	build := func() *int {
+		builds++
+		n := builds
+		return &n
+	}
+
+	first := cachedFromEnv("warm-test", []string{"WARM_TEST_VALUE"}, build)
+	second := cachedFromEnv("warm-test", []string{"WARM_TEST_VALUE"}, build)
+	if first != second || builds != 1 {
+		t.Errorf("Expected the value to be built once and reused, got %d builds", builds)
+	}
+
+	t.Setenv("WARM_TEST_VALUE", "b")
+	third := cachedFromEnv("warm-test", []string{"WARM_TEST_VALUE"}, build)
+	if third == first || builds != 2 {
+		t.Errorf("Expected the value to be rebuilt after the env changed, got %d builds", builds)
+	}
+}
+
+func TestJobStoreIsReusedAcrossInvocations(t *testing.T) {
+	t.Setenv(jobsTableEnvVar, "jobs")
+	if newJobStoreFromEnv() != newJobStoreFromEnv() {
+		t.Errorf("Expected the same job store for every invocation")
+	}
+}